@@ -0,0 +1,538 @@
+// Package acme obtains TLS certificates from an ACME certificate authority (RFC 8555), e.g. Let's Encrypt.
+// The domain ownership is proven with HTTP-01 challenge (the response is served by our web server)
+// or DNS-01 challenge (TXT record is created by a DNS provider).
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/logging"
+)
+
+var log = logging.New("acme")
+
+// LetsEncryptURL is the directory URL of Let's Encrypt production environment
+const LetsEncryptURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+const (
+	maxResponseSize = 1024 * 1024
+	pollInterval    = 2 * time.Second // the default interval between the status requests
+	maxPollInterval = 30 * time.Second
+)
+
+// Client talks to ACME server
+// The account key is an ECDSA P-256 key.
+type Client struct {
+	DirectoryURL string
+	Key          *ecdsa.PrivateKey
+	HTTPClient   *http.Client // nil: the default client
+
+	dir   directory
+	kid   string // the account URL
+	nonce string
+	lock  sync.Mutex
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// Problem is the error returned by ACME server
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string       `json:"status"`
+	Identifiers    []identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *Problem     `json:"error"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Wildcard   bool        `json:"wildcard"`
+	Challenges []challenge `json:"challenges"`
+}
+
+// GenerateKey creates a new ECDSA P-256 key for the account or the certificate
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// MarshalKey encodes the key in PEM format
+func MarshalKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParseKey decodes the key in PEM format
+func ParseKey(data []byte) (*ecdsa.PrivateKey, error) {
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return nil, errors.New("acme: no PEM data in the key")
+	}
+	return x509.ParseECPrivateKey(b.Bytes)
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Get the JSON Web Key of the account key
+func (c *Client) jwk() map[string]string {
+	size := (c.Key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"crv": c.Key.Curve.Params().Name,
+		"kty": "EC",
+		"x":   b64(padBytes(c.Key.X.Bytes(), size)),
+		"y":   b64(padBytes(c.Key.Y.Bytes(), size)),
+	}
+}
+
+// Add the leading zeros to the number
+func padBytes(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
+
+// Thumbprint returns the thumbprint of the account key (RFC 7638)
+func (c *Client) Thumbprint() string {
+	jwk := c.jwk()
+	// the members must be in lexicographic order without whitespace
+	data := fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk["crv"], jwk["x"], jwk["y"])
+	sum := sha256.Sum256([]byte(data))
+	return b64(sum[:])
+}
+
+// KeyAuthorization returns the response to the challenge with the token
+func (c *Client) KeyAuthorization(token string) string {
+	return token + "." + c.Thumbprint()
+}
+
+// Create JWS object signed by the account key
+// payload: nil for POST-as-GET request
+func (c *Client) signJWS(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if len(c.kid) != 0 {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	phdr, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	body := ""
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = b64(data)
+	}
+
+	signed := b64(phdr) + "." + body
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.Key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+
+	return json.Marshal(map[string]string{
+		"protected": b64(phdr),
+		"payload":   body,
+		"signature": b64(sig),
+	})
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Get the problem document from the error response
+func responseError(resp *http.Response, body []byte) error {
+	p := &Problem{}
+	if json.Unmarshal(body, p) != nil || len(p.Type) == 0 {
+		return fmt.Errorf("acme: %s: HTTP status %d", resp.Request.URL, resp.StatusCode)
+	}
+	return p
+}
+
+// Get the directory of the ACME server
+func (c *Client) discover(ctx context.Context) error {
+	if len(c.dir.NewOrder) != 0 {
+		return nil
+	}
+	req, err := http.NewRequest("GET", c.DirectoryURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, body)
+	}
+	err = json.Unmarshal(body, &c.dir)
+	if err != nil {
+		return fmt.Errorf("acme: invalid directory: %s", err)
+	}
+	if len(c.dir.NewNonce) == 0 || len(c.dir.NewAccount) == 0 || len(c.dir.NewOrder) == 0 {
+		return errors.New("acme: invalid directory")
+	}
+	return nil
+}
+
+// Get a fresh nonce
+func (c *Client) fetchNonce(ctx context.Context) (string, error) {
+	req, err := http.NewRequest("HEAD", c.dir.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if len(nonce) == 0 {
+		return "", errors.New("acme: no nonce")
+	}
+	return nonce, nil
+}
+
+// Send the signed request
+// The request with a stale nonce is repeated once with a fresh one.
+func (c *Client) post(ctx context.Context, url string, payload interface{}) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		nonce := c.nonce
+		c.nonce = ""
+		if len(nonce) == 0 {
+			var err error
+			nonce, err = c.fetchNonce(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		data, err := c.signJWS(url, nonce, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		resp, err := c.httpClient().Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		c.nonce = resp.Header.Get("Replay-Nonce")
+
+		if resp.StatusCode/100 == 2 {
+			return resp, body, nil
+		}
+		err = responseError(resp, body)
+		p, ok := err.(*Problem)
+		if ok && p.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+			log.Debug("ACME: %s: the nonce is rejected, repeating the request", url)
+			continue
+		}
+		return nil, nil, err
+	}
+}
+
+// Send POST-as-GET request and parse the response
+func (c *Client) fetch(ctx context.Context, url string, v interface{}) (*http.Response, error) {
+	resp, body, err := c.post(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return nil, fmt.Errorf("acme: %s: %s", url, err)
+	}
+	return resp, nil
+}
+
+// Register creates the account or finds the existing one for this key
+// The terms of service of the certificate authority are agreed to.
+func (c *Client) Register(ctx context.Context, email string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.register(ctx, email)
+}
+
+func (c *Client) register(ctx context.Context, email string) error {
+	err := c.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if len(c.kid) != 0 {
+		return nil
+	}
+
+	req := map[string]interface{}{"termsOfServiceAgreed": true}
+	if len(email) != 0 {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err := c.post(ctx, c.dir.NewAccount, req)
+	if err != nil {
+		return err
+	}
+	c.kid = resp.Header.Get("Location")
+	if len(c.kid) == 0 {
+		return errors.New("acme: no account URL")
+	}
+	log.Info("ACME: registered the account %s", c.kid)
+	return nil
+}
+
+// Wait for the time the server asks for, or for the default interval
+func wait(ctx context.Context, resp *http.Response) error {
+	d := pollInterval
+	sec, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err == nil && sec > 0 {
+		d = time.Duration(sec) * time.Second
+		if d > maxPollInterval {
+			d = maxPollInterval
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Prove the ownership of the domain
+func (c *Client) authorize(ctx context.Context, url string, solver Solver) error {
+	authz := authorization{}
+	_, err := c.fetch(ctx, url, &authz)
+	if err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var chal *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == solver.Type() {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: %s: %s challenge isn't offered", authz.Identifier.Value, solver.Type())
+	}
+
+	domain := authz.Identifier.Value
+	keyAuth := c.KeyAuthorization(chal.Token)
+	log.Debug("ACME: %s: responding to %s challenge", domain, solver.Type())
+	err = solver.Present(ctx, domain, chal.Token, keyAuth)
+	if err != nil {
+		return fmt.Errorf("acme: %s: %s", domain, err)
+	}
+	defer solver.CleanUp(domain, chal.Token, keyAuth)
+
+	// tell the server the response is ready
+	_, _, err = c.post(ctx, chal.URL, struct{}{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := c.fetch(ctx, url, &authz)
+		if err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			log.Info("ACME: %s: the domain is authorized", domain)
+			return nil
+		case "pending", "processing":
+		default:
+			for _, ch := range authz.Challenges {
+				if ch.Error != nil {
+					return fmt.Errorf("acme: %s: %s", domain, ch.Error.Detail)
+				}
+			}
+			return fmt.Errorf("acme: %s: authorization is %s", domain, authz.Status)
+		}
+		err = wait(ctx, resp)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Create the certificate signing request
+func createCSR(key crypto.Signer, domains []string) ([]byte, error) {
+	tmpl := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}
+	return x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+}
+
+// Obtain gets the certificate for the domains
+// Returns the PEM-encoded certificates chain and private key.
+func (c *Client) Obtain(ctx context.Context, email string, domains []string, solver Solver) ([]byte, []byte, error) {
+	if len(domains) == 0 {
+		return nil, nil, errors.New("acme: no domains")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.register(ctx, email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req := struct {
+		Identifiers []identifier `json:"identifiers"`
+	}{}
+	for _, d := range domains {
+		req.Identifiers = append(req.Identifiers, identifier{Type: "dns", Value: d})
+	}
+	resp, body, err := c.post(ctx, c.dir.NewOrder, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	o := order{}
+	err = json.Unmarshal(body, &o)
+	if err != nil || len(orderURL) == 0 {
+		return nil, nil, errors.New("acme: invalid order")
+	}
+
+	for _, url := range o.Authorizations {
+		err = c.authorize(ctx, url, solver)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := createCSR(key, domains)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, body, err = c.post(ctx, o.Finalize, map[string]string{"csr": b64(csr)})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = json.Unmarshal(body, &o)
+	if err != nil {
+		return nil, nil, errors.New("acme: invalid order")
+	}
+
+	for o.Status != "valid" {
+		if o.Status != "processing" && o.Status != "pending" && o.Status != "ready" {
+			if o.Error != nil {
+				return nil, nil, o.Error
+			}
+			return nil, nil, fmt.Errorf("acme: order is %s", o.Status)
+		}
+		err = wait(ctx, resp)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err = c.fetch(ctx, orderURL, &o)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	_, chain, err := c.post(ctx, o.Certificate, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, _ := pem.Decode(chain)
+	if b == nil || b.Type != "CERTIFICATE" {
+		return nil, nil, errors.New("acme: invalid certificate")
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: invalid certificate: %s", err)
+	}
+	log.Info("ACME: the certificate for %v is issued, valid until %s", domains, cert.NotAfter.Format(time.RFC3339))
+	keyPEM, err := MarshalKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, keyPEM, nil
+}
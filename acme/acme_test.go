@@ -0,0 +1,276 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64decode(t *testing.T, s string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatalf("base64: %s", err)
+	}
+	return data
+}
+
+// Fake certificate authority
+// The HTTP-01 response is checked by calling the solver directly.
+type fakeCA struct {
+	t          *testing.T
+	srv        *httptest.Server
+	solver     *HTTP01Solver
+	thumbprint string
+	nonce      int
+	domain     string
+	token      string
+	validated  bool
+	cert       []byte // the issued certificate in PEM format
+}
+
+func (ca *fakeCA) url(path string) string {
+	return ca.srv.URL + path
+}
+
+// Parse the signed request and return the payload
+func (ca *fakeCA) parseJWS(r *http.Request) []byte {
+	t := ca.t
+	req := map[string]string{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		t.Fatalf("JWS: %s", err)
+	}
+	hdr := struct {
+		Alg   string            `json:"alg"`
+		Nonce string            `json:"nonce"`
+		URL   string            `json:"url"`
+		Kid   string            `json:"kid"`
+		JWK   map[string]string `json:"jwk"`
+	}{}
+	err = json.Unmarshal(b64decode(t, req["protected"]), &hdr)
+	if err != nil {
+		t.Fatalf("JWS header: %s", err)
+	}
+	if hdr.Alg != "ES256" || len(hdr.Nonce) == 0 || hdr.URL != ca.url(r.URL.Path) {
+		t.Fatalf("JWS header: %+v", hdr)
+	}
+	if hdr.JWK != nil {
+		data := fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, hdr.JWK["crv"], hdr.JWK["x"], hdr.JWK["y"])
+		sum := sha256.Sum256([]byte(data))
+		ca.thumbprint = b64(sum[:])
+	} else if hdr.Kid != ca.url("/account/1") {
+		t.Fatalf("JWS kid: %s", hdr.Kid)
+	}
+	if len(b64decode(t, req["signature"])) != 64 {
+		t.Fatalf("JWS signature")
+	}
+	return b64decode(t, req["payload"])
+}
+
+func (ca *fakeCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce%d", ca.nonce))
+	if r.URL.Path == "/directory" {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	payload := ca.parseJWS(r)
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", ca.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+
+	case "/order":
+		req := order{}
+		_ = json.Unmarshal(payload, &req)
+		ca.domain = req.Identifiers[0].Value
+		w.Header().Set("Location", ca.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(order{
+			Status:         "pending",
+			Authorizations: []string{ca.url("/authz/1")},
+			Finalize:       ca.url("/finalize/1"),
+		})
+
+	case "/authz/1":
+		status := "pending"
+		if ca.validated {
+			status = "valid"
+		}
+		_ = json.NewEncoder(w).Encode(authorization{
+			Status:     status,
+			Identifier: identifier{Type: "dns", Value: ca.domain},
+			Challenges: []challenge{
+				{Type: "dns-01", URL: ca.url("/chal/2"), Token: "dnstoken"},
+				{Type: "http-01", URL: ca.url("/chal/1"), Token: ca.token},
+			},
+		})
+
+	case "/chal/1":
+		rec := httptest.NewRecorder()
+		ca.solver.ServeHTTP(rec, httptest.NewRequest("GET", HTTP01Path+ca.token, nil))
+		if rec.Body.String() != ca.token+"."+ca.thumbprint {
+			ca.t.Fatalf("HTTP-01 response: %s", rec.Body.String())
+		}
+		ca.validated = true
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+
+	case "/finalize/1":
+		req := map[string]string{}
+		_ = json.Unmarshal(payload, &req)
+		csr, err := x509.ParseCertificateRequest(b64decode(ca.t, req["csr"]))
+		if err != nil || csr.CheckSignature() != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != ca.domain {
+			ca.t.Fatalf("CSR: %v", err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: ca.domain},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		key, _ := GenerateKey()
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, key)
+		if err != nil {
+			ca.t.Fatalf("CreateCertificate: %s", err)
+		}
+		ca.cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		_ = json.NewEncoder(w).Encode(order{Status: "valid", Certificate: ca.url("/cert/1")})
+
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(ca.cert)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestObtain(t *testing.T) {
+	ca := &fakeCA{t: t, solver: NewHTTP01Solver(), token: "httptoken"}
+	ca.srv = httptest.NewServer(ca)
+	defer ca.srv.Close()
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	data, _ := MarshalKey(key)
+	key2, err := ParseKey(data)
+	if err != nil || key2.X.Cmp(key.X) != 0 {
+		t.Fatalf("ParseKey: %s", err)
+	}
+
+	c := &Client{DirectoryURL: ca.url("/directory"), Key: key}
+	chain, keyPEM, err := c.Obtain(context.Background(), "admin@example.org", []string{"example.org"}, ca.solver)
+	if err != nil {
+		t.Fatalf("Obtain: %s", err)
+	}
+	if c.Thumbprint() != ca.thumbprint {
+		t.Fatalf("Thumbprint: %s != %s", c.Thumbprint(), ca.thumbprint)
+	}
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair: %s", err)
+	}
+	if len(cert.Certificate) != 1 {
+		t.Fatalf("the chain: %d", len(cert.Certificate))
+	}
+
+	// the response isn't served after the challenge
+	rec := httptest.NewRecorder()
+	ca.solver.ServeHTTP(rec, httptest.NewRequest("GET", HTTP01Path+ca.token, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("the response is still served: %d", rec.Code)
+	}
+}
+
+func TestProblem(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:unauthorized","detail":"no"}`))
+	}))
+	defer srv.Close()
+
+	key, _ := GenerateKey()
+	c := &Client{DirectoryURL: srv.URL, Key: key}
+	err := c.Register(context.Background(), "")
+	p, ok := err.(*Problem)
+	if !ok || p.Type != "urn:ietf:params:acme:error:unauthorized" {
+		t.Fatalf("Register: %v", err)
+	}
+}
+
+type testDNSProvider struct {
+	records map[string]string
+}
+
+func (p *testDNSProvider) Present(fqdn, value string) error {
+	p.records[fqdn] = value
+	return nil
+}
+
+func (p *testDNSProvider) CleanUp(fqdn, value string) error {
+	delete(p.records, fqdn)
+	return nil
+}
+
+func TestDNS01(t *testing.T) {
+	name, value := DNS01Record("*.example.org", "token.thumbprint")
+	sum := sha256.Sum256([]byte("token.thumbprint"))
+	if name != "_acme-challenge.example.org." || value != b64(sum[:]) {
+		t.Fatalf("DNS01Record: %s %s", name, value)
+	}
+
+	RegisterDNSProvider("test", func(settings map[string]string) (DNSProvider, error) {
+		return &testDNSProvider{records: map[string]string{}}, nil
+	})
+	if !strings.Contains(strings.Join(DNSProviders(), ","), "rfc2136") {
+		t.Fatalf("DNSProviders: %v", DNSProviders())
+	}
+	prov, err := NewDNSProvider("test", nil)
+	if err != nil {
+		t.Fatalf("NewDNSProvider: %s", err)
+	}
+	s := &DNS01Solver{Provider: prov}
+	err = s.Present(context.Background(), "example.org", "token", "token.thumbprint")
+	if err != nil || prov.(*testDNSProvider).records[name] != value {
+		t.Fatalf("Present: %v", err)
+	}
+	s.CleanUp("example.org", "token", "token.thumbprint")
+	if len(prov.(*testDNSProvider).records) != 0 {
+		t.Fatalf("CleanUp")
+	}
+
+	_, err = NewDNSProvider("unknown", nil)
+	if err == nil {
+		t.Fatalf("NewDNSProvider: unknown provider")
+	}
+	_, err = NewDNSProvider("rfc2136", map[string]string{"zone": "example.org"})
+	if err == nil {
+		t.Fatalf("NewDNSProvider: rfc2136 without nameserver")
+	}
+}
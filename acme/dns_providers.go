@@ -0,0 +1,171 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dnsProviderTimeout = time.Minute
+	dnsRecordTTL       = 60
+)
+
+// DNSProvider creates and removes TXT records for DNS-01 challenge
+// fqdn is the full record name with the trailing dot: "_acme-challenge.example.org."
+type DNSProvider interface {
+	Present(fqdn, value string) error
+	CleanUp(fqdn, value string) error
+}
+
+// DNSProviderFactory creates the provider from its settings
+type DNSProviderFactory func(settings map[string]string) (DNSProvider, error)
+
+var dnsProviders = struct {
+	list map[string]DNSProviderFactory
+	lock sync.Mutex
+}{list: map[string]DNSProviderFactory{
+	"exec":    newExecProvider,
+	"rfc2136": newRFC2136Provider,
+}}
+
+// RegisterDNSProvider adds the provider, so it can be selected by its name
+func RegisterDNSProvider(name string, f DNSProviderFactory) {
+	dnsProviders.lock.Lock()
+	dnsProviders.list[name] = f
+	dnsProviders.lock.Unlock()
+}
+
+// DNSProviders returns the names of the providers
+func DNSProviders() []string {
+	dnsProviders.lock.Lock()
+	defer dnsProviders.lock.Unlock()
+	names := []string{}
+	for name := range dnsProviders.list {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDNSProvider creates the provider by its name
+func NewDNSProvider(name string, settings map[string]string) (DNSProvider, error) {
+	dnsProviders.lock.Lock()
+	f, ok := dnsProviders.list[name]
+	dnsProviders.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown DNS provider: %s", name)
+	}
+	return f(settings)
+}
+
+// The program which manages the records, e.g. via the API of the DNS hosting.
+// It's called as "command present|cleanup FQDN VALUE".
+// settings: command
+type execProvider struct {
+	command string
+}
+
+func newExecProvider(settings map[string]string) (DNSProvider, error) {
+	command := settings["command"]
+	if len(command) == 0 {
+		return nil, fmt.Errorf("exec: command is required")
+	}
+	return &execProvider{command: command}, nil
+}
+
+func (p *execProvider) run(action, fqdn, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsProviderTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, p.command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (p *execProvider) Present(fqdn, value string) error {
+	return p.run("present", fqdn, value)
+}
+
+func (p *execProvider) CleanUp(fqdn, value string) error {
+	return p.run("cleanup", fqdn, value)
+}
+
+// Dynamic DNS update (RFC 2136) of the zone on the authoritative DNS server, e.g. BIND or Knot
+// settings: nameserver (host[:port]), zone, and optional TSIG key: tsig_key, tsig_secret (base64), tsig_algorithm
+type rfc2136Provider struct {
+	nameserver string
+	zone       string
+	tsigKey    string
+	tsigSecret string
+	tsigAlg    string
+}
+
+func newRFC2136Provider(settings map[string]string) (DNSProvider, error) {
+	p := &rfc2136Provider{
+		nameserver: settings["nameserver"],
+		zone:       dns.Fqdn(settings["zone"]),
+		tsigKey:    settings["tsig_key"],
+		tsigSecret: settings["tsig_secret"],
+		tsigAlg:    settings["tsig_algorithm"],
+	}
+	if len(p.nameserver) == 0 || p.zone == "." {
+		return nil, fmt.Errorf("rfc2136: nameserver and zone are required")
+	}
+	if _, _, err := net.SplitHostPort(p.nameserver); err != nil {
+		p.nameserver = net.JoinHostPort(p.nameserver, "53")
+	}
+	if len(p.tsigKey) != 0 {
+		p.tsigKey = dns.Fqdn(p.tsigKey)
+		if len(p.tsigAlg) == 0 {
+			p.tsigAlg = dns.HmacSHA256
+		}
+		p.tsigAlg = dns.Fqdn(p.tsigAlg)
+	}
+	return p, nil
+}
+
+// Send the update with the record
+func (p *rfc2136Provider) update(fqdn, value string, insert bool) error {
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: dnsRecordTTL},
+		Txt: []string{value},
+	}
+	m := &dns.Msg{}
+	m.SetUpdate(p.zone)
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+
+	c := &dns.Client{Net: "tcp", Timeout: dnsProviderTimeout}
+	if len(p.tsigKey) != 0 {
+		m.SetTsig(p.tsigKey, p.tsigAlg, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{p.tsigKey: p.tsigSecret}
+	}
+	resp, _, err := c.Exchange(m, p.nameserver)
+	if err != nil {
+		return fmt.Errorf("rfc2136: %s", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: the update is rejected: %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) Present(fqdn, value string) error {
+	return p.update(fqdn, value, true)
+}
+
+func (p *rfc2136Provider) CleanUp(fqdn, value string) error {
+	return p.update(fqdn, value, false)
+}
@@ -0,0 +1,113 @@
+package acme
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP01Path is the path prefix of HTTP-01 challenge responses
+const HTTP01Path = "/.well-known/acme-challenge/"
+
+// Solver proves the ownership of the domain
+type Solver interface {
+	// Type returns the challenge type: "http-01" or "dns-01"
+	Type() string
+	// Present makes the response available to the certificate authority
+	Present(ctx context.Context, domain, token, keyAuth string) error
+	// CleanUp removes the response
+	CleanUp(domain, token, keyAuth string)
+}
+
+// HTTP01Solver serves the challenge responses at http://<domain>/.well-known/acme-challenge/<token>
+// It must be registered as the handler of HTTP01Path on port 80.
+type HTTP01Solver struct {
+	tokens map[string]string // token -> key authorization
+	lock   sync.Mutex
+}
+
+// NewHTTP01Solver creates the solver
+func NewHTTP01Solver() *HTTP01Solver {
+	return &HTTP01Solver{tokens: map[string]string{}}
+}
+
+// Type returns "http-01"
+func (s *HTTP01Solver) Type() string {
+	return "http-01"
+}
+
+// Present starts serving the response
+func (s *HTTP01Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	s.lock.Lock()
+	s.tokens[token] = keyAuth
+	s.lock.Unlock()
+	return nil
+}
+
+// CleanUp stops serving the response
+func (s *HTTP01Solver) CleanUp(domain, token, keyAuth string) {
+	s.lock.Lock()
+	delete(s.tokens, token)
+	s.lock.Unlock()
+}
+
+// ServeHTTP responds to the certificate authority
+func (s *HTTP01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, HTTP01Path)
+	s.lock.Lock()
+	keyAuth, ok := s.tokens[token]
+	s.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(keyAuth))
+}
+
+// DNS01Solver creates TXT record _acme-challenge.<domain> via the DNS provider
+type DNS01Solver struct {
+	Provider DNSProvider
+
+	// The time the record needs to reach the authoritative DNS servers
+	PropagationDelay time.Duration
+}
+
+// DNS01Record returns the name and the value of TXT record for the challenge
+func DNS01Record(domain, keyAuth string) (string, string) {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.") + ".", b64(sum[:])
+}
+
+// Type returns "dns-01"
+func (s *DNS01Solver) Type() string {
+	return "dns-01"
+}
+
+// Present creates the record and waits until it's propagated
+func (s *DNS01Solver) Present(ctx context.Context, domain, token, keyAuth string) error {
+	name, value := DNS01Record(domain, keyAuth)
+	err := s.Provider.Present(name, value)
+	if err != nil {
+		return fmt.Errorf("couldn't create TXT record %s: %s", name, err)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(s.PropagationDelay):
+		return nil
+	}
+}
+
+// CleanUp removes the record
+func (s *DNS01Solver) CleanUp(domain, token, keyAuth string) {
+	name, value := DNS01Record(domain, keyAuth)
+	err := s.Provider.CleanUp(name, value)
+	if err != nil {
+		log.Error("ACME: couldn't remove TXT record %s: %s", name, err)
+	}
+}
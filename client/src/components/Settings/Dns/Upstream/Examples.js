@@ -63,6 +63,25 @@ const Examples = props => (
                     </Trans>
                 </span>
             </li>
+            <li>
+                <code>quic://dns.adguard.com</code> –&nbsp;
+                <span>
+                    <Trans
+                        components={[
+                            <a
+                                href="https://datatracker.ietf.org/doc/html/rfc9250"
+                                target="_blank"
+                                rel="noopener noreferrer"
+                                key="0"
+                            >
+                                DNS-over-QUIC
+                            </a>,
+                        ]}
+                    >
+                        example_upstream_doq
+                    </Trans>
+                </span>
+            </li>
             <li>
                 <code>tcp://1.1.1.1</code> – <Trans>example_upstream_tcp</Trans>
             </li>
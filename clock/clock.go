@@ -0,0 +1,93 @@
+// Package clock provides the current time to the code which depends on it:
+// the filter refresh scheduler, the caches expiry, the DHCP leases expiry.
+// The tests replace the clock with a fake one, so they don't have to wait for the real time to pass.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time
+// It's compatible with gcache.Clock
+type Clock interface {
+	Now() time.Time
+}
+
+// The system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+var current = struct {
+	sync.RWMutex
+	clock Clock
+}{clock: realClock{}}
+
+// Set replaces the clock (test mode)
+// nil restores the system clock
+func Set(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	current.Lock()
+	current.clock = c
+	current.Unlock()
+}
+
+// Now returns the current time
+func Now() time.Time {
+	current.RLock()
+	c := current.clock
+	current.RUnlock()
+	return c.Now()
+}
+
+// Since returns the time elapsed since t
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// Current is the clock which always follows the clock set by Set()
+// It's passed to the objects which keep the clock, e.g. gcache.Cache
+var Current Clock = currentClock{}
+
+type currentClock struct{}
+
+func (currentClock) Now() time.Time {
+	return Now()
+}
+
+// Fake is the clock which doesn't move by itself
+type Fake struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewFake creates a new fake clock
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the current time of the fake clock
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+// Advance moves the fake clock forward (or backward, if d is negative)
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	f.now = f.now.Add(d)
+	f.lock.Unlock()
+}
+
+// SetTime sets the time of the fake clock
+func (f *Fake) SetTime(now time.Time) {
+	f.lock.Lock()
+	f.now = now
+	f.lock.Unlock()
+}
@@ -0,0 +1,26 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(2000000000, 0)
+	fake := NewFake(start)
+	Set(fake)
+	defer Set(nil)
+
+	if !Now().Equal(start) || !Current.Now().Equal(start) {
+		t.Fatalf("Now: %s", Now())
+	}
+	fake.Advance(time.Hour)
+	if Since(start) != time.Hour {
+		t.Fatalf("Since: %s", Since(start))
+	}
+
+	Set(nil)
+	if time.Since(Now()) > time.Second {
+		t.Fatalf("the system clock isn't restored: %s", Now())
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"os"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/krolaw/dhcp4"
 	"golang.org/x/net/ipv4"
 )
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/golibs/file"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/krolaw/dhcp4"
 )
 
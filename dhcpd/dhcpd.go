@@ -8,11 +8,14 @@ import (
 	"sync"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"github.com/AdguardTeam/AdGuardHome/logging"
 	"github.com/krolaw/dhcp4"
 	ping "github.com/sparrc/go-ping"
 )
 
+var log = logging.New("dhcpd")
+
 const defaultDiscoverTime = time.Second * 3
 const leaseExpireStatic = 1
 
@@ -42,6 +45,13 @@ type ServerConfig struct {
 	// IP conflict detector: time (ms) to wait for ICMP reply.
 	// 0: disable
 	ICMPTimeout uint `json:"icmp_timeout_msec" yaml:"icmp_timeout_msec"`
+
+	// The clients' host names from the leases are resolved in this domain: "host.lan"
+	// empty: they aren't resolved
+	LocalDomainName string `json:"local_domain_name" yaml:"local_domain_name"`
+
+	// DHCPv6 server and router advertisements on the same interface
+	V6 V6ServerConfig `json:"v6" yaml:"dhcpv6"`
 }
 
 // Server - the current state of the DHCP server
@@ -67,6 +77,11 @@ type Server struct {
 	IPpool map[[4]byte]net.HardwareAddr
 
 	conf ServerConfig
+
+	v6 v6Server // DHCPv6 server, it's used if conf.V6.Enabled
+
+	onLeaseChanged OnLeaseChangedFunc // called when a lease is assigned, renewed or expires
+	expiryStop     chan bool          // stops the expired leases check
 }
 
 // Print information about the available network interfaces
@@ -146,6 +161,13 @@ func (s *Server) setConfig(config ServerConfig) error {
 		dhcp4.OptionDomainNameServer: s.ipnet.IP,
 	}
 
+	if config.V6.Enabled {
+		err = s.v6.setConfig(config.V6, iface)
+		if err != nil {
+			return wrapErrPrint(err, "Invalid DHCPv6 configuration")
+		}
+	}
+
 	return nil
 }
 
@@ -156,6 +178,7 @@ func (s *Server) Start() error {
 	if s.conn != nil {
 		s.closeConn()
 	}
+	s.v6.stop()
 
 	iface, err := net.InterfaceByName(s.conf.InterfaceName)
 	if err != nil {
@@ -183,11 +206,25 @@ func (s *Server) Start() error {
 		s.cond.Signal()
 	}()
 
+	s.stopExpiryCheck()
+	s.expiryStop = make(chan bool)
+	go s.checkExpiredLeases(s.expiryStop)
+
+	if s.conf.V6.Enabled {
+		err = s.v6.start(iface)
+		if err != nil {
+			return wrapErrPrint(err, "Couldn't start DHCPv6 server")
+		}
+	}
+
 	return nil
 }
 
 // Stop closes the listening UDP socket
 func (s *Server) Stop() error {
+	s.v6.stop()
+	s.stopExpiryCheck()
+
 	if s.conn == nil {
 		// nothing to do, return silently
 		return nil
@@ -212,6 +249,14 @@ func (s *Server) Stop() error {
 	return nil
 }
 
+// Stop the expired leases check if it's running
+func (s *Server) stopExpiryCheck() {
+	if s.expiryStop != nil {
+		close(s.expiryStop)
+		s.expiryStop = nil
+	}
+}
+
 // closeConn will close the connection and set it to zero
 func (s *Server) closeConn() error {
 	if s.conn == nil {
@@ -275,7 +320,7 @@ func (s *Server) findLease(p dhcp4.Packet) *Lease {
 
 // Find an expired lease and return its index or -1
 func (s *Server) findExpiredLease() int {
-	now := time.Now().Unix()
+	now := clock.Now().Unix()
 	for i, lease := range s.leases {
 		if lease.Expiry.Unix() <= now && lease.Expiry.Unix() != leaseExpireStatic {
 			return i
@@ -409,7 +454,7 @@ func (s *Server) blacklistLease(lease *Lease) {
 	s.leasesLock.Lock()
 	lease.HWAddr = hw
 	lease.Hostname = ""
-	lease.Expiry = time.Now().Add(s.leaseTime)
+	lease.Expiry = clock.Now().Add(s.leaseTime)
 	s.leasesLock.Unlock()
 }
 
@@ -498,9 +543,12 @@ func (s *Server) handleDHCP4Request(p dhcp4.Packet, options dhcp4.Options) dhcp4
 		return dhcp4.ReplyPacket(p, dhcp4.NAK, s.ipnet.IP, nil, 0, nil)
 	}
 
-	lease.Expiry = time.Now().Add(s.leaseTime)
+	now := clock.Now()
+	event := leaseCommitEvent(lease, now)
+	lease.Expiry = now.Add(s.leaseTime)
 	log.Tracef("Replying with ACK.  IP: %s  HW: %s  Expire: %s",
 		lease.IP, lease.HWAddr, lease.Expiry)
+	notifyLeaseChanged(s.onLeaseChanged, event, lease)
 	opt := s.leaseOptions.SelectOrderOrAll(options[dhcp4.OptionParameterRequestList])
 	return dhcp4.ReplyPacket(p, dhcp4.ACK, s.ipnet.IP, lease.IP, s.leaseTime, opt)
 }
@@ -544,10 +592,26 @@ func (s *Server) AddStaticLease(l Lease) error {
 	s.leasesLock.Lock()
 	defer s.leasesLock.Unlock()
 
-	if s.findReservedHWaddr(l.IP) != nil {
+	for _, lease := range s.leases {
+		if bytes.Equal(lease.HWAddr, l.HWAddr) && lease.Expiry.Unix() == leaseExpireStatic {
+			return fmt.Errorf("Static lease for this MAC already exists")
+		}
+	}
+	hwaddr := s.findReservedHWaddr(l.IP)
+	if hwaddr != nil && !bytes.Equal(hwaddr, l.HWAddr) {
 		return fmt.Errorf("IP is already used")
 	}
-	s.leases = append(s.leases, &l)
+
+	// the device's dynamic lease is replaced, otherwise it would be found first and the static lease ignored
+	var newLeases []*Lease
+	for _, lease := range s.leases {
+		if bytes.Equal(lease.HWAddr, l.HWAddr) {
+			s.unreserveIP(lease.IP)
+			continue
+		}
+		newLeases = append(newLeases, lease)
+	}
+	s.leases = append(newLeases, &l)
 	s.reserveIP(l.IP, l.HWAddr)
 	s.dbStore()
 	return nil
@@ -593,7 +657,7 @@ func (s *Server) RemoveStaticLease(l Lease) error {
 // Leases returns the list of current DHCP leases (thread-safe)
 func (s *Server) Leases() []Lease {
 	var result []Lease
-	now := time.Now().Unix()
+	now := clock.Now().Unix()
 	s.leasesLock.RLock()
 	for _, lease := range s.leases {
 		if lease.Expiry.Unix() > now {
@@ -602,7 +666,7 @@ func (s *Server) Leases() []Lease {
 	}
 	s.leasesLock.RUnlock()
 
-	return result
+	return append(result, s.v6.activeLeases()...)
 }
 
 // StaticLeases returns the list of statically-configured DHCP leases (thread-safe)
@@ -624,6 +688,87 @@ func (s *Server) StaticLeases() []Lease {
 	return result
 }
 
+// ShiftLeases moves the expiration time of dynamic leases (thread-safe)
+// It's used after the system clock has jumped, so the leases don't expire all at once or never expire
+func (s *Server) ShiftLeases(delta time.Duration) {
+	if s.IPpool == nil {
+		return // the leases aren't loaded
+	}
+
+	s.leasesLock.Lock()
+	for _, l := range s.leases {
+		if l.Expiry.Unix() == leaseExpireStatic || l.Expiry.Unix() == 0 {
+			continue
+		}
+		l.Expiry = l.Expiry.Add(delta)
+	}
+	s.dbStore()
+	s.leasesLock.Unlock()
+	log.Debug("DHCP: leases expiration time is shifted by %s", delta)
+}
+
+// MergeLeases adds the dynamic leases assigned by another DHCP server, e.g. the other server of a failover pair (thread-safe)
+// When the device or the IP address already has a lease, the one which expires later is kept.
+// Returns the number of the added or updated leases.
+func (s *Server) MergeLeases(leases []Lease) int {
+	if s.IPpool == nil {
+		return 0 // the leases aren't loaded
+	}
+
+	now := clock.Now()
+	n := 0
+	s.leasesLock.Lock()
+	for _, l := range leases {
+		ip := l.IP.To4()
+		if ip == nil || len(l.HWAddr) != 6 ||
+			l.Expiry.Unix() == leaseExpireStatic || !l.Expiry.After(now) ||
+			!ipInRange(s.leaseStart, s.leaseStop, ip) {
+			continue
+		}
+		if s.mergeLease(Lease{HWAddr: l.HWAddr, IP: ip, Hostname: l.Hostname, Expiry: l.Expiry}) {
+			n++
+		}
+	}
+	if n != 0 {
+		s.dbStore()
+	}
+	s.leasesLock.Unlock()
+	return n
+}
+
+// Must be called with the leases lock held
+func (s *Server) mergeLease(l Lease) bool {
+	// the lease of another device with the same IP address
+	for i, lease := range s.leases {
+		if !bytes.Equal(lease.IP.To4(), l.IP) || bytes.Equal(lease.HWAddr, l.HWAddr) {
+			continue
+		}
+		if lease.Expiry.Unix() == leaseExpireStatic || !l.Expiry.After(lease.Expiry) {
+			return false
+		}
+		s.unreserveIP(lease.IP)
+		s.leases = append(s.leases[:i], s.leases[i+1:]...)
+		break
+	}
+
+	for _, lease := range s.leases {
+		if !bytes.Equal(lease.HWAddr, l.HWAddr) {
+			continue
+		}
+		if lease.Expiry.Unix() == leaseExpireStatic || !l.Expiry.After(lease.Expiry) {
+			return false
+		}
+		s.unreserveIP(lease.IP)
+		*lease = l
+		s.reserveIP(l.IP, l.HWAddr)
+		return true
+	}
+
+	s.leases = append(s.leases, &l)
+	s.reserveIP(l.IP, l.HWAddr)
+	return true
+}
+
 // Print information about the current leases
 func (s *Server) printLeases() {
 	log.Tracef("Leases:")
@@ -635,7 +780,7 @@ func (s *Server) printLeases() {
 
 // FindIPbyMAC finds an IP address by MAC address in the currently active DHCP leases
 func (s *Server) FindIPbyMAC(mac net.HardwareAddr) net.IP {
-	now := time.Now().Unix()
+	now := clock.Now().Unix()
 	s.leasesLock.RLock()
 	defer s.leasesLock.RUnlock()
 	for _, l := range s.leases {
@@ -643,9 +788,35 @@ func (s *Server) FindIPbyMAC(mac net.HardwareAddr) net.IP {
 			return l.IP
 		}
 	}
+
+	// IPv6-only client
+	for _, l := range s.v6.activeLeases() {
+		if bytes.Equal(mac, l.HWAddr) {
+			return l.IP
+		}
+	}
 	return nil
 }
 
+// FindHostnameByIP finds the hostname the client presented in the currently active DHCP lease for this IP address
+func (s *Server) FindHostnameByIP(ip net.IP) string {
+	now := clock.Now().Unix()
+	s.leasesLock.RLock()
+	defer s.leasesLock.RUnlock()
+	for _, l := range s.leases {
+		if l.Expiry.Unix() > now && l.IP.Equal(ip) {
+			return l.Hostname
+		}
+	}
+
+	for _, l := range s.v6.activeLeases() {
+		if l.IP.Equal(ip) {
+			return l.Hostname
+		}
+	}
+	return ""
+}
+
 // Reset internal state
 func (s *Server) reset() {
 	s.leasesLock.Lock()
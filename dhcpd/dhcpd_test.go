@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/clock"
 	"github.com/krolaw/dhcp4"
 )
 
@@ -170,3 +171,164 @@ func TestDB(t *testing.T) {
 
 	os.Remove("leases.db")
 }
+
+func TestShiftLeases(t *testing.T) {
+	var s = Server{}
+	s.reset()
+	s.leases = []*Lease{
+		{HWAddr: []byte{1, 2, 3, 4, 5, 6}, IP: []byte{1, 1, 1, 1}, Expiry: time.Unix(1000, 0)},
+		{HWAddr: []byte{2, 2, 3, 4, 5, 6}, IP: []byte{1, 1, 1, 2}, Expiry: time.Unix(leaseExpireStatic, 0)},
+	}
+
+	os.Remove("leases.db")
+	s.ShiftLeases(time.Hour)
+	check(t, s.leases[0].Expiry.Unix() == 1000+3600, "dynamic lease is shifted")
+	check(t, s.leases[1].Expiry.Unix() == leaseExpireStatic, "static lease isn't changed")
+	os.Remove("leases.db")
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	var s = Server{}
+	s.reset()
+	s.leaseStart = []byte{1, 1, 1, 1}
+	s.leaseStop = []byte{1, 1, 1, 1}
+	s.leaseTime = time.Hour
+
+	p := make(dhcp4.Packet, 241)
+	hw := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	p.SetCHAddr(hw)
+	lease, _ := s.reserveLease(p)
+	lease.Expiry = fake.Now().Add(s.leaseTime)
+
+	check(t, len(s.Leases()) == 1, "the lease is active")
+	check(t, s.FindIPbyMAC(hw).Equal(net.IP{1, 1, 1, 1}), "FindIPbyMAC")
+	check(t, s.findExpiredLease() == -1, "no expired leases")
+
+	fake.Advance(time.Hour)
+	check(t, len(s.Leases()) == 0, "the lease has expired")
+	check(t, s.FindIPbyMAC(hw) == nil, "FindIPbyMAC for the expired lease")
+	check(t, s.findExpiredLease() == 0, "the expired lease may be reused")
+}
+
+func TestStaticLeases(t *testing.T) {
+	var s = Server{}
+	s.reset()
+	s.leaseStart = []byte{1, 1, 1, 1}
+	s.leaseStop = []byte{1, 1, 1, 2}
+	s.leaseTime = time.Hour
+
+	p := make(dhcp4.Packet, 241)
+	hw := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	p.SetCHAddr(hw)
+	lease, _ := s.reserveLease(p)
+	check(t, bytes.Equal(lease.IP, []byte{1, 1, 1, 1}), "dynamic lease")
+
+	os.Remove("leases.db")
+	defer os.Remove("leases.db")
+
+	// the static lease replaces the device's dynamic lease
+	err := s.AddStaticLease(Lease{HWAddr: hw, IP: []byte{1, 1, 1, 2}, Hostname: "host"})
+	check(t, err == nil, "AddStaticLease")
+	lease = s.findLease(p)
+	check(t, lease != nil && bytes.Equal(lease.IP, []byte{1, 1, 1, 2}), "findLease returns the static lease")
+	check(t, s.findReservedHWaddr([]byte{1, 1, 1, 1}) == nil, "the dynamic lease's IP is free")
+	check(t, len(s.StaticLeases()) == 1, "StaticLeases")
+
+	err = s.AddStaticLease(Lease{HWAddr: hw, IP: []byte{1, 1, 1, 1}})
+	check(t, err != nil, "AddStaticLease - the same MAC")
+	err = s.AddStaticLease(Lease{HWAddr: net.HardwareAddr{2, 2, 3, 4, 5, 6}, IP: []byte{1, 1, 1, 2}})
+	check(t, err != nil, "AddStaticLease - the same IP")
+
+	err = s.RemoveStaticLease(Lease{HWAddr: hw, IP: []byte{1, 1, 1, 2}, Hostname: "host"})
+	check(t, err == nil, "RemoveStaticLease")
+	check(t, len(s.StaticLeases()) == 0 && s.findLease(p) == nil, "the lease is removed")
+}
+
+func TestLeaseEvents(t *testing.T) {
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	var events []LeaseEvent
+	var s = Server{}
+	s.reset()
+	s.SetOnLeaseChanged(func(event LeaseEvent, l Lease) {
+		check(t, bytes.Equal(l.HWAddr, []byte{1, 2, 3, 4, 5, 6}) && l.IP.Equal(net.IP{1, 1, 1, 1}), "the lease")
+		events = append(events, event)
+	})
+	s.leaseStart = []byte{1, 1, 1, 1}
+	s.leaseStop = []byte{1, 1, 1, 1}
+	s.leaseTime = time.Hour
+	s.ipnet = &net.IPNet{IP: []byte{1, 2, 3, 4}, Mask: []byte{0xff, 0xff, 0xff, 0}}
+
+	p := make(dhcp4.Packet, 241)
+	p.SetCHAddr([]byte{1, 2, 3, 4, 5, 6})
+	_, _ = s.reserveLease(p)
+	opt := dhcp4.Options{dhcp4.OptionRequestedIPAddress: []byte{1, 1, 1, 1}}
+	s.handleDHCP4Request(p, opt)
+	check(t, len(events) == 1 && events[0] == LeaseAssigned, "assigned")
+
+	fake.Advance(30 * time.Minute)
+	s.handleDHCP4Request(p, opt)
+	check(t, len(events) == 2 && events[1] == LeaseRenewed, "renewed")
+
+	start := fake.Now()
+	s.notifyExpiredLeases(start, fake.Now())
+	check(t, len(events) == 2, "the lease is active")
+	fake.Advance(2 * time.Hour)
+	s.notifyExpiredLeases(start, fake.Now())
+	check(t, len(events) == 3 && events[2] == LeaseExpired, "expired")
+	s.notifyExpiredLeases(fake.Now(), fake.Now())
+	check(t, len(events) == 3, "the expiry is reported once")
+
+	// the client comes back after the lease has expired
+	s.handleDHCP4Request(p, opt)
+	check(t, len(events) == 4 && events[3] == LeaseAssigned, "assigned again")
+	check(t, LeaseExpired.String() == "expired", "LeaseEvent.String()")
+}
+
+func TestMergeLeases(t *testing.T) {
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	var s = Server{}
+	s.reset()
+	s.leaseStart = []byte{1, 1, 1, 1}
+	s.leaseStop = []byte{1, 1, 1, 3}
+	hw := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	hw2 := net.HardwareAddr{2, 2, 3, 4, 5, 6}
+	s.leases = []*Lease{
+		{HWAddr: hw, IP: []byte{1, 1, 1, 1}, Expiry: fake.Now().Add(time.Hour)},
+		{HWAddr: hw2, IP: []byte{1, 1, 1, 2}, Expiry: time.Unix(leaseExpireStatic, 0)},
+	}
+	s.reserveIP(s.leases[0].IP, hw)
+	s.reserveIP(s.leases[1].IP, hw2)
+
+	os.Remove("leases.db")
+	defer os.Remove("leases.db")
+
+	n := s.MergeLeases([]Lease{
+		{HWAddr: hw, IP: net.IP{1, 1, 1, 1}, Expiry: fake.Now().Add(30 * time.Minute)},
+		{HWAddr: net.HardwareAddr{3, 2, 3, 4, 5, 6}, IP: net.IP{1, 1, 1, 2}, Expiry: fake.Now().Add(time.Hour)},
+		{HWAddr: net.HardwareAddr{4, 2, 3, 4, 5, 6}, IP: net.IP{1, 1, 1, 9}, Expiry: fake.Now().Add(time.Hour)},
+		{HWAddr: net.HardwareAddr{5, 2, 3, 4, 5, 6}, IP: net.IP{1, 1, 1, 3}, Expiry: fake.Now().Add(-time.Hour)},
+	})
+	check(t, n == 0 && len(s.leases) == 2, "older, static, out of range and expired leases are skipped")
+
+	n = s.MergeLeases([]Lease{
+		{HWAddr: hw, IP: net.ParseIP("1.1.1.3"), Hostname: "host", Expiry: fake.Now().Add(2 * time.Hour)},
+	})
+	check(t, n == 1 && len(s.leases) == 2, "the device's lease is updated")
+	check(t, s.FindIPbyMAC(hw).Equal(net.IP{1, 1, 1, 3}) && s.leases[0].Hostname == "host", "the new address")
+	check(t, s.findReservedHWaddr(net.IP{1, 1, 1, 1}) == nil, "the old address is free")
+
+	n = s.MergeLeases([]Lease{
+		{HWAddr: net.HardwareAddr{3, 2, 3, 4, 5, 6}, IP: net.IP{1, 1, 1, 3}, Expiry: fake.Now().Add(3 * time.Hour)},
+	})
+	check(t, n == 1 && len(s.leases) == 2 && s.FindIPbyMAC(hw) == nil, "the address is given to another device")
+}
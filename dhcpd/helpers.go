@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"net"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 )
 
@@ -0,0 +1,106 @@
+// Lease events
+// The owner of the server is notified when a client gets an address, renews it or doesn't renew it in time,
+// e.g. to alert about a new device on the network.
+
+package dhcpd
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+)
+
+// How often the expired leases are checked
+const leaseExpiryCheckPeriod = time.Minute
+
+// LeaseEvent - the type of the lease change
+type LeaseEvent int
+
+// The lease changes
+const (
+	LeaseAssigned LeaseEvent = iota + 1 // the client got the address
+	LeaseRenewed                        // the client extended its lease
+	LeaseExpired                        // the client didn't renew the lease in time
+)
+
+func (e LeaseEvent) String() string {
+	switch e {
+	case LeaseAssigned:
+		return "assigned"
+	case LeaseRenewed:
+		return "renewed"
+	case LeaseExpired:
+		return "expired"
+	}
+	return ""
+}
+
+// OnLeaseChangedFunc is called with a copy of the lease
+// It's called from the server's goroutines, so it must not block.
+type OnLeaseChangedFunc func(event LeaseEvent, l Lease)
+
+// SetOnLeaseChanged sets the function which is called when a lease is assigned, renewed or expires
+// (both DHCPv4 and DHCPv6 leases)
+func (s *Server) SetOnLeaseChanged(f OnLeaseChangedFunc) {
+	s.onLeaseChanged = f
+	s.v6.onLeaseChanged = f
+}
+
+// Get the event for the lease which is committed: it's a renewal if the lease is still active
+func leaseCommitEvent(l *Lease, now time.Time) LeaseEvent {
+	if l.Expiry.Unix() != leaseExpireStatic && now.Before(l.Expiry) {
+		return LeaseRenewed
+	}
+	return LeaseAssigned
+}
+
+func notifyLeaseChanged(f OnLeaseChangedFunc, event LeaseEvent, l *Lease) {
+	if f != nil {
+		f(event, *l)
+	}
+}
+
+// Report the dynamic leases which have expired in (since..now]
+// The expired leases which are given to another client before the check aren't reported.
+func (s *Server) notifyExpiredLeases(since, now time.Time) {
+	expired := func(l *Lease) bool {
+		return l.Expiry.Unix() != leaseExpireStatic && len(l.HWAddr) != 0 &&
+			l.Expiry.After(since) && !l.Expiry.After(now)
+	}
+
+	var leases []Lease
+	s.leasesLock.RLock()
+	for _, l := range s.leases {
+		if expired(l) {
+			leases = append(leases, *l)
+		}
+	}
+	s.leasesLock.RUnlock()
+
+	s.v6.leasesLock.Lock()
+	for _, l := range s.v6.leases {
+		if expired(l) {
+			leases = append(leases, *l)
+		}
+	}
+	s.v6.leasesLock.Unlock()
+
+	for i := range leases {
+		notifyLeaseChanged(s.onLeaseChanged, LeaseExpired, &leases[i])
+	}
+}
+
+// Check the expired leases periodically until the channel is closed
+func (s *Server) checkExpiredLeases(stop chan bool) {
+	last := clock.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(leaseExpiryCheckPeriod):
+		}
+		now := clock.Now()
+		s.notifyExpiredLeases(last, now)
+		last = now
+	}
+}
@@ -0,0 +1,410 @@
+// DHCPv6 server
+// Stateful address assignment: the clients get the addresses from the pool which starts with range_start,
+// the last byte of the address changes.  The clients are identified by their MAC addresses.
+// The leases are kept in memory: after a restart the clients get their addresses back when they renew them.
+
+package dhcpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	v6ServerPort       = 547
+	v6DefaultLeaseTime = 24 * time.Hour
+	v6PrefixLen        = 64
+)
+
+// All_DHCP_Relay_Agents_and_Servers multicast address
+var v6AllServers = net.ParseIP("ff02::1:2")
+
+// V6ServerConfig - DHCPv6 server and router advertisement configuration
+// field ordering is important -- yaml fields will mirror ordering from here
+type V6ServerConfig struct {
+	Enabled       bool   `json:"enabled" yaml:"enabled"`
+	RangeStart    string `json:"range_start" yaml:"range_start"`       // the first address of the pool, its /64 prefix is advertised
+	LeaseDuration uint32 `json:"lease_duration" yaml:"lease_duration"` // in seconds
+
+	// Don't run DHCPv6 server: the clients configure the addresses themselves (SLAAC)
+	// from the prefix in the router advertisements
+	RASLAACOnly bool `json:"ra_slaac_only" yaml:"ra_slaac_only"`
+
+	// The clients may configure the addresses via SLAAC in addition to DHCPv6
+	RAAllowSLAAC bool `json:"ra_allow_slaac" yaml:"ra_allow_slaac"`
+}
+
+type v6Server struct {
+	conf      V6ServerConfig
+	ipStart   net.IP // the first address of the pool
+	leaseTime time.Duration
+	dnsIP     net.IP           // the address the clients use as the DNS server
+	mac       net.HardwareAddr // the interface's MAC address
+	sid       []byte           // server DUID
+
+	leases     []*Lease
+	leasesLock sync.Mutex
+
+	onLeaseChanged OnLeaseChangedFunc
+
+	conn *ipv6.PacketConn
+	ra   raContext
+}
+
+// Get the IPv6 address the clients may use to reach us: a global one if there is any, otherwise link-local
+func getIfaceIPv6(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	var linkLocal net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil {
+			continue
+		}
+		if ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP
+		}
+		if ipnet.IP.IsLinkLocalUnicast() && linkLocal == nil {
+			linkLocal = ipnet.IP
+		}
+	}
+	return linkLocal
+}
+
+func (s *v6Server) setConfig(config V6ServerConfig, iface *net.Interface) error {
+	s.conf = config
+
+	s.ipStart = net.ParseIP(config.RangeStart)
+	if s.ipStart == nil || s.ipStart.To4() != nil {
+		return fmt.Errorf("%s is not an IPv6 address", config.RangeStart)
+	}
+
+	s.leaseTime = v6DefaultLeaseTime
+	if config.LeaseDuration != 0 {
+		s.leaseTime = time.Duration(config.LeaseDuration) * time.Second
+	}
+
+	s.dnsIP = getIfaceIPv6(iface)
+	if s.dnsIP == nil {
+		return fmt.Errorf("couldn't find IPv6 address of interface %s", iface.Name)
+	}
+
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("couldn't find MAC address of interface %s", iface.Name)
+	}
+	s.mac = iface.HardwareAddr
+	s.sid = append([]byte{0, duidLL, 0, 1}, iface.HardwareAddr...)
+	return nil
+}
+
+// Get the parameters of the router advertisements
+func (s *v6Server) raParams() raParams {
+	return raParams{
+		managed:  !s.conf.RASLAACOnly,
+		slaac:    s.conf.RASLAACOnly || s.conf.RAAllowSLAAC,
+		prefix:   s.ipStart.Mask(net.CIDRMask(v6PrefixLen, 128)),
+		lifetime: uint32(s.leaseTime / time.Second),
+		dnsIP:    s.dnsIP,
+		mac:      s.mac,
+	}
+}
+
+// Start sending the router advertisements and listen on port 547
+func (s *v6Server) start(iface *net.Interface) error {
+	err := s.ra.start(iface, s.raParams())
+	if err != nil {
+		return err
+	}
+	if s.conf.RASLAACOnly {
+		log.Info("DHCPv6: SLAAC only, the server isn't started")
+		return nil
+	}
+
+	c, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", v6ServerPort))
+	if err != nil {
+		s.ra.stop()
+		return err
+	}
+	conn := ipv6.NewPacketConn(c)
+	err = conn.JoinGroup(iface, &net.UDPAddr{IP: v6AllServers})
+	if err == nil {
+		err = conn.SetControlMessage(ipv6.FlagInterface, true)
+	}
+	if err != nil {
+		conn.Close()
+		s.ra.stop()
+		return err
+	}
+	log.Info("DHCPv6: listening on [::]:%d", v6ServerPort)
+
+	s.conn = conn
+	go s.serve(conn, iface.Index)
+	return nil
+}
+
+func (s *v6Server) stop() {
+	s.ra.stop()
+	if s.conn == nil {
+		return
+	}
+	s.conn.Close()
+	s.conn = nil
+}
+
+func (s *v6Server) serve(conn *ipv6.PacketConn, ifIndex int) {
+	buf := make([]byte, 4096)
+	for {
+		n, cm, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Debug("DHCPv6: %s", err)
+			return // the socket is closed
+		}
+		if cm != nil && cm.IfIndex != ifIndex {
+			continue
+		}
+		src, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		resp := s.process(buf[:n], src.IP)
+		if resp == nil {
+			continue
+		}
+		_, err = conn.WriteTo(resp, nil, addr)
+		if err != nil {
+			log.Debug("DHCPv6: couldn't send the response to %s: %s", addr, err)
+		}
+	}
+}
+
+// Process the client's message, return the response or nil if there's none
+func (s *v6Server) process(data []byte, src net.IP) []byte {
+	req, err := parseV6Message(data)
+	if err != nil {
+		log.Debug("DHCPv6: invalid message from %s: %s", src, err)
+		return nil
+	}
+	log.Tracef("DHCPv6: message %d from %s", req.msgType, src)
+
+	cid := req.option(v6OptClientID)
+	sid := req.option(v6OptServerID)
+	switch req.msgType {
+	case v6MsgSolicit, v6MsgConfirm, v6MsgRebind:
+		if cid == nil || sid != nil {
+			return nil
+		}
+	case v6MsgRequest, v6MsgRenew, v6MsgRelease, v6MsgDecline:
+		if cid == nil || !bytes.Equal(sid, s.sid) {
+			return nil
+		}
+	case v6MsgInfoRequest:
+		if sid != nil && !bytes.Equal(sid, s.sid) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	resp := &v6Message{msgType: v6MsgReply, txID: req.txID}
+	resp.addOption(v6OptServerID, s.sid)
+	if cid != nil {
+		resp.addOption(v6OptClientID, cid)
+	}
+
+	if req.msgType != v6MsgInfoRequest && req.option(v6OptIANA) != nil {
+		mac := duidMAC(cid)
+		if mac == nil {
+			mac = eui64MAC(src)
+		}
+		if mac == nil {
+			log.Debug("DHCPv6: couldn't get MAC address of the client %s", src)
+			return nil
+		}
+
+		ia, err := parseV6IANA(req.option(v6OptIANA))
+		if err != nil {
+			log.Debug("DHCPv6: invalid message from %s: %s", src, err)
+			return nil
+		}
+
+		switch req.msgType {
+		case v6MsgSolicit:
+			if req.option(v6OptRapidCommit) != nil {
+				resp.addOption(v6OptRapidCommit, nil)
+				s.assign(req, resp, ia, mac, true)
+			} else {
+				resp.msgType = v6MsgAdvertise
+				s.assign(req, resp, ia, mac, false)
+			}
+		case v6MsgRequest, v6MsgRenew, v6MsgRebind:
+			s.assign(req, resp, ia, mac, true)
+		case v6MsgConfirm:
+			s.confirm(resp, ia)
+		case v6MsgRelease, v6MsgDecline:
+			s.release(req, resp, ia, mac)
+			return resp.pack()
+		}
+	}
+
+	resp.addOption(v6OptDNSServers, s.dnsIP.To16())
+	return resp.pack()
+}
+
+// Return TRUE if the address belongs to the pool
+func (s *v6Server) inPool(ip net.IP) bool {
+	ip = ip.To16()
+	return ip != nil && ip.To4() == nil &&
+		bytes.Equal(ip[:15], s.ipStart[:15]) && ip[15] >= s.ipStart[15]
+}
+
+// Find the client's lease, the lock must be held
+func (s *v6Server) findLease(mac net.HardwareAddr) *Lease {
+	for _, l := range s.leases {
+		if bytes.Equal(l.HWAddr, mac) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Find the active lease for this address, the lock must be held
+func (s *v6Server) findActiveLeaseByIP(ip net.IP, now time.Time) *Lease {
+	for _, l := range s.leases {
+		if l.IP.Equal(ip) && now.Before(l.Expiry) {
+			return l
+		}
+	}
+	return nil
+}
+
+// Find a free address in the pool and remove the expired leases, the lock must be held
+func (s *v6Server) findFreeIP(now time.Time) net.IP {
+	var leases []*Lease
+	for _, l := range s.leases {
+		if now.Before(l.Expiry) {
+			leases = append(leases, l)
+		}
+	}
+	s.leases = leases
+
+	for i := int(s.ipStart[15]); i <= 0xff; i++ {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, s.ipStart)
+		ip[15] = byte(i)
+		if s.findActiveLeaseByIP(ip, now) == nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Add IA_NA with the client's address to the response
+// The lease is committed for Request, Renew, Rebind and Solicit with Rapid Commit.
+func (s *v6Server) assign(req, resp *v6Message, ia *v6IANA, mac net.HardwareAddr, commit bool) {
+	now := clock.Now()
+	s.leasesLock.Lock()
+	defer s.leasesLock.Unlock()
+
+	respIA := &v6IANA{iaid: ia.iaid}
+	lease := s.findLease(mac)
+	if lease == nil {
+		// the client may have got the address before the restart or with Advertise
+		ip := ia.addr()
+		if ip == nil || !s.inPool(ip) || s.findActiveLeaseByIP(ip, now) != nil {
+			if req.msgType == v6MsgRenew || req.msgType == v6MsgRebind {
+				respIA.options = append(respIA.options, v6Option{v6OptStatusCode, packV6Status(v6StatusNoBinding, "")})
+				resp.addOption(v6OptIANA, respIA.pack())
+				return
+			}
+			ip = s.findFreeIP(now)
+		}
+		if ip == nil {
+			log.Info("DHCPv6: no free addresses for %s", mac)
+			resp.addOption(v6OptStatusCode, packV6Status(v6StatusNoAddrsAvail, "no free addresses"))
+			return
+		}
+		lease = &Lease{HWAddr: mac, IP: ip}
+		if !commit {
+			s.fillIANA(respIA, lease.IP)
+			resp.addOption(v6OptIANA, respIA.pack())
+			return
+		}
+		s.leases = append(s.leases, lease)
+	}
+
+	if commit {
+		event := leaseCommitEvent(lease, now)
+		lease.Expiry = now.Add(s.leaseTime)
+		hostname := v6Hostname(req.option(v6OptClientFQDN))
+		if len(hostname) != 0 {
+			lease.Hostname = hostname
+		}
+		log.Tracef("DHCPv6: lease %s for %s until %s", lease.IP, mac, lease.Expiry)
+		notifyLeaseChanged(s.onLeaseChanged, event, lease)
+	}
+	s.fillIANA(respIA, lease.IP)
+	resp.addOption(v6OptIANA, respIA.pack())
+}
+
+func (s *v6Server) fillIANA(ia *v6IANA, ip net.IP) {
+	lifetime := uint32(s.leaseTime / time.Second)
+	ia.t1 = lifetime / 2
+	ia.t2 = lifetime / 5 * 4
+	ia.options = append(ia.options, v6Option{v6OptIAAddr, packV6IAAddr(ip, lifetime, lifetime)})
+}
+
+// Check whether the client's address is still appropriate for the link
+func (s *v6Server) confirm(resp *v6Message, ia *v6IANA) {
+	ip := ia.addr()
+	prefix := net.IPNet{IP: s.ipStart.Mask(net.CIDRMask(v6PrefixLen, 128)), Mask: net.CIDRMask(v6PrefixLen, 128)}
+	if ip != nil && !prefix.Contains(ip) {
+		resp.addOption(v6OptStatusCode, packV6Status(v6StatusNotOnLink, ""))
+		return
+	}
+	resp.addOption(v6OptStatusCode, packV6Status(v6StatusSuccess, ""))
+}
+
+// Remove the client's lease
+// The declined address is used by another device, so it's kept reserved until the lease time passes.
+func (s *v6Server) release(req, resp *v6Message, ia *v6IANA, mac net.HardwareAddr) {
+	ip := ia.addr()
+	s.leasesLock.Lock()
+	defer s.leasesLock.Unlock()
+
+	var leases []*Lease
+	for _, l := range s.leases {
+		if !bytes.Equal(l.HWAddr, mac) || !l.IP.Equal(ip) {
+			leases = append(leases, l)
+			continue
+		}
+		if req.msgType == v6MsgDecline {
+			log.Info("DHCPv6: address %s is declined by %s", l.IP, mac)
+			leases = append(leases, &Lease{IP: l.IP, Expiry: clock.Now().Add(s.leaseTime)})
+		}
+	}
+	s.leases = leases
+	resp.addOption(v6OptStatusCode, packV6Status(v6StatusSuccess, ""))
+}
+
+// Get the active leases
+func (s *v6Server) activeLeases() []Lease {
+	now := clock.Now()
+	var result []Lease
+	s.leasesLock.Lock()
+	for _, l := range s.leases {
+		if now.Before(l.Expiry) && len(l.HWAddr) != 0 {
+			result = append(result, *l)
+		}
+	}
+	s.leasesLock.Unlock()
+	return result
+}
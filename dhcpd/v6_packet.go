@@ -0,0 +1,229 @@
+// DHCPv6 messages (RFC 8415)
+// The message is the type, the transaction ID and the options: 2 bytes code, 2 bytes length, data.
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// DHCPv6 message types
+const (
+	v6MsgSolicit     = 1
+	v6MsgAdvertise   = 2
+	v6MsgRequest     = 3
+	v6MsgConfirm     = 4
+	v6MsgRenew       = 5
+	v6MsgRebind      = 6
+	v6MsgReply       = 7
+	v6MsgRelease     = 8
+	v6MsgDecline     = 9
+	v6MsgInfoRequest = 11
+)
+
+// DHCPv6 options
+const (
+	v6OptClientID     = 1
+	v6OptServerID     = 2
+	v6OptIANA         = 3
+	v6OptIAAddr       = 5
+	v6OptStatusCode   = 13
+	v6OptRapidCommit  = 14
+	v6OptDNSServers   = 23
+	v6OptClientFQDN   = 39
+	v6OptHeaderLength = 4
+)
+
+// DHCPv6 status codes
+const (
+	v6StatusSuccess      = 0
+	v6StatusNoAddrsAvail = 2
+	v6StatusNoBinding    = 3
+	v6StatusNotOnLink    = 4
+)
+
+// DUID types
+const (
+	duidLLT = 1 // link-layer address plus time
+	duidLL  = 3 // link-layer address
+)
+
+type v6Option struct {
+	code uint16
+	data []byte
+}
+
+type v6Message struct {
+	msgType byte
+	txID    [3]byte
+	options []v6Option
+}
+
+// Parse the options, they may be nested (e.g. IA_NA contains IAADDR)
+func parseV6Options(data []byte) ([]v6Option, error) {
+	var opts []v6Option
+	for len(data) != 0 {
+		if len(data) < v6OptHeaderLength {
+			return nil, fmt.Errorf("option is too short")
+		}
+		code := binary.BigEndian.Uint16(data)
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < v6OptHeaderLength+n {
+			return nil, fmt.Errorf("option %d is too long: %d", code, n)
+		}
+		opts = append(opts, v6Option{code: code, data: data[v6OptHeaderLength : v6OptHeaderLength+n]})
+		data = data[v6OptHeaderLength+n:]
+	}
+	return opts, nil
+}
+
+func parseV6Message(data []byte) (*v6Message, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message is too short")
+	}
+	m := &v6Message{msgType: data[0]}
+	copy(m.txID[:], data[1:4])
+	var err error
+	m.options, err = parseV6Options(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func packV6Options(opts []v6Option) []byte {
+	var data []byte
+	for _, o := range opts {
+		hdr := make([]byte, v6OptHeaderLength)
+		binary.BigEndian.PutUint16(hdr, o.code)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(o.data)))
+		data = append(data, hdr...)
+		data = append(data, o.data...)
+	}
+	return data
+}
+
+func (m *v6Message) pack() []byte {
+	data := []byte{m.msgType, m.txID[0], m.txID[1], m.txID[2]}
+	return append(data, packV6Options(m.options)...)
+}
+
+// Get the data of the first option with this code, nil if there's none
+func findV6Option(opts []v6Option, code uint16) []byte {
+	for _, o := range opts {
+		if o.code == code {
+			return o.data
+		}
+	}
+	return nil
+}
+
+func (m *v6Message) option(code uint16) []byte {
+	return findV6Option(m.options, code)
+}
+
+func (m *v6Message) addOption(code uint16, data []byte) {
+	m.options = append(m.options, v6Option{code: code, data: data})
+}
+
+// Get the MAC address from DUID-LLT or DUID-LL of Ethernet type
+func duidMAC(duid []byte) net.HardwareAddr {
+	if len(duid) < 4 || binary.BigEndian.Uint16(duid[2:]) != 1 {
+		return nil
+	}
+	var mac []byte
+	switch binary.BigEndian.Uint16(duid) {
+	case duidLLT:
+		if len(duid) == 14 {
+			mac = duid[8:]
+		}
+	case duidLL:
+		if len(duid) == 10 {
+			mac = duid[4:]
+		}
+	}
+	if mac == nil {
+		return nil
+	}
+	return net.HardwareAddr(append([]byte{}, mac...))
+}
+
+// Get the MAC address from the link-local address in modified EUI-64 format (RFC 4291)
+func eui64MAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	if ip == nil || !ip.IsLinkLocalUnicast() || ip.To4() != nil || ip[11] != 0xff || ip[12] != 0xfe {
+		return nil
+	}
+	return net.HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
+}
+
+// IA_NA option: IAID, T1, T2 and the nested options
+type v6IANA struct {
+	iaid    [4]byte
+	t1, t2  uint32
+	options []v6Option
+}
+
+func parseV6IANA(data []byte) (*v6IANA, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("IA_NA is too short")
+	}
+	ia := &v6IANA{
+		t1: binary.BigEndian.Uint32(data[4:]),
+		t2: binary.BigEndian.Uint32(data[8:]),
+	}
+	copy(ia.iaid[:], data)
+	var err error
+	ia.options, err = parseV6Options(data[12:])
+	if err != nil {
+		return nil, err
+	}
+	return ia, nil
+}
+
+func (ia *v6IANA) pack() []byte {
+	data := make([]byte, 12)
+	copy(data, ia.iaid[:])
+	binary.BigEndian.PutUint32(data[4:], ia.t1)
+	binary.BigEndian.PutUint32(data[8:], ia.t2)
+	return append(data, packV6Options(ia.options)...)
+}
+
+// Get the address the client asks for in IA_NA, nil if there's none
+func (ia *v6IANA) addr() net.IP {
+	data := findV6Option(ia.options, v6OptIAAddr)
+	if len(data) < 24 {
+		return nil
+	}
+	return net.IP(append([]byte{}, data[:16]...))
+}
+
+// IAADDR option: the address with its preferred and valid lifetime
+func packV6IAAddr(ip net.IP, preferred, valid uint32) []byte {
+	data := make([]byte, 24)
+	copy(data, ip.To16())
+	binary.BigEndian.PutUint32(data[16:], preferred)
+	binary.BigEndian.PutUint32(data[20:], valid)
+	return data
+}
+
+// Status Code option: the code and the message
+func packV6Status(code uint16, msg string) []byte {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, code)
+	return append(data, msg...)
+}
+
+// Get the host name from the Client FQDN option (RFC 4704): the first label of the domain name
+func v6Hostname(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	n := int(data[1])
+	if n == 0 || len(data) < 2+n {
+		return ""
+	}
+	return string(data[2 : 2+n])
+}
@@ -0,0 +1,148 @@
+// Router advertisements (RFC 4861)
+// AdGuard Home isn't the router of the network, so the advertisements have zero router lifetime:
+// they only tell the clients the prefix, whether to use DHCPv6 or SLAAC,
+// and the DNS server (RDNSS option, RFC 8106).
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	raInterval     = 10 * time.Second
+	raRDNSSTimeout = 3600 // the lifetime of the DNS server address, in seconds
+	raHopLimit     = 255  // the clients ignore the advertisements with another hop limit
+)
+
+// All-nodes multicast address
+var raAllNodes = net.ParseIP("ff02::1")
+
+type raParams struct {
+	managed  bool             // the clients get the addresses and the other configuration via DHCPv6 (M and O flags)
+	slaac    bool             // the clients may configure the addresses from the prefix (A flag)
+	prefix   net.IP           // /64
+	lifetime uint32           // the prefix lifetime, in seconds
+	dnsIP    net.IP           // the DNS server address
+	mac      net.HardwareAddr // the source link-layer address
+}
+
+type raContext struct {
+	conn *icmp.PacketConn
+	done chan bool
+}
+
+// Create ICMPv6 Router Advertisement message
+// The checksum is calculated by the kernel.
+func (p *raParams) pack() []byte {
+	data := make([]byte, 16)
+	data[0] = byte(ipv6.ICMPTypeRouterAdvertisement)
+	data[4] = 64 // the hop limit the clients use
+	if p.managed {
+		data[5] = 0x80 | 0x40
+	}
+	// router lifetime, reachable time and retransmission timer are 0: unspecified
+
+	// Prefix Information
+	opt := make([]byte, 32)
+	opt[0] = 3
+	opt[1] = 4 // in 8-byte units
+	opt[2] = v6PrefixLen
+	opt[3] = 0x80 // on-link
+	if p.slaac {
+		opt[3] |= 0x40
+	}
+	binary.BigEndian.PutUint32(opt[4:], p.lifetime) // valid lifetime
+	binary.BigEndian.PutUint32(opt[8:], p.lifetime) // preferred lifetime
+	copy(opt[16:], p.prefix.To16())
+	data = append(data, opt...)
+
+	// Recursive DNS Server
+	opt = make([]byte, 24)
+	opt[0] = 25
+	opt[1] = 3
+	binary.BigEndian.PutUint32(opt[4:], raRDNSSTimeout)
+	copy(opt[8:], p.dnsIP.To16())
+	data = append(data, opt...)
+
+	// Source Link-Layer Address
+	if len(p.mac) == 6 {
+		opt = []byte{1, 1}
+		opt = append(opt, p.mac...)
+		data = append(data, opt...)
+	}
+	return data
+}
+
+// Get the link-local address of the interface, the advertisements must be sent from it
+func getIfaceLinkLocal(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// Start sending the router advertisements periodically
+func (ra *raContext) start(iface *net.Interface, params raParams) error {
+	src := getIfaceLinkLocal(iface)
+	if src == nil {
+		return wrapErrPrint(nil, "Couldn't find link-local IPv6 address of interface %s", iface.Name)
+	}
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", src.String()+"%"+iface.Name)
+	if err != nil {
+		return wrapErrPrint(err, "Couldn't start sending the router advertisements")
+	}
+	p := conn.IPv6PacketConn()
+	err = p.SetMulticastHopLimit(raHopLimit)
+	if err == nil {
+		err = p.SetHopLimit(raHopLimit)
+	}
+	if err == nil {
+		err = p.SetMulticastInterface(iface)
+	}
+	if err != nil {
+		conn.Close()
+		return wrapErrPrint(err, "Couldn't start sending the router advertisements")
+	}
+
+	ra.conn = conn
+	ra.done = make(chan bool)
+	data := params.pack()
+	dst := &net.IPAddr{IP: raAllNodes, Zone: iface.Name}
+	go func(done chan bool) {
+		for {
+			_, err := conn.WriteTo(data, dst)
+			if err != nil {
+				log.Debug("DHCPv6: couldn't send the router advertisement: %s", err)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(raInterval):
+			}
+		}
+	}(ra.done)
+	log.Info("DHCPv6: sending the router advertisements on %s", iface.Name)
+	return nil
+}
+
+func (ra *raContext) stop() {
+	if ra.conn == nil {
+		return
+	}
+	close(ra.done)
+	ra.conn.Close()
+	ra.conn = nil
+}
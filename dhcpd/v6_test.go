@@ -0,0 +1,136 @@
+package dhcpd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestV6Server() *v6Server {
+	s := &v6Server{
+		ipStart:   net.ParseIP("2001::1"),
+		leaseTime: time.Hour,
+		dnsIP:     net.ParseIP("2001::ff"),
+		sid:       []byte{0, duidLL, 0, 1, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa},
+	}
+	s.ipStart = s.ipStart.To16()
+	return s
+}
+
+// Send the message to the server and parse the response
+func v6Exchange(t *testing.T, s *v6Server, msgType byte, opts ...v6Option) *v6Message {
+	req := &v6Message{msgType: msgType, txID: [3]byte{1, 2, 3}, options: opts}
+	data := s.process(req.pack(), net.ParseIP("fe80::1"))
+	if data == nil {
+		return nil
+	}
+	resp, err := parseV6Message(data)
+	check(t, err == nil, "parseV6Message")
+	check(t, resp.txID == req.txID, "transaction ID")
+	return resp
+}
+
+// Get the address from IA_NA of the response
+func respAddr(t *testing.T, resp *v6Message) net.IP {
+	ia, err := parseV6IANA(resp.option(v6OptIANA))
+	check(t, err == nil, "parseV6IANA")
+	check(t, ia.t1 == 1800 && ia.t2 == 2880, "T1 and T2")
+	return ia.addr()
+}
+
+func TestV6(t *testing.T) {
+	s := newTestV6Server()
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	cid := v6Option{v6OptClientID, append([]byte{0, duidLL, 0, 1}, mac...)}
+	sid := v6Option{v6OptServerID, s.sid}
+	ia := v6Option{v6OptIANA, (&v6IANA{iaid: [4]byte{0, 0, 0, 1}}).pack()}
+
+	// Solicit -> Advertise, the lease isn't committed yet
+	resp := v6Exchange(t, s, v6MsgSolicit, cid, ia)
+	check(t, resp != nil && resp.msgType == v6MsgAdvertise, "Advertise")
+	check(t, bytes.Equal(resp.option(v6OptServerID), s.sid), "server ID")
+	check(t, bytes.Equal(resp.option(v6OptClientID), cid.data), "client ID")
+	check(t, net.IP(resp.option(v6OptDNSServers)).Equal(s.dnsIP), "DNS servers")
+	check(t, respAddr(t, resp).Equal(net.ParseIP("2001::1")), "advertised address")
+	check(t, len(s.activeLeases()) == 0, "no leases")
+
+	// Request -> Reply
+	reqIA := v6Option{v6OptIANA, (&v6IANA{
+		iaid:    [4]byte{0, 0, 0, 1},
+		options: []v6Option{{v6OptIAAddr, packV6IAAddr(net.ParseIP("2001::1"), 0, 0)}},
+	}).pack()}
+	fqdn := v6Option{v6OptClientFQDN, []byte{0, 4, 'h', 'o', 's', 't', 0}}
+	resp = v6Exchange(t, s, v6MsgRequest, cid, sid, reqIA, fqdn)
+	check(t, resp != nil && resp.msgType == v6MsgReply, "Reply")
+	check(t, respAddr(t, resp).Equal(net.ParseIP("2001::1")), "assigned address")
+	leases := s.activeLeases()
+	check(t, len(leases) == 1 && bytes.Equal(leases[0].HWAddr, mac) && leases[0].Hostname == "host", "lease")
+
+	// the request for another server is ignored
+	other := v6Option{v6OptServerID, []byte{0, duidLL, 0, 1, 0xbb, 0xbb, 0xbb, 0xbb, 0xbb, 0xbb}}
+	check(t, v6Exchange(t, s, v6MsgRequest, cid, other, reqIA) == nil, "another server")
+
+	// another client with Rapid Commit gets the next address
+	cid2 := v6Option{v6OptClientID, []byte{0, duidLLT, 0, 1, 0, 0, 0, 0, 6, 5, 4, 3, 2, 1}}
+	resp = v6Exchange(t, s, v6MsgSolicit, cid2, ia, v6Option{v6OptRapidCommit, nil})
+	check(t, resp != nil && resp.msgType == v6MsgReply && resp.option(v6OptRapidCommit) != nil, "Rapid Commit")
+	check(t, respAddr(t, resp).Equal(net.ParseIP("2001::2")), "the next address")
+	check(t, len(s.activeLeases()) == 2, "2 leases")
+
+	// the binding is restored after a restart
+	s2 := newTestV6Server()
+	resp = v6Exchange(t, s2, v6MsgRenew, cid, sid, reqIA)
+	check(t, resp != nil && respAddr(t, resp).Equal(net.ParseIP("2001::1")), "Renew after a restart")
+	check(t, len(s2.activeLeases()) == 1, "restored lease")
+
+	// Confirm
+	resp = v6Exchange(t, s, v6MsgConfirm, cid, reqIA)
+	check(t, bytes.Equal(resp.option(v6OptStatusCode), packV6Status(v6StatusSuccess, "")), "Confirm")
+	otherIA := v6Option{v6OptIANA, (&v6IANA{
+		options: []v6Option{{v6OptIAAddr, packV6IAAddr(net.ParseIP("2002::1"), 0, 0)}},
+	}).pack()}
+	resp = v6Exchange(t, s, v6MsgConfirm, cid, otherIA)
+	check(t, bytes.Equal(resp.option(v6OptStatusCode), packV6Status(v6StatusNotOnLink, "")), "Confirm - not on link")
+
+	// Release
+	resp = v6Exchange(t, s, v6MsgRelease, cid, sid, reqIA)
+	check(t, resp != nil && resp.msgType == v6MsgReply, "Release")
+	check(t, len(s.activeLeases()) == 1, "the lease is released")
+
+	// Information-request
+	resp = v6Exchange(t, s, v6MsgInfoRequest)
+	check(t, resp != nil && net.IP(resp.option(v6OptDNSServers)).Equal(s.dnsIP), "Information-request")
+}
+
+func TestV6MAC(t *testing.T) {
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	check(t, bytes.Equal(duidMAC([]byte{0, duidLL, 0, 1, 1, 2, 3, 4, 5, 6}), mac), "DUID-LL")
+	check(t, bytes.Equal(duidMAC([]byte{0, duidLLT, 0, 1, 9, 9, 9, 9, 1, 2, 3, 4, 5, 6}), mac), "DUID-LLT")
+	check(t, duidMAC([]byte{0, 2, 0, 0, 0, 9, 1, 2, 3}) == nil, "DUID-EN")
+	check(t, bytes.Equal(eui64MAC(net.ParseIP("fe80::302:3ff:fe04:506")), mac), "EUI-64")
+	check(t, eui64MAC(net.ParseIP("fe80::1")) == nil, "not EUI-64")
+}
+
+func TestV6RA(t *testing.T) {
+	p := raParams{
+		managed:  true,
+		prefix:   net.ParseIP("2001::"),
+		lifetime: 3600,
+		dnsIP:    net.ParseIP("2001::ff"),
+		mac:      net.HardwareAddr{1, 2, 3, 4, 5, 6},
+	}
+	data := p.pack()
+	check(t, len(data) == 16+32+24+8, "length")
+	check(t, data[0] == 134 && data[5] == 0xc0 && data[6] == 0 && data[7] == 0, "header")
+	check(t, data[16] == 3 && data[18] == 64 && data[19] == 0x80, "prefix information")
+	check(t, net.IP(data[32:48]).Equal(p.prefix), "prefix")
+	check(t, data[48] == 25 && net.IP(data[56:72]).Equal(p.dnsIP), "RDNSS")
+	check(t, data[72] == 1 && bytes.Equal(data[74:80], p.mac), "source link-layer address")
+
+	// SLAAC only
+	p.managed = false
+	p.slaac = true
+	data = p.pack()
+	check(t, data[5] == 0 && data[19] == 0xc0, "SLAAC flags")
+}
@@ -0,0 +1,156 @@
+// Parental control categories
+// The categorized domain database is a text file with "domain category" on each line,
+// the subdomains of a domain belong to the same category.
+// The remote parental control service covers the adult category.
+
+package dnsfilter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parental control categories
+const (
+	CategoryAdult    = "adult"
+	CategoryViolence = "violence"
+	CategoryGambling = "gambling"
+	CategoryDrugs    = "drugs"
+)
+
+// ParentalCategories is the list of the supported categories
+var ParentalCategories = []string{CategoryAdult, CategoryViolence, CategoryGambling, CategoryDrugs}
+
+// CheckParentalCategories returns an error if the list contains unknown categories
+func CheckParentalCategories(list []string) error {
+	for _, c := range list {
+		if !categoryEnabled(ParentalCategories, c) {
+			return fmt.Errorf("unknown parental category: %s", c)
+		}
+	}
+	return nil
+}
+
+// Returns TRUE if the category is in the list
+// The empty list means all categories
+func categoryEnabled(list []string, category string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, c := range list {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+type categoryDB struct {
+	path    string
+	modTime time.Time
+	domains map[string]string // domain -> category
+}
+
+// CategoryDBStatus describes the loaded categorized domain database
+type CategoryDBStatus struct {
+	Path    string `json:"path"`
+	Domains int    `json:"domains"`
+	Error   string `json:"error,omitempty"`
+}
+
+// the database needs to survive the reload
+var categoryDBState = struct {
+	sync.Mutex
+	db     *categoryDB
+	status CategoryDBStatus
+}{}
+
+// Parse the categorized domain database
+func parseCategoryDB(data []byte) map[string]string {
+	domains := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !categoryEnabled(ParentalCategories, fields[1]) {
+			log.Debug("Category database: invalid line: %s", line)
+			continue
+		}
+		domains[strings.ToLower(strings.Trim(fields[0], "."))] = fields[1]
+	}
+	return domains
+}
+
+// Load the categorized domain database
+// The file isn't parsed again if it hasn't been changed since the previous load
+func loadCategoryDB(path string) *categoryDB {
+	categoryDBState.Lock()
+	defer categoryDBState.Unlock()
+
+	categoryDBState.status = CategoryDBStatus{Path: path}
+	st, err := os.Stat(path)
+	if err == nil {
+		db := categoryDBState.db
+		if db != nil && db.path == path && db.modTime.Equal(st.ModTime()) {
+			categoryDBState.status.Domains = len(db.domains)
+			return db
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Error("Couldn't load the parental categories database: %s", err)
+		categoryDBState.db = nil
+		categoryDBState.status.Error = err.Error()
+		return nil
+	}
+
+	db := &categoryDB{path: path, domains: parseCategoryDB(data)}
+	if st != nil {
+		db.modTime = st.ModTime()
+	}
+	categoryDBState.db = db
+	categoryDBState.status.Domains = len(db.domains)
+	log.Info("Loaded %d domains from the parental categories database %s", len(db.domains), path)
+	return db
+}
+
+// GetCategoryDBStatus returns the status of the categorized domain database
+func GetCategoryDBStatus() CategoryDBStatus {
+	categoryDBState.Lock()
+	defer categoryDBState.Unlock()
+	return categoryDBState.status
+}
+
+// Get the category of the host or its parent domain
+func (db *categoryDB) lookup(host string) string {
+	for {
+		c, ok := db.domains[host]
+		if ok {
+			return c
+		}
+		i := strings.IndexByte(host, '.')
+		if i == -1 {
+			return ""
+		}
+		host = host[i+1:]
+	}
+}
+
+// Check the host against the categorized domain database
+func (d *Dnsfilter) checkParentalCategory(host string, categories []string) Result {
+	if d.categoryDB == nil {
+		return Result{}
+	}
+	c := d.categoryDB.lookup(host)
+	if len(c) == 0 || !categoryEnabled(categories, c) {
+		return Result{}
+	}
+	log.Tracef("Host %s is blocked by parental control: category %s", host, c)
+	return Result{IsFiltered: true, Reason: FilteredParental, Category: c}
+}
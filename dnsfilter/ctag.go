@@ -0,0 +1,106 @@
+// Rules for the tagged clients
+// "||example.org^$ctag=device_phone|user_child" applies only to the clients with any of these tags.
+// The filtering engine doesn't know this modifier, so these rules are taken out of the filter lists
+// and each tag gets its own engine.
+
+package dnsfilter
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter"
+)
+
+const ctagOption = "ctag="
+
+// Split the rule into the rule without $ctag modifier and the tags
+// Returns nil tags if it's not a rule for the tagged clients
+func parseCtagRule(rule string) (string, []string) {
+	i := strings.LastIndexByte(rule, '$')
+	if i == -1 {
+		return rule, nil
+	}
+	var tags []string
+	opts := []string{}
+	for _, opt := range strings.Split(rule[i+1:], ",") {
+		if strings.HasPrefix(opt, ctagOption) {
+			for _, t := range strings.Split(opt[len(ctagOption):], "|") {
+				if len(t) != 0 {
+					tags = append(tags, t)
+				}
+			}
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	if tags == nil {
+		return rule, nil
+	}
+	if len(opts) == 0 {
+		return rule[:i], tags
+	}
+	return rule[:i+1] + strings.Join(opts, ","), tags
+}
+
+// Take the rules for the tagged clients out of the filter lists
+// Returns the new filters map and the filters for each tag
+func extractCtagRules(filters map[int]string) (map[int]string, map[string]map[int]string, map[string]string) {
+	result := map[int]string{}
+	tagged := map[string]map[int]string{}
+	texts := map[string]string{} // rule without the modifier -> original rule
+	for id, text := range filters {
+		if !strings.Contains(text, ctagOption) {
+			result[id] = text
+			continue
+		}
+
+		lines := strings.Split(text, "\n")
+		n := 0
+		for _, line := range lines {
+			rule, tags := parseCtagRule(strings.TrimSpace(line))
+			if tags == nil {
+				lines[n] = line
+				n++
+				continue
+			}
+			for _, t := range tags {
+				if tagged[t] == nil {
+					tagged[t] = map[int]string{}
+				}
+				tagged[t][id] += rule + "\n"
+			}
+			if _, ok := texts[rule]; !ok {
+				texts[rule] = strings.TrimSpace(line)
+			}
+		}
+		result[id] = strings.Join(lines[:n], "\n")
+	}
+	return result, tagged, texts
+}
+
+// Build the engines for the tagged clients
+func (d *Dnsfilter) initCtagFiltering(tagged map[string]map[int]string, texts map[string]string) {
+	d.ctagEngines = map[string]*urlfilter.DNSEngine{}
+	for t, filters := range tagged {
+		d.ctagEngines[t] = urlfilter.NewDNSEngine(filters, d.rulesStorage)
+	}
+	d.ctagRuleTexts = texts
+}
+
+// Match the host against the rules for the client's tags
+func (d *Dnsfilter) matchCtagHost(host string, qtype uint16, tags []string) (Result, error) {
+	for _, t := range tags {
+		engine, ok := d.ctagEngines[t]
+		if !ok {
+			continue
+		}
+		res, err := d.matchEngine(engine, host, qtype)
+		if err != nil || res.Reason.Matched() {
+			if text, ok := d.ctagRuleTexts[res.Rule]; ok {
+				res.Rule = text
+			}
+			return res, err
+		}
+	}
+	return Result{}, nil
+}
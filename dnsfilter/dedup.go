@@ -0,0 +1,77 @@
+// Deduplication of identical rules across filter lists
+
+package dnsfilter
+
+import (
+	"sort"
+	"strings"
+)
+
+// isRuleLine returns TRUE if the line is a rule (not a comment and not an empty line)
+func isRuleLine(line string) bool {
+	return len(line) != 0 && line[0] != '!' && line[0] != '#'
+}
+
+// dedupRules removes the rules which are already present in another filter list
+// The first occurrence of a rule is kept: the lists are processed in the order of their IDs,
+// but trusted lists go first so that an untrusted list doesn't prevent a trusted one from redirecting a host.
+// Returns the new lists and the IDs of the lists which contained the removed copies (rule text -> filter IDs)
+func dedupRules(filters map[int]string, untrusted map[int64]bool) (map[int]string, map[string][]int64) {
+	ids := []int{}
+	for id := range filters {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		ui := untrusted[int64(ids[i])]
+		uj := untrusted[int64(ids[j])]
+		if ui != uj {
+			return !ui
+		}
+		return ids[i] < ids[j]
+	})
+
+	owners := map[string]int{} // rule text -> ID of the list where the rule is kept
+	duplicates := map[string][]int64{}
+	result := map[int]string{}
+	removed := 0
+	for _, id := range ids {
+		text := filters[id]
+		sb := strings.Builder{}
+		sb.Grow(len(text))
+		for len(text) != 0 {
+			var line string
+			i := strings.IndexByte(text, '\n')
+			if i < 0 {
+				line, text = text, ""
+			} else {
+				line, text = text[:i], text[i+1:]
+			}
+			rule := strings.TrimSpace(line)
+			if !isRuleLine(rule) {
+				continue
+			}
+			if owner, ok := owners[rule]; ok {
+				removed++
+				if owner == id {
+					continue
+				}
+				// copy the rule text so the original list data isn't kept in memory
+				key := string([]byte(rule))
+				other := duplicates[key]
+				if len(other) == 0 || other[len(other)-1] != int64(id) {
+					duplicates[key] = append(other, int64(id))
+				}
+				continue
+			}
+			owners[rule] = id
+			sb.WriteString(rule)
+			sb.WriteByte('\n')
+		}
+		result[id] = sb.String()
+	}
+
+	if removed != 0 {
+		log.Debug("Removed %d duplicate rules from %d filter lists", removed, len(filters))
+	}
+	return result, duplicates
+}
@@ -17,14 +17,17 @@ import (
 
 	"github.com/joomcode/errorx"
 
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"github.com/AdguardTeam/AdGuardHome/logging"
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/bluele/gcache"
 	"github.com/miekg/dns"
 	"golang.org/x/net/publicsuffix"
 )
 
+var log = logging.New("dnsfilter")
+
 const defaultCacheSize = 64 * 1024 // in number of elements
 const defaultCacheTime = 30 * time.Minute
 
@@ -44,6 +47,17 @@ type RequestFilteringSettings struct {
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
+	ServicesRules       []ServiceEntry
+	UnblockedDomains    []string // temporarily unblocked domains, their subdomains are unblocked too
+	ClientTags          []string // the rules with $ctag modifier for these tags are applied
+	ParentalCategories  []string // categories blocked by parental control, empty: all
+	BlockedClient       string   // the name of the client whose Internet access is paused: all its requests are blocked
+}
+
+// ServiceEntry - blocked service array element
+type ServiceEntry struct {
+	Name    string
+	Domains []string // the service's domains, their subdomains are blocked too
 }
 
 // Config allows you to configure DNS filtering with New() or just change variables directly.
@@ -56,6 +70,20 @@ type Config struct {
 	SafeBrowsingEnabled   bool   `yaml:"safebrowsing_enabled"`
 	ResolverAddress       string // DNS server address
 
+	// Categories blocked by parental control (empty: all)
+	ParentalCategories []string `yaml:"parental_categories"`
+	// File with the categorized domains: "domain category" on each line (empty: only the remote service is used)
+	ParentalCategoryDB string `yaml:"parental_category_db"`
+
+	Rewrites []RewriteEntry `yaml:"rewrites"` // local DNS records
+
+	// Maximum evaluation time of a regular expression user rule per request, in microseconds (0: default)
+	// The slower rules are disabled
+	RegexRuleBudget uint32 `yaml:"regex_rule_budget"`
+
+	// IDs of filter lists which may only block hosts, but not redirect them to other IP addresses
+	UntrustedFilters map[int64]bool `yaml:"-"`
+
 	// Filtering callback function
 	FilterHandler func(clientAddr string, settings *RequestFilteringSettings) `yaml:"-"`
 }
@@ -84,6 +112,13 @@ type Stats struct {
 type Dnsfilter struct {
 	rulesStorage    *urlfilter.RulesStorage
 	filteringEngine *urlfilter.DNSEngine
+	duplicateRules  map[string][]int64 // rule text -> IDs of the other lists containing the rule
+
+	// the rules for the tagged clients
+	ctagEngines   map[string]*urlfilter.DNSEngine // tag -> engine
+	ctagRuleTexts map[string]string               // rule without $ctag modifier -> original rule
+
+	categoryDB *categoryDB // categorized domains for parental control
 
 	// HTTP lookups for safebrowsing and parental
 	client    http.Client     // handle for http client -- single instance as recommended by docs
@@ -95,8 +130,9 @@ type Dnsfilter struct {
 
 // Filter represents a filter list
 type Filter struct {
-	ID   int64  `json:"id"`         // auto-assigned when filter is added (see nextFilterID), json by default keeps ID uppercase but we need lowercase
-	Data []byte `json:"-" yaml:"-"` // List of rules divided by '\n'
+	ID      int64  `json:"id"`                     // auto-assigned when filter is added (see nextFilterID), json by default keeps ID uppercase but we need lowercase
+	Data    []byte `json:"-" yaml:"-"`             // List of rules divided by '\n'
+	Trusted bool   `json:"trusted" yaml:"trusted"` // if false, the list's rules can't redirect hosts to other IP addresses
 }
 
 //go:generate stringer -type=Reason
@@ -126,6 +162,11 @@ const (
 	FilteredInvalid
 	// FilteredSafeSearch - the host was replaced with safesearch variant
 	FilteredSafeSearch
+	// FilteredBlockedService - the host belongs to a blocked service
+	FilteredBlockedService
+
+	// ReasonRewrite - the host is answered from the DNS rewrites
+	ReasonRewrite
 )
 
 // these variables need to survive coredns reload
@@ -144,6 +185,15 @@ type Result struct {
 	Rule       string `json:",omitempty"` // Original rule text
 	IP         net.IP `json:",omitempty"` // Not nil only in the case of a hosts file syntax
 	FilterID   int64  `json:",omitempty"` // Filter ID the rule belongs to
+
+	OtherFilterIDs []int64 `json:",omitempty"` // IDs of the other filter lists containing the same rule
+
+	ServiceName string `json:",omitempty"` // Name of the blocked service
+
+	Category string `json:",omitempty"` // Parental control category
+
+	CanonName string   `json:",omitempty"` // CNAME value for a rewritten host
+	IPList    []net.IP `json:",omitempty"` // IP addresses for a rewritten host
 }
 
 // Matched can be used to see if any match at all was found, no matter filtered or not
@@ -151,6 +201,11 @@ func (r Reason) Matched() bool {
 	return r != NotFilteredNotFound
 }
 
+// Get the rule text shown for the requests of the paused client
+func clientBlockedRule(name string) string {
+	return fmt.Sprintf("$client='%s',important", name)
+}
+
 // CheckHost tries to match host against rules, then safebrowsing and parental if they are enabled
 func (d *Dnsfilter) CheckHost(host string, qtype uint16, clientAddr string) (Result, error) {
 	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
@@ -168,18 +223,56 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, clientAddr string) (Res
 	setts.SafeSearchEnabled = d.SafeSearchEnabled
 	setts.SafeBrowsingEnabled = d.SafeBrowsingEnabled
 	setts.ParentalEnabled = d.ParentalEnabled
+	setts.ParentalCategories = d.ParentalCategories
 	if len(clientAddr) != 0 && d.FilterHandler != nil {
 		d.FilterHandler(clientAddr, &setts)
 	}
 
-	var result Result
+	// the client's pause takes precedence over anything else
+	if len(setts.BlockedClient) != 0 {
+		log.Tracef("Host %s is blocked: client %s is paused", host, setts.BlockedClient)
+		return Result{IsFiltered: true, Reason: FilteredBlackList, Rule: clientBlockedRule(setts.BlockedClient)}, nil
+	}
+
+	// local DNS records take precedence over anything else
+	result := d.CheckRewrites(host, qtype)
+	if result.Reason == ReasonRewrite {
+		return result, nil
+	}
+
+	if len(setts.UnblockedDomains) != 0 {
+		for _, domain := range setts.UnblockedDomains {
+			if matchDomain(host, domain) {
+				log.Tracef("Host %s is temporarily unblocked by %s", host, domain)
+				return Result{Reason: NotFilteredWhiteList, Rule: domain}, nil
+			}
+		}
+	}
+
 	var err error
-	// try filter lists first
+	// try filter lists first, the rules for the client's tags take precedence
 	if setts.FilteringEnabled {
+		result, err = d.matchCtagHost(host, qtype, setts.ClientTags)
+		if err != nil {
+			return result, err
+		}
+		if result.Reason.Matched() {
+			recordRuleHit(result.FilterID, result.Rule)
+			return result, nil
+		}
+
 		result, err = d.matchHost(host, qtype)
 		if err != nil {
 			return result, err
 		}
+		if result.Reason.Matched() {
+			recordRuleHit(result.FilterID, result.Rule)
+			return result, nil
+		}
+	}
+
+	if len(setts.ServicesRules) != 0 {
+		result = matchBlockedServices(host, setts.ServicesRules)
 		if result.Reason.Matched() {
 			return result, nil
 		}
@@ -213,6 +306,12 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, clientAddr string) (Res
 
 	// check parental if no match
 	if setts.ParentalEnabled {
+		result = d.checkParentalCategory(host, setts.ParentalCategories)
+		if result.Reason.Matched() {
+			return result, nil
+		}
+	}
+	if setts.ParentalEnabled && categoryEnabled(setts.ParentalCategories, CategoryAdult) {
 		result, err = d.checkParental(host)
 		if err != nil {
 			// failed to do HTTP lookup -- treat it as if we got empty response, but don't save cache
@@ -220,6 +319,7 @@ func (d *Dnsfilter) CheckHost(host string, qtype uint16, clientAddr string) (Res
 			return Result{}, nil
 		}
 		if result.Reason.Matched() {
+			result.Category = CategoryAdult
 			return result, nil
 		}
 	}
@@ -293,13 +393,13 @@ func hostnameToHashParam(host string, addslash bool) (string, map[string]bool) {
 }
 
 func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
-	if log.GetLevel() >= log.DEBUG {
+	if log.Enabled(logging.DEBUG) {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("SafeSearch HTTP lookup for %s", host)
 	}
 
 	if safeSearchCache == nil {
-		safeSearchCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
+		safeSearchCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Clock(clock.Current).Build()
 	}
 
 	// Check cache. Return cached result if it was found
@@ -314,7 +414,8 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 		return Result{}, err
 	}
 
-	safeHost, ok := d.SafeSearchDomain(host)
+	// the caller has already decided whether safe search is enabled for this client
+	safeHost, ok := safeSearchDomains[host]
 	if !ok {
 		return Result{}, nil
 	}
@@ -357,7 +458,7 @@ func (d *Dnsfilter) checkSafeSearch(host string) (Result, error) {
 }
 
 func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
-	if log.GetLevel() >= log.DEBUG {
+	if log.Enabled(logging.DEBUG) {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("SafeBrowsing HTTP lookup for %s", host)
 	}
@@ -396,14 +497,14 @@ func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
 		return result, nil
 	}
 	if safebrowsingCache == nil {
-		safebrowsingCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
+		safebrowsingCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Clock(clock.Current).Build()
 	}
 	result, err := d.lookupCommon(host, &stats.Safebrowsing, safebrowsingCache, true, format, handleBody)
 	return result, err
 }
 
 func (d *Dnsfilter) checkParental(host string) (Result, error) {
-	if log.GetLevel() >= log.DEBUG {
+	if log.Enabled(logging.DEBUG) {
 		timer := log.StartTimer()
 		defer timer.LogElapsed("Parental HTTP lookup for %s", host)
 	}
@@ -451,7 +552,7 @@ func (d *Dnsfilter) checkParental(host string) (Result, error) {
 		return result, nil
 	}
 	if parentalCache == nil {
-		parentalCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
+		parentalCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Clock(clock.Current).Build()
 	}
 	result, err := d.lookupCommon(host, &stats.Parental, parentalCache, false, format, handleBody)
 	return result, err
@@ -542,17 +643,26 @@ func (d *Dnsfilter) initFiltering(filters map[int]string) error {
 		return err
 	}
 
+	filters = d.guardUserRules(filters)
+	filters, tagged, texts := extractCtagRules(filters)
+	filters, d.duplicateRules = dedupRules(filters, d.UntrustedFilters)
 	d.filteringEngine = urlfilter.NewDNSEngine(filters, d.rulesStorage)
+	d.initCtagFiltering(tagged, texts)
 	return nil
 }
 
 // matchHost is a low-level way to check only if hostname is filtered by rules, skipping expensive safebrowsing and parental lookups
 func (d *Dnsfilter) matchHost(host string, qtype uint16) (Result, error) {
-	if d.filteringEngine == nil {
+	return d.matchEngine(d.filteringEngine, host, qtype)
+}
+
+// Match the host against the rules of the engine
+func (d *Dnsfilter) matchEngine(engine *urlfilter.DNSEngine, host string, qtype uint16) (Result, error) {
+	if engine == nil {
 		return Result{}, nil
 	}
 
-	rules, ok := d.filteringEngine.Match(host)
+	rules, ok := engine.Match(host)
 	if !ok {
 		return Result{}, nil
 	}
@@ -569,6 +679,7 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16) (Result, error) {
 		res.IsFiltered = true
 		res.FilterID = int64(rule.GetFilterListID())
 		res.Rule = rule.Text()
+		res.OtherFilterIDs = d.duplicateRules[res.Rule]
 
 		if netRule, ok := rule.(*urlfilter.NetworkRule); ok {
 
@@ -580,6 +691,14 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16) (Result, error) {
 
 		} else if hostRule, ok := rule.(*urlfilter.HostRule); ok {
 
+			if d.UntrustedFilters[res.FilterID] && !isNullIP(hostRule.IP) &&
+				(qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+				// an untrusted list may block the host, but it mustn't redirect it
+				log.Debug("Rule '%s' from untrusted list %d can't redirect '%s', blocking it instead",
+					rule.Text(), res.FilterID, host)
+				return res, nil
+			}
+
 			if qtype == dns.TypeA && hostRule.IP.To4() != nil {
 				// either IPv4 or IPv4-mapped IPv6 address
 				res.IP = hostRule.IP.To4()
@@ -596,6 +715,11 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16) (Result, error) {
 					res.IP = net.IPv6zero
 					return res, nil
 				}
+				if ip4.IsLoopback() {
+					// send IP="::1" response for a rule "127.0.0.1 blockdomain"
+					res.IP = net.IPv6loopback
+					return res, nil
+				}
 			}
 			continue
 
@@ -608,6 +732,34 @@ func (d *Dnsfilter) matchHost(host string, qtype uint16) (Result, error) {
 	return Result{}, nil
 }
 
+// matchBlockedServices checks if the host belongs to one of the blocked services
+func matchBlockedServices(host string, services []ServiceEntry) Result {
+	for _, svc := range services {
+		for _, domain := range svc.Domains {
+			if matchDomain(host, domain) {
+				log.Tracef("Host %s is blocked by service %s", host, svc.Name)
+				return Result{
+					IsFiltered:  true,
+					Reason:      FilteredBlockedService,
+					Rule:        domain,
+					ServiceName: svc.Name,
+				}
+			}
+		}
+	}
+	return Result{}
+}
+
+// Return TRUE if the host is the domain or its subdomain
+func matchDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Return TRUE if a hosts rule with this IP address just blocks the host
+func isNullIP(ip net.IP) bool {
+	return ip.IsUnspecified() || ip.IsLoopback()
+}
+
 //
 // lifecycle helper functions
 //
@@ -714,7 +866,7 @@ func New(c *Config, filters map[int]string) *Dnsfilter {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 	if c != nil && len(c.ResolverAddress) != 0 {
-		dialCache = gcache.New(maxDialCacheSize).LRU().Expiration(defaultCacheTime).Build()
+		dialCache = gcache.New(maxDialCacheSize).LRU().Expiration(defaultCacheTime).Clock(clock.Current).Build()
 		d.transport.DialContext = d.createCustomDialContext(c.ResolverAddress)
 	}
 	d.client = http.Client{
@@ -726,6 +878,9 @@ func New(c *Config, filters map[int]string) *Dnsfilter {
 	if c != nil {
 		d.Config = *c
 	}
+	if len(d.ParentalCategoryDB) != 0 {
+		d.categoryDB = loadCategoryDB(d.ParentalCategoryDB)
+	}
 
 	if filters != nil {
 		err := d.initFiltering(filters)
@@ -2,9 +2,11 @@ package dnsfilter
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
 	"runtime"
 	"testing"
@@ -19,6 +21,121 @@ import (
 // PARENTAL
 // FILTERING
 // CLIENTS SETTINGS
+func TestUntrustedFilter(t *testing.T) {
+	filters := make(map[int]string)
+	filters[1] = "1.2.3.4 bank.example.org\n0.0.0.0 ads.example.org\n"
+	d := NewForTestFilters(filters)
+	defer d.Destroy()
+	d.UntrustedFilters = map[int64]bool{1: true}
+
+	// an untrusted list can't redirect the host, it's blocked instead
+	r, _ := d.CheckHost("bank.example.org", dns.TypeA, "")
+	if !r.IsFiltered || r.IP != nil {
+		t.Fatalf("CheckHost - untrusted redirect: %v", r)
+	}
+
+	// but it still can block hosts
+	r, _ = d.CheckHost("ads.example.org", dns.TypeA, "")
+	if !r.IsFiltered || !r.IP.Equal(net.IPv4zero) {
+		t.Fatalf("CheckHost - untrusted block: %v", r)
+	}
+
+	// the same rules from a trusted list work as usual
+	d.UntrustedFilters = nil
+	r, _ = d.CheckHost("bank.example.org", dns.TypeA, "")
+	if !r.IsFiltered || !r.IP.Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Fatalf("CheckHost - trusted redirect: %v", r)
+	}
+}
+
+func TestBlockedServices(t *testing.T) {
+	services := []ServiceEntry{
+		{Name: "facebook", Domains: []string{"facebook.com", "fbcdn.net"}},
+	}
+
+	r := matchBlockedServices("www.facebook.com", services)
+	if !r.IsFiltered || r.Reason != FilteredBlockedService || r.ServiceName != "facebook" {
+		t.Fatalf("matchBlockedServices: %v", r)
+	}
+
+	r = matchBlockedServices("fbcdn.net", services)
+	if !r.IsFiltered {
+		t.Fatalf("matchBlockedServices - domain itself")
+	}
+
+	r = matchBlockedServices("notfacebook.com", services)
+	if r.IsFiltered {
+		t.Fatalf("matchBlockedServices - suffix of another domain")
+	}
+}
+
+func TestUnblockedDomains(t *testing.T) {
+	d := NewForTestFilters(map[int]string{0: "||example.org^\n"})
+	defer d.Destroy()
+	d.FilterHandler = func(clientAddr string, settings *RequestFilteringSettings) {
+		settings.UnblockedDomains = []string{"example.org"}
+	}
+
+	r, _ := d.CheckHost("www.example.org", dns.TypeA, "1.1.1.1")
+	if r.IsFiltered || r.Reason != NotFilteredWhiteList || r.Rule != "example.org" {
+		t.Fatalf("CheckHost - unblocked domain: %v", r)
+	}
+}
+
+func TestBlockedClient(t *testing.T) {
+	d := NewForTestFilters(map[int]string{0: "@@||example.org^$important\n"})
+	defer d.Destroy()
+	d.FilterHandler = func(clientAddr string, settings *RequestFilteringSettings) {
+		if clientAddr == "1.1.1.1" {
+			settings.BlockedClient = "Timmy"
+		}
+	}
+
+	r, _ := d.CheckHost("www.example.org", dns.TypeA, "1.1.1.1")
+	if !r.IsFiltered || r.Reason != FilteredBlackList || r.Rule != "$client='Timmy',important" {
+		t.Fatalf("CheckHost - paused client: %v", r)
+	}
+	r, _ = d.CheckHost("www.example.org", dns.TypeA, "2.2.2.2")
+	if r.IsFiltered {
+		t.Fatalf("CheckHost - another client: %v", r)
+	}
+}
+
+func TestCtagRules(t *testing.T) {
+	rule, tags := parseCtagRule("||example.org^$important,ctag=device_phone|user_child")
+	if rule != "||example.org^$important" || len(tags) != 2 || tags[0] != "device_phone" || tags[1] != "user_child" {
+		t.Fatalf("parseCtagRule: %s %v", rule, tags)
+	}
+	rule, tags = parseCtagRule("/example[0-9]$/")
+	if rule != "/example[0-9]$/" || tags != nil {
+		t.Fatalf("parseCtagRule for a regular expression: %s %v", rule, tags)
+	}
+
+	d := NewForTestFilters(map[int]string{0: "||example.org^$ctag=user_child\n@@||example.net^$ctag=user_admin\n||example.net^\n"})
+	defer d.Destroy()
+	tagsByClient := map[string][]string{"1.1.1.1": {"user_child"}, "2.2.2.2": {"user_admin", "os_windows"}}
+	d.FilterHandler = func(clientAddr string, settings *RequestFilteringSettings) {
+		settings.ClientTags = tagsByClient[clientAddr]
+	}
+
+	r, _ := d.CheckHost("www.example.org", dns.TypeA, "1.1.1.1")
+	if !r.IsFiltered || r.Rule != "||example.org^$ctag=user_child" {
+		t.Fatalf("CheckHost - tagged client: %v", r)
+	}
+	r, _ = d.CheckHost("www.example.org", dns.TypeA, "2.2.2.2")
+	if r.IsFiltered {
+		t.Fatalf("CheckHost - client without the tag: %v", r)
+	}
+	r, _ = d.CheckHost("example.net", dns.TypeA, "1.1.1.1")
+	if !r.IsFiltered || r.Rule != "||example.net^" {
+		t.Fatalf("CheckHost - the rule for all clients: %v", r)
+	}
+	r, _ = d.CheckHost("example.net", dns.TypeA, "2.2.2.2")
+	if r.IsFiltered || r.Reason != NotFilteredWhiteList {
+		t.Fatalf("CheckHost - the tagged client is whitelisted: %v", r)
+	}
+}
+
 // BENCHMARKS
 
 // HELPERS
@@ -90,7 +207,7 @@ func (d *Dnsfilter) checkMatchEmpty(t *testing.T, hostname string) {
 func TestEtcHostsMatching(t *testing.T) {
 	addr := "216.239.38.120"
 	addr6 := "::1"
-	text := fmt.Sprintf("   %s  google.com www.google.com   # enforce google's safesearch   \n%s  google.com\n0.0.0.0 block.com\n",
+	text := fmt.Sprintf("   %s  google.com www.google.com   # enforce google's safesearch   \n%s  google.com\n0.0.0.0 block.com\n127.0.0.1 local.com\n",
 		addr, addr6)
 	filters := make(map[int]string)
 	filters[0] = text
@@ -108,6 +225,8 @@ func TestEtcHostsMatching(t *testing.T) {
 	// block both IPv4 and IPv6
 	d.checkMatchIP(t, "block.com", "0.0.0.0", dns.TypeA)
 	d.checkMatchIP(t, "block.com", "::", dns.TypeAAAA)
+	d.checkMatchIP(t, "local.com", "127.0.0.1", dns.TypeA)
+	d.checkMatchIP(t, "local.com", "::1", dns.TypeAAAA)
 }
 
 // SAFE BROWSING
@@ -464,6 +583,7 @@ func TestMatching(t *testing.T) {
 func applyClientSettings(clientAddr string, setts *RequestFilteringSettings) {
 	setts.FilteringEnabled = false
 	setts.ParentalEnabled = false
+	setts.SafeSearchEnabled = true
 }
 
 func TestClientSettings(t *testing.T) {
@@ -503,6 +623,49 @@ func TestClientSettings(t *testing.T) {
 	if r.IsFiltered {
 		t.Fatalf("CheckHost")
 	}
+
+	// override safesearch settings (disabled globally)
+	r, _ = d.CheckHost("yandex.ru", dns.TypeA, "1.1.1.1")
+	if !r.IsFiltered || r.Reason != FilteredSafeSearch {
+		t.Fatalf("CheckHost FilteredSafeSearch")
+	}
+}
+
+func TestParentalCategories(t *testing.T) {
+	f, err := ioutil.TempFile("", "agh-categories")
+	if err != nil {
+		t.Fatalf("TempFile: %s", err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("# test\ncasino.example gambling\nDrugs.Example. drugs\ninvalid.example unknown\n")
+	_ = f.Close()
+
+	d := New(&Config{ParentalEnabled: true, ParentalCategories: []string{CategoryGambling}, ParentalCategoryDB: f.Name()}, nil)
+	defer d.Destroy()
+	if st := GetCategoryDBStatus(); st.Domains != 2 || len(st.Error) != 0 {
+		t.Fatalf("GetCategoryDBStatus: %+v", st)
+	}
+
+	r, _ := d.CheckHost("www.casino.example", dns.TypeA, "")
+	if !r.IsFiltered || r.Reason != FilteredParental || r.Category != CategoryGambling {
+		t.Fatalf("CheckHost - blocked category: %+v", r)
+	}
+	r, _ = d.CheckHost("drugs.example", dns.TypeA, "")
+	if r.IsFiltered {
+		t.Fatalf("CheckHost - category isn't selected: %+v", r)
+	}
+
+	d.FilterHandler = func(clientAddr string, settings *RequestFilteringSettings) {
+		settings.ParentalCategories = []string{CategoryDrugs}
+	}
+	r, _ = d.CheckHost("drugs.example", dns.TypeA, "1.1.1.1")
+	if !r.IsFiltered || r.Category != CategoryDrugs {
+		t.Fatalf("CheckHost - client's category: %+v", r)
+	}
+
+	if CheckParentalCategories([]string{CategoryAdult, CategoryViolence}) != nil || CheckParentalCategories([]string{"news"}) == nil {
+		t.Fatalf("CheckParentalCategories")
+	}
 }
 
 // BENCHMARKS
@@ -572,3 +735,136 @@ func BenchmarkSafeSearchParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestRewrites(t *testing.T) {
+	d := NewForTest()
+	defer d.Destroy()
+	d.Rewrites = []RewriteEntry{
+		{Domain: "nas.home", Answer: "192.168.1.5"},
+		{Domain: "nas.home", Answer: "fd00::5"},
+		{Domain: "*.lab.home", Answer: "10.0.0.2"},
+		{Domain: "*.dev.lab.home", Answer: "10.0.0.3"},
+		{Domain: "files.home", Answer: "nas.home"},
+		{Domain: "mirror.home", Answer: "example.org"},
+	}
+
+	r := d.CheckRewrites("nas.home", dns.TypeA)
+	if r.Reason != ReasonRewrite || len(r.IPList) != 1 || !r.IPList[0].Equal(net.IPv4(192, 168, 1, 5)) {
+		t.Fatalf("CheckRewrites - A: %v", r)
+	}
+	r = d.CheckRewrites("nas.home", dns.TypeAAAA)
+	if r.Reason != ReasonRewrite || len(r.IPList) != 1 || !r.IPList[0].Equal(net.ParseIP("fd00::5")) {
+		t.Fatalf("CheckRewrites - AAAA: %v", r)
+	}
+
+	// wildcard, the longest one wins
+	r = d.CheckRewrites("host.lab.home", dns.TypeA)
+	if r.Reason != ReasonRewrite || !r.IPList[0].Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("CheckRewrites - wildcard: %v", r)
+	}
+	r = d.CheckRewrites("host.dev.lab.home", dns.TypeA)
+	if r.Reason != ReasonRewrite || !r.IPList[0].Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Fatalf("CheckRewrites - longest wildcard: %v", r)
+	}
+	r = d.CheckRewrites("lab.home", dns.TypeA)
+	if r.Reason == ReasonRewrite {
+		t.Fatalf("CheckRewrites - wildcard doesn't match the domain itself: %v", r)
+	}
+
+	// CNAME within rewrites
+	r = d.CheckRewrites("files.home", dns.TypeA)
+	if r.Reason != ReasonRewrite || r.CanonName != "nas.home" || len(r.IPList) != 1 {
+		t.Fatalf("CheckRewrites - CNAME: %v", r)
+	}
+
+	// CNAME to be resolved by upstream
+	r = d.CheckRewrites("mirror.home", dns.TypeA)
+	if r.Reason != ReasonRewrite || r.CanonName != "example.org" || len(r.IPList) != 0 {
+		t.Fatalf("CheckRewrites - external CNAME: %v", r)
+	}
+}
+
+func TestRuleStats(t *testing.T) {
+	ResetRuleStats()
+	defer ResetRuleStats()
+
+	recordRuleHit(1, "||example.org^")
+	recordRuleHit(1, "||example.org^")
+	recordRuleHit(1, "||example.com^")
+	recordRuleHit(1, "||example.net^")
+	recordRuleHit(2, "@@||example.org^")
+
+	st := GetRuleStats(2)
+	if len(st) != 2 || st[0].FilterID != 1 || st[1].FilterID != 2 {
+		t.Fatalf("GetRuleStats: %v", st)
+	}
+	if st[0].TotalHits != 4 || len(st[0].Rules) != 2 ||
+		st[0].Rules[0].Rule != "||example.org^" || st[0].Rules[0].Hits != 2 ||
+		st[0].Rules[1].Rule != "||example.com^" {
+		t.Fatalf("GetRuleStats: %v", st[0])
+	}
+
+	st = GetRuleStats(0)
+	if len(st[0].Rules) != 3 {
+		t.Fatalf("GetRuleStats - no limit: %v", st[0])
+	}
+}
+
+func TestDuplicateRules(t *testing.T) {
+	filters := make(map[int]string)
+	filters[1] = "! comment\n||example.org^\n||example.org^\n0.0.0.0 ads.example.org\n"
+	filters[2] = "||example.org^\n||only2.example.org^\n"
+	filters[3] = "1.2.3.4 ads.example.org\n||example.org^\n"
+
+	lists, duplicates := dedupRules(filters, map[int64]bool{1: true})
+	if lists[1] != "0.0.0.0 ads.example.org\n" ||
+		lists[2] != "||example.org^\n||only2.example.org^\n" ||
+		lists[3] != "1.2.3.4 ads.example.org\n" {
+		t.Fatalf("dedupRules: %v", lists)
+	}
+	other := duplicates["||example.org^"]
+	if len(other) != 2 || other[0] != 3 || other[1] != 1 {
+		t.Fatalf("dedupRules - duplicates: %v", duplicates)
+	}
+
+	d := New(&Config{UntrustedFilters: map[int64]bool{1: true}}, filters)
+	defer d.Destroy()
+	r, _ := d.CheckHost("example.org", dns.TypeA, "")
+	if !r.IsFiltered || r.FilterID != 2 || len(r.OtherFilterIDs) != 2 {
+		t.Fatalf("CheckHost - duplicate rule: %v", r)
+	}
+	r, _ = d.CheckHost("only2.example.org", dns.TypeA, "")
+	if !r.IsFiltered || r.FilterID != 2 || len(r.OtherFilterIDs) != 0 {
+		t.Fatalf("CheckHost - unique rule: %v", r)
+	}
+}
+
+func TestRegexGuard(t *testing.T) {
+	for rule, re := range map[string]string{
+		"/ads[0-9]+\\./":          "ads[0-9]+\\.",
+		"@@/^track\\./$important": "^track\\.",
+	} {
+		got, ok := ruleRegex(rule)
+		if !ok || got != re {
+			t.Fatalf("ruleRegex(%s): %s %v", rule, got, ok)
+		}
+	}
+	for _, rule := range []string{"||example.org^", "/path/to/file", "/"} {
+		if _, ok := ruleRegex(rule); ok {
+			t.Fatalf("ruleRegex(%s) must not be a regular expression", rule)
+		}
+	}
+
+	text := "||example.org^\n/ads[0-9]+\\./\n/[a-z]{1000}[0-9]{1000}x{1000}/\n/ads(/\n"
+	res, problems := guardRegexRules(text, time.Second)
+	if res != "||example.org^\n/ads[0-9]+\\./\n" || len(problems) != 2 ||
+		problems[0].Rule != "/[a-z]{1000}[0-9]{1000}x{1000}/" || problems[1].Rule != "/ads(/" {
+		t.Fatalf("guardRegexRules: %q %v", res, problems)
+	}
+
+	// every rule is slower than 1 nanosecond
+	_, problems = guardRegexRules(text, time.Nanosecond)
+	if len(problems) != 3 {
+		t.Fatalf("guardRegexRules: %v", problems)
+	}
+}
@@ -0,0 +1,156 @@
+// Protection from slow regular expression rules
+// A regular expression rule can't be indexed, so it's evaluated for every request.
+// The user rules which are too complex or too slow are disabled and reported.
+
+package dnsfilter
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxRegexLength         = 1024 // maximum length of the regular expression
+	maxRegexInstructions   = 3000 // maximum size of the compiled program
+	defaultRegexRuleBudget = 100 * time.Microsecond
+	regexBenchmarkRounds   = 10
+)
+
+// The inputs a rule is tested on: the longest host name is the worst case
+var regexBenchmarkInputs = []string{
+	strings.Repeat("abcdefghi.", 25) + "com",
+	"http://" + strings.Repeat("a1-b2.", 42) + "org/",
+}
+
+// RegexRuleProblem describes a regular expression rule which has been disabled
+type RegexRuleProblem struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// the problems are read by the API, which doesn't have access to the current Dnsfilter object
+var regexProblems = struct {
+	sync.Mutex
+	list []RegexRuleProblem
+}{}
+
+// GetRegexRuleProblems returns the user rules disabled by the last filters reload
+func GetRegexRuleProblems() []RegexRuleProblem {
+	regexProblems.Lock()
+	list := append([]RegexRuleProblem{}, regexProblems.list...)
+	regexProblems.Unlock()
+	return list
+}
+
+// Get the regular expression of the rule
+// Returns FALSE if it's not a regular expression rule
+func ruleRegex(rule string) (string, bool) {
+	rule = strings.TrimPrefix(rule, "@@")
+	if len(rule) < 2 || rule[0] != '/' {
+		return "", false
+	}
+	end := strings.LastIndexByte(rule, '/')
+	if end == 0 {
+		return "", false
+	}
+	if end != len(rule)-1 && rule[end+1] != '$' {
+		// e.g. "/path/to/file" is a pattern, not a regular expression
+		return "", false
+	}
+	return rule[1:end], true
+}
+
+// Check the complexity of the regular expression
+// Returns the description of the problem or an empty string
+func checkRegex(re string, budget time.Duration) string {
+	if len(re) > maxRegexLength {
+		return fmt.Sprintf("regular expression is too long: %d characters", len(re))
+	}
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return fmt.Sprintf("invalid regular expression: %s", err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return fmt.Sprintf("invalid regular expression: %s", err)
+	}
+	if len(prog.Inst) > maxRegexInstructions {
+		return fmt.Sprintf("regular expression is too complex: %d instructions", len(prog.Inst))
+	}
+
+	// the evaluation time is linear in the length of the input,
+	// so the time for the longest input is the upper bound for a request
+	compiled, err := regexp.Compile(re)
+	if err != nil {
+		return fmt.Sprintf("invalid regular expression: %s", err)
+	}
+	// the fastest round is taken, so a GC pause doesn't disable a good rule
+	for _, input := range regexBenchmarkInputs {
+		compiled.MatchString(input) // warm up
+		var fastest time.Duration
+		for i := 0; i < regexBenchmarkRounds; i++ {
+			start := time.Now()
+			compiled.MatchString(input)
+			elapsed := time.Since(start)
+			if i == 0 || elapsed < fastest {
+				fastest = elapsed
+			}
+		}
+		if fastest > budget {
+			return fmt.Sprintf("regular expression is too slow: %v per request, the limit is %v", fastest, budget)
+		}
+	}
+	return ""
+}
+
+// guardRegexRules removes the slow regular expression rules from the filter data
+// Returns the new filter data and the removed rules
+func guardRegexRules(text string, budget time.Duration) (string, []RegexRuleProblem) {
+	problems := []RegexRuleProblem{}
+	lines := strings.Split(text, "\n")
+	n := 0
+	for _, line := range lines {
+		re, ok := ruleRegex(strings.TrimSpace(line))
+		if ok {
+			reason := checkRegex(re, budget)
+			if len(reason) != 0 {
+				log.Info("Disabled rule %s: %s", strings.TrimSpace(line), reason)
+				problems = append(problems, RegexRuleProblem{Rule: strings.TrimSpace(line), Reason: reason})
+				continue
+			}
+		}
+		lines[n] = line
+		n++
+	}
+	if len(problems) == 0 {
+		return text, problems
+	}
+	return strings.Join(lines[:n], "\n"), problems
+}
+
+// Remove the slow regular expressions from the user rules and remember the problems
+// Returns the new filters map, the original one isn't modified
+func (d *Dnsfilter) guardUserRules(filters map[int]string) map[int]string {
+	budget := time.Duration(d.RegexRuleBudget) * time.Microsecond
+	if budget == 0 {
+		budget = defaultRegexRuleBudget
+	}
+
+	result := map[int]string{}
+	for id, text := range filters {
+		result[id] = text
+	}
+	problems := []RegexRuleProblem{}
+	text, ok := filters[0]
+	if ok {
+		result[0], problems = guardRegexRules(text, budget)
+	}
+	regexProblems.Lock()
+	regexProblems.list = problems
+	regexProblems.Unlock()
+	return result
+}
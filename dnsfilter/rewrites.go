@@ -0,0 +1,117 @@
+// DNS Rewrites
+
+package dnsfilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const maxRewriteCNAMEs = 10 // the maximum length of a CNAME chain within rewrites
+
+// RewriteEntry is a rewrite array element
+// Domain is either an exact host name or a wildcard: "*.example.org" matches all subdomains of example.org
+// Answer is an IP address (A or AAAA answer) or a host name (CNAME answer)
+type RewriteEntry struct {
+	Domain string `yaml:"domain"`
+	Answer string `yaml:"answer"`
+}
+
+// IsWildcard returns TRUE if the entry matches all subdomains of a domain
+func (r *RewriteEntry) IsWildcard() bool {
+	return strings.HasPrefix(r.Domain, "*.")
+}
+
+// match returns TRUE if the entry matches the host
+func (r *RewriteEntry) match(host string) bool {
+	if r.IsWildcard() {
+		return strings.HasSuffix(host, r.Domain[1:])
+	}
+	return host == r.Domain
+}
+
+// CheckRewriteEntry returns an error if the entry is invalid
+func CheckRewriteEntry(r RewriteEntry) error {
+	domain := strings.TrimPrefix(r.Domain, "*.")
+	if len(domain) == 0 || strings.ContainsAny(domain, " *") {
+		return fmt.Errorf("invalid domain: %s", r.Domain)
+	}
+	if len(r.Answer) == 0 || strings.ContainsAny(r.Answer, " *") {
+		return fmt.Errorf("invalid answer: %s", r.Answer)
+	}
+	return nil
+}
+
+// findRewrites returns the entries for the host
+// Exact matches take precedence over wildcards, the longest wildcard wins
+func findRewrites(rewrites []RewriteEntry, host string) []RewriteEntry {
+	var exact []RewriteEntry
+	var wild []RewriteEntry
+	for _, r := range rewrites {
+		if !r.match(host) {
+			continue
+		}
+		if !r.IsWildcard() {
+			exact = append(exact, r)
+			continue
+		}
+		if len(wild) != 0 && len(wild[0].Domain) > len(r.Domain) {
+			continue
+		}
+		if len(wild) != 0 && len(wild[0].Domain) < len(r.Domain) {
+			wild = nil
+		}
+		wild = append(wild, r)
+	}
+
+	if len(exact) != 0 {
+		return exact
+	}
+	return wild
+}
+
+// CheckRewrites checks the host against the configured DNS rewrites
+// If a rewrite is found, the result reason is ReasonRewrite.
+// CanonName is set if the host is an alias for another host name.
+// IPList contains the addresses of the requested type, if it's empty and CanonName is set,
+// the canonical name must be resolved by upstream servers.
+func (d *Dnsfilter) CheckRewrites(host string, qtype uint16) Result {
+	res := Result{}
+	host = strings.ToLower(host)
+
+	for i := 0; i != maxRewriteCNAMEs; i++ {
+		rr := findRewrites(d.Rewrites, host)
+		if len(rr) == 0 {
+			return res
+		}
+		res.Reason = ReasonRewrite
+
+		cname := ""
+		res.IPList = nil
+		for _, r := range rr {
+			ip := net.ParseIP(r.Answer)
+			if ip == nil {
+				cname = strings.ToLower(strings.TrimSuffix(r.Answer, "."))
+				break
+			}
+			if qtype == dns.TypeA && ip.To4() != nil {
+				res.IPList = append(res.IPList, ip.To4())
+			} else if qtype == dns.TypeAAAA && ip.To4() == nil {
+				res.IPList = append(res.IPList, ip)
+			}
+		}
+		if len(cname) == 0 || cname == host {
+			return res
+		}
+
+		log.Debug("Rewrite: CNAME for %s is %s", host, cname)
+		res.CanonName = cname
+		host = cname
+	}
+
+	log.Debug("Rewrite: CNAME chain for %s is too long", host)
+	return res
+}
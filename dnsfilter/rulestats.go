@@ -0,0 +1,80 @@
+// Filtering rule hit counters
+
+package dnsfilter
+
+import (
+	"sort"
+	"sync"
+)
+
+// RuleHits is the number of times a rule has matched a request
+type RuleHits struct {
+	Rule string `json:"rule"`
+	Hits uint64 `json:"hits"`
+}
+
+// FilterRuleStats holds the hit counters of a filter list
+type FilterRuleStats struct {
+	FilterID  int64      `json:"id"`
+	TotalHits uint64     `json:"total_hits"` // the number of matches of all rules of the list
+	Rules     []RuleHits `json:"rules"`      // the most frequently matched rules, sorted by hits
+}
+
+// the counters need to survive filters reload, that's why they aren't stored in Dnsfilter
+var ruleHits = struct {
+	sync.Mutex
+	filters map[int64]map[string]uint64 // filter ID -> rule text -> hits
+}{filters: map[int64]map[string]uint64{}}
+
+// recordRuleHit increments the hit counter of the rule
+func recordRuleHit(filterID int64, rule string) {
+	ruleHits.Lock()
+	rules, ok := ruleHits.filters[filterID]
+	if !ok {
+		rules = map[string]uint64{}
+		ruleHits.filters[filterID] = rules
+	}
+	rules[rule]++
+	ruleHits.Unlock()
+}
+
+// GetRuleStats returns the hit counters for every filter list that has matched at least once
+// topN is the maximum number of rules returned per list, 0 means no limit
+func GetRuleStats(topN int) []FilterRuleStats {
+	ruleHits.Lock()
+	list := []FilterRuleStats{}
+	for id, rules := range ruleHits.filters {
+		fs := FilterRuleStats{FilterID: id}
+		for rule, hits := range rules {
+			fs.TotalHits += hits
+			fs.Rules = append(fs.Rules, RuleHits{Rule: rule, Hits: hits})
+		}
+		list = append(list, fs)
+	}
+	ruleHits.Unlock()
+
+	for i := range list {
+		rules := list[i].Rules
+		sort.Slice(rules, func(a, b int) bool {
+			if rules[a].Hits != rules[b].Hits {
+				return rules[a].Hits > rules[b].Hits
+			}
+			return rules[a].Rule < rules[b].Rule
+		})
+		if topN > 0 && len(rules) > topN {
+			list[i].Rules = rules[:topN]
+		}
+	}
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].FilterID < list[b].FilterID
+	})
+	return list
+}
+
+// ResetRuleStats clears all rule hit counters
+func ResetRuleStats() {
+	ruleHits.Lock()
+	ruleHits.filters = map[int64]map[string]uint64{}
+	ruleHits.Unlock()
+}
@@ -0,0 +1,59 @@
+// Bogus NXDOMAIN
+// Some ISPs respond with the address of their search or ads page instead of NXDOMAIN.
+// The answers with these addresses are replaced with NXDOMAIN.
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Parse the list of IP addresses and CIDRs
+func parseBogusNXDomain(list []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range list {
+		ip := net.ParseIP(s)
+		if ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bogus_nxdomain: %s is neither IP address nor CIDR", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Return TRUE if the response has an address from the bogus NXDOMAIN list
+func (s *Server) isBogusNXDomain(res *dns.Msg) bool {
+	if len(s.bogusNXDomain) == 0 || res == nil {
+		return false
+	}
+	for _, rr := range res.Answer {
+		var ip net.IP
+		switch a := rr.(type) {
+		case *dns.A:
+			ip = a.A
+		case *dns.AAAA:
+			ip = a.AAAA
+		default:
+			continue
+		}
+		for _, n := range s.bogusNXDomain {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+// DNS responses cache
+// The responses are kept until their TTL expires, the negative responses (NXDOMAIN and NODATA)
+// are cached for the SOA minimum TTL as described in RFC 2308.
+// In optimistic mode the expired responses are served with a short TTL while they're refreshed in background.
+
+package dnsforward
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// TTL of an expired response served in optimistic mode
+const optimisticTTL = 10
+
+type cacheItem struct {
+	key    string
+	packed []byte    // the packed response
+	stored time.Time // when the response was stored
+	expire time.Time
+}
+
+type dnsCache struct {
+	maxSize int    // memory budget: the total size of the packed responses, in bytes
+	minTTL  uint32 // the lower TTLs are raised to this value (0: not used)
+	maxTTL  uint32 // the higher TTLs are lowered to this value (0: not used)
+
+	// serve the expired responses (up to staleMaxAge) and refresh them in background
+	optimistic bool
+
+	lock       sync.Mutex
+	items      map[string]*list.Element
+	lru        *list.List      // the recently used items are at the front
+	size       int             // the total size of the packed responses
+	refreshing map[string]bool // the keys being refreshed
+}
+
+// Create a cache
+// Returns nil if the cache is disabled (size is 0)
+func newDNSCache(size int, minTTL, maxTTL uint32, optimistic bool) *dnsCache {
+	if size <= 0 {
+		return nil
+	}
+	return &dnsCache{
+		maxSize:    size,
+		minTTL:     minTTL,
+		maxTTL:     maxTTL,
+		optimistic: optimistic,
+		items:      map[string]*list.Element{},
+		lru:        list.New(),
+		refreshing: map[string]bool{},
+	}
+}
+
+// Get the cache key for the request
+// The response depends on whether the client supports EDNS and DNSSEC, and on the client's subnet,
+// so these are a part of the key.
+func cacheKey(req *dns.Msg) string {
+	if len(req.Question) != 1 {
+		return ""
+	}
+	q := req.Question[0]
+	key := strings.ToLower(q.Name) + " " + dns.TypeToString[q.Qtype] + " " + dns.ClassToString[q.Qclass]
+	opt := req.IsEdns0()
+	if opt != nil {
+		key += " edns"
+		if opt.Do() {
+			key += " do"
+		}
+		ecs := getECS(req)
+		if ecs != nil {
+			key += fmt.Sprintf(" ecs %s/%d", ecs.Address, ecs.SourceNetmask)
+		}
+	}
+	return key
+}
+
+// Apply the min and max TTL settings
+func (c *dnsCache) clampTTL(ttl uint32) uint32 {
+	if c.minTTL != 0 && ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL != 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// Get the time the response may be cached for, 0: it mustn't be cached
+// The record TTLs are adjusted according to the min and max TTL settings.
+func (c *dnsCache) responseTTL(res *dns.Msg) uint32 {
+	if res.Truncated {
+		return 0
+	}
+
+	ttl := uint32(0)
+	found := false
+	switch {
+	case res.Rcode == dns.RcodeSuccess && len(res.Answer) != 0:
+		for _, rrs := range [][]dns.RR{res.Answer, res.Ns} {
+			for _, rr := range rrs {
+				rr.Header().Ttl = c.clampTTL(rr.Header().Ttl)
+				if !found || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+					found = true
+				}
+			}
+		}
+
+	case res.Rcode == dns.RcodeSuccess || res.Rcode == dns.RcodeNameError:
+		// negative response: SOA record tells how long it may be cached (RFC 2308 5)
+		for _, rr := range res.Ns {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			ttl = c.clampTTL(ttl)
+			soa.Hdr.Ttl = ttl
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0
+	}
+	return ttl
+}
+
+// Store the response
+func (c *dnsCache) set(key string, res *dns.Msg) {
+	if len(key) == 0 || res == nil {
+		return
+	}
+	res = res.Copy()
+	ttl := c.responseTTL(res)
+	if ttl == 0 {
+		return
+	}
+	packed, err := res.Pack()
+	if err != nil {
+		log.Debug("Cache: couldn't pack the response: %s", err)
+		return
+	}
+	if len(packed) > c.maxSize {
+		return
+	}
+
+	now := clock.Now()
+	item := &cacheItem{
+		key:    key,
+		packed: packed,
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if ok {
+		c.remove(e)
+	}
+	c.items[key] = c.lru.PushFront(item)
+	c.size += len(packed)
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Remove the item
+// Must be called with the lock held
+func (c *dnsCache) remove(e *list.Element) {
+	item := c.lru.Remove(e).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= len(item.packed)
+}
+
+// Get the response for the request, or nil if it's not in cache
+// The record TTLs are decreased by the time the response has been in cache.
+// expired: the response has expired and must be refreshed (optimistic mode only)
+func (c *dnsCache) get(key string, req *dns.Msg) (res *dns.Msg, expired bool) {
+	if len(key) == 0 {
+		return nil, false
+	}
+	now := clock.Now()
+
+	c.lock.Lock()
+	e, ok := c.items[key]
+	if !ok {
+		c.lock.Unlock()
+		return nil, false
+	}
+	item := e.Value.(*cacheItem)
+	expired = !now.Before(item.expire)
+	if expired && (!c.optimistic || now.Sub(item.expire) >= staleMaxAge) {
+		c.remove(e)
+		c.lock.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	c.lock.Unlock()
+
+	res = &dns.Msg{}
+	err := res.Unpack(item.packed)
+	if err != nil {
+		log.Debug("Cache: couldn't unpack the response: %s", err)
+		return nil, false
+	}
+
+	elapsed := uint32(now.Sub(item.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if expired {
+				hdr.Ttl = optimisticTTL
+			} else if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	res.Id = req.Id
+	res.Question = []dns.Question{req.Question[0]}
+	return res, expired
+}
+
+// Mark the key as being refreshed
+// Returns FALSE if it's already being refreshed
+func (c *dnsCache) startRefresh(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *dnsCache) endRefresh(key string) {
+	c.lock.Lock()
+	delete(c.refreshing, key)
+	c.lock.Unlock()
+}
+
+// Remove all responses
+func (c *dnsCache) clear() {
+	c.lock.Lock()
+	c.items = map[string]*list.Element{}
+	c.lru.Init()
+	c.size = 0
+	c.lock.Unlock()
+}
+
+// Get the number of the cached responses
+func (c *dnsCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
+}
+
+// Resolve the request of an expired cached response in background and update the cache
+func (s *Server) refreshCache(p *proxy.Proxy, d *proxy.DNSContext, key string) {
+	c := s.cache
+	if !c.startRefresh(key) {
+		return
+	}
+	rd := *d
+	rd.Req = d.Req.Copy()
+	rd.Res = nil
+	rd.Upstream = nil
+	go func() {
+		defer c.endRefresh(key)
+		_, err := s.resolveUpstream(p, &rd)
+		if err != nil {
+			log.Debug("Cache: couldn't refresh %s: %s", key, err)
+			return
+		}
+		if rd.Upstream != nil {
+			c.set(key, rd.Res)
+		}
+	}()
+}
+
+// ClearCache removes all responses from the DNS cache
+func (s *Server) ClearCache() {
+	s.RLock()
+	c := s.cache
+	s.RUnlock()
+	if c != nil {
+		c.clear()
+		log.Debug("DNS cache is cleared")
+	}
+}
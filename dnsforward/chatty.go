@@ -0,0 +1,200 @@
+package dnsforward
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+const (
+	chattyTrackSize    = 10000 // maximum number of client+domain pairs we keep track of
+	chattyMinPremature = 10    // a pair needs at least this many premature queries to be reported
+	chattyMinRatio     = 0.5   // ...and this share of its queries must be premature
+	chattyMaxDomains   = 20    // maximum number of domains reported for a single client
+)
+
+// chattyEntry holds query statistics for a client+domain pair
+type chattyEntry struct {
+	queries   uint64    // total number of queries
+	premature uint64    // number of queries received before the previous answer has expired
+	expire    time.Time // the time when the last answer given to the client expires
+	maxTTL    uint32    // the largest TTL we've seen for this domain
+	first     time.Time // the time of the first query
+	last      time.Time // the time of the last query
+}
+
+// chattyTracker detects clients that re-query domains much more often than the TTL of the answers allows.
+// It counts every query the client sends to us, no matter if it was answered from cache or not.
+type chattyTracker struct {
+	entries gcache.Cache // "client domain" -> *chattyEntry
+	lock    sync.Mutex
+}
+
+func newChattyTracker() *chattyTracker {
+	return &chattyTracker{
+		entries: gcache.New(chattyTrackSize).LRU().Build(),
+	}
+}
+
+// minAnswerTTL returns the minimum TTL of the answer records or 0 if there are none
+func minAnswerTTL(m *dns.Msg) uint32 {
+	if m == nil || len(m.Answer) == 0 {
+		return 0
+	}
+	ttl := m.Answer[0].Header().Ttl
+	for _, rr := range m.Answer[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// add registers a query from the client and the answer we gave to it
+func (c *chattyTracker) add(client string, req *dns.Msg, res *dns.Msg, now time.Time) {
+	if len(client) == 0 || req == nil || len(req.Question) != 1 {
+		return
+	}
+	host := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	if len(host) == 0 {
+		return
+	}
+	key := client + " " + host
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var e *chattyEntry
+	v, err := c.entries.Get(key)
+	if err == nil {
+		e, _ = v.(*chattyEntry)
+	}
+	if e == nil {
+		e = &chattyEntry{first: now}
+		err = c.entries.Set(key, e)
+		if err != nil {
+			log.Debug("chatty: can't add %s: %s", key, err)
+			return
+		}
+	}
+
+	e.queries++
+	if now.Before(e.expire) {
+		e.premature++
+	}
+	e.last = now
+
+	ttl := minAnswerTTL(res)
+	if ttl > e.maxTTL {
+		e.maxTTL = ttl
+	}
+	if ttl != 0 {
+		e.expire = now.Add(time.Duration(ttl) * time.Second)
+	}
+}
+
+// ChattyDomain is the statistics for a domain queried by a chatty client
+type ChattyDomain struct {
+	Domain    string `json:"domain"`
+	Queries   uint64 `json:"queries"`
+	Premature uint64 `json:"premature"`     // number of queries that were sent while the previous answer was still valid
+	Interval  uint32 `json:"interval"`      // average interval between queries, in seconds
+	TTL       uint32 `json:"ttl"`           // the largest TTL seen in the answers
+	Suggested uint32 `json:"suggested_ttl"` // suggested TTL override for this domain
+}
+
+// ChattyClient is a client that re-queries domains too often
+type ChattyClient struct {
+	IP        string         `json:"ip"`
+	Queries   uint64         `json:"queries"`
+	Premature uint64         `json:"premature"`
+	Domains   []ChattyDomain `json:"domains"`
+}
+
+// suggestTTL returns a TTL override which would let the client's stub resolver keep the answer long enough.
+// Broken stubs usually don't cache answers with tiny TTLs at all,
+// so we suggest serving at least the full TTL and never less than a minute.
+func suggestTTL(maxTTL uint32) uint32 {
+	const minSuggested = 60
+	if maxTTL < minSuggested {
+		return minSuggested
+	}
+	return maxTTL
+}
+
+// report returns the list of chatty clients sorted by the number of premature queries
+func (c *chattyTracker) report() []ChattyClient {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	clients := map[string]*ChattyClient{}
+	for _, ikey := range c.entries.Keys() {
+		key, ok := ikey.(string)
+		if !ok {
+			continue
+		}
+		v, err := c.entries.Get(key)
+		if err != nil {
+			continue
+		}
+		e, ok := v.(*chattyEntry)
+		if !ok {
+			continue
+		}
+		if e.premature < chattyMinPremature ||
+			float64(e.premature)/float64(e.queries) < chattyMinRatio {
+			continue
+		}
+
+		parts := strings.SplitN(key, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		cl, ok := clients[parts[0]]
+		if !ok {
+			cl = &ChattyClient{IP: parts[0]}
+			clients[parts[0]] = cl
+		}
+
+		d := ChattyDomain{
+			Domain:    parts[1],
+			Queries:   e.queries,
+			Premature: e.premature,
+			TTL:       e.maxTTL,
+			Suggested: suggestTTL(e.maxTTL),
+		}
+		if e.queries > 1 {
+			d.Interval = uint32(e.last.Sub(e.first).Seconds() / float64(e.queries-1))
+		}
+		cl.Queries += e.queries
+		cl.Premature += e.premature
+		cl.Domains = append(cl.Domains, d)
+	}
+
+	result := []ChattyClient{}
+	for _, cl := range clients {
+		sort.Slice(cl.Domains, func(i, j int) bool {
+			return cl.Domains[i].Premature > cl.Domains[j].Premature
+		})
+		if len(cl.Domains) > chattyMaxDomains {
+			cl.Domains = cl.Domains[:chattyMaxDomains]
+		}
+		result = append(result, *cl)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Premature > result[j].Premature
+	})
+	return result
+}
+
+// purge removes all collected data
+func (c *chattyTracker) purge() {
+	c.lock.Lock()
+	c.entries.Purge()
+	c.lock.Unlock()
+}
@@ -0,0 +1,83 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// DOHPath is the path of DNS-over-HTTPS requests
+// A client may identify itself by adding its ID to the path: "/dns-query/<ID>"
+const DOHPath = "/dns-query"
+
+// ClientIDFromPath returns the client ID from the path of DNS-over-HTTPS request, or "" if there's none
+func ClientIDFromPath(path string) string {
+	if !strings.HasPrefix(path, DOHPath+"/") {
+		return ""
+	}
+	return strings.Trim(path[len(DOHPath):], "/")
+}
+
+// IsValidClientID returns TRUE if the string may be used as a client ID:
+// it must be a valid DNS label, so the client is able to present it via DNS-over-TLS server name
+func IsValidClientID(id string) bool {
+	if len(id) == 0 || len(id) > 63 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the ID the client has presented via DNS-over-HTTPS path or DNS-over-TLS/DNS-over-QUIC server name
+// The invalid IDs are ignored
+func (s *Server) clientID(d *proxy.DNSContext) string {
+	id := ""
+	switch d.Proto {
+	case proxy.ProtoHTTPS:
+		if d.HTTPRequest != nil {
+			id = ClientIDFromPath(d.HTTPRequest.URL.Path)
+		}
+	case proxy.ProtoTLS:
+		if conn, ok := d.Conn.(*tls.Conn); ok {
+			id = ClientIDFromServerName(conn.ConnectionState().ServerName, s.conf.TLSServerName)
+		}
+	case ProtoQUIC:
+		if conn, ok := d.Conn.(*doqConn); ok {
+			id = ClientIDFromServerName(conn.conn.ConnectionState().TLS.ServerName, s.conf.TLSServerName)
+		}
+	}
+	if len(id) != 0 && !IsValidClientID(id) {
+		log.Debug("Invalid client ID %q from %s", id, d.Addr)
+		return ""
+	}
+	return id
+}
+
+// If an encrypted DNS client has identified itself,
+// replace its address with the address of the client with this ID,
+// so the filtering settings, the query log and the statistics see the same client as for plain DNS
+// Returns the client ID (empty if the client hasn't presented one)
+func (s *Server) identifyClient(d *proxy.DNSContext) string {
+	id := s.clientID(d)
+	if len(id) == 0 || s.conf.ClientIDHandler == nil {
+		return id
+	}
+	ip := net.ParseIP(s.conf.ClientIDHandler(id, GetIPString(d.Addr)))
+	if ip == nil {
+		log.Debug("No IP address for the client %s", id)
+		return id
+	}
+
+	port := 0
+	if addr, ok := d.Addr.(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+	d.Addr = &net.TCPAddr{IP: ip, Port: port}
+	return id
+}
@@ -0,0 +1,88 @@
+// Per-client upstream servers
+// A client may have its own upstream servers, for all domains or for some of them ("[/domain/]address"),
+// e.g. the work laptop uses the corporate resolver and the kids' tablets use a family-filtering resolver.
+// The other requests of the client are sent to the configured upstream servers.
+// The cached answers aren't shared between the clients which use different upstream servers.
+
+package dnsforward
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// Get the client's own upstream servers, nil if the configured upstream servers are used
+func (s *Server) clientUpstreams(d *proxy.DNSContext) *proxy.UpstreamConfig {
+	if s.conf.ClientUpstreamsHandler == nil {
+		return nil
+	}
+	return s.conf.ClientUpstreamsHandler(GetIPString(d.Addr))
+}
+
+// Get the upstream servers for the domain like the proxy does:
+// the most specific domain is used, nil value means the domain is excluded from the domain-specific servers
+// Returns nil if the configured upstream servers must be used
+func upstreamsForDomain(conf *proxy.UpstreamConfig, host string) []upstream.Upstream {
+	host = strings.ToLower(host)
+	for {
+		u, ok := conf.DomainReservedUpstreams[host]
+		if ok && u != nil {
+			return u
+		}
+		if ok {
+			break
+		}
+		i := strings.IndexByte(host, '.')
+		if i == -1 || i == len(host)-1 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return conf.Upstreams
+}
+
+// Get the suffix of the cache keys for the client:
+// the clients with the same upstream servers share the cached answers
+func (s *Server) upstreamsKey(d *proxy.DNSContext) string {
+	conf := s.clientUpstreams(d)
+	if conf == nil {
+		return ""
+	}
+	addrs := func(upstreams []upstream.Upstream) string {
+		a := []string{}
+		for _, u := range upstreams {
+			a = append(a, u.Address())
+		}
+		return strings.Join(a, ",")
+	}
+	keys := []string{addrs(conf.Upstreams)}
+	for host, upstreams := range conf.DomainReservedUpstreams {
+		keys = append(keys, "[/"+host+"/]"+addrs(upstreams))
+	}
+	sort.Strings(keys[1:])
+	return " upstreams " + strings.Join(keys, " ")
+}
+
+// exchange sends the request to the client's own upstream servers if it has them,
+// or to the configured upstream servers
+func (s *Server) exchange(p *proxy.Proxy, d *proxy.DNSContext) error {
+	conf := s.clientUpstreams(d)
+	if conf == nil || len(d.Req.Question) == 0 {
+		return p.Resolve(d)
+	}
+	upstreams := upstreamsForDomain(conf, d.Req.Question[0].Name)
+	if len(upstreams) == 0 {
+		return p.Resolve(d)
+	}
+	res, u, err := upstream.ExchangeParallel(upstreams, d.Req)
+	if err != nil {
+		log.Debug("The client's upstream servers couldn't resolve %s: %s", d.Req.Question[0].Name, err)
+		return err
+	}
+	d.Res = res
+	d.Upstream = u
+	return nil
+}
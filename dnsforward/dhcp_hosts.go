@@ -0,0 +1,100 @@
+// Host names of DHCP clients
+// When AdGuard Home serves DHCP, the requests for "host.lan" are answered with the addresses from the leases,
+// and the reverse lookups of the leases' addresses are answered with the host names,
+// so the devices reach each other by name without any configuration.
+
+package dnsforward
+
+import (
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Get the local domain name with the dots around it: ".lan." ("" if it isn't set)
+func (s *Server) localDomainSuffix() string {
+	domain := strings.ToLower(strings.Trim(s.conf.LocalDomainName, "."))
+	if len(domain) == 0 {
+		return ""
+	}
+	return "." + domain + "."
+}
+
+// Get the host name from the request name: "host.lan." -> "host" ("" if it isn't in the local domain)
+func (s *Server) dhcpHostFromName(name string) string {
+	suffix := s.localDomainSuffix()
+	name = strings.ToLower(dns.Fqdn(name))
+	if len(suffix) == 0 || !strings.HasSuffix(name, suffix) {
+		return ""
+	}
+	host := strings.TrimSuffix(name, suffix)
+	if strings.Contains(host, ".") {
+		return ""
+	}
+	return host
+}
+
+// Answer A, AAAA and PTR requests for the DHCP clients
+// Returns TRUE if the response is set, the other requests are processed as usual
+func (s *Server) answerDHCPHost(d *proxy.DNSContext) bool {
+	if len(d.Req.Question) != 1 || len(s.localDomainSuffix()) == 0 {
+		return false
+	}
+	q := d.Req.Question[0]
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		host := s.dhcpHostFromName(q.Name)
+		if len(host) == 0 || s.conf.DHCPHostIPsHandler == nil {
+			return false
+		}
+		ips := s.conf.DHCPHostIPsHandler(host)
+		if len(ips) == 0 {
+			return false
+		}
+
+		resp := dns.Msg{}
+		resp.SetReply(d.Req)
+		resp.RecursionAvailable = true
+		for _, ip := range ips {
+			if q.Qtype == dns.TypeA && ip.To4() != nil {
+				resp.Answer = append(resp.Answer, s.genAAnswer(d.Req, ip.To4()))
+			} else if q.Qtype == dns.TypeAAAA && ip.To4() == nil {
+				resp.Answer = append(resp.Answer, s.genAAAAAnswer(d.Req, ip))
+			}
+		}
+		log.Tracef("DHCP client %s: %d records", host, len(resp.Answer))
+		d.Res = &resp
+		return true
+
+	case dns.TypePTR:
+		ip := ipFromReverseName(q.Name)
+		if ip == nil || s.conf.DHCPHostNameHandler == nil {
+			return false
+		}
+		host := strings.ToLower(s.conf.DHCPHostNameHandler(ip))
+		// the host name must be a DNS label, which has the same rules as the client ID
+		if !IsValidClientID(host) {
+			return false
+		}
+		name := host + s.localDomainSuffix()
+
+		resp := dns.Msg{}
+		resp.SetReply(d.Req)
+		resp.RecursionAvailable = true
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypePTR,
+				Ttl:    s.conf.BlockedResponseTTL,
+				Class:  dns.ClassINET,
+			},
+			Ptr: name,
+		})
+		log.Tracef("DHCP client %s: %s", ip, name)
+		d.Res = &resp
+		return true
+	}
+	return false
+}
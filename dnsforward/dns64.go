@@ -0,0 +1,145 @@
+// DNS64 (RFC 6147)
+// IPv6-only clients behind NAT64 can't connect to IPv4-only hosts directly,
+// so AAAA records are synthesized from A records for such hosts:
+// the IPv4 address is embedded in the NAT64 prefix as described in RFC 6052.
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// the Well-Known Prefix (RFC 6052 2.1)
+const defaultDNS64Prefix = "64:ff9b::/96"
+
+// Parse NAT64 prefix, empty string means the default prefix
+func parseDNS64Prefix(s string) (*net.IPNet, error) {
+	if len(s) == 0 {
+		s = defaultDNS64Prefix
+	}
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("NAT64 prefix must be IPv6: %s", s)
+	}
+	ones, _ := n.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("NAT64 prefix length must be 32, 40, 48, 56, 64 or 96: %s", s)
+	}
+	// bits 64-71 must be zero (RFC 6052 2.2)
+	if ones > 64 && n.IP[8] != 0 {
+		return nil, fmt.Errorf("bits 64-71 of NAT64 prefix must be zero: %s", s)
+	}
+	return n, nil
+}
+
+// CheckDNS64Prefix checks that NAT64 prefix is valid
+func CheckDNS64Prefix(s string) error {
+	_, err := parseDNS64Prefix(s)
+	return err
+}
+
+// Embed IPv4 address in NAT64 prefix (RFC 6052 2.2)
+func dns64Address(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP[:ones/8])
+	i := ones / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++ // the "u" octet
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// Return TRUE if AAAA records must be synthesized for the response:
+// the response to AAAA request is successful, but has no AAAA records
+func needDNS64(req *dns.Msg, res *dns.Msg) bool {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeAAAA || res.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	// the client validates DNSSEC itself, the synthesized records would be bogus (RFC 6147 5.5)
+	opt := req.IsEdns0()
+	if req.CheckingDisabled && opt != nil && opt.Do() {
+		return false
+	}
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return false
+		}
+	}
+	return true
+}
+
+// Synthesize AAAA records from the A records of the host if the response has no AAAA records
+// d.Res is replaced with the synthesized response
+func (s *Server) synthesizeDNS64(p *proxy.Proxy, d *proxy.DNSContext) {
+	if !needDNS64(d.Req, d.Res) {
+		return
+	}
+
+	ad := *d
+	ad.Req = d.Req.Copy()
+	ad.Req.Question[0].Qtype = dns.TypeA
+	ad.Res = nil
+	ad.Upstream = nil
+	err := s.resolve(p, &ad)
+	if err != nil || ad.Res == nil || ad.Res.Rcode != dns.RcodeSuccess {
+		log.Tracef("DNS64: couldn't get A records of %s: %v", d.Req.Question[0].Name, err)
+		return
+	}
+
+	// the synthesized records mustn't live longer than the negative response (RFC 6147 5.1.7)
+	maxTTL := uint32(600)
+	for _, rr := range d.Res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < maxTTL {
+			maxTTL = soa.Minttl
+		}
+	}
+
+	answer := []dns.RR{}
+	synthesized := 0
+	for _, rr := range ad.Res.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			if rr.Header().Rrtype == dns.TypeCNAME {
+				answer = append(answer, rr)
+			}
+			continue
+		}
+		aaaa := &dns.AAAA{
+			Hdr:  a.Hdr,
+			AAAA: dns64Address(s.dns64Prefix, a.A),
+		}
+		aaaa.Hdr.Rrtype = dns.TypeAAAA
+		aaaa.Hdr.Rdlength = 0
+		if aaaa.Hdr.Ttl > maxTTL {
+			aaaa.Hdr.Ttl = maxTTL
+		}
+		answer = append(answer, aaaa)
+		synthesized++
+	}
+	if synthesized == 0 {
+		return // no A records
+	}
+
+	res := d.Res.Copy()
+	res.Answer = answer
+	res.Ns = nil
+	res.AuthenticatedData = false
+	d.Res = res
+	if ad.Upstream != nil {
+		d.Upstream = ad.Upstream
+	}
+}
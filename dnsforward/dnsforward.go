@@ -6,18 +6,25 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/clock"
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/logging"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/bluele/gcache"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
 
+var log = logging.New("dnsforward")
+
 // DefaultTimeout is the default upstream timeout
 const DefaultTimeout = 10 * time.Second
 
@@ -29,26 +36,62 @@ const (
 // Server is the main way to start a DNS server.
 //
 // Example:
-//  s := dnsforward.Server{}
-//  err := s.Start(nil) // will start a DNS server listening on default port 53, in a goroutine
-//  err := s.Reconfigure(ServerConfig{UDPListenAddr: &net.UDPAddr{Port: 53535}}) // will reconfigure running DNS server to listen on UDP port 53535
-//  err := s.Stop() // will stop listening on port 53535 and cancel all goroutines
-//  err := s.Start(nil) // will start listening again, on port 53535, in a goroutine
+//
+//	s := dnsforward.Server{}
+//	err := s.Start(nil) // will start a DNS server listening on default port 53, in a goroutine
+//	err := s.Reconfigure(ServerConfig{UDPListenAddr: &net.UDPAddr{Port: 53535}}) // will reconfigure running DNS server to listen on UDP port 53535
+//	err := s.Stop() // will stop listening on port 53535 and cancel all goroutines
+//	err := s.Start(nil) // will start listening again, on port 53535, in a goroutine
 //
 // The zero Server is empty and ready for use.
 type Server struct {
+	baseDir   string               // the directory for the data files
 	dnsProxy  *proxy.Proxy         // DNS proxy instance
+	resolver  *proxy.Proxy         // resolves the requests after Update() changed the upstream servers (nil: dnsProxy)
 	dnsFilter *dnsfilter.Dnsfilter // DNS filter instance
 	queryLog  *queryLog            // Query log instance
+	replica   *queryLogReplica     // Query log replica reader (optional)
 	stats     *stats               // General server statistics
+	chatty    *chattyTracker       // Detects clients that re-query domains too often
 	once      sync.Once
 
+	queryLogDB      *queryLogDB        // SQLite query log backend (optional)
+	queryLogDBDays  uint32             // the retention time of the open database
+	queryLogIgnored *queryLogIgnored   // the clients and the domains which aren't logged
+	queryLogForward *queryLogForwarder // sends the query log entries to a remote collector (optional)
+	statsDB         *statsDB           // persistent hourly statistics (optional)
+
+	staleCache gcache.Cache // the last successful answers, served when the upstream doesn't respond in time
+	cache      *dnsCache    // DNS responses cache (optional)
+
+	dnssec *dnssecValidator // DNSSEC validator (optional)
+
+	upstreamStats *upstreamStats // Per-upstream statistics
+
+	fastestAddrCache gcache.Cache                                   // IP address -> connection time (-1: unreachable)
+	dialProbe        func(addr string, timeout time.Duration) error // checks that the address accepts connections
+
 	AllowedClients         map[string]bool // IP addresses of whitelist clients
 	DisallowedClients      map[string]bool // IP addresses of clients that should be blocked
 	AllowedClientsIPNet    []net.IPNet     // CIDRs of whitelist clients
 	DisallowedClientsIPNet []net.IPNet     // CIDRs of clients that should be blocked
+	AllowedClientIDs       map[string]bool // IDs of whitelist clients
+	DisallowedClientIDs    map[string]bool // IDs of clients that should be blocked
 	BlockedHosts           map[string]bool // hosts that should be blocked
 
+	blockingIPv4 net.IP // IP address returned for blocked A requests in custom_ip mode
+	blockingIPv6 net.IP // IP address returned for blocked AAAA requests in custom_ip mode
+
+	bogusNXDomain []*net.IPNet // the answers with these addresses are replaced with NXDOMAIN
+	dns64Prefix   *net.IPNet   // NAT64 prefix
+
+	listenerErrors map[string]string // listener name -> the reason why it couldn't be started
+
+	dot *dotServer // DNS-over-TLS server
+	doq *doqServer // DNS-over-QUIC server
+
+	extra extraListeners // the listeners on the additional addresses
+
 	sync.RWMutex
 	conf ServerConfig
 }
@@ -57,37 +100,84 @@ type Server struct {
 // baseDir is the base directory for query logs
 func NewServer(baseDir string) *Server {
 	return &Server{
-		queryLog: newQueryLog(baseDir),
-		stats:    newStats(),
+		baseDir:    baseDir,
+		queryLog:   newQueryLog(baseDir),
+		stats:      newStats(),
+		chatty:     newChattyTracker(),
+		staleCache: newStaleCache(),
+
+		upstreamStats: newUpstreamStats(),
+
+		fastestAddrCache: newFastestAddrCache(),
+		dialProbe:        dialProbe,
 	}
 }
 
+func newStaleCache() gcache.Cache {
+	return gcache.New(staleCacheSize).LRU().Expiration(staleMaxAge).Clock(clock.Current).Build()
+}
+
 // FilteringConfig represents the DNS filtering configuration of AdGuard Home
 // The zero FilteringConfig is empty and ready for use.
 type FilteringConfig struct {
-	ProtectionEnabled  bool     `yaml:"protection_enabled"`   // whether or not use any of dnsfilter features
-	FilteringEnabled   bool     `yaml:"filtering_enabled"`    // whether or not use filter lists
-	BlockingMode       string   `yaml:"blocking_mode"`        // mode how to answer filtered requests
-	BlockedResponseTTL uint32   `yaml:"blocked_response_ttl"` // if 0, then default is used (3600)
-	QueryLogEnabled    bool     `yaml:"querylog_enabled"`     // if true, query log is enabled
-	Ratelimit          int      `yaml:"ratelimit"`            // max number of requests per second from a given IP (0 to disable)
-	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`  // a list of whitelisted client IP addresses
-	RefuseAny          bool     `yaml:"refuse_any"`           // if true, refuse ANY requests
-	BootstrapDNS       []string `yaml:"bootstrap_dns"`        // a list of bootstrap DNS for DoH and DoT (plain DNS only)
-	AllServers         bool     `yaml:"all_servers"`          // if true, parallel queries to all configured upstream servers are enabled
-
-	AllowedClients    []string `yaml:"allowed_clients"`    // IP addresses of whitelist clients
-	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses of clients that should be blocked
+	ProtectionEnabled  bool     `yaml:"protection_enabled"`    // whether or not use any of dnsfilter features
+	FilteringEnabled   bool     `yaml:"filtering_enabled"`     // whether or not use filter lists
+	BlockingMode       string   `yaml:"blocking_mode"`         // mode how to answer filtered requests: nxdomain, refused, null_ip or custom_ip
+	BlockingIPv4       string   `yaml:"blocking_ipv4"`         // IP address to be returned for a blocked A request (custom_ip mode)
+	BlockingIPv6       string   `yaml:"blocking_ipv6"`         // IP address to be returned for a blocked AAAA request (custom_ip mode)
+	BlockedResponseTTL uint32   `yaml:"blocked_response_ttl"`  // if 0, then default is used (3600)
+	QueryLogEnabled    bool     `yaml:"querylog_enabled"`      // if true, query log is enabled
+	QueryLogReplicaDir string   `yaml:"querylog_replica_dir"`  // if set, the query log API reads from a replicated copy of the query log files in this directory
+	QueryLogDB         bool     `yaml:"querylog_sqlite"`       // if true, the query log is also written to a SQLite database which supports the fast search
+	QueryLogDBDays     uint32   `yaml:"querylog_sqlite_days"`  // the entries are removed from the database after this time (in days, 0: default 30)
+	QueryLogMaxDays    uint32   `yaml:"querylog_max_days"`     // the query log files are removed after this time (in days, 0: default 1)
+	QueryLogMaxBytes   int64    `yaml:"querylog_max_bytes"`    // the oldest query log files are removed if all files take more disk space (0: no limit)
+	QueryLogAnonymize  string   `yaml:"querylog_anonymize"`    // how the client IP addresses are stored in the query log: truncate, hash, drop (empty: as is)
+	QueryLogIgnored    []string `yaml:"querylog_ignored"`      // the requests from these client IP addresses (or CIDRs) or for these domains (with subdomains) are neither logged nor counted in the statistics
+	QueryLogCompress   bool     `yaml:"querylog_compress"`     // if true, the rotated query log files are compressed with gzip
+	QueryLogForward    string   `yaml:"querylog_forward"`      // the query log entries are sent to this syslog server (udp://, tcp://, tls://) or HTTP collector (http://, https://)
+	StatsInterval      uint32   `yaml:"statistics_interval"`   // the statistics are stored in a database for this time (in days: 1, 7, 30 or 90; 0: not stored, only since the start)
+	Ratelimit          int      `yaml:"ratelimit"`             // max number of requests per second from a given IP (0 to disable)
+	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`   // a list of whitelisted client IP addresses
+	BogusNXDomain      []string `yaml:"bogus_nxdomain"`        // the answers with these IP addresses (or from these CIDRs) are replaced with NXDOMAIN
+	RefuseAny          bool     `yaml:"refuse_any"`            // if true, refuse ANY requests
+	AAAADisabled       bool     `yaml:"aaaa_disabled"`         // if true, respond to AAAA requests with an empty answer
+	HTTPSRemoveECH     bool     `yaml:"https_remove_ech"`      // if true, Encrypted Client Hello keys are removed from SVCB and HTTPS records
+	DNS64Enabled       bool     `yaml:"dns64_enabled"`         // if true, AAAA records are synthesized for IPv4-only hosts
+	DNS64Prefix        string   `yaml:"dns64_prefix"`          // NAT64 prefix for the synthesized AAAA records (empty: 64:ff9b::/96)
+	UDPMaxResponseSize uint16   `yaml:"udp_max_response_size"` // UDP responses are truncated to this size, or to the client's buffer size if it's smaller (0: client's buffer size)
+	BootstrapDNS       []string `yaml:"bootstrap_dns"`         // a list of bootstrap DNS for DoH and DoT (plain DNS only)
+	AllServers         bool     `yaml:"all_servers"`           // if true, parallel queries to all configured upstream servers are enabled
+	FastestAddr        bool     `yaml:"fastest_addr"`          // if true, respond with the fastest of the IP addresses (it's probed with a TCP connection)
+	DNSSECValidation   bool     `yaml:"dnssec_validation"`     // if true, validate DNSSEC signatures and respond with SERVFAIL to bogus answers
+	LatencyBudget      uint32   `yaml:"latency_budget"`        // if there's no upstream response within this time (in milliseconds), respond with a stale answer or SERVFAIL (0: no limit)
+	DOTMaxConnections  int      `yaml:"dot_max_connections"`   // max number of DNS-over-TLS connections (0: no limit)
+	DOTIdleTimeout     uint32   `yaml:"dot_idle_timeout"`      // DNS-over-TLS connection is closed if there's no request within this time (in seconds, 0: default)
+	CacheSize          int      `yaml:"cache_size"`            // DNS cache size in bytes (0: cache is disabled)
+	CacheMinTTL        uint32   `yaml:"cache_ttl_min"`         // the lower TTLs of the cached responses are raised to this value (in seconds, 0: not used)
+	CacheMaxTTL        uint32   `yaml:"cache_ttl_max"`         // the higher TTLs of the cached responses are lowered to this value (in seconds, 0: not used)
+	CacheOptimistic    bool     `yaml:"cache_optimistic"`      // if true, the expired responses are served right away and refreshed in background
+	EDNSCSMode         string   `yaml:"edns_cs_mode"`          // EDNS Client Subnet mode: "" (forward as is), send or strip
+	EDNSCSPrefixV4     uint8    `yaml:"edns_cs_prefix_v4"`     // the length of the client's IPv4 subnet sent upstream in send mode (0: default)
+	EDNSCSPrefixV6     uint8    `yaml:"edns_cs_prefix_v6"`     // the length of the client's IPv6 subnet sent upstream in send mode (0: default)
+
+	AllowedClients    []string `yaml:"allowed_clients"`    // IP addresses, CIDRs or client IDs of whitelist clients
+	DisallowedClients []string `yaml:"disallowed_clients"` // IP addresses, CIDRs or client IDs of clients that should be blocked
 	BlockedHosts      []string `yaml:"blocked_hosts"`      // hosts that should be blocked
 
 	dnsfilter.Config `yaml:",inline"`
 }
 
-// TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, and DNS-over-TLS
+// TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, DNS-over-TLS and DNS-over-QUIC
 type TLSConfig struct {
 	TLSListenAddr    *net.TCPAddr `yaml:"-" json:"-"`
+	QUICListenAddr   *net.UDPAddr `yaml:"-" json:"-"`                                 // DNS-over-QUIC, experimental
 	CertificateChain string       `yaml:"certificate_chain" json:"certificate_chain"` // PEM-encoded certificates chain
 	PrivateKey       string       `yaml:"private_key" json:"private_key"`             // PEM-encoded private key
+
+	// If set, it returns the certificate instead of CertificateChain and PrivateKey,
+	// so the certificate may be replaced without restarting the listener
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error) `yaml:"-" json:"-"`
 }
 
 // ServerConfig represents server configuration.
@@ -97,8 +187,36 @@ type ServerConfig struct {
 	TCPListenAddr            *net.TCPAddr                   // TCP listen address
 	Upstreams                []upstream.Upstream            // Configured upstreams
 	DomainsReservedUpstreams map[string][]upstream.Upstream // Map of domains and lists of configured upstreams
+	LocalPTRUpstreams        []upstream.Upstream            // Resolvers for the reverse lookups of the private addresses (none: NXDOMAIN)
+	FallbackUpstreams        []upstream.Upstream            // Used only if all upstreams fail
 	Filters                  []dnsfilter.Filter             // A list of filters to use
+	DisabledListeners        []string                       // Listeners which must not be started (ListenerUDP, ListenerTCP, ListenerTLS, ListenerQUIC)
 	OnDNSRequest             func(d *proxy.DNSContext)
+	LatencyBudgetHandler     func(clientAddr string) uint32 // returns the latency budget of the client in milliseconds (0: use LatencyBudget)
+	AAAADisabledHandler      func(clientAddr string) bool   // returns TRUE if the client's AAAA requests get an empty answer even if AAAADisabled is false
+	QueryLogIgnoredHandler   func(clientAddr string) bool   // returns TRUE if the client's requests are neither logged nor counted in the statistics
+	TLSServerName            string                         // DNS-over-TLS clients identify themselves via the server name "<client ID>.<TLSServerName>"
+
+	// returns the IP address of the client with this DNS-over-HTTPS or DNS-over-TLS client ID,
+	// clientAddr is the address the request came from
+	ClientIDHandler func(clientID string, clientAddr string) string
+	// returns the client's own upstream servers (nil: the configured upstreams are used)
+	ClientUpstreamsHandler func(clientAddr string) *proxy.UpstreamConfig
+
+	// the host names of DHCP clients are resolved in this domain, e.g. "host.lan" (empty: they aren't resolved)
+	LocalDomainName string
+	// returns the addresses of the DHCP client with this host name
+	DHCPHostIPsHandler func(host string) []net.IP
+	// returns the host name of the DHCP client with this address ("": unknown)
+	DHCPHostNameHandler func(ip net.IP) string
+
+	// additional addresses of plain DNS (UDP and TCP) and DNS-over-TLS listeners
+	ExtraListenAddrs    []*net.TCPAddr
+	ExtraTLSListenAddrs []*net.TCPAddr
+
+	// plain DNS sockets (UDP and TCP) passed by systemd, they're used instead of UDPListenAddr, TCPListenAddr and ExtraListenAddrs
+	// The files are owned by the caller: the server listens on their duplicates, so they may be used again after restart.
+	ActivatedSockets []*os.File
 
 	FilteringConfig
 	TLSConfig
@@ -131,6 +249,13 @@ func (s *Server) Start(config *ServerConfig) error {
 	return s.startInternal(config)
 }
 
+// The DNS proxy searches the rate limit whitelist with a binary search, so it must be sorted
+func sortedCopy(list []string) []string {
+	c := append([]string{}, list...)
+	sort.Strings(c)
+	return c
+}
+
 func convertArrayToMap(dst *map[string]bool, src []string) {
 	*dst = make(map[string]bool)
 	for _, s := range src {
@@ -138,9 +263,11 @@ func convertArrayToMap(dst *map[string]bool, src []string) {
 	}
 }
 
-// Split array of IP or CIDR into 2 containers for fast search
-func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []string) error {
+// Split array of IP, CIDR or client ID into 3 containers for fast search
+func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, dstIDs *map[string]bool, src []string) error {
 	*dst = make(map[string]bool)
+	*dstIPNet = nil
+	*dstIDs = make(map[string]bool)
 
 	for _, s := range src {
 		ip := net.ParseIP(s)
@@ -149,6 +276,11 @@ func processIPCIDRArray(dst *map[string]bool, dstIPNet *[]net.IPNet, src []strin
 			continue
 		}
 
+		if IsValidClientID(s) {
+			(*dstIDs)[strings.ToLower(s)] = true
+			continue
+		}
+
 		_, ipnet, err := net.ParseCIDR(s)
 		if err != nil {
 			return err
@@ -168,6 +300,7 @@ func (s *Server) startInternal(config *ServerConfig) error {
 	if s.dnsFilter != nil || s.dnsProxy != nil {
 		return errors.New("DNS server is already started")
 	}
+	s.resolver = nil
 
 	if s.queryLog == nil {
 		s.queryLog = newQueryLog(".")
@@ -177,11 +310,89 @@ func (s *Server) startInternal(config *ServerConfig) error {
 		s.stats = newStats()
 	}
 
+	if s.chatty == nil {
+		s.chatty = newChattyTracker()
+	}
+
+	if s.staleCache == nil {
+		s.staleCache = newStaleCache()
+	}
+
+	if s.upstreamStats == nil {
+		s.upstreamStats = newUpstreamStats()
+	}
+
+	s.cache = newDNSCache(s.conf.CacheSize, s.conf.CacheMinTTL, s.conf.CacheMaxTTL, s.conf.CacheOptimistic)
+
+	// the trust anchors survive the reconfiguration
+	if s.conf.DNSSECValidation && s.dnssec == nil {
+		s.dnssec = newDNSSECValidator(filepath.Join(s.baseDir, dnssecAnchorsFileName))
+	}
+
+	s.replica = nil
+	if len(s.conf.QueryLogReplicaDir) != 0 {
+		log.Info("Query log API will read from the replica in %s", s.conf.QueryLogReplicaDir)
+		s.replica = newQueryLogReplica(s.conf.QueryLogReplicaDir)
+	}
+
 	err := s.initDNSFilter()
 	if err != nil {
 		return err
 	}
 
+	err = CheckQueryLogAnonymize(s.conf.QueryLogAnonymize)
+	if err != nil {
+		return err
+	}
+	s.queryLog.setAnonymize(s.conf.QueryLogAnonymize)
+
+	s.queryLogIgnored, err = parseQueryLogIgnored(s.conf.QueryLogIgnored)
+	if err != nil {
+		return err
+	}
+
+	s.queryLog.setRetention(s.conf.QueryLogMaxDays, s.conf.QueryLogMaxBytes)
+	s.queryLog.enforceRetention()
+	s.queryLog.setCompress(s.conf.QueryLogCompress)
+
+	if s.queryLogDB != nil && (!s.conf.QueryLogDB || s.conf.QueryLogDBDays != s.queryLogDBDays) {
+		s.queryLogDB.close()
+		s.queryLogDB = nil
+	}
+	if s.conf.QueryLogDB && s.queryLogDB == nil {
+		s.queryLogDB, err = openQueryLogDB(filepath.Join(s.baseDir, queryLogDBFileName), s.conf.QueryLogDBDays)
+		if err != nil {
+			log.Error("Query log database is disabled: %s", err)
+		}
+		s.queryLogDBDays = s.conf.QueryLogDBDays
+	}
+
+	err = CheckStatsInterval(s.conf.StatsInterval)
+	if err != nil {
+		return err
+	}
+	if s.statsDB != nil && s.conf.StatsInterval != s.statsDB.interval {
+		s.statsDB.close()
+		s.statsDB = nil
+	}
+	if s.conf.StatsInterval != 0 && s.statsDB == nil {
+		s.statsDB, err = openStatsDB(filepath.Join(s.baseDir, statsDBFileName), s.conf.StatsInterval)
+		if err != nil {
+			log.Error("Statistics won't be stored: %s", err)
+		}
+	}
+
+	if s.queryLogForward != nil {
+		s.queryLogForward.close()
+		s.queryLogForward = nil
+	}
+	if len(s.conf.QueryLogForward) != 0 {
+		s.queryLogForward, err = newQueryLogForwarder(s.conf.QueryLogForward)
+		if err != nil {
+			return err
+		}
+	}
+
 	log.Tracef("Loading stats from querylog")
 	err = s.queryLog.fillStatsFromQueryLog(s.stats)
 	if err != nil {
@@ -200,29 +411,55 @@ func (s *Server) startInternal(config *ServerConfig) error {
 		UDPListenAddr:            s.conf.UDPListenAddr,
 		TCPListenAddr:            s.conf.TCPListenAddr,
 		Ratelimit:                s.conf.Ratelimit,
-		RatelimitWhitelist:       s.conf.RatelimitWhitelist,
+		RatelimitWhitelist:       sortedCopy(s.conf.RatelimitWhitelist),
 		RefuseAny:                s.conf.RefuseAny,
-		CacheEnabled:             true,
-		Upstreams:                s.conf.Upstreams,
-		DomainsReservedUpstreams: s.conf.DomainsReservedUpstreams,
+		CacheEnabled:             false, // we use our own cache
+		Upstreams:                s.upstreamStats.wrap(s.conf.Upstreams),
+		DomainsReservedUpstreams: map[string][]upstream.Upstream{},
 		BeforeRequestHandler:     s.beforeRequestHandler,
 		RequestHandler:           s.handleDNSRequest,
 		AllServers:               s.conf.AllServers,
+		Fallbacks:                s.upstreamStats.wrap(s.conf.FallbackUpstreams),
+	}
+
+	for domain, upstreams := range s.conf.DomainsReservedUpstreams {
+		proxyConfig.DomainsReservedUpstreams[domain] = s.upstreamStats.wrap(upstreams)
 	}
+	s.conf.LocalPTRUpstreams = s.upstreamStats.wrap(s.conf.LocalPTRUpstreams)
 
-	err = processIPCIDRArray(&s.AllowedClients, &s.AllowedClientsIPNet, s.conf.AllowedClients)
+	err = processIPCIDRArray(&s.AllowedClients, &s.AllowedClientsIPNet, &s.AllowedClientIDs, s.conf.AllowedClients)
 	if err != nil {
 		return err
 	}
 
-	err = processIPCIDRArray(&s.DisallowedClients, &s.DisallowedClientsIPNet, s.conf.DisallowedClients)
+	err = processIPCIDRArray(&s.DisallowedClients, &s.DisallowedClientsIPNet, &s.DisallowedClientIDs, s.conf.DisallowedClients)
 	if err != nil {
 		return err
 	}
 
 	convertArrayToMap(&s.BlockedHosts, s.conf.BlockedHosts)
 
-	if s.conf.TLSListenAddr != nil && s.conf.CertificateChain != "" && s.conf.PrivateKey != "" {
+	err = s.initBlockingMode()
+	if err != nil {
+		return err
+	}
+
+	err = CheckECSMode(s.conf.EDNSCSMode, s.conf.EDNSCSPrefixV4, s.conf.EDNSCSPrefixV6)
+	if err != nil {
+		return err
+	}
+
+	s.bogusNXDomain, err = parseBogusNXDomain(s.conf.BogusNXDomain)
+	if err != nil {
+		return err
+	}
+
+	s.dns64Prefix, err = parseDNS64Prefix(s.conf.DNS64Prefix)
+	if err != nil {
+		return err
+	}
+
+	if (s.conf.TLSListenAddr != nil || s.conf.QUICListenAddr != nil) && s.conf.CertificateChain != "" && s.conf.PrivateKey != "" {
 		proxyConfig.TLSListenAddr = s.conf.TLSListenAddr
 		keypair, err := tls.X509KeyPair([]byte(s.conf.CertificateChain), []byte(s.conf.PrivateKey))
 		if err != nil {
@@ -232,6 +469,10 @@ func (s *Server) startInternal(config *ServerConfig) error {
 			Certificates: []tls.Certificate{keypair},
 			MinVersion:   tls.VersionTLS12,
 		}
+		if s.conf.GetCertificate != nil {
+			proxyConfig.TLSConfig.Certificates = nil
+			proxyConfig.TLSConfig.GetCertificate = s.conf.GetCertificate
+		}
 	}
 
 	if proxyConfig.UDPListenAddr == nil {
@@ -246,9 +487,95 @@ func (s *Server) startInternal(config *ServerConfig) error {
 		proxyConfig.Upstreams = defaultValues.Upstreams
 	}
 
+	if len(s.conf.ActivatedSockets) != 0 {
+		proxyConfig.UDPListenAddr = nil
+		proxyConfig.TCPListenAddr = nil
+	}
+
+	disableListeners(&proxyConfig, s.conf.DisabledListeners)
+	s.listenerErrors = probeListeners(&proxyConfig)
+	if len(s.listenerErrors) != 0 &&
+		proxyConfig.UDPListenAddr == nil && proxyConfig.TCPListenAddr == nil && proxyConfig.TLSListenAddr == nil {
+		return fmt.Errorf("couldn't start any DNS listener: %v", s.listenerErrors)
+	}
+
+	// DNS-over-TLS is served by us, not by the DNS proxy
+	dotAddr := proxyConfig.TLSListenAddr
+	dotConfig := proxyConfig.TLSConfig
+	proxyConfig.TLSListenAddr = nil
+	proxyConfig.TLSConfig = nil
+
 	// Initialize and start the DNS proxy
+	// It can't start without listeners, but it still resolves DNS-over-TLS and DNS-over-HTTPS requests
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
-	return s.dnsProxy.Start()
+	if proxyConfig.UDPListenAddr != nil || proxyConfig.TCPListenAddr != nil {
+		err = s.dnsProxy.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	if dotAddr != nil {
+		idleTimeout := time.Duration(s.conf.DOTIdleTimeout) * time.Second
+		s.dot, err = startDOTServer(dotAddr, dotConfig, s.conf.DOTMaxConnections, idleTimeout, s.processRequest)
+		if err != nil {
+			return errorx.Decorate(err, "couldn't start DNS-over-TLS listener")
+		}
+	}
+
+	quicAddr := s.conf.QUICListenAddr
+	for _, l := range s.conf.DisabledListeners {
+		if l == ListenerQUIC {
+			quicAddr = nil
+		}
+	}
+	if quicAddr != nil && dotConfig != nil {
+		// it's experimental: the other listeners work without it
+		s.doq, err = startDOQServer(quicAddr, dotConfig, s.processRequest)
+		if err != nil {
+			log.Error("Couldn't start DNS-over-QUIC listener: %s", err)
+			s.listenerErrors[ListenerQUIC] = err.Error()
+		}
+	}
+
+	for l, e := range s.startExtraListeners(dotConfig) {
+		s.listenerErrors[l] = e
+	}
+	return nil
+}
+
+// CheckBlockingMode checks that the blocking mode and the custom IP addresses are valid
+func CheckBlockingMode(mode string, ipv4 string, ipv6 string) error {
+	switch mode {
+	case "", "nxdomain", "refused", "null_ip":
+		return nil
+	case "custom_ip":
+		ip := net.ParseIP(ipv4)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("blocking_ipv4 must be a valid IPv4 address in custom_ip mode")
+		}
+		ip = net.ParseIP(ipv6)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("blocking_ipv6 must be a valid IPv6 address in custom_ip mode")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown blocking mode: %s", mode)
+}
+
+// initBlockingMode validates the blocking mode settings and parses the custom IP addresses
+func (s *Server) initBlockingMode() error {
+	err := CheckBlockingMode(s.conf.BlockingMode, s.conf.BlockingIPv4, s.conf.BlockingIPv6)
+	if err != nil {
+		return err
+	}
+	s.blockingIPv4 = nil
+	s.blockingIPv6 = nil
+	if s.conf.BlockingMode == "custom_ip" {
+		s.blockingIPv4 = net.ParseIP(s.conf.BlockingIPv4).To4()
+		s.blockingIPv6 = net.ParseIP(s.conf.BlockingIPv6)
+	}
+	return nil
 }
 
 // Initializes the DNS filter
@@ -257,14 +584,20 @@ func (s *Server) initDNSFilter() error {
 
 	var filters map[int]string
 	filters = nil
+	untrusted := map[int64]bool{}
 	if s.conf.FilteringEnabled {
 		filters = make(map[int]string)
 		for _, f := range s.conf.Filters {
 			filters[int(f.ID)] = string(f.Data)
+			if !f.Trusted {
+				untrusted[f.ID] = true
+			}
 		}
 	}
 
-	s.dnsFilter = dnsfilter.New(&s.conf.Config, filters)
+	c := s.conf.Config
+	c.UntrustedFilters = untrusted
+	s.dnsFilter = dnsfilter.New(&c, filters)
 	if s.dnsFilter == nil {
 		return fmt.Errorf("could not initialize dnsfilter")
 	}
@@ -280,6 +613,22 @@ func (s *Server) Stop() error {
 
 // stopInternal stops without locking
 func (s *Server) stopInternal() error {
+	s.stopExtraListeners()
+	if s.dot != nil {
+		err := s.dot.close()
+		s.dot = nil
+		if err != nil {
+			log.Debug("Couldn't close DNS-over-TLS listener: %s", err)
+		}
+	}
+	if s.doq != nil {
+		err := s.doq.close()
+		s.doq = nil
+		if err != nil {
+			log.Debug("Couldn't close DNS-over-QUIC listener: %s", err)
+		}
+	}
+
 	if s.dnsProxy != nil {
 		err := s.dnsProxy.Stop()
 		s.dnsProxy = nil
@@ -293,8 +642,27 @@ func (s *Server) stopInternal() error {
 		s.dnsFilter = nil
 	}
 
+	if s.queryLogDB != nil {
+		err := s.queryLogDB.flush()
+		if err != nil {
+			log.Error("querylog db: write failed: %s", err)
+		}
+	}
+
+	if s.queryLogForward != nil {
+		s.queryLogForward.close()
+		s.queryLogForward = nil
+	}
+
+	if s.statsDB != nil {
+		err := s.statsDB.flush()
+		if err != nil {
+			log.Error("stats db: write failed: %s", err)
+		}
+	}
+
 	// flush remainder to file
-	return s.queryLog.flushLogBuffer(true)
+	return s.queryLog.flush()
 }
 
 // IsRunning returns true if the DNS server is running
@@ -320,6 +688,8 @@ func (s *Server) Reconfigure(config *ServerConfig) error {
 	}
 	err = s.startInternal(config)
 	if err != nil {
+		// don't leave it half-started: it can be started again with the previous settings
+		_ = s.stopInternal()
 		return errorx.Decorate(err, "could not reconfigure the server")
 	}
 
@@ -337,9 +707,54 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *Server) GetQueryLog() []map[string]interface{} {
 	s.RLock()
 	defer s.RUnlock()
+	if s.replica != nil {
+		return s.replica.getQueryLog()
+	}
 	return s.queryLog.getQueryLog()
 }
 
+// GetQueryLogDiskUsage returns the disk usage of the query log files and database ready to be converted to a JSON
+func (s *Server) GetQueryLogDiskUsage() map[string]interface{} {
+	s.RLock()
+	l := s.queryLog
+	db := s.queryLogDB
+	days := s.queryLogDBDays
+	s.RUnlock()
+
+	data := l.diskUsage()
+	if db != nil {
+		if days == 0 {
+			days = defaultQueryLogDBRetention
+		}
+		data["database_bytes"] = queryLogDBSize(filepath.Join(s.baseDir, queryLogDBFileName))
+		data["database_days"] = days
+	}
+	return data
+}
+
+// SearchQueryLog returns the query log entries selected by the filter, newest first, ready to be converted to a JSON
+// Only the recent entries kept in memory are searched if the query log database is disabled
+func (s *Server) SearchQueryLog(f QueryLogSearch) ([]map[string]interface{}, error) {
+	s.RLock()
+	db := s.queryLogDB
+	l := s.queryLog
+	s.RUnlock()
+
+	// the client IP addresses are stored anonymized
+	if net.ParseIP(f.Client) != nil {
+		f.Client = l.anonymize(f.Client)
+	}
+
+	if db == nil {
+		return logEntriesToJSON(l.search(&f)), nil
+	}
+	entries, err := db.search(&f)
+	if err != nil {
+		return nil, err
+	}
+	return logEntriesToJSON(entries), nil
+}
+
 // GetStatsTop returns the current stop stats
 func (s *Server) GetStatsTop() *StatsTop {
 	s.RLock()
@@ -352,13 +767,55 @@ func (s *Server) PurgeStats() {
 	s.Lock()
 	defer s.Unlock()
 	s.stats.purgeStats()
+	s.stats.markPurged()
+	if s.statsDB != nil {
+		err := s.statsDB.purge()
+		if err != nil {
+			log.Error("stats db: %s", err)
+		}
+	}
+	s.upstreamStats.purge()
+	s.chatty.purge()
 }
 
-// GetAggregatedStats returns aggregated stats data for the 24 hours
+// ResetStats removes the requests matching the filter from the statistics
+// Returns the number of the removed requests
+func (s *Server) ResetStats(f StatsResetFilter) (int, error) {
+	s.RLock()
+	l := s.queryLog
+	st := s.stats
+	db := s.statsDB
+	s.RUnlock()
+	return l.resetStats(st, db, f)
+}
+
+// GetChattyClients returns the list of clients that query domains far more often than the TTL allows
+func (s *Server) GetChattyClients() []ChattyClient {
+	s.RLock()
+	defer s.RUnlock()
+	return s.chatty.report()
+}
+
+// GetAggregatedStats returns aggregated stats data for the 24 hours, or for the statistics interval if the statistics are stored
 func (s *Server) GetAggregatedStats() map[string]interface{} {
 	s.RLock()
 	defer s.RUnlock()
-	return s.stats.getAggregatedStats()
+	data := s.stats.getAggregatedStats()
+	if s.statsDB != nil {
+		stored, err := s.statsDB.getAggregatedStats(s.stats, time.Now())
+		if err == nil {
+			data = stored
+		} else {
+			log.Error("stats db: %s", err)
+		}
+	}
+	data["upstreams"] = s.upstreamStats.get()
+	data["upstream_latency_buckets"] = upstreamLatencyBuckets
+	data["querylog_dropped"] = s.queryLog.droppedEntries()
+	if s.queryLogForward != nil {
+		data["querylog_forward_dropped"] = s.queryLogForward.droppedEntries()
+	}
+	return data
 }
 
 // GetStatsHistory gets stats history aggregated by the specified time unit
@@ -409,6 +866,26 @@ func (s *Server) isBlockedIP(ip string) bool {
 	return false
 }
 
+// Return TRUE if this client should be blocked
+// clientID is the ID the client has presented via DNS-over-HTTPS or DNS-over-TLS, or ""
+func (s *Server) isBlockedClient(ip string, clientID string) bool {
+	if len(clientID) != 0 {
+		clientID = strings.ToLower(clientID)
+		if s.AllowedClientIDs[clientID] {
+			return false
+		}
+		if s.DisallowedClientIDs[clientID] {
+			return true
+		}
+	}
+
+	// only the clients with these IDs are allowed
+	if len(s.AllowedClientIDs) != 0 && len(s.AllowedClients) == 0 && len(s.AllowedClientsIPNet) == 0 {
+		return true
+	}
+	return s.isBlockedIP(ip)
+}
+
 // Return TRUE if this domain should be blocked
 func (s *Server) isBlockedDomain(host string) bool {
 	_, ok := s.BlockedHosts[host]
@@ -417,8 +894,9 @@ func (s *Server) isBlockedDomain(host string) bool {
 
 func (s *Server) beforeRequestHandler(p *proxy.Proxy, d *proxy.DNSContext) (bool, error) {
 	ip, _, _ := net.SplitHostPort(d.Addr.String())
-	if s.isBlockedIP(ip) {
-		log.Tracef("Client IP %s is blocked by settings", ip)
+	clientID := s.clientID(d)
+	if s.isBlockedClient(ip, clientID) {
+		log.Tracef("Client %s (%s) is blocked by settings", ip, clientID)
 		return false, nil
 	}
 
@@ -436,25 +914,81 @@ func (s *Server) beforeRequestHandler(p *proxy.Proxy, d *proxy.DNSContext) (bool
 // handleDNSRequest filters the incoming DNS requests and writes them to the query log
 func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 	start := time.Now()
+	p = s.upstreamProxy(p)
+
+	clientID := s.identifyClient(d)
 
 	if s.conf.OnDNSRequest != nil {
 		s.conf.OnDNSRequest(d)
 	}
 
-	// use dnsfilter before cache -- changed settings or filters would require cache invalidation otherwise
-	res, err := s.filterDNSRequest(d)
-	if err != nil {
-		return err
+	origName := ""
+	if len(d.Req.Question) != 0 {
+		origName = d.Req.Question[0].Name
 	}
 
+	var res *dnsfilter.Result
+	var err error
+	if !s.answerDHCPHost(d) {
+		// use dnsfilter before cache -- changed settings or filters would require cache invalidation otherwise
+		res, err = s.filterDNSRequest(d)
+		if err != nil {
+			return err
+		}
+	}
+
+	aaaaDisabled := false
+	if d.Res == nil && s.isAAAADisabled(d) {
+		d.Res = s.genNoData(d.Req)
+		aaaaDisabled = true
+	}
+
+	dnssecStatus := ""
+	cached := false
+	var upstreamElapsed time.Duration
 	if d.Res == nil {
 		// request was not filtered so let it be processed further
-		err = p.Resolve(d)
+		origReq := d.Req
+		d.Req = s.applyECS(d.Req, net.ParseIP(GetIPString(d.Addr)))
+
+		key := ""
+		if s.cache != nil {
+			key = cacheKey(d.Req) + s.upstreamsKey(d)
+			expired := false
+			d.Res, expired = s.cache.get(key, d.Req)
+			cached = d.Res != nil
+			if expired {
+				s.refreshCache(p, d, key)
+			}
+		}
+		if !cached {
+			upstreamStart := time.Now()
+			dnssecStatus, err = s.resolveUpstream(p, d)
+			upstreamElapsed = time.Since(upstreamStart)
+			// stale answers aren't cached
+			if err == nil && s.cache != nil && d.Upstream != nil {
+				s.cache.set(key, d.Res)
+			}
+		}
+		if d.Req != origReq {
+			d.Req = origReq
+			if d.Res != nil {
+				d.Res = restoreECS(d.Req, d.Res)
+			}
+		}
+		if svcbRes := s.filterSVCBRecords(d); svcbRes != nil {
+			res = svcbRes
+		}
+		if res != nil && res.Reason == dnsfilter.ReasonRewrite && len(res.CanonName) != 0 {
+			s.addRewriteCNAME(d, origName, res.CanonName)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
+	s.truncateUDPResponse(d)
+
 	shouldLog := true
 	msg := d.Req
 
@@ -463,21 +997,95 @@ func (s *Server) handleDNSRequest(p *proxy.Proxy, d *proxy.DNSContext) error {
 		shouldLog = false
 	}
 
+	if shouldLog && s.isQueryLogIgnored(d) {
+		shouldLog = false
+	}
+
 	if s.conf.QueryLogEnabled && shouldLog {
 		elapsed := time.Since(start)
 		upstreamAddr := ""
 		if d.Upstream != nil {
 			upstreamAddr = d.Upstream.Address()
 		}
-		entry := s.queryLog.logRequest(msg, d.Res, res, elapsed, d.Addr, upstreamAddr)
+		entry := s.queryLog.logRequest(msg, d.Res, res, elapsed, d.Addr, d.Proto, upstreamAddr, upstreamElapsed, dnssecStatus, cached, aaaaDisabled, clientID)
 		if entry != nil {
+			if s.queryLogDB != nil {
+				s.queryLogDB.add(entry)
+			}
+			if s.queryLogForward != nil {
+				s.queryLogForward.add(entry)
+			}
 			s.stats.incrementCounters(entry)
+			if s.statsDB != nil {
+				s.statsDB.add(s.stats, entry, 1)
+			}
+			s.chatty.add(entry.IP, msg, d.Res, entry.Time)
 		}
 	}
 
 	return nil
 }
 
+// Return TRUE if the request is AAAA and such requests are disabled globally or for this client
+func (s *Server) isAAAADisabled(d *proxy.DNSContext) bool {
+	if len(d.Req.Question) != 1 || d.Req.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+	return s.aaaaDisabled(GetIPString(d.Addr))
+}
+
+// Return TRUE if AAAA requests are disabled globally or for this client
+func (s *Server) aaaaDisabled(clientAddr string) bool {
+	if s.conf.AAAADisabled {
+		return true
+	}
+	return s.conf.AAAADisabledHandler != nil && s.conf.AAAADisabledHandler(clientAddr)
+}
+
+// resolveUpstream sends the request to the upstream servers (or to the local resolvers
+// if it's a reverse lookup of a private address) and processes the response:
+// replaces bogus NXDOMAIN answers, validates DNSSEC signatures, synthesizes AAAA records (DNS64)
+// and picks the fastest IP address if it's configured
+// Returns DNSSEC validation status
+func (s *Server) resolveUpstream(p *proxy.Proxy, d *proxy.DNSContext) (string, error) {
+	validate := s.conf.DNSSECValidation && s.dnssec != nil && len(d.Req.Question) == 1
+	edns, do := false, false
+	if validate {
+		edns, do = setDNSSECOK(d.Req)
+	}
+	var err error
+	if isPrivatePTR(d.Req) {
+		err = s.resolvePrivatePTR(d)
+	} else {
+		err = s.resolve(p, d)
+	}
+	if err != nil || d.Res == nil {
+		return "", err
+	}
+
+	if s.isBogusNXDomain(d.Res) {
+		log.Tracef("Bogus NXDOMAIN answer for %s", d.Req.Question[0].Name)
+		d.Res = s.genNXDomain(d.Req)
+		return "", nil
+	}
+
+	dnssecStatus := ""
+	if validate {
+		d.Res, dnssecStatus = s.validateDNSSEC(resolver(p), d.Req, d.Res)
+		if !do {
+			d.Res = stripDNSSEC(d.Res, d.Req.Question[0].Qtype, edns)
+			d.Res.AuthenticatedData = d.Res.AuthenticatedData && d.Req.AuthenticatedData
+		}
+	}
+	if s.conf.DNS64Enabled && s.dns64Prefix != nil {
+		s.synthesizeDNS64(p, d)
+	}
+	if s.conf.FastestAddr {
+		d.Res = s.pickFastestAddr(d.Res)
+	}
+	return dnssecStatus, nil
+}
+
 // filterDNSRequest applies the dnsFilter and sets d.Res if the request was filtered
 func (s *Server) filterDNSRequest(d *proxy.DNSContext) (*dnsfilter.Result, error) {
 	msg := d.Req
@@ -488,34 +1096,90 @@ func (s *Server) filterDNSRequest(d *proxy.DNSContext) (*dnsfilter.Result, error
 	dnsFilter := s.dnsFilter
 	s.RUnlock()
 
-	if !protectionEnabled {
-		return nil, nil
-	}
-
 	var res dnsfilter.Result
 	var err error
 
-	clientAddr := ""
-	if d.Addr != nil {
-		clientAddr, _, _ = net.SplitHostPort(d.Addr.String())
+	if !protectionEnabled {
+		// local DNS records work even if protection is disabled
+		res = dnsFilter.CheckRewrites(host, d.Req.Question[0].Qtype)
+		if res.Reason != dnsfilter.ReasonRewrite {
+			return nil, nil
+		}
+	} else {
+		clientAddr := ""
+		if d.Addr != nil {
+			clientAddr, _, _ = net.SplitHostPort(d.Addr.String())
+		}
+		res, err = dnsFilter.CheckHost(host, d.Req.Question[0].Qtype, clientAddr)
+		if err != nil {
+			// Return immediately if there's an error
+			return nil, errorx.Decorate(err, "dnsfilter failed to check host '%s'", host)
+		}
 	}
-	res, err = dnsFilter.CheckHost(host, d.Req.Question[0].Qtype, clientAddr)
-	if err != nil {
-		// Return immediately if there's an error
-		return nil, errorx.Decorate(err, "dnsfilter failed to check host '%s'", host)
-	} else if res.IsFiltered {
+
+	if res.IsFiltered {
 		// log.Tracef("Host %s is filtered, reason - '%s', matched rule: '%s'", host, res.Reason, res.Rule)
 		d.Res = s.genDNSFilterMessage(d, &res)
+	} else if res.Reason == dnsfilter.ReasonRewrite {
+		if len(res.CanonName) != 0 && len(res.IPList) == 0 {
+			// resolve the canonical name, the CNAME record will be added to the response later
+			d.Req.Question[0].Name = dns.Fqdn(res.CanonName)
+		} else {
+			d.Res = s.genRewriteResponse(d.Req, &res)
+		}
 	}
 
 	return &res, err
 }
 
+// genRewriteResponse generates a response from the DNS rewrites
+func (s *Server) genRewriteResponse(req *dns.Msg, res *dnsfilter.Result) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+
+	name := req.Question[0].Name
+	if len(res.CanonName) != 0 {
+		resp.Answer = append(resp.Answer, s.genCNAMEAnswer(name, res.CanonName))
+		name = dns.Fqdn(res.CanonName)
+	}
+	for _, ip := range res.IPList {
+		if req.Question[0].Qtype == dns.TypeA {
+			a := s.genAAnswer(req, ip)
+			a.Hdr.Name = name
+			resp.Answer = append(resp.Answer, a)
+		} else {
+			aaaa := s.genAAAAAnswer(req, ip)
+			aaaa.Hdr.Name = name
+			resp.Answer = append(resp.Answer, aaaa)
+		}
+	}
+	return &resp
+}
+
+// addRewriteCNAME restores the original question of a request which was sent upstream
+// for the canonical name of a rewritten host, and adds the CNAME record to the response
+func (s *Server) addRewriteCNAME(d *proxy.DNSContext, origName string, canonName string) {
+	d.Req.Question[0].Name = origName
+	if d.Res == nil {
+		return
+	}
+	d.Res = d.Res.Copy() // the response may be cached for the canonical name
+	if len(d.Res.Question) != 0 {
+		d.Res.Question[0].Name = origName
+	}
+	answer := []dns.RR{s.genCNAMEAnswer(origName, canonName)}
+	d.Res.Answer = append(answer, d.Res.Answer...)
+}
+
 // genDNSFilterMessage generates a DNS message corresponding to the filtering result
 func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Result) *dns.Msg {
 	m := d.Req
 
 	if m.Question[0].Qtype != dns.TypeA && m.Question[0].Qtype != dns.TypeAAAA {
+		if s.conf.BlockingMode == "refused" {
+			return s.genRefused(m)
+		}
 		return s.genNXDomain(m)
 	}
 
@@ -525,10 +1189,14 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 	case dnsfilter.FilteredParental:
 		return s.genBlockedHost(m, parentalBlockHost, d)
 	default:
-		if result.IP != nil {
-			if m.Question[0].Qtype == dns.TypeA {
-				return s.genARecord(m, result.IP)
-			} else if m.Question[0].Qtype == dns.TypeAAAA {
+		// "0.0.0.0 host" and "127.0.0.1 host" rules only tell that the host is blocked,
+		// in custom_ip mode respond with the custom addresses for both A and AAAA, so clients get the blocking page
+		nullIP := result.IP.IsUnspecified() || result.IP.IsLoopback()
+		if result.IP != nil && !(s.conf.BlockingMode == "custom_ip" && nullIP) {
+			ip4 := result.IP.To4()
+			if m.Question[0].Qtype == dns.TypeA && ip4 != nil {
+				return s.genARecord(m, ip4)
+			} else if m.Question[0].Qtype == dns.TypeAAAA && ip4 == nil {
 				return s.genAAAARecord(m, result.IP)
 			}
 
@@ -538,13 +1206,25 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 			return &resp
 		}
 
-		if s.conf.BlockingMode == "null_ip" {
+		switch s.conf.BlockingMode {
+		case "null_ip":
 			switch m.Question[0].Qtype {
 			case dns.TypeA:
 				return s.genARecord(m, []byte{0, 0, 0, 0})
 			case dns.TypeAAAA:
 				return s.genAAAARecord(m, net.IPv6zero)
 			}
+
+		case "custom_ip":
+			switch m.Question[0].Qtype {
+			case dns.TypeA:
+				return s.genARecord(m, s.blockingIPv4)
+			case dns.TypeAAAA:
+				return s.genAAAARecord(m, s.blockingIPv6)
+			}
+
+		case "refused":
+			return s.genRefused(m)
 		}
 
 		return s.genNXDomain(m)
@@ -584,6 +1264,18 @@ func (s *Server) genAAnswer(req *dns.Msg, ip net.IP) *dns.A {
 	return answer
 }
 
+func (s *Server) genCNAMEAnswer(name string, target string) *dns.CNAME {
+	answer := new(dns.CNAME)
+	answer.Hdr = dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeCNAME,
+		Ttl:    s.conf.BlockedResponseTTL,
+		Class:  dns.ClassINET,
+	}
+	answer.Target = dns.Fqdn(target)
+	return answer
+}
+
 func (s *Server) genAAAAAnswer(req *dns.Msg, ip net.IP) *dns.AAAA {
 	answer := new(dns.AAAA)
 	answer.Hdr = dns.RR_Header{
@@ -609,7 +1301,7 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 		Req:       &replReq,
 	}
 
-	err := s.dnsProxy.Resolve(newContext)
+	err := s.upstreamProxy(s.dnsProxy).Resolve(newContext)
 	if err != nil {
 		log.Printf("Couldn't look up replacement host '%s': %s", newAddr, err)
 		return s.genServerFailure(request)
@@ -628,6 +1320,13 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 	return &resp
 }
 
+func (s *Server) genRefused(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeRefused)
+	resp.RecursionAvailable = true
+	return &resp
+}
+
 func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	resp := dns.Msg{}
 	resp.SetRcode(request, dns.RcodeNameError)
@@ -636,6 +1335,15 @@ func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// Generate an empty answer with SOA record, so the clients cache it
+func (s *Server) genNoData(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetReply(request)
+	resp.RecursionAvailable = true
+	resp.Ns = s.genSOA(request)
+	return &resp
+}
+
 func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 	zone := ""
 	if len(request.Question) > 0 {
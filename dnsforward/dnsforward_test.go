@@ -1,23 +1,40 @@
 package dnsforward
 
 import (
+	"context"
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/binary"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/clock"
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/testmode"
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/bluele/gcache"
+	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -106,7 +123,7 @@ func TestDotServer(t *testing.T) {
 	}
 
 	// Create a DNS-over-TLS client connection
-	addr := s.dnsProxy.Addr(proxy.ProtoTLS)
+	addr := s.DOTAddr()
 	conn, err := dns.DialWithTLS("tcp-tls", addr.String(), tlsConfig)
 	if err != nil {
 		t.Fatalf("cannot connect to the proxy: %s", err)
@@ -340,6 +357,118 @@ func TestNullBlockedRequest(t *testing.T) {
 	}
 }
 
+func TestCustomIPBlockedRequest(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.FilteringConfig.BlockingMode = "custom_ip"
+	s.conf.FilteringConfig.BlockingIPv4 = "10.0.0.1"
+	s.conf.FilteringConfig.BlockingIPv6 = "::1"
+	defer removeDataDir(t)
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	req := createTestMessage("nxdomain.example.org.")
+	reply, err := dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	}
+	a, ok := reply.Answer[0].(*dns.A)
+	assert.True(t, ok)
+	assert.True(t, net.IPv4(10, 0, 0, 1).Equal(a.A))
+
+	req = createTestMessage("nxdomain.example.org.")
+	req.Question[0].Qtype = dns.TypeAAAA
+	reply, err = dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	}
+	aaaa, ok := reply.Answer[0].(*dns.AAAA)
+	assert.True(t, ok)
+	assert.True(t, net.IPv6loopback.Equal(aaaa.AAAA))
+
+	// a hosts-syntax blocking rule is answered with the custom IPv6 address too
+	req = createTestMessage("zero.example.org.")
+	req.Question[0].Qtype = dns.TypeAAAA
+	reply, err = dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	}
+	aaaa, ok = reply.Answer[0].(*dns.AAAA)
+	assert.True(t, ok)
+	assert.True(t, net.IPv6loopback.Equal(aaaa.AAAA))
+
+	// "127.0.0.1 host" rule is handled the same way
+	req = createTestMessage("host.example.org.")
+	req.Question[0].Qtype = dns.TypeAAAA
+	reply, err = dns.Exchange(req, addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	}
+	aaaa, ok = reply.Answer[0].(*dns.AAAA)
+	assert.True(t, ok)
+	assert.True(t, net.IPv6loopback.Equal(aaaa.AAAA))
+
+	reply, err = dns.Exchange(createTestMessage("host.example.org."), addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	if len(reply.Answer) != 1 {
+		t.Fatalf("DNS server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
+	}
+	a, ok = reply.Answer[0].(*dns.A)
+	assert.True(t, ok)
+	assert.True(t, net.IPv4(10, 0, 0, 1).Equal(a.A))
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("DNS server failed to stop: %s", err)
+	}
+}
+
+func TestRefusedBlockedRequest(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.FilteringConfig.BlockingMode = "refused"
+	defer removeDataDir(t)
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
+
+	reply, err := dns.Exchange(createTestMessage("nxdomain.example.org."), addr.String())
+	if err != nil {
+		t.Fatalf("Couldn't talk to server %s: %s", addr, err)
+	}
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("DNS server failed to stop: %s", err)
+	}
+}
+
+func TestCheckBlockingMode(t *testing.T) {
+	assert.Nil(t, CheckBlockingMode("nxdomain", "", ""))
+	assert.Nil(t, CheckBlockingMode("custom_ip", "1.2.3.4", "::1"))
+	assert.NotNil(t, CheckBlockingMode("custom_ip", "::1", "::1"))
+	assert.NotNil(t, CheckBlockingMode("custom_ip", "1.2.3.4", ""))
+	assert.NotNil(t, CheckBlockingMode("unknown", "", ""))
+}
+
 func TestBlockedByHosts(t *testing.T) {
 	s := createTestServer(t)
 	defer removeDataDir(t)
@@ -458,7 +587,7 @@ func createTestServer(t *testing.T) *Server {
 	s.conf.FilteringConfig.SafeBrowsingEnabled = true
 	s.conf.Filters = make([]dnsfilter.Filter, 0)
 
-	rules := "||nxdomain.example.org^\n||null.example.org^\n127.0.0.1	host.example.org\n"
+	rules := "||nxdomain.example.org^\n||null.example.org^\n127.0.0.1	host.example.org\n0.0.0.0	zero.example.org\n"
 	filter := dnsfilter.Filter{ID: 1, Data: []byte(rules)}
 	s.conf.Filters = append(s.conf.Filters, filter)
 	return s
@@ -691,3 +820,2444 @@ func TestIsBlockedIPBlockedDomain(t *testing.T) {
 		t.Fatalf("isBlockedDomain")
 	}
 }
+
+func TestChattyClients(t *testing.T) {
+	c := newChattyTracker()
+	req := createTestMessage("example.org.")
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+
+	now := time.Now()
+	// this client re-queries the domain every 5 seconds
+	for i := 0; i < 20; i++ {
+		c.add("1.1.1.1", req, res, now.Add(time.Duration(i)*5*time.Second))
+	}
+	// this one honors TTL
+	for i := 0; i < 20; i++ {
+		c.add("2.2.2.2", req, res, now.Add(time.Duration(i)*301*time.Second))
+	}
+
+	report := c.report()
+	if len(report) != 1 || report[0].IP != "1.1.1.1" {
+		t.Fatalf("chatty report: %v", report)
+	}
+	d := report[0].Domains
+	if len(d) != 1 || d[0].Domain != "example.org" || d[0].Premature != 19 ||
+		d[0].Interval != 5 || d[0].Suggested != 300 {
+		t.Fatalf("chatty report domains: %v", d)
+	}
+
+	c.purge()
+	assert.Equal(t, 0, len(c.report()))
+}
+
+func TestQueryLogReplica(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+
+	// the primary instance writes the log...
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	for _, host := range []string{"first.example.org.", "second.example.org."} {
+		l.logRequest(createTestMessage(host), nil, nil, time.Millisecond, &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}, proxy.ProtoUDP, "", 0, "", false, false, "")
+	}
+	err := l.flush()
+	if err != nil {
+		t.Fatalf("flush: %s", err)
+	}
+
+	// ...and the replica reads it, newest first
+	r := newQueryLogReplica(dir)
+	data := r.getQueryLog()
+	assert.Equal(t, 2, len(data))
+	q, ok := data[0]["question"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "second.example.org", q["host"])
+}
+
+func TestProbeListeners(t *testing.T) {
+	busy, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenTCP: %s", err)
+	}
+	defer busy.Close()
+
+	c := proxy.Config{
+		UDPListenAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		TCPListenAddr: busy.Addr().(*net.TCPAddr),
+		TLSListenAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+	}
+	disableListeners(&c, []string{ListenerTLS})
+	assert.Nil(t, c.TLSListenAddr)
+
+	errs := probeListeners(&c)
+	assert.Equal(t, 1, len(errs))
+	assert.NotEmpty(t, errs[ListenerTCP])
+	assert.Nil(t, c.TCPListenAddr)
+	assert.NotNil(t, c.UDPListenAddr)
+}
+
+func TestStatsResetSelected(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	s := newStats()
+	add := func(host string, ip net.IP) {
+		entry := l.logRequest(createTestMessage(host), nil, nil, time.Millisecond, &net.UDPAddr{IP: ip}, proxy.ProtoUDP, "", 0, "", false, false, "")
+		s.incrementCounters(entry)
+	}
+	add("example.org.", net.IP{1, 1, 1, 1})
+	add("example.org.", net.IP{2, 2, 2, 2})
+	add("example.com.", net.IP{2, 2, 2, 2})
+	// some of the requests are in the file, some are still in the buffer
+	err := l.flush()
+	assert.Nil(t, err)
+	add("example.net.", net.IP{1, 1, 1, 1})
+
+	removed, err := l.resetStats(s, nil, StatsResetFilter{Client: "1.1.1.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, 2.0, s.getAggregatedStats()["dns_queries"])
+	top := l.runningTop.getStatsTop()
+	assert.Equal(t, 0, top.Clients["1.1.1.1"])
+	assert.Equal(t, 2, top.Clients["2.2.2.2"])
+	assert.Equal(t, 1, top.Domains["example.org"])
+	assert.Equal(t, 0, top.Domains["example.net"])
+
+	// the removed requests aren't counted twice
+	removed, err = l.resetStats(s, nil, StatsResetFilter{Domain: "example.org"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 1.0, s.getAggregatedStats()["dns_queries"])
+
+	// requests outside of the time range are kept
+	removed, err = l.resetStats(s, nil, StatsResetFilter{End: time.Now().Add(-time.Hour)})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestStatsDB(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	assert.NotNil(t, CheckStatsInterval(2))
+
+	path := filepath.Join(dir, statsDBFileName)
+	db, err := openStatsDB(path, 7)
+	if err != nil {
+		t.Fatalf("openStatsDB: %s", err)
+	}
+	s := newStats()
+	now := time.Now()
+	add := func(when time.Time, filtered bool) *logEntry {
+		entry := &logEntry{
+			Time:    when,
+			Elapsed: 10 * time.Millisecond,
+			Proto:   proxy.ProtoUDP,
+			Result:  dnsfilter.Result{IsFiltered: filtered, Reason: dnsfilter.FilteredBlackList},
+		}
+		if !filtered {
+			entry.Result = dnsfilter.Result{}
+		}
+		db.add(s, entry, 1)
+		return entry
+	}
+	add(now, false)
+	blocked := add(now, true)
+	add(now.Add(-25*time.Hour), false)
+	add(now.Add(-8*24*time.Hour), false) // outside of the interval
+
+	// the statistics survive the restart
+	db.close()
+	db, err = openStatsDB(path, 7)
+	if err != nil {
+		t.Fatalf("openStatsDB: %s", err)
+	}
+	data, err := db.getAggregatedStats(s, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 3.0, data["dns_queries"])
+	assert.Equal(t, 1.0, data["blocked_filtering"])
+	assert.Equal(t, 3.0, data["dns_queries_udp"])
+	assert.Equal(t, 10.0, data["avg_processing_time"])
+	assert.Equal(t, "7 days", data["stats_period"])
+	assert.Equal(t, "hours", data["time_unit"])
+	series := data["series"].(map[string]interface{})["dns_queries"].([]float64)
+	assert.Equal(t, 7*24, len(series))
+	assert.Equal(t, 2.0, series[len(series)-1])
+	assert.Equal(t, 1.0, series[len(series)-26])
+
+	// the removed request
+	db.add(s, blocked, -1)
+	data, err = db.getAggregatedStats(s, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, data["dns_queries"])
+	assert.Equal(t, 0.0, data["blocked_filtering"])
+
+	// the longer interval has the daily series, the values outside of the shorter one have been removed
+	db.close()
+	db, err = openStatsDB(path, 30)
+	if err != nil {
+		t.Fatalf("openStatsDB: %s", err)
+	}
+	data, err = db.getAggregatedStats(s, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, data["dns_queries"])
+	assert.Equal(t, "days", data["time_unit"])
+	assert.Equal(t, 30, len(data["series"].(map[string]interface{})["dns_queries"].([]float64)))
+	db.close()
+
+	db, err = openStatsDB(path, 1)
+	if err != nil {
+		t.Fatalf("openStatsDB: %s", err)
+	}
+	data, err = db.getAggregatedStats(s, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, data["dns_queries"])
+	assert.Equal(t, "24 hours", data["stats_period"])
+
+	assert.Nil(t, db.purge())
+	data, err = db.getAggregatedStats(s, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, data["dns_queries"])
+	db.close()
+}
+
+func TestStatsTopReport(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+
+	db, err := openStatsDB(filepath.Join(dir, statsDBFileName), 7)
+	if err != nil {
+		t.Fatalf("openStatsDB: %s", err)
+	}
+	defer db.close()
+	s := newStats()
+	now := time.Now()
+	add := func(host string, client string, upstream string, filtered bool, when time.Time) *logEntry {
+		q, _ := createTestMessage(host).Pack()
+		entry := &logEntry{
+			Question: q,
+			Time:     when,
+			IP:       client,
+			Upstream: upstream,
+			Result:   dnsfilter.Result{IsFiltered: filtered},
+		}
+		db.add(s, entry, 1)
+		return entry
+	}
+	add("a.example.org.", "1.1.1.1", "8.8.8.8:53", false, now)
+	add("a.example.org.", "2.2.2.2", "8.8.8.8:53", false, now)
+	add("b.example.org.", "1.1.1.1", "", false, now)
+	removed := add("ads.example.org.", "1.1.1.1", "", true, now)
+	add("ads.example.org.", "1.1.1.1", "", true, now)
+	add("old.example.org.", "3.3.3.3", "1.1.1.1:53", false, now.Add(-3*time.Hour))
+
+	r, err := db.getTopReport(now.Add(-time.Hour), now, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []StatsTopItem{{"a.example.org", 2}, {"ads.example.org", 2}}, r.Domains)
+	assert.Equal(t, []StatsTopItem{{"ads.example.org", 2}}, r.Blocked)
+	assert.Equal(t, []StatsTopItem{{"1.1.1.1", 4}, {"2.2.2.2", 1}}, r.Clients)
+	assert.Equal(t, []StatsTopItem{{"8.8.8.8:53", 2}}, r.Upstreams)
+
+	// the longer time range, the removed request
+	db.add(s, removed, -1)
+	r, err = db.getTopReport(now.Add(-24*time.Hour), now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []StatsTopItem{{"a.example.org", 2}, {"ads.example.org", 1}, {"b.example.org", 1}, {"old.example.org", 1}}, r.Domains)
+	assert.Equal(t, []StatsTopItem{{"8.8.8.8:53", 2}, {"1.1.1.1:53", 1}}, r.Upstreams)
+
+	// the finished hour keeps its most frequent keys
+	assert.Nil(t, db.compactTop(now.Add(-2*time.Hour)))
+	r, err = db.getTopReport(now.Add(-24*time.Hour), now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(r.Domains))
+
+	assert.Nil(t, db.purge())
+	r, err = db.getTopReport(now.Add(-24*time.Hour), now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(r.Clients))
+}
+
+func TestStatsClientReport(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+
+	db, err := openStatsDB(filepath.Join(dir, statsDBFileName), 30)
+	if err != nil {
+		t.Fatalf("openStatsDB: %s", err)
+	}
+	defer db.close()
+	s := newStats()
+	now := time.Now()
+	add := func(host string, client string, filtered bool, when time.Time) {
+		q, _ := createTestMessage(host).Pack()
+		db.add(s, &logEntry{Question: q, Time: when, IP: client, Result: dnsfilter.Result{IsFiltered: filtered}}, 1)
+	}
+	add("tv.example.org.", "1.1.1.1", false, now)
+	add("tv.example.org.", "1.1.1.1", false, now.Add(-2*time.Hour))
+	add("ads.example.org.", "1.1.1.1", true, now)
+	add("old.example.org.", "1.1.1.1", false, now.Add(-3*24*time.Hour))
+	add("other.example.org.", "1.1.1.10", false, now)
+
+	r, err := db.getClientReport("1.1.1.1", now.Add(-24*time.Hour), now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 3.0, r.Requests)
+	assert.Equal(t, 1.0, r.Blocked)
+	assert.Equal(t, "hours", r.TimeUnit)
+	assert.Equal(t, 25, len(r.RequestsSeries))
+	assert.Equal(t, 2.0, r.RequestsSeries[24])
+	assert.Equal(t, 1.0, r.RequestsSeries[22])
+	assert.Equal(t, 1.0, r.BlockedSeries[24])
+	assert.Equal(t, []StatsTopItem{{"tv.example.org", 2}, {"ads.example.org", 1}}, r.Domains)
+
+	// the daily series
+	r, err = db.getClientReport("1.1.1.1", now.Add(-10*24*time.Hour), now, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 4.0, r.Requests)
+	assert.Equal(t, "days", r.TimeUnit)
+	assert.Equal(t, []StatsTopItem{{"tv.example.org", 2}}, r.Domains)
+
+	r, err = db.getClientReport("2.2.2.2", now.Add(-24*time.Hour), now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, r.Requests)
+	assert.Equal(t, 0, len(r.Domains))
+}
+
+// upstream which responds after a delay
+type slowUpstream struct {
+	delay time.Duration
+}
+
+func (u *slowUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(u.delay)
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	return resp, nil
+}
+
+func (u *slowUpstream) Address() string {
+	return "slow"
+}
+
+func TestLatencyBudget(t *testing.T) {
+	u := &slowUpstream{}
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.conf.LatencyBudget = 100
+	addr := &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}
+
+	// the upstream responds in time
+	d := &proxy.DNSContext{Req: createTestMessage("example.org."), Addr: addr}
+	assert.Nil(t, s.resolve(p, d))
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, uint32(300), d.Res.Answer[0].Header().Ttl)
+
+	// the upstream is too slow: the stale answer is served
+	u.delay = 500 * time.Millisecond
+	d = &proxy.DNSContext{Req: createTestMessage("example.org."), Addr: addr}
+	start := time.Now()
+	assert.Nil(t, s.resolve(p, d))
+	assert.True(t, time.Since(start) < 400*time.Millisecond)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+	assert.Equal(t, uint32(staleTTL), d.Res.Answer[0].Header().Ttl)
+	assert.Equal(t, d.Req.Id, d.Res.Id)
+
+	// no stale answer: SERVFAIL
+	d = &proxy.DNSContext{Req: createTestMessage("example.com."), Addr: addr}
+	assert.Nil(t, s.resolve(p, d))
+	assert.Equal(t, dns.RcodeServerFailure, d.Res.Rcode)
+
+	// the client has a larger budget
+	s.conf.LatencyBudgetHandler = func(clientAddr string) uint32 {
+		if clientAddr == "1.2.3.4" {
+			return 1000
+		}
+		return 0
+	}
+	d = &proxy.DNSContext{Req: createTestMessage("example.net."), Addr: addr}
+	assert.Nil(t, s.resolve(p, d))
+	assert.Equal(t, uint32(300), d.Res.Answer[0].Header().Ttl)
+}
+
+func TestClientUpstreams(t *testing.T) {
+	answer := func(ip net.IP) *testmode.Upstream {
+		u := testmode.NewUpstream()
+		for _, host := range []string{"example.org", "www.corp.example", "public.corp.example"} {
+			u.SetAnswer(host, dns.TypeA, &dns.A{
+				Hdr: dns.RR_Header{Name: host + ".", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   ip,
+			})
+		}
+		return u
+	}
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{answer(net.IPv4(1, 2, 3, 4))}
+	clientUpstream := answer(net.IPv4(5, 6, 7, 8))
+	corpUpstream := answer(net.IPv4(10, 0, 0, 1))
+	s := NewServer("")
+	s.conf.ClientUpstreamsHandler = func(clientAddr string) *proxy.UpstreamConfig {
+		switch clientAddr {
+		case "192.168.1.2":
+			return &proxy.UpstreamConfig{Upstreams: []upstream.Upstream{clientUpstream}}
+		case "192.168.1.4":
+			// only the corporate domains are sent to the client's own server
+			return &proxy.UpstreamConfig{DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"corp.example.":        {corpUpstream},
+				"public.corp.example.": nil,
+			}}
+		}
+		return nil
+	}
+	resolve := func(host string, ip net.IP) string {
+		d := &proxy.DNSContext{Req: createTestMessage(host), Addr: &net.UDPAddr{IP: ip}}
+		assert.Nil(t, s.resolve(p, d))
+		return d.Res.Answer[0].(*dns.A).A.String()
+	}
+
+	// the client uses its own upstream server
+	d := &proxy.DNSContext{Req: createTestMessage("example.org."), Addr: &net.UDPAddr{IP: net.IP{192, 168, 1, 2}}}
+	assert.Nil(t, s.resolve(p, d))
+	assert.Equal(t, "5.6.7.8", d.Res.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, clientUpstream, d.Upstream)
+
+	// the other clients use the configured upstream servers
+	assert.Equal(t, "1.2.3.4", resolve("example.org.", net.IP{192, 168, 1, 3}))
+
+	// domain-specific upstream servers
+	assert.Equal(t, "10.0.0.1", resolve("www.corp.example.", net.IP{192, 168, 1, 4}))
+	assert.Equal(t, "1.2.3.4", resolve("public.corp.example.", net.IP{192, 168, 1, 4}))
+	assert.Equal(t, "1.2.3.4", resolve("example.org.", net.IP{192, 168, 1, 4}))
+
+	// the cached answers aren't shared
+	key := func(ip net.IP) string {
+		return s.upstreamsKey(&proxy.DNSContext{Addr: &net.UDPAddr{IP: ip}})
+	}
+	assert.Equal(t, "", key(net.IP{192, 168, 1, 3}))
+	assert.NotEqual(t, "", key(net.IP{192, 168, 1, 2}))
+	assert.NotEqual(t, key(net.IP{192, 168, 1, 2}), key(net.IP{192, 168, 1, 4}))
+	assert.Equal(t, key(net.IP{192, 168, 1, 4}), key(net.IP{192, 168, 1, 4}))
+}
+
+func TestStaleAnswerExpiry(t *testing.T) {
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.conf.LatencyBudget = 1000
+
+	d := &proxy.DNSContext{Req: createTestMessage("example.org."), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+	assert.Nil(t, s.resolve(p, d))
+	assert.Equal(t, 1, u.Requests())
+	assert.Equal(t, 1, len(d.Res.Answer))
+
+	fake.Advance(staleMaxAge - time.Minute)
+	assert.NotNil(t, s.getStale(staleKey(d.Req), d.Req))
+	fake.Advance(2 * time.Minute)
+	assert.Nil(t, s.getStale(staleKey(d.Req), d.Req))
+}
+
+func TestDOHClientID(t *testing.T) {
+	assert.Equal(t, "", ClientIDFromPath("/dns-query"))
+	assert.Equal(t, "", ClientIDFromPath("/dns-query/"))
+	assert.Equal(t, "phone", ClientIDFromPath("/dns-query/phone"))
+	assert.Equal(t, "", ClientIDFromPath("/control/status"))
+
+	s := NewServer("")
+	s.conf.ClientIDHandler = func(clientID string, clientAddr string) string {
+		if clientID == "phone" {
+			return "192.168.1.2"
+		}
+		return ""
+	}
+	addr := &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 443}
+
+	r := httptest.NewRequest(http.MethodPost, "/dns-query/phone", nil)
+	d := &proxy.DNSContext{Proto: proxy.ProtoHTTPS, Req: createTestMessage("example.org."), Addr: addr, HTTPRequest: r}
+	s.identifyClient(d)
+	assert.Equal(t, "192.168.1.2", GetIPString(d.Addr))
+
+	// unknown client ID: the address isn't changed
+	r = httptest.NewRequest(http.MethodPost, "/dns-query/tv", nil)
+	d = &proxy.DNSContext{Proto: proxy.ProtoHTTPS, Req: createTestMessage("example.org."), Addr: addr, HTTPRequest: r}
+	s.identifyClient(d)
+	assert.Equal(t, "1.2.3.4", GetIPString(d.Addr))
+
+	// plain DNS
+	d = &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: createTestMessage("example.org."), Addr: addr}
+	assert.Equal(t, "", s.identifyClient(d))
+	assert.Equal(t, "1.2.3.4", GetIPString(d.Addr))
+
+	// invalid client ID
+	r = httptest.NewRequest(http.MethodPost, "/dns-query/phone/1", nil)
+	d = &proxy.DNSContext{Proto: proxy.ProtoHTTPS, Req: createTestMessage("example.org."), Addr: addr, HTTPRequest: r}
+	assert.Equal(t, "", s.identifyClient(d))
+	assert.Equal(t, "1.2.3.4", GetIPString(d.Addr))
+
+	// the client ID is returned and shown in the query log
+	r = httptest.NewRequest(http.MethodPost, "/dns-query/phone", nil)
+	d = &proxy.DNSContext{Proto: proxy.ProtoHTTPS, Req: createTestMessage("example.org."), Addr: addr, HTTPRequest: r}
+	id := s.identifyClient(d)
+	assert.Equal(t, "phone", id)
+	entry := s.queryLog.logRequest(d.Req, nil, nil, time.Millisecond, d.Addr, d.Proto, "", 0, "", false, false, id)
+	assert.Equal(t, "phone", logEntryToJSON(entry)["client_id"])
+	assert.Equal(t, "192.168.1.2", logEntryToJSON(entry)["client"])
+}
+
+func TestDotConnections(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+	s := createTestServer(t)
+	defer removeDataDir(t)
+
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	s.conf.Upstreams = []upstream.Upstream{u}
+	s.conf.TLSConfig = TLSConfig{
+		TLSListenAddr:    &net.TCPAddr{Port: 0},
+		CertificateChain: string(certPem),
+		PrivateKey:       string(keyPem),
+	}
+	s.conf.DisabledListeners = []string{ListenerUDP, ListenerTCP}
+	s.conf.DOTMaxConnections = 1
+	s.conf.DOTIdleTimeout = 1
+	s.conf.TLSServerName = tlsServerName
+	s.conf.ClientIDHandler = func(clientID string, clientAddr string) string {
+		if clientID == "phone" {
+			return "192.168.1.2"
+		}
+		return ""
+	}
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer s.Stop()
+
+	tlsConfig := &tls.Config{
+		ServerName:         "phone." + tlsServerName,
+		InsecureSkipVerify: true,
+	}
+	addr := s.DOTAddr().String()
+	conn, err := dns.DialWithTLS("tcp-tls", addr, tlsConfig)
+	if err != nil {
+		t.Fatalf("cannot connect to the server: %s", err)
+	}
+	defer conn.Close()
+	err = conn.WriteMsg(createTestMessage("example.org."))
+	assert.Nil(t, err)
+	res, err := conn.ReadMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Answer))
+
+	// the client is identified by the server name
+	log := s.GetQueryLog()
+	assert.Equal(t, 1, len(log))
+	assert.Equal(t, "192.168.1.2", log[0]["client"])
+
+	// the connections limit is reached
+	conn2, err := dns.DialWithTLS("tcp-tls", addr, tlsConfig)
+	if err == nil {
+		_ = conn2.WriteMsg(createTestMessage("example.org."))
+		_, err = conn2.ReadMsg()
+		conn2.Close()
+	}
+	assert.NotNil(t, err)
+
+	// the idle connection is closed
+	time.Sleep(1500 * time.Millisecond)
+	assert.Equal(t, 0, s.dot.connCount())
+	_ = conn.WriteMsg(createTestMessage("example.org."))
+	_, err = conn.ReadMsg()
+	assert.NotNil(t, err)
+}
+
+func TestStatsProtocols(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	s := newStats()
+	for _, proto := range []string{proxy.ProtoUDP, proxy.ProtoUDP, proxy.ProtoTCP, proxy.ProtoTLS, ProtoQUIC} {
+		entry := l.logRequest(createTestMessage("example.org."), nil, nil, time.Millisecond, &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}, proto, "", 0, "", false, false, "")
+		s.incrementCounters(entry)
+	}
+
+	summed := s.getAggregatedStats()
+	assert.Equal(t, 5.0, summed["dns_queries"])
+	assert.Equal(t, 2.0, summed["dns_queries_udp"])
+	assert.Equal(t, 1.0, summed["dns_queries_tcp"])
+	assert.Equal(t, 1.0, summed["dns_queries_tls"])
+	assert.Equal(t, 0.0, summed["dns_queries_https"])
+	assert.Equal(t, 1.0, summed["dns_queries_quic"])
+}
+
+// Send the request on a new DNS-over-QUIC stream and read the response
+func doqExchange(conn quic.Connection, req *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	packet, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+	copy(buf[2:], packet)
+	_, err = stream.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	// the client closes its side of the stream after the request
+	_ = stream.Close()
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, fmt.Errorf("invalid response length")
+	}
+	res := &dns.Msg{}
+	err = res.Unpack(data[2:])
+	return res, err
+}
+
+func TestDOQServer(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+	s := createTestServer(t)
+	defer removeDataDir(t)
+
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	s.conf.Upstreams = []upstream.Upstream{u}
+	s.conf.TLSConfig = TLSConfig{
+		QUICListenAddr:   &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 0},
+		CertificateChain: string(certPem),
+		PrivateKey:       string(keyPem),
+	}
+	s.conf.TLSServerName = tlsServerName
+	s.conf.ClientIDHandler = func(clientID string, clientAddr string) string {
+		if clientID == "phone" {
+			return "192.168.1.2"
+		}
+		return ""
+	}
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer s.Stop()
+	if s.DOQAddr() == nil {
+		t.Fatalf("DNS-over-QUIC listener isn't started: %v", s.ListenerErrors())
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         "phone." + tlsServerName,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"doq"},
+	}
+	conn, err := quic.DialAddr(context.Background(), s.DOQAddr().String(), tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("cannot connect to the server: %s", err)
+	}
+
+	req := createTestMessage("example.org.")
+	req.Id = 0
+	res, err := doqExchange(conn, req)
+	if err != nil {
+		t.Fatalf("doqExchange: %s", err)
+	}
+	assert.Equal(t, uint16(0), res.Id)
+	assert.Equal(t, 1, len(res.Answer))
+
+	// the client is identified by the server name, the protocol is counted
+	log := s.GetQueryLog()
+	assert.Equal(t, 1, len(log))
+	assert.Equal(t, "192.168.1.2", log[0]["client"])
+	assert.Equal(t, 1.0, s.stats.getAggregatedStats()["dns_queries_quic"])
+
+	// the message ID must be 0: the connection is closed with a protocol error
+	req.Id = 1
+	_, err = doqExchange(conn, req)
+	assert.NotNil(t, err)
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection isn't closed")
+	}
+}
+
+func TestDOQUpstream(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+	s := createTestServer(t)
+	defer removeDataDir(t)
+
+	tu := testmode.NewUpstream()
+	tu.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	s.conf.Upstreams = []upstream.Upstream{tu}
+	s.conf.TLSConfig = TLSConfig{
+		QUICListenAddr:   &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 0},
+		CertificateChain: string(certPem),
+		PrivateKey:       string(keyPem),
+	}
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer s.Stop()
+	if s.DOQAddr() == nil {
+		t.Fatalf("DNS-over-QUIC listener isn't started: %v", s.ListenerErrors())
+	}
+
+	addr := "quic://" + s.DOQAddr().String()
+	pu, err := AddressToUpstream(addr, upstream.Options{Timeout: time.Second}, PoolConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, addr, pu.Address())
+	u := pu.(*doqUpstream)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPem)
+	u.tlsConfig.RootCAs = roots
+	u.tlsConfig.ServerName = tlsServerName
+
+	// the connection is reused, the message ID is restored
+	var conn quic.Connection
+	for i := 0; i != 3; i++ {
+		req := createTestMessage("example.org.")
+		res, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("Exchange: %s", err)
+		}
+		assert.Equal(t, req.Id, res.Id)
+		assert.Equal(t, 1, len(res.Answer))
+		if conn == nil {
+			conn = u.conn
+		}
+		assert.True(t, conn == u.conn)
+	}
+
+	// the closed connection is replaced
+	_ = conn.CloseWithError(0, "")
+	res, err := u.Exchange(createTestMessage("example.org."))
+	assert.Nil(t, err)
+	if res != nil {
+		assert.Equal(t, 1, len(res.Answer))
+	}
+	assert.False(t, conn == u.conn)
+
+	// the domain-specific servers are parsed
+	conf, err := ParseUpstreamsConfig([]string{"quic://dns.example", "[/example.org/]quic://dns.example:784"}, nil, time.Second, PoolConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, "quic://dns.example:853", conf.Upstreams[0].Address())
+	assert.Equal(t, "quic://dns.example:784", conf.DomainReservedUpstreams["example.org."][0].Address())
+}
+
+func TestDOQReplaySafe(t *testing.T) {
+	req := createTestMessage("example.org.")
+	assert.True(t, doqReplaySafe(req))
+	req.Opcode = dns.OpcodeUpdate
+	assert.False(t, doqReplaySafe(req))
+}
+
+func TestFastestAddr(t *testing.T) {
+	s := NewServer("")
+	probes := 0
+	var lock sync.Mutex
+	s.dialProbe = func(addr string, timeout time.Duration) error {
+		lock.Lock()
+		probes++
+		lock.Unlock()
+		host, _, _ := net.SplitHostPort(addr)
+		switch host {
+		case "1.1.1.1":
+			return fmt.Errorf("connection refused")
+		case "2.2.2.2":
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}
+	getProbes := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return probes
+	}
+
+	req := createTestMessage("example.org.")
+	res := new(dns.Msg)
+	res.SetReply(req)
+	for _, ip := range []net.IP{{1, 1, 1, 1}, {2, 2, 2, 2}, {3, 3, 3, 3}} {
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   ip,
+		})
+	}
+
+	fastest := s.pickFastestAddr(res)
+	assert.Equal(t, 1, len(fastest.Answer))
+	assert.Equal(t, "3.3.3.3", fastest.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 3, len(res.Answer))
+	assert.Equal(t, 3*len(fastestAddrPorts), getProbes())
+
+	// the probe results are cached
+	fastest = s.pickFastestAddr(res)
+	assert.Equal(t, "3.3.3.3", fastest.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, 3*len(fastestAddrPorts), getProbes())
+}
+
+// A signed zone for DNSSEC tests
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate: %s", err)
+	}
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  z.key.Algorithm,
+		SignerName: z.key.Hdr.Name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	err := sig.Sign(z.priv, rrset)
+	if err != nil {
+		t.Fatalf("Sign: %s", err)
+	}
+	return append(append([]dns.RR{}, rrset...), sig)
+}
+
+func newTestA(name string, ip net.IP) *dns.A {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: ip}
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+
+	u := testmode.NewUpstream()
+	u.SetAnswer(".", dns.TypeDNSKEY, root.sign(t, root.key)...)
+	u.SetAnswer("example.", dns.TypeDS, root.sign(t, example.key.ToDS(dns.SHA256))...)
+	u.SetAnswer("example.", dns.TypeDNSKEY, example.sign(t, example.key)...)
+
+	// "insecure." is an unsigned zone
+	nodata := new(dns.Msg)
+	nodata.Ns = root.sign(t, &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: "insecure.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: "zzz.",
+		TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+	})
+	u.SetResponse("insecure.", dns.TypeDS, nodata)
+
+	s := NewServer("")
+	s.dnssec = &dnssecValidator{
+		anchors: &trustAnchors{anchors: []*trustAnchor{{State: anchorValid, dnskey: root.key}}},
+		keys:    gcache.New(dnssecCacheSize).LRU().Build(),
+	}
+	check := func(name string, answer []dns.RR) (*dns.Msg, string) {
+		req := createTestMessage(name)
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = answer
+		return s.validateDNSSEC(u.Exchange, req, res)
+	}
+
+	res, status := check("www.example.", example.sign(t, newTestA("www.example.", net.IP{1, 2, 3, 4})))
+	assert.Equal(t, dnssecSecure, status)
+	assert.True(t, res.AuthenticatedData)
+
+	// the answer has been modified
+	answer := example.sign(t, newTestA("www.example.", net.IP{1, 2, 3, 4}))
+	answer[0].(*dns.A).A = net.IP{5, 6, 7, 8}
+	res, status = check("www.example.", answer)
+	assert.Equal(t, dnssecBogus, status)
+	assert.Equal(t, dns.RcodeServerFailure, res.Rcode)
+
+	// the signature has been stripped
+	_, status = check("www.example.", []dns.RR{newTestA("www.example.", net.IP{1, 2, 3, 4})})
+	assert.Equal(t, dnssecBogus, status)
+
+	res, status = check("www.insecure.", []dns.RR{newTestA("www.insecure.", net.IP{1, 2, 3, 4})})
+	assert.Equal(t, dnssecInsecure, status)
+	assert.False(t, res.AuthenticatedData)
+	assert.Equal(t, 1, len(res.Answer))
+
+	// signed by a key we don't trust
+	other := newTestZone(t, ".")
+	u.SetAnswer(".", dns.TypeDNSKEY, other.sign(t, other.key)...)
+	s.dnssec.keys.Purge()
+	_, status = check("www.example.", example.sign(t, newTestA("www.example.", net.IP{1, 2, 3, 4})))
+	assert.Equal(t, dnssecBogus, status)
+}
+
+// Get the NSEC3 hash which is next to this one (delta: 1 or -1)
+func nsec3Shift(hash string, delta int) string {
+	const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+	b := []byte(hash)
+	for i := len(b) - 1; i >= 0; i-- {
+		d := strings.IndexByte(alphabet, b[i]) + delta
+		carry := d < 0 || d >= len(alphabet)
+		b[i] = alphabet[(d+len(alphabet))%len(alphabet)]
+		if !carry {
+			break
+		}
+	}
+	return string(b)
+}
+
+// NSEC3 record of the zone which matches the name
+func newTestNSEC3(zone, name string, types ...uint16) *dns.NSEC3 {
+	h := dns.HashName(name, dns.SHA1, 0, "")
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: h + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+		Hash:       dns.SHA1,
+		NextDomain: nsec3Shift(h, 1),
+		HashLength: 20,
+		TypeBitMap: types,
+	}
+}
+
+// NSEC3 record of the zone which covers the name
+func newTestNSEC3Cover(zone, name string) *dns.NSEC3 {
+	h := dns.HashName(name, dns.SHA1, 0, "")
+	r := newTestNSEC3(zone, name, dns.TypeA)
+	r.Hdr.Name = nsec3Shift(h, -1) + "." + zone
+	r.NextDomain = nsec3Shift(h, 1)
+	return r
+}
+
+func newTestNSEC(name, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+func TestDNSSECDenial(t *testing.T) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+
+	u := testmode.NewUpstream()
+	u.SetAnswer(".", dns.TypeDNSKEY, root.sign(t, root.key)...)
+	u.SetAnswer("example.", dns.TypeDS, root.sign(t, example.key.ToDS(dns.SHA256))...)
+	u.SetAnswer("example.", dns.TypeDNSKEY, example.sign(t, example.key)...)
+	nodata := new(dns.Msg)
+	nodata.Ns = root.sign(t, newTestNSEC("insecure.", "zzz.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))
+	u.SetResponse("insecure.", dns.TypeDS, nodata)
+
+	s := NewServer("")
+	s.dnssec = &dnssecValidator{
+		anchors: &trustAnchors{anchors: []*trustAnchor{{State: anchorValid, dnskey: root.key}}},
+		keys:    gcache.New(dnssecCacheSize).LRU().Build(),
+	}
+	soa := example.sign(t, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 60,
+	})
+	check := func(name string, qtype uint16, rcode int, answer []dns.RR, ns ...[]dns.RR) string {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		res := new(dns.Msg)
+		res.SetRcode(req, rcode)
+		res.Answer = answer
+		for _, rrs := range ns {
+			res.Ns = append(res.Ns, rrs...)
+		}
+		_, status := s.validateDNSSEC(u.Exchange, req, res)
+		return status
+	}
+
+	// NXDOMAIN: the NSEC record covers the name and the wildcard
+	proof := example.sign(t, newTestNSEC("example.", "www.example.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC))
+	assert.Equal(t, dnssecSecure, check("nx.example.", dns.TypeA, dns.RcodeNameError, nil, soa, proof))
+
+	// forged NXDOMAIN: no proof, an unsigned one, or the proof for another name
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeNameError, nil))
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeNameError, nil, soa))
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeNameError, nil, soa[:1]))
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeNameError, nil, soa, proof))
+
+	// the wildcard isn't proven not to exist
+	noWildcard := example.sign(t, newTestNSEC("mx.example.", "www.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+	assert.Equal(t, dnssecBogus, check("nx.example.", dns.TypeA, dns.RcodeNameError, nil, soa, noWildcard))
+
+	// stripped answer: an empty response from the signed zone
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeSuccess, nil))
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeSuccess, nil, soa))
+
+	// NODATA: the name exists without the type
+	www := example.sign(t, newTestNSEC("www.example.", "zzz.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC))
+	assert.Equal(t, dnssecSecure, check("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil, soa, www))
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeSuccess, nil, soa, www))
+
+	// NSEC3: the closest encloser proof and the wildcard
+	nsec3 := func(rrs ...dns.RR) []dns.RR {
+		result := []dns.RR{}
+		for _, rr := range rrs {
+			result = append(result, example.sign(t, rr)...)
+		}
+		return result
+	}
+	apex := newTestNSEC3("example.", "example.", dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG)
+	nextCloser := newTestNSEC3Cover("example.", "nx.example.")
+	wildcard := newTestNSEC3Cover("example.", "*.example.")
+	assert.Equal(t, dnssecSecure, check("nx.example.", dns.TypeA, dns.RcodeNameError, nil, soa, nsec3(apex, nextCloser, wildcard)))
+	assert.Equal(t, dnssecBogus, check("nx.example.", dns.TypeA, dns.RcodeNameError, nil, soa, nsec3(apex, nextCloser)))
+	assert.Equal(t, dnssecBogus, check("nx.example.", dns.TypeA, dns.RcodeNameError, nil, soa, nsec3(nextCloser, wildcard)))
+	assert.Equal(t, dnssecSecure, check("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil, soa,
+		nsec3(newTestNSEC3("example.", "www.example.", dns.TypeA, dns.TypeRRSIG))))
+	assert.Equal(t, dnssecBogus, check("www.example.", dns.TypeA, dns.RcodeSuccess, nil, soa,
+		nsec3(newTestNSEC3("example.", "www.example.", dns.TypeA, dns.TypeRRSIG))))
+
+	// the answer synthesized from the wildcard requires the proof that the name doesn't exist
+	expanded := example.sign(t, newTestA("*.example.", net.IP{1, 2, 3, 4}))
+	for _, rr := range expanded {
+		rr.Header().Name = "nx.example."
+	}
+	assert.Equal(t, dnssecBogus, check("nx.example.", dns.TypeA, dns.RcodeSuccess, expanded))
+	assert.Equal(t, dnssecSecure, check("nx.example.", dns.TypeA, dns.RcodeSuccess, expanded, proof))
+	assert.Equal(t, dnssecSecure, check("nx.example.", dns.TypeA, dns.RcodeSuccess, expanded, nsec3(nextCloser)))
+
+	// the unsigned negative answer from the insecure zone
+	assert.Equal(t, dnssecInsecure, check("nx.insecure.", dns.TypeA, dns.RcodeNameError, nil))
+}
+
+func TestDNSSECTrustAnchors(t *testing.T) {
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	path := filepath.Join(dir, dnssecAnchorsFileName)
+
+	// the root zone key is the default
+	ta := loadTrustAnchors(path)
+	assert.Equal(t, 1, len(ta.trusted()))
+	assert.Equal(t, uint16(20326), ta.trusted()[0].KeyTag())
+
+	oldKey := ta.trusted()[0]
+	newKey := newTestZone(t, ".").key
+
+	// a new key isn't trusted until the hold-down time passes
+	ta.update([]*dns.DNSKEY{oldKey, newKey}, map[uint16]bool{oldKey.KeyTag(): true})
+	assert.Equal(t, 1, len(ta.trusted()))
+	fake.Advance(trustAnchorHoldDown)
+	ta.update([]*dns.DNSKEY{oldKey, newKey}, map[uint16]bool{oldKey.KeyTag(): true})
+	assert.Equal(t, 2, len(ta.trusted()))
+
+	// the state is saved
+	ta = loadTrustAnchors(path)
+	assert.Equal(t, 2, len(ta.trusted()))
+
+	// the old key is revoked: it signs the key set with REVOKE bit set
+	revoked := *oldKey
+	revoked.Flags |= dns.REVOKE
+	ta.update([]*dns.DNSKEY{&revoked, newKey}, map[uint16]bool{revoked.KeyTag(): true, newKey.KeyTag(): true})
+	assert.Equal(t, 1, len(ta.trusted()))
+	assert.Equal(t, newKey.KeyTag(), ta.trusted()[0].KeyTag())
+}
+
+func TestDNSCache(t *testing.T) {
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	nxdomain := new(dns.Msg)
+	nxdomain.Rcode = dns.RcodeNameError
+	nxdomain.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.org.",
+		Mbox:   "hostmaster.org.",
+		Minttl: 60,
+	}}
+	u.SetResponse("nx.org", dns.TypeA, nxdomain)
+
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer s.dnsFilter.Destroy()
+	s.cache = newDNSCache(4096, 0, 0, false)
+
+	query := func(host string) *dns.Msg {
+		d := &proxy.DNSContext{Req: createTestMessage(host), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+		assert.Nil(t, s.handleDNSRequest(p, d))
+		return d.Res
+	}
+
+	res := query("example.org.")
+	assert.Equal(t, 1, u.Requests())
+	assert.Equal(t, uint32(300), res.Answer[0].Header().Ttl)
+
+	// the TTL is decreased by the time the response has been in cache
+	fake.Advance(100 * time.Second)
+	res = query("example.org.")
+	assert.Equal(t, 1, u.Requests())
+	assert.Equal(t, uint32(200), res.Answer[0].Header().Ttl)
+
+	fake.Advance(200 * time.Second)
+	query("example.org.")
+	assert.Equal(t, 2, u.Requests())
+
+	// the negative response is cached for SOA minimum TTL
+	res = query("nx.org.")
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assert.Equal(t, 3, u.Requests())
+	fake.Advance(59 * time.Second)
+	query("nx.org.")
+	assert.Equal(t, 3, u.Requests())
+	fake.Advance(time.Second)
+	query("nx.org.")
+	assert.Equal(t, 4, u.Requests())
+
+	s.ClearCache()
+	assert.Equal(t, 0, s.cache.len())
+	query("example.org.")
+	assert.Equal(t, 5, u.Requests())
+
+	// the response without EDNS isn't used for the request with EDNS
+	req := createTestMessage("example.org.")
+	req.SetEdns0(4096, true)
+	res, _ = s.cache.get(cacheKey(req), req)
+	assert.Nil(t, res)
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	c := newDNSCache(4096, 60, 3600, false)
+	req := createTestMessage("example.org.")
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Answer = []dns.RR{newTestA("example.org.", net.IP{1, 2, 3, 4}), newTestA("example.org.", net.IP{5, 6, 7, 8})}
+	res.Answer[0].Header().Ttl = 10
+	res.Answer[1].Header().Ttl = 86400
+	c.set(cacheKey(req), res)
+
+	cached, _ := c.get(cacheKey(req), req)
+	assert.Equal(t, uint32(60), cached.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(3600), cached.Answer[1].Header().Ttl)
+	// the original response isn't modified
+	assert.Equal(t, uint32(10), res.Answer[0].Header().Ttl)
+
+	// negative response without SOA record isn't cached
+	req = createTestMessage("nx.example.org.")
+	res = new(dns.Msg)
+	res.SetRcode(req, dns.RcodeNameError)
+	c.set(cacheKey(req), res)
+	cached, _ = c.get(cacheKey(req), req)
+	assert.Nil(t, cached)
+
+	// the least recently used response is removed when the cache is full
+	assert.Nil(t, newDNSCache(0, 0, 0, false))
+	c = newDNSCache(200, 0, 0, false)
+	for _, host := range []string{"a.example.org.", "b.example.org.", "c.example.org.", "d.example.org."} {
+		req = createTestMessage(host)
+		res = new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = []dns.RR{newTestA(host, net.IP{1, 2, 3, 4})}
+		c.set(cacheKey(req), res)
+	}
+	assert.True(t, c.size <= 200)
+	assert.True(t, c.len() < 4)
+	req = createTestMessage("d.example.org.")
+	cached, _ = c.get(cacheKey(req), req)
+	assert.NotNil(t, cached)
+	req = createTestMessage("a.example.org.")
+	cached, _ = c.get(cacheKey(req), req)
+	assert.Nil(t, cached)
+}
+
+func TestDNSCacheOptimistic(t *testing.T) {
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	clock.Set(fake)
+	defer clock.Set(nil)
+
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer s.dnsFilter.Destroy()
+	s.cache = newDNSCache(4096, 0, 0, true)
+
+	query := func() *dns.Msg {
+		d := &proxy.DNSContext{Req: createTestMessage("example.org."), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+		assert.Nil(t, s.handleDNSRequest(p, d))
+		return d.Res
+	}
+	query()
+	assert.Equal(t, 1, u.Requests())
+
+	// the expired response is served right away and refreshed in background
+	fake.Advance(301 * time.Second)
+	res := query()
+	assert.Equal(t, uint32(optimisticTTL), res.Answer[0].Header().Ttl)
+	for i := 0; i < 100 && u.Requests() != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, u.Requests())
+	// wait until the refreshed response is stored
+	for i := 0; i < 100 && !s.cache.startRefresh("example.org. A IN"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.cache.endRefresh("example.org. A IN")
+
+	res = query()
+	assert.Equal(t, uint32(300), res.Answer[0].Header().Ttl)
+	assert.Equal(t, 2, u.Requests())
+
+	// the upstream doesn't respond: the expired response is still served
+	u.SetError(fmt.Errorf("timeout"))
+	fake.Advance(time.Hour)
+	res = query()
+	assert.Equal(t, uint32(optimisticTTL), res.Answer[0].Header().Ttl)
+
+	// too old responses aren't served
+	fake.Advance(staleMaxAge)
+	d := &proxy.DNSContext{Req: createTestMessage("example.org."), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+	assert.NotNil(t, s.handleDNSRequest(p, d))
+}
+
+func TestEDNSClientSubnet(t *testing.T) {
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer s.dnsFilter.Destroy()
+	s.cache = newDNSCache(4096, 0, 0, false)
+
+	query := func(req *dns.Msg, ip net.IP) *dns.Msg {
+		d := &proxy.DNSContext{Req: req, Addr: &net.UDPAddr{IP: ip}}
+		assert.Nil(t, s.handleDNSRequest(p, d))
+		return d.Res
+	}
+
+	// the client's subnet is sent upstream, but the client doesn't get it back
+	s.conf.EDNSCSMode = ECSModeSend
+	res := query(createTestMessage("example.org."), net.IP{203, 0, 113, 5})
+	ecs := getECS(u.LastRequest())
+	assert.NotNil(t, ecs)
+	assert.Equal(t, "203.0.113.0", ecs.Address.String())
+	assert.Equal(t, uint8(24), ecs.SourceNetmask)
+	assert.Nil(t, res.IsEdns0())
+	assert.Equal(t, 1, u.Requests())
+
+	// the same subnet: the response is from cache
+	query(createTestMessage("example.org."), net.IP{203, 0, 113, 6})
+	assert.Equal(t, 1, u.Requests())
+
+	// another subnet
+	s.conf.EDNSCSPrefixV6 = 48
+	query(createTestMessage("example.org."), net.ParseIP("2001:db8:1:2::1"))
+	assert.Equal(t, 2, u.Requests())
+	ecs = getECS(u.LastRequest())
+	assert.Equal(t, "2001:db8:1::", ecs.Address.String())
+	assert.Equal(t, uint8(48), ecs.SourceNetmask)
+
+	// private addresses aren't sent
+	query(createTestMessage("example.org."), net.IP{192, 168, 1, 1})
+	assert.Nil(t, getECS(u.LastRequest()))
+
+	// the client's subnet is removed from the request
+	s.conf.EDNSCSMode = ECSModeStrip
+	req := createTestMessage("example.org.")
+	req.SetEdns0(4096, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{198, 51, 100, 0},
+	})
+	res = query(req, net.IP{198, 51, 100, 1})
+	assert.NotNil(t, u.LastRequest().IsEdns0())
+	assert.Nil(t, getECS(u.LastRequest()))
+	assert.NotNil(t, res.IsEdns0())
+	assert.NotNil(t, getECS(req))
+
+	assert.NotNil(t, CheckECSMode("all", 24, 56))
+	assert.NotNil(t, CheckECSMode(ECSModeSend, 33, 56))
+	assert.Nil(t, CheckECSMode(ECSModeSend, 32, 128))
+}
+
+func TestTruncateUDPResponse(t *testing.T) {
+	s := NewServer("")
+	req := createTestMessage("example.org.")
+	res := new(dns.Msg)
+	res.SetReply(req)
+	for i := 0; i < 100; i++ {
+		res.Answer = append(res.Answer, newTestA("example.org.", net.IP{10, 0, byte(i / 256), byte(i)}))
+	}
+
+	// UDP: the response is truncated to 512 bytes if the client doesn't support EDNS
+	d := &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Res: res}
+	s.truncateUDPResponse(d)
+	assert.True(t, d.Res.Truncated)
+	assert.True(t, d.Res.Len() <= dns.MinMsgSize)
+	assert.Equal(t, 100, len(res.Answer))
+
+	// the client's buffer size
+	req = createTestMessage("example.org.")
+	req.SetEdns0(4096, false)
+	d = &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Res: res}
+	s.truncateUDPResponse(d)
+	assert.False(t, d.Res.Truncated)
+	assert.Equal(t, 100, len(d.Res.Answer))
+
+	// the configured max size
+	s.conf.UDPMaxResponseSize = 1232
+	d = &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req, Res: res}
+	s.truncateUDPResponse(d)
+	assert.True(t, d.Res.Truncated)
+	assert.True(t, d.Res.Len() <= 1232)
+
+	// TCP responses aren't truncated
+	d = &proxy.DNSContext{Proto: proxy.ProtoTCP, Req: req, Res: res}
+	s.truncateUDPResponse(d)
+	assert.False(t, d.Res.Truncated)
+
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, sortedCopy([]string{"2.2.2.2", "1.1.1.1"}))
+}
+
+func TestIsBlockedClientID(t *testing.T) {
+	s := createTestServer(t)
+	s.conf.AllowedClients = []string{"1.1.1.1", "phone"}
+	s.conf.DisallowedClients = []string{"laptop"}
+	err := s.Start(nil)
+	defer removeDataDir(t)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	defer func() { _ = s.Stop() }()
+
+	assert.False(t, s.isBlockedClient("1.1.1.1", ""))
+	assert.False(t, s.isBlockedClient("2.2.2.2", "Phone"))
+	assert.True(t, s.isBlockedClient("2.2.2.2", ""))
+	assert.True(t, s.isBlockedClient("1.1.1.1", "laptop"))
+
+	// only the clients with IDs are allowed
+	conf := s.conf
+	conf.AllowedClients = []string{"phone"}
+	conf.DisallowedClients = []string{"2.2.0.0/16"}
+	err = s.Reconfigure(&conf)
+	if err != nil {
+		t.Fatalf("Reconfigure: %s", err)
+	}
+	assert.True(t, s.isBlockedClient("1.1.1.1", ""))
+	assert.False(t, s.isBlockedClient("1.1.1.1", "phone"))
+
+	// the old CIDRs are removed
+	conf.AllowedClients = nil
+	conf.DisallowedClients = nil
+	err = s.Reconfigure(&conf)
+	if err != nil {
+		t.Fatalf("Reconfigure: %s", err)
+	}
+	assert.False(t, s.isBlockedClient("2.2.1.1", ""))
+
+	assert.True(t, IsValidClientID("my-phone1"))
+	assert.False(t, IsValidClientID("my.phone"))
+	assert.False(t, IsValidClientID("1.2.3.4/24"))
+}
+
+func TestBogusNXDomain(t *testing.T) {
+	u := testmode.NewUpstream()
+	u.SetAnswer("typo.example.org", dns.TypeA, newTestA("typo.example.org.", net.IP{198, 51, 100, 10}))
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+
+	var err error
+	s.bogusNXDomain, err = parseBogusNXDomain([]string{"198.51.100.0/24", "2001:db8::1"})
+	assert.Nil(t, err)
+	_, err = parseBogusNXDomain([]string{"198.51.100"})
+	assert.NotNil(t, err)
+
+	d := &proxy.DNSContext{Req: createTestMessage("typo.example.org."), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+	_, err = s.resolveUpstream(p, d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+
+	d = &proxy.DNSContext{Req: createTestMessage("example.org."), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+	_, err = s.resolveUpstream(p, d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+}
+
+func TestPrivatePTR(t *testing.T) {
+	assert.Equal(t, "192.168.1.2", ipFromReverseName("2.1.168.192.in-addr.arpa.").String())
+	assert.Equal(t, "fd00::1", ipFromReverseName("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.").String())
+	assert.Nil(t, ipFromReverseName("168.192.in-addr.arpa."))
+	assert.Nil(t, ipFromReverseName("example.org."))
+
+	ptr := func(ip string) *dns.Msg {
+		name, _ := dns.ReverseAddr(ip)
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypePTR)
+		return req
+	}
+	assert.True(t, isPrivatePTR(ptr("192.168.1.2")))
+	assert.True(t, isPrivatePTR(ptr("127.0.0.1")))
+	assert.False(t, isPrivatePTR(ptr("8.8.8.8")))
+
+	public := testmode.NewUpstream()
+	local := testmode.NewUpstream()
+	name, _ := dns.ReverseAddr("192.168.1.2")
+	local.SetAnswer(name, dns.TypePTR, &dns.PTR{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 300},
+		Ptr: "laptop.lan.",
+	})
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{public}
+	s := NewServer("")
+
+	// no local resolvers
+	d := &proxy.DNSContext{Req: ptr("192.168.1.2"), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+	_, err := s.resolveUpstream(p, d)
+	assert.Nil(t, err)
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+	assert.Equal(t, 0, public.Requests())
+
+	s.conf.LocalPTRUpstreams = []upstream.Upstream{local}
+	d = &proxy.DNSContext{Req: ptr("192.168.1.2"), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+	_, err = s.resolveUpstream(p, d)
+	assert.Nil(t, err)
+	assert.Equal(t, "laptop.lan.", d.Res.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, 0, public.Requests())
+
+	// public addresses are resolved by the upstream servers
+	d = &proxy.DNSContext{Req: ptr("8.8.8.8"), Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+	_, err = s.resolveUpstream(p, d)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, public.Requests())
+	assert.Equal(t, 1, local.Requests())
+}
+
+func TestDHCPHosts(t *testing.T) {
+	u := testmode.NewUpstream()
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer s.dnsFilter.Destroy()
+	s.conf.LocalDomainName = "lan"
+	s.conf.DHCPHostIPsHandler = func(host string) []net.IP {
+		if host == "laptop" {
+			return []net.IP{{192, 168, 1, 2}, net.ParseIP("fd00::2")}
+		}
+		return nil
+	}
+	s.conf.DHCPHostNameHandler = func(ip net.IP) string {
+		switch ip.String() {
+		case "192.168.1.2", "fd00::2":
+			return "Laptop"
+		case "192.168.1.3":
+			return "John's phone"
+		}
+		return ""
+	}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		d := &proxy.DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IP{192, 168, 1, 5}}}
+		assert.Nil(t, s.handleDNSRequest(p, d))
+		return d.Res
+	}
+
+	res := query("Laptop.lan.", dns.TypeA)
+	assert.Equal(t, 1, len(res.Answer))
+	assert.Equal(t, "192.168.1.2", res.Answer[0].(*dns.A).A.String())
+	res = query("laptop.lan.", dns.TypeAAAA)
+	assert.Equal(t, 1, len(res.Answer))
+	assert.Equal(t, "fd00::2", res.Answer[0].(*dns.AAAA).AAAA.String())
+	assert.Equal(t, 0, u.Requests())
+	query("laptop.lan.", dns.TypeMX)
+	assert.Equal(t, 1, u.Requests())
+
+	name, _ := dns.ReverseAddr("192.168.1.2")
+	res = query(name, dns.TypePTR)
+	assert.Equal(t, "laptop.lan.", res.Answer[0].(*dns.PTR).Ptr)
+	name, _ = dns.ReverseAddr("fd00::2")
+	res = query(name, dns.TypePTR)
+	assert.Equal(t, "laptop.lan.", res.Answer[0].(*dns.PTR).Ptr)
+	assert.Equal(t, 1, u.Requests())
+
+	// unknown hosts and invalid host names are processed as usual
+	query("phone.lan.", dns.TypeA)
+	query("laptop.example.lan.", dns.TypeA)
+	assert.Equal(t, 3, u.Requests())
+	name, _ = dns.ReverseAddr("192.168.1.3")
+	res = query(name, dns.TypePTR)
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+
+	// disabled
+	s.conf.LocalDomainName = ""
+	query("laptop.lan.", dns.TypeA)
+	assert.Equal(t, 4, u.Requests())
+}
+
+func TestAAAADisabled(t *testing.T) {
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	u.SetAnswer("example.org", dns.TypeAAAA, &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+		AAAA: net.ParseIP("2001:db8::1"),
+	})
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, nil)
+	defer s.dnsFilter.Destroy()
+
+	query := func(qtype uint16, ip net.IP) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.org.", qtype)
+		d := &proxy.DNSContext{Req: req, Addr: &net.UDPAddr{IP: ip}}
+		assert.Nil(t, s.handleDNSRequest(p, d))
+		return d.Res
+	}
+
+	assert.Equal(t, 1, len(query(dns.TypeAAAA, net.IP{1, 2, 3, 4}).Answer))
+	assert.Equal(t, 1, u.Requests())
+
+	// disabled for one client
+	s.conf.AAAADisabledHandler = func(clientAddr string) bool {
+		return clientAddr == "1.2.3.5"
+	}
+	res := query(dns.TypeAAAA, net.IP{1, 2, 3, 5})
+	assert.Equal(t, dns.RcodeSuccess, res.Rcode)
+	assert.Equal(t, 0, len(res.Answer))
+	assert.Equal(t, 1, len(res.Ns))
+	assert.Equal(t, 1, u.Requests())
+	assert.Equal(t, 1, len(query(dns.TypeAAAA, net.IP{1, 2, 3, 4}).Answer))
+
+	// disabled globally
+	s.conf.AAAADisabled = true
+	assert.Equal(t, 0, len(query(dns.TypeAAAA, net.IP{1, 2, 3, 4}).Answer))
+	assert.Equal(t, 1, len(query(dns.TypeA, net.IP{1, 2, 3, 4}).Answer))
+
+	// the suppressed answers are counted
+	st := newStats()
+	counters := st.entryCounters(&logEntry{AAAADisabled: true})
+	assert.Equal(t, st.aaaaDisabled, counters[len(counters)-1])
+}
+
+func TestSVCBRecords(t *testing.T) {
+	newHTTPS := func(name, rdata string) dns.RR {
+		return &dns.RFC3597{
+			Hdr:   dns.RR_Header{Name: name, Rrtype: typeHTTPS, Class: dns.ClassINET, Ttl: 300},
+			Rdata: rdata,
+		}
+	}
+	// 1 . alpn=h2 ipv4hint=1.2.3.4 ech=abc ipv6hint=2001:db8::1
+	service := "0001" + "00" + "0001000302683200040004010203040005000361626300060010" + "20010db8000000000000000000000001"
+	// 0 tracker.example.
+	alias := "0000" + "07747261636b6572076578616d706c6500"
+
+	u := testmode.NewUpstream()
+	serviceRR := newHTTPS("example.org.", service)
+	u.SetAnswer("example.org", typeHTTPS, serviceRR)
+	u.SetAnswer("example.net", typeHTTPS, newHTTPS("example.net.", alias))
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.conf.ProtectionEnabled = true
+	s.dnsFilter = dnsfilter.New(&dnsfilter.Config{}, map[int]string{1: "||tracker.example^\n"})
+	defer s.dnsFilter.Destroy()
+
+	query := func(host string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(host, typeHTTPS)
+		d := &proxy.DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+		assert.Nil(t, s.handleDNSRequest(p, d))
+		return d.Res
+	}
+	params := func(res *dns.Msg) string {
+		r, err := unpackSVCB(res.Answer[0].(*dns.RFC3597))
+		assert.Nil(t, err)
+		return r.String()
+	}
+
+	assert.Equal(t, "1 . alpn ipv4hint ech ipv6hint", params(query("example.org.")))
+
+	s.conf.HTTPSRemoveECH = true
+	assert.Equal(t, "1 . alpn ipv4hint ipv6hint", params(query("example.org.")))
+
+	s.conf.AAAADisabled = true
+	assert.Equal(t, "1 . alpn ipv4hint", params(query("example.org.")))
+
+	// the response from the upstream isn't modified
+	assert.Equal(t, service, serviceRR.(*dns.RFC3597).Rdata)
+
+	// the target name is blocked
+	res := query("example.net.")
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+	assert.Equal(t, 0, len(res.Answer))
+
+	m := answerToMap(&dns.Msg{Answer: []dns.RR{newHTTPS("example.net.", alias)}})
+	assert.Equal(t, "HTTPS", m[0]["type"])
+	assert.Equal(t, "0 tracker.example.", m[0]["value"])
+}
+
+func TestUpstreamStats(t *testing.T) {
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	st := newUpstreamStats()
+	wrapped := st.wrap([]upstream.Upstream{u})
+	assert.Equal(t, u.Address(), wrapped[0].Address())
+	// wrapping again doesn't account the requests twice
+	wrapped = st.wrap(wrapped)
+
+	_, err := wrapped[0].Exchange(createTestMessage("example.org."))
+	assert.Nil(t, err)
+	_, err = wrapped[0].Exchange(createTestMessage("nx.example.org."))
+	assert.Nil(t, err)
+	u.SetError(errorx.Decorate(&net.DNSError{Err: "i/o timeout", IsTimeout: true}, "exchange failed"))
+	_, err = wrapped[0].Exchange(createTestMessage("example.org."))
+	assert.NotNil(t, err)
+	u.SetError(errors.New("connection refused"))
+	_, err = wrapped[0].Exchange(createTestMessage("example.org."))
+	assert.NotNil(t, err)
+
+	data := st.get()
+	assert.Equal(t, 1, len(data))
+	assert.Equal(t, uint64(4), data[0]["requests"])
+	assert.Equal(t, uint64(2), data[0]["errors"])
+	assert.Equal(t, uint64(1), data[0]["timeouts"])
+	rcodes := data[0]["rcodes"].(map[string]uint64)
+	assert.Equal(t, uint64(2), rcodes["NOERROR"]+rcodes["NXDOMAIN"])
+	latency := data[0]["latency"].([]uint64)
+	assert.Equal(t, len(upstreamLatencyBuckets)+1, len(latency))
+	assert.Equal(t, uint64(2), latency[0])
+
+	st.purge()
+	assert.Equal(t, 0, len(st.get()))
+}
+
+func TestDNS64(t *testing.T) {
+	// the examples from RFC 6052 2.4
+	for prefix, ip := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+		"":                      "64:ff9b::c000:221",
+	} {
+		n, err := parseDNS64Prefix(prefix)
+		assert.Nil(t, err, prefix)
+		assert.Equal(t, ip, dns64Address(n, net.IP{192, 0, 2, 33}).String(), prefix)
+	}
+	assert.NotNil(t, CheckDNS64Prefix("64:ff9b::/80"))
+	assert.NotNil(t, CheckDNS64Prefix("192.168.0.0/16"))
+	assert.NotNil(t, CheckDNS64Prefix("2001:db8:0:0:ff00::/96"))
+
+	u := testmode.NewUpstream()
+	u.SetAnswer("ipv4only.example", dns.TypeA, newTestA("ipv4only.example.", net.IP{192, 0, 2, 33}))
+	nodata := new(dns.Msg)
+	nodata.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 60,
+	}}
+	u.SetResponse("ipv4only.example", dns.TypeAAAA, nodata)
+	u.SetAnswer("dualstack.example", dns.TypeAAAA, &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: "dualstack.example.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+		AAAA: net.ParseIP("2001:db8::1"),
+	})
+	p := &proxy.Proxy{}
+	p.Upstreams = []upstream.Upstream{u}
+	s := NewServer("")
+	s.conf.DNS64Enabled = true
+	s.dns64Prefix, _ = parseDNS64Prefix("")
+
+	query := func(host string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(host, dns.TypeAAAA)
+		d := &proxy.DNSContext{Req: req, Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}}
+		_, err := s.resolveUpstream(p, d)
+		assert.Nil(t, err)
+		return d.Res
+	}
+
+	res := query("ipv4only.example.")
+	assert.Equal(t, 1, len(res.Answer))
+	aaaa := res.Answer[0].(*dns.AAAA)
+	assert.Equal(t, "64:ff9b::c000:221", aaaa.AAAA.String())
+	assert.Equal(t, "ipv4only.example.", aaaa.Hdr.Name)
+	assert.Equal(t, uint32(60), aaaa.Hdr.Ttl)
+	assert.Equal(t, 0, len(res.Ns))
+
+	// the host has its own AAAA records
+	res = query("dualstack.example.")
+	assert.Equal(t, "2001:db8::1", res.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// NXDOMAIN isn't changed
+	res = query("nx.example.")
+	assert.Equal(t, dns.RcodeNameError, res.Rcode)
+
+	// disabled
+	s.conf.DNS64Enabled = false
+	res = query("ipv4only.example.")
+	assert.Equal(t, 0, len(res.Answer))
+}
+
+func TestUpstreamPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	lock := sync.Mutex{}
+	clients := map[string]bool{}
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		lock.Lock()
+		clients[w.RemoteAddr().String()] = true
+		lock.Unlock()
+		res := new(dns.Msg)
+		res.SetReply(req)
+		res.Answer = append(res.Answer, newTestA(req.Question[0].Name, net.IP{1, 2, 3, 4}))
+		_ = w.WriteMsg(res)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+	connections := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(clients)
+	}
+
+	u, err := AddressToUpstream("tcp://"+l.Addr().String(), upstream.Options{Timeout: time.Second}, PoolConfig{Size: 1, Pipelining: true})
+	assert.Nil(t, err)
+	assert.Equal(t, l.Addr().String(), u.Address())
+
+	// the connection is reused
+	for i := 0; i != 5; i++ {
+		req := createTestMessage("example.org.")
+		res, err := u.Exchange(req)
+		assert.Nil(t, err)
+		assert.Equal(t, req.Id, res.Id)
+		assert.Equal(t, 1, len(res.Answer))
+	}
+	assert.Equal(t, 1, connections())
+
+	// the concurrent requests are pipelined over the same connection
+	wg := sync.WaitGroup{}
+	for i := 0; i != 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			host := fmt.Sprintf("host%d.example.org.", i)
+			res, err := u.Exchange(createTestMessage(host))
+			assert.Nil(t, err)
+			if res != nil && assert.Equal(t, 1, len(res.Answer)) {
+				assert.Equal(t, host, res.Answer[0].Header().Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, connections())
+
+	// the domain-specific servers and the domain exclusions are preserved
+	conf, err := ParseUpstreamsConfig([]string{"1.1.1.1", "[/example.org/]tls://dns.example:8853", "[/sub.example.org/]#"}, nil, time.Second, PoolConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(conf.Upstreams))
+	assert.Equal(t, "1.1.1.1:53", conf.Upstreams[0].Address())
+	assert.Equal(t, "tls://dns.example:8853", conf.DomainReservedUpstreams["example.org."][0].Address())
+	us, ok := conf.DomainReservedUpstreams["sub.example.org."]
+	assert.True(t, ok)
+	assert.Nil(t, us)
+}
+
+func TestQueryLogDB(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	db, err := openQueryLogDB(filepath.Join(dir, queryLogDBFileName), 0)
+	if err != nil {
+		t.Fatalf("openQueryLogDB: %s", err)
+	}
+
+	addEntry := func(host string, client string, rcode int, filtered bool) {
+		req := createTestMessage(host)
+		res := new(dns.Msg)
+		res.SetRcode(req, rcode)
+		result := &dnsfilter.Result{IsFiltered: filtered}
+		entry := l.logRequest(req, res, result, time.Millisecond, &net.UDPAddr{IP: net.ParseIP(client)}, "udp", "", 0, "", false, false, "")
+		db.add(entry)
+	}
+	addEntry("www.example.org.", "1.1.1.1", dns.RcodeSuccess, false)
+	addEntry("example.org.", "2.2.2.2", dns.RcodeNameError, false)
+	addEntry("badexample.org.", "1.1.1.1", dns.RcodeSuccess, true)
+	addEntry("example.com.", "2.2.2.2", dns.RcodeSuccess, false)
+
+	check := func(f QueryLogSearch, hosts ...string) {
+		entries, err := db.search(&f)
+		assert.Nil(t, err)
+		memEntries := l.search(&f)
+		assert.Equal(t, len(hosts), len(entries), "%+v", f)
+		assert.Equal(t, len(hosts), len(memEntries), "%+v", f)
+		for i := 0; i < len(hosts) && i < len(entries) && i < len(memEntries); i++ {
+			host, _, _ := entryQuestion(entries[i])
+			assert.Equal(t, hosts[i], host)
+			host, _, _ = entryQuestion(memEntries[i])
+			assert.Equal(t, hosts[i], host)
+		}
+	}
+	check(QueryLogSearch{}, "example.com", "badexample.org", "example.org", "www.example.org")
+	check(QueryLogSearch{Domain: "example.org"}, "example.org", "www.example.org")
+	check(QueryLogSearch{Client: "1.1.1.1"}, "badexample.org", "www.example.org")
+	check(QueryLogSearch{Status: "NXDOMAIN"}, "example.org")
+	check(QueryLogSearch{Response: QueryLogBlocked}, "badexample.org")
+	check(QueryLogSearch{Client: "2.2.2.2", Domain: "com"}, "example.com")
+	check(QueryLogSearch{Start: time.Now().Add(time.Hour)})
+	check(QueryLogSearch{Limit: 1}, "example.com")
+
+	// the entries are kept after the database is reopened
+	db.close()
+	db, err = openQueryLogDB(filepath.Join(dir, queryLogDBFileName), 0)
+	if err != nil {
+		t.Fatalf("openQueryLogDB: %s", err)
+	}
+	defer db.close()
+	entries, err := db.search(&QueryLogSearch{})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(entries))
+	assert.Equal(t, "2.2.2.2", entries[0].IP)
+}
+
+func TestQueryLogSearch(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	path := filepath.Join(dir, queryLogDBFileName)
+
+	// the database of the previous version is upgraded
+	old, err := sql.Open("sqlite", path)
+	assert.Nil(t, err)
+	_, err = old.Exec(queryLogDBSchema)
+	assert.Nil(t, err)
+	assert.Nil(t, old.Close())
+	db, err := openQueryLogDB(path, 0)
+	if err != nil {
+		t.Fatalf("openQueryLogDB: %s", err)
+	}
+	defer db.close()
+
+	now := time.Now()
+	addEntry := func(host string, qtype uint16, reason dnsfilter.Reason, filtered bool) *logEntry {
+		req := new(dns.Msg)
+		req.SetQuestion(host, qtype)
+		res := new(dns.Msg)
+		res.SetReply(req)
+		result := &dnsfilter.Result{IsFiltered: filtered, Reason: reason}
+		entry := l.logRequest(req, res, result, time.Millisecond, &net.UDPAddr{IP: net.ParseIP("1.1.1.1")}, "udp", "", 0, "", false, false, "")
+		now = now.Add(time.Second)
+		entry.Time = now
+		db.add(entry)
+		return entry
+	}
+	addEntry("www.example.org.", dns.TypeA, dnsfilter.NotFilteredNotFound, false)
+	addEntry("www.example.org.", dns.TypeAAAA, dnsfilter.NotFilteredNotFound, false)
+	addEntry("ads.example.net.", dns.TypeA, dnsfilter.FilteredBlackList, true)
+	addEntry("rewrite.example.com.", dns.TypeA, dnsfilter.ReasonRewrite, false)
+	last := addEntry("myads.example.com.", dns.TypeAAAA, dnsfilter.FilteredBlackList, true)
+
+	check := func(f QueryLogSearch, hosts ...string) {
+		entries, err := db.search(&f)
+		assert.Nil(t, err)
+		memEntries := l.search(&f)
+		assert.Equal(t, len(hosts), len(entries), "%+v", f)
+		assert.Equal(t, len(hosts), len(memEntries), "%+v", f)
+		for i := 0; i < len(hosts) && i < len(entries) && i < len(memEntries); i++ {
+			host, _, _ := entryQuestion(entries[i])
+			assert.Equal(t, hosts[i], host)
+			host, _, _ = entryQuestion(memEntries[i])
+			assert.Equal(t, hosts[i], host)
+		}
+	}
+	check(QueryLogSearch{Search: "ads"}, "myads.example.com", "ads.example.net")
+	check(QueryLogSearch{QType: "AAAA"}, "myads.example.com", "www.example.org")
+	check(QueryLogSearch{Response: QueryLogBlocked}, "myads.example.com", "ads.example.net")
+	check(QueryLogSearch{Response: QueryLogRewritten}, "rewrite.example.com")
+	check(QueryLogSearch{Response: QueryLogAllowed}, "www.example.org", "www.example.org")
+	check(QueryLogSearch{Response: QueryLogBlocked, QType: "A"}, "ads.example.net")
+
+	// the pages are requested with the time of the last entry of the previous page
+	check(QueryLogSearch{Limit: 2}, "myads.example.com", "rewrite.example.com")
+	check(QueryLogSearch{Limit: 2, OlderThan: last.Time.Add(-time.Second)}, "ads.example.net", "www.example.org")
+	check(QueryLogSearch{Limit: 2, OlderThan: last.Time.Add(-3 * time.Second)}, "www.example.org")
+}
+
+func TestQueryLogAnonymize(t *testing.T) {
+	assert.Nil(t, CheckQueryLogAnonymize(""))
+	assert.Nil(t, CheckQueryLogAnonymize("hash"))
+	assert.NotNil(t, CheckQueryLogAnonymize("mask"))
+
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	assert.Equal(t, "1.2.3.4", l.anonymize("1.2.3.4"))
+
+	l.setAnonymize(QueryLogAnonymizeTruncate)
+	assert.Equal(t, "1.2.3.0", l.anonymize("1.2.3.4"))
+	assert.Equal(t, "2001:db8:1:2::", l.anonymize("2001:db8:1:2:3:4:5:6"))
+
+	l.setAnonymize(QueryLogAnonymizeHash)
+	h := l.anonymize("1.2.3.4")
+	assert.Equal(t, 16, len(h))
+	assert.Equal(t, h, l.anonymize("1.2.3.4"))
+	assert.NotEqual(t, h, l.anonymize("1.2.3.5"))
+	// the salt is changed
+	l.saltTime = l.saltTime.Add(-queryLogSaltPeriod)
+	assert.NotEqual(t, h, l.anonymize("1.2.3.4"))
+
+	l.setAnonymize(QueryLogAnonymizeDrop)
+	entry := l.logRequest(createTestMessage("example.org."), nil, nil, 0, &net.UDPAddr{IP: net.ParseIP("1.2.3.4")}, "udp", "", 0, "", false, false, "")
+	assert.Equal(t, "", entry.IP)
+}
+
+func TestQueryLogIgnored(t *testing.T) {
+	_, err := parseQueryLogIgnored([]string{"192.168.1.0/33"})
+	assert.NotNil(t, err)
+
+	s := NewServer("")
+	s.queryLogIgnored, err = parseQueryLogIgnored([]string{"192.168.1.10", "10.0.0.0/8", "Heartbeat.NAS.lan."})
+	assert.Nil(t, err)
+	s.conf.QueryLogIgnoredHandler = func(clientAddr string) bool {
+		return clientAddr == "192.168.1.20"
+	}
+
+	ignored := func(client string, host string) bool {
+		d := &proxy.DNSContext{
+			Addr: &net.UDPAddr{IP: net.ParseIP(client)},
+			Req:  createTestMessage(host),
+		}
+		return s.isQueryLogIgnored(d)
+	}
+	assert.True(t, ignored("192.168.1.10", "example.org."))
+	assert.True(t, ignored("10.1.2.3", "example.org."))
+	assert.True(t, ignored("192.168.1.20", "example.org."))
+	assert.True(t, ignored("192.168.1.30", "heartbeat.nas.lan."))
+	assert.True(t, ignored("192.168.1.30", "sub.heartbeat.nas.lan."))
+	assert.False(t, ignored("192.168.1.30", "nas.lan."))
+	assert.False(t, ignored("192.168.1.30", "example.org."))
+}
+
+func TestQueryLogExport(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	db, err := openQueryLogDB(filepath.Join(dir, queryLogDBFileName), 0)
+	if err != nil {
+		t.Fatalf("openQueryLogDB: %s", err)
+	}
+	defer db.close()
+
+	addEntry := func(host string, client string) {
+		entry := l.logRequest(createTestMessage(host), nil, nil, 0, &net.UDPAddr{IP: net.ParseIP(client)}, "udp", "", 0, "", false, false, "")
+		db.add(entry)
+	}
+	addEntry("a.example.org.", "1.1.1.1")
+	addEntry("b.example.org.", "2.2.2.2")
+	addEntry("c.example.org.", "1.1.1.1")
+	// the file has the older entries, the newer ones are waiting for the writer
+	assert.Nil(t, l.flush())
+	addEntry("d.example.org.", "1.1.1.1")
+	addEntry("e.example.org.", "2.2.2.2")
+
+	export := func(f QueryLogSearch, exporter func(f *QueryLogSearch, onEntry func(entry *logEntry) error) error) []string {
+		hosts := []string{}
+		err := exporter(&f, func(entry *logEntry) error {
+			host, _, _ := entryQuestion(entry)
+			hosts = append(hosts, host)
+			return nil
+		})
+		assert.Nil(t, err)
+		return hosts
+	}
+	for _, exporter := range []func(f *QueryLogSearch, onEntry func(entry *logEntry) error) error{l.export, db.export} {
+		assert.Equal(t, []string{"a.example.org", "b.example.org", "c.example.org", "d.example.org", "e.example.org"}, export(QueryLogSearch{}, exporter))
+		assert.Equal(t, []string{"a.example.org", "c.example.org", "d.example.org"}, export(QueryLogSearch{Client: "1.1.1.1"}, exporter))
+	}
+
+	// the export is stopped by the callback
+	stop := errors.New("stop")
+	n := 0
+	err = l.export(&QueryLogSearch{}, func(entry *logEntry) error {
+		n++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestQueryLogCompress(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	names := func() []string {
+		list := []string{}
+		for _, f := range l.diskUsage()["files"].([]map[string]interface{}) {
+			list = append(list, f["name"].(string))
+		}
+		return list
+	}
+	hosts := func() []string {
+		list := []string{}
+		err := l.export(&QueryLogSearch{}, func(entry *logEntry) error {
+			host, _, _ := entryQuestion(entry)
+			list = append(list, host)
+			return nil
+		})
+		assert.Nil(t, err)
+		return list
+	}
+	addEntry := func(host string) {
+		l.logRequest(createTestMessage(host), nil, nil, 0, &net.UDPAddr{IP: net.ParseIP("1.1.1.1")}, "udp", "", 0, "", false, false, "")
+		assert.Nil(t, l.flush())
+	}
+
+	addEntry("a.example.org.")
+	assert.Nil(t, l.rotateQueryLog())
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(t, os.Chtimes(l.segmentPath(1), mtime, mtime))
+
+	// the rotated file is compressed, the modification time is kept
+	l.setCompress(true)
+	l.compressSegments()
+	assert.Equal(t, []string{"querylog.json.1.gz"}, names())
+	fi, err := os.Stat(l.segmentPath(1) + gzipSuffix)
+	assert.Nil(t, err)
+	assert.True(t, fi.ModTime().Equal(mtime))
+
+	// the compressed file is rotated too, the plain and the compressed files are read
+	addEntry("b.example.org.")
+	l.setCompress(false)
+	assert.Nil(t, l.rotateQueryLog())
+	addEntry("c.example.org.")
+	assert.Equal(t, []string{"querylog.json", "querylog.json.1", "querylog.json.2.gz"}, names())
+	assert.Equal(t, []string{"a.example.org", "b.example.org", "c.example.org"}, hosts())
+	n := 0
+	onEntry := func(entry *logEntry) error {
+		n++
+		return nil
+	}
+	assert.Nil(t, l.genericLoader(onEntry, func() bool { return true }, queryLogTimeLimit))
+	assert.Equal(t, 3, n)
+}
+
+func TestQueryLogForward(t *testing.T) {
+	for _, addr := range []string{"", "ftp://127.0.0.1", "udp://127.0.0.1", "https://"} {
+		_, err := parseQueryLogForward(addr)
+		assert.NotNil(t, err, addr)
+	}
+
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	entry := l.logRequest(createTestMessage("forward.example.org."), nil, nil, 0, &net.UDPAddr{IP: net.ParseIP("1.1.1.1")}, "udp", "", 0, "", false, false, "")
+
+	// syslog
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	f, err := newQueryLogForwarder("udp://" + conn.LocalAddr().String())
+	assert.Nil(t, err)
+	f.add(entry)
+	f.close()
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err)
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<134>1 "), msg)
+	assert.True(t, strings.Contains(msg, ` AdGuardHome `), msg)
+	assert.True(t, strings.Contains(msg, `[query@32473 host="forward.example.org" type="A" client="1.1.1.1" status="allowed" rcode=""] {`), msg)
+
+	// HTTP collector
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies <- r.Header.Get("Content-Type") + "\n" + string(data)
+	}))
+	defer srv.Close()
+	f, err = newQueryLogForwarder(srv.URL + "/collect")
+	assert.Nil(t, err)
+	f.add(entry)
+	f.add(entry)
+	f.close()
+	lines := strings.Split(strings.TrimSpace(<-bodies), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "application/x-ndjson", lines[0])
+	assert.True(t, strings.Contains(lines[1], `"forward.example.org"`), lines[1])
+	assert.Equal(t, uint64(0), f.droppedEntries())
+
+	// the collector isn't available
+	srv.Close()
+	f, err = newQueryLogForwarder(srv.URL)
+	assert.Nil(t, err)
+	f.add(entry)
+	f.close()
+	assert.Equal(t, uint64(1), f.droppedEntries())
+}
+
+func TestQueryLogClear(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	db, err := openQueryLogDB(filepath.Join(dir, queryLogDBFileName), 0)
+	if err != nil {
+		t.Fatalf("openQueryLogDB: %s", err)
+	}
+	defer db.close()
+
+	addEntry := func(host string, client string) {
+		entry := l.logRequest(createTestMessage(host), nil, nil, 0, &net.UDPAddr{IP: net.ParseIP(client)}, "udp", "", 0, "", false, false, "")
+		db.add(entry)
+	}
+	hosts := func() []string {
+		list := []string{}
+		err := l.export(&QueryLogSearch{}, func(entry *logEntry) error {
+			host, _, _ := entryQuestion(entry)
+			list = append(list, host)
+			return nil
+		})
+		assert.Nil(t, err)
+		return list
+	}
+
+	// the entries are in the rotated compressed file, the current file and the queue
+	addEntry("a.example.org.", "1.1.1.1")
+	addEntry("b.example.org.", "2.2.2.2")
+	assert.Nil(t, l.flush())
+	assert.Nil(t, l.rotateQueryLog())
+	l.setCompress(true)
+	l.compressSegments()
+	addEntry("c.example.org.", "1.1.1.1")
+	assert.Nil(t, l.flush())
+	middle := time.Now()
+	addEntry("d.example.org.", "2.2.2.2")
+
+	removed, err := l.clear(&QueryLogClearFilter{Client: "1.1.1.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, []string{"b.example.org", "d.example.org"}, hosts())
+	assert.Equal(t, 2, len(l.getQueryLog()))
+	fi, err := os.Stat(l.segmentPath(1) + gzipSuffix)
+	assert.Nil(t, err)
+	assert.True(t, fi.Size() > 0)
+
+	// the time range, the file without entries is removed
+	removed, err = l.clear(&QueryLogClearFilter{End: middle})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, []string{"d.example.org"}, hosts())
+	_, err = os.Stat(l.segmentPath(1) + gzipSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// the database
+	assert.Nil(t, db.clear(&QueryLogClearFilter{Client: "1.1.1.1"}))
+	entries, err := db.search(&QueryLogSearch{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+
+	// all entries
+	removed, err = l.clear(&QueryLogClearFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 0, len(hosts()))
+	assert.Equal(t, 0, len(l.getQueryLog()))
+	assert.Nil(t, db.clear(&QueryLogClearFilter{}))
+	entries, err = db.search(&QueryLogSearch{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestQueryLogTail(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	s := NewServer(dir)
+	defer func() { _ = s.queryLog.close() }()
+	tail := s.TailQueryLog(QueryLogSearch{Domain: "example.org"})
+	addEntry := func(host string) {
+		s.queryLog.logRequest(createTestMessage(host), nil, nil, 0, &net.UDPAddr{IP: net.ParseIP("1.1.1.1")}, "udp", "", 0, "", false, false, "")
+	}
+
+	addEntry("www.example.org.")
+	addEntry("example.com.")
+	select {
+	case entry := <-tail.C:
+		assert.Equal(t, "www.example.org", entry["question"].(map[string]interface{})["host"])
+	case <-time.After(time.Second):
+		t.Fatalf("no entry")
+	}
+	assert.Equal(t, 0, len(tail.C))
+
+	// the entries are dropped if the receiver doesn't keep up
+	for i := 0; i != queryLogTailBuffer+10; i++ {
+		addEntry("example.org.")
+	}
+	assert.Equal(t, queryLogTailBuffer, len(tail.C))
+	assert.Equal(t, uint64(10), tail.Dropped())
+
+	tail.Close()
+	assert.Equal(t, 0, len(s.queryLog.subscribers))
+}
+
+func TestQueryLogEntryDetails(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	req := createTestMessage("example.org.")
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Answer = append(res.Answer, newTestA("example.org.", net.IP{1, 2, 3, 4}), newTestA("example.org.", net.IP{1, 2, 3, 5}))
+	res.Ns = append(res.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 100}, Ns: "ns.example.org."})
+	res.SetEdns0(4096, false)
+	entry := l.logRequest(req, res, nil, 30*time.Millisecond, &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}, "tls", "tls://1.1.1.1:853", 25*time.Millisecond, "secure", false, false, "")
+
+	data := logEntryToJSON(entry)
+	assert.Equal(t, "tls://1.1.1.1:853", data["upstream"])
+	assert.Equal(t, "25", data["upstream_elapsed_ms"])
+	assert.Equal(t, "30", data["elapsedMs"])
+	assert.Equal(t, "tls", data["proto"])
+	assert.Equal(t, false, data["cached"])
+	assert.Equal(t, "secure", data["dnssec"])
+	answer := data["answer"].([]map[string]interface{})
+	assert.Equal(t, 2, len(answer))
+	assert.Equal(t, net.IP{1, 2, 3, 5}, answer[1]["value"])
+	authority := data["authority"].([]map[string]interface{})
+	assert.Equal(t, 1, len(authority))
+	assert.Equal(t, "ns.example.org.", authority[0]["value"])
+	// OPT isn't a record
+	_, ok := data["additional"]
+	assert.False(t, ok)
+}
+
+func TestQueryLogWriter(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+
+	// the writer is blocked, the requests aren't
+	l.logBufferLock.Lock()
+	total := queryLogWriteQueueSize + 10
+	for i := 0; i != total; i++ {
+		l.logRequest(createTestMessage("writer.example.org."), nil, nil, 0, &net.UDPAddr{IP: net.IP{1, 2, 3, 4}}, "udp", "", 0, "", false, false, "")
+	}
+	dropped := l.droppedEntries()
+	assert.True(t, dropped == 9 || dropped == 10, "%d", dropped)
+	l.logBufferLock.Unlock()
+
+	assert.Nil(t, l.flush())
+	n := 0
+	assert.Nil(t, exportFile(l.logFile, func(entry *logEntry) error {
+		// the other tests may have written to the file too
+		host, _, _ := entryQuestion(entry)
+		if host == "writer.example.org" {
+			n++
+		}
+		return nil
+	}))
+	assert.Equal(t, total-int(dropped), n)
+}
+
+func TestQueryLogRetention(t *testing.T) {
+	dir := createDataDir(t)
+	defer removeDataDir(t)
+	l := newQueryLog(dir)
+	defer func() { _ = l.close() }()
+	write := func(i int, size int, age time.Duration) {
+		path := l.segmentPath(i)
+		assert.Nil(t, ioutil.WriteFile(path, make([]byte, size), 0644))
+		mtime := time.Now().Add(-age)
+		assert.Nil(t, os.Chtimes(path, mtime, mtime))
+	}
+	names := func() []string {
+		list := []string{}
+		for _, f := range l.diskUsage()["files"].([]map[string]interface{}) {
+			list = append(list, f["name"].(string))
+		}
+		return list
+	}
+
+	// rotation
+	write(0, 10, 0)
+	write(1, 10, 0)
+	assert.Nil(t, l.rotateQueryLog())
+	assert.Equal(t, []string{"querylog.json.1", "querylog.json.2"}, names())
+
+	// age
+	write(0, 10, 0)
+	write(3, 10, 72*time.Hour)
+	l.setRetention(2, 0)
+	l.enforceRetention()
+	assert.Equal(t, []string{"querylog.json", "querylog.json.1", "querylog.json.2"}, names())
+
+	// size: the current file is kept
+	l.setRetention(30, 25)
+	l.enforceRetention()
+	assert.Equal(t, []string{"querylog.json", "querylog.json.1"}, names())
+	assert.Equal(t, int64(20), l.diskUsage()["files_bytes"])
+
+	// the large file is rotated
+	write(0, 20, 0)
+	assert.Nil(t, l.rotateIfLarge())
+	l.enforceRetention()
+	assert.Equal(t, []string{"querylog.json.1"}, names())
+}
+
+func TestExtraListeners(t *testing.T) {
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	s.conf.ExtraListenAddrs = []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}, Port: 0}}
+	err := s.Start(nil)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	assert.Equal(t, 2, len(s.extra.servers), "UDP and TCP listeners")
+
+	addrs := []string{
+		s.extra.servers[0].PacketConn.LocalAddr().String(),
+		s.extra.servers[1].Listener.Addr().String(),
+	}
+	for i, network := range []string{"udp", "tcp"} {
+		c := dns.Client{Net: network}
+		reply, _, err := c.Exchange(createTestMessage("nxdomain.example.org."), addrs[i])
+		if err != nil {
+			t.Fatalf("Couldn't talk to server %s: %s", addrs[i], err)
+		}
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode, network)
+	}
+
+	err = s.Stop()
+	if err != nil {
+		t.Fatalf("DNS server failed to stop: %s", err)
+	}
+	assert.Equal(t, 0, len(s.extra.servers))
+}
+
+func TestServerUpdate(t *testing.T) {
+	u1 := testmode.NewUpstream()
+	u1.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	u2 := testmode.NewUpstream()
+	u2.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{5, 6, 7, 8}))
+	u2.SetAnswer("nxdomain.example.org", dns.TypeA, newTestA("nxdomain.example.org.", net.IP{5, 6, 7, 8}))
+
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	s.conf.SafeBrowsingEnabled = false
+	s.conf.Upstreams = []upstream.Upstream{u1}
+	assert.NotNil(t, s.Update(&s.conf))
+	assert.Nil(t, s.Start(nil))
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	exchange := func(host string) *dns.Msg {
+		reply, err := dns.Exchange(createTestMessage(host), addr)
+		assert.Nil(t, err)
+		return reply
+	}
+	assert.Equal(t, "1.2.3.4", exchange("example.org.").Answer[0].(*dns.A).A.String())
+	assert.Equal(t, dns.RcodeNameError, exchange("nxdomain.example.org.").Rcode)
+
+	// the listeners are the same, the new upstream servers and filters are used
+	conf := s.conf
+	conf.Upstreams = []upstream.Upstream{u2}
+	conf.Filters = []dnsfilter.Filter{{ID: 1, Data: []byte("||example.org^\n")}}
+	assert.Nil(t, s.Update(&conf))
+	assert.Equal(t, addr, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+	assert.Equal(t, dns.RcodeNameError, exchange("example.org.").Rcode)
+
+	conf.Filters = nil
+	assert.Nil(t, s.Update(&conf))
+	assert.Equal(t, "5.6.7.8", exchange("example.org.").Answer[0].(*dns.A).A.String())
+	assert.Equal(t, "5.6.7.8", exchange("nxdomain.example.org.").Answer[0].(*dns.A).A.String())
+
+	// the updated upstream servers aren't kept after restart
+	assert.Nil(t, s.Stop())
+	assert.Nil(t, s.Start(nil))
+	assert.Nil(t, s.resolver)
+	assert.Nil(t, s.Stop())
+}
+
+func TestActivatedSockets(t *testing.T) {
+	u := testmode.NewUpstream()
+	u.SetAnswer("example.org", dns.TypeA, newTestA("example.org.", net.IP{1, 2, 3, 4}))
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	assert.Nil(t, err)
+	defer conn.Close()
+	f, err := conn.File()
+	assert.Nil(t, err)
+	defer f.Close()
+
+	s := createTestServer(t)
+	defer removeDataDir(t)
+	s.conf.SafeBrowsingEnabled = false
+	s.conf.Upstreams = []upstream.Upstream{u}
+	s.conf.ActivatedSockets = []*os.File{f}
+	s.conf.ExtraListenAddrs = []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}}
+	assert.Nil(t, s.Start(nil))
+	assert.Equal(t, 1, len(s.extra.servers))
+	assert.Nil(t, s.dnsProxy.Addr(proxy.ProtoUDP))
+
+	// the socket is still open after restart
+	for i := 0; i != 2; i++ {
+		reply, err := dns.Exchange(createTestMessage("example.org."), conn.LocalAddr().String())
+		assert.Nil(t, err)
+		assert.Equal(t, "1.2.3.4", reply.Answer[0].(*dns.A).A.String())
+		assert.Nil(t, s.Stop())
+		assert.Nil(t, s.Start(nil))
+	}
+	assert.Nil(t, s.Stop())
+}
@@ -0,0 +1,511 @@
+// DNSSEC validation
+// We don't trust the AD bit from the upstream servers, instead we build the chain of trust ourselves:
+// the answer is signed by the zone key, the zone key is confirmed by the DS record in the parent zone,
+// and so on up to the root zone, whose keys are our trust anchors.
+// A negative answer from a signed zone must prove the denial of existence (see dnssec_denial.go),
+// an empty or unsigned answer is accepted only if the zone is proven to be insecure.
+// The answers that fail the validation are replaced with SERVFAIL.
+
+package dnsforward
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation status
+const (
+	dnssecSecure   = "secure"   // the answer is signed and the chain of trust is valid
+	dnssecInsecure = "insecure" // the zone isn't signed, and the parent zone proves it
+	dnssecBogus    = "bogus"    // the validation has failed
+)
+
+const (
+	dnssecCacheSize = 1000
+	dnssecCacheTTL  = time.Hour // how long the validated zone keys are used
+	dnssecMaxDepth  = 16        // the max length of the chain of trust
+
+	dnssecAnchorsFileName = "dnssec_anchors.json"
+)
+
+// There are no DS records, and there's no proof that the zone is an insecure delegation
+var errNoDS = errors.New("no DS records")
+
+// The result of a zone keys validation
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	status string
+	err    error
+}
+
+type dnssecValidator struct {
+	anchors *trustAnchors
+	keys    gcache.Cache // zone -> zoneKeys
+}
+
+func newDNSSECValidator(anchorsFile string) *dnssecValidator {
+	return &dnssecValidator{
+		anchors: loadTrustAnchors(anchorsFile),
+		keys:    gcache.New(dnssecCacheSize).LRU().Expiration(dnssecCacheTTL).Clock(clock.Current).Build(),
+	}
+}
+
+// The validation of a single response
+type dnssecValidation struct {
+	v        *dnssecValidator
+	exchange func(req *dns.Msg) (*dns.Msg, error) // sends the request to the upstream servers
+}
+
+// Set DNSSEC OK bit in the request, so the upstream server sends the signatures
+// Returns TRUE if the request has EDNS, and TRUE if the client has set the bit itself
+func setDNSSECOK(req *dns.Msg) (bool, bool) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+		return false, false
+	}
+	do := opt.Do()
+	opt.SetDo()
+	return true, do
+}
+
+// Remove DNSSEC records and EDNS from the response if the client hasn't asked for them
+func stripDNSSEC(res *dns.Msg, qtype uint16, edns bool) *dns.Msg {
+	res = res.Copy()
+	strip := func(rrs []dns.RR) []dns.RR {
+		result := []dns.RR{}
+		for _, rr := range rrs {
+			t := rr.Header().Rrtype
+			if t == qtype || (t != dns.TypeRRSIG && t != dns.TypeNSEC && t != dns.TypeNSEC3) {
+				result = append(result, rr)
+			}
+		}
+		return result
+	}
+	res.Answer = strip(res.Answer)
+	res.Ns = strip(res.Ns)
+	res.Extra = strip(res.Extra)
+	if !edns {
+		extra := []dns.RR{}
+		for _, rr := range res.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		res.Extra = extra
+	} else if opt := res.IsEdns0(); opt != nil {
+		// the DO bit in the response reflects the request's one
+		opt.Hdr.Ttl &^= 1 << 15
+	}
+	return res
+}
+
+// Group the records to RRsets, the signatures are returned separately
+func splitRRsets(rrs []dns.RR) (map[string][]dns.RR, []*dns.RRSIG) {
+	sets := map[string][]dns.RR{}
+	sigs := []*dns.RRSIG{}
+	for _, rr := range rrs {
+		switch r := rr.(type) {
+		case *dns.RRSIG:
+			sigs = append(sigs, r)
+		case *dns.OPT:
+			// not an RRset
+		default:
+			key := strings.ToLower(rr.Header().Name) + " " + dns.TypeToString[rr.Header().Rrtype]
+			sets[key] = append(sets[key], rr)
+		}
+	}
+	return sets, sigs
+}
+
+// Find the signatures of the RRset
+func rrsetSigs(rrset []dns.RR, sigs []*dns.RRSIG) []*dns.RRSIG {
+	h := rrset[0].Header()
+	found := []*dns.RRSIG{}
+	for _, sig := range sigs {
+		if sig.TypeCovered == h.Rrtype && strings.EqualFold(sig.Hdr.Name, h.Name) {
+			found = append(found, sig)
+		}
+	}
+	return found
+}
+
+// Check that the RRset is signed by one of the keys
+// Returns the tags of the keys that have signed the RRset
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) map[uint16]bool {
+	now := clock.Now()
+	signed := map[uint16]bool{}
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, rrset) == nil {
+				signed[sig.KeyTag] = true
+			}
+		}
+	}
+	return signed
+}
+
+// Send the request with DNSSEC OK bit
+func (d *dnssecValidation) query(name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	req.CheckingDisabled = true
+	res, err := d.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || (res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError) {
+		return nil, fmt.Errorf("%s %s: no response", name, dns.TypeToString[qtype])
+	}
+	return res, nil
+}
+
+// Get the validated keys of the zone
+func (d *dnssecValidation) zoneKeys(zone string, depth int) zoneKeys {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	val, err := d.v.keys.Get(zone)
+	if err == nil {
+		return val.(zoneKeys)
+	}
+	zk := d.validateZoneKeys(zone, depth)
+	if zk.err == nil {
+		_ = d.v.keys.Set(zone, zk)
+	}
+	return zk
+}
+
+func (d *dnssecValidation) validateZoneKeys(zone string, depth int) zoneKeys {
+	if depth > dnssecMaxDepth {
+		return zoneKeys{status: dnssecBogus, err: fmt.Errorf("the chain of trust is too long")}
+	}
+
+	res, err := d.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return zoneKeys{status: dnssecBogus, err: err}
+	}
+	keys := []*dns.DNSKEY{}
+	keySet := []dns.RR{}
+	sigs := []*dns.RRSIG{}
+	for _, rr := range res.Answer {
+		switch r := rr.(type) {
+		case *dns.DNSKEY:
+			if strings.EqualFold(r.Hdr.Name, zone) {
+				keys = append(keys, r)
+				keySet = append(keySet, r)
+			}
+		case *dns.RRSIG:
+			if r.TypeCovered == dns.TypeDNSKEY && strings.EqualFold(r.Hdr.Name, zone) {
+				sigs = append(sigs, r)
+			}
+		}
+	}
+
+	// the key set must be signed by a key that we trust
+	var trusted []*dns.DNSKEY
+	if zone == "." {
+		trusted = d.v.anchors.trusted()
+	} else {
+		ds, status, err := d.dsRecords(zone, depth)
+		if status != dnssecSecure || err != nil {
+			return zoneKeys{status: status, err: err}
+		}
+		for _, k := range keys {
+			for _, r := range ds {
+				kds := k.ToDS(r.DigestType)
+				if kds != nil && r.KeyTag == kds.KeyTag && r.Algorithm == kds.Algorithm &&
+					strings.EqualFold(r.Digest, kds.Digest) {
+					trusted = append(trusted, k)
+				}
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return zoneKeys{status: dnssecBogus, err: fmt.Errorf("%s: no DNSKEY records", zone)}
+	}
+
+	if len(verifyRRset(keySet, sigs, trusted)) == 0 {
+		return zoneKeys{status: dnssecBogus, err: fmt.Errorf("%s: DNSKEY isn't signed by a trusted key", zone)}
+	}
+	if zone == "." {
+		d.v.anchors.update(keys, verifyRRset(keySet, sigs, keys))
+	}
+	return zoneKeys{keys: keys, status: dnssecSecure}
+}
+
+// Get the validated DS records of the zone
+// Returns insecure status if the parent zone proves that there are no DS records
+func (d *dnssecValidation) dsRecords(zone string, depth int) ([]*dns.DS, string, error) {
+	res, err := d.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, dnssecBogus, err
+	}
+
+	ds := []*dns.DS{}
+	dsSet := []dns.RR{}
+	for _, rr := range res.Answer {
+		if r, ok := rr.(*dns.DS); ok && strings.EqualFold(r.Hdr.Name, zone) {
+			ds = append(ds, r)
+			dsSet = append(dsSet, r)
+		}
+	}
+	if len(ds) == 0 {
+		insecure, err := d.provenNoDS(zone, res, depth)
+		if err != nil {
+			return nil, dnssecBogus, err
+		}
+		if insecure {
+			return nil, dnssecInsecure, nil
+		}
+		return nil, dnssecBogus, errNoDS
+	}
+
+	_, sigs := splitRRsets(res.Answer)
+	status, err := d.verifySigned(dsSet, sigs, zone, depth)
+	return ds, status, err
+}
+
+// Check the RRset signatures with the signer zone keys
+// owner is the name the RRset belongs to, its signer must be a parent zone
+func (d *dnssecValidation) verifySigned(rrset []dns.RR, sigs []*dns.RRSIG, owner string, depth int) (string, error) {
+	sigs = rrsetSigs(rrset, sigs)
+	if len(sigs) == 0 {
+		return dnssecBogus, fmt.Errorf("%s: no signatures", rrset[0].Header().Name)
+	}
+	var err error
+	for _, sig := range sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) ||
+			(rrset[0].Header().Rrtype == dns.TypeDS && strings.EqualFold(signer, owner)) {
+			err = fmt.Errorf("%s: invalid signer %s", owner, signer)
+			continue
+		}
+		zk := d.zoneKeys(signer, depth+1)
+		if zk.status != dnssecSecure {
+			return zk.status, zk.err
+		}
+		if len(verifyRRset(rrset, []*dns.RRSIG{sig}, zk.keys)) != 0 {
+			return dnssecSecure, nil
+		}
+		err = fmt.Errorf("%s: invalid signature", rrset[0].Header().Name)
+	}
+	return dnssecBogus, err
+}
+
+// Check that the response proves that the zone is an insecure delegation:
+// NSEC or NSEC3 record for the name has NS bit and doesn't have DS bit,
+// or NSEC3 opt-out record covers the name
+func (d *dnssecValidation) provenNoDS(zone string, res *dns.Msg, depth int) (bool, error) {
+	sets, sigs := splitRRsets(res.Ns)
+	for _, rrset := range sets {
+		t := rrset[0].Header().Rrtype
+		if t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		status, err := d.verifySigned(rrset, sigs, zone, depth)
+		if status != dnssecSecure {
+			if err == nil {
+				err = fmt.Errorf("%s: the denial of existence isn't secure", zone)
+			}
+			return false, err
+		}
+		for _, rr := range rrset {
+			switch r := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(r.Hdr.Name, zone) {
+					return hasType(r.TypeBitMap, dns.TypeNS) && !hasType(r.TypeBitMap, dns.TypeDS), nil
+				}
+			case *dns.NSEC3:
+				if r.Match(zone) {
+					return hasType(r.TypeBitMap, dns.TypeNS) && !hasType(r.TypeBitMap, dns.TypeDS), nil
+				}
+				if r.Flags&1 != 0 && r.Cover(zone) {
+					return true, nil // opt-out
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the unsigned name is in an insecure zone:
+// one of the zones from the root down to the name is an insecure delegation
+func (d *dnssecValidation) unsignedInsecure(name string) (bool, error) {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		_, status, err := d.dsRecords(zone, 0)
+		switch {
+		case status == dnssecInsecure:
+			return true, nil
+		case status == dnssecSecure:
+			continue
+		case err == errNoDS:
+			continue // not a zone cut
+		default:
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Follow the CNAME records of the answer from the name
+func answerTarget(name string, answer []dns.RR) string {
+	for i := 0; i < dnssecMaxDepth; i++ {
+		found := false
+		for _, rr := range answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+				name = c.Target
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return name
+}
+
+// Check that the signed answer records synthesized from a wildcard are allowed
+func checkWildcards(answer []dns.RR, denial *denialRecords) error {
+	sets, sigs := splitRRsets(answer)
+	for _, rrset := range sets {
+		name := rrset[0].Header().Name
+		rs := rrsetSigs(rrset, sigs)
+		if len(rs) == 0 || strings.HasPrefix(name, "*.") {
+			continue
+		}
+		labels := 0
+		for _, sig := range rs {
+			if int(sig.Labels) > labels {
+				labels = int(sig.Labels)
+			}
+		}
+		if labels < dns.CountLabel(name) {
+			err := denial.proveWildcard(name, labels)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate the response to the question
+// Returns the status and the reason of the failure
+func (d *dnssecValidation) validate(q dns.Question, res *dns.Msg) (string, error) {
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return dnssecInsecure, nil
+	}
+	rrs := append(append([]dns.RR{}, res.Answer...), res.Ns...)
+	sets, sigs := splitRRsets(rrs)
+
+	status := dnssecSecure
+	for _, rrset := range sets {
+		name := rrset[0].Header().Name
+		if len(rrsetSigs(rrset, sigs)) == 0 {
+			insecure, err := d.unsignedInsecure(name)
+			if !insecure {
+				if err == nil {
+					err = fmt.Errorf("%s %s isn't signed", name, dns.TypeToString[rrset[0].Header().Rrtype])
+				}
+				return dnssecBogus, err
+			}
+			status = dnssecInsecure
+			continue
+		}
+
+		s, err := d.verifySigned(rrset, sigs, name, 0)
+		if s == dnssecBogus {
+			return s, err
+		}
+		if s == dnssecInsecure {
+			status = dnssecInsecure
+		}
+	}
+
+	denial := newDenialRecords(res.Ns)
+	name := q.Name
+	if q.Qtype != dns.TypeCNAME {
+		name = answerTarget(q.Name, res.Answer)
+	}
+	if res.Rcode == dns.RcodeSuccess {
+		for _, rr := range res.Answer {
+			h := rr.Header()
+			if strings.EqualFold(h.Name, name) && (h.Rrtype == q.Qtype || q.Qtype == dns.TypeANY) {
+				err := checkWildcards(res.Answer, denial)
+				if err != nil {
+					return dnssecBogus, err
+				}
+				return status, nil
+			}
+		}
+	}
+
+	// there's no answer: the name must be proven not to exist or not to have the type,
+	//  unless its zone is insecure
+	s, err := denial.prove(name, q.Qtype, res.Rcode)
+	if err != nil {
+		insecure, ierr := d.unsignedInsecure(name)
+		if insecure {
+			return dnssecInsecure, nil
+		}
+		if ierr != nil {
+			err = ierr
+		}
+		return dnssecBogus, err
+	}
+	if s == dnssecInsecure {
+		status = dnssecInsecure
+	}
+	return status, nil
+}
+
+// Get the function that sends the requests to the upstream servers
+func resolver(p *proxy.Proxy) func(req *dns.Msg) (*dns.Msg, error) {
+	return func(req *dns.Msg) (*dns.Msg, error) {
+		d := &proxy.DNSContext{Proto: proxy.ProtoUDP, Req: req}
+		err := p.Resolve(d)
+		return d.Res, err
+	}
+}
+
+// validateDNSSEC checks the response and sets AD bit for a secure answer
+// A bogus answer is replaced with SERVFAIL
+// Returns the validation status
+func (s *Server) validateDNSSEC(exchange func(req *dns.Msg) (*dns.Msg, error), req *dns.Msg, res *dns.Msg) (*dns.Msg, string) {
+	if len(req.Question) == 0 {
+		return res, dnssecInsecure
+	}
+	d := &dnssecValidation{v: s.dnssec, exchange: exchange}
+	status, err := d.validate(req.Question[0], res)
+	if status == dnssecBogus {
+		log.Debug("DNSSEC: %s: bogus answer: %s", req.Question[0].Name, err)
+		fail := new(dns.Msg)
+		fail.SetRcode(req, dns.RcodeServerFailure)
+		return fail, status
+	}
+	res = res.Copy()
+	res.AuthenticatedData = status == dnssecSecure
+	return res, status
+}
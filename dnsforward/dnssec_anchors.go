@@ -0,0 +1,179 @@
+// DNSSEC trust anchors
+// The root zone keys are trusted initially, the new keys are added and the revoked keys are removed
+// automatically as described in RFC 5011.
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/miekg/dns"
+)
+
+// The root zone KSK-2017
+const rootTrustAnchor = ". 172800 IN DNSKEY 257 3 8 AwEAAaz/tAm8yTn4Mfeh5eyI96WSVexTBAvkMgJzkKTOiW1vkIbzxeF3+/4RgWOq7HrxRixHlFlExOLAJr5emLvN7SWXgnLh4+B5xQlNVz8Og8kvArMtNROxVQuCaSnIDdD5LKyWbRd2n9WGe2R8PzgCmr3EgVLrjyBxWezF0jLHwVN8efS3rCj/EWgvIWgb9tarpVUDK/b58Da+sqqls3eNbuv7pr+eoZG+SrDK6nWeL3c6H5Apxz7LjVc1uTIdsIXxuOLYA4/ilBmSVIzuDWfdRUfhHdY6+cn8HFRm+2hM8AnXGXws9555KrUB5qihylGa8subX2Nn6UwNR1AkUTV74bU="
+
+// A new key becomes trusted if it's been seen for this long (RFC 5011 2.4.1)
+const trustAnchorHoldDown = 30 * 24 * time.Hour
+
+// Trust anchor states (RFC 5011 4)
+const (
+	anchorValid   = "valid"
+	anchorAddPend = "addpend" // a new key, not trusted until the hold-down time passes
+	anchorRevoked = "revoked"
+)
+
+type trustAnchor struct {
+	Key       string    `json:"key"` // DNSKEY record in the presentation format
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"first_seen"`
+
+	dnskey *dns.DNSKEY
+}
+
+type trustAnchors struct {
+	path    string // the file the anchors are saved to, empty: not saved
+	anchors []*trustAnchor
+	lock    sync.Mutex
+}
+
+// Load the trust anchors from the file
+// The root zone key is used if the file doesn't exist
+func loadTrustAnchors(path string) *trustAnchors {
+	ta := &trustAnchors{path: path}
+	if len(path) != 0 {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &ta.anchors)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Error("Couldn't load DNSSEC trust anchors from %s: %s", path, err)
+		}
+	}
+
+	anchors := []*trustAnchor{}
+	for _, a := range ta.anchors {
+		rr, err := dns.NewRR(a.Key)
+		if err != nil {
+			log.Error("Invalid DNSSEC trust anchor %s: %s", a.Key, err)
+			continue
+		}
+		k, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			log.Error("Invalid DNSSEC trust anchor %s: not a DNSKEY record", a.Key)
+			continue
+		}
+		a.dnskey = k
+		anchors = append(anchors, a)
+	}
+	ta.anchors = anchors
+
+	if len(ta.anchors) == 0 {
+		rr, _ := dns.NewRR(rootTrustAnchor)
+		ta.anchors = []*trustAnchor{{Key: rootTrustAnchor, State: anchorValid, dnskey: rr.(*dns.DNSKEY)}}
+	}
+	return ta
+}
+
+// Save the trust anchors to the file
+func (ta *trustAnchors) save() {
+	if len(ta.path) == 0 {
+		return
+	}
+	data, err := json.MarshalIndent(ta.anchors, "", "  ")
+	if err != nil {
+		log.Error("Couldn't save DNSSEC trust anchors: %s", err)
+		return
+	}
+	err = file.SafeWrite(ta.path, data)
+	if err != nil {
+		log.Error("Couldn't save DNSSEC trust anchors: %s", err)
+	}
+}
+
+// The keys are the same if their public keys are the same, the flags may differ (e.g. REVOKE bit)
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.Protocol == b.Protocol &&
+		strings.EqualFold(a.Hdr.Name, b.Hdr.Name) && a.PublicKey == b.PublicKey
+}
+
+// Get the trusted keys
+func (ta *trustAnchors) trusted() []*dns.DNSKEY {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+	keys := []*dns.DNSKEY{}
+	for _, a := range ta.anchors {
+		if a.State == anchorValid {
+			keys = append(keys, a.dnskey)
+		}
+	}
+	return keys
+}
+
+// Update the trust anchors from the root zone keys
+// keys must be validated by a trusted key
+// selfSigned: the key tags of the keys which have signed the key set
+func (ta *trustAnchors) update(keys []*dns.DNSKEY, selfSigned map[uint16]bool) {
+	ta.lock.Lock()
+	defer ta.lock.Unlock()
+
+	now := clock.Now()
+	changed := false
+	seen := map[*trustAnchor]bool{}
+	for _, k := range keys {
+		if k.Flags&dns.SEP == 0 {
+			continue
+		}
+		var anchor *trustAnchor
+		for _, a := range ta.anchors {
+			if sameKey(a.dnskey, k) {
+				anchor = a
+				break
+			}
+		}
+
+		if k.Flags&dns.REVOKE != 0 {
+			// the revoked key must sign the key set itself
+			if anchor != nil && anchor.State != anchorRevoked && selfSigned[k.KeyTag()] {
+				log.Info("DNSSEC: trust anchor %d is revoked", anchor.dnskey.KeyTag())
+				anchor.State = anchorRevoked
+				changed = true
+			}
+			continue
+		}
+
+		if anchor == nil {
+			anchor = &trustAnchor{Key: k.String(), State: anchorAddPend, FirstSeen: now, dnskey: k}
+			ta.anchors = append(ta.anchors, anchor)
+			log.Info("DNSSEC: new root key %d, it becomes trusted after %v", k.KeyTag(), trustAnchorHoldDown)
+			changed = true
+		} else if anchor.State == anchorAddPend && now.Sub(anchor.FirstSeen) >= trustAnchorHoldDown {
+			anchor.State = anchorValid
+			log.Info("DNSSEC: root key %d is trusted", k.KeyTag())
+			changed = true
+		}
+		seen[anchor] = true
+	}
+
+	// a pending key that has disappeared is forgotten
+	anchors := []*trustAnchor{}
+	for _, a := range ta.anchors {
+		if a.State == anchorAddPend && !seen[a] {
+			changed = true
+			continue
+		}
+		anchors = append(anchors, a)
+	}
+	ta.anchors = anchors
+
+	if changed {
+		ta.save()
+	}
+}
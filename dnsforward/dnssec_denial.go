@@ -0,0 +1,263 @@
+// DNSSEC authenticated denial of existence (RFC 4035 section 5.4, RFC 5155 section 8)
+// A negative answer from a signed zone must carry NSEC or NSEC3 records which prove
+// that the name doesn't exist and no wildcard could have answered instead (NXDOMAIN),
+// or that the name exists but has no records of the requested type (NODATA).
+// An answer synthesized from a wildcard must prove that the name itself doesn't exist.
+// The signatures of the NSEC and NSEC3 records are checked with the other records of the response.
+
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The responses with more expensive NSEC3 hashes are treated as insecure (RFC 9276)
+const dnssecMaxNSEC3Iterations = 150
+
+// NSEC and NSEC3 records of the response
+type denialRecords struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+func newDenialRecords(rrs []dns.RR) *denialRecords {
+	d := &denialRecords{}
+	for _, rr := range rrs {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			d.nsec = append(d.nsec, r)
+		case *dns.NSEC3:
+			d.nsec3 = append(d.nsec3, r)
+		}
+	}
+	return d
+}
+
+// Compare the names in the canonical order (RFC 4034 section 6.1): label by label from the right
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		c := strings.Compare(la[len(la)-i], lb[len(lb)-i])
+		if c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// Get the longest common ancestor of the names
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	labels := dns.SplitDomainName(strings.ToLower(a))
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// Get the ancestor of the name with this number of labels
+func ancestor(name string, n int) string {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	if n > len(labels) {
+		n = len(labels)
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// Check that the record of the name proves that there are no records of the type
+func typeAbsent(bitmap []uint16, qtype uint16) bool {
+	if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+		return false
+	}
+	// the record of a delegation point is from the parent zone: it proves only that there's no DS,
+	// and the record of a zone apex is from the child zone: it can't prove that
+	if qtype != dns.TypeDS && hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA) {
+		return false
+	}
+	if qtype == dns.TypeDS && hasType(bitmap, dns.TypeSOA) {
+		return false
+	}
+	return true
+}
+
+// Check that the name is between the owner name and the next name of the NSEC record
+func nsecCovers(r *dns.NSEC, name string) bool {
+	if canonicalCompare(r.Hdr.Name, name) >= 0 {
+		return false
+	}
+	if canonicalCompare(r.Hdr.Name, r.NextDomain) < 0 {
+		return canonicalCompare(name, r.NextDomain) < 0
+	}
+	// the last record of the zone: the next name is the zone apex
+	return dns.IsSubDomain(r.NextDomain, name)
+}
+
+func (d *denialRecords) nsecMatching(name string) *dns.NSEC {
+	for _, r := range d.nsec {
+		if strings.EqualFold(r.Hdr.Name, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (d *denialRecords) nsecCovering(name string) *dns.NSEC {
+	for _, r := range d.nsec {
+		if nsecCovers(r, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (d *denialRecords) nsec3Matching(name string) *dns.NSEC3 {
+	for _, r := range d.nsec3 {
+		if r.Match(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (d *denialRecords) nsec3Covering(name string) *dns.NSEC3 {
+	for _, r := range d.nsec3 {
+		// Cover() is also TRUE for the matching record
+		if r.Cover(name) && !r.Match(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Prove that the name doesn't exist or doesn't have the records of the type
+// Returns insecure status if the name is in an opt-out span of NSEC3 records
+func (d *denialRecords) prove(name string, qtype uint16, rcode int) (string, error) {
+	if len(d.nsec3) != 0 {
+		for _, r := range d.nsec3 {
+			if r.Hash != dns.SHA1 || r.Iterations > dnssecMaxNSEC3Iterations {
+				return dnssecInsecure, nil
+			}
+		}
+		return d.proveNSEC3(name, qtype, rcode)
+	}
+	if len(d.nsec) != 0 {
+		err := d.proveNSEC(name, qtype, rcode)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		return dnssecSecure, nil
+	}
+	return dnssecBogus, fmt.Errorf("%s: no NSEC or NSEC3 records", name)
+}
+
+func (d *denialRecords) proveNSEC(name string, qtype uint16, rcode int) error {
+	if rcode == dns.RcodeSuccess {
+		r := d.nsecMatching(name)
+		if r != nil {
+			if !typeAbsent(r.TypeBitMap, qtype) {
+				return fmt.Errorf("%s: NSEC shows that %s exists", name, dns.TypeToString[qtype])
+			}
+			return nil
+		}
+	}
+
+	r := d.nsecCovering(name)
+	if r == nil {
+		return fmt.Errorf("%s: no NSEC record covers the name", name)
+	}
+	if rcode == dns.RcodeSuccess && dns.IsSubDomain(name, r.NextDomain) {
+		return nil // an empty non-terminal: the name has the descendants but no records
+	}
+
+	// the closest encloser is the longest existing ancestor of the name
+	ce := commonAncestor(name, r.Hdr.Name)
+	if ce2 := commonAncestor(name, r.NextDomain); dns.CountLabel(ce2) > dns.CountLabel(ce) {
+		ce = ce2
+	}
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	if rcode == dns.RcodeNameError {
+		if d.nsecCovering(wildcard) == nil {
+			return fmt.Errorf("%s: no NSEC record proves that there's no wildcard", name)
+		}
+		return nil
+	}
+
+	// NODATA for the name which is synthesized from the wildcard
+	w := d.nsecMatching(wildcard)
+	if w == nil || !typeAbsent(w.TypeBitMap, qtype) {
+		return fmt.Errorf("%s: no NSEC record proves that there's no %s", name, dns.TypeToString[qtype])
+	}
+	return nil
+}
+
+// Find the closest encloser proof: the NSEC3 record which matches the closest encloser
+// and the one which covers the next closer name
+// Returns the closest encloser and TRUE if the covering record has the opt-out flag
+func (d *denialRecords) closestEncloser(name string) (string, bool, error) {
+	n := dns.CountLabel(name)
+	for i := n - 1; i >= 0; i-- {
+		ce := ancestor(name, i)
+		r := d.nsec3Matching(ce)
+		if r == nil {
+			continue
+		}
+		if hasType(r.TypeBitMap, dns.TypeDNAME) ||
+			(hasType(r.TypeBitMap, dns.TypeNS) && !hasType(r.TypeBitMap, dns.TypeSOA)) {
+			return "", false, fmt.Errorf("%s: the closest encloser %s is a delegation", name, ce)
+		}
+		c := d.nsec3Covering(ancestor(name, i+1))
+		if c == nil {
+			return "", false, fmt.Errorf("%s: no NSEC3 record covers the next closer name", name)
+		}
+		return ce, c.Flags&1 != 0, nil
+	}
+	return "", false, fmt.Errorf("%s: no closest encloser proof", name)
+}
+
+func (d *denialRecords) proveNSEC3(name string, qtype uint16, rcode int) (string, error) {
+	if rcode == dns.RcodeSuccess {
+		r := d.nsec3Matching(name)
+		if r != nil {
+			if !typeAbsent(r.TypeBitMap, qtype) {
+				return dnssecBogus, fmt.Errorf("%s: NSEC3 shows that %s exists", name, dns.TypeToString[qtype])
+			}
+			return dnssecSecure, nil
+		}
+	}
+
+	ce, optOut, err := d.closestEncloser(name)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if rcode == dns.RcodeSuccess && qtype == dns.TypeDS && optOut {
+		return dnssecInsecure, nil // an unsigned delegation in the opt-out span
+	}
+
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	if rcode == dns.RcodeNameError {
+		if d.nsec3Covering(wildcard) == nil {
+			return dnssecBogus, fmt.Errorf("%s: no NSEC3 record proves that there's no wildcard", name)
+		}
+		if optOut {
+			return dnssecInsecure, nil
+		}
+		return dnssecSecure, nil
+	}
+
+	// NODATA for the name which is synthesized from the wildcard
+	w := d.nsec3Matching(wildcard)
+	if w == nil || !typeAbsent(w.TypeBitMap, qtype) {
+		return dnssecBogus, fmt.Errorf("%s: no NSEC3 record proves that there's no %s", name, dns.TypeToString[qtype])
+	}
+	return dnssecSecure, nil
+}
+
+// Prove that the name doesn't exist, so it could be synthesized from the wildcard
+// labels is the number of labels of the wildcard's parent, as in its signature
+func (d *denialRecords) proveWildcard(name string, labels int) error {
+	if d.nsec3Covering(ancestor(name, labels+1)) != nil || d.nsecCovering(name) != nil {
+		return nil
+	}
+	return fmt.Errorf("%s: the answer is synthesized from a wildcard, but the name isn't proven not to exist", name)
+}
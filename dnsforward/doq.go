@@ -0,0 +1,214 @@
+// DNS-over-QUIC server (RFC 9250), experimental
+// It uses the same certificate as DNS-over-TLS, on UDP port.
+// Every request is sent on its own stream: 2-byte length and the message whose ID must be 0,
+// the response is sent on the same stream, then the stream is closed.
+// A client may identify itself via the TLS server name, as with DNS-over-TLS.
+// The requests in 0-RTT data may be replayed by an attacker, so only the standard queries are answered
+// before the handshake is complete, the other requests wait for it (RFC 9250 section 4.5).
+
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// ProtoQUIC is the transport protocol of DNS-over-QUIC requests
+const ProtoQUIC = "quic"
+
+const (
+	doqALPN        = "doq"
+	doqIdleTimeout = 30 * time.Second
+	doqMaxStreams  = 100 // concurrent requests of a connection
+)
+
+// DoQ error codes (RFC 9250 section 4.3)
+const (
+	doqInternalError    = 0x1
+	doqProtocolError    = 0x2
+	doqUnspecifiedError = 0x5
+)
+
+type doqServer struct {
+	listener *quic.EarlyListener
+
+	// processes the request and returns the response (nil: don't respond)
+	handler func(d *proxy.DNSContext) *dns.Msg
+}
+
+// The stream of the request: it's passed as the connection of the request
+type doqConn struct {
+	quic.Stream
+	conn quic.EarlyConnection
+}
+
+func (c *doqConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *doqConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Start listening for DNS-over-QUIC connections
+func startDOQServer(addr *net.UDPAddr, tlsConfig *tls.Config, handler func(d *proxy.DNSContext) *dns.Msg) (*doqServer, error) {
+	tc := tlsConfig.Clone()
+	tc.NextProtos = []string{doqALPN}
+	tc.MinVersion = tls.VersionTLS13
+	qc := &quic.Config{
+		MaxIdleTimeout:        doqIdleTimeout,
+		MaxIncomingStreams:    doqMaxStreams,
+		MaxIncomingUniStreams: -1, // DoQ uses only the bidirectional streams
+		Allow0RTT:             true,
+	}
+	ln, err := quic.ListenAddrEarly(addr.String(), tc, qc)
+	if err != nil {
+		return nil, err
+	}
+	srv := &doqServer{
+		listener: ln,
+		handler:  handler,
+	}
+	log.Info("Listening to quic://%s", ln.Addr())
+	go srv.serve()
+	return srv, nil
+}
+
+func (srv *doqServer) serve() {
+	for {
+		conn, err := srv.listener.Accept(context.Background())
+		if err != nil {
+			if err != quic.ErrServerClosed {
+				log.Debug("DOQ: accept: %s", err)
+			}
+			return
+		}
+		go srv.handleConn(conn)
+	}
+}
+
+// Process the streams of the connection until it's closed
+func (srv *doqServer) handleConn(conn quic.EarlyConnection) {
+	log.Tracef("DOQ: new connection from %s", conn.RemoteAddr())
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go srv.handleStream(conn, stream)
+	}
+}
+
+// Check that the request may be answered from 0-RTT data which may be replayed:
+// the standard query doesn't change anything on the server
+func doqReplaySafe(req *dns.Msg) bool {
+	return req.Opcode == dns.OpcodeQuery
+}
+
+// Wait until the handshake is complete
+// Returns FALSE if the connection is closed
+func doqWaitHandshake(conn quic.EarlyConnection) bool {
+	select {
+	case <-conn.HandshakeComplete():
+		return true
+	case <-conn.Context().Done():
+		return false
+	}
+}
+
+// Check the handshake state without waiting
+func doqHandshakeComplete(conn quic.EarlyConnection) bool {
+	select {
+	case <-conn.HandshakeComplete():
+		return true
+	default:
+		return false
+	}
+}
+
+// Read the request from the stream and write the response
+func (srv *doqServer) handleStream(conn quic.EarlyConnection, stream quic.Stream) {
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(doqIdleTimeout))
+	clog := log.With("client", conn.RemoteAddr())
+
+	var length uint16
+	err := binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		stream.CancelRead(doqProtocolError)
+		return
+	}
+	packet := make([]byte, length)
+	_, err = io.ReadFull(stream, packet)
+	if err != nil {
+		stream.CancelRead(doqProtocolError)
+		return
+	}
+	req := &dns.Msg{}
+	err = req.Unpack(packet)
+	if err != nil || req.Id != 0 {
+		clog.Debug("DOQ: invalid request: %v", err)
+		_ = conn.CloseWithError(doqProtocolError, "invalid request")
+		return
+	}
+
+	if !doqHandshakeComplete(conn) && !doqReplaySafe(req) {
+		clog.Tracef("DOQ: waiting for the handshake to answer the request from 0-RTT data")
+		if !doqWaitHandshake(conn) {
+			return
+		}
+	}
+
+	d := &proxy.DNSContext{
+		Proto:     ProtoQUIC,
+		Req:       req,
+		Conn:      &doqConn{Stream: stream, conn: conn},
+		Addr:      conn.RemoteAddr(),
+		StartTime: time.Now(),
+	}
+	res := srv.handler(d)
+	if res == nil {
+		stream.CancelWrite(doqUnspecifiedError)
+		return
+	}
+	res = res.Copy()
+	res.Id = 0
+	packet, err = res.Pack()
+	if err != nil {
+		clog.Error("DOQ: couldn't pack the response: %s", err)
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+	buf := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+	copy(buf[2:], packet)
+	_, err = stream.Write(buf)
+	if err != nil {
+		clog.Debug("DOQ: couldn't write the response: %s", err)
+	}
+}
+
+// Stop listening and close all connections
+func (srv *doqServer) close() error {
+	return srv.listener.Close()
+}
+
+// DOQAddr returns the address of DNS-over-QUIC listener, or nil if it isn't running
+func (s *Server) DOQAddr() net.Addr {
+	s.RLock()
+	defer s.RUnlock()
+	if s.doq == nil {
+		return nil
+	}
+	return s.doq.listener.Addr()
+}
@@ -0,0 +1,227 @@
+// DNS-over-TLS server
+// The DNS proxy can't limit the number of connections nor their idle time, so we run the DoT listener ourselves.
+// A client may identify itself via the TLS server name: "<client ID>.<server name>"
+
+package dnsforward
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+const defaultDOTIdleTimeout = 10 * time.Second
+
+type dotServer struct {
+	listener    net.Listener
+	maxConns    int           // 0: no limit
+	idleTimeout time.Duration // the connection is closed if there's no request within this time
+
+	// processes the request and returns the response (nil: don't respond)
+	handler func(d *proxy.DNSContext) *dns.Msg
+
+	lock  sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// Start listening for DNS-over-TLS connections
+func startDOTServer(addr *net.TCPAddr, tlsConfig *tls.Config, maxConns int, idleTimeout time.Duration,
+	handler func(d *proxy.DNSContext) *dns.Msg) (*dotServer, error) {
+
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if idleTimeout == 0 {
+		idleTimeout = defaultDOTIdleTimeout
+	}
+	srv := &dotServer{
+		listener:    tls.NewListener(ln, tlsConfig),
+		maxConns:    maxConns,
+		idleTimeout: idleTimeout,
+		handler:     handler,
+		conns:       map[net.Conn]bool{},
+	}
+	log.Info("Listening to tls://%s", srv.listener.Addr())
+	go srv.serve()
+	return srv, nil
+}
+
+func (srv *dotServer) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			log.Debug("DOT: accept: %s", err)
+			continue
+		}
+		if !srv.addConn(conn) {
+			log.Debug("DOT: too many connections, closing %s", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		go srv.handleConn(conn)
+	}
+}
+
+// Register the new connection
+// Returns FALSE if the connections limit is reached
+func (srv *dotServer) addConn(conn net.Conn) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.conns == nil || (srv.maxConns != 0 && len(srv.conns) >= srv.maxConns) {
+		return false
+	}
+	srv.conns[conn] = true
+	return true
+}
+
+func (srv *dotServer) removeConn(conn net.Conn) {
+	srv.lock.Lock()
+	delete(srv.conns, conn)
+	srv.lock.Unlock()
+}
+
+// Get the number of the open connections
+func (srv *dotServer) connCount() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return len(srv.conns)
+}
+
+// Process the requests from a client until it closes the connection or stays idle for too long
+func (srv *dotServer) handleConn(conn net.Conn) {
+	log.Tracef("DOT: new connection from %s", conn.RemoteAddr())
+	defer func() {
+		_ = conn.Close()
+		srv.removeConn(conn)
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(srv.idleTimeout))
+		var length uint16
+		err := binary.Read(conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		_, err = io.ReadFull(conn, packet)
+		if err != nil {
+			return
+		}
+		req := &dns.Msg{}
+		err = req.Unpack(packet)
+		if err != nil {
+			log.Debug("DOT: invalid request from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+
+		d := &proxy.DNSContext{
+			Proto:     proxy.ProtoTLS,
+			Req:       req,
+			Conn:      conn,
+			Addr:      conn.RemoteAddr(),
+			StartTime: time.Now(),
+		}
+		res := srv.handler(d)
+		if res == nil {
+			continue
+		}
+		packet, err = res.Pack()
+		if err != nil {
+			log.Error("DOT: couldn't pack the response: %s", err)
+			return
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(srv.idleTimeout))
+		err = binary.Write(conn, binary.BigEndian, uint16(len(packet)))
+		if err == nil {
+			_, err = conn.Write(packet)
+		}
+		if err != nil {
+			log.Debug("DOT: couldn't write the response to %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// Stop listening and close all connections
+func (srv *dotServer) close() error {
+	err := srv.listener.Close()
+	srv.lock.Lock()
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+	srv.conns = nil
+	srv.lock.Unlock()
+	return err
+}
+
+// Process the request received by our own listener the same way the DNS proxy does
+func (s *Server) processRequest(d *proxy.DNSContext) *dns.Msg {
+	s.RLock()
+	p := s.dnsProxy
+	refuseAny := s.conf.RefuseAny
+	s.RUnlock()
+	if p == nil {
+		return nil
+	}
+
+	ok, _ := s.beforeRequestHandler(p, d)
+	if !ok {
+		return nil
+	}
+	if len(d.Req.Question) != 1 {
+		d.Res = new(dns.Msg)
+		d.Res.SetRcode(d.Req, dns.RcodeServerFailure)
+		return d.Res
+	}
+	if refuseAny && d.Req.Question[0].Qtype == dns.TypeANY {
+		d.Res = new(dns.Msg)
+		d.Res.SetRcode(d.Req, dns.RcodeNotImplemented)
+		return d.Res
+	}
+
+	err := s.handleDNSRequest(p, d)
+	if err != nil {
+		log.Tracef("error handling DNS (%s) request: %s", d.Proto, err)
+	}
+	if d.Res == nil {
+		d.Res = new(dns.Msg)
+		d.Res.SetRcode(d.Req, dns.RcodeServerFailure)
+	}
+	return d.Res
+}
+
+// ClientIDFromServerName returns the client ID from the TLS server name "<client ID>.<server name>",
+// or "" if there's none
+func ClientIDFromServerName(sni, serverName string) string {
+	sni = strings.ToLower(strings.TrimSuffix(sni, "."))
+	serverName = strings.ToLower(serverName)
+	if len(serverName) == 0 || !strings.HasSuffix(sni, "."+serverName) {
+		return ""
+	}
+	id := sni[:len(sni)-len(serverName)-1]
+	if strings.IndexByte(id, '.') != -1 {
+		return ""
+	}
+	return id
+}
+
+// DOTAddr returns the address of DNS-over-TLS listener, or nil if it isn't running
+func (s *Server) DOTAddr() net.Addr {
+	s.RLock()
+	defer s.RUnlock()
+	if s.dot == nil {
+		return nil
+	}
+	return s.dot.listener.Addr()
+}
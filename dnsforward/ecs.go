@@ -0,0 +1,163 @@
+// EDNS Client Subnet (RFC 7871)
+// send: the client's subnet is added to the requests, so CDN-aware upstreams can choose the nearest server
+// strip: the client's subnet is removed from the requests for privacy
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet modes
+const (
+	ECSModeSend  = "send"
+	ECSModeStrip = "strip"
+)
+
+const (
+	defaultECSPrefixV4 = 24
+	defaultECSPrefixV6 = 56
+)
+
+// The subnets which mustn't be sent to the upstream servers
+var ecsPrivateNets = []*net.IPNet{}
+
+func init() {
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(s)
+		ecsPrivateNets = append(ecsPrivateNets, n)
+	}
+}
+
+// CheckECSMode checks that EDNS Client Subnet mode and the prefix lengths are valid
+func CheckECSMode(mode string, prefixV4, prefixV6 uint8) error {
+	switch mode {
+	case "", ECSModeSend, ECSModeStrip:
+	default:
+		return fmt.Errorf("unknown EDNS Client Subnet mode: %s", mode)
+	}
+	if prefixV4 > 32 {
+		return fmt.Errorf("edns_cs_prefix_v4 must be in range 0-32")
+	}
+	if prefixV6 > 128 {
+		return fmt.Errorf("edns_cs_prefix_v6 must be in range 0-128")
+	}
+	return nil
+}
+
+// IsPublicIP returns TRUE if the address is reachable from the Internet, so it makes sense to send it upstream
+func IsPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range ecsPrivateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get EDNS Client Subnet option of the message, or nil if there's none
+func getECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// Remove EDNS Client Subnet option from the message
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := []dns.EDNS0{}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// Remove OPT record from the message
+func removeEDNS(m *dns.Msg) {
+	extra := []dns.RR{}
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// Apply EDNS Client Subnet settings to the request
+// Returns the request to be sent upstream: a modified copy, or the same request if nothing is changed
+func (s *Server) applyECS(req *dns.Msg, clientIP net.IP) *dns.Msg {
+	switch s.conf.EDNSCSMode {
+	case ECSModeStrip:
+		if getECS(req) == nil {
+			return req
+		}
+		req = req.Copy()
+		removeECS(req)
+		return req
+
+	case ECSModeSend:
+		// the client's own subnet is used as is
+		if getECS(req) != nil || !IsPublicIP(clientIP) {
+			return req
+		}
+		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+		if ip4 := clientIP.To4(); ip4 != nil {
+			prefix := s.conf.EDNSCSPrefixV4
+			if prefix == 0 {
+				prefix = defaultECSPrefixV4
+			}
+			ecs.Family = 1
+			ecs.SourceNetmask = prefix
+			ecs.Address = ip4.Mask(net.CIDRMask(int(prefix), 32))
+		} else {
+			prefix := s.conf.EDNSCSPrefixV6
+			if prefix == 0 {
+				prefix = defaultECSPrefixV6
+			}
+			ecs.Family = 2
+			ecs.SourceNetmask = prefix
+			ecs.Address = clientIP.Mask(net.CIDRMask(int(prefix), 128))
+		}
+		req = req.Copy()
+		opt := req.IsEdns0()
+		if opt == nil {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt = req.IsEdns0()
+		}
+		opt.Option = append(opt.Option, ecs)
+		return req
+	}
+	return req
+}
+
+// Make the response to the request sent upstream match the client's original request:
+// the client doesn't get EDNS or EDNS Client Subnet option if it hasn't sent them
+// The response isn't modified, a copy is returned.
+func restoreECS(origReq *dns.Msg, res *dns.Msg) *dns.Msg {
+	res = res.Copy()
+	if origReq.IsEdns0() == nil {
+		removeEDNS(res)
+	} else if getECS(origReq) == nil {
+		removeECS(res)
+	}
+	return res
+}
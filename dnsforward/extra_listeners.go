@@ -0,0 +1,149 @@
+// Additional listen addresses
+// The DNS proxy listens on a single address, so the plain DNS requests to the other addresses are received
+// by our own listeners and processed the same way as DNS-over-TLS requests.
+// The sockets passed by systemd are served the same way, the DNS proxy doesn't listen then.
+
+package dnsforward
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+type extraListeners struct {
+	servers []*dns.Server // plain DNS over UDP and TCP
+	dot     []*dotServer  // DNS-over-TLS
+}
+
+// Respond to the plain DNS request
+func (s *Server) serveExtraDNS(w dns.ResponseWriter, req *dns.Msg) {
+	proto := proxy.ProtoUDP
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		proto = proxy.ProtoTCP
+	}
+	d := &proxy.DNSContext{
+		Proto:     proto,
+		Req:       req,
+		Addr:      w.RemoteAddr(),
+		StartTime: time.Now(),
+	}
+	res := s.processRequest(d)
+	if res == nil {
+		return
+	}
+	err := w.WriteMsg(res)
+	if err != nil {
+		log.Debug("couldn't write the response to %s: %s", w.RemoteAddr(), err)
+	}
+}
+
+// Start the listeners on the additional addresses
+// A listener that can't be started is skipped, so the other listeners still work
+// Returns the bind errors: "<listener name>://<address>" -> error
+func (s *Server) startExtraListeners(dotConfig *tls.Config) map[string]string {
+	errs := map[string]string{}
+	disabled := map[string]bool{}
+	for _, l := range s.conf.DisabledListeners {
+		disabled[l] = true
+	}
+	handler := dns.HandlerFunc(s.serveExtraDNS)
+
+	for _, f := range s.conf.ActivatedSockets {
+		srv, err := activatedDNSServer(f, handler)
+		if err != nil {
+			errs[fmt.Sprintf("fd://%s", f.Name())] = err.Error()
+			continue
+		}
+		s.extra.servers = append(s.extra.servers, srv)
+		go func() { _ = srv.ActivateAndServe() }()
+	}
+
+	extraAddrs := s.conf.ExtraListenAddrs
+	if len(s.conf.ActivatedSockets) != 0 {
+		extraAddrs = nil
+	}
+	for _, addr := range extraAddrs {
+		if !disabled[ListenerUDP] {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+			if err != nil {
+				errs[fmt.Sprintf("%s://%s", ListenerUDP, addr)] = err.Error()
+			} else {
+				srv := &dns.Server{PacketConn: conn, Handler: handler}
+				s.extra.servers = append(s.extra.servers, srv)
+				go func() { _ = srv.ActivateAndServe() }()
+				log.Info("Listening to udp://%s", conn.LocalAddr())
+			}
+		}
+		if !disabled[ListenerTCP] {
+			ln, err := net.ListenTCP("tcp", addr)
+			if err != nil {
+				errs[fmt.Sprintf("%s://%s", ListenerTCP, addr)] = err.Error()
+			} else {
+				srv := &dns.Server{Listener: ln, Handler: handler}
+				s.extra.servers = append(s.extra.servers, srv)
+				go func() { _ = srv.ActivateAndServe() }()
+				log.Info("Listening to tcp://%s", ln.Addr())
+			}
+		}
+	}
+
+	if dotConfig != nil && !disabled[ListenerTLS] {
+		idleTimeout := time.Duration(s.conf.DOTIdleTimeout) * time.Second
+		for _, addr := range s.conf.ExtraTLSListenAddrs {
+			srv, err := startDOTServer(addr, dotConfig, s.conf.DOTMaxConnections, idleTimeout, s.processRequest)
+			if err != nil {
+				errs[fmt.Sprintf("%s://%s", ListenerTLS, addr)] = err.Error()
+				continue
+			}
+			s.extra.dot = append(s.extra.dot, srv)
+		}
+	}
+
+	for l, e := range errs {
+		log.Error("Couldn't start %s listener: %s", l, e)
+	}
+	return errs
+}
+
+// Get the DNS server for the socket passed by systemd
+// It listens on a duplicate of the socket, so the socket itself stays open after the server is stopped.
+func activatedDNSServer(f *os.File, handler dns.Handler) (*dns.Server, error) {
+	conn, err := net.FilePacketConn(f)
+	if err == nil {
+		log.Info("Listening to udp://%s (socket activation)", conn.LocalAddr())
+		return &dns.Server{PacketConn: conn, Handler: handler}, nil
+	}
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Listening to tcp://%s (socket activation)", ln.Addr())
+	return &dns.Server{Listener: ln, Handler: handler}, nil
+}
+
+// Stop the listeners on the additional addresses
+func (s *Server) stopExtraListeners() {
+	for _, srv := range s.extra.servers {
+		_ = srv.Shutdown()
+		// the server may have not started yet
+		if srv.PacketConn != nil {
+			_ = srv.PacketConn.Close()
+		}
+		if srv.Listener != nil {
+			_ = srv.Listener.Close()
+		}
+	}
+	for _, srv := range s.extra.dot {
+		err := srv.close()
+		if err != nil {
+			log.Debug("Couldn't close DNS-over-TLS listener: %s", err)
+		}
+	}
+	s.extra = extraListeners{}
+}
@@ -0,0 +1,121 @@
+// Fastest IP address mode
+// When the answer has several IP addresses, we try to connect to each of them
+// and respond with the one that accepted the connection first.
+
+package dnsforward
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+const (
+	fastestAddrProbeTimeout = time.Second
+	fastestAddrCacheSize    = 10000
+	fastestAddrCacheTTL     = 10 * time.Minute // how long the probe result for an IP address is used
+)
+
+// The ports we try to connect to
+var fastestAddrPorts = []int{443, 80}
+
+func newFastestAddrCache() gcache.Cache {
+	return gcache.New(fastestAddrCacheSize).LRU().Expiration(fastestAddrCacheTTL).Clock(clock.Current).Build()
+}
+
+// Connect to the address, returns an error if it isn't reachable
+func dialProbe(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Get the time it takes to connect to the IP address, or -1 if it isn't reachable
+func (s *Server) probeAddr(ip net.IP) time.Duration {
+	val, err := s.fastestAddrCache.Get(ip.String())
+	if err == nil {
+		return val.(time.Duration)
+	}
+
+	type result struct {
+		elapsed time.Duration
+		err     error
+	}
+	ch := make(chan result, len(fastestAddrPorts))
+	for _, port := range fastestAddrPorts {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		go func() {
+			start := time.Now()
+			err := s.dialProbe(addr, fastestAddrProbeTimeout)
+			ch <- result{time.Since(start), err}
+		}()
+	}
+
+	elapsed := time.Duration(-1)
+	for range fastestAddrPorts {
+		r := <-ch
+		if r.err == nil {
+			elapsed = r.elapsed
+			break
+		}
+	}
+	_ = s.fastestAddrCache.Set(ip.String(), elapsed)
+	return elapsed
+}
+
+// Keep only the fastest of the IP addresses in the response
+// Returns the new response, or the same one if none of the addresses is reachable
+// The original response isn't modified, the DNS proxy may have cached it
+func (s *Server) pickFastestAddr(res *dns.Msg) *dns.Msg {
+	ips := map[int]net.IP{} // index in res.Answer -> IP address
+	for i, rr := range res.Answer {
+		switch a := rr.(type) {
+		case *dns.A:
+			ips[i] = a.A
+		case *dns.AAAA:
+			ips[i] = a.AAAA
+		}
+	}
+	if len(ips) < 2 {
+		return res
+	}
+
+	type result struct {
+		index   int
+		elapsed time.Duration
+	}
+	ch := make(chan result, len(ips))
+	for i, ip := range ips {
+		go func(i int, ip net.IP) {
+			ch <- result{i, s.probeAddr(ip)}
+		}(i, ip)
+	}
+	fastest := result{index: -1}
+	for range ips {
+		r := <-ch
+		if r.elapsed >= 0 && (fastest.index == -1 || r.elapsed < fastest.elapsed) {
+			fastest = r
+		}
+	}
+	if fastest.index == -1 {
+		log.Debug("Fastest address: none of %d addresses is reachable", len(ips))
+		return res
+	}
+
+	log.Tracef("Fastest address: %s (%v)", ips[fastest.index], fastest.elapsed)
+	res = res.Copy()
+	answer := []dns.RR{}
+	for i, rr := range res.Answer {
+		if _, ok := ips[i]; !ok || i == fastest.index {
+			answer = append(answer, rr)
+		}
+	}
+	res.Answer = answer
+	return res
+}
@@ -0,0 +1,178 @@
+// SVCB and HTTPS records (RFC 9460)
+// The browsers use HTTPS records to get the IP addresses and the Encrypted Client Hello keys of the servers.
+// The records in the responses are processed so they can't be used to bypass filtering:
+// the target names are checked by the filters, ipv6hint is removed if AAAA requests are disabled
+// and ech is removed if it's configured.
+
+package dnsforward
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// the record types aren't known to miekg/dns, such records are unpacked as RFC3597
+const (
+	typeSVCB  = 64
+	typeHTTPS = 65
+)
+
+var svcbTypeNames = map[uint16]string{typeSVCB: "SVCB", typeHTTPS: "HTTPS"}
+
+// SvcParamKeys
+const (
+	svcParamECH      = 5
+	svcParamIPv6Hint = 6
+)
+
+var svcParamNames = []string{"mandatory", "alpn", "no-default-alpn", "port", "ipv4hint", "ech", "ipv6hint"}
+
+type svcParam struct {
+	key   uint16
+	value []byte
+}
+
+// the data of SVCB or HTTPS record
+type svcbData struct {
+	head   []byte // SvcPriority and TargetName in wire format
+	target string
+	params []svcParam
+}
+
+// Parse the data of SVCB or HTTPS record
+func unpackSVCB(rr *dns.RFC3597) (*svcbData, error) {
+	data, err := hex.DecodeString(rr.Rdata)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 3 {
+		return nil, fmt.Errorf("record is too short")
+	}
+	r := &svcbData{}
+	var off int
+	r.target, off, err = dns.UnpackDomainName(data, 2)
+	if err != nil {
+		return nil, err
+	}
+	r.head = data[:off]
+	for off != len(data) {
+		if len(data)-off < 4 {
+			return nil, fmt.Errorf("bad SvcParam at offset %d", off)
+		}
+		key := binary.BigEndian.Uint16(data[off:])
+		n := int(binary.BigEndian.Uint16(data[off+2:]))
+		off += 4
+		if len(data)-off < n {
+			return nil, fmt.Errorf("bad SvcParam length at offset %d", off)
+		}
+		r.params = append(r.params, svcParam{key: key, value: data[off : off+n]})
+		off += n
+	}
+	return r, nil
+}
+
+// Get the record data in RFC 3597 form
+func (r *svcbData) pack() string {
+	data := append([]byte{}, r.head...)
+	for _, p := range r.params {
+		data = append(data, byte(p.key>>8), byte(p.key), byte(len(p.value)>>8), byte(len(p.value)))
+		data = append(data, p.value...)
+	}
+	return hex.EncodeToString(data)
+}
+
+// Remove the parameters with this key
+// Returns TRUE if anything is removed
+func (r *svcbData) removeParam(key uint16) bool {
+	params := []svcParam{}
+	for _, p := range r.params {
+		if p.key != key {
+			params = append(params, p)
+		}
+	}
+	removed := len(params) != len(r.params)
+	r.params = params
+	return removed
+}
+
+// Get the record data in a short text form for the query log: the priority, the target name and the parameter keys
+func (r *svcbData) String() string {
+	str := fmt.Sprintf("%d %s", binary.BigEndian.Uint16(r.head), r.target)
+	for _, p := range r.params {
+		if int(p.key) < len(svcParamNames) {
+			str += " " + svcParamNames[p.key]
+		} else {
+			str += fmt.Sprintf(" key%d", p.key)
+		}
+	}
+	return str
+}
+
+// Get SVCB and HTTPS records of the response
+func svcbRecords(res *dns.Msg) []*dns.RFC3597 {
+	var rrs []*dns.RFC3597
+	for _, rr := range res.Answer {
+		t := rr.Header().Rrtype
+		if t != typeSVCB && t != typeHTTPS {
+			continue
+		}
+		r, ok := rr.(*dns.RFC3597)
+		if ok {
+			rrs = append(rrs, r)
+		}
+	}
+	return rrs
+}
+
+// Process SVCB and HTTPS records of the response
+// Returns the filtering result if the response is blocked because of a record's target name, otherwise nil
+func (s *Server) filterSVCBRecords(d *proxy.DNSContext) *dnsfilter.Result {
+	if d.Res == nil || len(svcbRecords(d.Res)) == 0 {
+		return nil
+	}
+	clientAddr := GetIPString(d.Addr)
+	removeIPv6Hint := s.aaaaDisabled(clientAddr)
+
+	s.RLock()
+	protectionEnabled := s.conf.ProtectionEnabled
+	dnsFilter := s.dnsFilter
+	s.RUnlock()
+
+	d.Res = d.Res.Copy() // the response may be cached
+	for _, rr := range svcbRecords(d.Res) {
+		r, err := unpackSVCB(rr)
+		if err != nil {
+			log.Debug("Couldn't parse SVCB record of %s: %s", rr.Hdr.Name, err)
+			continue
+		}
+
+		// "." means the owner name which has already been checked
+		target := strings.TrimSuffix(r.target, ".")
+		if protectionEnabled && len(target) != 0 {
+			res, err := dnsFilter.CheckHost(target, rr.Hdr.Rrtype, clientAddr)
+			if err == nil && res.IsFiltered {
+				log.Tracef("SVCB target %s of %s is filtered", target, rr.Hdr.Name)
+				d.Res = s.genDNSFilterMessage(d, &res)
+				return &res
+			}
+		}
+
+		modified := false
+		if removeIPv6Hint && r.removeParam(svcParamIPv6Hint) {
+			modified = true
+		}
+		if s.conf.HTTPSRemoveECH && r.removeParam(svcParamECH) {
+			modified = true
+		}
+		if modified {
+			rr.Rdata = r.pack()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package dnsforward
+
+import (
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+const (
+	staleCacheSize = 10000
+	staleMaxAge    = 24 * time.Hour // stale answers older than that aren't used
+	staleTTL       = 30             // TTL of a stale answer, as recommended by RFC 8767
+)
+
+// The key of the stale answers cache
+func staleKey(req *dns.Msg) string {
+	q := req.Question[0]
+	return strings.ToLower(q.Name) + " " + dns.TypeToString[q.Qtype] + " " + dns.ClassToString[q.Qclass]
+}
+
+// Remember the successful answer, it may be served when the upstream doesn't respond in time
+func (s *Server) storeStale(key string, res *dns.Msg) {
+	if res == nil || res.Rcode != dns.RcodeSuccess || len(res.Answer) == 0 {
+		return
+	}
+	err := s.staleCache.Set(key, res.Copy())
+	if err != nil {
+		log.Debug("Couldn't store the stale answer: %s", err)
+	}
+}
+
+// Get the previous answer for the request
+func (s *Server) getStale(key string, req *dns.Msg) *dns.Msg {
+	val, err := s.staleCache.Get(key)
+	if err != nil {
+		return nil
+	}
+	res := val.(*dns.Msg).Copy()
+	res.Id = req.Id
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = staleTTL
+			}
+		}
+	}
+	return res
+}
+
+// Get the latency budget for the client, 0 means no limit
+func (s *Server) latencyBudget(d *proxy.DNSContext) time.Duration {
+	budget := s.conf.LatencyBudget
+	if s.conf.LatencyBudgetHandler != nil {
+		b := s.conf.LatencyBudgetHandler(GetIPString(d.Addr))
+		if b != 0 {
+			budget = b
+		}
+	}
+	return time.Duration(budget) * time.Millisecond
+}
+
+// resolve sends the request to the upstream servers
+// If there's no response within the latency budget,
+// the client gets the stale answer or SERVFAIL right away, so it doesn't wait for its own timeout.
+func (s *Server) resolve(p *proxy.Proxy, d *proxy.DNSContext) error {
+	budget := s.latencyBudget(d)
+	if budget == 0 || len(d.Req.Question) != 1 {
+		return s.exchange(p, d)
+	}
+
+	// the clients with their own upstream servers don't share the stale answers with the others
+	key := staleKey(d.Req) + s.upstreamsKey(d)
+
+	// the request keeps being processed after the budget is exceeded,
+	// so it mustn't use the client's context
+	rd := *d
+	rd.Req = d.Req.Copy()
+	done := make(chan error, 1)
+	go func() {
+		err := s.exchange(p, &rd)
+		if err == nil {
+			s.storeStale(key, rd.Res)
+		}
+		done <- err
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		d.Res = rd.Res
+		d.Upstream = rd.Upstream
+		return err
+	case <-timer.C:
+	}
+
+	host := d.Req.Question[0].Name
+	d.Res = s.getStale(key, d.Req)
+	if d.Res != nil {
+		log.Debug("No response for %s within %v, serving the stale answer", host, budget)
+		return nil
+	}
+	log.Debug("No response for %s within %v, sending SERVFAIL", host, budget)
+	d.Res = new(dns.Msg)
+	d.Res.SetRcode(d.Req, dns.RcodeServerFailure)
+	return nil
+}
@@ -0,0 +1,82 @@
+package dnsforward
+
+import (
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// Listener names
+const (
+	ListenerUDP  = "udp"
+	ListenerTCP  = "tcp"
+	ListenerTLS  = "tls"
+	ListenerQUIC = "quic"
+)
+
+// Disable the listeners which are turned off in the configuration
+func disableListeners(c *proxy.Config, disabled []string) {
+	for _, l := range disabled {
+		switch l {
+		case ListenerUDP:
+			c.UDPListenAddr = nil
+		case ListenerTCP:
+			c.TCPListenAddr = nil
+		case ListenerTLS:
+			c.TLSListenAddr = nil
+		}
+	}
+}
+
+// Check that the listen addresses can be bound
+// A listener that can't be started is disabled, so the other listeners still work
+// Returns the bind errors: listener name -> error
+func probeListeners(c *proxy.Config) map[string]string {
+	errs := map[string]string{}
+	if c.UDPListenAddr != nil {
+		conn, err := net.ListenUDP("udp", c.UDPListenAddr)
+		if err == nil {
+			err = conn.Close()
+		}
+		if err != nil {
+			errs[ListenerUDP] = err.Error()
+			c.UDPListenAddr = nil
+		}
+	}
+	if c.TCPListenAddr != nil {
+		ln, err := net.ListenTCP("tcp", c.TCPListenAddr)
+		if err == nil {
+			err = ln.Close()
+		}
+		if err != nil {
+			errs[ListenerTCP] = err.Error()
+			c.TCPListenAddr = nil
+		}
+	}
+	if c.TLSListenAddr != nil {
+		ln, err := net.ListenTCP("tcp", c.TLSListenAddr)
+		if err == nil {
+			err = ln.Close()
+		}
+		if err != nil {
+			errs[ListenerTLS] = err.Error()
+			c.TLSListenAddr = nil
+		}
+	}
+
+	for l, e := range errs {
+		log.Error("Couldn't start %s listener: %s", l, e)
+	}
+	return errs
+}
+
+// ListenerErrors returns the reasons why the listeners couldn't be started: listener name -> error
+func (s *Server) ListenerErrors() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	errs := map[string]string{}
+	for l, e := range s.listenerErrors {
+		errs[l] = e
+	}
+	return errs
+}
@@ -0,0 +1,80 @@
+// Reverse lookups of private addresses
+// PTR requests for the addresses from the private ranges are never sent to the public upstream servers:
+// they're sent to the local resolvers (e.g. the router), or answered with NXDOMAIN if there are none.
+
+package dnsforward
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// Get the IP address from the reverse lookup name, or nil if it isn't a full address
+// "4.3.2.1.in-addr.arpa." -> 1.2.3.4
+func ipFromReverseName(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(n)
+		}
+		return ip
+
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return nil
+			}
+			// the nibbles are in reverse order
+			j := 2*net.IPv6len - 1 - i
+			ip[j/2] |= byte(n) << uint(4*(1-j%2))
+		}
+		return ip
+	}
+	return nil
+}
+
+// Return TRUE if the request is a reverse lookup of a private address
+func isPrivatePTR(req *dns.Msg) bool {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypePTR {
+		return false
+	}
+	ip := ipFromReverseName(req.Question[0].Name)
+	return ip != nil && !IsPublicIP(ip)
+}
+
+// Send the reverse lookup of a private address to the local resolvers
+func (s *Server) resolvePrivatePTR(d *proxy.DNSContext) error {
+	if len(s.conf.LocalPTRUpstreams) == 0 {
+		d.Res = s.genNXDomain(d.Req)
+		return nil
+	}
+	res, u, err := upstream.ExchangeParallel(s.conf.LocalPTRUpstreams, d.Req)
+	if err != nil {
+		log.Debug("Local resolvers couldn't resolve %s: %s", d.Req.Question[0].Name, err)
+		return err
+	}
+	d.Res = res
+	d.Upstream = u
+	return nil
+}
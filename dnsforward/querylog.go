@@ -7,10 +7,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
 
@@ -25,25 +25,48 @@ const (
 
 // queryLog is a structure that writes and reads the DNS query log
 type queryLog struct {
+	dropped uint64 // the entries which weren't written because the writer didn't keep up (accessed atomically, must be 64-bit aligned)
+
 	logFile    string  // path to the log file
 	runningTop *dayTop // current top charts
 
+	writeQueue    chan *logEntry // the entries waiting for the writer
+	flushRequests chan chan error
+	stopWriter    chan bool
+
 	logBufferLock sync.RWMutex
 	logBuffer     []*logEntry
 	fileFlushLock sync.Mutex // synchronize a file-flushing goroutine and main thread
-	flushPending  bool       // don't start another goroutine while the previous one is still running
 
 	queryLogCache []*logEntry
 	queryLogLock  sync.RWMutex
+
+	retentionLock sync.Mutex
+	maxAge        time.Duration // the older files are removed (0: default)
+	maxBytes      int64         // the oldest files are removed if all files are larger (0: no limit)
+	compress      bool          // the rotated files are compressed
+	compressLock  sync.Mutex    // only one goroutine compresses the files
+
+	anonymizeLock sync.Mutex
+	anonymizeMode string    // how the client IP addresses are stored
+	salt          []byte    // the salt of the hashed addresses
+	saltTime      time.Time // when the salt was generated
+
+	subscribersLock sync.RWMutex
+	subscribers     map[*queryLogSubscriber]bool // the live tails of the query log
 }
 
 // newQueryLog creates a new instance of the query log
 func newQueryLog(baseDir string) *queryLog {
 	l := &queryLog{
-		logFile:    filepath.Join(baseDir, queryLogFileName),
-		runningTop: &dayTop{},
+		logFile:       filepath.Join(baseDir, queryLogFileName),
+		runningTop:    &dayTop{},
+		writeQueue:    make(chan *logEntry, queryLogWriteQueueSize),
+		flushRequests: make(chan chan error),
+		stopWriter:    make(chan bool),
 	}
 	l.runningTop.init()
+	go l.writer()
 	return l
 }
 
@@ -55,13 +78,21 @@ type logEntry struct {
 	Elapsed  time.Duration
 	IP       string
 	Upstream string `json:",omitempty"` // if empty, means it was cached
+	Proto    string `json:",omitempty"` // transport protocol: udp, tcp, tls, https or quic
+	DNSSEC   string `json:",omitempty"` // DNSSEC validation status: secure, insecure or bogus
+	Cached   bool   `json:",omitempty"` // the response is from the DNS cache
+	ClientID string `json:",omitempty"` // the ID the client presented via DNS-over-HTTPS path or DNS-over-TLS server name
+
+	AAAADisabled bool `json:",omitempty"` // empty answer to AAAA request (AAAA requests are disabled)
+
+	UpstreamElapsed time.Duration `json:",omitempty"` // the time of the exchange with the upstream servers, including the retries
 }
 
-func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfilter.Result, elapsed time.Duration, addr net.Addr, upstream string) *logEntry {
+func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfilter.Result, elapsed time.Duration, addr net.Addr, proto string, upstream string, upstreamElapsed time.Duration, dnssec string, cached bool, aaaaDisabled bool, clientID string) *logEntry {
 	var q []byte
 	var a []byte
 	var err error
-	ip := GetIPString(addr)
+	ip := l.anonymize(GetIPString(addr))
 
 	if question != nil {
 		q, err = question.Pack()
@@ -92,18 +123,23 @@ func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfil
 		Elapsed:  elapsed,
 		IP:       ip,
 		Upstream: upstream,
+		Proto:    proto,
+		DNSSEC:   dnssec,
+		Cached:   cached,
+		ClientID: clientID,
+
+		AAAADisabled: aaaaDisabled,
+
+		UpstreamElapsed: upstreamElapsed,
 	}
 
-	l.logBufferLock.Lock()
-	l.logBuffer = append(l.logBuffer, &entry)
-	needFlush := false
-	if !l.flushPending {
-		needFlush = len(l.logBuffer) >= logBufferCap
-		if needFlush {
-			l.flushPending = true
-		}
+	// the DNS request mustn't wait for the disk
+	select {
+	case l.writeQueue <- &entry:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
 	}
-	l.logBufferLock.Unlock()
+
 	l.queryLogLock.Lock()
 	l.queryLogCache = append(l.queryLogCache, &entry)
 	if len(l.queryLogCache) > queryLogSize {
@@ -112,6 +148,8 @@ func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfil
 	}
 	l.queryLogLock.Unlock()
 
+	l.publish(&entry)
+
 	// add it to running top
 	err = l.runningTop.addEntry(&entry, question, now)
 	if err != nil {
@@ -119,13 +157,6 @@ func (l *queryLog) logRequest(question *dns.Msg, answer *dns.Msg, result *dnsfil
 		// don't do failure, just log
 	}
 
-	// if buffer needs to be flushed to disk, do it now
-	if needFlush {
-		// write to file
-		// do it in separate goroutine -- we are stalling DNS response this whole time
-		go l.flushLogBuffer(false) // nolint
-	}
-
 	return &entry
 }
 
@@ -141,70 +172,120 @@ func (l *queryLog) getQueryLog() []map[string]interface{} {
 		values[left], values[right] = values[right], values[left]
 	}
 
-	// iterate
+	return logEntriesToJSON(values)
+}
+
+// logEntriesToJSON converts log entries to a JSON-ready form, the order is preserved
+func logEntriesToJSON(values []*logEntry) []map[string]interface{} {
 	var data = []map[string]interface{}{}
 	for _, entry := range values {
-		var q *dns.Msg
-		var a *dns.Msg
-
-		if len(entry.Question) > 0 {
-			q = new(dns.Msg)
-			if err := q.Unpack(entry.Question); err != nil {
-				// ignore, log and move on
-				log.Printf("Failed to unpack dns message question: %s", err)
-				q = nil
-			}
-		}
-		if len(entry.Answer) > 0 {
-			a = new(dns.Msg)
-			if err := a.Unpack(entry.Answer); err != nil {
-				// ignore, log and move on
-				log.Printf("Failed to unpack dns message question: %s", err)
-				a = nil
-			}
-		}
+		data = append(data, logEntryToJSON(entry))
+	}
+
+	return data
+}
+
+// logEntryToJSON converts the log entry to a JSON-ready form
+func logEntryToJSON(entry *logEntry) map[string]interface{} {
+	var q *dns.Msg
+	var a *dns.Msg
 
-		jsonEntry := map[string]interface{}{
-			"reason":    entry.Result.Reason.String(),
-			"elapsedMs": strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
-			"time":      entry.Time.Format(time.RFC3339),
-			"client":    entry.IP,
+	if len(entry.Question) > 0 {
+		q = new(dns.Msg)
+		if err := q.Unpack(entry.Question); err != nil {
+			// ignore, log and move on
+			log.Printf("Failed to unpack dns message question: %s", err)
+			q = nil
 		}
-		if q != nil {
-			jsonEntry["question"] = map[string]interface{}{
-				"host":  strings.ToLower(strings.TrimSuffix(q.Question[0].Name, ".")),
-				"type":  dns.Type(q.Question[0].Qtype).String(),
-				"class": dns.Class(q.Question[0].Qclass).String(),
-			}
+	}
+	if len(entry.Answer) > 0 {
+		a = new(dns.Msg)
+		if err := a.Unpack(entry.Answer); err != nil {
+			// ignore, log and move on
+			log.Printf("Failed to unpack dns message question: %s", err)
+			a = nil
 		}
+	}
 
-		if a != nil {
-			jsonEntry["status"] = dns.RcodeToString[a.Rcode]
-		}
-		if len(entry.Result.Rule) > 0 {
-			jsonEntry["rule"] = entry.Result.Rule
-			jsonEntry["filterId"] = entry.Result.FilterID
+	jsonEntry := map[string]interface{}{
+		"reason":    entry.Result.Reason.String(),
+		"elapsedMs": strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
+		"time":      entry.Time.Format(time.RFC3339Nano), // also the cursor of the next page
+		"client":    entry.IP,
+	}
+	if len(entry.ClientID) != 0 {
+		jsonEntry["client_id"] = entry.ClientID
+	}
+	if q != nil {
+		jsonEntry["question"] = map[string]interface{}{
+			"host":  strings.ToLower(strings.TrimSuffix(q.Question[0].Name, ".")),
+			"type":  dns.Type(q.Question[0].Qtype).String(),
+			"class": dns.Class(q.Question[0].Qclass).String(),
 		}
+	}
 
-		answers := answerToMap(a)
-		if answers != nil {
-			jsonEntry["answer"] = answers
+	if a != nil {
+		jsonEntry["status"] = dns.RcodeToString[a.Rcode]
+	}
+	if len(entry.Result.Rule) > 0 {
+		jsonEntry["rule"] = entry.Result.Rule
+		jsonEntry["filterId"] = entry.Result.FilterID
+		if len(entry.Result.OtherFilterIDs) != 0 {
+			jsonEntry["otherFilterIds"] = entry.Result.OtherFilterIDs
 		}
+	}
+	if len(entry.Result.ServiceName) != 0 {
+		jsonEntry["service_name"] = entry.Result.ServiceName
+	}
+	if len(entry.Result.Category) != 0 {
+		jsonEntry["category"] = entry.Result.Category
+	}
+	if len(entry.DNSSEC) != 0 {
+		jsonEntry["dnssec"] = entry.DNSSEC
+	}
+	jsonEntry["cached"] = entry.Cached
+	if len(entry.Upstream) != 0 {
+		jsonEntry["upstream"] = entry.Upstream
+		jsonEntry["upstream_elapsed_ms"] = strconv.FormatFloat(entry.UpstreamElapsed.Seconds()*1000, 'f', -1, 64)
+	}
+	if len(entry.Proto) != 0 {
+		jsonEntry["proto"] = entry.Proto
+	}
+	if entry.AAAADisabled {
+		jsonEntry["aaaa_disabled"] = true
+	}
 
-		data = append(data, jsonEntry)
+	answers := answerToMap(a)
+	if answers != nil {
+		jsonEntry["answer"] = answers
+	}
+	if a != nil {
+		if authority := rrsToMap(a.Ns); authority != nil {
+			jsonEntry["authority"] = authority
+		}
+		if additional := rrsToMap(a.Extra); additional != nil {
+			jsonEntry["additional"] = additional
+		}
 	}
 
-	return data
+	return jsonEntry
 }
 
 func answerToMap(a *dns.Msg) []map[string]interface{} {
-	if a == nil || len(a.Answer) == 0 {
+	if a == nil {
 		return nil
 	}
+	return rrsToMap(a.Answer)
+}
 
+// rrsToMap converts the resource records to a JSON-ready form, OPT pseudo-record is skipped
+func rrsToMap(rrs []dns.RR) []map[string]interface{} {
 	var answers = []map[string]interface{}{}
-	for _, k := range a.Answer {
+	for _, k := range rrs {
 		header := k.Header()
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
 		answer := map[string]interface{}{
 			"type": dns.TypeToString[header.Rrtype],
 			"ttl":  header.Ttl,
@@ -231,6 +312,13 @@ func answerToMap(a *dns.Msg) []map[string]interface{} {
 			answer["value"] = fmt.Sprintf("%v %v %v %v %v %v %v", v.Ns, v.Mbox, v.Serial, v.Refresh, v.Retry, v.Expire, v.Minttl)
 		case *dns.CAA:
 			answer["value"] = fmt.Sprintf("%v %v \"%v\"", v.Flag, v.Tag, v.Value)
+		case *dns.RFC3597:
+			if name, ok := svcbTypeNames[header.Rrtype]; ok {
+				answer["type"] = name
+				if r, err := unpackSVCB(v); err == nil {
+					answer["value"] = r.String()
+				}
+			}
 		case *dns.HINFO:
 			answer["value"] = fmt.Sprintf("\"%v\" \"%v\"", v.Cpu, v.Os)
 		case *dns.RRSIG:
@@ -242,5 +330,8 @@ func answerToMap(a *dns.Msg) []map[string]interface{} {
 		answers = append(answers, answer)
 	}
 
+	if len(answers) == 0 {
+		return nil
+	}
 	return answers
 }
@@ -0,0 +1,88 @@
+// Anonymization of the client IP addresses in the query log
+// The addresses are changed before the entry is written anywhere:
+// to the query log files, the SQLite database, the top clients and the API responses.
+// The hashed addresses of a client are the same during a day, so its requests can be still grouped,
+// but the salt is random and never stored, so the addresses can't be recovered from the hashes later.
+
+package dnsforward
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The query log anonymization modes
+const (
+	QueryLogAnonymizeNone     = ""         // the client IP addresses are stored as is
+	QueryLogAnonymizeTruncate = "truncate" // only the network is stored: /24 for IPv4, /64 for IPv6
+	QueryLogAnonymizeHash     = "hash"     // the addresses are hashed with a salt which is changed daily
+	QueryLogAnonymizeDrop     = "drop"     // the addresses aren't stored
+)
+
+const queryLogSaltPeriod = 24 * time.Hour
+
+// CheckQueryLogAnonymize checks the query log anonymization mode
+func CheckQueryLogAnonymize(mode string) error {
+	switch mode {
+	case QueryLogAnonymizeNone, QueryLogAnonymizeTruncate, QueryLogAnonymizeHash, QueryLogAnonymizeDrop:
+		return nil
+	}
+	return fmt.Errorf("invalid query log anonymization mode: %s", mode)
+}
+
+// Set the anonymization mode of the new entries
+func (l *queryLog) setAnonymize(mode string) {
+	l.anonymizeLock.Lock()
+	if mode != l.anonymizeMode {
+		l.salt = nil
+	}
+	l.anonymizeMode = mode
+	l.anonymizeLock.Unlock()
+}
+
+// Get the client IP address to store in the query log
+func (l *queryLog) anonymize(ip string) string {
+	l.anonymizeLock.Lock()
+	defer l.anonymizeLock.Unlock()
+
+	switch l.anonymizeMode {
+	case QueryLogAnonymizeTruncate:
+		return truncateIP(ip)
+
+	case QueryLogAnonymizeHash:
+		now := time.Now()
+		if l.salt == nil || now.Sub(l.saltTime) >= queryLogSaltPeriod {
+			salt := make([]byte, 32)
+			_, err := rand.Read(salt)
+			if err != nil {
+				return "" // don't store the address if it can't be hashed
+			}
+			l.salt = salt
+			l.saltTime = now
+		}
+		mac := hmac.New(sha256.New, l.salt)
+		_, _ = mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+
+	case QueryLogAnonymizeDrop:
+		return ""
+	}
+	return ip
+}
+
+// Clear the host bits of the IP address: 1.2.3.4 -> 1.2.3.0, 2001:db8:1:2:3:4:5:6 -> 2001:db8:1:2::
+func truncateIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
@@ -0,0 +1,190 @@
+// Query log clearing
+// The entries of a client or a time range (or all entries) are removed from the query log files,
+// the database and the recent entries in memory. The files are rewritten without the removed entries.
+
+package dnsforward
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// QueryLogClearFilter selects the entries which are removed from the query log
+// The empty fields match all entries
+type QueryLogClearFilter struct {
+	Client string    // client IP address
+	Start  time.Time // the oldest entry
+	End    time.Time // the newest entry
+}
+
+// match returns TRUE if the entry is selected by the filter
+func (f *QueryLogClearFilter) match(entry *logEntry) bool {
+	return (len(f.Client) == 0 || entry.IP == f.Client) &&
+		(f.Start.IsZero() || !entry.Time.Before(f.Start)) &&
+		(f.End.IsZero() || !entry.Time.After(f.End))
+}
+
+// clear removes the entries selected by the filter, returns the number of the removed entries
+func (l *queryLog) clear(f *QueryLogClearFilter) (int, error) {
+	// the queued entries must be removed too
+	err := l.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	l.queryLogLock.Lock()
+	cache := []*logEntry{}
+	for _, entry := range l.queryLogCache {
+		if !f.match(entry) {
+			cache = append(cache, entry)
+		}
+	}
+	l.queryLogCache = cache
+	l.queryLogLock.Unlock()
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+	removed := 0
+	for _, s := range l.segments() {
+		n, err := clearSegment(s.path, f)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// Rewrite the query log file without the entries selected by the filter
+// The file is removed if no entries are left. The modification time is kept.
+func clearSegment(path string, f *QueryLogClearFilter) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	src, err := openSegment(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	tmp := path + ".clear.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	var w io.Writer = dst
+	var zw *gzip.Writer
+	if enableGzip || strings.HasSuffix(path, gzipSuffix) {
+		zw = gzip.NewWriter(dst)
+		w = zw
+	}
+
+	removed := 0
+	kept := 0
+	d := json.NewDecoder(src)
+	e := json.NewEncoder(w)
+	for d.More() {
+		var entry logEntry
+		err = d.Decode(&entry)
+		if err != nil {
+			log.Error("Failed to decode %s: %s", path, err)
+			err = nil
+			break // the rest of the file can't be decoded, it's dropped
+		}
+		if f.match(&entry) {
+			removed++
+			continue
+		}
+		err = e.Encode(&entry)
+		if err != nil {
+			break
+		}
+		kept++
+	}
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	cerr := dst.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil || removed == 0 {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+
+	if kept == 0 {
+		_ = os.Remove(tmp)
+		return removed, os.Remove(path)
+	}
+	err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+	return removed, nil
+}
+
+// clear removes the entries selected by the filter from the database
+func (q *queryLogDB) clear(f *QueryLogClearFilter) error {
+	err := q.flush()
+	if err != nil {
+		return err
+	}
+
+	where := []string{}
+	args := []interface{}{}
+	if len(f.Client) != 0 {
+		where = append(where, "client = ?")
+		args = append(args, f.Client)
+	}
+	if !f.Start.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, f.Start.UnixNano())
+	}
+	if !f.End.IsZero() {
+		where = append(where, "time <= ?")
+		args = append(args, f.End.UnixNano())
+	}
+	query := "DELETE FROM querylog"
+	if len(where) != 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	_, err = q.db.Exec(query, args...)
+	return err
+}
+
+// ClearQueryLog removes the entries selected by the filter from the query log
+// Returns the number of the entries removed from the query log files
+func (s *Server) ClearQueryLog(f QueryLogClearFilter) (int, error) {
+	s.RLock()
+	db := s.queryLogDB
+	l := s.queryLog
+	s.RUnlock()
+
+	if net.ParseIP(f.Client) != nil {
+		f.Client = l.anonymize(f.Client)
+	}
+
+	removed, err := l.clear(&f)
+	if err != nil {
+		return removed, err
+	}
+	if db != nil {
+		err = db.clear(&f)
+	}
+	log.Info("Query log: removed %d entries (client:%q start:%v end:%v)", removed, f.Client, f.Start, f.End)
+	return removed, err
+}
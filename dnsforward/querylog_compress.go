@@ -0,0 +1,146 @@
+// Compression of the rotated query log files
+// The current file is appended to, so it's never compressed.
+// The rotated files are compressed with gzip in background: querylog.json.1 becomes querylog.json.1.gz.
+// The readers check the file name, so the compressed and the plain files may be mixed,
+// e.g. after the compression is enabled or disabled.
+
+package dnsforward
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+const gzipSuffix = ".gz"
+
+// Set whether the rotated files are compressed
+func (l *queryLog) setCompress(compress bool) {
+	l.retentionLock.Lock()
+	l.compress = compress
+	l.retentionLock.Unlock()
+	if compress {
+		go l.compressSegments()
+	}
+}
+
+func (l *queryLog) getCompress() bool {
+	l.retentionLock.Lock()
+	defer l.retentionLock.Unlock()
+	return l.compress
+}
+
+// Open the query log file for reading, the compressed file is decompressed
+func openSegment(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !enableGzip && !strings.HasSuffix(path, gzipSuffix) {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{Reader: zr, f: f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (z *gzipFile) Close() error {
+	_ = z.Reader.Close()
+	return z.f.Close()
+}
+
+// Compress all rotated files which aren't compressed yet
+func (l *queryLog) compressSegments() {
+	l.compressLock.Lock()
+	defer l.compressLock.Unlock()
+
+	fileWriteLock.Lock()
+	segments := l.segments()
+	fileWriteLock.Unlock()
+
+	for _, s := range segments {
+		if s.index == 0 || strings.HasSuffix(s.path, gzipSuffix) {
+			continue
+		}
+		if !l.getCompress() {
+			return
+		}
+		err := l.compressSegment(s.path)
+		if err != nil {
+			log.Error("querylog: failed to compress %s: %s", s.path, err)
+		}
+	}
+}
+
+// Compress the rotated file
+// The file isn't locked while it's compressed, so it may be renamed or removed meanwhile:
+// the compressed file replaces the original one wherever it's now.
+func (l *queryLog) compressSegment(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := l.logFile + ".compress.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	cerr := dst.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// the retention and the search depend on the modification time
+		err = os.Chtimes(tmp, srcInfo.ModTime(), srcInfo.ModTime())
+	}
+	var dstInfo os.FileInfo
+	if err == nil {
+		dstInfo, err = os.Stat(tmp)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+	for _, s := range l.segments() {
+		fi, err := os.Stat(s.path)
+		if err != nil || !os.SameFile(fi, srcInfo) {
+			continue
+		}
+		err = os.Rename(tmp, s.path+gzipSuffix)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		log.Debug("querylog: compressed %s: %d -> %d bytes", s.path, srcInfo.Size(), dstInfo.Size())
+		return os.Remove(s.path)
+	}
+
+	// the file has been removed
+	return os.Remove(tmp)
+}
@@ -0,0 +1,122 @@
+// Query log export
+// All entries selected by the search filter are passed one by one, oldest first,
+// so a large export doesn't need the memory for the whole result.
+// The entries are read from the database if it's enabled, otherwise from the query log files.
+
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+)
+
+// export passes the entries selected by the filter to onEntry, oldest first
+// The search limit is ignored.
+func (q *queryLogDB) export(f *QueryLogSearch, onEntry func(entry *logEntry) error) error {
+	err := q.flush()
+	if err != nil {
+		log.Error("querylog db: write failed: %s", err)
+	}
+
+	where, args := f.where()
+	rows, err := q.db.Query("SELECT entry FROM querylog"+where+" ORDER BY time ASC", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return err
+		}
+		entry := &logEntry{}
+		err = json.Unmarshal(data, entry)
+		if err != nil {
+			log.Debug("querylog db: %s", err)
+			continue
+		}
+		err = onEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// export passes the entries of the query log files selected by the filter to onEntry, oldest first
+// The search limit is ignored.
+func (l *queryLog) export(f *QueryLogSearch, onEntry func(entry *logEntry) error) error {
+	// the recent entries must be exported too
+	err := l.flush()
+	if err != nil {
+		return err
+	}
+
+	fileWriteLock.Lock()
+	segments := l.segments()
+	fileWriteLock.Unlock()
+
+	onMatch := func(entry *logEntry) error {
+		host, qtype, status := entryQuestion(entry)
+		if !f.match(entry, host, qtype, status) {
+			return nil
+		}
+		return onEntry(entry)
+	}
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		err = exportFile(segments[i].path, onMatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pass all entries of the query log file to onEntry
+func exportFile(path string, onEntry func(entry *logEntry) error) error {
+	f, err := openSegment(path)
+	if err != nil {
+		log.Error("Failed to open file \"%s\": %s", path, err)
+		return nil // the file is removed by the retention policy
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(f)
+	for d.More() {
+		var entry logEntry
+		err = d.Decode(&entry)
+		if err != nil {
+			log.Error("Failed to decode %s: %s", path, err)
+			return nil // the rest of the file can't be decoded
+		}
+		err = onEntry(&entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportQueryLog passes all query log entries selected by the filter to onEntry, oldest first, ready to be converted to a JSON
+// If onEntry returns an error, the export is stopped and the error is returned.
+func (s *Server) ExportQueryLog(f QueryLogSearch, onEntry func(entry map[string]interface{}) error) error {
+	s.RLock()
+	db := s.queryLogDB
+	l := s.queryLog
+	s.RUnlock()
+
+	if net.ParseIP(f.Client) != nil {
+		f.Client = l.anonymize(f.Client)
+	}
+
+	onLogEntry := func(entry *logEntry) error {
+		return onEntry(logEntryToJSON(entry))
+	}
+	if db != nil {
+		return db.export(&f, onLogEntry)
+	}
+	return l.export(&f, onLogEntry)
+}
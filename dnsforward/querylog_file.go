@@ -6,10 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/go-test/deep"
 )
 
@@ -33,13 +33,17 @@ func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	}
 	flushBuffer := l.logBuffer
 	l.logBuffer = nil
-	l.flushPending = false
 	l.logBufferLock.Unlock()
 	err := l.flushToFile(flushBuffer)
 	if err != nil {
 		log.Error("Saving querylog to file failed: %s", err)
 		return err
 	}
+	err = l.rotateIfLarge()
+	if err != nil {
+		log.Error("Failed to rotate querylog: %s", err)
+	}
+	l.enforceRetention()
 	return nil
 }
 
@@ -111,6 +115,13 @@ func (l *queryLog) flushToFile(buffer []*logEntry) error {
 		return err
 	}
 
+	// one sync per batch
+	err = f.Sync()
+	if err != nil {
+		log.Error("Couldn't sync file: %s", err)
+		return err
+	}
+
 	log.Debug("ok \"%s\": %v bytes written", filename, n)
 
 	return nil
@@ -144,28 +155,34 @@ func checkBuffer(buffer []*logEntry, b bytes.Buffer) error {
 	return nil
 }
 
+// rotateQueryLog renames the current file to .1, .1 to .2 and so on
 func (l *queryLog) rotateQueryLog() error {
-	from := l.logFile
-	to := l.logFile + ".1"
-
-	if enableGzip {
-		from = l.logFile + ".gz"
-		to = l.logFile + ".gz.1"
-	}
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
 
-	if _, err := os.Stat(from); os.IsNotExist(err) {
+	if _, err := os.Stat(l.segmentPath(0)); os.IsNotExist(err) {
 		// do nothing, file doesn't exist
 		return nil
 	}
 
-	err := os.Rename(from, to)
-	if err != nil {
-		log.Error("Failed to rename querylog: %s", err)
-		return err
+	segments := l.segments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		from := segments[i].path
+		to := l.segmentPath(segments[i].index + 1)
+		if strings.HasSuffix(from, gzipSuffix) {
+			to += gzipSuffix
+		}
+		err := os.Rename(from, to)
+		if err != nil {
+			log.Error("Failed to rename querylog: %s", err)
+			return err
+		}
+		log.Debug("Rotated from %s to %s successfully", from, to)
 	}
 
-	log.Debug("Rotated from %s to %s successfully", from, to)
-
+	if l.getCompress() {
+		go l.compressSegments()
+	}
 	return nil
 }
 
@@ -176,37 +193,28 @@ func (l *queryLog) periodicQueryLogRotate() {
 			log.Error("Failed to rotate querylog: %s", err)
 			// do nothing, continue rotating
 		}
+		l.enforceRetention()
 	}
 }
 
 func (l *queryLog) genericLoader(onEntry func(entry *logEntry) error, needMore func() bool, timeWindow time.Duration) error {
 	now := time.Now()
 	// read from querylog files, try newest file first
-	var files []string
-
-	if enableGzip {
-		files = []string{
-			l.logFile + ".gz",
-			l.logFile + ".gz.1",
-		}
-	} else {
-		files = []string{
-			l.logFile,
-			l.logFile + ".1",
-		}
-	}
+	fileWriteLock.Lock()
+	segments := l.segments()
+	fileWriteLock.Unlock()
 
-	// read from all files
-	for _, file := range files {
+	for _, segment := range segments {
 		if !needMore() {
 			break
 		}
-		if _, err := os.Stat(file); os.IsNotExist(err) {
-			// do nothing, file doesn't exist
-			continue
+		if now.Sub(segment.modified) > timeWindow {
+			// all entries of this file and the older ones are outside of the time window
+			break
 		}
+		file := segment.path
 
-		f, err := os.Open(file)
+		f, err := openSegment(file)
 		if err != nil {
 			log.Error("Failed to open file \"%s\": %s", file, err)
 			// try next file
@@ -214,19 +222,7 @@ func (l *queryLog) genericLoader(onEntry func(entry *logEntry) error, needMore f
 		}
 		defer f.Close()
 
-		var d *json.Decoder
-
-		if enableGzip {
-			zr, err := gzip.NewReader(f)
-			if err != nil {
-				log.Error("Failed to create gzip reader: %s", err)
-				continue
-			}
-			defer zr.Close()
-			d = json.NewDecoder(zr)
-		} else {
-			d = json.NewDecoder(f)
-		}
+		d := json.NewDecoder(f)
 
 		i := 0
 		over := 0
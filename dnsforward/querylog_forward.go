@@ -0,0 +1,268 @@
+// Query log forwarding
+// The query log entries are sent to a remote collector, so the DNS events can be processed
+// by the existing log infrastructure:
+//  udp://host:514, tcp://host:514, tls://host:6514 - syslog (RFC 5424), the message is the entry in JSON format
+//  http://host/path, https://host/path - the entries are POSTed in batches in JSON Lines format
+// The DNS requests never wait for the collector: if it doesn't keep up or isn't available, the entries are dropped.
+
+package dnsforward
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queryLogForwardQueueSize = 1024             // the new entries are dropped if the queue is full
+	queryLogForwardBatch     = 100              // max number of entries in one HTTP request
+	queryLogForwardPeriod    = time.Second      // the batched entries are sent at least this often
+	queryLogForwardTimeout   = 5 * time.Second  // connection and write timeout
+	queryLogForwardRetry     = 10 * time.Second // the entries are dropped for this time after a connection failure
+
+	queryLogSyslogPriority = 16*8 + 6 // facility: local0, severity: informational
+	queryLogSyslogSDID     = "query@32473"
+)
+
+type queryLogForwarder struct {
+	dropped uint64 // the entries which weren't sent (accessed atomically, must be 64-bit aligned)
+
+	url      *url.URL
+	hostname string
+	queue    chan *logEntry
+	stop     chan bool
+	done     chan bool
+
+	// used only by the sender goroutine
+	conn      net.Conn     // syslog connection
+	client    *http.Client // HTTP collector client
+	failed    bool         // the last attempt has failed
+	retryTime time.Time    // don't connect until this time
+}
+
+// Check the URL of the query log collector
+func parseQueryLogForward(addr string) (*url.URL, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("querylog_forward: %s", err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		if _, _, err = net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("querylog_forward: %s: %s", addr, err)
+		}
+	case "http", "https":
+		if len(u.Host) == 0 {
+			return nil, fmt.Errorf("querylog_forward: %s: no host", addr)
+		}
+	default:
+		return nil, fmt.Errorf("querylog_forward: %s: the scheme must be udp, tcp, tls, http or https", addr)
+	}
+	return u, nil
+}
+
+// Create the forwarder and start sending the entries
+func newQueryLogForwarder(addr string) (*queryLogForwarder, error) {
+	u, err := parseQueryLogForward(addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	if len(hostname) == 0 {
+		hostname = "-"
+	}
+	f := &queryLogForwarder{
+		url:      u,
+		hostname: hostname,
+		queue:    make(chan *logEntry, queryLogForwardQueueSize),
+		stop:     make(chan bool),
+		done:     make(chan bool),
+		client:   &http.Client{Timeout: queryLogForwardTimeout},
+	}
+	go f.sender()
+	return f, nil
+}
+
+// Queue the entry
+func (f *queryLogForwarder) add(entry *logEntry) {
+	select {
+	case f.queue <- entry:
+	default:
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+// Send the queued entries and stop
+func (f *queryLogForwarder) close() {
+	close(f.stop)
+	<-f.done
+}
+
+// Get the number of entries which weren't sent
+func (f *queryLogForwarder) droppedEntries() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+func (f *queryLogForwarder) isHTTP() bool {
+	return f.url.Scheme == "http" || f.url.Scheme == "https"
+}
+
+func (f *queryLogForwarder) sender() {
+	defer close(f.done)
+	ticker := time.NewTicker(queryLogForwardPeriod)
+	defer ticker.Stop()
+
+	var batch []*logEntry
+	for {
+		select {
+		case entry := <-f.queue:
+			batch = append(batch, entry)
+			if !f.isHTTP() || len(batch) >= queryLogForwardBatch {
+				f.send(batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			if len(batch) != 0 {
+				f.send(batch)
+				batch = nil
+			}
+
+		case <-f.stop:
+			for len(f.queue) != 0 {
+				batch = append(batch, <-f.queue)
+			}
+			if len(batch) != 0 {
+				f.send(batch)
+			}
+			if f.conn != nil {
+				_ = f.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// Send the entries, they're dropped on error
+func (f *queryLogForwarder) send(batch []*logEntry) {
+	if time.Now().Before(f.retryTime) {
+		atomic.AddUint64(&f.dropped, uint64(len(batch)))
+		return
+	}
+
+	var err error
+	if f.isHTTP() {
+		err = f.post(batch)
+	} else {
+		err = f.write(batch)
+	}
+
+	if err != nil {
+		atomic.AddUint64(&f.dropped, uint64(len(batch)))
+		f.retryTime = time.Now().Add(queryLogForwardRetry)
+		if !f.failed {
+			log.Error("querylog: can't send the entries to %s: %s", f.url.Host, err)
+			f.failed = true
+		}
+		return
+	}
+	if f.failed {
+		log.Info("querylog: sending the entries to %s again", f.url.Host)
+		f.failed = false
+	}
+}
+
+// POST the entries to the HTTP collector
+func (f *queryLogForwarder) post(batch []*logEntry) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, entry := range batch {
+		err := enc.Encode(logEntryToJSON(entry))
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := f.client.Post(f.url.String(), "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Write the entries to the syslog server
+func (f *queryLogForwarder) write(batch []*logEntry) error {
+	if f.conn == nil {
+		conn, err := f.dial()
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range batch {
+		msg, err := f.syslogMessage(entry)
+		if err != nil {
+			return err
+		}
+		if f.url.Scheme != "udp" {
+			// octet counting framing (RFC 6587)
+			fmt.Fprintf(&buf, "%d ", len(msg))
+		}
+		buf.Write(msg)
+	}
+
+	_ = f.conn.SetWriteDeadline(time.Now().Add(queryLogForwardTimeout))
+	_, err := f.conn.Write(buf.Bytes())
+	if err != nil {
+		_ = f.conn.Close()
+		f.conn = nil // reconnect
+	}
+	return err
+}
+
+func (f *queryLogForwarder) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: queryLogForwardTimeout}
+	if f.url.Scheme == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", f.url.Host, &tls.Config{ServerName: f.url.Hostname()})
+	}
+	return dialer.Dial(f.url.Scheme, f.url.Host)
+}
+
+// Format the entry as a syslog message (RFC 5424)
+// The main fields are in the structured data, the message is the entry in JSON format.
+func (f *queryLogForwarder) syslogMessage(entry *logEntry) ([]byte, error) {
+	data, err := json.Marshal(logEntryToJSON(entry))
+	if err != nil {
+		return nil, err
+	}
+	host, qtype, rcode := entryQuestion(entry)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s AdGuardHome %d query ",
+		queryLogSyslogPriority, entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"), f.hostname, os.Getpid())
+	fmt.Fprintf(&buf, "[%s host=\"%s\" type=\"%s\" client=\"%s\" status=\"%s\" rcode=\"%s\"] ",
+		queryLogSyslogSDID, sdEscape(host), sdEscape(qtype), sdEscape(entry.IP), responseStatus(&entry.Result), sdEscape(rcode))
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// Escape the structured data parameter value
+var sdReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func sdEscape(s string) string {
+	return sdReplacer.Replace(s)
+}
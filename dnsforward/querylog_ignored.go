@@ -0,0 +1,86 @@
+// Query log exclusions
+// The requests of some clients (e.g. the admin's workstation or a monitoring probe)
+// or for some domains (e.g. a heartbeat) are neither logged nor counted in the statistics.
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// queryLogIgnored is the list of the clients and the domains whose requests aren't logged
+type queryLogIgnored struct {
+	nets    []*net.IPNet
+	domains []string // their subdomains match too
+}
+
+// Parse the list of client IP addresses, CIDRs and domain names
+func parseQueryLogIgnored(list []string) (*queryLogIgnored, error) {
+	ignored := &queryLogIgnored{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			ignored.nets = append(ignored.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("querylog_ignored: invalid CIDR: %s", s)
+			}
+			ignored.nets = append(ignored.nets, n)
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSuffix(s, "."))
+		if strings.ContainsAny(domain, " *:") {
+			return nil, fmt.Errorf("querylog_ignored: %s is neither IP address, CIDR nor domain name", s)
+		}
+		ignored.domains = append(ignored.domains, domain)
+	}
+	return ignored, nil
+}
+
+// Return TRUE if the client or the host is in the list
+func (i *queryLogIgnored) match(clientAddr string, host string) bool {
+	ip := net.ParseIP(clientAddr)
+	if ip != nil {
+		for _, n := range i.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range i.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return TRUE if the request must be neither logged nor counted in the statistics
+func (s *Server) isQueryLogIgnored(d *proxy.DNSContext) bool {
+	clientAddr := GetIPString(d.Addr)
+	host := ""
+	if len(d.Req.Question) != 0 {
+		host = d.Req.Question[0].Name
+	}
+	if s.queryLogIgnored != nil && s.queryLogIgnored.match(clientAddr, host) {
+		return true
+	}
+	return s.conf.QueryLogIgnoredHandler != nil && s.conf.QueryLogIgnoredHandler(clientAddr)
+}
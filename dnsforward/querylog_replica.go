@@ -0,0 +1,77 @@
+package dnsforward
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const queryLogReplicaRefresh = 10 * time.Second // don't re-read the replica files more often than this
+
+// queryLogReplica serves the query log API from a replicated copy of the query log files,
+// so that reading doesn't contend with the DNS server writing the log
+type queryLogReplica struct {
+	reader *queryLog // used only to read files from the replica directory
+
+	lock    sync.Mutex
+	cache   []*logEntry // newest entries, newest first
+	updated time.Time   // when the cache was filled
+}
+
+// newQueryLogReplica creates a new instance of the query log replica reader
+func newQueryLogReplica(dir string) *queryLogReplica {
+	return &queryLogReplica{
+		reader: &queryLog{logFile: filepath.Join(dir, queryLogFileName)},
+	}
+}
+
+// load reads the newest entries from the replica files
+func (r *queryLogReplica) load() ([]*logEntry, error) {
+	entries := []*logEntry{}
+
+	// sort by time and keep only the newest entries
+	trim := func() {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Time.After(entries[j].Time)
+		})
+		if len(entries) > queryLogSize {
+			entries = entries[:queryLogSize]
+		}
+	}
+
+	onEntry := func(entry *logEntry) error {
+		entries = append(entries, entry)
+		if len(entries) >= queryLogSize*2 {
+			trim()
+		}
+		return nil
+	}
+	needMore := func() bool {
+		return true
+	}
+	err := r.reader.genericLoader(onEntry, needMore, queryLogTimeLimit)
+	if err != nil {
+		return nil, err
+	}
+	trim()
+	return entries, nil
+}
+
+// getQueryLog returns a map with the query log from the replica ready to be converted to a JSON
+func (r *queryLogReplica) getQueryLog() []map[string]interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.updated) >= queryLogReplicaRefresh {
+		entries, err := r.load()
+		if err != nil {
+			log.Error("querylog replica: failed to read %s: %s", r.reader.logFile, err)
+		} else {
+			r.cache = entries
+			r.updated = time.Now()
+		}
+	}
+
+	return logEntriesToJSON(r.cache)
+}
@@ -0,0 +1,160 @@
+// Query log retention
+// The query log file is rotated daily and when it grows over a half of the size limit:
+// querylog.json becomes querylog.json.1, querylog.json.1 becomes querylog.json.2 and so on.
+// The oldest files are removed when they're older than the max age or when all files take more than the size limit.
+
+package dnsforward
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const defaultQueryLogMaxDays = 1
+
+// queryLogSegment is a query log file
+type queryLogSegment struct {
+	index    int // 0 is the current file, 1 is the previous one and so on
+	path     string
+	size     int64
+	modified time.Time // the newest entries of the file are older than this
+}
+
+// Set the retention limits: the max age of the files in days (0: default) and their max total size (0: no limit)
+func (l *queryLog) setRetention(maxDays uint32, maxBytes int64) {
+	if maxDays == 0 {
+		maxDays = defaultQueryLogMaxDays
+	}
+	l.retentionLock.Lock()
+	l.maxAge = time.Duration(maxDays) * 24 * time.Hour
+	l.maxBytes = maxBytes
+	l.retentionLock.Unlock()
+}
+
+func (l *queryLog) getRetention() (time.Duration, int64) {
+	l.retentionLock.Lock()
+	defer l.retentionLock.Unlock()
+	if l.maxAge == 0 {
+		return defaultQueryLogMaxDays * 24 * time.Hour, l.maxBytes
+	}
+	return l.maxAge, l.maxBytes
+}
+
+// Get the path of the file: 0 is the current file, 1 is the previous one and so on
+func (l *queryLog) segmentPath(i int) string {
+	path := l.logFile
+	if enableGzip {
+		path += ".gz"
+	}
+	if i != 0 {
+		path += "." + strconv.Itoa(i)
+	}
+	return path
+}
+
+// Get the query log files, newest first
+// The current file may not exist yet, the rotated files are numbered without gaps and may be compressed.
+func (l *queryLog) segments() []queryLogSegment {
+	segments := []queryLogSegment{}
+	for i := 0; ; i++ {
+		path := l.segmentPath(i)
+		fi, err := os.Stat(path)
+		if err != nil && i != 0 {
+			path += gzipSuffix
+			fi, err = os.Stat(path)
+		}
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			break
+		}
+		segments = append(segments, queryLogSegment{index: i, path: path, size: fi.Size(), modified: fi.ModTime()})
+	}
+	return segments
+}
+
+// Rotate the files if the current one is more than a half of the size limit
+func (l *queryLog) rotateIfLarge() error {
+	_, maxBytes := l.getRetention()
+	if maxBytes <= 0 {
+		return nil
+	}
+	fi, err := os.Stat(l.segmentPath(0))
+	if err != nil || fi.Size() < maxBytes/2 {
+		return nil
+	}
+	return l.rotateQueryLog()
+}
+
+// Remove the files which are too old or don't fit the size limit, the current file is never removed
+func (l *queryLog) enforceRetention() {
+	maxAge, maxBytes := l.getRetention()
+
+	fileWriteLock.Lock()
+	defer fileWriteLock.Unlock()
+
+	segments := l.segments()
+	var total int64
+	for _, s := range segments {
+		total += s.size
+	}
+	now := time.Now()
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		if s.index == 0 {
+			break
+		}
+		if now.Sub(s.modified) <= maxAge && (maxBytes <= 0 || total <= maxBytes) {
+			break
+		}
+		err := os.Remove(s.path)
+		if err != nil {
+			log.Error("querylog: failed to remove %s: %s", s.path, err)
+			break
+		}
+		log.Debug("querylog: removed %s", s.path)
+		total -= s.size
+	}
+}
+
+// Get the disk usage of the query log and the retention limits ready to be converted to a JSON
+func (l *queryLog) diskUsage() map[string]interface{} {
+	maxAge, maxBytes := l.getRetention()
+
+	fileWriteLock.Lock()
+	segments := l.segments()
+	fileWriteLock.Unlock()
+
+	files := []map[string]interface{}{}
+	var total int64
+	for _, s := range segments {
+		files = append(files, map[string]interface{}{
+			"name":     filepath.Base(s.path),
+			"size":     s.size,
+			"modified": s.modified.Format(time.RFC3339),
+		})
+		total += s.size
+	}
+	return map[string]interface{}{
+		"files":       files,
+		"files_bytes": total,
+		"max_days":    int64(maxAge / (24 * time.Hour)),
+		"max_bytes":   maxBytes,
+		"compress":    l.getCompress(),
+	}
+}
+
+// Get the size of the database file and its journal
+func queryLogDBSize(path string) int64 {
+	var size int64
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		fi, err := os.Stat(p)
+		if err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,421 @@
+// SQLite query log backend
+// The entries are stored in a database in addition to the query log files.
+// The table is indexed by time, client, domain, question type and response status,
+// so searching weeks of the query log doesn't scan the files.
+// The entries are written in batches by a background goroutine, the DNS requests don't wait for the disk.
+
+package dnsforward
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+	_ "modernc.org/sqlite" // SQLite driver in pure Go, the binaries are built with CGO_ENABLED=0
+)
+
+const (
+	queryLogDBFileName         = "querylog.db"
+	queryLogDBFlushPeriod      = time.Second
+	queryLogDBCleanupPeriod    = time.Hour
+	queryLogDBMaxBuffer        = logBufferCap * 10 // the entries are dropped if the database can't keep up
+	defaultQueryLogDBRetention = 30                // days
+
+	// the options of the SQLite databases
+	sqliteOptions = "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+)
+
+const queryLogDBSchema = `
+CREATE TABLE IF NOT EXISTS querylog (
+	time     INTEGER NOT NULL, -- Unix time in nanoseconds
+	client   TEXT NOT NULL,
+	host     TEXT NOT NULL,    -- the labels are reversed ("org.example.www"), so subdomains are found by prefix
+	status   TEXT NOT NULL,    -- response code, e.g. NOERROR (empty: no response)
+	filtered INTEGER NOT NULL,
+	entry    BLOB NOT NULL     -- JSON-encoded logEntry
+);
+`
+
+// the columns added after the first version of the table
+var queryLogDBColumns = []string{
+	"name TEXT NOT NULL DEFAULT ''",     // host name as is, for the substring search
+	"qtype TEXT NOT NULL DEFAULT ''",    // question type, e.g. AAAA
+	"reason INTEGER NOT NULL DEFAULT 0", // dnsfilter.Reason
+}
+
+const queryLogDBIndexes = `
+CREATE INDEX IF NOT EXISTS querylog_time ON querylog (time);
+CREATE INDEX IF NOT EXISTS querylog_client ON querylog (client, time);
+CREATE INDEX IF NOT EXISTS querylog_host ON querylog (host, time);
+CREATE INDEX IF NOT EXISTS querylog_status ON querylog (status, time);
+CREATE INDEX IF NOT EXISTS querylog_qtype ON querylog (qtype, time);
+`
+
+// The search response statuses
+const (
+	QueryLogBlocked   = "blocked"   // the filtered requests
+	QueryLogAllowed   = "allowed"   // the requests which are neither filtered nor rewritten
+	QueryLogRewritten = "rewritten" // the requests answered from the DNS rewrites
+)
+
+// QueryLogSearch selects the query log entries
+// The empty fields match all entries
+type QueryLogSearch struct {
+	Client    string    // client IP address
+	Domain    string    // host name, its subdomains match too
+	Search    string    // substring of the host name
+	QType     string    // question type, e.g. AAAA
+	Status    string    // response code, e.g. NXDOMAIN
+	Response  string    // QueryLogBlocked, QueryLogAllowed or QueryLogRewritten
+	Start     time.Time // the oldest request
+	End       time.Time // the newest request
+	OlderThan time.Time // the cursor: the time of the last entry of the previous page
+	Limit     int       // max number of entries (0: default)
+}
+
+// match returns TRUE if the entry is selected
+func (f *QueryLogSearch) match(entry *logEntry, host string, qtype string, status string) bool {
+	return (len(f.Client) == 0 || entry.IP == f.Client) &&
+		(len(f.Domain) == 0 || host == f.Domain || strings.HasSuffix(host, "."+f.Domain)) &&
+		(len(f.Search) == 0 || strings.Contains(host, f.Search)) &&
+		(len(f.QType) == 0 || qtype == f.QType) &&
+		(len(f.Status) == 0 || status == f.Status) &&
+		(len(f.Response) == 0 || f.Response == responseStatus(&entry.Result)) &&
+		(f.Start.IsZero() || !entry.Time.Before(f.Start)) &&
+		(f.End.IsZero() || !entry.Time.After(f.End)) &&
+		(f.OlderThan.IsZero() || entry.Time.Before(f.OlderThan))
+}
+
+// Get the search response status of the filtering result
+func responseStatus(res *dnsfilter.Result) string {
+	if res.IsFiltered {
+		return QueryLogBlocked
+	} else if res.Reason == dnsfilter.ReasonRewrite {
+		return QueryLogRewritten
+	}
+	return QueryLogAllowed
+}
+
+func (f *QueryLogSearch) limit() int {
+	if f.Limit <= 0 || f.Limit > queryLogSize {
+		return queryLogSize
+	}
+	return f.Limit
+}
+
+// Get the host name, the question type and the response code of the entry
+func entryQuestion(entry *logEntry) (string, string, string) {
+	host := ""
+	qtype := ""
+	status := ""
+	if len(entry.Question) != 0 {
+		q := new(dns.Msg)
+		if q.Unpack(entry.Question) == nil && len(q.Question) != 0 {
+			host = strings.ToLower(strings.TrimSuffix(q.Question[0].Name, "."))
+			qtype = dns.Type(q.Question[0].Qtype).String()
+		}
+	}
+	if len(entry.Answer) != 0 {
+		a := new(dns.Msg)
+		if a.Unpack(entry.Answer) == nil {
+			status = dns.RcodeToString[a.Rcode]
+		}
+	}
+	return host, qtype, status
+}
+
+// Reverse the labels of the host name: "www.example.org" -> "org.example.www"
+func reverseHost(host string) string {
+	labels := strings.Split(host, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+type queryLogDB struct {
+	db        *sql.DB
+	retention time.Duration
+
+	lock   sync.Mutex
+	buffer []*logEntry
+
+	stop chan bool
+	done chan bool
+}
+
+// openQueryLogDB opens or creates the database and starts writing to it
+func openQueryLogDB(path string, retentionDays uint32) (*queryLogDB, error) {
+	if retentionDays == 0 {
+		retentionDays = defaultQueryLogDBRetention
+	}
+	db, err := sql.Open("sqlite", path+sqliteOptions)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't open %s", path)
+	}
+	err = initQueryLogDB(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, errorx.Decorate(err, "couldn't initialize %s", path)
+	}
+
+	q := &queryLogDB{
+		db:        db,
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+		stop:      make(chan bool),
+		done:      make(chan bool),
+	}
+	go q.run()
+	return q, nil
+}
+
+// Create the table or add the missing columns to it
+func initQueryLogDB(db *sql.DB) error {
+	_, err := db.Exec(queryLogDBSchema)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("PRAGMA table_info(querylog)")
+	if err != nil {
+		return err
+	}
+	columns := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = true
+	}
+	rows.Close()
+
+	for _, c := range queryLogDBColumns {
+		name := strings.Fields(c)[0]
+		if columns[name] {
+			continue
+		}
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE querylog ADD COLUMN %s", c))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(queryLogDBIndexes)
+	return err
+}
+
+// add the entry to the batch which is written later
+func (q *queryLogDB) add(entry *logEntry) {
+	q.lock.Lock()
+	if len(q.buffer) < queryLogDBMaxBuffer {
+		q.buffer = append(q.buffer, entry)
+	}
+	q.lock.Unlock()
+}
+
+// Write the buffered entries in one transaction
+func (q *queryLogDB) flush() error {
+	q.lock.Lock()
+	buffer := q.buffer
+	q.buffer = nil
+	q.lock.Unlock()
+	if len(buffer) == 0 {
+		return nil
+	}
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT INTO querylog (time, client, host, name, qtype, status, filtered, reason, entry) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, entry := range buffer {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Error("querylog db: failed to marshal entry: %s", err)
+			continue
+		}
+		host, qtype, status := entryQuestion(entry)
+		_, err = stmt.Exec(entry.Time.UnixNano(), entry.IP, reverseHost(host), host, qtype, status, entry.Result.IsFiltered, int(entry.Result.Reason), data)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Remove the entries older than the retention time
+func (q *queryLogDB) cleanup() error {
+	res, err := q.db.Exec("DELETE FROM querylog WHERE time < ?", time.Now().Add(-q.retention).UnixNano())
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	log.Debug("querylog db: removed %d old entries", n)
+	return nil
+}
+
+// Write the entries and remove the old ones periodically until the database is closed
+func (q *queryLogDB) run() {
+	flushTicker := time.NewTicker(queryLogDBFlushPeriod)
+	defer flushTicker.Stop()
+	cleanupTicker := time.NewTicker(queryLogDBCleanupPeriod)
+	defer cleanupTicker.Stop()
+
+	err := q.cleanup()
+	if err != nil {
+		log.Error("querylog db: cleanup failed: %s", err)
+	}
+	for {
+		select {
+		case <-flushTicker.C:
+			err = q.flush()
+			if err != nil {
+				log.Error("querylog db: write failed: %s", err)
+			}
+		case <-cleanupTicker.C:
+			err = q.cleanup()
+			if err != nil {
+				log.Error("querylog db: cleanup failed: %s", err)
+			}
+		case <-q.stop:
+			close(q.done)
+			return
+		}
+	}
+}
+
+// close writes the buffered entries and closes the database
+func (q *queryLogDB) close() {
+	close(q.stop)
+	<-q.done
+	err := q.flush()
+	if err != nil {
+		log.Error("querylog db: write failed: %s", err)
+	}
+	_ = q.db.Close()
+}
+
+// Get the WHERE clause of the SQL query which selects the entries and its arguments
+func (f *QueryLogSearch) where() (string, []interface{}) {
+	where := []string{}
+	args := []interface{}{}
+	if len(f.Client) != 0 {
+		where = append(where, "client = ?")
+		args = append(args, f.Client)
+	}
+	if len(f.Domain) != 0 {
+		// "/" follows "." so the range has all names which start with "org.example."
+		host := reverseHost(f.Domain)
+		where = append(where, "(host = ? OR (host > ? AND host < ?))")
+		args = append(args, host, host+".", host+"/")
+	}
+	if len(f.Search) != 0 {
+		where = append(where, "instr(name, ?) > 0")
+		args = append(args, f.Search)
+	}
+	if len(f.QType) != 0 {
+		where = append(where, "qtype = ?")
+		args = append(args, f.QType)
+	}
+	if len(f.Status) != 0 {
+		where = append(where, "status = ?")
+		args = append(args, f.Status)
+	}
+	switch f.Response {
+	case QueryLogBlocked:
+		where = append(where, "filtered = 1")
+	case QueryLogRewritten:
+		where = append(where, "filtered = 0 AND reason = ?")
+		args = append(args, int(dnsfilter.ReasonRewrite))
+	case QueryLogAllowed:
+		where = append(where, "filtered = 0 AND reason != ?")
+		args = append(args, int(dnsfilter.ReasonRewrite))
+	}
+	if !f.Start.IsZero() {
+		where = append(where, "time >= ?")
+		args = append(args, f.Start.UnixNano())
+	}
+	if !f.End.IsZero() {
+		where = append(where, "time <= ?")
+		args = append(args, f.End.UnixNano())
+	}
+	if !f.OlderThan.IsZero() {
+		where = append(where, "time < ?")
+		args = append(args, f.OlderThan.UnixNano())
+	}
+
+	if len(where) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+// search returns the entries selected by the filter, newest first
+func (q *queryLogDB) search(f *QueryLogSearch) ([]*logEntry, error) {
+	// the recent entries must be found too
+	err := q.flush()
+	if err != nil {
+		log.Error("querylog db: write failed: %s", err)
+	}
+
+	where, args := f.where()
+	query := "SELECT entry FROM querylog" + where + " ORDER BY time DESC LIMIT ?"
+	args = append(args, f.limit())
+
+	rows, err := q.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*logEntry{}
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+		entry := &logEntry{}
+		err = json.Unmarshal(data, entry)
+		if err != nil {
+			log.Error("querylog db: failed to decode entry: %s", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// search returns the in-memory entries selected by the filter, newest first
+func (l *queryLog) search(f *QueryLogSearch) []*logEntry {
+	l.queryLogLock.RLock()
+	values := make([]*logEntry, len(l.queryLogCache))
+	copy(values, l.queryLogCache)
+	l.queryLogLock.RUnlock()
+
+	entries := []*logEntry{}
+	for i := len(values) - 1; i >= 0 && len(entries) < f.limit(); i-- {
+		host, qtype, status := entryQuestion(values[i])
+		if f.match(values[i], host, qtype, status) {
+			entries = append(entries, values[i])
+		}
+	}
+	return entries
+}
@@ -0,0 +1,83 @@
+// Live tail of the query log
+// The subscribers receive the new entries selected by their filters as soon as they're logged.
+// The DNS requests never wait for a subscriber: if it doesn't keep up, its entries are dropped.
+
+package dnsforward
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+const queryLogTailBuffer = 256 // the entries which the subscriber hasn't received yet
+
+type queryLogSubscriber struct {
+	filter  QueryLogSearch
+	ch      chan map[string]interface{}
+	dropped uint64 // accessed atomically
+}
+
+// QueryLogTail receives the new query log entries
+type QueryLogTail struct {
+	C <-chan map[string]interface{} // the entries ready to be converted to a JSON
+
+	l   *queryLog
+	sub *queryLogSubscriber
+}
+
+// Dropped returns the number of entries which were dropped because the receiver is too slow
+func (t *QueryLogTail) Dropped() uint64 {
+	return atomic.LoadUint64(&t.sub.dropped)
+}
+
+// Close stops receiving the entries
+func (t *QueryLogTail) Close() {
+	t.l.subscribersLock.Lock()
+	delete(t.l.subscribers, t.sub)
+	t.l.subscribersLock.Unlock()
+}
+
+// Pass the new entry to the subscribers
+func (l *queryLog) publish(entry *logEntry) {
+	l.subscribersLock.RLock()
+	defer l.subscribersLock.RUnlock()
+	if len(l.subscribers) == 0 {
+		return
+	}
+
+	host, qtype, status := entryQuestion(entry)
+	for sub := range l.subscribers {
+		if !sub.filter.match(entry, host, qtype, status) {
+			continue
+		}
+		select {
+		case sub.ch <- logEntryToJSON(entry):
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// TailQueryLog starts receiving the new query log entries selected by the filter
+// The search limit is ignored. The caller must close the tail.
+func (s *Server) TailQueryLog(f QueryLogSearch) *QueryLogTail {
+	s.RLock()
+	l := s.queryLog
+	s.RUnlock()
+
+	if net.ParseIP(f.Client) != nil {
+		f.Client = l.anonymize(f.Client)
+	}
+
+	sub := &queryLogSubscriber{
+		filter: f,
+		ch:     make(chan map[string]interface{}, queryLogTailBuffer),
+	}
+	l.subscribersLock.Lock()
+	if l.subscribers == nil {
+		l.subscribers = map[*queryLogSubscriber]bool{}
+	}
+	l.subscribers[sub] = true
+	l.subscribersLock.Unlock()
+	return &QueryLogTail{C: sub.ch, l: l, sub: sub}
+}
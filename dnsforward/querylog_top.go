@@ -9,7 +9,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/bluele/gcache"
 	"github.com/miekg/dns"
 )
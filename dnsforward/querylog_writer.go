@@ -0,0 +1,85 @@
+// Query log writer
+// The entries are passed to a background goroutine through a bounded queue,
+// so the DNS requests never wait for the disk. The writer appends the entries to the file in batches:
+// when the buffer is full or periodically, with one sync per batch.
+// If the writer doesn't keep up (e.g. the disk is slow during a burst of requests), the new entries are dropped and counted.
+
+package dnsforward
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queryLogWriteQueueSize = logBufferCap * 4 // the new entries are dropped if the queue is full
+	queryLogSyncPeriod     = 5 * time.Second  // the buffered entries are written at least this often
+)
+
+// writer moves the entries from the queue to the buffer and writes the buffer to the file
+func (l *queryLog) writer() {
+	ticker := time.NewTicker(queryLogSyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-l.writeQueue:
+			if l.bufferEntry(entry) >= logBufferCap {
+				_ = l.flushLogBuffer(false)
+			}
+
+		case res := <-l.flushRequests:
+			l.drainWriteQueue()
+			res <- l.flushLogBuffer(true)
+
+		case <-l.stopWriter:
+			return
+
+		case <-ticker.C:
+			l.logBufferLock.RLock()
+			n := len(l.logBuffer)
+			l.logBufferLock.RUnlock()
+			if n != 0 {
+				_ = l.flushLogBuffer(true)
+			}
+		}
+	}
+}
+
+// Add the entry to the buffer, return the number of the buffered entries
+func (l *queryLog) bufferEntry(entry *logEntry) int {
+	l.logBufferLock.Lock()
+	defer l.logBufferLock.Unlock()
+	l.logBuffer = append(l.logBuffer, entry)
+	return len(l.logBuffer)
+}
+
+// Move all queued entries to the buffer
+func (l *queryLog) drainWriteQueue() {
+	for {
+		select {
+		case entry := <-l.writeQueue:
+			l.bufferEntry(entry)
+		default:
+			return
+		}
+	}
+}
+
+// flush writes all queued and buffered entries to the file
+func (l *queryLog) flush() error {
+	res := make(chan error, 1)
+	l.flushRequests <- res
+	return <-res
+}
+
+// close writes all queued and buffered entries to the file and stops the writer
+func (l *queryLog) close() error {
+	err := l.flush()
+	close(l.stopWriter)
+	return err
+}
+
+// Get the number of entries which weren't written because the writer didn't keep up
+func (l *queryLog) droppedEntries() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
@@ -6,8 +6,12 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
 )
 
+// the transport protocols the requests are counted for
+var statsProtocols = []string{proxy.ProtoUDP, proxy.ProtoTCP, proxy.ProtoTLS, proxy.ProtoHTTPS, ProtoQUIC}
+
 // how far back to keep the stats
 const statsHistoryElements = 60 + 1 // +1 for calculating delta
 
@@ -38,7 +42,14 @@ type stats struct {
 	whitelisted          *counter   // total number of requests whitelisted by filter lists
 	safesearch           *counter   // total number of requests for which safe search rules were applied
 	errorsTotal          *counter   // total number of errors
+	cacheHits            *counter   // total number of requests answered from the DNS cache
+	cacheMisses          *counter   // total number of requests sent to the upstream servers
+	aaaaDisabled         *counter   // total number of AAAA requests answered with an empty answer
 	elapsedTime          *histogram // requests duration histogram
+
+	protoRequests map[string]*counter // number of requests for each transport protocol
+
+	resets statsResets // selective resets of the statistics
 }
 
 // initializes an empty stats structure
@@ -52,7 +63,14 @@ func newStats() *stats {
 		whitelisted:          newDNSCounter("whitelisted_total"),
 		safesearch:           newDNSCounter("safesearch_total"),
 		errorsTotal:          newDNSCounter("errors_total"),
+		cacheHits:            newDNSCounter("cache_hits_total"),
+		cacheMisses:          newDNSCounter("cache_misses_total"),
+		aaaaDisabled:         newDNSCounter("aaaa_disabled_total"),
 		elapsedTime:          newDNSHistogram("request_duration"),
+		protoRequests:        map[string]*counter{},
+	}
+	for _, proto := range statsProtocols {
+		s.protoRequests[proto] = newDNSCounter("requests_" + proto + "_total")
 	}
 
 	// Initializes empty per-sec/minute/hour/day stats
@@ -79,7 +97,7 @@ func (p *periodicStats) Inc(name string, when time.Time) {
 	// calculate how many periods ago this happened
 	elapsed := int64(time.Since(when) / p.period)
 	// log.Tracef("%s: %v as %v -> [%v]", name, time.Since(when), p.period, elapsed)
-	if elapsed >= statsHistoryElements {
+	if elapsed < 0 || elapsed >= statsHistoryElements {
 		return // outside of our timeframe
 	}
 	p.Lock()
@@ -93,7 +111,7 @@ func (p *periodicStats) Observe(name string, when time.Time, value float64) {
 	// calculate how many periods ago this happened
 	elapsed := int64(time.Since(when) / p.period)
 	// log.Tracef("%s: %v as %v -> [%v]", name, time.Since(when), p.period, elapsed)
-	if elapsed >= statsHistoryElements {
+	if elapsed < 0 || elapsed >= statsHistoryElements {
 		return // outside of our timeframe
 	}
 	p.Lock()
@@ -201,28 +219,47 @@ func (s *stats) observeWithTime(h *histogram, value float64, when time.Time) {
 // stats
 // -----
 func (s *stats) incrementCounters(entry *logEntry) {
-	s.incWithTime(s.requests, entry.Time)
+	for _, c := range s.entryCounters(entry) {
+		s.incWithTime(c, entry.Time)
+	}
+	s.observeWithTime(s.elapsedTime, entry.Elapsed.Seconds(), entry.Time)
+}
+
+// entryCounters returns the counters the request is accounted in
+func (s *stats) entryCounters(entry *logEntry) []*counter {
+	counters := []*counter{s.requests}
+	if c, ok := s.protoRequests[entry.Proto]; ok {
+		counters = append(counters, c)
+	}
 	if entry.Result.IsFiltered {
-		s.incWithTime(s.filtered, entry.Time)
+		counters = append(counters, s.filtered)
+	}
+	if entry.Cached {
+		counters = append(counters, s.cacheHits)
+	} else if len(entry.Upstream) != 0 {
+		counters = append(counters, s.cacheMisses)
+	}
+	if entry.AAAADisabled {
+		counters = append(counters, s.aaaaDisabled)
 	}
 
 	switch entry.Result.Reason {
 	case dnsfilter.NotFilteredWhiteList:
-		s.incWithTime(s.whitelisted, entry.Time)
+		counters = append(counters, s.whitelisted)
 	case dnsfilter.NotFilteredError:
-		s.incWithTime(s.errorsTotal, entry.Time)
+		counters = append(counters, s.errorsTotal)
 	case dnsfilter.FilteredBlackList:
-		s.incWithTime(s.filteredLists, entry.Time)
+		counters = append(counters, s.filteredLists)
 	case dnsfilter.FilteredSafeBrowsing:
-		s.incWithTime(s.filteredSafebrowsing, entry.Time)
+		counters = append(counters, s.filteredSafebrowsing)
 	case dnsfilter.FilteredParental:
-		s.incWithTime(s.filteredParental, entry.Time)
+		counters = append(counters, s.filteredParental)
 	case dnsfilter.FilteredInvalid:
 		// do nothing
 	case dnsfilter.FilteredSafeSearch:
-		s.incWithTime(s.safesearch, entry.Time)
+		counters = append(counters, s.safesearch)
 	}
-	s.observeWithTime(s.elapsedTime, entry.Elapsed.Seconds(), entry.Time)
+	return counters
 }
 
 // getAggregatedStats returns aggregated stats data for the 24 hours
@@ -276,16 +313,32 @@ func (s *stats) generateMapFromStats(stats *periodicStats, start int, end int) m
 	}
 
 	result := map[string]interface{}{
-		"dns_queries":           getReversedSlice(stats.entries[s.requests.name], start, end),
-		"blocked_filtering":     getReversedSlice(stats.entries[s.filtered.name], start, end),
-		"replaced_safebrowsing": getReversedSlice(stats.entries[s.filteredSafebrowsing.name], start, end),
-		"replaced_safesearch":   getReversedSlice(stats.entries[s.safesearch.name], start, end),
-		"replaced_parental":     getReversedSlice(stats.entries[s.filteredParental.name], start, end),
-		"avg_processing_time":   avgProcessingTime,
+		"avg_processing_time": avgProcessingTime,
+	}
+	for key, name := range s.seriesNames() {
+		result[key] = getReversedSlice(stats.entries[name], start, end)
 	}
 	return result
 }
 
+// seriesNames returns the names of the counters by the keys of the returned statistics
+func (s *stats) seriesNames() map[string]string {
+	names := map[string]string{
+		"dns_queries":           s.requests.name,
+		"blocked_filtering":     s.filtered.name,
+		"replaced_safebrowsing": s.filteredSafebrowsing.name,
+		"replaced_safesearch":   s.safesearch.name,
+		"replaced_parental":     s.filteredParental.name,
+		"cache_hits":            s.cacheHits.name,
+		"cache_misses":          s.cacheMisses.name,
+		"aaaa_disabled":         s.aaaaDisabled.name,
+	}
+	for proto, c := range s.protoRequests {
+		names["dns_queries_"+proto] = c.name
+	}
+	return names
+}
+
 // getStatsHistory gets stats history aggregated by the specified time unit
 // timeUnit is either time.Second, time.Minute, time.Hour, or 24*time.Hour
 // start is start of the time range
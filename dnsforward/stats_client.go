@@ -0,0 +1,117 @@
+// Per-client statistics
+// The numbers of the requests and the blocked requests of a client and its top domains over a time range
+// are calculated from the top charts of the statistics database.
+
+package dnsforward
+
+import (
+	"net"
+	"time"
+)
+
+// StatsClientReport is the statistics of a client over a time range
+type StatsClientReport struct {
+	Requests float64 // the number of the requests
+	Blocked  float64 // the number of the blocked requests
+
+	TimeUnit       string    // hours for up to 7 days, days for the longer ranges
+	RequestsSeries []float64 // the number of the requests for each hour or day, oldest first
+	BlockedSeries  []float64 // the number of the blocked requests for each hour or day, oldest first
+
+	Domains []StatsTopItem // the requested domains, the most frequent first
+}
+
+// getClientReport returns the statistics of the client over the time range, the hours are included if they overlap with it
+func (d *statsDB) getClientReport(ip string, startTime time.Time, endTime time.Time, limit int) (*StatsClientReport, error) {
+	err := d.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	start := statsHour(startTime)
+	end := statsHour(endTime)
+	hoursPerBucket := int64(1)
+	r := &StatsClientReport{TimeUnit: "hours"}
+	if end-start >= statsDBMaxHourly*24*3600 {
+		hoursPerBucket = 24
+		r.TimeUnit = "days"
+	}
+	buckets := int((end-start)/3600/hoursPerBucket) + 1
+	r.RequestsSeries = make([]float64, buckets)
+	r.BlockedSeries = make([]float64, buckets)
+
+	rows, err := d.db.Query(`SELECT hour, category, value FROM stats_top
+		WHERE hour >= ? AND hour <= ? AND category IN (?, ?) AND key = ?`,
+		start, end, statsTopClients, statsTopClientBlocked, ip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hour int64
+		var category string
+		var value float64
+		err = rows.Scan(&hour, &category, &value)
+		if err != nil {
+			return nil, err
+		}
+		i := int((hour - start) / 3600 / hoursPerBucket)
+		if category == statsTopClients {
+			r.RequestsSeries[i] += value
+			r.Requests += value
+		} else {
+			r.BlockedSeries[i] += value
+			r.Blocked += value
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Domains, err = d.getClientDomains(ip, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get the top domains of the client
+func (d *statsDB) getClientDomains(ip string, start int64, end int64, limit int) ([]StatsTopItem, error) {
+	// "!" follows " " so the range has all keys which start with "<ip> "
+	rows, err := d.db.Query(`SELECT substr(key, ?) AS domain, SUM(value) AS total FROM stats_top
+		WHERE hour >= ? AND hour <= ? AND category = ? AND key > ? AND key < ?
+		GROUP BY domain HAVING total > 0 ORDER BY total DESC, domain LIMIT ?`,
+		len(ip)+2, start, end, statsTopClientDomains, ip+" ", ip+"!", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []StatsTopItem{}
+	for rows.Next() {
+		item := StatsTopItem{}
+		err = rows.Scan(&item.Name, &item.Count)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// GetStatsClientReport returns the statistics of the client over the time range
+// Returns ErrStatsNotStored if the statistics aren't stored
+func (s *Server) GetStatsClientReport(ip string, startTime time.Time, endTime time.Time, limit int) (*StatsClientReport, error) {
+	s.RLock()
+	db := s.statsDB
+	l := s.queryLog
+	s.RUnlock()
+	if db == nil {
+		return nil, ErrStatsNotStored
+	}
+
+	if net.ParseIP(ip) != nil {
+		ip = l.anonymize(ip)
+	}
+	return db.getClientReport(ip, startTime, endTime, limit)
+}
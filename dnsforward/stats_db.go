@@ -0,0 +1,308 @@
+// Persistent statistics
+// The counters are aggregated into hourly buckets which are stored in a SQLite database,
+// so the statistics survive the restarts and cover up to 90 days, not only the requests since the start.
+// The changes are accumulated in memory and written periodically, the DNS requests don't wait for the disk.
+
+package dnsforward
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/joomcode/errorx"
+)
+
+const (
+	statsDBFileName    = "stats.db"
+	statsDBFlushPeriod = time.Minute
+	statsDBMaxHourly   = 7 // days; the longer intervals are returned as daily series
+)
+
+const statsDBSchema = `
+CREATE TABLE IF NOT EXISTS stats (
+	hour  INTEGER NOT NULL, -- Unix time of the start of the hour
+	name  TEXT NOT NULL,    -- counter name, e.g. requests_total
+	value REAL NOT NULL,
+	PRIMARY KEY (hour, name)
+) WITHOUT ROWID;
+`
+
+// CheckStatsInterval checks the statistics interval (in days)
+func CheckStatsInterval(days uint32) error {
+	switch days {
+	case 0, 1, 7, 30, 90:
+		return nil
+	}
+	return fmt.Errorf("statistics_interval: must be 1, 7, 30 or 90 days")
+}
+
+type statsDBKey struct {
+	hour int64 // Unix time of the start of the hour
+	name string
+}
+
+type statsDB struct {
+	db       *sql.DB
+	interval uint32 // days
+
+	lock       sync.Mutex
+	pending    map[statsDBKey]float64    // the changes which aren't written yet
+	topPending map[statsDBTopKey]float64 // the changes of the top charts which aren't written yet
+	compacted  int64                     // the last hour whose top charts are compacted
+
+	stop chan bool
+	done chan bool
+}
+
+// openStatsDB opens or creates the database and starts writing to it
+func openStatsDB(path string, days uint32) (*statsDB, error) {
+	db, err := sql.Open("sqlite", path+sqliteOptions)
+	if err != nil {
+		return nil, errorx.Decorate(err, "couldn't open %s", path)
+	}
+	_, err = db.Exec(statsDBSchema + statsTopSchema)
+	if err != nil {
+		_ = db.Close()
+		return nil, errorx.Decorate(err, "couldn't initialize %s", path)
+	}
+
+	d := &statsDB{
+		db:         db,
+		interval:   days,
+		pending:    map[statsDBKey]float64{},
+		topPending: map[statsDBTopKey]float64{},
+		stop:       make(chan bool),
+		done:       make(chan bool),
+	}
+	go d.run()
+	return d, nil
+}
+
+// Get the start of the hour
+func statsHour(t time.Time) int64 {
+	return t.Unix() / 3600 * 3600
+}
+
+// add adds the request to the statistics (sign: 1), or removes it (sign: -1)
+func (d *statsDB) add(s *stats, entry *logEntry, sign float64) {
+	hour := statsHour(entry.Time)
+	counters := s.entryCounters(entry)
+
+	d.lock.Lock()
+	for _, c := range counters {
+		d.pending[statsDBKey{hour, c.name}] += sign
+	}
+	d.pending[statsDBKey{hour, s.elapsedTime.name + "_count"}] += sign
+	d.pending[statsDBKey{hour, s.elapsedTime.name + "_sum"}] += sign * entry.Elapsed.Seconds()
+	d.addTop(entry, sign)
+	d.lock.Unlock()
+}
+
+// Write the accumulated changes in one transaction
+func (d *statsDB) flush() error {
+	d.lock.Lock()
+	pending := d.pending
+	d.pending = map[statsDBKey]float64{}
+	topPending := d.topPending
+	d.topPending = map[statsDBTopKey]float64{}
+	d.lock.Unlock()
+	if len(pending) == 0 && len(topPending) == 0 {
+		return nil
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = writeStats(tx, pending)
+	if err == nil {
+		err = writeStatsTop(tx, topPending)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Write the counters changes
+func writeStats(tx *sql.Tx, pending map[statsDBKey]float64) error {
+	update, err := tx.Prepare("UPDATE stats SET value = MAX(0, value + ?) WHERE hour = ? AND name = ?")
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	insert, err := tx.Prepare("INSERT INTO stats (hour, name, value) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for key, value := range pending {
+		res, err := update.Exec(value, key.hour, key.name)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		if n != 0 || value <= 0 {
+			continue
+		}
+		_, err = insert.Exec(key.hour, key.name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the hours outside of the interval and compact the top charts of the finished hour
+func (d *statsDB) cleanup() error {
+	now := time.Now()
+	start := statsHour(now) - int64(d.interval)*24*3600
+	res, err := d.db.Exec("DELETE FROM stats WHERE hour <= ?", start)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	log.Debug("stats db: removed %d old values", n)
+
+	_, err = d.db.Exec("DELETE FROM stats_top WHERE hour <= ?", start)
+	if err != nil {
+		return err
+	}
+	return d.compactTop(now)
+}
+
+// purge removes all statistics
+func (d *statsDB) purge() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.pending = map[statsDBKey]float64{}
+	d.topPending = map[statsDBTopKey]float64{}
+	_, err := d.db.Exec("DELETE FROM stats; DELETE FROM stats_top")
+	return err
+}
+
+// Write the changes and remove the old values periodically until the database is closed
+func (d *statsDB) run() {
+	ticker := time.NewTicker(statsDBFlushPeriod)
+	defer ticker.Stop()
+	for {
+		err := d.flush()
+		if err == nil {
+			err = d.cleanup()
+		}
+		if err != nil {
+			log.Error("stats db: write failed: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.stop:
+			close(d.done)
+			return
+		}
+	}
+}
+
+// close writes the changes and closes the database
+func (d *statsDB) close() {
+	close(d.stop)
+	<-d.done
+	err := d.flush()
+	if err != nil {
+		log.Error("stats db: write failed: %s", err)
+	}
+	_ = d.db.Close()
+}
+
+// getAggregatedStats returns the statistics for the whole interval in the same format as stats.getAggregatedStats
+// and their time series, oldest first: hourly for up to 7 days, daily for the longer intervals
+func (d *statsDB) getAggregatedStats(s *stats, now time.Time) (map[string]interface{}, error) {
+	err := d.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	hoursPerBucket := int64(1)
+	timeUnit := "hours"
+	if d.interval > statsDBMaxHourly {
+		hoursPerBucket = 24
+		timeUnit = "days"
+	}
+	numHours := int64(d.interval) * 24
+	buckets := int(numHours / hoursPerBucket)
+	start := statsHour(now) - (numHours-1)*3600
+
+	rows, err := d.db.Query("SELECT hour, name, value FROM stats WHERE hour >= ?", start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := map[string][]float64{}
+	for rows.Next() {
+		var hour int64
+		var name string
+		var value float64
+		err = rows.Scan(&hour, &name, &value)
+		if err != nil {
+			return nil, err
+		}
+		i := int((hour - start) / 3600 / hoursPerBucket)
+		if i >= buckets {
+			continue // the clock has been changed
+		}
+		if _, ok := values[name]; !ok {
+			values[name] = make([]float64, buckets)
+		}
+		values[name][i] += value
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := func(series []float64) float64 {
+		total := 0.0
+		for _, v := range series {
+			total += v
+		}
+		return total
+	}
+	get := func(name string) []float64 {
+		if series, ok := values[name]; ok {
+			return series
+		}
+		return make([]float64, buckets)
+	}
+
+	series := map[string]interface{}{}
+	summed := map[string]interface{}{}
+	for key, name := range s.seriesNames() {
+		series[key] = get(name)
+		summed[key] = sum(get(name))
+	}
+
+	count := get(s.elapsedTime.name + "_count")
+	elapsed := get(s.elapsedTime.name + "_sum")
+	avgProcessingTime := make([]float64, buckets)
+	for i := range count {
+		if count[i] != 0 {
+			avgProcessingTime[i] = elapsed[i] / count[i] * 1000
+		}
+	}
+	series["avg_processing_time"] = avgProcessingTime
+	summed["avg_processing_time"] = 0.0
+	if total := sum(count); total != 0 {
+		summed["avg_processing_time"] = sum(elapsed) / total * 1000
+	}
+
+	summed["series"] = series
+	summed["time_unit"] = timeUnit
+	summed["stats_period"] = "24 hours"
+	if d.interval > 1 {
+		summed["stats_period"] = fmt.Sprintf("%d days", d.interval)
+	}
+	return summed, nil
+}
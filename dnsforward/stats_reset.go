@@ -0,0 +1,231 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/miekg/dns"
+)
+
+// StatsResetFilter selects the requests which are removed from the statistics
+// The empty fields match all requests
+type StatsResetFilter struct {
+	Client string    // client IP address
+	Domain string    // host name
+	Start  time.Time // the oldest request
+	End    time.Time // the newest request
+}
+
+// match returns TRUE if the request is selected by the filter
+func (f *StatsResetFilter) match(entry *logEntry, host string) bool {
+	return (len(f.Client) == 0 || entry.IP == f.Client) &&
+		(len(f.Domain) == 0 || host == f.Domain) &&
+		(f.Start.IsZero() || !entry.Time.Before(f.Start)) &&
+		(f.End.IsZero() || !entry.Time.After(f.End))
+}
+
+// A reset that has been already applied
+type statsReset struct {
+	filter StatsResetFilter
+	when   time.Time // the requests received after this time aren't affected
+}
+
+// The state of the statistics resets
+// The statistics are calculated from the requests,
+// so to reset them we remove the requests matching the filter one by one.
+type statsResets struct {
+	lock   sync.Mutex
+	purged time.Time // the time of the last full reset
+	list   []statsReset
+}
+
+// The request has been already removed from the statistics
+func (r *statsResets) removed(entry *logEntry, host string) bool {
+	for i := range r.list {
+		if !entry.Time.After(r.list[i].when) && r.list[i].filter.match(entry, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remember the time of the full reset
+func (s *stats) markPurged() {
+	s.resets.lock.Lock()
+	s.resets.purged = time.Now()
+	s.resets.list = nil
+	s.resets.lock.Unlock()
+}
+
+// Decrement the value, but don't go below zero
+func (p *periodicStats) dec(name string, when time.Time, value float64) {
+	elapsed := int64(time.Since(when) / p.period)
+	if elapsed < 0 || elapsed >= statsHistoryElements {
+		return // outside of our timeframe
+	}
+	p.Lock()
+	currentValues, ok := p.entries[name]
+	if ok {
+		currentValues[elapsed] -= value
+		if currentValues[elapsed] < 0 {
+			currentValues[elapsed] = 0
+		}
+		p.entries[name] = currentValues
+	}
+	p.Unlock()
+}
+
+func (s *stats) decWithTime(c *counter, when time.Time) {
+	for _, p := range []*periodicStats{&s.perSecond, &s.perMinute, &s.perHour, &s.perDay} {
+		p.dec(c.name, when, 1)
+	}
+	c.Lock()
+	if c.value > 0 {
+		c.value--
+	}
+	c.Unlock()
+}
+
+func (s *stats) unobserveWithTime(h *histogram, value float64, when time.Time) {
+	for _, p := range []*periodicStats{&s.perSecond, &s.perMinute, &s.perHour, &s.perDay} {
+		p.dec(h.name+"_count", when, 1)
+		p.dec(h.name+"_sum", when, value)
+	}
+	h.Lock()
+	if h.count > 0 {
+		h.count--
+		h.total -= value
+	}
+	h.Unlock()
+}
+
+// decrementCounters removes the request from the statistics
+func (s *stats) decrementCounters(entry *logEntry) {
+	for _, c := range s.entryCounters(entry) {
+		s.decWithTime(c, entry.Time)
+	}
+	s.unobserveWithTime(s.elapsedTime, entry.Elapsed.Seconds(), entry.Time)
+}
+
+// Decrement the value, remove the key when it reaches zero
+func (h *hourTop) decrementValue(key string, cache gcache.Cache) bool {
+	h.Lock()
+	defer h.Unlock()
+	value, err := h.lockedGetValue(key, cache)
+	if err != nil || value == 0 {
+		return false
+	}
+	if value == 1 {
+		cache.Remove(key)
+		return true
+	}
+	err = cache.Set(key, value-1)
+	if err != nil {
+		log.Printf("Failed to set hourly top value: %s", err)
+	}
+	return true
+}
+
+// removeEntry removes the request from the top charts
+func (d *dayTop) removeEntry(entry *logEntry, host string, now time.Time) {
+	hour := int(now.Sub(entry.Time).Hours())
+	if hour < 0 || hour >= 24 {
+		return
+	}
+
+	d.hoursReadLock()
+	defer d.hoursReadUnlock()
+	// the hours are rotated since the start, not on the hour boundaries,
+	// so the request may be in the neighbouring bucket
+	for _, i := range []int{hour, hour - 1, hour + 1} {
+		if i < 0 || i >= len(d.hours) {
+			continue
+		}
+		h := d.hours[i]
+		if !h.decrementValue(host, h.domains) {
+			continue
+		}
+		if entry.Result.IsFiltered {
+			h.decrementValue(host, h.blocked)
+		}
+		if len(entry.IP) != 0 {
+			h.decrementValue(entry.IP, h.clients)
+		}
+		return
+	}
+}
+
+// Get the host name of the request
+func entryHost(entry *logEntry) string {
+	q := new(dns.Msg)
+	if len(entry.Question) == 0 || q.Unpack(entry.Question) != nil || len(q.Question) != 1 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(q.Question[0].Name, "."))
+}
+
+// resetStats removes the requests matching the filter from the statistics and the top charts
+// Returns the number of the removed requests
+func (l *queryLog) resetStats(s *stats, db *statsDB, f StatsResetFilter) (int, error) {
+	s.resets.lock.Lock()
+	defer s.resets.lock.Unlock()
+
+	// the queued requests must be found too
+	now := time.Now()
+	err := l.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	// the buffer mustn't be moved to the file while we're reading both of them
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	removed := 0
+	onEntry := func(entry *logEntry) error {
+		if entry.Time.After(now) {
+			return nil
+		}
+		host := entryHost(entry)
+		if len(host) == 0 || !f.match(entry, host) || s.resets.removed(entry, host) {
+			return nil
+		}
+		l.runningTop.removeEntry(entry, host, now)
+		if entry.Time.After(s.resets.purged) {
+			s.decrementCounters(entry)
+			if db != nil {
+				db.add(s, entry, -1)
+			}
+		}
+		removed++
+		return nil
+	}
+
+	needMore := func() bool { return true }
+	err = l.genericLoader(onEntry, needMore, queryLogTimeLimit)
+	if err != nil {
+		return removed, err
+	}
+
+	l.logBufferLock.RLock()
+	buffer := append([]*logEntry{}, l.logBuffer...)
+	l.logBufferLock.RUnlock()
+	for _, entry := range buffer {
+		_ = onEntry(entry)
+	}
+
+	// forget the resets which don't affect the stored requests anymore
+	list := []statsReset{}
+	for _, r := range s.resets.list {
+		if now.Sub(r.when) < queryLogTimeLimit {
+			list = append(list, r)
+		}
+	}
+	s.resets.list = append(list, statsReset{filter: f, when: now})
+
+	log.Info("Stats: removed %d requests (client:%q domain:%q start:%v end:%v)",
+		removed, f.Client, f.Domain, f.Start, f.End)
+	return removed, nil
+}
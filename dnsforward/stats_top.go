@@ -0,0 +1,221 @@
+// Top charts over a time range
+// The requests are counted by domain, blocked domain, client and upstream server in the hourly buckets of the statistics database.
+// Only the most frequent keys of each finished hour are kept, so the database and the memory needed
+// to calculate the charts don't grow with the number of the distinct domains and clients.
+
+package dnsforward
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const statsDBMaxTopPending = 100000 // the new keys which aren't written yet, the others are dropped
+
+const statsTopSchema = `
+CREATE TABLE IF NOT EXISTS stats_top (
+	hour     INTEGER NOT NULL, -- Unix time of the start of the hour
+	category TEXT NOT NULL,    -- domains, blocked, clients, upstreams, client_blocked or client_domains
+	key      TEXT NOT NULL,    -- domain name, client IP address, upstream address or "<client IP address> <domain name>"
+	value    REAL NOT NULL,
+	PRIMARY KEY (hour, category, key)
+) WITHOUT ROWID;
+`
+
+// The top charts
+const (
+	statsTopDomains       = "domains"
+	statsTopBlocked       = "blocked"
+	statsTopClients       = "clients"
+	statsTopUpstreams     = "upstreams"
+	statsTopClientBlocked = "client_blocked" // the blocked requests of the clients
+	statsTopClientDomains = "client_domains" // the domains requested by the clients
+)
+
+// the keys of a finished hour which are kept, the less frequent ones are removed
+var statsTopHourlyLimits = map[string]int{
+	statsTopDomains:       1000,
+	statsTopBlocked:       1000,
+	statsTopClients:       1000,
+	statsTopUpstreams:     1000,
+	statsTopClientBlocked: 1000,
+	statsTopClientDomains: 10000,
+}
+
+// ErrStatsNotStored is returned when the top charts are requested, but the statistics aren't stored
+var ErrStatsNotStored = errors.New("the statistics are not stored")
+
+// StatsTopItem is a line of the top chart
+type StatsTopItem struct {
+	Name  string  `json:"name"`
+	Count float64 `json:"count"`
+}
+
+// StatsTopReport is the top charts over a time range, the most frequent first
+type StatsTopReport struct {
+	Domains   []StatsTopItem // the requested domains
+	Blocked   []StatsTopItem // the blocked domains
+	Clients   []StatsTopItem // the client IP addresses
+	Upstreams []StatsTopItem // the upstream servers
+}
+
+type statsDBTopKey struct {
+	hour     int64
+	category string
+	key      string
+}
+
+// Count the request in the top charts of its hour
+// Must be called with the lock held
+func (d *statsDB) addTop(entry *logEntry, sign float64) {
+	hour := statsHour(entry.Time)
+	inc := func(category string, key string) {
+		if len(key) == 0 {
+			return
+		}
+		k := statsDBTopKey{hour, category, key}
+		if _, ok := d.topPending[k]; !ok && len(d.topPending) >= statsDBMaxTopPending {
+			return
+		}
+		d.topPending[k] += sign
+	}
+
+	host := entryHost(entry)
+	inc(statsTopDomains, host)
+	if entry.Result.IsFiltered {
+		inc(statsTopBlocked, host)
+	}
+	inc(statsTopClients, entry.IP)
+	inc(statsTopUpstreams, entry.Upstream)
+	if len(entry.IP) != 0 && len(host) != 0 {
+		if entry.Result.IsFiltered {
+			inc(statsTopClientBlocked, entry.IP)
+		}
+		inc(statsTopClientDomains, entry.IP+" "+host)
+	}
+}
+
+// Write the top charts changes
+func writeStatsTop(tx *sql.Tx, pending map[statsDBTopKey]float64) error {
+	update, err := tx.Prepare("UPDATE stats_top SET value = MAX(0, value + ?) WHERE hour = ? AND category = ? AND key = ?")
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	insert, err := tx.Prepare("INSERT INTO stats_top (hour, category, key, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for k, value := range pending {
+		res, err := update.Exec(value, k.hour, k.category, k.key)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		if n != 0 || value <= 0 {
+			continue
+		}
+		_, err = insert.Exec(k.hour, k.category, k.key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keep only the most frequent keys of the finished hour
+func (d *statsDB) compactTop(now time.Time) error {
+	hour := statsHour(now) - 3600
+	d.lock.Lock()
+	compacted := d.compacted
+	d.lock.Unlock()
+	if hour <= compacted {
+		return nil
+	}
+	for category, limit := range statsTopHourlyLimits {
+		_, err := d.db.Exec(`DELETE FROM stats_top WHERE hour = ?1 AND category = ?2 AND key NOT IN
+			(SELECT key FROM stats_top WHERE hour = ?1 AND category = ?2 ORDER BY value DESC LIMIT ?3)`,
+			hour, category, limit)
+		if err != nil {
+			return err
+		}
+	}
+	d.lock.Lock()
+	d.compacted = hour
+	d.lock.Unlock()
+	log.Debug("stats db: compacted the top charts of %s", time.Unix(hour, 0))
+	return nil
+}
+
+// Get the top chart over the time range
+func (d *statsDB) getTop(category string, start int64, end int64, limit int) ([]StatsTopItem, error) {
+	rows, err := d.db.Query(`SELECT key, SUM(value) AS total FROM stats_top
+		WHERE hour >= ? AND hour <= ? AND category = ?
+		GROUP BY key HAVING total > 0 ORDER BY total DESC, key LIMIT ?`,
+		start, end, category, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []StatsTopItem{}
+	for rows.Next() {
+		item := StatsTopItem{}
+		err = rows.Scan(&item.Name, &item.Count)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// getTopReport returns the top charts over the time range, the hours are included if they overlap with it
+func (d *statsDB) getTopReport(startTime time.Time, endTime time.Time, limit int) (*StatsTopReport, error) {
+	err := d.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	start := statsHour(startTime)
+	end := statsHour(endTime)
+	r := &StatsTopReport{}
+	for _, c := range []struct {
+		category string
+		items    *[]StatsTopItem
+	}{
+		{statsTopDomains, &r.Domains},
+		{statsTopBlocked, &r.Blocked},
+		{statsTopClients, &r.Clients},
+		{statsTopUpstreams, &r.Upstreams},
+	} {
+		*c.items, err = d.getTop(c.category, start, end, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// GetStatsTopReport returns the top charts over the time range
+// Returns ErrStatsNotStored if the statistics aren't stored
+func (s *Server) GetStatsTopReport(startTime time.Time, endTime time.Time, limit int) (*StatsTopReport, error) {
+	s.RLock()
+	db := s.statsDB
+	s.RUnlock()
+	if db == nil {
+		return nil, ErrStatsNotStored
+	}
+	return db.getTopReport(startTime, endTime, limit)
+}
+
+// GetStatsInterval returns for how long the statistics are stored (0: they aren't stored)
+func (s *Server) GetStatsInterval() time.Duration {
+	s.RLock()
+	defer s.RUnlock()
+	if s.statsDB == nil {
+		return 0
+	}
+	return time.Duration(s.statsDB.interval) * 24 * time.Hour
+}
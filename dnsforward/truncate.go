@@ -0,0 +1,38 @@
+// UDP responses are truncated to the client's buffer size (and to udp_max_response_size),
+// the client gets TC bit and retries over TCP.
+// Together with the rate limit and ANY requests refusal it keeps the server from being used for amplification attacks.
+
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// Get the max size of UDP response to the request
+func (s *Server) udpResponseSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	opt := req.IsEdns0()
+	if opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if s.conf.UDPMaxResponseSize != 0 && int(s.conf.UDPMaxResponseSize) < size {
+		size = int(s.conf.UDPMaxResponseSize)
+	}
+	return size
+}
+
+// Truncate the response to UDP request if it doesn't fit into the client's buffer
+func (s *Server) truncateUDPResponse(d *proxy.DNSContext) {
+	if d.Proto != proxy.ProtoUDP || d.Res == nil {
+		return
+	}
+	size := s.udpResponseSize(d.Req)
+	if d.Res.Len() <= size {
+		return
+	}
+	res := d.Res.Copy() // the response may be cached
+	res.Truncate(size)
+	log.Tracef("UDP response to %s is truncated to %d bytes", d.Addr, size)
+	d.Res = res
+}
@@ -0,0 +1,76 @@
+// Updating the running server
+// Reconfigure() restarts the listeners, so the requests which are being processed are dropped.
+// Update() applies the new filters, filtering settings and upstream servers without a restart:
+//  the new requests use a new DNS filter and a new (not listening) proxy which resolves them,
+//  the requests which are being processed are finished with the old ones.
+
+package dnsforward
+
+import (
+	"errors"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// The old DNS filter is destroyed after the requests which use it are finished
+const updateGracePeriod = 30 * time.Second
+
+// Get the proxy which resolves the request received by the proxy 'p'
+func (s *Server) upstreamProxy(p *proxy.Proxy) *proxy.Proxy {
+	s.RLock()
+	r := s.resolver
+	s.RUnlock()
+	if r != nil {
+		return r
+	}
+	return p
+}
+
+// Update applies the new configuration to the running server without restarting the listeners
+// Only the filters, the filtering settings and the upstream servers are changed.
+// The other settings must be the same as the current ones: they're applied by Reconfigure().
+func (s *Server) Update(config *ServerConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.dnsProxy == nil {
+		return errors.New("DNS server isn't running")
+	}
+
+	oldConf := s.conf
+	oldFilter := s.dnsFilter
+	s.conf = *config
+	err := s.initDNSFilter()
+	if err != nil {
+		s.conf = oldConf
+		s.dnsFilter = oldFilter
+		return err
+	}
+
+	proxyConfig := s.dnsProxy.Config
+	proxyConfig.Upstreams = s.upstreamStats.wrap(s.conf.Upstreams)
+	if len(proxyConfig.Upstreams) == 0 {
+		proxyConfig.Upstreams = defaultValues.Upstreams
+	}
+	proxyConfig.DomainsReservedUpstreams = map[string][]upstream.Upstream{}
+	for domain, upstreams := range s.conf.DomainsReservedUpstreams {
+		proxyConfig.DomainsReservedUpstreams[domain] = s.upstreamStats.wrap(upstreams)
+	}
+	proxyConfig.Fallbacks = s.upstreamStats.wrap(s.conf.FallbackUpstreams)
+	proxyConfig.AllServers = s.conf.AllServers
+	s.resolver = &proxy.Proxy{Config: proxyConfig}
+	s.conf.LocalPTRUpstreams = s.upstreamStats.wrap(s.conf.LocalPTRUpstreams)
+
+	// the cached answers of the previous upstream servers
+	if s.cache != nil {
+		s.cache.clear()
+	}
+
+	if oldFilter != nil {
+		time.AfterFunc(updateGracePeriod, oldFilter.Destroy)
+	}
+	log.Info("DNS server is updated")
+	return nil
+}
@@ -0,0 +1,168 @@
+// DNS-over-QUIC upstream servers (RFC 9250)
+// The QUIC connection to the server is kept open and reused by the following requests,
+// every request is sent on its own stream, so the concurrent requests don't wait for each other.
+// The connection is closed if there's no request within the idle timeout of the connection pools.
+// The host name of the server is resolved with the bootstrap servers when a new connection is opened.
+
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const doqDefaultPort = "853"
+
+// DNS-over-QUIC server
+type doqUpstream struct {
+	address     string
+	port        string
+	timeout     time.Duration
+	idleTimeout time.Duration
+	lookup      func() ([]net.IP, error)
+	tlsConfig   *tls.Config
+
+	lock sync.Mutex
+	conn quic.Connection // the open connection or nil
+}
+
+func newDOQUpstream(host string, port string, bootstrap []string, timeout time.Duration, pool PoolConfig) *doqUpstream {
+	return &doqUpstream{
+		address:     "quic://" + net.JoinHostPort(host, port),
+		port:        port,
+		timeout:     timeout,
+		idleTimeout: pool.withDefaults().IdleTimeout,
+		lookup:      bootstrapLookup(host, bootstrap, timeout),
+		tlsConfig: &tls.Config{
+			ServerName:         host,
+			RootCAs:            upstream.RootCAs,
+			NextProtos:         []string{doqALPN},
+			MinVersion:         tls.VersionTLS13,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+	}
+}
+
+func (u *doqUpstream) Address() string { return u.address }
+
+func (u *doqUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.getConn()
+	if err != nil {
+		return nil, err
+	}
+	res, err := u.exchangeConn(conn, m)
+	if err != nil && conn.Context().Err() != nil {
+		// the connection was closed by the server: try once more with a new connection
+		log.Tracef("DOQ upstream %s: the connection is closed, reconnecting", u.address)
+		u.resetConn(conn)
+		conn, err = u.getConn()
+		if err != nil {
+			return nil, err
+		}
+		res, err = u.exchangeConn(conn, m)
+	}
+	return res, err
+}
+
+// Get the open connection or open a new one
+func (u *doqUpstream) getConn() (quic.Connection, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn != nil && u.conn.Context().Err() == nil {
+		return u.conn, nil
+	}
+	u.conn = nil
+
+	ips, err := u.lookup()
+	if err != nil {
+		return nil, err
+	}
+	qc := &quic.Config{
+		HandshakeIdleTimeout: u.timeout,
+		MaxIdleTimeout:       u.idleTimeout,
+	}
+	for _, ip := range ips {
+		ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+		var conn quic.Connection
+		conn, err = quic.DialAddr(ctx, net.JoinHostPort(ip.String(), u.port), u.tlsConfig, qc)
+		cancel()
+		if err == nil {
+			u.conn = conn
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no addresses")
+	}
+	return nil, err
+}
+
+// Close the connection if it's still used by the upstream
+func (u *doqUpstream) resetConn(conn quic.Connection) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn == conn {
+		u.conn = nil
+	}
+	_ = conn.CloseWithError(0, "")
+}
+
+// Send the request on a new stream of the connection and read the response
+func (u *doqUpstream) exchangeConn(conn quic.Connection, m *dns.Msg) (*dns.Msg, error) {
+	// the message ID must be 0 (RFC 9250 section 4.2.1)
+	req := m.Copy()
+	req.Id = 0
+	packet, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_ = stream.SetDeadline(time.Now().Add(u.timeout))
+
+	buf := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+	copy(buf[2:], packet)
+	_, err = stream.Write(buf)
+	if err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	// the client closes its side of the stream after the request
+	_ = stream.Close()
+
+	var length uint16
+	err = binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	packet = make([]byte, length)
+	_, err = io.ReadFull(stream, packet)
+	if err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	res := &dns.Msg{}
+	err = res.Unpack(packet)
+	if err != nil {
+		return nil, err
+	}
+	res.Id = m.Id
+	return res, nil
+}
@@ -0,0 +1,490 @@
+// Connection pools of the plain DNS and DNS-over-TLS upstream servers
+// TCP and TLS connections are kept open and reused by the following requests (RFC 7766 6.2.1),
+// so the TCP fallback and DNS-over-TLS requests don't pay for the handshakes every time.
+// If pipelining is enabled, several requests are sent over a connection without waiting for the responses,
+// the responses are matched to the requests by ID and may arrive in any order.
+
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPoolSize        = 4
+	defaultPoolIdleTimeout = 30 * time.Second
+	maxPipelinedRequests   = 64 // max number of requests waiting for the responses on a connection
+)
+
+// PoolConfig is the configuration of TCP and TLS connections to an upstream server
+type PoolConfig struct {
+	Size        int           // max number of connections kept open (0: default)
+	Pipelining  bool          // if true, several requests may be sent over a connection without waiting for the responses
+	IdleTimeout time.Duration // connection is closed if there's no request within this time (0: default)
+}
+
+func (c PoolConfig) withDefaults() PoolConfig {
+	if c.Size <= 0 {
+		c.Size = defaultPoolSize
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = defaultPoolIdleTimeout
+	}
+	return c
+}
+
+// the error returned if there's no response within the upstream timeout
+type poolTimeoutError struct{}
+
+func (poolTimeoutError) Error() string   { return "i/o timeout" }
+func (poolTimeoutError) Timeout() bool   { return true }
+func (poolTimeoutError) Temporary() bool { return true }
+
+// the connection with the requests waiting for the responses
+type poolConn struct {
+	conn        *dns.Conn
+	idleTimeout time.Duration
+
+	writeLock sync.Mutex // the requests are written one by one
+
+	lock    sync.Mutex
+	pending map[uint16]chan *dns.Msg // request ID -> channel for the response
+	closed  bool
+}
+
+func newPoolConn(conn net.Conn, idleTimeout time.Duration) *poolConn {
+	c := &poolConn{
+		conn:        &dns.Conn{Conn: conn},
+		idleTimeout: idleTimeout,
+		pending:     map[uint16]chan *dns.Msg{},
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	go c.readLoop()
+	return c
+}
+
+// Get the number of the requests waiting for the responses, -1 if the connection is closed
+func (c *poolConn) load() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return -1
+	}
+	return len(c.pending)
+}
+
+// Register a new request unless the connection is closed or has "limit" requests waiting for the responses
+// Returns the request ID which is unique on this connection
+func (c *poolConn) reserve(limit int, timeout time.Duration) (uint16, chan *dns.Msg, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed || len(c.pending) >= limit {
+		return 0, nil, false
+	}
+	id := dns.Id()
+	for c.pending[id] != nil {
+		id = dns.Id()
+	}
+	ch := make(chan *dns.Msg, 1)
+	c.pending[id] = ch
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	return id, ch, true
+}
+
+// Forget the request, the connection is closed if it stays idle
+// Must be called with the lock held
+func (c *poolConn) release(id uint16) {
+	delete(c.pending, id)
+	if len(c.pending) == 0 && !c.closed {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
+// Close the connection, the requests waiting for the responses fail
+func (c *poolConn) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	_ = c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// Pass the responses to the requests until the connection is closed or times out
+func (c *poolConn) readLoop() {
+	for {
+		res, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close()
+			return
+		}
+		id := res.Id // the response belongs to the request after it's sent to the channel
+		c.lock.Lock()
+		ch, ok := c.pending[id]
+		if ok {
+			ch <- res
+			c.release(id)
+		}
+		c.lock.Unlock()
+		if !ok {
+			log.Debug("Unexpected response with ID %d from %s", id, c.conn.RemoteAddr())
+		}
+	}
+}
+
+// Send the request registered with reserve() and wait for the response
+func (c *poolConn) exchange(m *dns.Msg, id uint16, ch chan *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	req := m.Copy()
+	req.Id = id
+	c.writeLock.Lock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := c.conn.WriteMsg(req)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("connection is closed")
+		}
+		res.Id = m.Id
+		return res, nil
+	case <-timer.C:
+		c.lock.Lock()
+		c.release(id)
+		c.lock.Unlock()
+		return nil, poolTimeoutError{}
+	}
+}
+
+// the connections to an upstream server
+type connPool struct {
+	address string // for the error messages
+	dial    func() (net.Conn, error)
+	conf    PoolConfig
+	timeout time.Duration
+
+	lock  sync.Mutex
+	conns []*poolConn
+}
+
+func newConnPool(address string, dial func() (net.Conn, error), conf PoolConfig, timeout time.Duration) *connPool {
+	return &connPool{
+		address: address,
+		dial:    dial,
+		conf:    conf.withDefaults(),
+		timeout: timeout,
+	}
+}
+
+func (p *connPool) limit() int {
+	if p.conf.Pipelining {
+		return maxPipelinedRequests
+	}
+	return 1
+}
+
+// Register the request on the least busy of the open connections
+// Returns nil if a new connection should be opened:
+// there's no free connection, or all connections are busy and the pool isn't full yet
+func (p *connPool) get() (*poolConn, uint16, chan *dns.Msg) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var best *poolConn
+	bestLoad := 0
+	conns := p.conns[:0]
+	for _, c := range p.conns {
+		n := c.load()
+		if n < 0 {
+			continue // closed
+		}
+		conns = append(conns, c)
+		if n < p.limit() && (best == nil || n < bestLoad) {
+			best = c
+			bestLoad = n
+		}
+	}
+	for i := len(conns); i != len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = conns
+
+	if best == nil || (bestLoad != 0 && len(p.conns) < p.conf.Size) {
+		return nil, 0, nil
+	}
+	id, ch, ok := best.reserve(p.limit(), p.timeout)
+	if !ok {
+		return nil, 0, nil
+	}
+	return best, id, ch
+}
+
+// Open a new connection and register the request on it
+// Returns FALSE if the pool is full: the connection must be closed after the request
+func (p *connPool) connect() (*poolConn, uint16, chan *dns.Msg, bool, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, 0, nil, false, errorx.Decorate(err, "couldn't connect to %s", p.address)
+	}
+	c := newPoolConn(conn, p.conf.IdleTimeout)
+	id, ch, _ := c.reserve(p.limit(), p.timeout)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.conns) >= p.conf.Size {
+		return c, id, ch, false, nil
+	}
+	p.conns = append(p.conns, c)
+	return c, id, ch, true, nil
+}
+
+func (p *connPool) exchange(m *dns.Msg) (*dns.Msg, error) {
+	c, id, ch := p.get()
+	if c != nil {
+		res, err := c.exchange(m, id, ch, p.timeout)
+		if err == nil || isTimeout(err) {
+			return res, err
+		}
+		// the server may have closed the idle connection
+		log.Tracef("Reused connection to %s failed: %s, reconnecting", p.address, err)
+	}
+
+	c, id, ch, pooled, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	if !pooled {
+		defer c.close()
+	}
+	res, err := c.exchange(m, id, ch, p.timeout)
+	if err != nil {
+		return nil, errorx.Decorate(err, "exchange with %s failed", p.address)
+	}
+	return res, nil
+}
+
+// plain DNS server: the requests are sent over UDP, TCP is used if the response is truncated
+// tcp:// servers get all requests over TCP
+type pooledPlainUpstream struct {
+	address   string
+	timeout   time.Duration
+	preferTCP bool
+	pool      *connPool
+}
+
+func (u *pooledPlainUpstream) Address() string { return u.address }
+
+func (u *pooledPlainUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	if !u.preferTCP {
+		client := dns.Client{Timeout: u.timeout, UDPSize: dns.MaxMsgSize}
+		res, _, err := client.Exchange(m, u.address)
+		if err != nil || res == nil || !res.Truncated {
+			return res, err
+		}
+		log.Tracef("Truncated message was received, retrying over TCP, question: %s", m.Question[0].String())
+	}
+	return u.pool.exchange(m)
+}
+
+// DNS-over-TLS server
+type pooledTLSUpstream struct {
+	address string
+	pool    *connPool
+}
+
+func (u *pooledTLSUpstream) Address() string { return u.address }
+
+func (u *pooledTLSUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	return u.pool.exchange(m)
+}
+
+// Get the function which resolves the host name of the server with the bootstrap servers
+func bootstrapLookup(host string, bootstrap []string, timeout time.Duration) func() ([]net.IP, error) {
+	resolvers := []*upstream.Resolver{}
+	for _, addr := range bootstrap {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		resolvers = append(resolvers, upstream.NewResolver(addr, timeout))
+	}
+	if len(resolvers) == 0 {
+		resolvers = append(resolvers, upstream.NewResolver("", timeout))
+	}
+
+	return func() ([]net.IP, error) {
+		ip := net.ParseIP(host)
+		if ip != nil {
+			return []net.IP{ip}, nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		addrs, err := upstream.LookupParallel(ctx, resolvers, host)
+		cancel()
+		if err != nil {
+			return nil, errorx.Decorate(err, "couldn't resolve %s", host)
+		}
+		ips := []net.IP{}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+		return ips, nil
+	}
+}
+
+// Get the function which opens a TLS connection to the server
+// The host name is resolved with the bootstrap servers on each connection, so the changes of the address are noticed.
+func tlsDialer(host string, port string, bootstrap []string, timeout time.Duration) func() (net.Conn, error) {
+	lookup := bootstrapLookup(host, bootstrap, timeout)
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		RootCAs:    upstream.RootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return func() (net.Conn, error) {
+		ips, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+
+		dialer := &net.Dialer{Timeout: timeout}
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(ip.String(), port), tlsConfig)
+			if err == nil {
+				return conn, nil
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("no addresses")
+		}
+		return nil, err
+	}
+}
+
+// AddressToUpstream creates the upstream server like upstream.AddressToUpstream,
+// but plain DNS and DNS-over-TLS servers keep their TCP and TLS connections open and reuse them
+func AddressToUpstream(address string, opts upstream.Options, pool PoolConfig) (upstream.Upstream, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	if !strings.Contains(address, "://") {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		return newPooledPlainUpstream(address, false, timeout, pool), nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errorx.Decorate(err, "failed to parse %s", address)
+	}
+	hostPort := func(port string) string {
+		if len(u.Port()) == 0 {
+			return net.JoinHostPort(u.Hostname(), port)
+		}
+		return u.Host
+	}
+	switch u.Scheme {
+	case "dns":
+		return newPooledPlainUpstream(hostPort("53"), false, timeout, pool), nil
+	case "tcp":
+		return newPooledPlainUpstream(hostPort("53"), true, timeout, pool), nil
+	case "tls":
+		addr := hostPort("853")
+		host, port, _ := net.SplitHostPort(addr)
+		dial := tlsDialer(host, port, opts.Bootstrap, timeout)
+		return &pooledTLSUpstream{
+			address: "tls://" + addr,
+			pool:    newConnPool(addr, dial, pool, timeout),
+		}, nil
+	case "quic":
+		host, port, _ := net.SplitHostPort(hostPort(doqDefaultPort))
+		return newDOQUpstream(host, port, opts.Bootstrap, timeout, pool), nil
+	}
+	return upstream.AddressToUpstream(address, opts)
+}
+
+func newPooledPlainUpstream(address string, preferTCP bool, timeout time.Duration, pool PoolConfig) *pooledPlainUpstream {
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	return &pooledPlainUpstream{
+		address:   address,
+		timeout:   timeout,
+		preferTCP: preferTCP,
+		pool:      newConnPool(address, dial, pool, timeout),
+	}
+}
+
+// ParseUpstreamsConfig parses the upstreams configuration like proxy.ParseUpstreamsConfig,
+// but the upstream servers are created with AddressToUpstream
+func ParseUpstreamsConfig(lines []string, bootstrap []string, timeout time.Duration, pool PoolConfig) (proxy.UpstreamConfig, error) {
+	conf := proxy.UpstreamConfig{
+		Upstreams:               []upstream.Upstream{},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{},
+	}
+	opts := upstream.Options{Bootstrap: bootstrap, Timeout: timeout}
+	for _, line := range lines {
+		addr := line
+		domains := ""
+		if strings.HasPrefix(line, "[/") && strings.Contains(line, "/]") {
+			i := strings.Index(line, "/]") + 2
+			domains, addr = line[:i], line[i:]
+		}
+		// the line is checked and its domains are parsed by dnsproxy,
+		// which doesn't know DNS-over-QUIC: the address is checked by us
+		checkLine := line
+		if strings.HasPrefix(addr, "quic://") {
+			checkLine = domains + "127.0.0.1"
+		}
+		lineConf, err := proxy.ParseUpstreamsConfig([]string{checkLine}, bootstrap, timeout)
+		if err != nil {
+			return proxy.UpstreamConfig{}, err
+		}
+
+		if len(lineConf.DomainReservedUpstreams) != 0 && addr == "#" {
+			for host := range lineConf.DomainReservedUpstreams {
+				conf.DomainReservedUpstreams[host] = nil
+			}
+			continue
+		}
+
+		u, err := AddressToUpstream(addr, opts, pool)
+		if err != nil {
+			return proxy.UpstreamConfig{}, fmt.Errorf("cannot prepare the upstream %s (%s): %s", addr, bootstrap, err)
+		}
+		if len(lineConf.DomainReservedUpstreams) == 0 {
+			conf.Upstreams = append(conf.Upstreams, u)
+			continue
+		}
+		for host := range lineConf.DomainReservedUpstreams {
+			conf.DomainReservedUpstreams[host] = append(conf.DomainReservedUpstreams[host], u)
+		}
+	}
+	return conf, nil
+}
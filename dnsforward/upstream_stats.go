@@ -0,0 +1,157 @@
+// Per-upstream statistics: the number of requests, errors and timeouts,
+// the response codes and the latency histogram.
+// The upstream servers are wrapped, so every exchange is accounted, including the failed ones
+// and the requests sent to several servers in parallel.
+
+package dnsforward
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/joomcode/errorx"
+	"github.com/miekg/dns"
+)
+
+// the upper bounds of the latency histogram buckets, in milliseconds
+// The last bucket of the histogram has the slower responses.
+var upstreamLatencyBuckets = []int64{10, 20, 50, 100, 200, 500, 1000, 2000}
+
+type upstreamStat struct {
+	requests  uint64
+	errors    uint64 // including timeouts
+	timeouts  uint64
+	rcodes    map[string]uint64 // response code -> the number of responses
+	latency   []uint64          // the number of responses in each latency bucket
+	totalTime time.Duration     // the total time of the successful exchanges
+}
+
+type upstreamStats struct {
+	lock  sync.Mutex
+	stats map[string]*upstreamStat // upstream address -> stats
+}
+
+func newUpstreamStats() *upstreamStats {
+	return &upstreamStats{stats: map[string]*upstreamStat{}}
+}
+
+// Return TRUE if the error is a timeout
+func isTimeout(err error) bool {
+	for err != nil {
+		ne, ok := err.(net.Error)
+		if ok && ne.Timeout() {
+			return true
+		}
+		e, ok := err.(*errorx.Error)
+		if !ok {
+			return false
+		}
+		err = e.Cause()
+	}
+	return false
+}
+
+// Account the exchange with the upstream server
+func (s *upstreamStats) record(addr string, elapsed time.Duration, res *dns.Msg, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st, ok := s.stats[addr]
+	if !ok {
+		st = &upstreamStat{
+			rcodes:  map[string]uint64{},
+			latency: make([]uint64, len(upstreamLatencyBuckets)+1),
+		}
+		s.stats[addr] = st
+	}
+
+	st.requests++
+	if err != nil || res == nil {
+		st.errors++
+		if isTimeout(err) {
+			st.timeouts++
+		}
+		return
+	}
+
+	st.rcodes[dns.RcodeToString[res.Rcode]]++
+	st.totalTime += elapsed
+	ms := int64(elapsed / time.Millisecond)
+	i := sort.Search(len(upstreamLatencyBuckets), func(i int) bool {
+		return ms <= upstreamLatencyBuckets[i]
+	})
+	st.latency[i]++
+}
+
+// Remove all statistics
+func (s *upstreamStats) purge() {
+	s.lock.Lock()
+	s.stats = map[string]*upstreamStat{}
+	s.lock.Unlock()
+}
+
+// Get the statistics in a JSON-ready form, sorted by the upstream address
+func (s *upstreamStats) get() []map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addrs := []string{}
+	for addr := range s.stats {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	data := []map[string]interface{}{}
+	for _, addr := range addrs {
+		st := s.stats[addr]
+		avg := 0.0
+		if st.requests != st.errors {
+			avg = float64(st.totalTime) / float64(st.requests-st.errors) / float64(time.Millisecond)
+		}
+		rcodes := map[string]uint64{}
+		for k, v := range st.rcodes {
+			rcodes[k] = v
+		}
+		data = append(data, map[string]interface{}{
+			"address":             addr,
+			"requests":            st.requests,
+			"errors":              st.errors,
+			"timeouts":            st.timeouts,
+			"avg_processing_time": avg,
+			"rcodes":              rcodes,
+			"latency":             append([]uint64{}, st.latency...),
+		})
+	}
+	return data
+}
+
+// the upstream server which accounts its exchanges in the statistics
+type statsUpstream struct {
+	upstream.Upstream
+	stats *upstreamStats
+}
+
+func (u *statsUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	res, err := u.Upstream.Exchange(m)
+	u.stats.record(u.Address(), time.Since(start), res, err)
+	return res, err
+}
+
+// Get the list of upstream servers which account their exchanges in the statistics
+func (s *upstreamStats) wrap(upstreams []upstream.Upstream) []upstream.Upstream {
+	if upstreams == nil {
+		return nil
+	}
+	wrapped := make([]upstream.Upstream, len(upstreams))
+	for i, u := range upstreams {
+		// the configuration may be reused when the server is restarted
+		if su, ok := u.(*statsUpstream); ok {
+			u = su.Upstream
+		}
+		wrapped[i] = &statsUpstream{Upstream: u, stats: s}
+	}
+	return wrapped
+}
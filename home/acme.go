@@ -0,0 +1,382 @@
+// Automatic certificate issuance via ACME (e.g. Let's Encrypt)
+// The certificate and its private key are written to data/acme/ and used as the certificate files
+// (certificate_path, private_key_path), so the listeners pick up the renewed certificate without restarting.
+// The settings are in the configuration file only: DNS provider settings may contain credentials or commands.
+
+package home
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/acme"
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/utils"
+)
+
+const (
+	acmeDir            = "acme"
+	acmeAccountKeyFile = "account.key"
+	acmeCertFile       = "cert.pem"
+	acmeKeyFile        = "key.pem"
+
+	acmeCheckPeriod = 12 * time.Hour
+	acmeTimeout     = 10 * time.Minute
+)
+
+type acmeConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Email   string   `yaml:"email"`   // the contact address of the account (optional)
+	Domains []string `yaml:"domains"` // the first domain is the certificate subject, "*.example.org" requires dns-01
+
+	Challenge         string            `yaml:"challenge"`           // "http-01" or "dns-01"
+	DNSProvider       string            `yaml:"dns_provider"`        // "exec", "rfc2136"
+	DNSProviderConfig map[string]string `yaml:"dns_provider_config"` // the settings of the DNS provider
+	PropagationDelay  uint32            `yaml:"propagation_delay"`   // the time to wait for TXT record to propagate (in seconds)
+
+	DirectoryURL    string `yaml:"directory_url"`     // the directory of the certificate authority
+	RenewBeforeDays uint32 `yaml:"renew_before_days"` // renew the certificate when it expires in this number of days
+}
+
+type acmeState struct {
+	httpSolver  *acme.HTTP01Solver // serves HTTP-01 challenge responses
+	running     bool
+	lastAttempt time.Time
+	lastError   string
+	lock        sync.Mutex
+}
+
+var acmeCtx = acmeState{httpSolver: acme.NewHTTP01Solver()}
+
+// Get the paths of the account key, the certificate and the private key
+func acmePaths() (string, string, string) {
+	dir := filepath.Join(config.ourWorkingDir, dataDir, acmeDir)
+	return filepath.Join(dir, acmeAccountKeyFile), filepath.Join(dir, acmeCertFile), filepath.Join(dir, acmeKeyFile)
+}
+
+// Load the account key or create a new one
+func loadOrCreateACMEAccountKey(fn string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err == nil {
+		return data, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := acme.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err = acme.MarshalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(fn, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("ACME: created the account key: %s", fn)
+	return data, nil
+}
+
+// Parse the first certificate of the chain
+func parseCertificatePEM(data []byte) *x509.Certificate {
+	b, _ := pem.Decode(data)
+	if b == nil || b.Type != "CERTIFICATE" {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+// Return TRUE if the certificate is missing, expires soon or doesn't cover all the domains
+func acmeNeedsRenewal(certPEM []byte, domains []string, renewBefore time.Duration, now time.Time) bool {
+	cert := parseCertificatePEM(certPEM)
+	if cert == nil || now.Add(renewBefore).After(cert.NotAfter) {
+		return true
+	}
+	for _, d := range domains {
+		// a wildcard domain is checked with a name it covers
+		if cert.VerifyHostname(strings.Replace(d, "*", "wildcard-check", 1)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the settings before talking to the certificate authority
+func validateACMEConfig(c acmeConfig) error {
+	if len(c.Domains) == 0 {
+		return fmt.Errorf("no domains")
+	}
+	for _, d := range c.Domains {
+		wildcard := strings.HasPrefix(d, "*.")
+		if wildcard && c.Challenge != "dns-01" {
+			return fmt.Errorf("%s: a wildcard domain requires dns-01 challenge", d)
+		}
+		err := utils.IsValidHostname(strings.TrimPrefix(d, "*."))
+		if err != nil {
+			return fmt.Errorf("%s: %s", d, err)
+		}
+	}
+	if c.Challenge != "http-01" && c.Challenge != "dns-01" {
+		return fmt.Errorf("unknown challenge type: %s", c.Challenge)
+	}
+	return nil
+}
+
+// Create the solver for the configured challenge
+// Returns the function which stops the temporary listener.
+func acmeSolver(c acmeConfig) (acme.Solver, func(), error) {
+	if c.Challenge == "dns-01" {
+		prov, err := acme.NewDNSProvider(c.DNSProvider, c.DNSProviderConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := &acme.DNS01Solver{
+			Provider:         prov,
+			PropagationDelay: time.Duration(c.PropagationDelay) * time.Second,
+		}
+		return s, func() {}, nil
+	}
+
+	config.RLock()
+	bindHost, bindPort := config.BindHost, config.BindPort
+	config.RUnlock()
+	if bindPort == 80 {
+		// our web server serves the responses
+		return acmeCtx.httpSolver, func() {}, nil
+	}
+
+	// the certificate authority connects to port 80 only: listen on it while the certificate is issued
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindHost, "80"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("http-01 challenge requires port 80: %s", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(acme.HTTP01Path, acmeCtx.httpSolver)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	return acmeCtx.httpSolver, func() { _ = srv.Close() }, nil
+}
+
+// Get the certificate from the certificate authority and use it
+func obtainACMECertificate() error {
+	config.RLock()
+	c := config.ACME
+	config.RUnlock()
+	err := validateACMEConfig(c)
+	if err != nil {
+		return err
+	}
+
+	accountKeyFile, certFile, keyFile := acmePaths()
+	data, err := loadOrCreateACMEAccountKey(accountKeyFile)
+	if err != nil {
+		return fmt.Errorf("account key: %s", err)
+	}
+	accountKey, err := acme.ParseKey(data)
+	if err != nil {
+		return fmt.Errorf("account key: %s", err)
+	}
+
+	solver, stop, err := acmeSolver(c)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	client := &acme.Client{DirectoryURL: c.DirectoryURL, Key: accountKey}
+	ctx, cancel := context.WithTimeout(context.Background(), acmeTimeout)
+	defer cancel()
+	log.Info("ACME: requesting the certificate for %v", c.Domains)
+	chain, key, err := client.Obtain(ctx, c.Email, c.Domains, solver)
+	if err != nil {
+		return err
+	}
+
+	// write the key first: the certificate is checked for renewal
+	err = ioutil.WriteFile(keyFile, key, 0600)
+	if err != nil {
+		return fmt.Errorf("can't write %s: %s", keyFile, err)
+	}
+	err = file.SafeWrite(certFile, chain)
+	if err != nil {
+		return fmt.Errorf("can't write %s: %s", certFile, err)
+	}
+	log.Info("ACME: received the certificate for %v", c.Domains)
+
+	applyACMECertificate(certFile, keyFile, c.Domains[0])
+	return nil
+}
+
+// Use the certificate files for the HTTPS, DNS-over-HTTPS and DNS-over-TLS listeners
+func applyACMECertificate(certFile, keyFile, serverName string) {
+	config.Lock()
+	changed := config.TLS.CertificatePath != certFile || config.TLS.PrivateKeyPath != keyFile || !config.TLS.Enabled
+	config.TLS.CertificatePath = certFile
+	config.TLS.PrivateKeyPath = keyFile
+	config.TLS.Enabled = true
+	if len(config.TLS.ServerName) == 0 {
+		config.TLS.ServerName = strings.TrimPrefix(serverName, "*.")
+	}
+	config.pendingTLS = nil
+	config.Unlock()
+
+	reloadTLSFiles()
+	if changed {
+		_ = writeAllConfigs()
+	}
+}
+
+// Obtain the certificate unless another attempt is in progress
+func renewACMECertificate() error {
+	acmeCtx.lock.Lock()
+	if acmeCtx.running {
+		acmeCtx.lock.Unlock()
+		return fmt.Errorf("the certificate is being obtained already")
+	}
+	acmeCtx.running = true
+	acmeCtx.lastAttempt = time.Now()
+	acmeCtx.lock.Unlock()
+
+	err := obtainACMECertificate()
+
+	acmeCtx.lock.Lock()
+	acmeCtx.running = false
+	acmeCtx.lastError = ""
+	if err != nil {
+		acmeCtx.lastError = err.Error()
+	}
+	acmeCtx.lock.Unlock()
+	if err != nil {
+		log.Error("ACME: %s", err)
+	}
+	return err
+}
+
+// Renew the certificate if it expires soon
+func checkACMERenewal() {
+	config.RLock()
+	c := config.ACME
+	firstRun := config.firstRun
+	config.RUnlock()
+	if !c.Enabled || firstRun {
+		return
+	}
+
+	_, certFile, keyFile := acmePaths()
+	data, _ := ioutil.ReadFile(certFile)
+	renewBefore := time.Duration(c.RenewBeforeDays) * 24 * time.Hour
+	if !acmeNeedsRenewal(data, c.Domains, renewBefore, time.Now()) {
+		// the certificate may have been obtained while the settings were different
+		applyACMECertificate(certFile, keyFile, c.Domains[0])
+		return
+	}
+	_ = renewACMECertificate()
+}
+
+func periodicallyRenewACMECertificate() {
+	for {
+		checkACMERenewal()
+		time.Sleep(acmeCheckPeriod)
+	}
+}
+
+type acmeStatusJSON struct {
+	Enabled     bool       `json:"enabled"`
+	Domains     []string   `json:"domains"`
+	Challenge   string     `json:"challenge"`
+	Running     bool       `json:"running"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	NotAfter    *time.Time `json:"not_after,omitempty"` // the expiration time of the obtained certificate
+}
+
+func handleACMEStatus(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	resp := acmeStatusJSON{
+		Enabled:   config.ACME.Enabled,
+		Domains:   config.ACME.Domains,
+		Challenge: config.ACME.Challenge,
+	}
+	config.RUnlock()
+
+	acmeCtx.lock.Lock()
+	resp.Running = acmeCtx.running
+	resp.LastError = acmeCtx.lastError
+	if !acmeCtx.lastAttempt.IsZero() {
+		t := acmeCtx.lastAttempt
+		resp.LastAttempt = &t
+	}
+	acmeCtx.lock.Unlock()
+
+	_, certFile, _ := acmePaths()
+	data, err := ioutil.ReadFile(certFile)
+	if err == nil {
+		cert := parseCertificatePEM(data)
+		if cert != nil {
+			resp.NotAfter = &cert.NotAfter
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// Obtain the certificate now
+// It may take minutes, so the result is reported by /control/tls/acme/status.
+func handleACMERenew(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	c := config.ACME
+	config.RUnlock()
+	if !c.Enabled {
+		httpError(w, http.StatusBadRequest, "ACME is disabled")
+		return
+	}
+	err := validateACMEConfig(c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "ACME: %s", err)
+		return
+	}
+	acmeCtx.lock.Lock()
+	running := acmeCtx.running
+	acmeCtx.lock.Unlock()
+	if running {
+		httpError(w, http.StatusBadRequest, "The certificate is being obtained already")
+		return
+	}
+
+	go func() {
+		_ = renewACMECertificate()
+	}()
+	returnOK(w)
+}
@@ -0,0 +1,60 @@
+package home
+
+import (
+	"testing"
+	"time"
+)
+
+func TestACMENeedsRenewal(t *testing.T) {
+	ca, _, err := createLocalCA("example.org")
+	if err != nil {
+		t.Fatalf("createLocalCA: %s", err)
+	}
+	chain, _, err := ca.issue("*.example.org", nil)
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+	cert := parseCertificatePEM([]byte(chain))
+	if cert == nil {
+		t.Fatalf("parseCertificatePEM")
+	}
+
+	renewBefore := 30 * 24 * time.Hour
+	now := time.Now()
+	if acmeNeedsRenewal([]byte(chain), []string{"*.example.org", "www.example.org"}, renewBefore, now) {
+		t.Fatalf("the certificate is valid")
+	}
+	if !acmeNeedsRenewal(nil, []string{"*.example.org"}, renewBefore, now) {
+		t.Fatalf("no certificate")
+	}
+	if !acmeNeedsRenewal([]byte(chain), []string{"example.org"}, renewBefore, now) {
+		t.Fatalf("the domain isn't covered")
+	}
+	if !acmeNeedsRenewal([]byte(chain), []string{"*.example.org"}, renewBefore, cert.NotAfter.Add(-renewBefore/2)) {
+		t.Fatalf("the certificate expires soon")
+	}
+}
+
+func TestValidateACMEConfig(t *testing.T) {
+	c := acmeConfig{Challenge: "http-01", Domains: []string{"example.org"}}
+	if err := validateACMEConfig(c); err != nil {
+		t.Fatalf("validateACMEConfig: %s", err)
+	}
+	c.Domains = []string{"*.example.org"}
+	if validateACMEConfig(c) == nil {
+		t.Fatalf("a wildcard domain requires dns-01")
+	}
+	c.Challenge = "dns-01"
+	if err := validateACMEConfig(c); err != nil {
+		t.Fatalf("validateACMEConfig: %s", err)
+	}
+	c.Domains = nil
+	if validateACMEConfig(c) == nil {
+		t.Fatalf("no domains")
+	}
+	c.Domains = []string{"example.org"}
+	c.Challenge = "tls-alpn-01"
+	if validateACMEConfig(c) == nil {
+		t.Fatalf("unknown challenge")
+	}
+}
@@ -0,0 +1,202 @@
+// Audit log
+// The configuration changes (audit_config.go) and the actions which remove data
+// (e.g. the statistics and the query log resets) are recorded
+// with the user who performed them, one JSON object per line.
+// The file is rotated when it grows too big: the previous one is kept as audit.log.1.
+
+package home
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	auditLogFileName = "audit.log"
+	auditLogMaxSize  = 10 * 1024 * 1024
+	auditQueryLimit  = 100 // default number of records returned by /control/audit
+)
+
+var auditLogLock sync.Mutex
+
+type auditRecord struct {
+	Time     string                 `json:"time"`
+	User     string                 `json:"user"`      // empty if the authentication is disabled
+	Address  string                 `json:"remote_ip"` // the address of the user
+	Action   string                 `json:"action"`    // e.g. stats_reset, config_change
+	Endpoint string                 `json:"endpoint,omitempty"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+	Changes  []auditChange          `json:"changes,omitempty"`
+}
+
+func auditLogPath() string {
+	return filepath.Join(config.ourWorkingDir, dataDir, auditLogFileName)
+}
+
+func newAuditRecord(r *http.Request, action string, details map[string]interface{}) auditRecord {
+	rec := auditRecord{
+		Time:    time.Now().Format(time.RFC3339),
+		User:    requestUser(r),
+		Address: r.RemoteAddr,
+		Action:  action,
+		Details: details,
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		rec.Address = host
+	}
+	return rec
+}
+
+// auditLog records the action performed by the user
+func auditLog(r *http.Request, action string, details map[string]interface{}) {
+	writeAuditRecord(newAuditRecord(r, action, details))
+}
+
+func writeAuditRecord(rec auditRecord) {
+	if rec.Endpoint != "" {
+		log.Info("Audit: %s %s by %q from %s: %d changes", rec.Action, rec.Endpoint, rec.User, rec.Address, len(rec.Changes))
+	} else {
+		log.Info("Audit: %s by %q from %s: %v", rec.Action, rec.User, rec.Address, rec.Details)
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Error("audit: %s", err)
+		return
+	}
+	data = append(data, '\n')
+
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+	path := auditLogPath()
+	st, err := os.Stat(path)
+	if err == nil && st.Size()+int64(len(data)) > auditLogMaxSize {
+		err = os.Rename(path, path+".1")
+		if err != nil {
+			log.Error("audit: %s", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, privateFileMode)
+	if err != nil {
+		log.Error("audit: %s", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	if err != nil {
+		log.Error("audit: %s", err)
+	}
+}
+
+// The conditions of the audit log search
+type auditFilter struct {
+	user   string
+	action string
+	since  time.Time
+	limit  int
+}
+
+func (f *auditFilter) match(rec *auditRecord) bool {
+	if f.user != "" && rec.User != f.user {
+		return false
+	}
+	if f.action != "" && rec.Action != f.action {
+		return false
+	}
+	if !f.since.IsZero() {
+		t, err := time.Parse(time.RFC3339, rec.Time)
+		if err != nil || t.Before(f.since) {
+			return false
+		}
+	}
+	return true
+}
+
+// Read the records from the file, the newest first
+func readAuditLog(f auditFilter) ([]auditRecord, error) {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	all := []auditRecord{}
+	for _, path := range []string{auditLogPath() + ".1", auditLogPath()} {
+		file, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		sc := bufio.NewScanner(file)
+		sc.Buffer(make([]byte, 64*1024), auditLogMaxSize)
+		for sc.Scan() {
+			rec := auditRecord{}
+			err = json.Unmarshal(sc.Bytes(), &rec)
+			if err != nil || !f.match(&rec) {
+				continue
+			}
+			all = append(all, rec)
+		}
+		err = sc.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := []auditRecord{}
+	for i := len(all) - 1; i >= 0 && len(result) != f.limit; i-- {
+		result = append(result, all[i])
+	}
+	return result, nil
+}
+
+// Get the audit log records
+// Parameters: user, action, since (RFC 3339), limit
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	q := r.URL.Query()
+	f := auditFilter{
+		user:   q.Get("user"),
+		action: q.Get("action"),
+		limit:  auditQueryLimit,
+	}
+	var err error
+	if s := q.Get("since"); s != "" {
+		f.since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "since: %s", err)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		f.limit, err = strconv.Atoi(s)
+		if err != nil || f.limit <= 0 {
+			httpError(w, http.StatusBadRequest, "invalid limit: %s", s)
+			return
+		}
+	}
+
+	records, err := readAuditLog(f)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't read the audit log: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(records)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+func registerAuditHandlers() {
+	http.HandleFunc("/control/audit", postInstall(optionalAuth(ensureGET(handleAudit))))
+}
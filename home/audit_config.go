@@ -0,0 +1,271 @@
+// Audit of the configuration changes
+// The settings are compared before and after every request which may change them (not GET),
+//  and the changed values are recorded to the audit log with the user and the endpoint.
+// The lists of objects (clients, filters, users...) are compared object by object,
+//  the lists of strings (upstreams, rules...) show the added and the removed items.
+// The secrets are recorded as "(hidden)".
+
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	auditHidden          = "(hidden)"
+	auditMaxChanges      = 100 // changes in a record
+	auditMaxChangedItems = 20  // added or removed items of a list in a change
+)
+
+// The keys of the objects in the lists
+var auditObjectKeys = []string{"id", "name", "url", "domain"}
+
+// The values which are never recorded
+var auditSecretKeys = []string{"password", "private_key", "certificate_chain", "secret", "hash", "recovery_codes", "dns_provider_config", "sync.key", "sync.token", "ha.token"}
+
+type auditChange struct {
+	Key     string      `json:"key"` // e.g. "dns.upstream_dns", "clients[laptop]"
+	Before  interface{} `json:"before,omitempty"`
+	After   interface{} `json:"after,omitempty"`
+	Added   []string    `json:"added,omitempty"`
+	Removed []string    `json:"removed,omitempty"`
+}
+
+func auditSecretKey(key string) bool {
+	for _, s := range auditSecretKeys {
+		if strings.HasSuffix(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the settings as flat key -> value map
+func configSnapshot() map[string]interface{} {
+	config.RLock()
+	data, err := yaml.Marshal(&config)
+	config.RUnlock()
+	if err != nil {
+		log.Error("audit: %s", err)
+		return nil
+	}
+	var v interface{}
+	err = yaml.Unmarshal(data, &v)
+	if err != nil {
+		log.Error("audit: %s", err)
+		return nil
+	}
+
+	clients.lock.Lock()
+	list := []clientObject{}
+	for _, c := range clientsGetList() {
+		list = append(list, toClientObject(c))
+	}
+	clients.lock.Unlock()
+	data, err = yaml.Marshal(list)
+	if err != nil {
+		log.Error("audit: %s", err)
+		return nil
+	}
+	var cv interface{}
+	_ = yaml.Unmarshal(data, &cv)
+
+	snap := map[string]interface{}{}
+	flattenConfig("", normalizeYAML(v), snap)
+	flattenConfig("clients", normalizeYAML(cv), snap)
+	delete(snap, "schema_version")
+	return snap
+}
+
+// Convert the maps from YAML decoder so they can be encoded to JSON
+func normalizeYAML(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, val := range vv {
+			m[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(vv))
+		for i := range vv {
+			l[i] = normalizeYAML(vv[i])
+		}
+		return l
+	}
+	return v
+}
+
+// Get the key of the object in a list
+func auditObjectKey(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	for _, k := range auditObjectKeys {
+		if id, ok := m[k]; ok && fmt.Sprint(id) != "" {
+			return fmt.Sprint(id), true
+		}
+	}
+	return "", false
+}
+
+func flattenConfig(prefix string, v interface{}, snap map[string]interface{}) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, val := range vv {
+			flattenConfig(join(k), val, snap)
+		}
+		return
+
+	case []interface{}:
+		objects := map[string]interface{}{}
+		strs := []string{}
+		for _, item := range vv {
+			if key, ok := auditObjectKey(item); ok {
+				if _, dup := objects[key]; !dup {
+					objects[key] = item
+					continue
+				}
+			}
+			if _, ok := item.(map[string]interface{}); ok {
+				// an object without a unique key: the whole list is a single value
+				snap[prefix] = vv
+				return
+			}
+			strs = append(strs, fmt.Sprint(item))
+		}
+		for key, item := range objects {
+			snap[prefix+"["+key+"]"] = item
+		}
+		if len(strs) != 0 || len(objects) == 0 {
+			snap[prefix] = strs
+		}
+		return
+	}
+
+	snap[prefix] = v
+}
+
+// Replace the secrets in the value
+func auditMask(key string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	if auditSecretKey(key) {
+		return auditHidden
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	masked := map[string]interface{}{}
+	for k, val := range m {
+		masked[k] = auditMask(k, val)
+	}
+	return masked
+}
+
+// Get the items of a which aren't in b
+func stringsMissing(a, b []string) []string {
+	set := map[string]bool{}
+	for _, s := range b {
+		set[s] = true
+	}
+	missing := []string{}
+	for _, s := range a {
+		if !set[s] {
+			missing = append(missing, s)
+		}
+	}
+	if len(missing) > auditMaxChangedItems {
+		n := len(missing) - auditMaxChangedItems
+		missing = append(missing[:auditMaxChangedItems], fmt.Sprintf("... and %d more", n))
+	}
+	return missing
+}
+
+// Compare the snapshots
+func diffConfigSnapshots(before, after map[string]interface{}) []auditChange {
+	keys := []string{}
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []auditChange{}
+	for _, k := range keys {
+		b, a := before[k], after[k]
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		bl, bIsList := b.([]string)
+		al, aIsList := a.([]string)
+		if (bIsList || b == nil) && (aIsList || a == nil) && !auditSecretKey(k) {
+			ch := auditChange{Key: k, Added: stringsMissing(al, bl), Removed: stringsMissing(bl, al)}
+			if len(ch.Added)+len(ch.Removed) == 0 {
+				// only the order has changed
+				ch.Before, ch.After = bl, al
+			}
+			changes = append(changes, ch)
+		} else {
+			changes = append(changes, auditChange{Key: k, Before: auditMask(k, b), After: auditMask(k, a)})
+		}
+		if len(changes) == auditMaxChanges {
+			break
+		}
+	}
+	return changes
+}
+
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Record the configuration changes made by the handler
+func auditConfigChanges(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+		before := configSnapshot()
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+		if sw.status >= http.StatusMultipleChoices {
+			return
+		}
+		changes := diffConfigSnapshots(before, configSnapshot())
+		if len(changes) == 0 {
+			return
+		}
+		rec := newAuditRecord(r, "config_change", nil)
+		rec.Endpoint = r.URL.Path
+		rec.Changes = changes
+		writeAuditRecord(rec)
+	}
+}
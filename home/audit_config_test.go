@@ -0,0 +1,87 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffConfigSnapshots(t *testing.T) {
+	before := map[string]interface{}{}
+	flattenConfig("", normalizeYAML(map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{
+			"upstream_dns":  []interface{}{"8.8.8.8", "1.1.1.1"},
+			"blocking_mode": "nxdomain",
+		},
+		"users": []interface{}{
+			map[interface{}]interface{}{"name": "admin", "password": "$2a$10$old"},
+		},
+	}), before)
+	after := map[string]interface{}{}
+	flattenConfig("", normalizeYAML(map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{
+			"upstream_dns":  []interface{}{"1.1.1.1", "tls://9.9.9.9"},
+			"blocking_mode": "nxdomain",
+		},
+		"users": []interface{}{
+			map[interface{}]interface{}{"name": "admin", "password": "$2a$10$new"},
+			map[interface{}]interface{}{"name": "kid", "password": "$2a$10$kid"},
+		},
+	}), after)
+
+	changes := diffConfigSnapshots(before, after)
+	if len(changes) != 3 {
+		t.Fatalf("changes: %+v", changes)
+	}
+	ch := changes[0]
+	if ch.Key != "dns.upstream_dns" || len(ch.Added) != 1 || ch.Added[0] != "tls://9.9.9.9" ||
+		len(ch.Removed) != 1 || ch.Removed[0] != "8.8.8.8" {
+		t.Fatalf("upstreams: %+v", ch)
+	}
+	ch = changes[1]
+	if ch.Key != "users[admin]" || ch.Before.(map[string]interface{})["password"] != auditHidden ||
+		ch.After.(map[string]interface{})["password"] != auditHidden {
+		t.Fatalf("password: %+v", ch)
+	}
+	ch = changes[2]
+	if ch.Key != "users[kid]" || ch.Before != nil || ch.After.(map[string]interface{})["name"] != "kid" {
+		t.Fatalf("new user: %+v", ch)
+	}
+}
+
+func TestAuditConfigChanges(t *testing.T) {
+	defer prepareTestAuth(t)()
+	_ = os.MkdirAll(filepath.Join(config.ourWorkingDir, dataDir), 0755)
+	upstreams := config.DNS.UpstreamDNS
+	defer func() { config.DNS.UpstreamDNS = upstreams }()
+	config.DNS.UpstreamDNS = []string{"8.8.8.8"}
+
+	handler := optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		config.DNS.UpstreamDNS = []string{"1.1.1.1"}
+	})
+	r := httptest.NewRequest("POST", "/control/set_upstreams_config", nil)
+	r.SetBasicAuth("admin", "secret")
+	handler(httptest.NewRecorder(), r)
+
+	// GET requests aren't recorded
+	r = httptest.NewRequest("GET", "/control/status", nil)
+	r.SetBasicAuth("admin", "secret")
+	handler(httptest.NewRecorder(), r)
+
+	records, err := readAuditLog(auditFilter{action: "config_change", limit: 10})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("records: %+v %v", records, err)
+	}
+	rec := records[0]
+	if rec.User != "admin" || rec.Endpoint != "/control/set_upstreams_config" ||
+		len(rec.Changes) != 1 || rec.Changes[0].Key != "dns.upstream_dns" {
+		t.Fatalf("record: %+v", rec)
+	}
+
+	records, _ = readAuditLog(auditFilter{user: "kid", limit: 10})
+	if len(records) != 0 {
+		t.Fatalf("filter by user: %+v", records)
+	}
+}
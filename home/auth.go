@@ -0,0 +1,616 @@
+// Web interface authentication
+// The users and their bcrypt password hashes are stored in the configuration file.
+// A successful login creates a session: its random token is sent in a cookie,
+//  the sessions are stored in data/sessions.db and survive the restart.
+// HTTP Basic authentication is still accepted, e.g. from the scripts.
+// The address which fails to log in too many times is blocked for a while.
+// The second factor is optional for every user (auth_totp.go).
+
+package home
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionsFileName  = "sessions.db"
+	sessionCookieName = "agh_session"
+	sessionTokenSize  = 16 // bytes
+
+	// the window in which the failed login attempts are counted
+	authAttemptsWindow = 15 * time.Minute
+
+	// the password of an unknown user is compared with this hash,
+	//  so the response time doesn't reveal whether the user exists
+	dummyPasswordHash = "$2a$10$akQf1l/x.h0fawqClNrGcuvvvMUf.hjZyAGE54SRzr0vtl5pzm.tC"
+)
+
+type webUser struct {
+	Name         string `yaml:"name"`
+	PasswordHash string `yaml:"password"` // bcrypt hash
+
+	Role string `yaml:"role,omitempty"` // admin or read-only (empty: admin)
+
+	TOTPSecret    string   `yaml:"totp_secret,omitempty"`    // base32; empty: no second factor
+	RecoveryCodes []string `yaml:"recovery_codes,omitempty"` // SHA-256 hashes of the unused recovery codes
+}
+
+type session struct {
+	User   string `json:"user"`
+	Expire int64  `json:"expire"` // Unix time
+}
+
+// The failed login attempts from an address
+type authAttempts struct {
+	num          uint
+	first        time.Time // the first failed attempt in the window
+	blockedUntil time.Time
+}
+
+var auth struct {
+	sync.Mutex
+	sessions map[string]session // token (hex) -> session
+	attempts map[string]*authAttempts
+}
+
+type authInfoKey struct{}
+
+// Return TRUE if the web interface requires authentication
+func authRequired() bool {
+	config.RLock()
+	defer config.RUnlock()
+	return len(config.Users) != 0
+}
+
+// Get the user with this name.  The config lock must be held.
+func findWebUser(name string) *webUser {
+	for i := range config.Users {
+		if config.Users[i].Name == name {
+			return &config.Users[i]
+		}
+	}
+	return nil
+}
+
+// Check the user's password
+// Returns the user name if the credentials are correct.
+func checkUserPassword(name, password string) (string, bool) {
+	config.RLock()
+	u := findWebUser(name)
+	hash := dummyPasswordHash
+	if u != nil {
+		hash = u.PasswordHash
+	}
+	config.RUnlock()
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if u == nil {
+		return "", false
+	}
+	return name, err == nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func sessionsFilePath() string {
+	return filepath.Join(config.ourWorkingDir, dataDir, sessionsFileName)
+}
+
+// Load the sessions from the file
+func initAuth() {
+	auth.Lock()
+	defer auth.Unlock()
+	auth.sessions = map[string]session{}
+	auth.attempts = map[string]*authAttempts{}
+
+	data, err := ioutil.ReadFile(sessionsFilePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Auth: %s", err)
+		}
+		return
+	}
+	err = json.Unmarshal(data, &auth.sessions)
+	if err != nil {
+		log.Error("Auth: %s: %s", sessionsFilePath(), err)
+		auth.sessions = map[string]session{}
+		return
+	}
+	removeExpiredSessions(time.Now())
+	log.Debug("Auth: loaded %d sessions", len(auth.sessions))
+}
+
+// The auth lock must be held
+func removeExpiredSessions(now time.Time) {
+	for token, s := range auth.sessions {
+		if now.Unix() >= s.Expire {
+			delete(auth.sessions, token)
+		}
+	}
+}
+
+// Write the sessions to the file.  The auth lock must be held.
+func storeSessions() {
+	data, err := json.Marshal(auth.sessions)
+	if err != nil {
+		log.Error("Auth: %s", err)
+		return
+	}
+	path := sessionsFilePath()
+	err = file.SafeWrite(path, data)
+	if err != nil {
+		log.Error("Auth: couldn't store the sessions: %s", err)
+		return
+	}
+	secureFile(path)
+}
+
+func sessionTTL() time.Duration {
+	config.RLock()
+	defer config.RUnlock()
+	return time.Duration(config.WebSessionTTL) * time.Hour
+}
+
+// Create a new session for the user
+func createSession(user string) (string, time.Time, error) {
+	buf := make([]byte, sessionTokenSize)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expire := time.Now().Add(sessionTTL())
+
+	auth.Lock()
+	removeExpiredSessions(time.Now())
+	auth.sessions[token] = session{User: user, Expire: expire.Unix()}
+	storeSessions()
+	auth.Unlock()
+	return token, expire, nil
+}
+
+// Get the user of the session
+func checkSession(token string) (string, bool) {
+	auth.Lock()
+	defer auth.Unlock()
+	s, ok := auth.sessions[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().Unix() >= s.Expire {
+		delete(auth.sessions, token)
+		storeSessions()
+		return "", false
+	}
+	return s.User, true
+}
+
+func removeSession(token string) {
+	auth.Lock()
+	defer auth.Unlock()
+	if _, ok := auth.sessions[token]; ok {
+		delete(auth.sessions, token)
+		storeSessions()
+	}
+}
+
+// Remove all sessions of the user, e.g. after the password is changed
+func removeUserSessions(user string) {
+	auth.Lock()
+	defer auth.Unlock()
+	n := 0
+	for token, s := range auth.sessions {
+		if s.User == user {
+			delete(auth.sessions, token)
+			n++
+		}
+	}
+	if n != 0 {
+		storeSessions()
+	}
+}
+
+// Return TRUE if the address is blocked because of the failed login attempts
+func authBlocked(addr string) bool {
+	auth.Lock()
+	defer auth.Unlock()
+	a, ok := auth.attempts[addr]
+	return ok && time.Now().Before(a.blockedUntil)
+}
+
+// Count the login attempt from this address
+func recordAuthAttempt(addr string, success bool) {
+	config.RLock()
+	maxAttempts := config.AuthAttempts
+	blockDuration := time.Duration(config.AuthBlockMin) * time.Minute
+	config.RUnlock()
+
+	auth.Lock()
+	defer auth.Unlock()
+	if success {
+		delete(auth.attempts, addr)
+		return
+	}
+	if maxAttempts == 0 {
+		return
+	}
+
+	now := time.Now()
+	a, ok := auth.attempts[addr]
+	if !ok || now.Sub(a.first) > authAttemptsWindow {
+		a = &authAttempts{first: now}
+		auth.attempts[addr] = a
+	}
+	a.num++
+	if a.num >= maxAttempts {
+		a.blockedUntil = now.Add(blockDuration)
+		a.num = 0
+		a.first = now
+		log.Info("Auth: %s is blocked for %s after %d failed login attempts", addr, blockDuration, maxAttempts)
+	}
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Who has sent the request
+type authInfo struct {
+	user string // the user name or "token:" and the API token name
+	role string
+}
+
+// Authenticate the request by the session cookie, the API token or the Basic authentication
+// Returns the HTTP status code for the error.
+func authenticate(r *http.Request) (authInfo, int) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil {
+		user, ok := checkSession(cookie.Value)
+		if ok {
+			return authInfo{user: user, role: userRole(user)}, 0
+		}
+	}
+
+	addr := remoteHost(r)
+	token, ok := bearerToken(r)
+	if ok {
+		if authBlocked(addr) {
+			return authInfo{}, http.StatusTooManyRequests
+		}
+		t, ok := checkAPIToken(token)
+		recordAuthAttempt(addr, ok)
+		if !ok {
+			return authInfo{}, http.StatusUnauthorized
+		}
+		return authInfo{user: "token:" + t.Name, role: t.Scope}, 0
+	}
+
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		return authInfo{}, http.StatusUnauthorized
+	}
+	if authBlocked(addr) {
+		return authInfo{}, http.StatusTooManyRequests
+	}
+	user, ok := checkUserPassword(name, pass)
+	if ok && userHasTOTP(user) {
+		// the second factor can't be sent this way
+		return authInfo{}, http.StatusUnauthorized
+	}
+	recordAuthAttempt(addr, ok)
+	if !ok {
+		return authInfo{}, http.StatusUnauthorized
+	}
+	return authInfo{user: user, role: userRole(user)}, 0
+}
+
+// Get the name of the authenticated user who sent the request
+// Empty if the authentication is disabled.
+func requestUser(r *http.Request) string {
+	a, _ := r.Context().Value(authInfoKey{}).(authInfo)
+	return a.user
+}
+
+// Get the role of the user who sent the request
+func requestRole(r *http.Request) string {
+	a, ok := r.Context().Value(authInfoKey{}).(authInfo)
+	if !ok {
+		// the authentication is disabled
+		return roleAdmin
+	}
+	return a.role
+}
+
+func withAuthInfo(r *http.Request, a authInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authInfoKey{}, a))
+}
+
+type loginJSON struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	OTP      string `json:"otp"` // the one-time password or a recovery code, if the user has the second factor
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := loginJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	addr := remoteHost(r)
+	if authBlocked(addr) {
+		httpError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+		return
+	}
+	user, ok := checkUserPassword(req.Name, req.Password)
+	if !ok {
+		recordAuthAttempt(addr, false)
+		log.Info("Auth: failed login of %q from %s", req.Name, addr)
+		httpError(w, http.StatusUnauthorized, "Invalid user name or password")
+		return
+	}
+	if userHasTOTP(user) {
+		if len(req.OTP) == 0 {
+			// the password is correct: the client asks for the code and repeats the request
+			httpError(w, http.StatusUnauthorized, "Two-factor authentication code is required")
+			return
+		}
+		// a used recovery code is removed from the configuration file
+		controlLock.Lock()
+		ok = checkSecondFactor(user, req.OTP)
+		controlLock.Unlock()
+		if !ok {
+			recordAuthAttempt(addr, false)
+			log.Info("Auth: invalid two-factor code of %q from %s", user, addr)
+			httpError(w, http.StatusUnauthorized, "Invalid two-factor authentication code")
+			return
+		}
+	}
+	recordAuthAttempt(addr, true)
+
+	token, expire, err := createSession(user)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't create a session: %s", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expire,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		// with force_https the login over plain HTTP is redirected to HTTPS, so the cookie is never sent over plain HTTP
+		Secure: r.TLS != nil,
+	})
+	log.Info("Auth: %q logged in from %s", user, addr)
+	returnOK(w)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil {
+		removeSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+	returnOK(w)
+}
+
+type userJSON struct {
+	Name        string `json:"name"`
+	Password    string `json:"password,omitempty"` // empty: don't change the password of the existing user
+	Role        string `json:"role"`
+	TOTPEnabled bool   `json:"totp_enabled"` // read-only
+}
+
+func handleUsersList(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	resp := []userJSON{}
+	for _, u := range config.Users {
+		role := u.Role
+		if role == "" {
+			role = roleAdmin
+		}
+		resp = append(resp, userJSON{Name: u.Name, Role: role, TOTPEnabled: len(u.TOTPSecret) != 0})
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// Add a user or change the password or the role of the existing one
+func handleUsersSet(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := userJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if len(req.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "user name is required")
+		return
+	}
+	if !validRole(req.Role) {
+		httpError(w, http.StatusBadRequest, "invalid role %q", req.Role)
+		return
+	}
+	if req.Role == roleAdmin {
+		req.Role = ""
+	}
+	hash := ""
+	if len(req.Password) != 0 {
+		hash, err = hashPassword(req.Password)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+
+	config.Lock()
+	users := append([]webUser{}, config.Users...)
+	var u *webUser
+	for i := range users {
+		if users[i].Name == req.Name {
+			u = &users[i]
+		}
+	}
+	if u == nil {
+		if len(hash) == 0 {
+			config.Unlock()
+			httpError(w, http.StatusBadRequest, "password is required")
+			return
+		}
+		users = append(users, webUser{Name: req.Name, PasswordHash: hash, Role: req.Role})
+	} else {
+		if len(hash) != 0 {
+			u.PasswordHash = hash
+		}
+		u.Role = req.Role
+	}
+	err = checkAdminRemains(users)
+	if err == nil {
+		config.Users = users
+	}
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if u != nil && len(hash) != 0 {
+		removeUserSessions(req.Name)
+	}
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+func handleUsersDelete(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := userJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	config.Lock()
+	found := false
+	users := []webUser{}
+	for _, u := range config.Users {
+		if u.Name == req.Name {
+			found = true
+			continue
+		}
+		users = append(users, u)
+	}
+	err = checkAdminRemains(users)
+	if found && err == nil {
+		config.Users = users
+	}
+	config.Unlock()
+	if !found {
+		httpError(w, http.StatusBadRequest, "user %q not found", req.Name)
+		return
+	}
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	removeUserSessions(req.Name)
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// Check the users from the configuration file
+func validateWebUsers(users []webUser) error {
+	names := map[string]bool{}
+	for _, u := range users {
+		if len(u.Name) == 0 {
+			return fmt.Errorf("users: empty user name")
+		}
+		if names[u.Name] {
+			return fmt.Errorf("users: duplicate user %q", u.Name)
+		}
+		names[u.Name] = true
+		if !validRole(u.Role) {
+			return fmt.Errorf("users: %q: invalid role %q", u.Name, u.Role)
+		}
+		if len(u.TOTPSecret) != 0 {
+			_, err := base32NoPad.DecodeString(strings.ToUpper(u.TOTPSecret))
+			if err != nil {
+				return fmt.Errorf("users: %q: invalid totp_secret: %s", u.Name, err)
+			}
+		}
+		_, err := bcrypt.Cost([]byte(u.PasswordHash))
+		if err != nil {
+			return fmt.Errorf("users: %q: the password must be a bcrypt hash: %s", u.Name, err)
+		}
+	}
+	return checkAdminRemains(users)
+}
+
+func registerAuthHandlers() {
+	http.HandleFunc("/control/login", postInstall(ensureMethod("POST", handleLogin)))
+	http.HandleFunc("/control/logout", postInstall(ensurePOST(handleLogout)))
+	http.HandleFunc("/control/users/list", postInstall(optionalAuth(ensureGET(handleUsersList))))
+	http.HandleFunc("/control/users/set", postInstall(optionalAuth(ensurePOST(handleUsersSet))))
+	http.HandleFunc("/control/users/delete", postInstall(optionalAuth(ensurePOST(handleUsersDelete))))
+	registerTOTPHandlers()
+	registerAPITokenHandlers()
+}
@@ -0,0 +1,88 @@
+// Roles of the web interface users
+// admin: everything
+// read-only: the dashboard, the statistics, the query log and the settings, but no changes.
+// The role is checked for every request of an authenticated user (optionalAuth):
+//  the handlers which change something accept only POST, so a read-only user may send only GET requests.
+
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	roleAdmin    = "admin"
+	roleReadOnly = "read-only"
+)
+
+// GET handlers which show the secrets (the private key, the users and the API tokens, the backup, the synced settings) and the audit log
+var adminOnlyPaths = map[string]bool{
+	"/control/tls/status":      true,
+	"/control/users/list":      true,
+	"/control/api_tokens/list": true,
+	"/control/audit":           true,
+	"/control/backup":          true,
+	"/control/sync/export":     true,
+}
+
+// POST handlers which any user may use: they don't change the settings or change only the user's own ones
+var readOnlyPostPaths = map[string]bool{
+	"/control/logout":       true,
+	"/control/version.json": true,
+}
+
+func validRole(role string) bool {
+	return role == "" || role == roleAdmin || role == roleReadOnly
+}
+
+// Get the role of the user
+// Everybody is admin if the authentication is disabled.
+func userRole(name string) string {
+	config.RLock()
+	defer config.RUnlock()
+	if len(config.Users) == 0 {
+		return roleAdmin
+	}
+	u := findWebUser(name)
+	if u == nil {
+		return roleReadOnly
+	}
+	if u.Role == "" {
+		return roleAdmin
+	}
+	return u.Role
+}
+
+// Return TRUE if the request is sent by an admin
+func requestIsAdmin(r *http.Request) bool {
+	return requestRole(r) == roleAdmin
+}
+
+// Check whether the user with this role may send the request
+func roleAllows(role string, r *http.Request) bool {
+	if role == roleAdmin {
+		return true
+	}
+	if readOnlyPostPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/control/totp/") {
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return !adminOnlyPaths[r.URL.Path]
+}
+
+// Check that there's an admin while there are any users at all
+func checkAdminRemains(users []webUser) error {
+	if len(users) == 0 {
+		return nil
+	}
+	for _, u := range users {
+		if u.Role == "" || u.Role == roleAdmin {
+			return nil
+		}
+	}
+	return fmt.Errorf("at least one user must have %s role", roleAdmin)
+}
@@ -0,0 +1,261 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func prepareTestAuth(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "agh-auth")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	workDir, users, attempts, blockMin := config.ourWorkingDir, config.Users, config.AuthAttempts, config.AuthBlockMin
+	config.ourWorkingDir = dir
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	config.Users = []webUser{{Name: "admin", PasswordHash: string(hash)}}
+	config.AuthAttempts = 3
+	config.AuthBlockMin = 1
+	initAuth()
+	return func() {
+		config.ourWorkingDir, config.Users, config.AuthAttempts, config.AuthBlockMin = workDir, users, attempts, blockMin
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAuthSession(t *testing.T) {
+	defer prepareTestAuth(t)()
+
+	var user string
+	handler := optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		user = requestUser(r)
+	})
+
+	// login
+	body := bytes.NewBufferString(`{"name":"admin","password":"secret"}`)
+	w := httptest.NewRecorder()
+	handleLogin(w, httptest.NewRequest("POST", "/control/login", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: %d %s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("cookie: %+v", cookies)
+	}
+
+	// the sessions survive the restart
+	initAuth()
+	r := httptest.NewRequest("GET", "/control/status", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || user != "admin" {
+		t.Fatalf("session: %d %q", w.Code, user)
+	}
+
+	// logout
+	w = httptest.NewRecorder()
+	handleLogout(w, r)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("after logout: %d", w.Code)
+	}
+
+	// Basic authentication
+	r = httptest.NewRequest("GET", "/control/status", nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK || user != "admin" {
+		t.Fatalf("basic auth: %d %q", w.Code, user)
+	}
+}
+
+// The password is checked without controlLock, so a slow settings change doesn't block the login
+func TestAuthLoginUnlocked(t *testing.T) {
+	defer prepareTestAuth(t)()
+
+	controlLock.Lock()
+	defer controlLock.Unlock()
+	done := make(chan int)
+	go func() {
+		body := bytes.NewBufferString(`{"name":"admin","password":"secret"}`)
+		w := httptest.NewRecorder()
+		ensureMethod("POST", handleLogin)(w, httptest.NewRequest("POST", "/control/login", body))
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusOK {
+			t.Fatalf("login: %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the login waits for controlLock")
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	defer prepareTestAuth(t)()
+
+	login := func(pass string) int {
+		body := bytes.NewBufferString(`{"name":"admin","password":"` + pass + `"}`)
+		w := httptest.NewRecorder()
+		handleLogin(w, httptest.NewRequest("POST", "/control/login", body))
+		return w.Code
+	}
+	for i := 0; i < 3; i++ {
+		if code := login("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: %d", i, code)
+		}
+	}
+	// even the correct password isn't accepted now
+	if code := login("secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("blocked: %d", code)
+	}
+}
+
+func TestCheckUserPassword(t *testing.T) {
+	defer prepareTestAuth(t)()
+
+	if name, ok := checkUserPassword("admin", "secret"); !ok || name != "admin" {
+		t.Fatalf("valid credentials: %q %v", name, ok)
+	}
+	if _, ok := checkUserPassword("admin", "wrong"); ok {
+		t.Fatalf("wrong password")
+	}
+	// the unknown user is checked against the dummy hash
+	if _, ok := checkUserPassword("nobody", "not a password"); ok {
+		t.Fatalf("unknown user")
+	}
+}
+
+func TestInstallConfigureEmptyPassword(t *testing.T) {
+	body := bytes.NewBufferString(`{"web":{"port":3000},"dns":{"port":53},"username":"admin","password":""}`)
+	w := httptest.NewRecorder()
+	handleInstallConfigure(w, httptest.NewRequest("POST", "/control/install/configure", body))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("empty password: %d", w.Code)
+	}
+}
+
+func TestValidateWebUsers(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if validateWebUsers([]webUser{{Name: "a", PasswordHash: string(hash)}}) != nil {
+		t.Fatalf("valid user")
+	}
+	if validateWebUsers([]webUser{{Name: "a", PasswordHash: "secret"}}) == nil {
+		t.Fatalf("plain text password")
+	}
+	if validateWebUsers([]webUser{{Name: "a", PasswordHash: string(hash)}, {Name: "a", PasswordHash: string(hash)}}) == nil {
+		t.Fatalf("duplicate user")
+	}
+}
+
+func TestAuthRoles(t *testing.T) {
+	defer prepareTestAuth(t)()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("family"), bcrypt.MinCost)
+	config.Users = append(config.Users, webUser{Name: "kid", PasswordHash: string(hash), Role: roleReadOnly})
+
+	called := false
+	handler := optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	send := func(method, path, user, pass string) int {
+		called = false
+		r := httptest.NewRequest(method, path, nil)
+		r.SetBasicAuth(user, pass)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code == http.StatusOK && !called {
+			t.Fatalf("%s %s: the handler isn't called", method, path)
+		}
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/control/stats", http.StatusOK},
+		{"GET", "/control/querylog", http.StatusOK},
+		{"POST", "/control/filtering/add_url", http.StatusForbidden},
+		{"POST", "/control/set_upstreams_config", http.StatusForbidden},
+		{"GET", "/control/tls/status", http.StatusForbidden},
+		{"POST", "/control/logout", http.StatusOK},
+		{"POST", "/control/totp/enroll", http.StatusOK},
+	} {
+		if code := send(tc.method, tc.path, "kid", "family"); code != tc.code {
+			t.Fatalf("read-only %s %s: %d", tc.method, tc.path, code)
+		}
+		if code := send(tc.method, tc.path, "admin", "secret"); code != http.StatusOK {
+			t.Fatalf("admin %s %s: %d", tc.method, tc.path, code)
+		}
+	}
+
+	if checkAdminRemains(config.Users[1:]) == nil {
+		t.Fatalf("no admin")
+	}
+	if validateWebUsers([]webUser{{Name: "a", PasswordHash: string(hash), Role: "root"}}) == nil {
+		t.Fatalf("invalid role")
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	defer prepareTestAuth(t)()
+	configFile := config.ourConfigFilename
+	config.ourConfigFilename = config.ourWorkingDir + "/AdGuardHome.yaml"
+	apiTokens := config.APITokens
+	defer func() { config.ourConfigFilename, config.APITokens = configFile, apiTokens }()
+	config.APITokens = nil
+
+	// create a read-only token
+	r := httptest.NewRequest("POST", "/control/api_tokens/create", bytes.NewBufferString(`{"name":"ha","scope":"read-only"}`))
+	w := httptest.NewRecorder()
+	handleAPITokensCreate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	created := apiTokenCreatedJSON{}
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+	if len(config.APITokens) != 1 || config.APITokens[0].Hash == created.Token || validateAPITokens(config.APITokens) != nil {
+		t.Fatalf("tokens: %+v", config.APITokens)
+	}
+
+	var user string
+	handler := optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		user = requestUser(r)
+	})
+	send := func(method, token string) int {
+		r := httptest.NewRequest(method, "/control/stats", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	if send("GET", created.Token) != http.StatusOK || user != "token:ha" {
+		t.Fatalf("GET with the token: %q", user)
+	}
+	if send("POST", created.Token) != http.StatusForbidden {
+		t.Fatalf("POST with the read-only token")
+	}
+	if send("GET", "agh_invalid") != http.StatusUnauthorized {
+		t.Fatalf("invalid token")
+	}
+
+	// revoke
+	r = httptest.NewRequest("POST", "/control/api_tokens/revoke", bytes.NewBufferString(`{"id":"`+created.ID+`"}`))
+	w = httptest.NewRecorder()
+	handleAPITokensRevoke(w, r)
+	if w.Code != http.StatusOK || send("GET", created.Token) != http.StatusUnauthorized {
+		t.Fatalf("revoked token: %d", w.Code)
+	}
+}
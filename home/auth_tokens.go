@@ -0,0 +1,249 @@
+// API tokens for the scripts and the integrations
+// The token is sent in "Authorization: Bearer" header instead of the user's credentials.
+// It's shown only once when it's created, the configuration file contains its SHA-256 hash.
+// The scope of the token is a role: admin or read-only.
+
+package home
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiTokenPrefix = "agh_"
+	apiTokenSize   = 24 // bytes
+	apiTokenIDSize = 4  // bytes
+)
+
+type apiToken struct {
+	ID      string    `yaml:"id"`
+	Name    string    `yaml:"name"`
+	Hash    string    `yaml:"hash"`  // SHA-256 of the token, hex
+	Scope   string    `yaml:"scope"` // admin or read-only
+	Created time.Time `yaml:"created"`
+}
+
+// When the tokens were used last time (not stored)
+var apiTokensUsage struct {
+	sync.Mutex
+	lastUsed map[string]time.Time // ID -> time
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get the token from "Authorization: Bearer ..." header
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
+
+// Find the token
+func checkAPIToken(token string) (apiToken, bool) {
+	h := hashAPIToken(token)
+	config.RLock()
+	var found *apiToken
+	for i := range config.APITokens {
+		if subtle.ConstantTimeCompare([]byte(config.APITokens[i].Hash), []byte(h)) == 1 {
+			found = &config.APITokens[i]
+		}
+	}
+	var t apiToken
+	if found != nil {
+		t = *found
+	}
+	config.RUnlock()
+	if found == nil {
+		return apiToken{}, false
+	}
+
+	apiTokensUsage.Lock()
+	if apiTokensUsage.lastUsed == nil {
+		apiTokensUsage.lastUsed = map[string]time.Time{}
+	}
+	apiTokensUsage.lastUsed[t.ID] = time.Now()
+	apiTokensUsage.Unlock()
+	return t, true
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Check the tokens from the configuration file
+func validateAPITokens(tokens []apiToken) error {
+	ids := map[string]bool{}
+	for _, t := range tokens {
+		if len(t.ID) == 0 || ids[t.ID] {
+			return fmt.Errorf("api_tokens: %q: empty or duplicate ID", t.Name)
+		}
+		ids[t.ID] = true
+		if t.Scope != roleAdmin && t.Scope != roleReadOnly {
+			return fmt.Errorf("api_tokens: %q: invalid scope %q", t.Name, t.Scope)
+		}
+		if len(t.Hash) != sha256.Size*2 {
+			return fmt.Errorf("api_tokens: %q: invalid hash", t.Name)
+		}
+	}
+	return nil
+}
+
+type apiTokenJSON struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Scope    string     `json:"scope"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+func handleAPITokensList(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	resp := []apiTokenJSON{}
+	config.RLock()
+	for _, t := range config.APITokens {
+		resp = append(resp, apiTokenJSON{ID: t.ID, Name: t.Name, Scope: t.Scope, Created: t.Created})
+	}
+	config.RUnlock()
+	apiTokensUsage.Lock()
+	for i := range resp {
+		if lu, ok := apiTokensUsage.lastUsed[resp[i].ID]; ok {
+			resp[i].LastUsed = &lu
+		}
+	}
+	apiTokensUsage.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+type apiTokenCreateJSON struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+type apiTokenCreatedJSON struct {
+	ID    string `json:"id"`
+	Token string `json:"token"` // shown only once
+}
+
+func handleAPITokensCreate(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := apiTokenCreateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if len(req.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if req.Scope != roleAdmin && req.Scope != roleReadOnly {
+		httpError(w, http.StatusBadRequest, "invalid scope %q", req.Scope)
+		return
+	}
+
+	secret, err := randomHex(apiTokenSize)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	id, err := randomHex(apiTokenIDSize)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	token := apiTokenPrefix + secret
+	t := apiToken{
+		ID:      id,
+		Name:    req.Name,
+		Hash:    hashAPIToken(token),
+		Scope:   req.Scope,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	config.Lock()
+	config.APITokens = append(config.APITokens, t)
+	config.Unlock()
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(apiTokenCreatedJSON{ID: id, Token: token})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+type apiTokenRevokeJSON struct {
+	ID string `json:"id"`
+}
+
+func handleAPITokensRevoke(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := apiTokenRevokeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	config.Lock()
+	found := false
+	tokens := []apiToken{}
+	for _, t := range config.APITokens {
+		if t.ID == req.ID {
+			found = true
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	config.APITokens = tokens
+	config.Unlock()
+	if !found {
+		httpError(w, http.StatusBadRequest, "token %q not found", req.ID)
+		return
+	}
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+func registerAPITokenHandlers() {
+	http.HandleFunc("/control/api_tokens/list", postInstall(optionalAuth(ensureGET(handleAPITokensList))))
+	http.HandleFunc("/control/api_tokens/create", postInstall(optionalAuth(ensurePOST(handleAPITokensCreate))))
+	http.HandleFunc("/control/api_tokens/revoke", postInstall(optionalAuth(ensurePOST(handleAPITokensRevoke))))
+}
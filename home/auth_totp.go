@@ -0,0 +1,326 @@
+// Two-factor authentication with time-based one-time passwords (RFC 6238)
+// The user enrolls by adding the secret to an authenticator app (the provisioning URI is shown as a QR code)
+//  and confirming it with the first code.  The recovery codes are shown once, they're stored as SHA-256 hashes.
+// A user with the second factor can't use Basic authentication: it has no place for the code.
+
+package home
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpIssuer     = "AdGuard Home"
+	totpPeriod     = 30 // seconds
+	totpDigits     = 6
+	totpSkew       = 1  // the codes of the adjacent periods are accepted too
+	totpSecretSize = 20 // bytes
+
+	recoveryCodesNum  = 10
+	recoveryCodeBytes = 5
+)
+
+var totp struct {
+	sync.Mutex
+	pending  map[string]string // user -> the secret which isn't confirmed yet
+	lastUsed map[string]int64  // user -> the last accepted period: a code can't be used twice
+}
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generate the code for the period
+func totpCode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// Check the code and return its period (0: the code is invalid)
+func totpValidate(secretB32, code string, now time.Time) int64 {
+	secret, err := base32NoPad.DecodeString(strings.ToUpper(secretB32))
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	counter := now.Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		c := totpCode(secret, counter+i)
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return counter + i
+		}
+	}
+	return 0
+}
+
+func totpNewSecret() (string, error) {
+	buf := make([]byte, totpSecretSize)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base32NoPad.EncodeToString(buf), nil
+}
+
+// Get the URI for the authenticator app
+func totpProvisioningURI(user, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + user,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(code, "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate the recovery codes and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	for i := 0; i != recoveryCodesNum; i++ {
+		buf := make([]byte, recoveryCodeBytes)
+		_, err := rand.Read(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := hex.EncodeToString(buf)
+		code := s[:5] + "-" + s[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Return TRUE if the user must enter the second factor
+func userHasTOTP(name string) bool {
+	config.RLock()
+	defer config.RUnlock()
+	u := findWebUser(name)
+	return u != nil && len(u.TOTPSecret) != 0
+}
+
+// Check the second factor: a one-time password or a recovery code
+// The used recovery code is removed.
+func checkSecondFactor(name, code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) == 0 {
+		return false
+	}
+
+	config.Lock()
+	u := findWebUser(name)
+	if u == nil {
+		config.Unlock()
+		return false
+	}
+	secret := u.TOTPSecret
+	recoveryUsed := false
+	if len(code) != totpDigits {
+		h := hashRecoveryCode(code)
+		for i, rc := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				recoveryUsed = true
+				break
+			}
+		}
+	}
+	config.Unlock()
+
+	if recoveryUsed {
+		log.Info("Auth: %q used a recovery code", name)
+		err := writeAllConfigs()
+		if err != nil {
+			log.Error("Auth: %s", err)
+		}
+		return true
+	}
+
+	counter := totpValidate(secret, code, time.Now())
+	if counter == 0 {
+		return false
+	}
+	totp.Lock()
+	defer totp.Unlock()
+	if totp.lastUsed == nil {
+		totp.lastUsed = map[string]int64{}
+	}
+	if counter <= totp.lastUsed[name] {
+		return false
+	}
+	totp.lastUsed[name] = counter
+	return true
+}
+
+type totpEnrollJSON struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI for the QR code
+}
+
+// Start the enrollment of the user who sent the request
+func handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	user := requestUser(r)
+	config.RLock()
+	found := findWebUser(user) != nil
+	config.RUnlock()
+	if !found {
+		// the authentication is disabled, or it's an API token
+		httpError(w, http.StatusBadRequest, "Two-factor authentication requires a logged in user")
+		return
+	}
+	secret, err := totpNewSecret()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	totp.Lock()
+	if totp.pending == nil {
+		totp.pending = map[string]string{}
+	}
+	totp.pending[user] = secret
+	totp.Unlock()
+
+	resp := totpEnrollJSON{Secret: secret, URI: totpProvisioningURI(user, secret)}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+type totpCodeJSON struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodesJSON struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Enable the second factor after the user has entered the first code
+func handleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := totpCodeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	user := requestUser(r)
+	totp.Lock()
+	secret, ok := totp.pending[user]
+	totp.Unlock()
+	if !ok {
+		httpError(w, http.StatusBadRequest, "The enrollment hasn't been started")
+		return
+	}
+	if totpValidate(secret, strings.TrimSpace(req.Code), time.Now()) == 0 {
+		httpError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+
+	config.Lock()
+	u := findWebUser(user)
+	if u != nil {
+		u.TOTPSecret = secret
+		u.RecoveryCodes = hashes
+	}
+	config.Unlock()
+	if u == nil {
+		httpError(w, http.StatusBadRequest, "user %q not found", user)
+		return
+	}
+	totp.Lock()
+	delete(totp.pending, user)
+	totp.Unlock()
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(recoveryCodesJSON{RecoveryCodes: codes})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// Disable the second factor of the user who sent the request
+// The current code (or a recovery code) is required.
+func handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := totpCodeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	user := requestUser(r)
+	if !userHasTOTP(user) {
+		httpError(w, http.StatusBadRequest, "Two-factor authentication is not enabled")
+		return
+	}
+	if !checkSecondFactor(user, req.Code) {
+		httpError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+
+	config.Lock()
+	u := findWebUser(user)
+	if u != nil {
+		u.TOTPSecret = ""
+		u.RecoveryCodes = nil
+	}
+	config.Unlock()
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+func registerTOTPHandlers() {
+	http.HandleFunc("/control/totp/enroll", postInstall(optionalAuth(ensurePOST(handleTOTPEnroll))))
+	http.HandleFunc("/control/totp/confirm", postInstall(optionalAuth(ensurePOST(handleTOTPConfirm))))
+	http.HandleFunc("/control/totp/disable", postInstall(optionalAuth(ensurePOST(handleTOTPDisable))))
+}
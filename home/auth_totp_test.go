@@ -0,0 +1,98 @@
+package home
+
+import (
+	"bytes"
+	"encoding/base32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors (SHA-1), the last 6 digits
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	} {
+		if c := totpCode(secret, tc.time/totpPeriod); c != tc.code {
+			t.Fatalf("%d: %s, expected %s", tc.time, c, tc.code)
+		}
+	}
+
+	b32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	now := time.Unix(1111111109, 0)
+	if totpValidate(b32, "081804", now) == 0 {
+		t.Fatalf("valid code")
+	}
+	if totpValidate(b32, "081804", now.Add(-totpPeriod*time.Second)) == 0 {
+		t.Fatalf("the code of the next period")
+	}
+	if totpValidate(b32, "081804", now.Add(time.Hour)) != 0 {
+		t.Fatalf("old code")
+	}
+	if totpValidate(b32, "000000", now) != 0 {
+		t.Fatalf("invalid code")
+	}
+
+	uri := totpProvisioningURI("admin", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/AdGuard%20Home:admin?") || !strings.Contains(uri, "secret=ABC") {
+		t.Fatalf("uri: %s", uri)
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+	defer prepareTestAuth(t)()
+
+	secret, _ := totpNewSecret()
+	codes, hashes, _ := newRecoveryCodes()
+	config.Users[0].TOTPSecret = secret
+	config.Users[0].RecoveryCodes = hashes
+	writeConfig := config.ourConfigFilename
+	config.ourConfigFilename = config.ourWorkingDir + "/AdGuardHome.yaml"
+	defer func() { config.ourConfigFilename = writeConfig }()
+
+	login := func(otp string) int {
+		body := bytes.NewBufferString(`{"name":"admin","password":"secret","otp":"` + otp + `"}`)
+		w := httptest.NewRecorder()
+		handleLogin(w, httptest.NewRequest("POST", "/control/login", body))
+		return w.Code
+	}
+
+	if login("") != http.StatusUnauthorized {
+		t.Fatalf("login without the code")
+	}
+	if login("000000") != http.StatusUnauthorized {
+		t.Fatalf("login with an invalid code")
+	}
+
+	s, _ := base32NoPad.DecodeString(secret)
+	code := totpCode(s, time.Now().Unix()/totpPeriod)
+	if login(code) != http.StatusOK {
+		t.Fatalf("login with the code")
+	}
+	if login(code) == http.StatusOK {
+		t.Fatalf("the code is used twice")
+	}
+
+	if login(codes[0]) != http.StatusOK {
+		t.Fatalf("login with a recovery code")
+	}
+	if login(codes[0]) == http.StatusOK || len(config.Users[0].RecoveryCodes) != recoveryCodesNum-1 {
+		t.Fatalf("the recovery code is used twice")
+	}
+
+	// no second factor in Basic authentication
+	r := httptest.NewRequest("GET", "/control/status", nil)
+	r.SetBasicAuth("admin", "secret")
+	if _, status := authenticate(r); status != http.StatusUnauthorized {
+		t.Fatalf("basic auth: %d", status)
+	}
+}
@@ -0,0 +1,381 @@
+// Backup and restore
+// The backup is a .tar.gz archive with the configuration file (it contains the clients and the DHCP settings),
+//  the filter files, the DHCP leases and optionally the statistics and the query log.
+// backup.json describes the archive: the version which has created it and the schema version of the configuration.
+// The restore writes the files next to the current ones first and then replaces them and restarts AdGuard Home,
+//  the configuration of an older version is upgraded as usual.
+// If a file can't be replaced, the already replaced ones are restored from their old copies.
+// The certificate files and include_dir are not a part of the backup: they are referenced by the paths.
+
+package home
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	backupManifestName = "backup.json"
+	backupConfigName   = "AdGuardHome.yaml"
+	backupLeasesName   = "leases.db"
+	backupMaxSize      = 512 * 1024 * 1024  // the archive
+	backupMaxFileSize  = 512 * 1024 * 1024  // a file from the archive
+	backupMaxDataSize  = 1024 * 1024 * 1024 // all files from the archive
+	backupNewSuffix    = ".restore-new"
+	backupOldSuffix    = ".restore-old"
+)
+
+type backupManifest struct {
+	Version       string    `json:"version"`        // AdGuard Home version
+	SchemaVersion int       `json:"schema_version"` // of the configuration file
+	Created       time.Time `json:"created"`
+	Stats         bool      `json:"stats"`    // the archive contains the statistics
+	QueryLog      bool      `json:"querylog"` // the archive contains the query log
+}
+
+// Get the path of the file from the archive (empty: the file isn't allowed)
+func backupFilePath(name string) string {
+	if name != filepath.ToSlash(filepath.Clean(name)) || strings.Contains(name, "..") {
+		return ""
+	}
+	dir, base := filepath.Split(filepath.FromSlash(name))
+	switch {
+	case name == backupConfigName:
+		return config.getConfigFilename()
+	case name == backupLeasesName:
+		return backupLeasesName // the DHCP server keeps it in the current directory
+	case dir == filepath.Join(dataDir, filterDir)+string(filepath.Separator):
+		return filepath.Join(config.ourWorkingDir, dataDir, filterDir, base)
+	case dir == dataDir+string(filepath.Separator) && (backupStatsFile(base) || backupQueryLogFile(base)):
+		return filepath.Join(config.ourWorkingDir, dataDir, base)
+	}
+	return ""
+}
+
+func backupStatsFile(name string) bool {
+	return name == "stats.db"
+}
+
+func backupQueryLogFile(name string) bool {
+	return strings.HasPrefix(name, "querylog.json") || name == "querylog.db"
+}
+
+func addBackupFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	err := tw.WriteHeader(&hdr)
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Add the file from the disk (it's skipped if it doesn't exist)
+func addBackupDiskFile(tw *tar.Writer, name, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return addBackupFile(tw, name, data)
+}
+
+// Add the files from the directory which match the condition
+func addBackupDir(tw *tar.Writer, dir string, match func(name string) bool) error {
+	files, err := ioutil.ReadDir(filepath.Join(config.ourWorkingDir, filepath.FromSlash(dir)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || !match(fi.Name()) {
+			continue
+		}
+		err = addBackupDiskFile(tw, dir+"/"+fi.Name(), filepath.Join(config.ourWorkingDir, filepath.FromSlash(dir), fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBackup(w io.Writer, m backupManifest) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = addBackupFile(tw, backupManifestName, data)
+	if err != nil {
+		return err
+	}
+	err = addBackupDiskFile(tw, backupConfigName, config.getConfigFilename())
+	if err != nil {
+		return err
+	}
+	err = addBackupDiskFile(tw, backupLeasesName, backupLeasesName)
+	if err != nil {
+		return err
+	}
+	err = addBackupDir(tw, dataDir+"/"+filterDir, func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+	err = addBackupDir(tw, dataDir, func(name string) bool {
+		return (m.Stats && backupStatsFile(name)) || (m.QueryLog && backupQueryLogFile(name))
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// Get the backup archive
+// Parameters: stats=true, querylog=true to include the statistics and the query log
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	q := r.URL.Query()
+	m := backupManifest{
+		Version:       VersionString,
+		SchemaVersion: currentSchemaVersion,
+		Created:       time.Now().UTC().Truncate(time.Second),
+		Stats:         q.Get("stats") == "true",
+		QueryLog:      q.Get("querylog") == "true",
+	}
+
+	// the configuration file must be up to date
+	err := writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = writeBackup(buf, m)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't create the backup: %s", err)
+		return
+	}
+
+	name := fmt.Sprintf("AdGuardHome-backup-%s.tar.gz", m.Created.Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		log.Debug("backup: %s", err)
+	}
+}
+
+// Read the archive and check that it can be restored
+func readBackup(r io.Reader) (backupManifest, map[string][]byte, error) {
+	m := backupManifest{}
+	files := map[string][]byte{}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return m, nil, err
+	}
+	tr := tar.NewReader(gr)
+	total := int64(0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if hdr.Name != backupManifestName && backupFilePath(hdr.Name) == "" {
+			return m, nil, fmt.Errorf("unexpected file %q", hdr.Name)
+		}
+		if hdr.Size > backupMaxFileSize {
+			return m, nil, fmt.Errorf("%s exceeds the limit of %d bytes", hdr.Name, backupMaxFileSize)
+		}
+		total += hdr.Size
+		if total > backupMaxDataSize {
+			return m, nil, fmt.Errorf("the files exceed the limit of %d bytes", backupMaxDataSize)
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return m, nil, err
+		}
+		files[hdr.Name] = data
+	}
+
+	data, ok := files[backupManifestName]
+	if !ok {
+		return m, nil, fmt.Errorf("%s is missing: it's not an AdGuard Home backup", backupManifestName)
+	}
+	delete(files, backupManifestName)
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return m, nil, fmt.Errorf("%s: %s", backupManifestName, err)
+	}
+	if m.SchemaVersion > currentSchemaVersion {
+		return m, nil, fmt.Errorf("the backup is created by a newer version %s, update AdGuard Home first", m.Version)
+	}
+
+	data, ok = files[backupConfigName]
+	if !ok {
+		return m, nil, fmt.Errorf("%s is missing", backupConfigName)
+	}
+	diskConfig := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &diskConfig)
+	if err != nil {
+		return m, nil, fmt.Errorf("%s: %s", backupConfigName, err)
+	}
+	if v, ok := diskConfig["schema_version"].(int); !ok || v != m.SchemaVersion {
+		return m, nil, fmt.Errorf("%s: schema_version doesn't match %s", backupConfigName, backupManifestName)
+	}
+	return m, files, nil
+}
+
+// Write the files from the backup next to the ones they replace
+// Returns the paths of the files to replace
+func stageBackupFiles(files map[string][]byte) ([]string, error) {
+	_ = os.MkdirAll(filepath.Join(config.ourWorkingDir, dataDir, filterDir), 0755)
+	paths := []string{}
+	for name, data := range files {
+		path := backupFilePath(name)
+		err := file.SafeWrite(path+backupNewSuffix, data)
+		if err != nil {
+			removeStagedBackupFiles(paths)
+			return nil, err
+		}
+		secureFile(path + backupNewSuffix)
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func removeStagedBackupFiles(paths []string) {
+	for _, path := range paths {
+		_ = os.Remove(path + backupNewSuffix)
+	}
+}
+
+// Replace the files with the staged ones
+// If a file can't be replaced, the already replaced files are restored.
+func commitBackupFiles(paths []string) error {
+	replaced := []string{}
+	hasOld := map[string]bool{}
+	var err error
+	for _, path := range paths {
+		err = os.Rename(path, path+backupOldSuffix)
+		if err == nil {
+			hasOld[path] = true
+		} else if !os.IsNotExist(err) {
+			break
+		}
+		err = os.Rename(path+backupNewSuffix, path)
+		if err != nil {
+			if hasOld[path] {
+				_ = os.Rename(path+backupOldSuffix, path)
+			}
+			break
+		}
+		replaced = append(replaced, path)
+	}
+
+	if err != nil {
+		for i := len(replaced) - 1; i >= 0; i-- {
+			path := replaced[i]
+			var rerr error
+			if hasOld[path] {
+				rerr = os.Rename(path+backupOldSuffix, path)
+			} else {
+				rerr = os.Remove(path)
+			}
+			if rerr != nil {
+				log.Error("restore: couldn't roll back %s: %s", path, rerr)
+			}
+		}
+		removeStagedBackupFiles(paths)
+		return err
+	}
+
+	for path := range hasOld {
+		_ = os.Remove(path + backupOldSuffix)
+	}
+	return nil
+}
+
+// Restore the files from the backup and restart
+// The request body is the archive.
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	m, files, err := readBackup(http.MaxBytesReader(w, r.Body, backupMaxSize))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid backup: %s", err)
+		return
+	}
+	binName, err := os.Executable()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	paths, err := stageBackupFiles(files)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't restore the backup: %s", err)
+		return
+	}
+
+	log.Info("Restoring the backup of version %s created at %s", m.Version, m.Created)
+	auditLog(r, "config_restore", map[string]interface{}{"version": m.Version, "created": m.Created})
+
+	// the DNS and DHCP servers write their files when they stop
+	cleanup()
+
+	err = commitBackupFiles(paths)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't restore the backup: %s", err)
+	} else {
+		returnOK(w)
+	}
+
+	// the HTTP server can't be stopped until this request is finished
+	go func() {
+		time.Sleep(time.Second)
+		stopHTTPServer()
+		cleanupAlways()
+		restartProcess(binName)
+	}()
+}
+
+func registerBackupHandlers() {
+	http.HandleFunc("/control/backup", postInstall(optionalAuth(ensureGET(handleBackup))))
+	http.HandleFunc("/control/restore", postInstall(optionalAuth(ensurePOST(handleRestore))))
+}
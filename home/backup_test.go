@@ -0,0 +1,135 @@
+package home
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-backup")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir, configFile := config.ourWorkingDir, config.ourConfigFilename
+	defer func() { config.ourWorkingDir, config.ourConfigFilename = workDir, configFile }()
+	config.ourWorkingDir = dir
+	config.ourConfigFilename = "AdGuardHome.yaml"
+
+	_ = os.MkdirAll(filepath.Join(dir, dataDir, filterDir), 0755)
+	_ = ioutil.WriteFile(filepath.Join(dir, "AdGuardHome.yaml"), []byte("bind_port: 3000\nschema_version: 5\n"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, dataDir, filterDir, "1.txt"), []byte("||example.org^\n"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, dataDir, "stats.db"), []byte("stats"), 0600)
+	_ = ioutil.WriteFile(filepath.Join(dir, dataDir, "sessions.db"), []byte("{}"), 0600)
+
+	buf := &bytes.Buffer{}
+	err = writeBackup(buf, backupManifest{Version: "v0.99", SchemaVersion: 5})
+	if err != nil {
+		t.Fatalf("writeBackup: %s", err)
+	}
+	m, files, err := readBackup(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("readBackup: %s", err)
+	}
+	if m.Version != "v0.99" || len(files) != 2 ||
+		string(files["data/filters/1.txt"]) != "||example.org^\n" || files["AdGuardHome.yaml"] == nil {
+		t.Fatalf("backup: %+v %v", m, files)
+	}
+
+	// the statistics are included only on request
+	buf.Reset()
+	_ = writeBackup(buf, backupManifest{SchemaVersion: 5, Stats: true})
+	_, files, _ = readBackup(bytes.NewReader(buf.Bytes()))
+	if string(files["data/stats.db"]) != "stats" {
+		t.Fatalf("stats: %v", files)
+	}
+
+	// a newer version
+	buf.Reset()
+	_ = writeBackup(buf, backupManifest{SchemaVersion: currentSchemaVersion + 1})
+	_, _, err = readBackup(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Fatalf("newer schema version")
+	}
+
+	// a file outside the allowed directories
+	buf.Reset()
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	_ = addBackupFile(tw, "../AdGuardHome", []byte("binary"))
+	_ = tw.Close()
+	_ = gw.Close()
+	_, _, err = readBackup(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Fatalf("path traversal")
+	}
+
+	// a file which is too large when decompressed
+	buf.Reset()
+	gw = gzip.NewWriter(buf)
+	tw = tar.NewWriter(gw)
+	_ = tw.WriteHeader(&tar.Header{Name: "data/filters/2.txt", Mode: 0600, Size: backupMaxFileSize + 1})
+	_ = gw.Close()
+	_, _, err = readBackup(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Fatalf("the file size limit")
+	}
+}
+
+func TestRestoreFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-restore")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir, configFile := config.ourWorkingDir, config.ourConfigFilename
+	defer func() { config.ourWorkingDir, config.ourConfigFilename = workDir, configFile }()
+	config.ourWorkingDir = dir
+	config.ourConfigFilename = "AdGuardHome.yaml"
+	configPath := filepath.Join(dir, "AdGuardHome.yaml")
+	filterPath := filepath.Join(dir, dataDir, filterDir, "1.txt")
+	_ = ioutil.WriteFile(configPath, []byte("old"), 0600)
+
+	files := map[string][]byte{"AdGuardHome.yaml": []byte("new"), "data/filters/1.txt": []byte("list")}
+	paths, err := stageBackupFiles(files)
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("stageBackupFiles: %v %v", paths, err)
+	}
+	// nothing is replaced yet
+	data, _ := ioutil.ReadFile(configPath)
+	if string(data) != "old" {
+		t.Fatalf("the config is replaced while staging: %s", data)
+	}
+
+	// the last file can't be replaced: the others are rolled back
+	_ = os.Remove(paths[1] + backupNewSuffix)
+	err = commitBackupFiles(paths)
+	if err == nil {
+		t.Fatalf("commitBackupFiles: no error")
+	}
+	data, _ = ioutil.ReadFile(configPath)
+	_, ferr := os.Stat(filterPath)
+	if string(data) != "old" || !os.IsNotExist(ferr) {
+		t.Fatalf("rollback: %q %v", data, ferr)
+	}
+
+	paths, _ = stageBackupFiles(files)
+	err = commitBackupFiles(paths)
+	if err != nil {
+		t.Fatalf("commitBackupFiles: %s", err)
+	}
+	data, _ = ioutil.ReadFile(configPath)
+	list, _ := ioutil.ReadFile(filterPath)
+	if string(data) != "new" || string(list) != "list" {
+		t.Fatalf("restore: %q %q", data, list)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*.restore-*"))
+	if len(left) != 0 {
+		t.Fatalf("the temporary files are left: %v", left)
+	}
+}
@@ -0,0 +1,142 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+type svc struct {
+	name    string
+	domains []string
+}
+
+// Built-in list of services that can be blocked with a single toggle
+// Subdomains of every domain are blocked too
+var serviceRulesArray = []svc{
+	{"whatsapp", []string{"whatsapp.net", "whatsapp.com"}},
+	{"facebook", []string{"facebook.com", "facebook.net", "fbcdn.net", "fb.me", "fb.com", "fbsbx.com", "messenger.com"}},
+	{"twitter", []string{"twitter.com", "twttr.com", "t.co", "twimg.com"}},
+	{"youtube", []string{"youtube.com", "ytimg.com", "youtu.be", "googlevideo.com", "youtubei.googleapis.com", "youtube-nocookie.com"}},
+	{"instagram", []string{"instagram.com", "cdninstagram.com"}},
+	{"snapchat", []string{"snapchat.com", "snap-telemetry.io", "snapads.com", "sc-cdn.net", "feelinsonice-hrd.appspot.com"}},
+	{"tiktok", []string{"tiktok.com", "tiktokv.com", "tiktokcdn.com", "musical.ly", "muscdn.com", "byteoversea.com", "ibytedtos.com"}},
+	{"netflix", []string{"netflix.com", "netflix.net", "nflxext.com", "nflximg.com", "nflximg.net", "nflxvideo.net", "nflxso.net"}},
+	{"steam", []string{"steam.com", "steampowered.com", "steamcommunity.com", "steamstatic.com", "steamcontent.com", "steamusercontent.com"}},
+	{"twitch", []string{"twitch.tv", "ttvnw.net", "jtvnw.net", "twitchcdn.net"}},
+	{"discord", []string{"discord.gg", "discordapp.net", "discordapp.com", "discord.com", "discord.media"}},
+	{"reddit", []string{"reddit.com", "redditstatic.com", "redditmedia.com", "redd.it"}},
+	{"skype", []string{"skype.com", "skypeassets.com"}},
+	{"vk", []string{"vk.com", "userapi.com", "vk-cdn.net", "vkuservideo.net"}},
+	{"ok", []string{"ok.ru"}},
+	{"amazon", []string{"amazon.com", "media-amazon.com", "primevideo.com", "amazontrust.com", "amazonvideo.com"}},
+	{"ebay", []string{"ebay.com"}},
+	{"origin", []string{"origin.com", "signin.ea.com", "accounts.ea.com"}},
+	{"epic_games", []string{"epicgames.com", "unrealengine.com"}},
+}
+
+// serviceRules maps service names to their domain lists
+var serviceRules map[string][]string
+
+// initServices prepares the service name index
+func initServices() {
+	serviceRules = make(map[string][]string)
+	for _, s := range serviceRulesArray {
+		serviceRules[s.name] = s.domains
+	}
+}
+
+// checkBlockedServices returns an error if the list contains unknown services
+func checkBlockedServices(list []string) error {
+	for _, name := range list {
+		_, ok := serviceRules[name]
+		if !ok {
+			return fmt.Errorf("unknown blocked service: %s", name)
+		}
+	}
+	return nil
+}
+
+// applyBlockedServices sets the rules of the services from the list to the filtering settings
+func applyBlockedServices(setts *dnsfilter.RequestFilteringSettings, list []string) {
+	setts.ServicesRules = []dnsfilter.ServiceEntry{}
+	for _, name := range list {
+		domains, ok := serviceRules[name]
+		if !ok {
+			log.Debug("unknown service name: %s", name)
+			continue
+		}
+		setts.ServicesRules = append(setts.ServicesRules, dnsfilter.ServiceEntry{
+			Name:    name,
+			Domains: domains,
+		})
+	}
+}
+
+func handleBlockedServicesAvailable(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	list := []string{}
+	for _, s := range serviceRulesArray {
+		list = append(list, s.name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleBlockedServicesList(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	list := config.DNS.BlockedServices
+	config.RUnlock()
+	if list == nil {
+		list = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleBlockedServicesSet(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	list := []string{}
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = checkBlockedServices(list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	config.DNS.BlockedServices = list
+	config.Unlock()
+
+	log.Debug("Updated blocked services list: %d", len(list))
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// RegisterBlockedServicesHandlers - register HTTP handlers
+func RegisterBlockedServicesHandlers() {
+	http.HandleFunc("/control/blocked_services/services", postInstall(optionalAuth(ensureGET(handleBlockedServicesAvailable))))
+	http.HandleFunc("/control/blocked_services/list", postInstall(optionalAuth(ensureGET(handleBlockedServicesList))))
+	http.HandleFunc("/control/blocked_services/set", postInstall(optionalAuth(ensurePOST(handleBlockedServicesSet))))
+}
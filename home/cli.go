@@ -0,0 +1,566 @@
+// Command-line administration
+// "AdGuardHome COMMAND ..." manages a running instance over the control API, so it can be managed via SSH and by scripts:
+//  AdGuardHome filter add https://example.org/list.txt
+//  AdGuardHome config set dns.upstream_dns https://dns10.quad9.net/dns-query tls://1.1.1.1
+// The address of the instance is taken from AdGuardHome.yaml in the binary's directory or from --server.
+// The credentials are an API token (--token, $AGH_TOKEN) or a user name and a password (--user, $AGH_USER, $AGH_PASSWORD).
+
+package home
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type cliContext struct {
+	server   string // e.g. "http://127.0.0.1:3000"
+	token    string
+	user     string
+	password string
+	insecure bool // don't verify the server's certificate
+
+	limit  int  // querylog tail: the number of entries
+	follow bool // querylog tail: wait for the new entries
+
+	args []string // the command and its arguments
+	out  io.Writer
+}
+
+type cliCommand struct {
+	usage string
+	run   func(c *cliContext) error
+}
+
+var cliCommands = map[string][]cliCommand{
+	"status": {
+		{"status", cliStatus},
+	},
+	"filter": {
+		{"filter list", cliFilterList},
+		{"filter add URL [NAME]", cliFilterAdd},
+		{"filter remove URL", cliFilterRemove},
+		{"filter refresh", cliFilterRefresh},
+	},
+	"client": {
+		{"client list", cliClientList},
+	},
+	"querylog": {
+		{"querylog tail [-n NUMBER] [-f]", cliQueryLogTail},
+	},
+	"config": {
+		{"config get [KEY]", cliConfigGet},
+		{"config set KEY VALUE...", cliConfigSet},
+	},
+}
+
+// Return TRUE if the command line is an administration command
+func isCLICommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	_, ok := cliCommands[args[0]]
+	return ok
+}
+
+func printCLIUsage(w io.Writer) {
+	names := []string{}
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "Usage:\n\n")
+	for _, name := range names {
+		for _, cmd := range cliCommands[name] {
+			fmt.Fprintf(w, "  %s %s\n", os.Args[0], cmd.usage)
+		}
+	}
+	fmt.Fprintf(w, "\nOptions:\n")
+	fmt.Fprintf(w, "  %-34s %s\n", "--server URL", "Address of AdGuard Home, e.g. http://127.0.0.1:3000")
+	fmt.Fprintf(w, "  %-34s %s\n", "--token TOKEN", "API token ($AGH_TOKEN)")
+	fmt.Fprintf(w, "  %-34s %s\n", "--user NAME", "User name ($AGH_USER), the password is $AGH_PASSWORD")
+	fmt.Fprintf(w, "  %-34s %s\n", "--insecure", "Don't verify the server's certificate")
+}
+
+// Run the administration command and return the exit code
+func runCLI(args []string, out io.Writer) int {
+	c := &cliContext{
+		token:    os.Getenv("AGH_TOKEN"),
+		user:     os.Getenv("AGH_USER"),
+		password: os.Getenv("AGH_PASSWORD"),
+		limit:    20,
+		out:      out,
+	}
+	err := c.parseArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n\n", err)
+		printCLIUsage(os.Stderr)
+		return 64
+	}
+	if len(c.server) == 0 {
+		c.server = cliDefaultServer()
+	}
+
+	for _, cmd := range cliCommands[c.args[0]] {
+		words := strings.Fields(cmd.usage)
+		if len(words) > 1 && (len(c.args) < 2 || c.args[1] != words[1]) {
+			continue
+		}
+		err = cmd.run(c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+	printCLIUsage(os.Stderr)
+	return 64
+}
+
+// Separate the options from the command and its arguments
+func (c *cliContext) parseArgs(args []string) error {
+	for i := 0; i < len(args); i++ {
+		v := args[i]
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("got %s without argument", v)
+			}
+			i++
+			return args[i], nil
+		}
+		var err error
+		switch v {
+		case "--server":
+			c.server, err = value()
+		case "--token":
+			c.token, err = value()
+		case "--user":
+			c.user, err = value()
+		case "--insecure":
+			c.insecure = true
+		case "-f":
+			c.follow = true
+		case "-n":
+			var n string
+			n, err = value()
+			if err == nil {
+				c.limit, err = strconv.Atoi(n)
+				if err != nil || c.limit <= 0 {
+					err = fmt.Errorf("invalid number of entries: %s", n)
+				}
+			}
+		default:
+			c.args = append(c.args, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.args) == 0 {
+		return fmt.Errorf("no command")
+	}
+	return nil
+}
+
+// Get the address of the web interface from the configuration file
+func cliDefaultServer() string {
+	server := "http://127.0.0.1:3000"
+	exec, err := os.Executable()
+	if err != nil {
+		return server
+	}
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(exec), config.ourConfigFilename))
+	if err != nil {
+		return server
+	}
+	conf := struct {
+		BindHost string `yaml:"bind_host"`
+		BindPort int    `yaml:"bind_port"`
+	}{}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil || conf.BindPort == 0 {
+		return server
+	}
+	host := conf.BindHost
+	if len(host) == 0 || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(conf.BindPort))
+}
+
+func (c *cliContext) httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.insecure},
+		},
+	}
+}
+
+func (c *cliContext) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.server, "/")+"/control/"+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if len(c.user) != 0 {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	return req, nil
+}
+
+// Send the request to the control API
+// The response is decoded into 'result' if it isn't nil, otherwise it's returned as a text.
+func (c *cliContext) request(method, path string, body interface{}, result interface{}) (string, error) {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient(time.Minute).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s /control/%s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result != nil {
+		err = json.Unmarshal(data, result)
+		if err != nil {
+			return "", fmt.Errorf("/control/%s: %s", path, err)
+		}
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (c *cliContext) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+}
+
+func cliStatus(c *cliContext) error {
+	status := map[string]interface{}{}
+	_, err := c.request("GET", "status", nil, &status)
+	if err != nil {
+		return err
+	}
+	tw := c.table()
+	for _, k := range []string{"version", "running", "protection_enabled", "querylog_enabled", "dns_addresses", "dns_port", "http_port"} {
+		fmt.Fprintf(tw, "%s\t%v\n", k, status[k])
+	}
+	return tw.Flush()
+}
+
+func cliFilterList(c *cliContext) error {
+	status := struct {
+		Filters []filter `json:"filters"`
+	}{}
+	_, err := c.request("GET", "filtering/status", nil, &status)
+	if err != nil {
+		return err
+	}
+	tw := c.table()
+	fmt.Fprintf(tw, "ID\tENABLED\tRULES\tUPDATED\tNAME\tURL\n")
+	for _, f := range status.Filters {
+		updated := ""
+		if !f.LastUpdated.IsZero() {
+			updated = f.LastUpdated.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%d\t%v\t%d\t%s\t%s\t%s\n", f.ID, f.Enabled, f.RulesCount, updated, f.Name, f.URL)
+	}
+	return tw.Flush()
+}
+
+func cliFilterAdd(c *cliContext) error {
+	if len(c.args) < 3 || len(c.args) > 4 {
+		return fmt.Errorf("usage: filter add URL [NAME]")
+	}
+	f := map[string]string{"url": c.args[2], "name": c.args[2]}
+	if len(c.args) == 4 {
+		f["name"] = c.args[3]
+	}
+	text, err := c.request("POST", "filtering/add_url", f, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, text)
+	return nil
+}
+
+func cliFilterRemove(c *cliContext) error {
+	if len(c.args) != 3 {
+		return fmt.Errorf("usage: filter remove URL")
+	}
+	_, err := c.request("POST", "filtering/remove_url", map[string]string{"url": c.args[2]}, nil)
+	return err
+}
+
+func cliFilterRefresh(c *cliContext) error {
+	text, err := c.request("POST", "filtering/refresh", nil, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, text)
+	return nil
+}
+
+func cliClientList(c *cliContext) error {
+	list := clientListJSON{}
+	_, err := c.request("GET", "clients", nil, &list)
+	if err != nil {
+		return err
+	}
+	tw := c.table()
+	fmt.Fprintf(tw, "NAME\tIP\tMAC\tCLIENT ID\tGLOBAL SETTINGS\tFILTERING\n")
+	for _, cj := range list.Clients {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%v\n",
+			cj.Name, cj.IP, cj.MAC, cj.ClientID, cj.UseGlobalSettings, cj.FilteringEnabled)
+	}
+	for _, cj := range list.AutoClients {
+		fmt.Fprintf(tw, "%s\t%s\t\t\t\t\n", cj.Name, cj.IP)
+	}
+	return tw.Flush()
+}
+
+func printQueryLogEntry(w io.Writer, e map[string]interface{}) {
+	t, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(e["time"]))
+	client, _ := e["client"].(string)
+	if name, ok := e["client_name"].(string); ok {
+		client = name + " (" + client + ")"
+	}
+	q, _ := e["question"].(map[string]interface{})
+	status, _ := e["status"].(string)
+	fmt.Fprintf(w, "%s %s %v %v %v %s\n",
+		t.Local().Format("2006-01-02 15:04:05"), client, q["type"], q["host"], e["reason"], status)
+}
+
+func cliQueryLogTail(c *cliContext) error {
+	entries := []map[string]interface{}{}
+	_, err := c.request("GET", "querylog?limit="+strconv.Itoa(c.limit), nil, &entries)
+	if err != nil {
+		return err
+	}
+	// the newest entries are the first
+	for i := len(entries) - 1; i >= 0; i-- {
+		printQueryLogEntry(c.out, entries[i])
+	}
+	if !c.follow {
+		return nil
+	}
+
+	req, err := c.newRequest("GET", "querylog/stream", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /control/querylog/stream: %s", resp.Status)
+	}
+	event := ""
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case len(line) == 0:
+			event = ""
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && len(event) == 0:
+			e := map[string]interface{}{}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e) == nil {
+				printQueryLogEntry(c.out, e)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// The settings which "config" command manages: "dns.KEY"
+// The upstream settings are changed all at once, the others one by one.
+const (
+	cliUpstreamGet = "status"
+	cliUpstreamSet = "set_upstreams_config"
+	cliDNSGet      = "dns_info"
+	cliDNSSet      = "dns_config"
+)
+
+var cliConfigAliases = map[string]string{
+	"upstreams": "upstream_dns",
+	"bootstrap": "bootstrap_dns",
+	"fallback":  "fallback_dns",
+}
+
+// Get the upstream settings and the other DNS settings as JSON key -> value
+func (c *cliContext) getDNSSettings() (map[string]interface{}, map[string]interface{}, error) {
+	u := upstreamConfig{}
+	_, err := c.request("GET", cliUpstreamGet, nil, &u)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, _ := json.Marshal(u)
+	upstream := map[string]interface{}{}
+	_ = json.Unmarshal(data, &upstream)
+
+	dns := map[string]interface{}{}
+	_, err = c.request("GET", cliDNSGet, nil, &dns)
+	if err != nil {
+		return nil, nil, err
+	}
+	return upstream, dns, nil
+}
+
+// Get the setting name from the key "dns.NAME"
+func cliConfigKey(key string) (string, error) {
+	if !strings.HasPrefix(key, "dns.") {
+		return "", fmt.Errorf("unknown key %q, it must be dns.NAME", key)
+	}
+	name := strings.TrimPrefix(key, "dns.")
+	if a, ok := cliConfigAliases[name]; ok {
+		name = a
+	}
+	return name, nil
+}
+
+func cliConfigGet(c *cliContext) error {
+	if len(c.args) > 3 {
+		return fmt.Errorf("usage: config get [KEY]")
+	}
+	upstream, dns, err := c.getDNSSettings()
+	if err != nil {
+		return err
+	}
+	all := map[string]interface{}{}
+	for k, v := range dns {
+		all[k] = v
+	}
+	for k, v := range upstream {
+		all[k] = v
+	}
+
+	if len(c.args) == 3 {
+		name, err := cliConfigKey(c.args[2])
+		if err != nil {
+			return err
+		}
+		v, ok := all[name]
+		if !ok {
+			return fmt.Errorf("unknown key %q", c.args[2])
+		}
+		fmt.Fprintln(c.out, cliFormatValue(v))
+		return nil
+	}
+
+	names := []string{}
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	tw := c.table()
+	for _, k := range names {
+		fmt.Fprintf(tw, "dns.%s\t%s\n", k, cliFormatValue(all[k]))
+	}
+	return tw.Flush()
+}
+
+func cliFormatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		s := []string{}
+		for _, e := range v {
+			s = append(s, fmt.Sprint(e))
+		}
+		return strings.Join(s, " ")
+	}
+	return fmt.Sprint(v)
+}
+
+// Convert the command-line values to the type of the current value
+func cliParseValue(cur interface{}, values []string) (interface{}, error) {
+	// the unset lists are null
+	if _, ok := cur.([]interface{}); ok || cur == nil {
+		list := []string{}
+		for _, v := range values {
+			if len(v) != 0 {
+				list = append(list, v)
+			}
+		}
+		return list, nil
+	}
+	if len(values) != 1 {
+		return nil, fmt.Errorf("a single value is expected")
+	}
+	switch cur.(type) {
+	case bool:
+		return strconv.ParseBool(values[0])
+	case float64:
+		return strconv.ParseFloat(values[0], 64)
+	}
+	return values[0], nil
+}
+
+func cliConfigSet(c *cliContext) error {
+	if len(c.args) < 4 {
+		return fmt.Errorf("usage: config set KEY VALUE...")
+	}
+	name, err := cliConfigKey(c.args[2])
+	if err != nil {
+		return err
+	}
+	upstream, dns, err := c.getDNSSettings()
+	if err != nil {
+		return err
+	}
+
+	path := cliDNSSet
+	body := map[string]interface{}{}
+	cur, ok := upstream[name]
+	if ok {
+		path = cliUpstreamSet
+		body = upstream
+	} else if cur, ok = dns[name]; !ok {
+		return fmt.Errorf("unknown key %q", c.args[2])
+	}
+	body[name], err = cliParseValue(cur, c.args[3:])
+	if err != nil {
+		return fmt.Errorf("%s: %s", c.args[2], err)
+	}
+	_, err = c.request("POST", path, body, nil)
+	return err
+}
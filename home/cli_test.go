@@ -0,0 +1,84 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCLI(t *testing.T) {
+	posted := map[string]map[string]interface{}{} // path -> request body
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/control/status":
+			_, _ = w.Write([]byte(`{"version":"v0.99","upstream_dns":["1.1.1.1"],"bootstrap_dns":["9.9.9.9"],"upstream_timeout":10}`))
+		case "/control/dns_info":
+			_, _ = w.Write([]byte(`{"ratelimit":20,"refuse_any":false,"blocking_mode":"default","bogus_nxdomain":null}`))
+		case "/control/querylog":
+			_, _ = w.Write([]byte(`[{"time":"2020-01-01T00:00:02Z","client":"1.2.3.4","question":{"host":"b.example.org","type":"A"},"reason":"NotFilteredNotFound"},
+				{"time":"2020-01-01T00:00:01Z","client":"1.2.3.4","client_name":"laptop","question":{"host":"a.example.org","type":"A"},"reason":"FilteredBlackList"}]`))
+		default:
+			body := map[string]interface{}{}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			posted[r.URL.Path] = body
+			_, _ = w.Write([]byte("OK"))
+		}
+	}))
+	defer srv.Close()
+
+	run := func(args ...string) (int, string) {
+		out := &bytes.Buffer{}
+		code := runCLI(append(args, "--server", srv.URL, "--token", "token"), out)
+		return code, out.String()
+	}
+
+	code, _ := run("config", "set", "dns.upstreams", "tls://1.1.1.1", "8.8.8.8")
+	body := posted["/control/set_upstreams_config"]
+	if code != 0 || len(body["upstream_dns"].([]interface{})) != 2 ||
+		body["bootstrap_dns"].([]interface{})[0] != "9.9.9.9" || body["upstream_timeout"] != float64(10) {
+		t.Fatalf("config set dns.upstreams: %d %v", code, body)
+	}
+
+	code, _ = run("config", "set", "dns.refuse_any", "true")
+	body = posted["/control/dns_config"]
+	if code != 0 || len(body) != 1 || body["refuse_any"] != true {
+		t.Fatalf("config set dns.refuse_any: %d %v", code, body)
+	}
+	code, _ = run("config", "set", "dns.ratelimit", "fast")
+	if code == 0 {
+		t.Fatalf("invalid value")
+	}
+	code, _ = run("config", "set", "dns.unknown", "1")
+	if code == 0 {
+		t.Fatalf("unknown key")
+	}
+
+	code, out := run("config", "get", "dns.upstreams")
+	if code != 0 || out != "1.1.1.1\n" {
+		t.Fatalf("config get: %d %q", code, out)
+	}
+
+	code, _ = run("filter", "add", "https://example.org/list.txt", "List")
+	body = posted["/control/filtering/add_url"]
+	if code != 0 || body["url"] != "https://example.org/list.txt" || body["name"] != "List" {
+		t.Fatalf("filter add: %d %v", code, body)
+	}
+
+	code, out = run("querylog", "tail", "-n", "2")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if code != 0 || len(lines) != 2 || !strings.Contains(lines[0], "laptop (1.2.3.4) A a.example.org FilteredBlackList") {
+		t.Fatalf("querylog tail: %d %q", code, out)
+	}
+
+	code, _ = run("filter", "unknown")
+	if code != 64 || isCLICommand([]string{"--help"}) || !isCLICommand([]string{"client", "list"}) {
+		t.Fatalf("isCLICommand")
+	}
+}
@@ -0,0 +1,158 @@
+// Client tags and groups
+// A tag describes a client: its device type, OS or user, e.g. "device_phone", "os_windows", "user_child".
+// The filtering rules may target the tags via $ctag modifier.
+// A group sets the filtering policy for all clients with any of its tags, so the policy is written once.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+// The tags which may be assigned to the clients
+var clientTags = []string{
+	"device_audio",
+	"device_camera",
+	"device_gameconsole",
+	"device_laptop",
+	"device_nas",
+	"device_pc",
+	"device_phone",
+	"device_printer",
+	"device_tablet",
+	"device_tv",
+	"device_other",
+
+	"os_android",
+	"os_ios",
+	"os_linux",
+	"os_macos",
+	"os_windows",
+	"os_other",
+
+	"user_admin",
+	"user_regular",
+	"user_child",
+}
+
+type clientGroup struct {
+	Name string   `yaml:"name" json:"name"`
+	Tags []string `yaml:"tags" json:"tags"` // the group applies to the clients with any of these tags
+
+	UseGlobalSettings   bool `yaml:"use_global_settings" json:"use_global_settings"`
+	FilteringEnabled    bool `yaml:"filtering_enabled" json:"filtering_enabled"`
+	ParentalEnabled     bool `yaml:"parental_enabled" json:"parental_enabled"`
+	SafeSearchEnabled   bool `yaml:"safesearch_enabled" json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool `yaml:"safebrowsing_enabled" json:"safebrowsing_enabled"`
+
+	ParentalCategories []string `yaml:"parental_categories" json:"parental_categories"` // empty: use the global setting
+
+	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services" json:"use_global_blocked_services"`
+	BlockedServices          []string `yaml:"blocked_services" json:"blocked_services"`
+}
+
+// checkClientTags returns an error if the list contains unknown tags
+func checkClientTags(tags []string) error {
+	for _, t := range tags {
+		known := false
+		for _, ct := range clientTags {
+			if t == ct {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown client tag: %s", t)
+		}
+	}
+	return nil
+}
+
+// checkClientGroups returns an error if a group is invalid
+func checkClientGroups(groups []clientGroup) error {
+	names := map[string]bool{}
+	for _, g := range groups {
+		if len(g.Name) == 0 {
+			return fmt.Errorf("group name is empty")
+		}
+		if names[g.Name] {
+			return fmt.Errorf("group %s already exists", g.Name)
+		}
+		names[g.Name] = true
+		if len(g.Tags) == 0 {
+			return fmt.Errorf("group %s has no tags", g.Name)
+		}
+		err := checkClientTags(g.Tags)
+		if err != nil {
+			return fmt.Errorf("group %s: %s", g.Name, err)
+		}
+		err = checkBlockedServices(g.BlockedServices)
+		if err != nil {
+			return fmt.Errorf("group %s: %s", g.Name, err)
+		}
+		err = dnsfilter.CheckParentalCategories(g.ParentalCategories)
+		if err != nil {
+			return fmt.Errorf("group %s: %s", g.Name, err)
+		}
+	}
+	return nil
+}
+
+// Find the first group matching the client's tags
+// Must be called with the configuration lock held
+func findClientGroup(tags []string) *clientGroup {
+	for i := range config.ClientGroups {
+		g := &config.ClientGroups[i]
+		for _, gt := range g.Tags {
+			for _, t := range tags {
+				if t == gt {
+					return g
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func handleClientGroupsList(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	groups := append([]clientGroup{}, config.ClientGroups...)
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(groups)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Replace the list of client groups
+func handleClientGroupsSet(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	groups := []clientGroup{}
+	err := json.NewDecoder(r.Body).Decode(&groups)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = checkClientGroups(groups)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	config.ClientGroups = groups
+	config.Unlock()
+	log.Debug("Updated client groups: %d", len(groups))
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
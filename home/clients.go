@@ -6,44 +6,114 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
-	"runtime"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/utils"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Client information
 type Client struct {
-	IP                  string
+	IP                  string // IP address or CIDR subnet, e.g. 192.168.1.0/24
 	MAC                 string
+	Hostname            string // the hostname the client presents via DHCP or rDNS
+	ClientID            string // the ID the client presents via DNS-over-HTTPS path or DNS-over-TLS server name
 	Name                string
 	UseOwnSettings      bool // false: use global settings
 	FilteringEnabled    bool
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
+	ParentalCategories  []string // empty: use the global setting
+
+	UseOwnBlockedServices bool // false: use global settings
+	BlockedServices       []string
+
+	PortalPasswordHash string // bcrypt hash of the password for the self-service portal, the portal is disabled for the client if empty
+
+	LatencyBudget uint32 // in milliseconds, 0: use the global setting
+
+	AAAADisabled bool // AAAA requests get an empty answer (if false, the global setting is used)
+
+	IgnoreQueryLog bool // the requests are neither logged nor counted in the statistics
+
+	Tags []string // the client's tags select the client groups and the rules with $ctag modifier
+
+	Upstreams []string // the client's own upstream servers, may be domain-specific; empty: use the global setting
+
+	Blocked      bool      // the client's Internet access is paused: all its requests are blocked
+	BlockedUntil time.Time // the pause ends automatically at this time; zero: until it's removed
 }
 
 type clientJSON struct {
 	IP                  string `json:"ip"`
 	MAC                 string `json:"mac"`
+	Hostname            string `json:"hostname"`
+	ClientID            string `json:"client_id"`
 	Name                string `json:"name"`
 	UseGlobalSettings   bool   `json:"use_global_settings"`
 	FilteringEnabled    bool   `json:"filtering_enabled"`
 	ParentalEnabled     bool   `json:"parental_enabled"`
-	SafeSearchEnabled   bool   `json:"safebrowsing_enabled"`
-	SafeBrowsingEnabled bool   `json:"safesearch_enabled"`
+	SafeSearchEnabled   bool   `json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool   `json:"safebrowsing_enabled"`
+
+	ParentalCategories []string `json:"parental_categories"`
+
+	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
+	BlockedServices          []string `json:"blocked_services"`
+
+	PortalPassword    string `json:"portal_password,omitempty"` // write-only: the new password
+	PortalPasswordSet bool   `json:"portal_password_set"`       // false with no new password: the portal is disabled
+
+	LatencyBudget uint32 `json:"latency_budget"`
+
+	AAAADisabled bool `json:"aaaa_disabled"`
+
+	IgnoreQueryLog bool `json:"ignore_querylog"`
+
+	Tags []string `json:"tags"`
+
+	Upstreams []string `json:"upstreams"`
+
+	// read-only
+	WhoisInfo *whoisInfo `json:"whois_info,omitempty"`
+	Vendor    string     `json:"vendor,omitempty"` // the vendor of the device, by its MAC address
+
+	Blocked      bool       `json:"blocked"`                 // the client's Internet access is paused
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"` // the time the pause ends, none: until it's removed
+
+	Online   bool       `json:"online"`              // the device has replied during the last presence check
+	LastSeen *time.Time `json:"last_seen,omitempty"` // the last time the device replied
 }
 
 type clientSource uint
 
+// The sources of the host names, the later ones take precedence
 const (
-	ClientSourceHostsFile clientSource = 0 // from /etc/hosts
-	ClientSourceRDNS      clientSource = 1 // from rDNS
+	ClientSourceARP       clientSource = iota // from the ARP table
+	ClientSourceRDNS                          // from rDNS
+	ClientSourceDHCP                          // from the DHCP leases
+	ClientSourceHostsFile                     // from /etc/hosts
 )
 
+// Get the name of the source for the API
+func (s clientSource) String() string {
+	switch s {
+	case ClientSourceARP:
+		return "ARP"
+	case ClientSourceRDNS:
+		return "rDNS"
+	case ClientSourceDHCP:
+		return "DHCP"
+	}
+	return "etc/hosts"
+}
+
 // ClientHost information
 type ClientHost struct {
 	Host   string
@@ -51,10 +121,13 @@ type ClientHost struct {
 }
 
 type clientsContainer struct {
-	list    map[string]*Client
-	ipIndex map[string]*Client
-	ipHost  map[string]ClientHost // IP -> Hostname
-	lock    sync.Mutex
+	list      map[string]*Client
+	ipIndex   map[string]*Client
+	ipHost    map[string]ClientHost            // IP -> Hostname
+	idIP      map[string]string                // IP -> the name of the client identified by client ID which uses it
+	ipMAC     map[string]string                // IP -> MAC address from the ARP table
+	upstreams map[string]*proxy.UpstreamConfig // client name -> the client's own upstream servers
+	lock      sync.Mutex
 }
 
 var clients clientsContainer
@@ -67,6 +140,8 @@ func clientsInit() {
 	clients.list = make(map[string]*Client)
 	clients.ipIndex = make(map[string]*Client)
 	clients.ipHost = make(map[string]ClientHost)
+	clients.idIP = make(map[string]string)
+	clients.upstreams = make(map[string]*proxy.UpstreamConfig)
 
 	clientsAddFromHostsFile()
 }
@@ -98,6 +173,16 @@ func clientFind(ip string) (Client, bool) {
 		return *c, true
 	}
 
+	c, ok = clients.list[clients.idIP[ip]]
+	if ok && len(c.ClientID) != 0 {
+		return *c, true
+	}
+
+	c = clientFindSubnet(ip)
+	if c != nil {
+		return *c, true
+	}
+
 	for _, c = range clients.list {
 		if len(c.MAC) != 0 {
 			mac, err := net.ParseMAC(c.MAC)
@@ -114,31 +199,204 @@ func clientFind(ip string) (Client, bool) {
 		}
 	}
 
+	// the client may roam between networks and get a different IP address each time,
+	// but it will present the same host name
+	dhcpHost := ""
+	ipAddr := net.ParseIP(ip)
+	if ipAddr != nil {
+		dhcpHost = dhcpServer.FindHostnameByIP(ipAddr)
+	}
+	autoHost := clients.ipHost[ip].Host
+	for _, c = range clients.list {
+		if len(c.Hostname) == 0 {
+			continue
+		}
+		if hostnameMatch(c.Hostname, dhcpHost) || hostnameMatch(c.Hostname, autoHost) {
+			return *c, true
+		}
+	}
+
 	return Client{}, false
 }
 
+// Find the client with the most specific subnet which contains the IP address
+func clientFindSubnet(ip string) *Client {
+	ipAddr := net.ParseIP(ip)
+	if ipAddr == nil {
+		return nil
+	}
+	var found *Client
+	foundOnes := -1
+	for _, c := range clients.list {
+		if !strings.Contains(c.IP, "/") {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(c.IP)
+		if err != nil || !ipnet.Contains(ipAddr) {
+			continue
+		}
+		ones, _ := ipnet.Mask.Size()
+		if ones > foundOnes {
+			found = c
+			foundOnes = ones
+		}
+	}
+	return found
+}
+
+// Return TRUE if the host name (which may be fully-qualified) belongs to the client's host name
+func hostnameMatch(clientHost, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(host) == 0 {
+		return false
+	}
+	return host == clientHost ||
+		strings.HasPrefix(host, clientHost+".")
+}
+
+// Find the current IP address of a client identified by host name
+func clientFindIPByHostname(host string) string {
+	for _, l := range dhcpServer.Leases() {
+		if hostnameMatch(host, l.Hostname) {
+			return l.IP.String()
+		}
+	}
+	for ip, ch := range clients.ipHost {
+		if hostnameMatch(host, ch.Host) {
+			return ip
+		}
+	}
+	return ""
+}
+
+// Return TRUE if there's a client with this name
+func clientNameExists(name string) bool {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok := clients.list[name]
+	return ok
+}
+
+// Find the current IP address of a client identified by name
+// DNS-over-HTTPS clients use the name as their ID: "/dns-query/<name>"
+func clientFindIPByName(name string) string {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[name]
+	if !ok {
+		return ""
+	}
+	if len(c.IP) != 0 {
+		if strings.Contains(c.IP, "/") {
+			return "" // a subnet
+		}
+		return c.IP
+	}
+	if len(c.MAC) != 0 {
+		mac, err := net.ParseMAC(c.MAC)
+		if err == nil {
+			ipAddr := dhcpServer.FindIPbyMAC(mac)
+			if ipAddr != nil {
+				return ipAddr.String()
+			}
+		}
+	}
+	if len(c.Hostname) != 0 {
+		return clientFindIPByHostname(c.Hostname)
+	}
+	return ""
+}
+
+// Remove the upstream servers of all clients, they are created again with the current settings
+func clientsResetUpstreams() {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	clients.upstreams = make(map[string]*proxy.UpstreamConfig)
+}
+
+// Find the IP address of the client with this DNS-over-HTTPS or DNS-over-TLS client ID
+// The client identified by client ID gets the address the request came from (addr),
+// the other clients use their name as the ID
+func clientFindIPByID(id string, addr string) string {
+	clients.lock.Lock()
+	for _, c := range clients.list {
+		if len(c.ClientID) != 0 && strings.EqualFold(c.ClientID, id) {
+			if len(addr) != 0 {
+				clients.idIP[addr] = c.Name
+			}
+			clients.lock.Unlock()
+			return addr
+		}
+	}
+	clients.lock.Unlock()
+
+	return clientFindIPByName(id)
+}
+
+// Find the current IP address of a client identified by name or host name
+func clientFindIP(name string) string {
+	ip := clientFindIPByName(name)
+	if len(ip) != 0 {
+		return ip
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	return clientFindIPByHostname(name)
+}
+
 // Check if Client object's fields are correct
 func clientCheck(c *Client) error {
 	if len(c.Name) == 0 {
 		return fmt.Errorf("Invalid Name")
 	}
 
-	if (len(c.IP) == 0 && len(c.MAC) == 0) ||
-		(len(c.IP) != 0 && len(c.MAC) != 0) {
-		return fmt.Errorf("IP or MAC required")
+	n := 0
+	for _, s := range []string{c.IP, c.MAC, c.Hostname, c.ClientID} {
+		if len(s) != 0 {
+			n++
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("IP, subnet, MAC, host name or client ID required")
 	}
 
 	if len(c.IP) != 0 {
 		ip := net.ParseIP(c.IP)
-		if ip == nil {
-			return fmt.Errorf("Invalid IP")
+		if ip != nil {
+			c.IP = ip.String()
+		} else {
+			_, ipnet, err := net.ParseCIDR(c.IP)
+			if err != nil {
+				return fmt.Errorf("Invalid IP")
+			}
+			c.IP = ipnet.String()
 		}
-		c.IP = ip.String()
-	} else {
+	} else if len(c.ClientID) != 0 {
+		c.ClientID = strings.ToLower(c.ClientID)
+		if !dnsforward.IsValidClientID(c.ClientID) {
+			return fmt.Errorf("Invalid client ID: only letters, digits and '-' are allowed")
+		}
+	} else if len(c.MAC) != 0 {
 		_, err := net.ParseMAC(c.MAC)
 		if err != nil {
 			return fmt.Errorf("Invalid MAC: %s", err)
 		}
+	} else {
+		c.Hostname = strings.ToLower(strings.TrimSuffix(c.Hostname, "."))
+		err := utils.IsValidHostname(c.Hostname)
+		if err != nil {
+			return fmt.Errorf("Invalid host name: %s", err)
+		}
+	}
+
+	if len(c.PortalPasswordHash) != 0 {
+		_, err := bcrypt.Cost([]byte(c.PortalPasswordHash))
+		if err != nil {
+			return fmt.Errorf("the portal password must be a bcrypt hash: %s", err)
+		}
 	}
 	return nil
 }
@@ -168,15 +426,75 @@ func clientAdd(c Client) (bool, error) {
 		}
 	}
 
+	c2 := clientFindByID(c.ClientID)
+	if c2 != nil {
+		return false, fmt.Errorf("Another client uses the same client ID: %s", c2.Name)
+	}
+
 	clients.list[c.Name] = &c
 	if len(c.IP) != 0 {
 		clients.ipIndex[c.IP] = &c
 	}
 
-	log.Tracef("'%s': '%s' | '%s' -> [%d]", c.Name, c.IP, c.MAC, len(clients.list))
+	log.Tracef("'%s': '%s' | '%s' | '%s' -> [%d]", c.Name, c.IP, c.MAC, c.Hostname, len(clients.list))
 	return true, nil
 }
 
+// Get the copies of the persistent clients
+func clientsSnapshot() []Client {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	list := make([]Client, 0, len(clients.list))
+	for _, c := range clients.list {
+		list = append(list, *c)
+	}
+	return list
+}
+
+// Replace the persistent clients at once, so the requests are never processed with a part of the clients
+// The clients which can't be added are skipped, their errors are returned.
+func clientsReplace(list []Client) []error {
+	var errs []error
+	newList := map[string]*Client{}
+	newIndex := map[string]*Client{}
+	for i := range list {
+		c := list[i]
+		err := clientCheck(&c)
+		if err == nil {
+			if _, ok := newList[c.Name]; ok {
+				err = fmt.Errorf("Client already exists")
+			} else if c2, ok := newIndex[c.IP]; ok && len(c.IP) != 0 {
+				err = fmt.Errorf("Another client uses the same IP address: %s", c2.Name)
+			}
+		}
+		if err == nil && len(c.ClientID) != 0 {
+			for _, c2 := range newList {
+				if c2.ClientID == c.ClientID {
+					err = fmt.Errorf("Another client uses the same client ID: %s", c2.Name)
+					break
+				}
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", c.Name, err))
+			continue
+		}
+
+		newList[c.Name] = &c
+		if len(c.IP) != 0 {
+			newIndex[c.IP] = &c
+		}
+	}
+
+	clients.lock.Lock()
+	clients.list = newList
+	clients.ipIndex = newIndex
+	clients.idIP = make(map[string]string)
+	clients.upstreams = make(map[string]*proxy.UpstreamConfig)
+	clients.lock.Unlock()
+	return errs
+}
+
 // Remove a client
 func clientDel(name string) bool {
 	clients.lock.Lock()
@@ -189,9 +507,35 @@ func clientDel(name string) bool {
 
 	delete(clients.list, name)
 	delete(clients.ipIndex, c.IP)
+	clientForget(name)
 	return true
 }
 
+// Find the client with this client ID
+// Must be called with the lock held
+func clientFindByID(id string) *Client {
+	if len(id) == 0 {
+		return nil
+	}
+	for _, c := range clients.list {
+		if c.ClientID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// Remove the addresses and the upstream servers of the client
+// Must be called with the lock held
+func clientForget(name string) {
+	for ip, n := range clients.idIP {
+		if n == name {
+			delete(clients.idIP, ip)
+		}
+	}
+	delete(clients.upstreams, name)
+}
+
 // Update a client
 func clientUpdate(name string, c Client) error {
 	err := clientCheck(&c)
@@ -223,11 +567,23 @@ func clientUpdate(name string, c Client) error {
 		}
 	}
 
+	if old.ClientID != c.ClientID {
+		c2 := clientFindByID(c.ClientID)
+		if c2 != nil {
+			return fmt.Errorf("Another client uses the same client ID: %s", c2.Name)
+		}
+	}
+
+	// the pause is changed by /control/clients/block only
+	c.Blocked = old.Blocked
+	c.BlockedUntil = old.BlockedUntil
+
 	// update Name index
 	if old.Name != c.Name {
 		delete(clients.list, old.Name)
 	}
 	clients.list[c.Name] = &c
+	clientForget(old.Name)
 
 	// update IP index
 	if old.IP != c.IP {
@@ -240,13 +596,15 @@ func clientUpdate(name string, c Client) error {
 	return nil
 }
 
+// Add the host name of the IP address
+// Return false if there's a host name from the same source or from a source which takes precedence
 func clientAddHost(ip, host string, source clientSource) (bool, error) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
 	// check index
-	_, ok := clients.ipHost[ip]
-	if ok {
+	ch, ok := clients.ipHost[ip]
+	if ok && ch.Source >= source {
 		return false, nil
 	}
 
@@ -258,73 +616,116 @@ func clientAddHost(ip, host string, source clientSource) (bool, error) {
 	return true, nil
 }
 
-// Parse system 'hosts' file and fill clients array
-func clientsAddFromHostsFile() {
-	hostsFn := "/etc/hosts"
-	if runtime.GOOS == "windows" {
-		hostsFn = os.ExpandEnv("$SystemRoot\\system32\\drivers\\etc\\hosts")
-	}
+// Replace the host names from the source with the new ones (IP -> host name)
+// Returns the number of the host names which are used
+func clientsSetHosts(source clientSource, hosts map[string]string) int {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
 
-	d, e := ioutil.ReadFile(hostsFn)
-	if e != nil {
-		log.Info("Can't read file %s: %v", hostsFn, e)
-		return
+	for ip, ch := range clients.ipHost {
+		if _, ok := hosts[ip]; !ok && ch.Source == source {
+			delete(clients.ipHost, ip)
+		}
 	}
-
-	lines := strings.Split(string(d), "\n")
 	n := 0
-	for _, ln := range lines {
-		ln = strings.TrimSpace(ln)
-		if len(ln) == 0 || ln[0] == '#' {
+	for ip, host := range hosts {
+		ch, ok := clients.ipHost[ip]
+		if ok && ch.Source > source {
 			continue
 		}
-
-		fields := strings.Fields(ln)
-		if len(fields) < 2 {
-			continue
+		clients.ipHost[ip] = ClientHost{
+			Host:   host,
+			Source: source,
 		}
+		n++
+	}
+	log.Tracef("%s: %d host names -> [%d]", source, n, len(clients.ipHost))
+	return n
+}
 
-		ok, e := clientAddHost(fields[0], fields[1], ClientSourceHostsFile)
-		if e != nil {
-			log.Tracef("%s", e)
-		}
-		if ok {
-			n++
+// Get the MAC address of the LAN device from the DHCP leases or the ARP table, "" if it's unknown
+// Must be called with the lock held
+func clientMAC(ip string) string {
+	if len(ip) == 0 {
+		return ""
+	}
+	for _, l := range dhcpServer.Leases() {
+		if l.IP.String() == ip {
+			return l.HWAddr.String()
 		}
 	}
+	return clients.ipMAC[ip]
+}
 
-	log.Info("Added %d client aliases from %s", n, hostsFn)
+// Get the name to show for the client's IP address:
+// the name of the persistent client or the host name from rDNS or 'hosts' file
+// Returns empty string if the client is unknown.
+func clientName(ip string) string {
+	c, ok := clientFind(ip)
+	if ok {
+		return c.Name
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	return clients.ipHost[ip].Host
 }
 
 type clientHostJSON struct {
 	IP     string `json:"ip"`
 	Name   string `json:"name"`
 	Source string `json:"source"`
+
+	MAC       string     `json:"mac,omitempty"`
+	Vendor    string     `json:"vendor,omitempty"` // the vendor of the device, by its MAC address
+	WhoisInfo *whoisInfo `json:"whois_info,omitempty"`
+
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
 }
 
 type clientListJSON struct {
-	Clients     []clientJSON     `json:"clients"`
-	AutoClients []clientHostJSON `json:"auto_clients"`
+	Clients       []clientJSON     `json:"clients"`
+	AutoClients   []clientHostJSON `json:"auto_clients"`
+	SupportedTags []string         `json:"supported_tags"`
 }
 
 // respond with information about configured clients
 func handleGetClients(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
 
-	data := clientListJSON{}
+	data := clientListJSON{SupportedTags: clientTags}
 
 	clients.lock.Lock()
 	for _, c := range clients.list {
 		cj := clientJSON{
 			IP:                  c.IP,
 			MAC:                 c.MAC,
+			Hostname:            c.Hostname,
+			ClientID:            c.ClientID,
 			Name:                c.Name,
 			UseGlobalSettings:   !c.UseOwnSettings,
 			FilteringEnabled:    c.FilteringEnabled,
 			ParentalEnabled:     c.ParentalEnabled,
 			SafeSearchEnabled:   c.SafeSearchEnabled,
 			SafeBrowsingEnabled: c.SafeBrowsingEnabled,
+
+			ParentalCategories: c.ParentalCategories,
+
+			UseGlobalBlockedServices: !c.UseOwnBlockedServices,
+			BlockedServices:          c.BlockedServices,
+
+			LatencyBudget: c.LatencyBudget,
+
+			AAAADisabled: c.AAAADisabled,
+
+			IgnoreQueryLog: c.IgnoreQueryLog,
+
+			Tags: c.Tags,
+
+			Upstreams: c.Upstreams,
 		}
+		cj.PortalPasswordSet = len(c.PortalPasswordHash) != 0
 
 		if len(c.MAC) != 0 {
 			hwAddr, _ := net.ParseMAC(c.MAC)
@@ -332,23 +733,47 @@ func handleGetClients(w http.ResponseWriter, r *http.Request) {
 			if ipAddr != nil {
 				cj.IP = ipAddr.String()
 			}
+		} else if len(c.Hostname) != 0 {
+			cj.IP = clientFindIPByHostname(c.Hostname)
+		}
+
+		mac := c.MAC
+		if len(mac) == 0 {
+			mac = clientMAC(cj.IP)
 		}
+		cj.Vendor = macVendor(mac)
+		cj.Online, cj.LastSeen = presence.get(mac)
+		cj.WhoisInfo = clientWhois(cj.IP)
+		cj.Blocked, cj.BlockedUntil = clientBlockedStatus(c, time.Now())
 
 		data.Clients = append(data.Clients, cj)
 	}
 	for ip, ch := range clients.ipHost {
 		cj := clientHostJSON{
-			IP:   ip,
-			Name: ch.Host,
-		}
-		cj.Source = "etc/hosts"
-		if ch.Source == ClientSourceRDNS {
-			cj.Source = "rDNS"
+			IP:        ip,
+			Name:      ch.Host,
+			Source:    ch.Source.String(),
+			MAC:       clientMAC(ip),
+			WhoisInfo: clientWhois(ip),
 		}
+		cj.Vendor = macVendor(cj.MAC)
+		cj.Online, cj.LastSeen = presence.get(cj.MAC)
 		data.AutoClients = append(data.AutoClients, cj)
 	}
 	clients.lock.Unlock()
 
+	// the public addresses have no host names, but they may be identified by WHOIS information
+	for _, ip := range whoisAddresses() {
+		if clientExists(ip) {
+			continue
+		}
+		data.AutoClients = append(data.AutoClients, clientHostJSON{
+			IP:        ip,
+			Source:    "WHOIS",
+			WhoisInfo: clientWhois(ip),
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	e := json.NewEncoder(w).Encode(data)
 	if e != nil {
@@ -362,12 +787,55 @@ func jsonToClient(cj clientJSON) (*Client, error) {
 	c := Client{
 		IP:                  cj.IP,
 		MAC:                 cj.MAC,
+		Hostname:            cj.Hostname,
+		ClientID:            cj.ClientID,
 		Name:                cj.Name,
 		UseOwnSettings:      !cj.UseGlobalSettings,
 		FilteringEnabled:    cj.FilteringEnabled,
 		ParentalEnabled:     cj.ParentalEnabled,
 		SafeSearchEnabled:   cj.SafeSearchEnabled,
 		SafeBrowsingEnabled: cj.SafeBrowsingEnabled,
+		ParentalCategories:  cj.ParentalCategories,
+
+		UseOwnBlockedServices: !cj.UseGlobalBlockedServices,
+		BlockedServices:       cj.BlockedServices,
+
+		LatencyBudget: cj.LatencyBudget,
+
+		AAAADisabled: cj.AAAADisabled,
+
+		IgnoreQueryLog: cj.IgnoreQueryLog,
+
+		Tags: cj.Tags,
+
+		Upstreams: cj.Upstreams,
+	}
+
+	if len(cj.PortalPassword) != 0 {
+		hash, err := hashPassword(cj.PortalPassword)
+		if err != nil {
+			return nil, err
+		}
+		c.PortalPasswordHash = hash
+	}
+
+	err := checkBlockedServices(c.BlockedServices)
+	if err != nil {
+		return nil, err
+	}
+	err = checkClientTags(c.Tags)
+	if err != nil {
+		return nil, err
+	}
+	err = dnsfilter.CheckParentalCategories(c.ParentalCategories)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range c.Upstreams {
+		_, err = validateUpstream(u)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", u, err)
+		}
 	}
 	return &c, nil
 }
@@ -462,6 +930,15 @@ func handleUpdateClient(w http.ResponseWriter, r *http.Request) {
 		httpError(w, http.StatusBadRequest, "%s", err)
 		return
 	}
+	if len(dj.Data.PortalPassword) == 0 && dj.Data.PortalPasswordSet {
+		// the password isn't sent back: the client keeps the current one
+		clients.lock.Lock()
+		old, ok := clients.list[dj.Name]
+		if ok {
+			c.PortalPasswordHash = old.PortalPasswordHash
+		}
+		clients.lock.Unlock()
+	}
 
 	err = clientUpdate(dj.Name, *c)
 	if err != nil {
@@ -479,4 +956,8 @@ func RegisterClientsHandlers() {
 	http.HandleFunc("/control/clients/add", postInstall(optionalAuth(ensurePOST(handleAddClient))))
 	http.HandleFunc("/control/clients/delete", postInstall(optionalAuth(ensurePOST(handleDelClient))))
 	http.HandleFunc("/control/clients/update", postInstall(optionalAuth(ensurePOST(handleUpdateClient))))
+	http.HandleFunc("/control/clients/block", postInstall(optionalAuth(ensurePOST(handleBlockClient))))
+	http.HandleFunc("/control/clients/wake", postInstall(optionalAuth(ensurePOST(handleClientsWake))))
+	http.HandleFunc("/control/client_groups/list", postInstall(optionalAuth(ensureGET(handleClientGroupsList))))
+	http.HandleFunc("/control/client_groups/set", postInstall(optionalAuth(ensurePOST(handleClientGroupsSet))))
 }
@@ -0,0 +1,123 @@
+// Pausing the Internet access of a client
+// E.g. "pause the Internet for Timmy until 7 PM": all DNS requests of the client are blocked
+// with a rule which takes precedence over everything else. The pause ends automatically
+// at the given time, the expired pauses are removed from the configuration by a background job.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Return TRUE if the client's Internet access is paused at this time
+func (c *Client) blockedAt(now time.Time) bool {
+	return c.Blocked && (c.BlockedUntil.IsZero() || now.Before(c.BlockedUntil))
+}
+
+// Get the pause status shown for the client
+func clientBlockedStatus(c *Client, now time.Time) (bool, *time.Time) {
+	if !c.blockedAt(now) {
+		return false, nil
+	}
+	if c.BlockedUntil.IsZero() {
+		return true, nil
+	}
+	until := c.BlockedUntil
+	return true, &until
+}
+
+// Pause or resume the Internet access of the client
+// The zero time pauses the access until it's resumed.
+func clientSetBlocked(name string, blocked bool, until time.Time, now time.Time) error {
+	if blocked && !until.IsZero() && !now.Before(until) {
+		return fmt.Errorf("the time must be in the future: %s", until.Format(time.RFC3339))
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	c, ok := clients.list[name]
+	if !ok {
+		return fmt.Errorf("Client not found")
+	}
+	c.Blocked = blocked
+	c.BlockedUntil = time.Time{}
+	if blocked {
+		c.BlockedUntil = until
+	}
+	return nil
+}
+
+// Resume the access of the clients whose pause has ended
+// Returns TRUE if a client has been changed
+func removeExpiredClientBlocks(now time.Time) bool {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	changed := false
+	for _, c := range clients.list {
+		if c.Blocked && !c.blockedAt(now) {
+			log.Info("Client %s: the pause has ended", c.Name)
+			c.Blocked = false
+			c.BlockedUntil = time.Time{}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Remove the ended pauses from the configuration periodically
+// The pause doesn't apply once it has ended, so the job only cleans up the configuration.
+func periodicallyRemoveExpiredClientBlocks() {
+	for range time.Tick(time.Minute) {
+		if !removeExpiredClientBlocks(time.Now()) {
+			continue
+		}
+		err := writeAllConfigs()
+		if err != nil {
+			log.Error("Couldn't write config file: %s", err)
+		}
+	}
+}
+
+type clientBlockJSON struct {
+	Name    string     `json:"name"`
+	Blocked bool       `json:"blocked"`
+	Until   *time.Time `json:"until"` // none: until the access is resumed
+}
+
+// Pause or resume the Internet access of the client
+func handleBlockClient(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := clientBlockJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if len(req.Name) == 0 {
+		httpError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	until := time.Time{}
+	if req.Until != nil {
+		until = *req.Until
+	}
+	err = clientSetBlocked(req.Name, req.Blocked, until, time.Now())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if !req.Blocked {
+		log.Info("Client %s: the Internet access is resumed", req.Name)
+	} else if until.IsZero() {
+		log.Info("Client %s: the Internet access is paused", req.Name)
+	} else {
+		log.Info("Client %s: the Internet access is paused until %s", req.Name, until.Format(time.RFC3339))
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
@@ -0,0 +1,157 @@
+// Runtime client discovery
+// The host names of the clients which aren't configured are collected from /etc/hosts, the DHCP leases,
+// the ARP table and rDNS (the addresses from the DNS requests are resolved via our own DNS server),
+// so the dashboard and the query log show their friendly names.
+// The sources are read again periodically, the host names from a source with higher priority are kept.
+
+package home
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	clientsRefreshPeriod = time.Minute
+	rdnsRetryPeriod      = time.Hour // the addresses which couldn't be resolved are resolved again
+)
+
+// Get the path of the system 'hosts' file
+func hostsFilePath() string {
+	if runtime.GOOS == "windows" {
+		return os.ExpandEnv("$SystemRoot\\system32\\drivers\\etc\\hosts")
+	}
+	return "/etc/hosts"
+}
+
+// Parse 'hosts' file: IP -> the first host name of the first line with this IP
+func parseHostsFile(data string) map[string]string {
+	hosts := map[string]string{}
+	for _, ln := range strings.Split(data, "\n") {
+		ln = strings.TrimSpace(ln)
+		if len(ln) == 0 || ln[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(ln)
+		if len(fields) < 2 {
+			continue
+		}
+		if _, ok := hosts[fields[0]]; !ok {
+			hosts[fields[0]] = fields[1]
+		}
+	}
+	return hosts
+}
+
+// Parse system 'hosts' file and fill clients array
+func clientsAddFromHostsFile() {
+	hostsFn := hostsFilePath()
+	d, e := ioutil.ReadFile(hostsFn)
+	if e != nil {
+		log.Debug("Can't read file %s: %v", hostsFn, e)
+		return
+	}
+
+	n := clientsSetHosts(ClientSourceHostsFile, parseHostsFile(string(d)))
+	log.Debug("Added %d client aliases from %s", n, hostsFn)
+}
+
+// Get the host names of the DHCP clients
+func clientsAddFromDHCP() {
+	hosts := map[string]string{}
+	for _, l := range append(dhcpServer.StaticLeases(), dhcpServer.Leases()...) {
+		if len(l.Hostname) != 0 && l.IP != nil {
+			hosts[l.IP.String()] = l.Hostname
+		}
+	}
+	clientsSetHosts(ClientSourceDHCP, hosts)
+}
+
+// Parse the output of 'arp -a': "<host name> (<IP>) at <MAC> ...", the host name is "?" if it's unknown
+// Returns IP -> host name and IP -> MAC address
+// The output on Windows has a different format, so nothing is found.
+func parseARP(data string) (map[string]string, map[string]string) {
+	hosts := map[string]string{}
+	macs := map[string]string{}
+	for _, ln := range strings.Split(data, "\n") {
+		fields := strings.Fields(ln)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := strings.TrimSuffix(strings.TrimPrefix(fields[1], "("), ")")
+		if net.ParseIP(ip) == nil {
+			continue
+		}
+		if fields[0] != "?" {
+			hosts[ip] = strings.TrimSuffix(fields[0], ".")
+		}
+		if len(fields) >= 4 && fields[2] == "at" {
+			mac, err := net.ParseMAC(padMAC(fields[3]))
+			if err == nil {
+				macs[ip] = mac.String()
+			}
+		}
+	}
+	return hosts, macs
+}
+
+// Add the leading zeros to the MAC address octets: macOS and BSD print "0:1a:2b:3c:4d:5e"
+func padMAC(mac string) string {
+	octets := strings.Split(mac, ":")
+	for i, o := range octets {
+		if len(o) == 1 {
+			octets[i] = "0" + o
+		}
+	}
+	return strings.Join(octets, ":")
+}
+
+// Read the ARP table: IP -> host name and IP -> MAC address
+// Returns FALSE if it can't be read.
+func readARP() (map[string]string, map[string]string, bool) {
+	if runtime.GOOS == "windows" {
+		return nil, nil, false
+	}
+	out, err := exec.Command("arp", "-a").Output()
+	if err != nil {
+		log.Debug("Can't read the ARP table: %s", err)
+		return nil, nil, false
+	}
+	hosts, macs := parseARP(string(out))
+	return hosts, macs, true
+}
+
+// Get the host names and the MAC addresses of the hosts in the ARP table
+func clientsAddFromARP() {
+	hosts, macs, ok := readARP()
+	if !ok {
+		return
+	}
+	clientsSetHosts(ClientSourceARP, hosts)
+
+	clients.lock.Lock()
+	clients.ipMAC = macs
+	clients.lock.Unlock()
+}
+
+// Read the sources of the host names again periodically
+func periodicallyRefreshClients() {
+	lastRDNSRetry := time.Now()
+	for {
+		clientsAddFromHostsFile()
+		clientsAddFromDHCP()
+		clientsAddFromARP()
+
+		if time.Since(lastRDNSRetry) >= rdnsRetryPeriod {
+			resetRDNS()
+			lastRDNSRetry = time.Now()
+		}
+		time.Sleep(clientsRefreshPeriod)
+	}
+}
@@ -1,6 +1,12 @@
 package home
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
 
 func TestClients(t *testing.T) {
 	var c Client
@@ -119,4 +125,299 @@ func TestClients(t *testing.T) {
 	if !clientExists("1.1.1.1") {
 		t.Fatalf("clientAddHost")
 	}
+
+	// add client identified by host name
+	c = Client{
+		Hostname: "Host.",
+		Name:     "client4",
+	}
+	b, e = clientAdd(c)
+	if !b || e != nil {
+		t.Fatalf("clientAdd - hostname")
+	}
+
+	// failed add - both IP and host name
+	c = Client{
+		IP:       "1.2.3.4",
+		Hostname: "host2",
+		Name:     "client5",
+	}
+	b, e = clientAdd(c)
+	if b || e == nil {
+		t.Fatalf("clientAdd - IP and hostname")
+	}
+
+	// find by host name
+	c, b = clientFind("1.1.1.1")
+	if !b || c.Name != "client4" {
+		t.Fatalf("clientFind - hostname")
+	}
+	_, b = clientFind("1.1.1.3")
+	if b {
+		t.Fatalf("clientFind - unknown hostname")
+	}
+
+	// name for the query log
+	_, _ = clientAddHost("192.168.1.2", "laptop.lan", ClientSourceRDNS)
+	if clientName("1.1.1.1") != "client4" || clientName("192.168.1.2") != "laptop.lan" || clientName("1.1.1.3") != "" {
+		t.Fatalf("clientName")
+	}
+}
+
+func TestClientGroups(t *testing.T) {
+	clients.list = map[string]*Client{}
+	clients.ipIndex = map[string]*Client{}
+	clients.ipHost = map[string]ClientHost{}
+	defer func() { clients.list, clients.ipIndex, clients.ipHost = nil, nil, nil }()
+	savedGroups, savedServices := config.ClientGroups, config.DNS.BlockedServices
+	defer func() { config.ClientGroups, config.DNS.BlockedServices = savedGroups, savedServices }()
+	initServices()
+
+	if checkClientTags([]string{"device_phone", "user_child"}) != nil || checkClientTags([]string{"user_root"}) == nil {
+		t.Fatalf("checkClientTags")
+	}
+	groups := []clientGroup{
+		{Name: "kids", Tags: []string{"user_child"}, ParentalEnabled: true, BlockedServices: []string{"tiktok"}},
+		{Name: "phones", Tags: []string{"device_phone"}, UseGlobalSettings: true, UseGlobalBlockedServices: true},
+	}
+	if err := checkClientGroups(groups); err != nil {
+		t.Fatalf("checkClientGroups: %s", err)
+	}
+	if checkClientGroups(append(groups, clientGroup{Name: "kids", Tags: []string{"os_ios"}})) == nil {
+		t.Fatalf("checkClientGroups - duplicate name")
+	}
+	config.ClientGroups = groups
+	config.DNS.BlockedServices = []string{"facebook"}
+
+	_, _ = clientAdd(Client{IP: "1.1.1.1", Name: "tablet", Tags: []string{"device_tablet", "user_child"}})
+	_, _ = clientAdd(Client{IP: "2.2.2.2", Name: "phone", Tags: []string{"device_phone", "os_android"}})
+	_, _ = clientAdd(Client{IP: "3.3.3.3", Name: "own", Tags: []string{"user_child"}, UseOwnSettings: true, FilteringEnabled: true})
+
+	// the group's settings
+	setts := dnsfilter.RequestFilteringSettings{}
+	applyClientSettings("1.1.1.1", &setts)
+	if !setts.ParentalEnabled || len(setts.ServicesRules) != 1 || setts.ServicesRules[0].Name != "tiktok" ||
+		len(setts.ClientTags) != 2 {
+		t.Fatalf("applyClientSettings - group: %+v", setts)
+	}
+
+	// the group uses the global settings
+	setts = dnsfilter.RequestFilteringSettings{FilteringEnabled: true}
+	applyClientSettings("2.2.2.2", &setts)
+	if setts.ParentalEnabled || !setts.FilteringEnabled || setts.ServicesRules[0].Name != "facebook" {
+		t.Fatalf("applyClientSettings - group with global settings: %+v", setts)
+	}
+
+	// the client's own settings take precedence
+	setts = dnsfilter.RequestFilteringSettings{}
+	applyClientSettings("3.3.3.3", &setts)
+	if setts.ParentalEnabled || !setts.FilteringEnabled || setts.ServicesRules[0].Name != "tiktok" {
+		t.Fatalf("applyClientSettings - own settings: %+v", setts)
+	}
+}
+
+func TestClientsSubnetAndID(t *testing.T) {
+	clients.list = map[string]*Client{}
+	clients.ipIndex = map[string]*Client{}
+	clients.ipHost = map[string]ClientHost{}
+	clients.idIP = map[string]string{}
+	clients.upstreams = map[string]*proxy.UpstreamConfig{}
+	defer func() {
+		clients.list, clients.ipIndex, clients.ipHost, clients.idIP, clients.upstreams = nil, nil, nil, nil, nil
+	}()
+
+	// subnets: the most specific one is used
+	b, e := clientAdd(Client{IP: "192.168.0.0/16", Name: "lan"})
+	if !b || e != nil {
+		t.Fatalf("clientAdd - subnet: %v", e)
+	}
+	b, e = clientAdd(Client{IP: "192.168.1.7/24", Name: "kids", Upstreams: []string{"1.1.1.3", "[/corp.example/]10.0.0.1"}})
+	if !b || e != nil {
+		t.Fatalf("clientAdd - subnet #2: %v", e)
+	}
+	b, _ = clientAdd(Client{IP: "192.168.1.0/33", Name: "invalid"})
+	if b {
+		t.Fatalf("clientAdd - invalid subnet")
+	}
+	c, b := clientFind("192.168.1.20")
+	if !b || c.Name != "kids" || c.IP != "192.168.1.0/24" {
+		t.Fatalf("clientFind - subnet: %+v", c)
+	}
+	c, b = clientFind("192.168.2.20")
+	if !b || c.Name != "lan" {
+		t.Fatalf("clientFind - subnet #2: %+v", c)
+	}
+	_, b = clientFind("10.0.0.1")
+	if b {
+		t.Fatalf("clientFind - no subnet")
+	}
+
+	// client ID
+	b, e = clientAdd(Client{ClientID: "My-Phone", Name: "phone", UseOwnSettings: true})
+	if !b || e != nil {
+		t.Fatalf("clientAdd - client ID: %v", e)
+	}
+	b, _ = clientAdd(Client{ClientID: "my-phone", Name: "phone2"})
+	if b {
+		t.Fatalf("clientAdd - client ID in use")
+	}
+	b, _ = clientAdd(Client{ClientID: "my.phone", Name: "phone3"})
+	if b {
+		t.Fatalf("clientAdd - invalid client ID")
+	}
+	_, b = clientFind("10.0.0.2")
+	if b {
+		t.Fatalf("clientFind - client ID before the request")
+	}
+	if clientFindIPByID("my-phone", "10.0.0.2") != "10.0.0.2" {
+		t.Fatalf("clientFindIPByID")
+	}
+	c, b = clientFind("10.0.0.2")
+	if !b || c.Name != "phone" {
+		t.Fatalf("clientFind - client ID: %+v", c)
+	}
+	if clientFindIPByID("unknown", "10.0.0.3") != "" {
+		t.Fatalf("clientFindIPByID - unknown")
+	}
+	if !clientDel("phone") {
+		t.Fatalf("clientDel - client ID")
+	}
+	_, b = clientFind("10.0.0.2")
+	if b {
+		t.Fatalf("clientFind - removed client ID")
+	}
+
+	// the client's own upstream servers are reused
+	u := clientUpstreams("192.168.1.20")
+	if u == nil || len(u.Upstreams) != 1 || u.Upstreams[0].Address() != "1.1.1.3:53" ||
+		u.DomainReservedUpstreams["corp.example."][0].Address() != "10.0.0.1:53" {
+		t.Fatalf("clientUpstreams: %v", u)
+	}
+	if clientUpstreams("192.168.1.21") != u {
+		t.Fatalf("clientUpstreams - reused")
+	}
+	if clientUpstreams("192.168.2.20") != nil {
+		t.Fatalf("clientUpstreams - global")
+	}
+}
+
+func TestClientsDiscovery(t *testing.T) {
+	clients.list = map[string]*Client{}
+	clients.ipIndex = map[string]*Client{}
+	clients.ipHost = map[string]ClientHost{}
+	defer func() { clients.list, clients.ipIndex, clients.ipHost = nil, nil, nil }()
+
+	hosts := parseHostsFile("# comment\n127.0.0.1 localhost\n192.168.1.2  nas nas.lan\n192.168.1.2 other\n::1 localhost6\ninvalid\n")
+	if len(hosts) != 3 || hosts["192.168.1.2"] != "nas" || hosts["::1"] != "localhost6" {
+		t.Fatalf("parseHostsFile: %v", hosts)
+	}
+
+	arp, macs := parseARP("router.lan (192.168.1.1) at aa:bb:cc:dd:ee:ff [ether] on eth0\n" +
+		"? (192.168.1.5) at <incomplete> on eth0\n" +
+		"? (192.168.1.8) at 0:1a:2b:3c:4d:5e on en0 ifscope [ethernet]\n" +
+		"phone.lan. (192.168.1.6) at 11:22:33:44:55:66 on en0 ifscope [ethernet]\n")
+	if len(arp) != 2 || arp["192.168.1.1"] != "router.lan" || arp["192.168.1.6"] != "phone.lan" {
+		t.Fatalf("parseARP: %v", arp)
+	}
+	if len(macs) != 3 || macs["192.168.1.1"] != "aa:bb:cc:dd:ee:ff" || macs["192.168.1.8"] != "00:1a:2b:3c:4d:5e" {
+		t.Fatalf("parseARP - MAC: %v", macs)
+	}
+
+	// the sources with higher priority take precedence
+	if clientsSetHosts(ClientSourceARP, arp) != 2 {
+		t.Fatalf("clientsSetHosts - ARP")
+	}
+	if clientsSetHosts(ClientSourceDHCP, map[string]string{"192.168.1.1": "gateway"}) != 1 {
+		t.Fatalf("clientsSetHosts - DHCP")
+	}
+	b, _ := clientAddHost("192.168.1.1", "router-rdns", ClientSourceRDNS)
+	if b || clientName("192.168.1.1") != "gateway" || clientName("192.168.1.6") != "phone.lan" {
+		t.Fatalf("clientAddHost - lower priority")
+	}
+	if clientsSetHosts(ClientSourceARP, map[string]string{"192.168.1.1": "router.lan"}) != 0 {
+		t.Fatalf("clientsSetHosts - ARP with lower priority")
+	}
+	b, _ = clientAddHost("192.168.1.7", "tv.lan", ClientSourceRDNS)
+	if !b || clientName("192.168.1.7") != "tv.lan" {
+		t.Fatalf("clientAddHost - rDNS")
+	}
+
+	// the host names which are gone from the source are removed
+	if clientName("192.168.1.6") != "" {
+		t.Fatalf("clientsSetHosts - removed")
+	}
+	clientsSetHosts(ClientSourceDHCP, map[string]string{})
+	if clientName("192.168.1.1") != "" || clientName("192.168.1.7") != "tv.lan" {
+		t.Fatalf("clientsSetHosts - DHCP removed")
+	}
+}
+
+func TestClientsBlock(t *testing.T) {
+	clients.list = map[string]*Client{}
+	clients.ipIndex = map[string]*Client{}
+	clients.ipHost = map[string]ClientHost{}
+	clients.idIP = map[string]string{}
+	clients.upstreams = map[string]*proxy.UpstreamConfig{}
+	defer func() {
+		clients.list, clients.ipIndex, clients.ipHost, clients.idIP, clients.upstreams = nil, nil, nil, nil, nil
+	}()
+
+	b, e := clientAdd(Client{IP: "1.1.1.1", Name: "Timmy"})
+	if !b || e != nil {
+		t.Fatalf("clientAdd: %v", e)
+	}
+	now := time.Now()
+	if clientSetBlocked("Tommy", true, time.Time{}, now) == nil {
+		t.Fatalf("clientSetBlocked - unknown client")
+	}
+	if clientSetBlocked("Timmy", true, now.Add(-time.Minute), now) == nil {
+		t.Fatalf("clientSetBlocked - the time in the past")
+	}
+
+	// until the pause is removed
+	if clientSetBlocked("Timmy", true, time.Time{}, now) != nil {
+		t.Fatalf("clientSetBlocked")
+	}
+	setts := dnsfilter.RequestFilteringSettings{}
+	applyClientSettings("1.1.1.1", &setts)
+	if setts.BlockedClient != "Timmy" {
+		t.Fatalf("applyClientSettings - paused client: %+v", setts)
+	}
+
+	// the update keeps the pause
+	if clientUpdate("Timmy", Client{IP: "1.1.1.1", Name: "Timmy", FilteringEnabled: true}) != nil {
+		t.Fatalf("clientUpdate")
+	}
+	blocked, until := clientBlockedStatus(clients.list["Timmy"], now)
+	if !blocked || until != nil {
+		t.Fatalf("clientBlockedStatus: %v %v", blocked, until)
+	}
+
+	// the pause ends automatically
+	if clientSetBlocked("Timmy", true, now.Add(time.Hour), now) != nil {
+		t.Fatalf("clientSetBlocked - until")
+	}
+	blocked, until = clientBlockedStatus(clients.list["Timmy"], now)
+	if !blocked || until == nil || !until.Equal(now.Add(time.Hour)) {
+		t.Fatalf("clientBlockedStatus - until: %v %v", blocked, until)
+	}
+	if removeExpiredClientBlocks(now) {
+		t.Fatalf("removeExpiredClientBlocks - the pause hasn't ended")
+	}
+	later := now.Add(2 * time.Hour)
+	blocked, _ = clientBlockedStatus(clients.list["Timmy"], later)
+	if blocked || !removeExpiredClientBlocks(later) || clients.list["Timmy"].Blocked {
+		t.Fatalf("removeExpiredClientBlocks")
+	}
+
+	// resume the access
+	_ = clientSetBlocked("Timmy", true, time.Time{}, now)
+	if clientSetBlocked("Timmy", false, time.Time{}, now) != nil || clients.list["Timmy"].Blocked {
+		t.Fatalf("clientSetBlocked - resume")
+	}
+	setts = dnsfilter.RequestFilteringSettings{}
+	applyClientSettings("1.1.1.1", &setts)
+	if len(setts.BlockedClient) != 0 {
+		t.Fatalf("applyClientSettings - resumed client: %+v", setts)
+	}
 }
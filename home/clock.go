@@ -0,0 +1,92 @@
+// System clock jumps detection
+// Routers without RTC boot with the clock set to 1970 and then get the correct time via NTP,
+// the time-dependent subsystems must survive such jumps.
+
+package home
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	clockCheckPeriod   = 10 * time.Second
+	clockJumpThreshold = time.Minute    // a smaller difference is a normal NTP adjustment
+	clockWarningPeriod = 24 * time.Hour // how long a warning about a jump is shown
+)
+
+// The system clock is surely wrong if it's earlier than this
+var clockMinValid = time.Date(2019, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+type clockJump struct {
+	when  time.Time     // the time after the jump
+	delta time.Duration // positive if the clock has moved forward
+}
+
+var clockState struct {
+	sync.Mutex
+	lastJump clockJump
+}
+
+// clockIsValid returns false if the system clock is obviously not set
+func clockIsValid(now time.Time) bool {
+	return now.After(clockMinValid)
+}
+
+// Check the wall clock against the monotonic clock periodically
+func clockMonitor() {
+	prev := time.Now()
+	for range time.Tick(clockCheckPeriod) {
+		now := time.Now()
+		elapsed := now.Sub(prev)                       // uses the monotonic clock readings
+		wallElapsed := now.Round(0).Sub(prev.Round(0)) // Round(0) strips the monotonic clock reading
+		delta := wallElapsed - elapsed
+		if delta >= clockJumpThreshold || delta <= -clockJumpThreshold {
+			onClockJump(prev.Round(0).Add(elapsed), now, delta)
+		}
+		prev = now
+	}
+}
+
+// Handle the system clock jump
+// expected is the time we'd have now if the clock hadn't jumped
+func onClockJump(expected, now time.Time, delta time.Duration) {
+	log.Info("System clock has jumped by %s: %s -> %s",
+		delta, expected.Format(time.RFC3339), now.Format(time.RFC3339))
+
+	clockState.Lock()
+	clockState.lastJump = clockJump{when: now, delta: delta}
+	clockState.Unlock()
+
+	// The leases issued with an unset clock would all expire at once,
+	// and the leases issued before the clock was set back would never expire.
+	// A forward jump from a valid time may be a system resume though: then the leases have really expired.
+	if delta < 0 || !clockIsValid(expected) {
+		config.RLock()
+		dhcpEnabled := config.DHCP.Enabled
+		config.RUnlock()
+		if dhcpEnabled {
+			dhcpServer.ShiftLeases(delta)
+		}
+	}
+
+	// filters update time might have become invalid
+	go filtering.refreshFiltersIfNecessary(false)
+}
+
+// clockWarning returns a description of the system clock problem or an empty string
+func clockWarning() string {
+	now := time.Now()
+	if !clockIsValid(now) {
+		return fmt.Sprintf("System clock is not set: %s", now.Format(time.RFC3339))
+	}
+
+	clockState.Lock()
+	jump := clockState.lastJump
+	clockState.Unlock()
+	if !jump.when.IsZero() && now.Sub(jump.when) < clockWarningPeriod {
+		return fmt.Sprintf("System clock has jumped by %s at %s", jump.delta, jump.when.Format(time.RFC3339))
+	}
+	return ""
+}
@@ -8,11 +8,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/acme"
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/golibs/file"
-	"github.com/AdguardTeam/golibs/log"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -23,19 +23,47 @@ const (
 
 // logSettings
 type logSettings struct {
-	LogFile string `yaml:"log_file"` // Path to the log file. If empty, write to stdout. If "syslog", writes to syslog
-	Verbose bool   `yaml:"verbose"`  // If true, verbose logging is enabled
+	LogFile       string            `yaml:"log_file"`        // Path to the log file. If empty, write to stdout. If "syslog", writes to syslog
+	Verbose       bool              `yaml:"verbose"`         // If true, verbose logging is enabled
+	LogLevel      string            `yaml:"log_level"`       // The default level: "error", "info" or "debug" (empty: by "verbose")
+	LogLevels     map[string]string `yaml:"log_levels"`      // subsystem -> level
+	LogFormat     string            `yaml:"log_format"`      // "text" (default) or "json"
+	LogMaxSize    int               `yaml:"log_max_size"`    // The log file is rotated when it's larger (MB), 0: never
+	LogMaxAge     int               `yaml:"log_max_age"`     // The log file is rotated when it's older (days), 0: never
+	LogMaxBackups int               `yaml:"log_max_backups"` // The number of the rotated files to keep, 0: all
 }
 
 type clientObject struct {
 	Name                string `yaml:"name"`
 	IP                  string `yaml:"ip"`
 	MAC                 string `yaml:"mac"`
+	Hostname            string `yaml:"hostname"`
+	ClientID            string `yaml:"client_id,omitempty"`
 	UseGlobalSettings   bool   `yaml:"use_global_settings"`
 	FilteringEnabled    bool   `yaml:"filtering_enabled"`
 	ParentalEnabled     bool   `yaml:"parental_enabled"`
-	SafeSearchEnabled   bool   `yaml:"safebrowsing_enabled"`
-	SafeBrowsingEnabled bool   `yaml:"safesearch_enabled"`
+	SafeSearchEnabled   bool   `yaml:"safesearch_enabled"`
+	SafeBrowsingEnabled bool   `yaml:"safebrowsing_enabled"`
+
+	ParentalCategories []string `yaml:"parental_categories,omitempty"`
+
+	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services"`
+	BlockedServices          []string `yaml:"blocked_services"`
+
+	PortalPasswordHash string `yaml:"portal_password,omitempty"` // bcrypt hash
+
+	LatencyBudget uint32 `yaml:"latency_budget,omitempty"` // in milliseconds
+
+	AAAADisabled bool `yaml:"aaaa_disabled,omitempty"`
+
+	IgnoreQueryLog bool `yaml:"ignore_querylog,omitempty"`
+
+	Tags []string `yaml:"tags,omitempty"`
+
+	Upstreams []string `yaml:"upstreams,omitempty"`
+
+	Blocked      bool      `yaml:"blocked,omitempty"`
+	BlockedUntil time.Time `yaml:"blocked_until,omitempty"`
 }
 
 // configuration is loaded from YAML
@@ -52,18 +80,70 @@ type configuration struct {
 	runningAsService bool
 	disableUpdate    bool // If set, don't check for updates
 
+	// The settings from the reloaded file which take effect after restart (nil: none)
+	// The running servers keep the current ones, but these are written to the file.
+	pendingTLS  *tlsConfig
+	pendingDHCP *dhcpd.ServerConfig
+
 	BindHost     string `yaml:"bind_host"`     // BindHost is the IP address of the HTTP server to bind to
 	BindPort     int    `yaml:"bind_port"`     // BindPort is the port the HTTP server
-	AuthName     string `yaml:"auth_name"`     // AuthName is the basic auth username
-	AuthPass     string `yaml:"auth_pass"`     // AuthPass is the basic auth password
 	Language     string `yaml:"language"`      // two-letter ISO 639-1 language code
 	RlimitNoFile uint   `yaml:"rlimit_nofile"` // Maximum number of opened fd's per process (0: default)
+	IncludeDir   string `yaml:"include_dir"`   // Directory with *.yaml files containing additional clients, rewrites and filters
+	ServiceUser  string `yaml:"service_user"`  // The user who must own the configuration and data files (empty: don't change the owner)
+
+	UpdateChannel string `yaml:"update_channel"` // "stable" or "beta" (empty: the channel of this build)
+
+	// Users of the web interface (empty: no authentication)
+	Users         []webUser `yaml:"users"`
+	WebSessionTTL uint32    `yaml:"web_session_ttl"` // lifetime of the login session, in hours
+	AuthAttempts  uint      `yaml:"auth_attempts"`   // an address is blocked after this number of failed login attempts (0: never)
+	AuthBlockMin  uint      `yaml:"block_auth_min"`  // for this number of minutes
+
+	// Tokens of the scripts and the integrations
+	APITokens []apiToken `yaml:"api_tokens"`
+
+	// Listen addresses of the services (empty: bind_host, bind_port and the ports in dns and tls sections)
+	Listen listenConfig `yaml:"listen"`
 
 	DNS       dnsConfig          `yaml:"dns"`
 	TLS       tlsConfig          `yaml:"tls"`
+	ACME      acmeConfig         `yaml:"acme"`
 	Filters   []filter           `yaml:"filters"`
 	UserRules []string           `yaml:"user_rules"`
 	DHCP      dhcpd.ServerConfig `yaml:"dhcp"`
+	Portal    portalConfig       `yaml:"portal"`
+
+	// The URL and the script which are notified about the DHCP lease events
+	DHCPHooks dhcpHooksConfig `yaml:"dhcp_hooks"`
+
+	// Rules which allow or block a domain for a limited time
+	TempRules []tempRule `yaml:"temp_rules"`
+
+	// User rules and rewrites may be provisioned from a remote URL
+	RemoteRules remoteRulesConfig `yaml:"remote_rules"`
+
+	// The settings may be pulled from another instance
+	Sync syncConfig `yaml:"sync"`
+
+	// Failover pair with another instance
+	HA haConfig `yaml:"ha"`
+
+	// Limits for every filter list, protect from a list which is broken or suddenly grows too big
+	FilterMaxSize  int64 `yaml:"filter_max_size"`  // maximum size in bytes (0: no limit)
+	FilterMaxRules int   `yaml:"filter_max_rules"` // maximum number of rules (0: no limit)
+
+	// Bounds of the update period set by a filter via "! Expires:" header (in hours)
+	FilterMinUpdatePeriod uint32 `yaml:"filter_min_update_period"`
+	FilterMaxUpdatePeriod uint32 `yaml:"filter_max_update_period"` // 0: no limit
+
+	// Filtering policies for the tagged clients
+	ClientGroups []clientGroup `yaml:"client_groups"`
+
+	WhoisEnabled bool   `yaml:"whois_enabled"` // the public addresses of the clients are looked up in WHOIS
+	OUIFile      string `yaml:"oui_file"`      // IEEE OUI registry file for the device vendors (empty: the system file)
+
+	PresenceDetection bool `yaml:"presence_detection"` // the addresses from the DHCP leases are probed to show which devices are online
 
 	// Note: this array is filled only before file read/write and then it's cleared
 	Clients []clientObject `yaml:"clients"`
@@ -82,7 +162,18 @@ type dnsConfig struct {
 
 	dnsforward.FilteringConfig `yaml:",inline"`
 
-	UpstreamDNS []string `yaml:"upstream_dns"`
+	UpstreamDNS         []string `yaml:"upstream_dns"`
+	UpstreamTimeout     uint32   `yaml:"upstream_timeout"`      // in seconds, 0: default
+	UpstreamPoolSize    int      `yaml:"upstream_pool_size"`    // max number of TCP and TLS connections kept open to an upstream server, 0: default
+	UpstreamPipelining  bool     `yaml:"upstream_pipelining"`   // if true, several requests are sent over a connection without waiting for the responses
+	UpstreamIdleTimeout uint32   `yaml:"upstream_idle_timeout"` // TCP and TLS connections are closed after this idle time, in seconds, 0: default
+	LocalPTRDNS         []string `yaml:"local_ptr_upstreams"`   // resolvers for the reverse lookups of the private addresses
+	FallbackDNS         []string `yaml:"fallback_dns"`          // used only if all upstream servers fail
+	FallbackTimeout     uint32   `yaml:"fallback_timeout"`      // in seconds, 0: default
+	BlockedServices     []string `yaml:"blocked_services"`      // services blocked for all clients which don't use their own list
+
+	// Listeners which are turned off: "udp", "tcp", "tls" (DNS-over-TLS), "quic" (DNS-over-QUIC), "https" (DNS-over-HTTPS)
+	DisabledListeners []string `yaml:"disabled_listeners"`
 }
 
 var defaultDNS = []string{"https://dns.cloudflare.com/dns-query"}
@@ -95,6 +186,18 @@ type tlsConfigSettings struct {
 	PortHTTPS      int    `yaml:"port_https" json:"port_https,omitempty"`               // HTTPS port. If 0, HTTPS will be disabled
 	PortDNSOverTLS int    `yaml:"port_dns_over_tls" json:"port_dns_over_tls,omitempty"` // DNS-over-TLS port. If 0, DOT will be disabled
 
+	// DNS-over-QUIC UDP port (experimental). If 0, DOQ will be disabled
+	PortDNSOverQUIC int `yaml:"port_dns_over_quic" json:"port_dns_over_quic,omitempty"`
+
+	// Strict-Transport-Security header sent with force_https
+	HSTSMaxAge            uint32 `yaml:"hsts_max_age" json:"hsts_max_age,omitempty"` // seconds; 0: one year
+	HSTSIncludeSubdomains bool   `yaml:"hsts_include_subdomains" json:"hsts_include_subdomains,omitempty"`
+
+	// The certificates chain and the private key are loaded from these files, e.g. the ones renewed by certbot
+	// empty: they are stored in this file
+	CertificatePath string `yaml:"certificate_path" json:"certificate_path"`
+	PrivateKeyPath  string `yaml:"private_key_path" json:"private_key_path"`
+
 	dnsforward.TLSConfig `yaml:",inline" json:",inline"`
 }
 
@@ -131,6 +234,9 @@ var config = configuration{
 	ourConfigFilename: "AdGuardHome.yaml",
 	BindPort:          3000,
 	BindHost:          "0.0.0.0",
+	WebSessionTTL:     30 * 24,
+	AuthAttempts:      5,
+	AuthBlockMin:      15,
 	DNS: dnsConfig{
 		BindHost: "0.0.0.0",
 		Port:     53,
@@ -144,6 +250,8 @@ var config = configuration{
 			RefuseAny:          true,
 			BootstrapDNS:       defaultBootstrap,
 			AllServers:         false,
+			CacheSize:          4 * 1024 * 1024,
+			StatsInterval:      1, // days
 		},
 		UpstreamDNS: defaultDNS,
 	},
@@ -153,6 +261,12 @@ var config = configuration{
 			PortDNSOverTLS: 853, // needs to be passed through to dnsproxy
 		},
 	},
+	ACME: acmeConfig{
+		Challenge:        "http-01",
+		PropagationDelay: 60,
+		DirectoryURL:     acme.LetsEncryptURL,
+		RenewBeforeDays:  30,
+	},
 	Filters: []filter{
 		{Filter: dnsfilter.Filter{ID: 1}, Enabled: true, URL: "https://adguardteam.github.io/AdGuardSDNSFilter/Filters/filter.txt", Name: "AdGuard Simplified Domain Names filter"},
 		{Filter: dnsfilter.Filter{ID: 2}, Enabled: false, URL: "https://adaway.org/hosts.txt", Name: "AdAway"},
@@ -160,10 +274,31 @@ var config = configuration{
 		{Filter: dnsfilter.Filter{ID: 4}, Enabled: false, URL: "https://www.malwaredomainlist.com/hostslist/hosts.txt", Name: "MalwareDomainList.com Hosts List"},
 	},
 	DHCP: dhcpd.ServerConfig{
-		LeaseDuration: 86400,
-		ICMPTimeout:   1000,
+		LeaseDuration:   86400,
+		ICMPTimeout:     1000,
+		LocalDomainName: "lan",
+		V6: dhcpd.V6ServerConfig{
+			LeaseDuration: 86400,
+		},
+	},
+	Portal: portalConfig{
+		UnblockDuration: 60,
 	},
-	SchemaVersion: currentSchemaVersion,
+	RemoteRules: remoteRulesConfig{
+		Interval: 60,
+	},
+	Sync: syncConfig{
+		Interval: 10,
+	},
+	HA: haConfig{
+		Interval: 60,
+	},
+	FilterMaxSize:         100 * 1024 * 1024,
+	FilterMinUpdatePeriod: 1,
+	FilterMaxUpdatePeriod: 7 * 24,
+	WhoisEnabled:          true,
+	PresenceDetection:     true,
+	SchemaVersion:         currentSchemaVersion,
 }
 
 // init initializes default configuration for the current OS&ARCH
@@ -206,6 +341,27 @@ func getLogSettings() logSettings {
 	return l
 }
 
+// Check the settings which can't be used as is
+func validateConfig(c *configuration) error {
+	err := validateWebUsers(c.Users)
+	if err == nil {
+		err = validateAPITokens(c.APITokens)
+	}
+	if err == nil {
+		err = validateSyncConfig(c.Sync)
+	}
+	if err == nil {
+		err = validateHAConfig(c.HA)
+	}
+	if err == nil {
+		err = validateUpdateChannel(c.UpdateChannel)
+	}
+	if err == nil {
+		err = validateLogSettings(c.logSettings)
+	}
+	return err
+}
+
 // parseConfig loads configuration from the YAML file
 func parseConfig() error {
 	configFile := config.getConfigFilename()
@@ -221,21 +377,25 @@ func parseConfig() error {
 		return err
 	}
 
+	err = loadConfigIncludes()
+	if err != nil {
+		log.Error("%s", err)
+		return err
+	}
+
+	err = validateConfig(&config)
+	if err != nil {
+		log.Error("%s", err)
+		return err
+	}
+
+	// on reload, the new clients replace the current ones at once
+	list := []Client{}
 	for _, cy := range config.Clients {
-		cli := Client{
-			Name:                cy.Name,
-			IP:                  cy.IP,
-			MAC:                 cy.MAC,
-			UseOwnSettings:      !cy.UseGlobalSettings,
-			FilteringEnabled:    cy.FilteringEnabled,
-			ParentalEnabled:     cy.ParentalEnabled,
-			SafeSearchEnabled:   cy.SafeSearchEnabled,
-			SafeBrowsingEnabled: cy.SafeBrowsingEnabled,
-		}
-		_, err = clientAdd(cli)
-		if err != nil {
-			log.Tracef("clientAdd: %s", err)
-		}
+		list = append(list, fromClientObject(cy))
+	}
+	for _, err := range clientsReplace(list) {
+		log.Tracef("clientAdd: %s", err)
 	}
 	config.Clients = nil
 
@@ -262,6 +422,81 @@ func readConfigFile() ([]byte, error) {
 	return d, nil
 }
 
+// Get the client from its settings in the configuration file
+func fromClientObject(cy clientObject) Client {
+	return Client{
+		Name:                cy.Name,
+		IP:                  cy.IP,
+		MAC:                 cy.MAC,
+		Hostname:            cy.Hostname,
+		ClientID:            cy.ClientID,
+		UseOwnSettings:      !cy.UseGlobalSettings,
+		FilteringEnabled:    cy.FilteringEnabled,
+		ParentalEnabled:     cy.ParentalEnabled,
+		SafeSearchEnabled:   cy.SafeSearchEnabled,
+		SafeBrowsingEnabled: cy.SafeBrowsingEnabled,
+		ParentalCategories:  cy.ParentalCategories,
+
+		UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
+		BlockedServices:       cy.BlockedServices,
+
+		PortalPasswordHash: cy.PortalPasswordHash,
+
+		LatencyBudget: cy.LatencyBudget,
+
+		AAAADisabled: cy.AAAADisabled,
+
+		IgnoreQueryLog: cy.IgnoreQueryLog,
+
+		Tags: cy.Tags,
+
+		Upstreams: cy.Upstreams,
+
+		Blocked:      cy.Blocked,
+		BlockedUntil: cy.BlockedUntil,
+	}
+}
+
+// Get the client's settings for the configuration file
+func toClientObject(cli *Client) clientObject {
+	ip := cli.IP
+	if len(cli.MAC) != 0 || len(cli.Hostname) != 0 || len(cli.ClientID) != 0 {
+		ip = ""
+	}
+	return clientObject{
+		Name:                cli.Name,
+		IP:                  ip,
+		MAC:                 cli.MAC,
+		Hostname:            cli.Hostname,
+		ClientID:            cli.ClientID,
+		UseGlobalSettings:   !cli.UseOwnSettings,
+		FilteringEnabled:    cli.FilteringEnabled,
+		ParentalEnabled:     cli.ParentalEnabled,
+		SafeSearchEnabled:   cli.SafeSearchEnabled,
+		SafeBrowsingEnabled: cli.SafeBrowsingEnabled,
+
+		ParentalCategories: cli.ParentalCategories,
+
+		UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+		BlockedServices:          cli.BlockedServices,
+
+		PortalPasswordHash: cli.PortalPasswordHash,
+
+		LatencyBudget: cli.LatencyBudget,
+
+		AAAADisabled: cli.AAAADisabled,
+
+		IgnoreQueryLog: cli.IgnoreQueryLog,
+
+		Tags: cli.Tags,
+
+		Upstreams: cli.Upstreams,
+
+		Blocked:      cli.Blocked,
+		BlockedUntil: cli.BlockedUntil,
+	}
+}
+
 // Saves configuration to the YAML file and also saves the user filter contents to a file
 func (c *configuration) write() error {
 	c.Lock()
@@ -269,26 +504,18 @@ func (c *configuration) write() error {
 
 	clientsList := clientsGetList()
 	for _, cli := range clientsList {
-		ip := cli.IP
-		if len(cli.MAC) != 0 {
-			ip = ""
-		}
-		cy := clientObject{
-			Name:                cli.Name,
-			IP:                  ip,
-			MAC:                 cli.MAC,
-			UseGlobalSettings:   !cli.UseOwnSettings,
-			FilteringEnabled:    cli.FilteringEnabled,
-			ParentalEnabled:     cli.ParentalEnabled,
-			SafeSearchEnabled:   cli.SafeSearchEnabled,
-			SafeBrowsingEnabled: cli.SafeBrowsingEnabled,
-		}
-		config.Clients = append(config.Clients, cy)
+		config.Clients = append(config.Clients, toClientObject(cli))
 	}
 
 	configFile := config.getConfigFilename()
 	log.Debug("Writing YAML file: %s", configFile)
+	restorePending := includePendingSettings()
+	restoreIncluded := excludeIncludedObjects()
+	restoreTLS := excludeTLSFileContents()
 	yamlText, err := yaml.Marshal(&config)
+	restoreTLS()
+	restoreIncluded()
+	restorePending()
 	config.Clients = nil
 	if err != nil {
 		log.Error("Couldn't generate YAML file: %s", err)
@@ -299,6 +526,7 @@ func (c *configuration) write() error {
 		log.Error("Couldn't save YAML config: %s", err)
 		return err
 	}
+	secureFile(configFile)
 
 	return nil
 }
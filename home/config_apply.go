@@ -0,0 +1,310 @@
+// Applying and validating the settings
+// The new settings are applied to the DNS server first and written to the file only if it has succeeded.
+// If either step fails, the previous settings are restored and the DNS server is started with them again,
+//  so the server isn't left stopped or with a half of the new settings.
+// The settings are recorded as the previous ones only after the DNS server has accepted them:
+//  the DNS, TLS and listen settings, the filters, the user and temporary rules, the client groups and the clients.
+// /control/config/validate checks the proposed settings without applying them:
+//  the upstream servers must answer, the ports must be free and the certificate must be valid.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// The settings which the DNS server is configured with
+type settingsSnapshot struct {
+	dns          dnsConfig
+	tls          tlsConfig
+	listen       listenConfig
+	filters      []filter
+	userRules    []string
+	tempRules    []tempRule
+	clientGroups []clientGroup
+	clients      []Client
+}
+
+// The settings which were applied successfully for the last time
+var appliedSettings struct {
+	sync.Mutex
+	saved    bool
+	snapshot settingsSnapshot
+}
+
+// Get the copy of the current settings
+func takeSettingsSnapshot() settingsSnapshot {
+	config.RLock()
+	s := settingsSnapshot{
+		dns:          config.DNS,
+		tls:          config.TLS,
+		listen:       config.Listen,
+		filters:      append([]filter{}, config.Filters...),
+		userRules:    append([]string{}, config.UserRules...),
+		tempRules:    append([]tempRule{}, config.TempRules...),
+		clientGroups: append([]clientGroup{}, config.ClientGroups...),
+	}
+	config.RUnlock()
+	s.clients = clientsSnapshot()
+	return s
+}
+
+// Record the settings which the DNS server has accepted
+func saveAppliedSettings() {
+	s := takeSettingsSnapshot()
+	appliedSettings.Lock()
+	appliedSettings.saved = true
+	appliedSettings.snapshot = s
+	appliedSettings.Unlock()
+}
+
+// Put the settings back into the configuration
+func (s settingsSnapshot) restore() {
+	config.Lock()
+	config.DNS = s.dns
+	config.TLS = s.tls
+	config.Listen = s.listen
+	config.Filters = append([]filter{}, s.filters...)
+	config.UserRules = append([]string{}, s.userRules...)
+	config.TempRules = append([]tempRule{}, s.tempRules...)
+	config.ClientGroups = append([]clientGroup{}, s.clientGroups...)
+	config.Unlock()
+	for _, err := range clientsReplace(s.clients) {
+		log.Error("Couldn't restore client %s", err)
+	}
+}
+
+// Restore the previous settings and apply them again
+func rollbackSettings() {
+	appliedSettings.Lock()
+	if !appliedSettings.saved {
+		appliedSettings.Unlock()
+		return
+	}
+	s := appliedSettings.snapshot
+	appliedSettings.Unlock()
+	s.restore()
+
+	log.Info("The previous settings are restored")
+	if config.TLS.ValidPair {
+		err := setTLSCertificate(config.TLS.CertificateChain, config.TLS.PrivateKey)
+		if err != nil {
+			log.Error("TLS: %s", err)
+		}
+	}
+
+	var err error
+	if isRunning() {
+		err = reconfigureDNSServer()
+	} else {
+		err = startDNSServer()
+	}
+	if err != nil {
+		log.Error("Couldn't start DNS server with the previous settings: %s", err)
+	}
+}
+
+// Apply the settings to the DNS server and write them to the file
+// Nothing is changed if either step fails.
+func writeAllConfigsAndReloadDNS() error {
+	if !isRunning() {
+		err := writeAllConfigs()
+		if err != nil {
+			return err
+		}
+		return reconfigureDNSServer()
+	}
+
+	appliedSettings.Lock()
+	prev, prevSaved := appliedSettings.snapshot, appliedSettings.saved
+	appliedSettings.Unlock()
+
+	err := reconfigureDNSServer()
+	if err != nil {
+		log.Error("Couldn't apply the settings: %s", err)
+		rollbackSettings()
+		return err
+	}
+
+	err = writeAllConfigs()
+	if err != nil {
+		log.Error("Couldn't write all configs: %s", err)
+		// the new settings are applied already, but they aren't saved
+		appliedSettings.Lock()
+		appliedSettings.snapshot, appliedSettings.saved = prev, prevSaved
+		appliedSettings.Unlock()
+		rollbackSettings()
+		return err
+	}
+	return nil
+}
+
+type configValidateAddr struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+type configValidateReq struct {
+	Upstreams    []string            `json:"upstream_dns"`
+	BootstrapDNS []string            `json:"bootstrap_dns"`
+	FallbackDNS  []string            `json:"fallback_dns"`
+	DNS          *configValidateAddr `json:"dns"` // the listen address of the DNS server
+	Web          *configValidateAddr `json:"web"` // the listen address of the web interface
+	TLS          *tlsConfig          `json:"tls"` // the same object as for /control/tls/configure
+}
+
+type configValidateError struct {
+	Field string `json:"field"` // e.g. "upstream_dns", "dns", "tls"
+	Value string `json:"value,omitempty"`
+	Error string `json:"error"`
+}
+
+type configValidateResp struct {
+	Valid  bool                  `json:"valid"`
+	Errors []configValidateError `json:"errors"`
+}
+
+func (resp *configValidateResp) add(field, value string, err error) {
+	resp.Errors = append(resp.Errors, configValidateError{Field: field, Value: value, Error: err.Error()})
+}
+
+// Check that the upstream servers answer
+func validateUpstreamsReachable(resp *configValidateResp, field string, upstreams, bootstrap []string) {
+	for _, u := range upstreams {
+		err := checkDNS(u, bootstrap)
+		if err != nil {
+			resp.add(field, u, err)
+		}
+	}
+}
+
+// Check that the port is free (the port which we use already is fine)
+func validatePortFree(resp *configValidateResp, field, host string, port, curPort int, packet bool) {
+	if port == 0 || port == curPort {
+		return
+	}
+	addr := fmt.Sprintf("%s:%d", host, port)
+	err := checkPortAvailable(host, port)
+	if err == nil && packet {
+		err = checkPacketPortAvailable(host, port)
+	}
+	if err != nil {
+		resp.add(field, addr, err)
+	}
+}
+
+func validateTLSSettings(resp *configValidateResp, data tlsConfig) {
+	err := decodeTLSPEM(&data)
+	if err != nil {
+		resp.add("tls", "", err)
+		return
+	}
+	err = loadTLSFiles(&data.tlsConfigSettings)
+	if err != nil {
+		resp.add("tls", "", err)
+		return
+	}
+
+	if data.Enabled {
+		curHTTPS := 0
+		if httpsServer.server != nil {
+			curHTTPS = config.TLS.PortHTTPS
+		}
+		validatePortFree(resp, "tls.port_https", config.BindHost, data.PortHTTPS, curHTTPS, false)
+		curDOT := 0
+		if config.TLS.Enabled && isRunning() {
+			curDOT = config.TLS.PortDNSOverTLS
+		}
+		validatePortFree(resp, "tls.port_dns_over_tls", config.DNS.BindHost, data.PortDNSOverTLS, curDOT, false)
+		curDOQ := 0
+		if config.TLS.Enabled && isRunning() {
+			curDOQ = config.TLS.PortDNSOverQUIC
+		}
+		if data.PortDNSOverQUIC != 0 && data.PortDNSOverQUIC != curDOQ {
+			err := checkPacketPortAvailable(config.DNS.BindHost, data.PortDNSOverQUIC)
+			if err != nil {
+				resp.add("tls.port_dns_over_quic", fmt.Sprintf("%s:%d", config.DNS.BindHost, data.PortDNSOverQUIC), err)
+			}
+		}
+	}
+
+	if data.CertificateChain == "" && data.PrivateKey == "" {
+		if data.Enabled {
+			resp.add("tls", "", fmt.Errorf("certificate chain and private key are required"))
+		}
+		return
+	}
+	status := validateCertificates(data.CertificateChain, data.PrivateKey, data.ServerName)
+	if !status.ValidPair {
+		msg := status.WarningValidation
+		if msg == "" {
+			msg = "invalid certificate or private key"
+		}
+		resp.add("tls", "", fmt.Errorf("%s", msg))
+	}
+}
+
+// Check the proposed settings without applying them
+func handleConfigValidate(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := configValidateReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	resp := configValidateResp{Errors: []configValidateError{}}
+
+	if len(req.Upstreams) != 0 {
+		err = validateUpstreams(req.Upstreams)
+		if err != nil {
+			resp.add("upstream_dns", "", err)
+		} else {
+			validateUpstreamsReachable(&resp, "upstream_dns", req.Upstreams, req.BootstrapDNS)
+		}
+	}
+	for _, host := range req.BootstrapDNS {
+		err = checkPlainDNS(host)
+		if err != nil {
+			resp.add("bootstrap_dns", host, err)
+		}
+	}
+	if len(req.FallbackDNS) != 0 {
+		err = validateCommonUpstreams(req.FallbackDNS)
+		if err != nil {
+			resp.add("fallback_dns", "", err)
+		} else {
+			validateUpstreamsReachable(&resp, "fallback_dns", req.FallbackDNS, req.BootstrapDNS)
+		}
+	}
+
+	if req.DNS != nil {
+		curPort := 0
+		if isRunning() && req.DNS.IP == config.DNS.BindHost {
+			curPort = config.DNS.Port
+		}
+		validatePortFree(&resp, "dns", req.DNS.IP, req.DNS.Port, curPort, true)
+	}
+	if req.Web != nil {
+		curPort := 0
+		if req.Web.IP == config.BindHost {
+			curPort = config.BindPort
+		}
+		validatePortFree(&resp, "web", req.Web.IP, req.Web.Port, curPort, false)
+	}
+	if req.TLS != nil {
+		validateTLSSettings(&resp, *req.TLS)
+	}
+
+	resp.Valid = len(resp.Errors) == 0
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
@@ -0,0 +1,85 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+	busyPort := ln.Addr().(*net.TCPAddr).Port
+
+	validate := func(body string) configValidateResp {
+		w := httptest.NewRecorder()
+		handleConfigValidate(w, httptest.NewRequest("POST", "/control/config/validate", bytes.NewBufferString(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", body, w.Code, w.Body.String())
+		}
+		resp := configValidateResp{}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	resp := validate(fmt.Sprintf(`{"web":{"ip":"127.0.0.1","port":%d}}`, busyPort))
+	if resp.Valid || len(resp.Errors) != 1 || resp.Errors[0].Field != "web" {
+		t.Fatalf("busy port: %+v", resp)
+	}
+
+	resp = validate(`{"upstream_dns":["[/example.org/]1.1.1.1"],"bootstrap_dns":["tls://1.1.1.1"]}`)
+	if resp.Valid || len(resp.Errors) != 2 ||
+		resp.Errors[0].Field != "upstream_dns" || resp.Errors[1].Field != "bootstrap_dns" {
+		t.Fatalf("invalid upstreams: %+v", resp)
+	}
+
+	resp = validate(`{"tls":{"enabled":true,"certificate_chain":"aW52YWxpZA==","private_key":"aW52YWxpZA=="}}`)
+	if resp.Valid || len(resp.Errors) != 1 || resp.Errors[0].Field != "tls" {
+		t.Fatalf("invalid certificate: %+v", resp)
+	}
+
+	resp = validate(`{}`)
+	if !resp.Valid || len(resp.Errors) != 0 {
+		t.Fatalf("empty: %+v", resp)
+	}
+}
+
+func TestSettingsSnapshot(t *testing.T) {
+	clients.list = map[string]*Client{}
+	clients.ipIndex = map[string]*Client{}
+	clients.ipHost = map[string]ClientHost{}
+	defer func() { clients.list, clients.ipIndex, clients.ipHost = nil, nil, nil }()
+	saved := takeSettingsSnapshot()
+	defer saved.restore()
+
+	config.UserRules = []string{"||old.example^"}
+	config.Filters = []filter{{URL: "https://example.org/old.txt"}}
+	config.ClientGroups = nil
+	_, _ = clientAdd(Client{IP: "1.1.1.1", Name: "old"})
+	s := takeSettingsSnapshot()
+
+	// the new settings which the DNS server hasn't accepted
+	config.UserRules = []string{"||new.example^"}
+	config.Filters = append(config.Filters, filter{URL: "https://example.org/new.txt"})
+	config.ClientGroups = []clientGroup{{Name: "children"}}
+	clientDel("old")
+	_, _ = clientAdd(Client{IP: "2.2.2.2", Name: "new"})
+
+	s.restore()
+	if len(config.UserRules) != 1 || config.UserRules[0] != "||old.example^" {
+		t.Fatalf("user rules: %v", config.UserRules)
+	}
+	if len(config.Filters) != 1 || len(config.ClientGroups) != 0 {
+		t.Fatalf("filters: %v, client groups: %v", config.Filters, config.ClientGroups)
+	}
+	if !clientNameExists("old") || clientNameExists("new") {
+		t.Fatalf("clients: %v", clientsSnapshot())
+	}
+}
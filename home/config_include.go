@@ -0,0 +1,244 @@
+// Configuration fragments from the include directory
+// Large deployments may keep clients, rewrites and filters in separate machine-generated files.
+// The files are merged in the lexical order of their names: a later file overrides the objects of an earlier one,
+// and the main configuration file overrides them all.
+
+package home
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configFragment is the contents of an include file
+type configFragment struct {
+	Clients  []clientObject           `yaml:"clients"`
+	Rewrites []dnsfilter.RewriteEntry `yaml:"rewrites"`
+	Filters  []filter                 `yaml:"filters"`
+}
+
+// The objects which came from the include files: object key -> the state which may be modified via the API
+// They aren't written to the main configuration file, unless they are modified via the API
+var configIncluded map[string]string
+
+func includedClientKey(name string) string {
+	return "client:" + name
+}
+
+func includedRewriteKey(r dnsfilter.RewriteEntry) string {
+	return "rewrite:" + r.Domain + " " + r.Answer
+}
+
+func includedFilterKey(url string) string {
+	return "filter:" + url
+}
+
+// Get the state of the included object which may be modified via the API
+// The changes made by the server itself don't count:
+// a client is compared in its normalized form (e.g. with the lowercased host name),
+// a filter list is compared by its settings and not by the name and the data from the list's updates.
+func includedState(obj interface{}) string {
+	switch o := obj.(type) {
+	case clientObject:
+		c := fromClientObject(o)
+		if clientCheck(&c) == nil {
+			obj = toClientObject(&c)
+		}
+	case filter:
+		obj = struct {
+			Enabled     bool
+			Trusted     bool
+			ChecksumURL string
+			MaxSize     int64
+			MaxRules    int
+		}{o.Enabled, o.Trusted, o.ChecksumURL, o.MaxSize, o.MaxRules}
+	}
+	data, _ := yaml.Marshal(obj)
+	return string(data)
+}
+
+// isIncludedUnchanged returns TRUE if the object came from an include file and it hasn't been modified since
+func isIncludedUnchanged(key string, obj interface{}) bool {
+	data, ok := configIncluded[key]
+	return ok && data == includedState(obj)
+}
+
+// Get the path to the include directory, relative paths are relative to the working directory
+func configIncludeDir() string {
+	dir := config.IncludeDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(config.ourWorkingDir, dir)
+	}
+	return dir
+}
+
+// Read the *.yaml files from the include directory
+func readConfigFragments(dir string) ([]configFragment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, fi := range files {
+		if fi.IsDir() || !(strings.HasSuffix(fi.Name(), ".yaml") || strings.HasSuffix(fi.Name(), ".yml")) {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+
+	fragments := []configFragment{}
+	for _, name := range names {
+		fn := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		fr := configFragment{}
+		err = yaml.Unmarshal(data, &fr)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse %s: %s", fn, err)
+		}
+		log.Debug("Read config fragment %s: %d clients, %d rewrites, %d filters",
+			fn, len(fr.Clients), len(fr.Rewrites), len(fr.Filters))
+		fragments = append(fragments, fr)
+	}
+	return fragments, nil
+}
+
+// Get a stable ID for an included filter that has no ID, so its data file doesn't change after restart
+func includedFilterID(url string, used map[int64]bool) int64 {
+	id := int64(crc32.ChecksumIEEE([]byte(url)))
+	for id == 0 || used[id] {
+		id++
+	}
+	return id
+}
+
+// loadConfigIncludes merges the objects from the include directory into the configuration
+// Must be called after the main configuration file is parsed
+func loadConfigIncludes() error {
+	configIncluded = map[string]string{}
+	if len(config.IncludeDir) == 0 {
+		return nil
+	}
+	dir := configIncludeDir()
+	fragments, err := readConfigFragments(dir)
+	if err != nil {
+		return fmt.Errorf("couldn't read config include directory: %s", err)
+	}
+
+	// the objects defined in the main file take precedence
+	mainKeys := map[string]bool{}
+	usedIDs := map[int64]bool{}
+	for _, cy := range config.Clients {
+		mainKeys[includedClientKey(cy.Name)] = true
+	}
+	for _, r := range config.DNS.Rewrites {
+		mainKeys[includedRewriteKey(r)] = true
+	}
+	for _, f := range config.Filters {
+		mainKeys[includedFilterKey(f.URL)] = true
+		usedIDs[f.ID] = true
+	}
+
+	// a later fragment overrides the objects of an earlier one
+	var keys []string
+	objects := map[string]interface{}{}
+	for _, fr := range fragments {
+		for _, cy := range fr.Clients {
+			if len(cy.MAC) != 0 || len(cy.Hostname) != 0 {
+				cy.IP = "" // that's how the client is written back
+			}
+			key := includedClientKey(cy.Name)
+			if _, ok := objects[key]; !ok {
+				keys = append(keys, key)
+			}
+			objects[key] = cy
+		}
+		for _, r := range fr.Rewrites {
+			key := includedRewriteKey(r)
+			if _, ok := objects[key]; !ok {
+				keys = append(keys, key)
+			}
+			objects[key] = r
+		}
+		for _, f := range fr.Filters {
+			key := includedFilterKey(f.URL)
+			if _, ok := objects[key]; !ok {
+				keys = append(keys, key)
+			}
+			objects[key] = f
+		}
+	}
+
+	for _, key := range keys {
+		if mainKeys[key] {
+			log.Debug("%s is overridden by the main configuration file", key)
+			continue
+		}
+		switch obj := objects[key].(type) {
+		case clientObject:
+			config.Clients = append(config.Clients, obj)
+		case dnsfilter.RewriteEntry:
+			config.DNS.Rewrites = append(config.DNS.Rewrites, obj)
+		case filter:
+			if obj.ID == 0 {
+				obj.ID = includedFilterID(obj.URL, usedIDs)
+			}
+			usedIDs[obj.ID] = true
+			config.Filters = append(config.Filters, obj)
+			configIncluded[key] = includedState(obj)
+			continue
+		}
+		configIncluded[key] = includedState(objects[key])
+	}
+
+	log.Info("Merged %d objects from %s", len(configIncluded), dir)
+	return nil
+}
+
+// Remove the unmodified included objects before the configuration is written to the main file
+// Returns the function that restores them
+// Must be called with the configuration lock held
+func excludeIncludedObjects() func() {
+	if len(configIncluded) == 0 {
+		return func() {}
+	}
+
+	clientsAll := config.Clients
+	rewritesAll := config.DNS.Rewrites
+	filtersAll := config.Filters
+
+	config.Clients = []clientObject{}
+	for _, cy := range clientsAll {
+		if !isIncludedUnchanged(includedClientKey(cy.Name), cy) {
+			config.Clients = append(config.Clients, cy)
+		}
+	}
+	config.DNS.Rewrites = []dnsfilter.RewriteEntry{}
+	for _, r := range rewritesAll {
+		if !isIncludedUnchanged(includedRewriteKey(r), r) {
+			config.DNS.Rewrites = append(config.DNS.Rewrites, r)
+		}
+	}
+	config.Filters = []filter{}
+	for _, f := range filtersAll {
+		if !isIncludedUnchanged(includedFilterKey(f.URL), f) {
+			config.Filters = append(config.Filters, f)
+		}
+	}
+
+	return func() {
+		config.Clients = clientsAll
+		config.DNS.Rewrites = rewritesAll
+		config.Filters = filtersAll
+	}
+}
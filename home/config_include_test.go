@@ -0,0 +1,98 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-include")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fragment1 := `
+clients:
+- name: laptop
+  ip: 192.168.1.2
+- name: tv
+  ip: 192.168.1.3
+- name: phone
+  hostname: Phone.LAN
+rewrites:
+- domain: nas.home
+  answer: 192.168.1.5
+filters:
+- enabled: true
+  url: https://example.org/filter.txt
+  name: Example
+`
+	fragment2 := `
+clients:
+- name: tv
+  ip: 192.168.1.4
+`
+	_ = ioutil.WriteFile(filepath.Join(dir, "10-first.yaml"), []byte(fragment1), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "20-second.yaml"), []byte(fragment2), 0644)
+	_ = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a fragment"), 0644)
+
+	savedFilters := config.Filters
+	defer func() {
+		config.IncludeDir = ""
+		config.Clients = nil
+		config.DNS.Rewrites = nil
+		config.Filters = savedFilters
+		configIncluded = nil
+	}()
+	config.IncludeDir = dir
+	config.Clients = []clientObject{{Name: "laptop", IP: "192.168.1.10"}}
+	config.DNS.Rewrites = nil
+	config.Filters = nil
+
+	err = loadConfigIncludes()
+	if err != nil {
+		t.Fatalf("loadConfigIncludes: %s", err)
+	}
+
+	// the main file takes precedence, a later fragment overrides an earlier one
+	if len(config.Clients) != 3 || config.Clients[0].IP != "192.168.1.10" ||
+		config.Clients[1].Name != "tv" || config.Clients[1].IP != "192.168.1.4" {
+		t.Fatalf("clients: %v", config.Clients)
+	}
+	if len(config.DNS.Rewrites) != 1 || config.DNS.Rewrites[0].Answer != "192.168.1.5" {
+		t.Fatalf("rewrites: %v", config.DNS.Rewrites)
+	}
+	if len(config.Filters) != 1 || config.Filters[0].ID == 0 {
+		t.Fatalf("filters: %v", config.Filters)
+	}
+
+	// the changes made by the server don't count: the host name is normalized, the list's title is applied
+	config.Clients[2].Hostname = "phone.lan"
+	config.Filters[0].Name = "Example filter"
+	config.Filters[0].RulesCount = 100
+	restore := excludeIncludedObjects()
+	if len(config.Clients) != 1 || len(config.Filters) != 0 {
+		t.Fatalf("excludeIncludedObjects - not modified: %v %v", config.Clients, config.Filters)
+	}
+	restore()
+
+	// unmodified included objects aren't written to the main file
+	config.Filters[0].Enabled = false
+	restore = excludeIncludedObjects()
+	if len(config.Clients) != 1 || config.Clients[0].Name != "laptop" {
+		t.Fatalf("excludeIncludedObjects - clients: %v", config.Clients)
+	}
+	if len(config.DNS.Rewrites) != 0 {
+		t.Fatalf("excludeIncludedObjects - rewrites: %v", config.DNS.Rewrites)
+	}
+	if len(config.Filters) != 1 {
+		t.Fatalf("excludeIncludedObjects - the modified filter must be kept")
+	}
+	restore()
+	if len(config.Clients) != 3 || len(config.DNS.Rewrites) != 1 {
+		t.Fatalf("restore")
+	}
+}
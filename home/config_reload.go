@@ -0,0 +1,156 @@
+// Reloading the configuration file on SIGHUP
+// The file may be changed by a configuration management tool (e.g. Ansible), which then sends SIGHUP instead of restarting.
+// The new file is checked first: nothing is changed if it can't be parsed or it's invalid.
+// The upstream servers, the filters, the filtering settings and the clients are applied to the running DNS server
+//  without restarting its listeners, so the requests which are being processed aren't dropped.
+// If the other DNS settings have changed, the DNS server is restarted with them.
+// The DHCP server keeps running with its settings and leases, the changes of the DHCP, TLS and web settings
+//  take effect after restart: until then they are kept aside and written to the file instead of the running ones.
+// The clients from the file replace the current ones at once.
+
+package home
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Get the DNS settings which can't be changed without restarting the DNS server
+func dnsRestartSettings(c dnsConfig) dnsConfig {
+	c.UpstreamDNS = nil
+	c.UpstreamTimeout = 0
+	c.UpstreamPoolSize = 0
+	c.UpstreamPipelining = false
+	c.UpstreamIdleTimeout = 0
+	c.LocalPTRDNS = nil
+	c.FallbackDNS = nil
+	c.FallbackTimeout = 0
+	c.BlockedServices = nil
+	c.BootstrapDNS = nil
+	c.AllServers = false
+	c.ProtectionEnabled = false
+	c.FilteringEnabled = false
+	c.Config = dnsfilter.Config{}
+	return c
+}
+
+// Return TRUE if the DNS server must be restarted to apply the new settings
+func dnsRestartRequired(a, b dnsConfig, listenA, listenB listenConfig) bool {
+	return !reflect.DeepEqual(dnsRestartSettings(a), dnsRestartSettings(b)) ||
+		!reflect.DeepEqual(listenA.DNS, listenB.DNS) ||
+		!reflect.DeepEqual(listenA.DOT, listenB.DOT)
+}
+
+// Put the pending settings into the configuration before it's written to the file
+// Returns the function that restores the running settings
+// Must be called with the configuration lock held
+func includePendingSettings() func() {
+	tls, dhcp := config.TLS, config.DHCP
+	if config.pendingTLS != nil {
+		config.TLS = *config.pendingTLS
+	}
+	if config.pendingDHCP != nil {
+		config.DHCP = *config.pendingDHCP
+	}
+	return func() {
+		config.TLS, config.DHCP = tls, dhcp
+	}
+}
+
+// Read the configuration file again and apply the new settings
+// The whole reload is done under controlLock, so it doesn't interleave with the changes made by the HTTP handlers
+func reloadConfig() error {
+	controlLock.Lock()
+	defer controlLock.Unlock()
+
+	configFile := config.getConfigFilename()
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read config file: %s", err)
+	}
+	c := &configuration{}
+	err = yaml.Unmarshal(data, c)
+	if err != nil {
+		return fmt.Errorf("couldn't parse config file: %s", err)
+	}
+	if c.SchemaVersion != currentSchemaVersion {
+		return fmt.Errorf("config file has schema version %d, restart to upgrade it", c.SchemaVersion)
+	}
+	err = validateConfig(c)
+	if err != nil {
+		return err
+	}
+	log.Info("Reloading config file %s", configFile)
+
+	config.Lock()
+	oldDNS, oldListen := config.DNS, config.Listen
+	oldTLS, oldDHCP := config.TLS, config.DHCP
+	oldBindHost, oldBindPort := config.BindHost, config.BindPort
+	config.fileData = data
+	err = parseConfig()
+	// the running servers keep these settings until restart
+	restartRequired := tlsSettingsChanged(oldTLS.tlsConfigSettings, config.TLS.tlsConfigSettings) ||
+		!reflect.DeepEqual(oldDHCP, config.DHCP) ||
+		oldBindHost != config.BindHost || oldBindPort != config.BindPort ||
+		!reflect.DeepEqual(oldListen.Web, config.Listen.Web) ||
+		!reflect.DeepEqual(oldListen.HTTPS, config.Listen.HTTPS) ||
+		!reflect.DeepEqual(oldListen.DOH, config.Listen.DOH)
+	if err == nil {
+		config.pendingTLS, config.pendingDHCP = nil, nil
+		if !reflect.DeepEqual(oldTLS.tlsConfigSettings, config.TLS.tlsConfigSettings) {
+			tls := config.TLS
+			config.pendingTLS = &tls
+		}
+		if !reflect.DeepEqual(oldDHCP, config.DHCP) {
+			dhcp := config.DHCP
+			config.pendingDHCP = &dhcp
+		}
+	}
+	config.TLS = oldTLS
+	config.DHCP = oldDHCP
+	newFilters := false
+	if err == nil {
+		loadFilters()
+		for _, f := range config.Filters {
+			newFilters = newFilters || (f.Enabled && len(f.Data) == 0)
+		}
+	}
+	dnsRestart := dnsRestartRequired(oldDNS, config.DNS, oldListen, config.Listen)
+	config.Unlock()
+	if err != nil {
+		return err
+	}
+	if restartRequired {
+		log.Info("The changes of the web interface, TLS or DHCP settings take effect after restart")
+	}
+
+	if isRunning() {
+		if dnsRestart {
+			log.Info("DNS listener settings have changed, restarting DNS server")
+			err = reconfigureDNSServer()
+			if err != nil {
+				rollbackSettings()
+				return err
+			}
+		} else {
+			newconfig := generateServerConfig()
+			err = dnsServer.Update(&newconfig)
+			if err != nil {
+				rollbackSettings()
+				return fmt.Errorf("couldn't update DNS server: %s", err)
+			}
+		}
+		saveAppliedSettings()
+	}
+
+	if newFilters {
+		// download the filter lists which were added
+		go filtering.refreshFiltersIfNecessary(false)
+	}
+	log.Info("Config file is reloaded")
+	return nil
+}
@@ -0,0 +1,111 @@
+package home
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-reload")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clients.list = map[string]*Client{}
+	clients.ipIndex = map[string]*Client{}
+	clients.ipHost = map[string]ClientHost{}
+	clients.idIP = map[string]string{}
+	clients.upstreams = map[string]*proxy.UpstreamConfig{}
+	defer func() {
+		clients.list, clients.ipIndex, clients.ipHost, clients.idIP, clients.upstreams = nil, nil, nil, nil, nil
+	}()
+	workDir, configFile := config.ourWorkingDir, config.ourConfigFilename
+	dns, dhcp, filters, tls := config.DNS, config.DHCP, config.Filters, config.TLS
+	defer func() {
+		config.TLS, config.pendingTLS, config.pendingDHCP = tls, nil, nil
+		config.ourWorkingDir, config.ourConfigFilename = workDir, configFile
+		config.DNS, config.DHCP, config.Filters = dns, dhcp, filters
+		config.fileData = nil
+	}()
+	config.ourWorkingDir = dir
+	config.ourConfigFilename = "AdGuardHome.yaml"
+	fn := filepath.Join(dir, "AdGuardHome.yaml")
+
+	_, _ = clientAdd(Client{IP: "192.168.1.2", Name: "old"})
+	data := fmt.Sprintf(`dns:
+  upstream_dns:
+  - 8.8.8.8
+filters: []
+clients:
+- name: new
+  ip: 192.168.1.3
+dhcp:
+  enabled: true
+  interface_name: eth0
+tls:
+  server_name: new.example.org
+schema_version: %d
+`, currentSchemaVersion)
+	_ = ioutil.WriteFile(fn, []byte(data), 0600)
+	err = reloadConfig()
+	if err != nil {
+		t.Fatalf("reloadConfig: %s", err)
+	}
+	if len(config.DNS.UpstreamDNS) != 1 || config.DNS.UpstreamDNS[0] != "8.8.8.8" || len(config.Filters) != 0 {
+		t.Fatalf("settings: %v %v", config.DNS.UpstreamDNS, config.Filters)
+	}
+	if _, ok := clients.list["old"]; ok || clients.list["new"] == nil {
+		t.Fatalf("clients: %v", clients.list)
+	}
+	// the DHCP server keeps its settings until restart
+	if config.DHCP.Enabled != dhcp.Enabled || config.DHCP.InterfaceName != dhcp.InterfaceName {
+		t.Fatalf("dhcp: %+v", config.DHCP)
+	}
+	if config.TLS.ServerName != tls.ServerName {
+		t.Fatalf("tls: %+v", config.TLS)
+	}
+	// but the new settings are written to the file
+	err = config.write()
+	if err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	written := configuration{}
+	data2, _ := ioutil.ReadFile(fn)
+	_ = yaml.Unmarshal(data2, &written)
+	if !written.DHCP.Enabled || written.DHCP.InterfaceName != "eth0" || written.TLS.ServerName != "new.example.org" {
+		t.Fatalf("written: %+v %+v", written.DHCP, written.TLS)
+	}
+	if config.DHCP.InterfaceName != dhcp.InterfaceName || config.TLS.ServerName != tls.ServerName {
+		t.Fatalf("the running settings are changed by write")
+	}
+
+	// nothing is changed if the file is invalid
+	_ = ioutil.WriteFile(fn, []byte("dns:\n  upstream_dns: [1.1.1.1]\nusers: [{name: admin}]\n"), 0600)
+	if reloadConfig() == nil || config.DNS.UpstreamDNS[0] != "8.8.8.8" {
+		t.Fatalf("invalid file: %v", config.DNS.UpstreamDNS)
+	}
+	_ = ioutil.WriteFile(fn, []byte("dns: [\n"), 0600)
+	if reloadConfig() == nil || clients.list["new"] == nil {
+		t.Fatalf("broken file")
+	}
+
+	a := dnsConfig{Port: 53, UpstreamDNS: []string{"1.1.1.1"}}
+	b := a
+	b.UpstreamDNS = []string{"8.8.8.8"}
+	b.ProtectionEnabled = true
+	if dnsRestartRequired(a, b, listenConfig{}, listenConfig{}) {
+		t.Fatalf("upstreams changed")
+	}
+	b.Port = 5353
+	if !dnsRestartRequired(a, b, listenConfig{}, listenConfig{}) ||
+		!dnsRestartRequired(a, a, listenConfig{}, listenConfig{DNS: []string{"127.0.0.1:53"}}) {
+		t.Fatalf("listeners changed")
+	}
+}
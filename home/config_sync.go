@@ -0,0 +1,723 @@
+// Settings synchronization between instances
+// A secondary instance periodically pulls the settings from the primary one: the DNS settings (with the rewrites),
+//  the filter lists, the user rules, the persistent clients and the client groups.
+// The listen addresses and the other settings of the instance itself are kept.
+// The request is authenticated with an API token of the primary and it's sent over HTTPS
+//  (the primary's certificate may be pinned by its SHA-256 checksum instead of being verified).
+// The data is encrypted with AES-256-GCM by the key derived from the shared passphrase with scrypt,
+//  so it can't be read or altered on the way.
+// Every export has a generation number (the time it was created) which is authenticated with the data:
+//  the secondary rejects the data older than the applied one, so an old copy can't roll its settings back.
+// The synchronized settings may be changed on the secondary, but they're overwritten when the primary's ones change.
+
+package home
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	"github.com/AdguardTeam/golibs/file"
+	"golang.org/x/crypto/scrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	syncRolePrimary   = "primary"
+	syncRoleSecondary = "secondary"
+	syncMaxSize       = 64 * 1024 * 1024
+	syncKeyMinLength  = 16
+	syncStateFileName = "sync.json" // the generation of the applied data
+
+	// The encrypted data: format version, salt, generation, nonce, sealed data
+	// The header (format version, salt and generation) is authenticated.
+	syncFormatVersion = 1
+	syncSaltSize      = 16
+	syncHeaderSize    = 1 + syncSaltSize + 8
+
+	// scrypt parameters
+	syncScryptN = 1 << 15
+	syncScryptR = 8
+	syncScryptP = 1
+)
+
+type syncConfig struct {
+	Role     string `yaml:"role"`     // primary or secondary (empty: disabled)
+	Key      string `yaml:"key"`      // the shared key which encrypts the data, at least 16 characters
+	Interval uint32 `yaml:"interval"` // secondary: polling interval (in minutes)
+
+	PrimaryURL string `yaml:"primary_url"` // secondary: the address of the primary's web interface, e.g. https://192.168.1.2
+	Token      string `yaml:"token"`       // secondary: the primary's API token
+
+	// secondary: SHA-256 checksum of the primary's certificate (hex), e.g. for a self-signed one
+	// If set, the certificate isn't verified otherwise.
+	PrimaryCertSHA256 string `yaml:"primary_cert_sha256,omitempty"`
+}
+
+// The filter list without its state: the secondary downloads the lists itself
+type syncFilter struct {
+	Enabled     bool   `yaml:"enabled"`
+	URL         string `yaml:"url"`
+	Name        string `yaml:"name"`
+	ChecksumURL string `yaml:"checksum_url,omitempty"`
+	MaxSize     int64  `yaml:"max_size,omitempty"`
+	MaxRules    int    `yaml:"max_rules,omitempty"`
+	Trusted     bool   `yaml:"trusted"`
+}
+
+// The DNS settings which are shared by the instances
+// The listeners, the query log, the statistics and the connection tuning are the settings of each instance.
+type syncDNS struct {
+	ProtectionEnabled  bool     `yaml:"protection_enabled"`
+	FilteringEnabled   bool     `yaml:"filtering_enabled"`
+	BlockingMode       string   `yaml:"blocking_mode"`
+	BlockingIPv4       string   `yaml:"blocking_ipv4"`
+	BlockingIPv6       string   `yaml:"blocking_ipv6"`
+	BlockedResponseTTL uint32   `yaml:"blocked_response_ttl"`
+	Ratelimit          int      `yaml:"ratelimit"`
+	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"`
+	BogusNXDomain      []string `yaml:"bogus_nxdomain"`
+	RefuseAny          bool     `yaml:"refuse_any"`
+	AAAADisabled       bool     `yaml:"aaaa_disabled"`
+	HTTPSRemoveECH     bool     `yaml:"https_remove_ech"`
+	DNS64Enabled       bool     `yaml:"dns64_enabled"`
+	DNS64Prefix        string   `yaml:"dns64_prefix"`
+	BootstrapDNS       []string `yaml:"bootstrap_dns"`
+	AllServers         bool     `yaml:"all_servers"`
+	FastestAddr        bool     `yaml:"fastest_addr"`
+	DNSSECValidation   bool     `yaml:"dnssec_validation"`
+	CacheSize          int      `yaml:"cache_size"`
+	CacheMinTTL        uint32   `yaml:"cache_ttl_min"`
+	CacheMaxTTL        uint32   `yaml:"cache_ttl_max"`
+	CacheOptimistic    bool     `yaml:"cache_optimistic"`
+	EDNSCSMode         string   `yaml:"edns_cs_mode"`
+	EDNSCSPrefixV4     uint8    `yaml:"edns_cs_prefix_v4"`
+	EDNSCSPrefixV6     uint8    `yaml:"edns_cs_prefix_v6"`
+	AllowedClients     []string `yaml:"allowed_clients"`
+	DisallowedClients  []string `yaml:"disallowed_clients"`
+	BlockedHosts       []string `yaml:"blocked_hosts"`
+
+	ParentalSensitivity int                      `yaml:"parental_sensitivity"`
+	ParentalEnabled     bool                     `yaml:"parental_enabled"`
+	ParentalCategories  []string                 `yaml:"parental_categories"`
+	SafeSearchEnabled   bool                     `yaml:"safesearch_enabled"`
+	SafeBrowsingEnabled bool                     `yaml:"safebrowsing_enabled"`
+	Rewrites            []dnsfilter.RewriteEntry `yaml:"rewrites"`
+	RegexRuleBudget     uint32                   `yaml:"regex_rule_budget"`
+
+	UpstreamDNS     []string `yaml:"upstream_dns"`
+	UpstreamTimeout uint32   `yaml:"upstream_timeout"`
+	FallbackDNS     []string `yaml:"fallback_dns"`
+	FallbackTimeout uint32   `yaml:"fallback_timeout"`
+	BlockedServices []string `yaml:"blocked_services"`
+}
+
+// Get the shared DNS settings
+func getSyncDNS(c *dnsConfig) syncDNS {
+	return syncDNS{
+		ProtectionEnabled:  c.ProtectionEnabled,
+		FilteringEnabled:   c.FilteringEnabled,
+		BlockingMode:       c.BlockingMode,
+		BlockingIPv4:       c.BlockingIPv4,
+		BlockingIPv6:       c.BlockingIPv6,
+		BlockedResponseTTL: c.BlockedResponseTTL,
+		Ratelimit:          c.Ratelimit,
+		RatelimitWhitelist: c.RatelimitWhitelist,
+		BogusNXDomain:      c.BogusNXDomain,
+		RefuseAny:          c.RefuseAny,
+		AAAADisabled:       c.AAAADisabled,
+		HTTPSRemoveECH:     c.HTTPSRemoveECH,
+		DNS64Enabled:       c.DNS64Enabled,
+		DNS64Prefix:        c.DNS64Prefix,
+		BootstrapDNS:       c.BootstrapDNS,
+		AllServers:         c.AllServers,
+		FastestAddr:        c.FastestAddr,
+		DNSSECValidation:   c.DNSSECValidation,
+		CacheSize:          c.CacheSize,
+		CacheMinTTL:        c.CacheMinTTL,
+		CacheMaxTTL:        c.CacheMaxTTL,
+		CacheOptimistic:    c.CacheOptimistic,
+		EDNSCSMode:         c.EDNSCSMode,
+		EDNSCSPrefixV4:     c.EDNSCSPrefixV4,
+		EDNSCSPrefixV6:     c.EDNSCSPrefixV6,
+		AllowedClients:     c.AllowedClients,
+		DisallowedClients:  c.DisallowedClients,
+		BlockedHosts:       c.BlockedHosts,
+
+		ParentalSensitivity: c.ParentalSensitivity,
+		ParentalEnabled:     c.ParentalEnabled,
+		ParentalCategories:  c.ParentalCategories,
+		SafeSearchEnabled:   c.SafeSearchEnabled,
+		SafeBrowsingEnabled: c.SafeBrowsingEnabled,
+		Rewrites:            c.Rewrites,
+		RegexRuleBudget:     c.RegexRuleBudget,
+
+		UpstreamDNS:     c.UpstreamDNS,
+		UpstreamTimeout: c.UpstreamTimeout,
+		FallbackDNS:     c.FallbackDNS,
+		FallbackTimeout: c.FallbackTimeout,
+		BlockedServices: c.BlockedServices,
+	}
+}
+
+// Apply the shared DNS settings, the other ones are kept
+func (s syncDNS) apply(c *dnsConfig) {
+	c.ProtectionEnabled = s.ProtectionEnabled
+	c.FilteringEnabled = s.FilteringEnabled
+	c.BlockingMode = s.BlockingMode
+	c.BlockingIPv4 = s.BlockingIPv4
+	c.BlockingIPv6 = s.BlockingIPv6
+	c.BlockedResponseTTL = s.BlockedResponseTTL
+	c.Ratelimit = s.Ratelimit
+	c.RatelimitWhitelist = s.RatelimitWhitelist
+	c.BogusNXDomain = s.BogusNXDomain
+	c.RefuseAny = s.RefuseAny
+	c.AAAADisabled = s.AAAADisabled
+	c.HTTPSRemoveECH = s.HTTPSRemoveECH
+	c.DNS64Enabled = s.DNS64Enabled
+	c.DNS64Prefix = s.DNS64Prefix
+	c.BootstrapDNS = s.BootstrapDNS
+	c.AllServers = s.AllServers
+	c.FastestAddr = s.FastestAddr
+	c.DNSSECValidation = s.DNSSECValidation
+	c.CacheSize = s.CacheSize
+	c.CacheMinTTL = s.CacheMinTTL
+	c.CacheMaxTTL = s.CacheMaxTTL
+	c.CacheOptimistic = s.CacheOptimistic
+	c.EDNSCSMode = s.EDNSCSMode
+	c.EDNSCSPrefixV4 = s.EDNSCSPrefixV4
+	c.EDNSCSPrefixV6 = s.EDNSCSPrefixV6
+	c.AllowedClients = s.AllowedClients
+	c.DisallowedClients = s.DisallowedClients
+	c.BlockedHosts = s.BlockedHosts
+
+	c.ParentalSensitivity = s.ParentalSensitivity
+	c.ParentalEnabled = s.ParentalEnabled
+	c.ParentalCategories = s.ParentalCategories
+	c.SafeSearchEnabled = s.SafeSearchEnabled
+	c.SafeBrowsingEnabled = s.SafeBrowsingEnabled
+	c.Rewrites = s.Rewrites
+	c.RegexRuleBudget = s.RegexRuleBudget
+
+	c.UpstreamDNS = s.UpstreamDNS
+	c.UpstreamTimeout = s.UpstreamTimeout
+	c.FallbackDNS = s.FallbackDNS
+	c.FallbackTimeout = s.FallbackTimeout
+	c.BlockedServices = s.BlockedServices
+}
+
+// The settings sent to the secondary
+type syncData struct {
+	Version      string         `yaml:"version"`
+	DNS          syncDNS        `yaml:"dns"`
+	Filters      []syncFilter   `yaml:"filters"`
+	UserRules    []string       `yaml:"user_rules"`
+	Clients      []clientObject `yaml:"clients"`
+	ClientGroups []clientGroup  `yaml:"client_groups"`
+}
+
+// The state of the synchronization
+var syncState struct {
+	sync.Mutex
+	checksum   [sha256.Size]byte // checksum of the applied data
+	generation uint64            // secondary: the generation of the applied data; primary: of the last export
+	loaded     bool              // secondary: the generation is read from the file
+	lastCheck  time.Time
+	lastSynced time.Time
+	lastError  string
+}
+
+func validateSyncConfig(c syncConfig) error {
+	switch c.Role {
+	case "":
+		return nil
+	case syncRolePrimary:
+	case syncRoleSecondary:
+		if !strings.HasPrefix(c.PrimaryURL, "https://") {
+			return fmt.Errorf("sync: invalid primary_url %q: it must be an https:// URL", c.PrimaryURL)
+		}
+		if len(c.PrimaryCertSHA256) != 0 {
+			pin, err := hex.DecodeString(c.PrimaryCertSHA256)
+			if err != nil || len(pin) != sha256.Size {
+				return fmt.Errorf("sync: invalid primary_cert_sha256 %q", c.PrimaryCertSHA256)
+			}
+		}
+	default:
+		return fmt.Errorf("sync: invalid role %q", c.Role)
+	}
+	if len(c.Key) < syncKeyMinLength {
+		return fmt.Errorf("sync: the key must be at least %d characters long", syncKeyMinLength)
+	}
+	return nil
+}
+
+// The last derived key: scrypt is slow on purpose
+var syncKeyCache struct {
+	sync.Mutex
+	passphrase string
+	salt       []byte
+	key        []byte
+}
+
+// Derive the encryption key from the passphrase
+func syncDeriveKey(passphrase string, salt []byte) ([]byte, error) {
+	syncKeyCache.Lock()
+	defer syncKeyCache.Unlock()
+	if syncKeyCache.key != nil && syncKeyCache.passphrase == passphrase && bytes.Equal(syncKeyCache.salt, salt) {
+		return syncKeyCache.key, nil
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, syncScryptN, syncScryptR, syncScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	syncKeyCache.passphrase = passphrase
+	syncKeyCache.salt = append([]byte{}, salt...)
+	syncKeyCache.key = key
+	return key, nil
+}
+
+// Get the salt for the exported data: it's kept while the passphrase is the same
+func syncSalt(passphrase string) ([]byte, error) {
+	syncKeyCache.Lock()
+	if syncKeyCache.key != nil && syncKeyCache.passphrase == passphrase {
+		salt := syncKeyCache.salt
+		syncKeyCache.Unlock()
+		return salt, nil
+	}
+	syncKeyCache.Unlock()
+
+	salt := make([]byte, syncSaltSize)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+func syncCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := syncDeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt the data of this generation
+func syncEncrypt(passphrase string, generation uint64, data []byte) ([]byte, error) {
+	salt, err := syncSalt(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := syncCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, syncHeaderSize)
+	header[0] = syncFormatVersion
+	copy(header[1:], salt)
+	binary.BigEndian.PutUint64(header[1+syncSaltSize:], generation)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, data, header), nil
+}
+
+// Decrypt the data, return its generation
+func syncDecrypt(passphrase string, data []byte) (uint64, []byte, error) {
+	if len(data) < syncHeaderSize || data[0] != syncFormatVersion {
+		return 0, nil, fmt.Errorf("unsupported data format: update AdGuard Home on both instances")
+	}
+	header := data[:syncHeaderSize]
+	aead, err := syncCipher(passphrase, header[1:1+syncSaltSize])
+	if err != nil {
+		return 0, nil, err
+	}
+	data = data[syncHeaderSize:]
+	n := aead.NonceSize()
+	if len(data) < n {
+		return 0, nil, fmt.Errorf("the data is too short")
+	}
+	plain, err := aead.Open(nil, data[:n], data[n:], header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("couldn't decrypt the data: the keys are different or the data is corrupted")
+	}
+	return binary.BigEndian.Uint64(header[1+syncSaltSize:]), plain, nil
+}
+
+// Get the generation of the new export: the current time, but always greater than the previous one
+func nextSyncGeneration() uint64 {
+	syncState.Lock()
+	defer syncState.Unlock()
+	g := uint64(time.Now().UnixNano())
+	if g <= syncState.generation {
+		g = syncState.generation + 1
+	}
+	syncState.generation = g
+	return g
+}
+
+func syncStateFilePath() string {
+	return filepath.Join(config.ourWorkingDir, dataDir, syncStateFileName)
+}
+
+// Get the generation of the applied data
+// The sync state lock must be held.
+func appliedSyncGeneration() uint64 {
+	if syncState.loaded {
+		return syncState.generation
+	}
+	syncState.loaded = true
+	data, err := ioutil.ReadFile(syncStateFilePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("sync: %s", err)
+		}
+		return 0
+	}
+	st := struct {
+		Generation uint64 `json:"generation"`
+	}{}
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		log.Error("sync: %s: %s", syncStateFilePath(), err)
+		return 0
+	}
+	syncState.generation = st.Generation
+	return st.Generation
+}
+
+// Store the generation of the applied data
+// The sync state lock must be held.
+func storeSyncGeneration(generation uint64) {
+	syncState.generation = generation
+	syncState.loaded = true
+	data, _ := json.Marshal(map[string]uint64{"generation": generation})
+	err := file.SafeWrite(syncStateFilePath(), data)
+	if err != nil {
+		log.Error("sync: %s", err)
+	}
+}
+
+// Get the HTTP client for the requests to the primary
+func syncHTTPClient(conf syncConfig) *http.Client {
+	if len(conf.PrimaryCertSHA256) == 0 {
+		return client
+	}
+	pin, _ := hex.DecodeString(conf.PrimaryCertSHA256)
+	t := &http.Transport{
+		DialContext: customDialContext,
+	}
+	t.TLSClientConfig = &tls.Config{
+		// the pinned certificate is checked instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("no certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("the certificate's checksum %x doesn't match primary_cert_sha256", sum)
+			}
+			return nil
+		},
+	}
+	return &http.Client{Timeout: client.Timeout, Transport: t}
+}
+
+// Get the settings which are sent to the secondary
+func getSyncData() syncData {
+	d := syncData{Version: VersionString}
+	config.RLock()
+	d.DNS = getSyncDNS(&config.DNS)
+	for _, f := range config.Filters {
+		d.Filters = append(d.Filters, syncFilter{
+			Enabled:     f.Enabled,
+			URL:         f.URL,
+			Name:        f.Name,
+			ChecksumURL: f.ChecksumURL,
+			MaxSize:     f.MaxSize,
+			MaxRules:    f.MaxRules,
+			Trusted:     f.Trusted,
+		})
+	}
+	d.UserRules = config.UserRules
+	d.ClientGroups = config.ClientGroups
+	config.RUnlock()
+
+	clients.lock.Lock()
+	for _, cli := range clientsGetList() {
+		d.Clients = append(d.Clients, toClientObject(cli))
+	}
+	clients.lock.Unlock()
+	return d
+}
+
+// Send the encrypted settings to the secondary
+func handleSyncExport(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	conf := config.Sync
+	config.RUnlock()
+	if conf.Role != syncRolePrimary {
+		httpError(w, http.StatusBadRequest, "This instance isn't the primary")
+		return
+	}
+
+	data, err := yaml.Marshal(getSyncData())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "yaml.Marshal: %s", err)
+		return
+	}
+	data, err = syncEncrypt(conf.Key, nextSyncGeneration(), data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, err = w.Write(data)
+	if err != nil {
+		log.Debug("sync: %s", err)
+	}
+}
+
+// Download and decrypt the settings from the primary
+// Returns the data, its generation and the parsed settings
+func downloadSyncData(conf syncConfig) ([]byte, uint64, syncData, error) {
+	d := syncData{}
+	url := strings.TrimRight(conf.PrimaryURL, "/") + "/control/sync/export"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, d, err
+	}
+	if len(conf.Token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+conf.Token)
+	}
+	resp, err := syncHTTPClient(conf).Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, 0, d, fmt.Errorf("couldn't request the settings from %s: %s", url, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, 0, d, fmt.Errorf("got status code %d from %s", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, syncMaxSize+1))
+	if err != nil {
+		return nil, 0, d, fmt.Errorf("couldn't read the settings from %s: %s", url, err)
+	}
+	if len(body) > syncMaxSize {
+		return nil, 0, d, fmt.Errorf("the settings exceed the limit of %d bytes", syncMaxSize)
+	}
+	generation, body, err := syncDecrypt(conf.Key, body)
+	if err != nil {
+		return nil, 0, d, err
+	}
+	err = yaml.Unmarshal(body, &d)
+	if err != nil {
+		return nil, 0, d, fmt.Errorf("couldn't parse the settings: %s", err)
+	}
+	return body, generation, d, nil
+}
+
+// Replace the filter lists: the lists with the same URL keep their IDs and contents
+// Must be called with the configuration lock held
+func syncFilters(list []syncFilter) {
+	old := map[string]filter{}
+	for _, f := range config.Filters {
+		old[f.URL] = f
+	}
+	filters := []filter{}
+	for _, sf := range list {
+		f, ok := old[sf.URL]
+		if ok {
+			delete(old, sf.URL)
+		} else {
+			f = filter{}
+			f.ID = assignUniqueFilterID()
+			f.URL = sf.URL
+		}
+		f.Enabled = sf.Enabled
+		f.Name = sf.Name
+		f.ChecksumURL = sf.ChecksumURL
+		f.MaxSize = sf.MaxSize
+		f.MaxRules = sf.MaxRules
+		f.Trusted = sf.Trusted
+		filters = append(filters, f)
+	}
+	config.Filters = filters
+
+	for _, f := range old {
+		_ = os.Remove(f.Path())
+		_ = os.Remove(f.metaPath())
+		_ = os.Remove(f.oldPath())
+	}
+}
+
+// Replace the persistent clients at once
+func syncClients(list []clientObject) {
+	cl := []Client{}
+	for _, cy := range list {
+		cl = append(cl, fromClientObject(cy))
+	}
+	for _, err := range clientsReplace(cl) {
+		log.Info("sync: client: %s", err)
+	}
+}
+
+// Download the settings from the primary and apply them if they have changed
+// Returns TRUE if the settings were updated
+func refreshSync() (bool, error) {
+	config.RLock()
+	conf := config.Sync
+	config.RUnlock()
+	if conf.Role != syncRoleSecondary {
+		return false, nil
+	}
+
+	syncState.Lock()
+	syncState.lastCheck = time.Now()
+	syncState.Unlock()
+
+	body, generation, d, err := downloadSyncData(conf)
+	syncState.Lock()
+	if err == nil && generation < appliedSyncGeneration() {
+		err = fmt.Errorf("the settings from %s are older than the applied ones", conf.PrimaryURL)
+	}
+	if err != nil {
+		syncState.lastError = err.Error()
+		syncState.Unlock()
+		return false, err
+	}
+	syncState.lastError = ""
+	checksum := sha256.Sum256(body)
+	if checksum == syncState.checksum {
+		storeSyncGeneration(generation)
+		syncState.Unlock()
+		log.Tracef("The settings of %s haven't changed", conf.PrimaryURL)
+		return false, nil
+	}
+	syncState.Unlock()
+
+	config.Lock()
+	d.DNS.apply(&config.DNS)
+	config.UserRules = d.UserRules
+	config.ClientGroups = d.ClientGroups
+	syncFilters(d.Filters)
+	config.Unlock()
+	syncClients(d.Clients)
+	log.Info("Applied the settings of %s (version %s): %d filters, %d clients",
+		conf.PrimaryURL, d.Version, len(d.Filters), len(d.Clients))
+
+	err = writeAllConfigsAndReloadDNS()
+	if err != nil {
+		syncState.Lock()
+		syncState.lastError = err.Error()
+		syncState.Unlock()
+		return false, err
+	}
+
+	syncState.Lock()
+	storeSyncGeneration(generation)
+	syncState.checksum = checksum
+	syncState.lastSynced = time.Now()
+	syncState.Unlock()
+
+	// download the new filter lists
+	go filtering.refreshFiltersIfNecessary(false)
+	return true, nil
+}
+
+func periodicallySyncConfig() {
+	for {
+		config.RLock()
+		interval := time.Duration(config.Sync.Interval) * time.Minute
+		config.RUnlock()
+		if interval == 0 {
+			interval = 10 * time.Minute
+		}
+
+		syncState.Lock()
+		due := time.Since(syncState.lastCheck) >= interval
+		syncState.Unlock()
+		if due {
+			_, err := refreshSync()
+			if err != nil {
+				log.Error("Couldn't sync the settings: %s", err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+type syncStatusJSON struct {
+	Role       string    `json:"role"`
+	PrimaryURL string    `json:"primary_url,omitempty"`
+	Interval   uint32    `json:"interval"`
+	LastSynced time.Time `json:"last_synced,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+func handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	j := syncStatusJSON{
+		Role:       config.Sync.Role,
+		PrimaryURL: config.Sync.PrimaryURL,
+		Interval:   config.Sync.Interval,
+	}
+	config.RUnlock()
+	syncState.Lock()
+	j.LastSynced = syncState.lastSynced
+	j.LastError = syncState.lastError
+	syncState.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// Sync the settings right away
+func handleSyncRefresh(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	updated, err := refreshSync()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't sync the settings: %s", err)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "OK %v\n", updated)
+}
+
+func registerSyncHandlers() {
+	http.HandleFunc("/control/sync/export", postInstall(optionalAuth(ensureGET(handleSyncExport))))
+	http.HandleFunc("/control/sync/status", postInstall(optionalAuth(ensureGET(handleSyncStatus))))
+	http.HandleFunc("/control/sync/refresh", postInstall(optionalAuth(ensurePOST(handleSyncRefresh))))
+}
@@ -0,0 +1,167 @@
+package home
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+func TestSyncEncrypt(t *testing.T) {
+	data, err := syncEncrypt("0123456789abcdef", 5, []byte("settings"))
+	if err != nil {
+		t.Fatalf("syncEncrypt: %s", err)
+	}
+	gen, plain, err := syncDecrypt("0123456789abcdef", data)
+	if err != nil || string(plain) != "settings" || gen != 5 {
+		t.Fatalf("syncDecrypt: %d %q %v", gen, plain, err)
+	}
+	_, _, err = syncDecrypt("fedcba9876543210", data)
+	if err == nil {
+		t.Fatalf("a different key")
+	}
+
+	// the generation is authenticated
+	data[syncHeaderSize-1] ^= 1
+	_, _, err = syncDecrypt("0123456789abcdef", data)
+	if err == nil {
+		t.Fatalf("altered generation")
+	}
+	data[syncHeaderSize-1] ^= 1
+
+	data[len(data)-1] ^= 1
+	_, _, err = syncDecrypt("0123456789abcdef", data)
+	if err == nil {
+		t.Fatalf("altered data")
+	}
+
+	if g1, g2 := nextSyncGeneration(), nextSyncGeneration(); g2 <= g1 {
+		t.Fatalf("generations: %d %d", g1, g2)
+	}
+}
+
+// The secondary doesn't apply the data older than the applied one
+func TestSyncOlderGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-sync")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	_ = os.MkdirAll(filepath.Join(dir, dataDir), 0755)
+	workDir, syncConf := config.ourWorkingDir, config.Sync
+	defer func() { config.ourWorkingDir, config.Sync = workDir, syncConf }()
+	config.ourWorkingDir = dir
+	defer func() {
+		syncState.generation, syncState.loaded, syncState.lastError = 0, false, ""
+	}()
+
+	data, err := syncEncrypt("0123456789abcdef", 5, []byte("version: v1"))
+	if err != nil {
+		t.Fatalf("syncEncrypt: %s", err)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+	pin := sha256.Sum256(srv.Certificate().Raw)
+	config.Sync = syncConfig{Role: syncRoleSecondary, Key: "0123456789abcdef",
+		PrimaryURL: srv.URL, PrimaryCertSHA256: hex.EncodeToString(pin[:])}
+
+	syncState.Lock()
+	storeSyncGeneration(6)
+	syncState.loaded = false
+	if appliedSyncGeneration() != 6 {
+		t.Fatalf("the generation isn't stored")
+	}
+	syncState.Unlock()
+
+	updated, err := refreshSync()
+	if updated || err == nil {
+		t.Fatalf("the older settings are applied: %v %v", updated, err)
+	}
+}
+
+func TestSyncExport(t *testing.T) {
+	syncConf, filters, rules := config.Sync, config.Filters, config.UserRules
+	defer func() { config.Sync, config.Filters, config.UserRules = syncConf, filters, rules }()
+
+	config.Sync = syncConfig{Role: syncRolePrimary, Key: "0123456789abcdef"}
+	config.UserRules = []string{"||example.org^"}
+	trusted := filter{Enabled: true, URL: "https://example.org/list.txt", Name: "List"}
+	trusted.Trusted = true
+	config.Filters = []filter{trusted}
+	srv := httptest.NewTLSServer(http.HandlerFunc(handleSyncExport))
+	defer srv.Close()
+
+	// the primary's self-signed certificate is pinned
+	pin := sha256.Sum256(srv.Certificate().Raw)
+	conf := syncConfig{Role: syncRoleSecondary, Key: "0123456789abcdef", PrimaryURL: srv.URL + "/",
+		PrimaryCertSHA256: hex.EncodeToString(pin[:])}
+	_, _, d, err := downloadSyncData(conf)
+	if err != nil {
+		t.Fatalf("downloadSyncData: %s", err)
+	}
+	if len(d.UserRules) != 1 || len(d.Filters) != 1 || d.Filters[0].URL != "https://example.org/list.txt" {
+		t.Fatalf("sync data: %+v", d)
+	}
+
+	conf.Key = "fedcba9876543210"
+	_, _, _, err = downloadSyncData(conf)
+	if err == nil {
+		t.Fatalf("a different key")
+	}
+
+	conf.Key = "0123456789abcdef"
+	conf.PrimaryCertSHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	_, _, _, err = downloadSyncData(conf)
+	if err == nil {
+		t.Fatalf("a different certificate")
+	}
+
+	// the known lists keep their IDs
+	f := filter{Enabled: false, URL: "https://example.org/list.txt"}
+	f.ID = 100
+	config.Filters = []filter{f}
+	syncFilters(d.Filters)
+	if len(config.Filters) != 1 || config.Filters[0].ID != 100 || !config.Filters[0].Enabled || config.Filters[0].Name != "List" ||
+		!config.Filters[0].Trusted {
+		t.Fatalf("filters: %+v", config.Filters)
+	}
+
+	if validateSyncConfig(syncConfig{Role: syncRoleSecondary, Key: "short", PrimaryURL: "https://a"}) == nil ||
+		validateSyncConfig(syncConfig{Role: syncRoleSecondary, Key: "0123456789abcdef", PrimaryURL: "a"}) == nil ||
+		validateSyncConfig(syncConfig{Role: syncRoleSecondary, Key: "0123456789abcdef", PrimaryURL: "http://a"}) == nil ||
+		validateSyncConfig(syncConfig{Role: syncRoleSecondary, Key: "0123456789abcdef", PrimaryURL: "https://a",
+			PrimaryCertSHA256: "ab"}) == nil ||
+		validateSyncConfig(syncConfig{Role: "master"}) == nil {
+		t.Fatalf("invalid settings")
+	}
+}
+
+// Only the shared DNS settings are applied, the settings of the instance are kept
+func TestSyncDNS(t *testing.T) {
+	primary := dnsConfig{UpstreamDNS: []string{"1.1.1.1"}}
+	primary.ProtectionEnabled = true
+	primary.QueryLogForward = "udp://1.2.3.4:514"
+	primary.StatsInterval = 90
+	primary.Rewrites = []dnsfilter.RewriteEntry{{Domain: "example.org", Answer: "1.2.3.4"}}
+
+	secondary := dnsConfig{BindHost: "127.0.0.1", Port: 5353}
+	secondary.QueryLogDB = true
+	secondary.StatsInterval = 7
+	getSyncDNS(&primary).apply(&secondary)
+
+	if !secondary.ProtectionEnabled || len(secondary.UpstreamDNS) != 1 || len(secondary.Rewrites) != 1 {
+		t.Fatalf("shared settings: %+v", secondary)
+	}
+	if secondary.BindHost != "127.0.0.1" || secondary.Port != 5353 || !secondary.QueryLogDB ||
+		secondary.QueryLogForward != "" || secondary.StatsInterval != 7 {
+		t.Fatalf("instance settings: %+v", secondary)
+	}
+}
@@ -1,12 +1,17 @@
 package home
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -14,9 +19,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/utils"
 	"github.com/NYTimes/gziphandler"
 	"github.com/miekg/dns"
@@ -26,10 +31,13 @@ import (
 const updatePeriod = time.Minute * 30
 
 // cached version.json to avoid hammering github.io for each page reload
+// They're protected by versionCheckLock: the data may be requested while controlLock is held.
+var versionCheckLock sync.Mutex
 var versionCheckJSON []byte
 var versionCheckLastTime time.Time
+var versionCheckChannel string
 
-var protocols = []string{"tls://", "https://", "tcp://", "sdns://"}
+var protocols = []string{"tls://", "https://", "quic://", "tcp://", "sdns://"}
 
 var transport = &http.Transport{
 	DialContext: customDialContext,
@@ -62,15 +70,6 @@ func httpError(w http.ResponseWriter, code int, format string, args ...interface
 // ---------------
 // dns run control
 // ---------------
-func writeAllConfigsAndReloadDNS() error {
-	err := writeAllConfigs()
-	if err != nil {
-		log.Error("Couldn't write all configs: %s", err)
-		return err
-	}
-	return reconfigureDNSServer()
-}
-
 func httpUpdateConfigReloadDNSReturnOK(w http.ResponseWriter, r *http.Request) {
 	err := writeAllConfigsAndReloadDNS()
 	if err != nil {
@@ -100,17 +99,27 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := map[string]interface{}{
-		"dns_addresses":      dnsAddresses,
-		"http_port":          config.BindPort,
-		"dns_port":           config.DNS.Port,
-		"protection_enabled": config.DNS.ProtectionEnabled,
-		"querylog_enabled":   config.DNS.QueryLogEnabled,
-		"running":            isRunning(),
-		"bootstrap_dns":      config.DNS.BootstrapDNS,
-		"upstream_dns":       config.DNS.UpstreamDNS,
-		"all_servers":        config.DNS.AllServers,
-		"version":            VersionString,
-		"language":           config.Language,
+		"dns_addresses":         dnsAddresses,
+		"http_port":             config.BindPort,
+		"dns_port":              config.DNS.Port,
+		"protection_enabled":    config.DNS.ProtectionEnabled,
+		"querylog_enabled":      config.DNS.QueryLogEnabled,
+		"running":               isRunning(),
+		"bootstrap_dns":         config.DNS.BootstrapDNS,
+		"upstream_dns":          config.DNS.UpstreamDNS,
+		"all_servers":           config.DNS.AllServers,
+		"local_ptr_upstreams":   config.DNS.LocalPTRDNS,
+		"fallback_dns":          config.DNS.FallbackDNS,
+		"upstream_timeout":      config.DNS.UpstreamTimeout,
+		"upstream_pool_size":    config.DNS.UpstreamPoolSize,
+		"upstream_pipelining":   config.DNS.UpstreamPipelining,
+		"upstream_idle_timeout": config.DNS.UpstreamIdleTimeout,
+		"fallback_timeout":      config.DNS.FallbackTimeout,
+		"version":               VersionString,
+		"language":              config.Language,
+		"clock_warning":         clockWarning(),
+		"listeners":             getListenersStatus(),
+		"file_problems":         getFilePermissionProblems(),
 	}
 
 	jsonVal, err := json.Marshal(data)
@@ -153,9 +162,101 @@ func handleQueryLogDisable(w http.ResponseWriter, r *http.Request) {
 	httpUpdateConfigReloadDNSReturnOK(w, r)
 }
 
-func handleQueryLog(w http.ResponseWriter, r *http.Request) {
-	log.Tracef("%s %v", r.Method, r.URL)
-	data := dnsServer.GetQueryLog()
+// Add the names of the clients to the query log entries
+func addQueryLogClientNames(data []map[string]interface{}) {
+	names := map[string]string{} // client IP -> name
+	for _, entry := range data {
+		addQueryLogClientName(entry, names)
+	}
+}
+
+// Add the name of the client to the query log entry, the names are cached in the map
+func addQueryLogClientName(entry map[string]interface{}, names map[string]string) {
+	ip, _ := entry["client"].(string)
+	name, ok := names[ip]
+	if !ok {
+		name = clientName(ip)
+		names[ip] = name
+	}
+	if len(name) != 0 {
+		entry["client_name"] = name
+	}
+}
+
+// the parameters of /control/querylog which select the entries
+var queryLogSearchParams = []string{"client", "domain", "search", "question_type", "status", "response_status",
+	"start_time", "end_time", "older_than", "limit"}
+
+// Parse the query log search parameters
+func parseQueryLogSearch(q url.Values) (dnsforward.QueryLogSearch, error) {
+	f := dnsforward.QueryLogSearch{
+		Domain:   strings.ToLower(strings.TrimSuffix(q.Get("domain"), ".")),
+		Search:   strings.ToLower(q.Get("search")),
+		QType:    strings.ToUpper(q.Get("question_type")),
+		Status:   strings.ToUpper(q.Get("status")),
+		Response: q.Get("response_status"),
+	}
+	if _, ok := dns.StringToType[f.QType]; len(f.QType) != 0 && !ok {
+		return f, fmt.Errorf("invalid question_type: %s", q.Get("question_type"))
+	}
+	if f.Status == "FILTERED" {
+		// compatibility with /control/querylog_search
+		f.Status = ""
+		f.Response = dnsforward.QueryLogBlocked
+	} else if _, ok := dns.StringToRcode[f.Status]; len(f.Status) != 0 && !ok {
+		return f, fmt.Errorf("invalid status: %s", q.Get("status"))
+	}
+	switch f.Response {
+	case "", dnsforward.QueryLogBlocked, dnsforward.QueryLogAllowed, dnsforward.QueryLogRewritten:
+	default:
+		return f, fmt.Errorf("invalid response_status: %s", f.Response)
+	}
+
+	// the client is an IP address, a persistent client name, a host name
+	// or an anonymized address from the query log
+	client := q.Get("client")
+	if len(client) != 0 {
+		ip := net.ParseIP(client)
+		if ip != nil {
+			f.Client = ip.String()
+		} else {
+			f.Client = clientFindIP(client)
+			if len(f.Client) == 0 {
+				f.Client = client
+			}
+		}
+	}
+
+	var err error
+	if len(q.Get("start_time")) != 0 {
+		f.Start, err = time.Parse(time.RFC3339, q.Get("start_time"))
+		if err != nil {
+			return f, fmt.Errorf("invalid start_time: %s", err)
+		}
+	}
+	if len(q.Get("end_time")) != 0 {
+		f.End, err = time.Parse(time.RFC3339, q.Get("end_time"))
+		if err != nil {
+			return f, fmt.Errorf("invalid end_time: %s", err)
+		}
+	}
+	if len(q.Get("older_than")) != 0 {
+		f.OlderThan, err = time.Parse(time.RFC3339Nano, q.Get("older_than"))
+		if err != nil {
+			return f, fmt.Errorf("invalid older_than: %s", err)
+		}
+	}
+	if len(q.Get("limit")) != 0 {
+		f.Limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || f.Limit <= 0 {
+			return f, fmt.Errorf("invalid limit: %s", q.Get("limit"))
+		}
+	}
+	return f, nil
+}
+
+func writeQueryLog(w http.ResponseWriter, data []map[string]interface{}) {
+	addQueryLogClientNames(data)
 
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
@@ -170,6 +271,240 @@ func handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleQueryLog returns the recent query log entries,
+// or the entries selected by the search parameters, newest first
+// The next page is requested with older_than set to the time of the last entry.
+func handleQueryLog(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	q := r.URL.Query()
+
+	search := false
+	for _, p := range queryLogSearchParams {
+		if len(q.Get(p)) != 0 {
+			search = true
+			break
+		}
+	}
+	if !search {
+		writeQueryLog(w, dnsServer.GetQueryLog())
+		return
+	}
+
+	f, err := parseQueryLogSearch(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	data, err := dnsServer.SearchQueryLog(f)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't search the query log: %s", err)
+		return
+	}
+	writeQueryLog(w, data)
+}
+
+// handleQueryLogSearch returns the query log entries of a client, a domain, a response status or a time range
+func handleQueryLogSearch(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	f, err := parseQueryLogSearch(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	data, err := dnsServer.SearchQueryLog(f)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't search the query log: %s", err)
+		return
+	}
+	writeQueryLog(w, data)
+}
+
+// the columns of the query log exported to CSV
+var queryLogCSVHeader = []string{"time", "client", "client_name", "host", "type", "class", "status", "reason",
+	"rule", "filter_id", "service_name", "elapsed_ms", "cached", "answer"}
+
+// Convert the query log entry to a CSV record
+func queryLogCSVRecord(entry map[string]interface{}) []string {
+	str := func(key string) string {
+		v, ok := entry[key]
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf("%v", v)
+	}
+	host, qtype, class := "", "", ""
+	if q, ok := entry["question"].(map[string]interface{}); ok {
+		host = fmt.Sprintf("%v", q["host"])
+		qtype = fmt.Sprintf("%v", q["type"])
+		class = fmt.Sprintf("%v", q["class"])
+	}
+	answer := []string{}
+	if a, ok := entry["answer"].([]map[string]interface{}); ok {
+		for _, rr := range a {
+			answer = append(answer, fmt.Sprintf("%v", rr["value"]))
+		}
+	}
+	return []string{str("time"), str("client"), str("client_name"), host, qtype, class, str("status"), str("reason"),
+		str("rule"), str("filterId"), str("service_name"), str("elapsedMs"), str("cached"), strings.Join(answer, " ")}
+}
+
+// stops the export when the requested number of entries is written
+var errExportLimit = errors.New("the limit is reached")
+
+// handleQueryLogExport streams the query log entries selected by the search parameters, oldest first,
+// as CSV or JSON Lines
+func handleQueryLogExport(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	q := r.URL.Query()
+
+	format := q.Get("format")
+	contentType := ""
+	switch format {
+	case "csv":
+		contentType = "text/csv"
+	case "jsonl":
+		contentType = "application/x-ndjson"
+	default:
+		httpError(w, http.StatusBadRequest, "Invalid format: %s", format)
+		return
+	}
+	f, err := parseQueryLogSearch(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"querylog.%s\"", format))
+
+	bw := bufio.NewWriter(w)
+	cw := csv.NewWriter(bw)
+	enc := json.NewEncoder(bw)
+	if format == "csv" {
+		_ = cw.Write(queryLogCSVHeader)
+	}
+	names := map[string]string{} // client IP -> name
+	n := 0
+	err = dnsServer.ExportQueryLog(f, func(entry map[string]interface{}) error {
+		if f.Limit != 0 && n == f.Limit {
+			return errExportLimit
+		}
+		n++
+		addQueryLogClientName(entry, names)
+		if format == "csv" {
+			return cw.Write(queryLogCSVRecord(entry))
+		}
+		return enc.Encode(entry)
+	})
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err == nil || err == errExportLimit {
+		err = bw.Flush()
+	}
+	if err != nil {
+		// the response status has been sent already
+		log.Error("querylog: export failed after %d entries: %s", n, err)
+	}
+}
+
+// the comment sent to the query log stream if there are no new entries, so the broken connections are detected
+const queryLogStreamKeepAlive = 15 * time.Second
+
+// queryLogStreams stops the streams when the HTTP server is shut down,
+// otherwise the shutdown would wait for them
+var queryLogStreams = struct {
+	sync.Mutex
+	stop chan struct{}
+}{stop: make(chan struct{})}
+
+func stopQueryLogStreams() {
+	queryLogStreams.Lock()
+	close(queryLogStreams.stop)
+	queryLogStreams.stop = make(chan struct{})
+	queryLogStreams.Unlock()
+}
+
+// handleQueryLogStream pushes the new query log entries selected by the search parameters as Server-Sent Events
+// Each entry is sent as a message, "dropped" event has the number of entries dropped because the client is too slow.
+func handleQueryLogStream(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "Streaming isn't supported")
+		return
+	}
+	f, err := parseQueryLogSearch(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	queryLogStreams.Lock()
+	stop := queryLogStreams.stop
+	queryLogStreams.Unlock()
+
+	tail := dnsServer.TailQueryLog(f)
+	defer tail.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx mustn't buffer the events
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	names := map[string]string{} // client IP -> name
+	var dropped uint64
+	keepAlive := time.NewTicker(queryLogStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var data []byte
+		select {
+		case entry := <-tail.C:
+			addQueryLogClientName(entry, names)
+			jsonVal, err := json.Marshal(entry)
+			if err != nil {
+				log.Error("querylog: stream: %s", err)
+				continue
+			}
+			data = []byte(fmt.Sprintf("data: %s\n\n", jsonVal))
+			if n := tail.Dropped(); n != dropped {
+				dropped = n
+				data = append(data, fmt.Sprintf("event: dropped\ndata: {\"dropped\":%d}\n\n", n)...)
+			}
+
+		case <-keepAlive.C:
+			data = []byte(": keep-alive\n\n")
+
+		case <-r.Context().Done():
+			return
+
+		case <-stop:
+			return
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			log.Debug("querylog: stream: %s", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// handleQueryLogDiskUsage returns the disk space taken by the query log and the retention limits
+func handleQueryLogDiskUsage(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	data := dnsServer.GetQueryLogDiskUsage()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
 func handleStatsTop(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
 	s := dnsServer.GetStatsTop()
@@ -216,17 +551,332 @@ func handleStatsTop(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleStatsReset resets the stats caches
+// The scope of a reset: the requests of a client, a domain or a time range
+type resetScope struct {
+	Client    string `json:"client"`
+	Domain    string `json:"domain"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+// Parse the scope of a reset, the empty scope (or no request body) selects all requests
+func parseResetScope(r *http.Request) (dnsforward.StatsResetFilter, error) {
+	f := dnsforward.StatsResetFilter{}
+	req := resetScope{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		return f, fmt.Errorf("json.Decode: %s", err)
+	}
+
+	f.Domain = strings.ToLower(strings.TrimSuffix(req.Domain, "."))
+	if len(req.Client) != 0 {
+		ip := net.ParseIP(req.Client)
+		if ip == nil {
+			return f, fmt.Errorf("invalid client IP address: %s", req.Client)
+		}
+		f.Client = ip.String()
+	}
+	if len(req.StartTime) != 0 {
+		f.Start, err = time.Parse(time.RFC3339, req.StartTime)
+		if err != nil {
+			return f, fmt.Errorf("invalid start_time: %s", err)
+		}
+	}
+	if len(req.EndTime) != 0 {
+		f.End, err = time.Parse(time.RFC3339, req.EndTime)
+		if err != nil {
+			return f, fmt.Errorf("invalid end_time: %s", err)
+		}
+	}
+	return f, nil
+}
+
+// Return TRUE if the scope selects all requests
+func resetScopeAll(f dnsforward.StatsResetFilter) bool {
+	return len(f.Client) == 0 && len(f.Domain) == 0 && f.Start.IsZero() && f.End.IsZero()
+}
+
+// Get the scope of a reset for the audit log
+func resetScopeDetails(f dnsforward.StatsResetFilter) map[string]interface{} {
+	details := map[string]interface{}{}
+	if len(f.Client) != 0 {
+		details["client"] = f.Client
+	}
+	if len(f.Domain) != 0 {
+		details["domain"] = f.Domain
+	}
+	if !f.Start.IsZero() {
+		details["start_time"] = f.Start.Format(time.RFC3339)
+	}
+	if !f.End.IsZero() {
+		details["end_time"] = f.End.Format(time.RFC3339)
+	}
+	return details
+}
+
+// handleStatsReset resets all stats, or removes the requests of a client, a domain or a time range from the stats
 func handleStatsReset(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
-	dnsServer.PurgeStats()
-	_, err := fmt.Fprintf(w, "OK\n")
+
+	f, err := parseResetScope(r)
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if resetScopeAll(f) {
+		dnsServer.PurgeStats()
+		auditLog(r, "stats_reset", nil)
+		_, err = fmt.Fprintf(w, "OK\n")
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+		}
+		return
+	}
+	resetStatsSelected(w, r, f)
+}
+
+// handleStatsResetSelected removes the requests of a client, a domain or a time range from the stats
+func handleStatsResetSelected(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	f, err := parseResetScope(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if resetScopeAll(f) {
+		httpError(w, http.StatusBadRequest, "Specify client, domain or time range, use /control/stats_reset to reset all stats")
+		return
+	}
+	resetStatsSelected(w, r, f)
+}
+
+func resetStatsSelected(w http.ResponseWriter, r *http.Request, f dnsforward.StatsResetFilter) {
+	removed, err := dnsServer.ResetStats(f)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't reset stats: %s", err)
+		return
+	}
+	details := resetScopeDetails(f)
+	details["removed"] = removed
+	auditLog(r, "stats_reset", details)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// handleQueryLogClear removes all query log entries, or the entries of a client or a time range
+func handleQueryLogClear(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	f, err := parseResetScope(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if len(f.Domain) != 0 {
+		httpError(w, http.StatusBadRequest, "The query log can be cleared for a client or a time range only")
+		return
+	}
+
+	removed, err := dnsServer.ClearQueryLog(dnsforward.QueryLogClearFilter{Client: f.Client, Start: f.Start, End: f.End})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't clear the query log: %s", err)
+		return
+	}
+	details := resetScopeDetails(f)
+	details["removed"] = removed
+	auditLog(r, "querylog_clear", details)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
 	}
 }
 
-// handleStats returns aggregated stats data for the 24 hours
+const (
+	statsTopReportLimit    = 10  // default number of lines of each top chart
+	statsTopReportMaxLimit = 100 // max number of lines of each top chart
+)
+
+// Parse the time range and the number of lines of the top charts
+// The default time range is the statistics interval.
+func parseStatsRange(q url.Values) (time.Time, time.Time, int, error) {
+	var err error
+	endTime := time.Now()
+	if len(q.Get("end_time")) != 0 {
+		endTime, err = time.Parse(time.RFC3339, q.Get("end_time"))
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid end_time: %s", err)
+		}
+	}
+	startTime := endTime.Add(-dnsServer.GetStatsInterval())
+	if len(q.Get("start_time")) != 0 {
+		startTime, err = time.Parse(time.RFC3339, q.Get("start_time"))
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("invalid start_time: %s", err)
+		}
+	}
+	if startTime.After(endTime) {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("start_time must be before end_time")
+	}
+	limit := statsTopReportLimit
+	if len(q.Get("limit")) != 0 {
+		limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 || limit > statsTopReportMaxLimit {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("limit must be a number from 1 to %d", statsTopReportMaxLimit)
+		}
+	}
+	return startTime, endTime, limit, nil
+}
+
+// handleStatsTopReport returns the top domains, blocked domains, clients and upstream servers over the time range
+func handleStatsTopReport(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	startTime, endTime, limit, err := parseStatsRange(r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	report, err := dnsServer.GetStatsTopReport(startTime, endTime, limit)
+	if err == dnsforward.ErrStatsNotStored {
+		httpError(w, http.StatusBadRequest, "The statistics are not stored, set the statistics interval")
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't get the top charts: %s", err)
+		return
+	}
+
+	clients := []map[string]interface{}{}
+	for _, item := range report.Clients {
+		client := map[string]interface{}{"name": item.Name, "count": item.Count}
+		if name := clientName(item.Name); len(name) != 0 {
+			client["client_name"] = name
+		}
+		clients = append(clients, client)
+	}
+	data := map[string]interface{}{
+		"top_queried_domains": report.Domains,
+		"top_blocked_domains": report.Blocked,
+		"top_clients":         clients,
+		"top_upstreams":       report.Upstreams,
+		"start_time":          startTime.Format(time.RFC3339),
+		"end_time":            endTime.Format(time.RFC3339),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// handleStatsClient returns the numbers of the requests and the blocked requests of the client and its top domains over the time range
+// The client is identified by its IP address, name or host name.
+func handleStatsClient(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	q := r.URL.Query()
+
+	id := q.Get("id")
+	if len(id) == 0 {
+		httpError(w, http.StatusBadRequest, "id is required")
+		return
+	}
+	ip := id
+	if net.ParseIP(id) == nil {
+		ip = clientFindIP(id)
+		if len(ip) == 0 {
+			httpError(w, http.StatusNotFound, "Unknown client: %s", id)
+			return
+		}
+	}
+	startTime, endTime, limit, err := parseStatsRange(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	report, err := dnsServer.GetStatsClientReport(ip, startTime, endTime, limit)
+	if err == dnsforward.ErrStatsNotStored {
+		httpError(w, http.StatusBadRequest, "The statistics are not stored, set the statistics interval")
+		return
+	} else if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't get the client statistics: %s", err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"client":              ip,
+		"dns_queries":         report.Requests,
+		"blocked_filtering":   report.Blocked,
+		"time_unit":           report.TimeUnit,
+		"series":              map[string][]float64{"dns_queries": report.RequestsSeries, "blocked_filtering": report.BlockedSeries},
+		"top_queried_domains": report.Domains,
+		"start_time":          startTime.Format(time.RFC3339),
+		"end_time":            endTime.Format(time.RFC3339),
+	}
+	if name := clientName(ip); len(name) != 0 {
+		data["client_name"] = name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+type statsConfigJSON struct {
+	Interval uint32 `json:"interval"` // days
+}
+
+// handleStatsInfo returns the statistics settings
+func handleStatsInfo(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	j := statsConfigJSON{Interval: config.DNS.StatsInterval}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// handleStatsConfig sets for how long the statistics are stored
+func handleStatsConfig(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	j := statsConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = dnsforward.CheckStatsInterval(j.Interval)
+	if err != nil || j.Interval == 0 {
+		httpError(w, http.StatusBadRequest, "interval must be 1, 7, 30 or 90 days")
+		return
+	}
+
+	config.Lock()
+	config.DNS.StatsInterval = j.Interval
+	config.Unlock()
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleStats returns aggregated stats data for the 24 hours, or for the statistics interval if the statistics are stored
 func handleStats(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
 	summed := dnsServer.GetAggregatedStats()
@@ -296,6 +946,27 @@ func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleStatsChatty returns the list of clients that re-query domains far more often than the TTL allows
+func handleStatsChatty(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	data := map[string]interface{}{
+		"clients": dnsServer.GetChattyClients(),
+	}
+
+	jsonVal, err := json.Marshal(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to marshal chatty clients json: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+		return
+	}
+}
+
 // sortByValue is a helper function for querylog API
 func sortByValue(m map[string]int) []string {
 	type kv struct {
@@ -323,9 +994,16 @@ func sortByValue(m map[string]int) []string {
 
 // TODO this struct will become unnecessary after config file rework
 type upstreamConfig struct {
-	Upstreams    []string `json:"upstream_dns"`  // Upstreams
-	BootstrapDNS []string `json:"bootstrap_dns"` // Bootstrap DNS
-	AllServers   bool     `json:"all_servers"`   // --all-servers param for dnsproxy
+	Upstreams           []string `json:"upstream_dns"`          // Upstreams
+	BootstrapDNS        []string `json:"bootstrap_dns"`         // Bootstrap DNS
+	AllServers          bool     `json:"all_servers"`           // --all-servers param for dnsproxy
+	LocalPTRDNS         []string `json:"local_ptr_upstreams"`   // resolvers for the reverse lookups of the private addresses
+	FallbackDNS         []string `json:"fallback_dns"`          // used only if all upstreams fail
+	UpstreamTimeout     uint32   `json:"upstream_timeout"`      // in seconds, 0: default
+	FallbackTimeout     uint32   `json:"fallback_timeout"`      // in seconds, 0: default
+	UpstreamPoolSize    int      `json:"upstream_pool_size"`    // max number of TCP and TLS connections kept open to an upstream server, 0: default
+	UpstreamPipelining  bool     `json:"upstream_pipelining"`   // if true, several requests are sent over a connection without waiting for the responses
+	UpstreamIdleTimeout uint32   `json:"upstream_idle_timeout"` // in seconds, 0: default
 }
 
 func handleSetUpstreamConfig(w http.ResponseWriter, r *http.Request) {
@@ -343,6 +1021,23 @@ func handleSetUpstreamConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = validateCommonUpstreams(newconfig.LocalPTRDNS)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "wrong local resolvers specification: %s", err)
+		return
+	}
+
+	err = validateCommonUpstreams(newconfig.FallbackDNS)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "wrong fallback servers specification: %s", err)
+		return
+	}
+
+	if newconfig.UpstreamPoolSize < 0 {
+		httpError(w, http.StatusBadRequest, "upstream_pool_size must not be negative")
+		return
+	}
+
 	config.DNS.UpstreamDNS = defaultDNS
 	if len(newconfig.Upstreams) > 0 {
 		config.DNS.UpstreamDNS = newconfig.Upstreams
@@ -362,7 +1057,31 @@ func handleSetUpstreamConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	config.DNS.AllServers = newconfig.AllServers
+	config.DNS.LocalPTRDNS = newconfig.LocalPTRDNS
+	config.DNS.FallbackDNS = newconfig.FallbackDNS
+	config.DNS.UpstreamTimeout = newconfig.UpstreamTimeout
+	config.DNS.FallbackTimeout = newconfig.FallbackTimeout
+	config.DNS.UpstreamPoolSize = newconfig.UpstreamPoolSize
+	config.DNS.UpstreamPipelining = newconfig.UpstreamPipelining
+	config.DNS.UpstreamIdleTimeout = newconfig.UpstreamIdleTimeout
 	httpUpdateConfigReloadDNSReturnOK(w, r)
+
+	// the addresses which couldn't be resolved before may be resolved by the new servers
+	resetRDNS()
+}
+
+// validateCommonUpstreams validates each upstream and returns an error if any upstream is invalid or domain-specific
+func validateCommonUpstreams(upstreams []string) error {
+	for _, u := range upstreams {
+		d, err := validateUpstream(u)
+		if err != nil {
+			return fmt.Errorf("%s: %s", u, err)
+		}
+		if !d {
+			return fmt.Errorf("%s: domain-specific upstreams aren't supported", u)
+		}
+	}
+	return nil
 }
 
 // validateUpstreams validates each upstream and returns an error if any upstream is invalid or if there are no default upstreams specified
@@ -403,7 +1122,7 @@ func validateUpstream(u string) (bool, error) {
 	// Check if the upstream has a valid protocol prefix
 	for _, proto := range protocols {
 		if strings.HasPrefix(u, proto) {
-			return defaultUpstream, nil
+			return defaultUpstream, checkUpstreamURL(u)
 		}
 	}
 
@@ -416,6 +1135,36 @@ func validateUpstream(u string) (bool, error) {
 	return defaultUpstream, checkPlainDNS(u)
 }
 
+// checkUpstreamURL checks that the upstream URL has a valid host and port
+func checkUpstreamURL(upstream string) error {
+	if strings.HasPrefix(upstream, "sdns://") {
+		return nil // DNS stamps are checked by the DNS proxy
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if len(host) == 0 {
+		return fmt.Errorf("%s: no host", upstream)
+	}
+	if net.ParseIP(host) == nil {
+		err = utils.IsValidHostname(host)
+		if err != nil {
+			return fmt.Errorf("%s: %s", upstream, err)
+		}
+	}
+	port := u.Port()
+	if len(port) != 0 {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 0xffff {
+			return fmt.Errorf("%s: invalid port %s", upstream, port)
+		}
+	}
+	return nil
+}
+
 // separateUpstream returns upstream without specified domains and a bool flag that indicates if no domains were specified
 // error will be returned if upstream per domain specification is invalid
 func separateUpstream(upstream string) (string, bool, error) {
@@ -526,7 +1275,7 @@ func checkDNS(input string, bootstrap []string) error {
 	}
 
 	log.Debug("Checking if DNS %s works...", input)
-	u, err := upstream.AddressToUpstream(input, upstream.Options{Bootstrap: bootstrap, Timeout: dnsforward.DefaultTimeout})
+	u, err := dnsforward.AddressToUpstream(input, upstream.Options{Bootstrap: bootstrap, Timeout: dnsforward.DefaultTimeout}, upstreamPoolConfig())
 	if err != nil {
 		return fmt.Errorf("failed to choose upstream for %s: %s", input, err)
 	}
@@ -579,6 +1328,8 @@ func handleFilteringStatus(w http.ResponseWriter, r *http.Request) {
 	config.RLock()
 	data["filters"] = config.Filters
 	data["user_rules"] = config.UserRules
+	data["temp_rules"] = getTempRulesStatus(time.Now())
+	data["disabled_rules"] = dnsfilter.GetRegexRuleProblems()
 	jsonVal, err := json.Marshal(data)
 	config.RUnlock()
 
@@ -614,6 +1365,13 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the checksum is useless against MITM if it's downloaded via the same insecure channel
+	if len(f.ChecksumURL) != 0 &&
+		(!govalidator.IsRequestURL(f.ChecksumURL) || !strings.HasPrefix(strings.ToLower(f.ChecksumURL), "https://")) {
+		http.Error(w, "checksum_url parameter must be a valid HTTPS URL", http.StatusBadRequest)
+		return
+	}
+
 	// Check for duplicates
 	if filterExists(f.URL) {
 		httpError(w, http.StatusBadRequest, "Filter URL already added -- %s", f.URL)
@@ -625,7 +1383,7 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	f.Enabled = true
 
 	// Download the filter contents
-	ok, err := f.update()
+	ok, err := filtering.update(&f)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "Couldn't fetch filter from url %s: %s", f.URL, err)
 		return
@@ -702,6 +1460,8 @@ func handleFilteringRemoveURL(w http.ResponseWriter, r *http.Request) {
 				httpError(w, http.StatusInternalServerError, "Couldn't remove the filter file: %s", err)
 				return
 			}
+			_ = os.Remove(filter.metaPath())
+			_ = os.Remove(filter.oldPath())
 		}
 	}
 	// Update the configuration after removing filter files
@@ -766,8 +1526,38 @@ func handleFilteringDisableURL(w http.ResponseWriter, r *http.Request) {
 	httpUpdateConfigReloadDNSReturnOK(w, r)
 }
 
+func handleFilteringSetTrusted(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	type request struct {
+		URL     string `json:"url"`
+		Trusted bool   `json:"trusted"`
+	}
+	req := request{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	if valid := govalidator.IsRequestURL(req.URL); !valid {
+		http.Error(w, "URL parameter is not valid request URL", http.StatusBadRequest)
+		return
+	}
+
+	if !filterSetTrusted(req.URL, req.Trusted) {
+		http.Error(w, "URL parameter was not previously added", http.StatusBadRequest)
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
 func handleFilteringSetRules(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
+	if !checkLocalRulesEditable(w) {
+		return
+	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		httpError(w, http.StatusBadRequest, "Failed to read request body: %s", err)
@@ -780,10 +1570,77 @@ func handleFilteringSetRules(w http.ResponseWriter, r *http.Request) {
 
 func handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
-	updated := refreshFiltersIfNecessary(true)
+	if len(r.URL.Query().Get("async")) != 0 {
+		handleFilteringRefreshAsync(w, r)
+		return
+	}
+	updated := filtering.refreshFiltersIfNecessary(true)
 	fmt.Fprintf(w, "OK %d filters updated\n", updated)
 }
 
+const defaultRuleStatsTop = 10
+
+type filterRuleStatsJSON struct {
+	ID        int64                `json:"id"`
+	Name      string               `json:"name"`
+	URL       string               `json:"url"`
+	Enabled   bool                 `json:"enabled"`
+	TotalHits uint64               `json:"total_hits"`
+	Rules     []dnsfilter.RuleHits `json:"rules"`
+}
+
+// Get the most frequently matched rules of every filter list
+// Lists that have never matched are returned too: they're candidates for removal
+func handleFilteringRuleStats(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	top := defaultRuleStatsTop
+	topStr := r.URL.Query().Get("top")
+	if len(topStr) != 0 {
+		var err error
+		top, err = strconv.Atoi(topStr)
+		if err != nil || top < 0 {
+			httpError(w, http.StatusBadRequest, "Invalid 'top' parameter: %s", topStr)
+			return
+		}
+	}
+
+	hits := map[int64]dnsfilter.FilterRuleStats{}
+	for _, fs := range dnsfilter.GetRuleStats(top) {
+		hits[fs.FilterID] = fs
+	}
+
+	config.RLock()
+	// user rules always have ID=0
+	filters := []filter{{Enabled: true, Name: "Custom filtering rules"}}
+	filters = append(filters, config.Filters...)
+	config.RUnlock()
+
+	data := []filterRuleStatsJSON{}
+	for _, f := range filters {
+		fs := hits[f.ID]
+		j := filterRuleStatsJSON{
+			ID:        f.ID,
+			Name:      f.Name,
+			URL:       f.URL,
+			Enabled:   f.Enabled,
+			TotalHits: fs.TotalHits,
+			Rules:     fs.Rules,
+		}
+		if j.Rules == nil {
+			j.Rules = []dnsfilter.RuleHits{}
+		}
+		data = append(data, j)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
 // ------------
 // safebrowsing
 // ------------
@@ -872,6 +1729,30 @@ func handleParentalDisable(w http.ResponseWriter, r *http.Request) {
 	httpUpdateConfigReloadDNSReturnOK(w, r)
 }
 
+// Set the categories blocked by parental control, the empty list means all categories
+func handleParentalCategories(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	list := []string{}
+	err := json.NewDecoder(r.Body).Decode(&list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = dnsfilter.CheckParentalCategories(list)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	config.DNS.ParentalCategories = list
+	config.Unlock()
+	log.Debug("Parental categories: %v", list)
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
 func handleParentalStatus(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
 	data := map[string]interface{}{
@@ -880,6 +1761,15 @@ func handleParentalStatus(w http.ResponseWriter, r *http.Request) {
 	if config.DNS.ParentalEnabled {
 		data["sensitivity"] = config.DNS.ParentalSensitivity
 	}
+	categories := config.DNS.ParentalCategories
+	if categories == nil {
+		categories = []string{}
+	}
+	data["categories"] = categories
+	data["available_categories"] = dnsfilter.ParentalCategories
+	if len(config.DNS.ParentalCategoryDB) != 0 {
+		data["category_db"] = dnsfilter.GetCategoryDBStatus()
+	}
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "Unable to marshal status json: %s", err)
@@ -944,6 +1834,20 @@ func handleDOH(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	config.RLock()
+	disabled := listenerDisabled(listenerHTTPS)
+	config.RUnlock()
+	if disabled {
+		httpError(w, http.StatusNotFound, "DNS-over-HTTPS is disabled")
+		return
+	}
+
+	id := dnsforward.ClientIDFromPath(r.URL.Path)
+	if len(id) != 0 && !clientNameExists(id) {
+		httpError(w, http.StatusNotFound, "Unknown client: %s", id)
+		return
+	}
+
 	dnsServer.ServeHTTP(w, r)
 }
 
@@ -955,18 +1859,33 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/enable_protection", postInstall(optionalAuth(ensurePOST(handleProtectionEnable))))
 	http.HandleFunc("/control/disable_protection", postInstall(optionalAuth(ensurePOST(handleProtectionDisable))))
 	http.Handle("/control/querylog", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleQueryLog)))))
+	http.Handle("/control/querylog/export", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleQueryLogExport)))))
+	http.Handle("/control/querylog/stream", postInstallHandler(optionalAuthHandler(ensureGETHandler(handleQueryLogStream))))
+	http.Handle("/control/querylog_search", postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureGETHandler(handleQueryLogSearch)))))
+	http.HandleFunc("/control/querylog_disk_usage", postInstall(optionalAuth(ensureGET(handleQueryLogDiskUsage))))
 	http.HandleFunc("/control/querylog_enable", postInstall(optionalAuth(ensurePOST(handleQueryLogEnable))))
 	http.HandleFunc("/control/querylog_disable", postInstall(optionalAuth(ensurePOST(handleQueryLogDisable))))
 	http.HandleFunc("/control/set_upstreams_config", postInstall(optionalAuth(ensurePOST(handleSetUpstreamConfig))))
 	http.HandleFunc("/control/test_upstream_dns", postInstall(optionalAuth(ensurePOST(handleTestUpstreamDNS))))
+	http.HandleFunc("/control/config/validate", postInstall(optionalAuth(ensurePOST(handleConfigValidate))))
 	http.HandleFunc("/control/i18n/change_language", postInstall(optionalAuth(ensurePOST(handleI18nChangeLanguage))))
 	http.HandleFunc("/control/i18n/current_language", postInstall(optionalAuth(ensureGET(handleI18nCurrentLanguage))))
 	http.HandleFunc("/control/stats_top", postInstall(optionalAuth(ensureGET(handleStatsTop))))
 	http.HandleFunc("/control/stats", postInstall(optionalAuth(ensureGET(handleStats))))
 	http.HandleFunc("/control/stats_history", postInstall(optionalAuth(ensureGET(handleStatsHistory))))
 	http.HandleFunc("/control/stats_reset", postInstall(optionalAuth(ensurePOST(handleStatsReset))))
+	http.HandleFunc("/control/querylog_clear", postInstall(optionalAuth(ensurePOST(handleQueryLogClear))))
+	http.HandleFunc("/control/stats_top_report", postInstall(optionalAuth(ensureGET(handleStatsTopReport))))
+	http.HandleFunc("/control/stats/client", postInstall(optionalAuth(ensureGET(handleStatsClient))))
+	http.HandleFunc("/control/stats_info", postInstall(optionalAuth(ensureGET(handleStatsInfo))))
+	http.HandleFunc("/control/stats_config", postInstall(optionalAuth(ensurePOST(handleStatsConfig))))
+	http.HandleFunc("/control/stats_reset_selected", postInstall(optionalAuth(ensurePOST(handleStatsResetSelected))))
+	http.HandleFunc("/control/stats_chatty", postInstall(optionalAuth(ensureGET(handleStatsChatty))))
 	http.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
 	http.HandleFunc("/control/update", postInstall(optionalAuth(ensurePOST(handleUpdate))))
+	http.HandleFunc("/control/update_check", postInstall(optionalAuth(ensureGET(handleUpdateCheck))))
+	http.HandleFunc("/control/update_now", postInstall(optionalAuth(ensurePOST(handleUpdate))))
+	http.HandleFunc("/control/update_report", postInstall(optionalAuth(ensureGET(handleUpdateReport))))
 	http.HandleFunc("/control/filtering/enable", postInstall(optionalAuth(ensurePOST(handleFilteringEnable))))
 	http.HandleFunc("/control/filtering/disable", postInstall(optionalAuth(ensurePOST(handleFilteringDisable))))
 	http.HandleFunc("/control/filtering/add_url", postInstall(optionalAuth(ensurePOST(handleFilteringAddURL))))
@@ -976,12 +1895,18 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/filtering/refresh", postInstall(optionalAuth(ensurePOST(handleFilteringRefresh))))
 	http.HandleFunc("/control/filtering/status", postInstall(optionalAuth(ensureGET(handleFilteringStatus))))
 	http.HandleFunc("/control/filtering/set_rules", postInstall(optionalAuth(ensurePOST(handleFilteringSetRules))))
+	http.HandleFunc("/control/filtering/set_trusted", postInstall(optionalAuth(ensurePOST(handleFilteringSetTrusted))))
+	http.HandleFunc("/control/filtering/refresh_status", postInstall(optionalAuth(ensureGET(handleFilteringRefreshStatus))))
+	http.HandleFunc("/control/filtering/rule_stats", postInstall(optionalAuth(ensureGET(handleFilteringRuleStats))))
+	http.HandleFunc("/control/filtering/diff", postInstall(optionalAuth(ensureGET(handleFilteringDiff))))
+	http.HandleFunc("/control/filtering/temp_rule", postInstall(optionalAuth(ensurePOST(handleFilteringTempRule))))
 	http.HandleFunc("/control/safebrowsing/enable", postInstall(optionalAuth(ensurePOST(handleSafeBrowsingEnable))))
 	http.HandleFunc("/control/safebrowsing/disable", postInstall(optionalAuth(ensurePOST(handleSafeBrowsingDisable))))
 	http.HandleFunc("/control/safebrowsing/status", postInstall(optionalAuth(ensureGET(handleSafeBrowsingStatus))))
 	http.HandleFunc("/control/parental/enable", postInstall(optionalAuth(ensurePOST(handleParentalEnable))))
 	http.HandleFunc("/control/parental/disable", postInstall(optionalAuth(ensurePOST(handleParentalDisable))))
 	http.HandleFunc("/control/parental/status", postInstall(optionalAuth(ensureGET(handleParentalStatus))))
+	http.HandleFunc("/control/parental/categories", postInstall(optionalAuth(ensurePOST(handleParentalCategories))))
 	http.HandleFunc("/control/safesearch/enable", postInstall(optionalAuth(ensurePOST(handleSafeSearchEnable))))
 	http.HandleFunc("/control/safesearch/disable", postInstall(optionalAuth(ensurePOST(handleSafeSearchDisable))))
 	http.HandleFunc("/control/safesearch/status", postInstall(optionalAuth(ensureGET(handleSafeSearchStatus))))
@@ -991,12 +1916,27 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/dhcp/find_active_dhcp", postInstall(optionalAuth(ensurePOST(handleDHCPFindActiveServer))))
 	http.HandleFunc("/control/dhcp/add_static_lease", postInstall(optionalAuth(ensurePOST(handleDHCPAddStaticLease))))
 	http.HandleFunc("/control/dhcp/remove_static_lease", postInstall(optionalAuth(ensurePOST(handleDHCPRemoveStaticLease))))
+	http.HandleFunc("/control/dhcp/import_static_leases", postInstall(optionalAuth(ensurePOST(handleDHCPImportStaticLeases))))
 
 	http.HandleFunc("/control/access/list", postInstall(optionalAuth(ensureGET(handleAccessList))))
 	http.HandleFunc("/control/access/set", postInstall(optionalAuth(ensurePOST(handleAccessSet))))
 
 	RegisterTLSHandlers()
 	RegisterClientsHandlers()
-
-	http.HandleFunc("/dns-query", postInstall(handleDOH))
+	RegisterBlockedServicesHandlers()
+	registerRewritesHandlers()
+	registerPortalHandlers()
+	registerRemoteRulesHandlers()
+	registerListenersHandlers()
+	registerListenHandlers()
+	registerAuthHandlers()
+	registerAuditHandlers()
+	registerBackupHandlers()
+	registerSyncHandlers()
+	registerHAHandlers()
+	registerDNSConfigHandlers()
+	registerLogHandlers()
+
+	http.HandleFunc(dnsforward.DOHPath, postInstall(handleDOH))
+	http.HandleFunc(dnsforward.DOHPath+"/", postInstall(handleDOH))
 }
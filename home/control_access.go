@@ -5,7 +5,7 @@ import (
 	"net"
 	"net/http"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 )
 
 type accessListJSON struct {
@@ -17,13 +17,13 @@ type accessListJSON struct {
 func handleAccessList(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
 
-	controlLock.Lock()
+	config.RLock()
 	j := accessListJSON{
 		AllowedClients:    config.DNS.AllowedClients,
 		DisallowedClients: config.DNS.DisallowedClients,
 		BlockedHosts:      config.DNS.BlockedHosts,
 	}
-	controlLock.Unlock()
+	config.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(j)
@@ -33,7 +33,8 @@ func handleAccessList(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func checkIPCIDRArray(src []string) error {
+// Check that every element is an IP address or a CIDR
+func checkIPCIDRList(src []string) error {
 	for _, s := range src {
 		ip := net.ParseIP(s)
 		if ip != nil {
@@ -49,6 +50,21 @@ func checkIPCIDRArray(src []string) error {
 	return nil
 }
 
+// Check that every element is an IP address, a CIDR or a client ID
+func checkIPCIDRArray(src []string) error {
+	for _, s := range src {
+		if dnsforward.IsValidClientID(s) {
+			continue
+		}
+		err := checkIPCIDRList([]string{s})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
 
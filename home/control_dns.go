@@ -0,0 +1,280 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+	"github.com/miekg/dns"
+)
+
+type dnsConfigJSON struct {
+	ProtectionEnabled  *bool     `json:"protection_enabled,omitempty"`
+	RateLimit          *int      `json:"ratelimit,omitempty"`
+	BlockingMode       *string   `json:"blocking_mode,omitempty"`
+	BlockingIPv4       *string   `json:"blocking_ipv4,omitempty"`
+	BlockingIPv6       *string   `json:"blocking_ipv6,omitempty"`
+	UpstreamMode       *string   `json:"upstream_mode,omitempty"`
+	DNSSECValidation   *bool     `json:"dnssec_validation,omitempty"`
+	CacheSize          *int      `json:"cache_size,omitempty"`
+	CacheMinTTL        *uint32   `json:"cache_ttl_min,omitempty"`
+	CacheMaxTTL        *uint32   `json:"cache_ttl_max,omitempty"`
+	CacheOptimistic    *bool     `json:"cache_optimistic,omitempty"`
+	EDNSCSMode         *string   `json:"edns_cs_mode,omitempty"`
+	EDNSCSPrefixV4     *uint8    `json:"edns_cs_prefix_v4,omitempty"`
+	EDNSCSPrefixV6     *uint8    `json:"edns_cs_prefix_v6,omitempty"`
+	RatelimitWhitelist *[]string `json:"ratelimit_whitelist,omitempty"`
+	RefuseAny          *bool     `json:"refuse_any,omitempty"`
+	UDPMaxResponseSize *uint16   `json:"udp_max_response_size,omitempty"`
+	BogusNXDomain      *[]string `json:"bogus_nxdomain,omitempty"`
+	AAAADisabled       *bool     `json:"aaaa_disabled,omitempty"`
+	HTTPSRemoveECH     *bool     `json:"https_remove_ech,omitempty"`
+	DNS64Enabled       *bool     `json:"dns64_enabled,omitempty"`
+	DNS64Prefix        *string   `json:"dns64_prefix,omitempty"`
+}
+
+// Upstream modes
+const (
+	upstreamModeLoadBalance = ""             // query the fastest upstream server
+	upstreamModeParallel    = "parallel"     // query all upstream servers, use the first answer
+	upstreamModeFastestAddr = "fastest_addr" // respond with the fastest of the IP addresses
+)
+
+// Get the upstream mode
+// Must be called with the configuration lock held
+func getUpstreamMode() string {
+	if config.DNS.FastestAddr {
+		return upstreamModeFastestAddr
+	} else if config.DNS.AllServers {
+		return upstreamModeParallel
+	}
+	return upstreamModeLoadBalance
+}
+
+func handleGetDNSConfig(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	mode := getUpstreamMode()
+	j := dnsConfigJSON{
+		ProtectionEnabled:  &config.DNS.ProtectionEnabled,
+		RateLimit:          &config.DNS.Ratelimit,
+		BlockingMode:       &config.DNS.BlockingMode,
+		BlockingIPv4:       &config.DNS.BlockingIPv4,
+		BlockingIPv6:       &config.DNS.BlockingIPv6,
+		UpstreamMode:       &mode,
+		DNSSECValidation:   &config.DNS.DNSSECValidation,
+		CacheSize:          &config.DNS.CacheSize,
+		CacheMinTTL:        &config.DNS.CacheMinTTL,
+		CacheMaxTTL:        &config.DNS.CacheMaxTTL,
+		CacheOptimistic:    &config.DNS.CacheOptimistic,
+		EDNSCSMode:         &config.DNS.EDNSCSMode,
+		EDNSCSPrefixV4:     &config.DNS.EDNSCSPrefixV4,
+		EDNSCSPrefixV6:     &config.DNS.EDNSCSPrefixV6,
+		RatelimitWhitelist: &config.DNS.RatelimitWhitelist,
+		RefuseAny:          &config.DNS.RefuseAny,
+		UDPMaxResponseSize: &config.DNS.UDPMaxResponseSize,
+		BogusNXDomain:      &config.DNS.BogusNXDomain,
+		AAAADisabled:       &config.DNS.AAAADisabled,
+		HTTPSRemoveECH:     &config.DNS.HTTPSRemoveECH,
+		DNS64Enabled:       &config.DNS.DNS64Enabled,
+		DNS64Prefix:        &config.DNS.DNS64Prefix,
+	}
+	data, err := json.Marshal(j)
+	config.RUnlock()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+	}
+}
+
+func handleSetDNSConfig(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	j := dnsConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	config.RLock()
+	mode := config.DNS.BlockingMode
+	ipv4 := config.DNS.BlockingIPv4
+	ipv6 := config.DNS.BlockingIPv6
+	minTTL := config.DNS.CacheMinTTL
+	maxTTL := config.DNS.CacheMaxTTL
+	ecsMode := config.DNS.EDNSCSMode
+	ecsPrefixV4 := config.DNS.EDNSCSPrefixV4
+	ecsPrefixV6 := config.DNS.EDNSCSPrefixV6
+	config.RUnlock()
+
+	if j.BlockingMode != nil {
+		mode = *j.BlockingMode
+	}
+	if j.BlockingIPv4 != nil {
+		ipv4 = *j.BlockingIPv4
+	}
+	if j.BlockingIPv6 != nil {
+		ipv6 = *j.BlockingIPv6
+	}
+	err = dnsforward.CheckBlockingMode(mode, ipv4, ipv6)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if j.RateLimit != nil && *j.RateLimit < 0 {
+		httpError(w, http.StatusBadRequest, "ratelimit must be a non-negative number")
+		return
+	}
+
+	if j.RatelimitWhitelist != nil {
+		for _, ip := range *j.RatelimitWhitelist {
+			if net.ParseIP(ip) == nil {
+				httpError(w, http.StatusBadRequest, "ratelimit_whitelist: %s is not a valid IP address", ip)
+				return
+			}
+		}
+	}
+
+	if j.UDPMaxResponseSize != nil && *j.UDPMaxResponseSize != 0 && *j.UDPMaxResponseSize < dns.MinMsgSize {
+		httpError(w, http.StatusBadRequest, "udp_max_response_size must be 0 or at least %d", dns.MinMsgSize)
+		return
+	}
+
+	if j.BogusNXDomain != nil {
+		err = checkIPCIDRList(*j.BogusNXDomain)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "bogus_nxdomain: %s", err)
+			return
+		}
+	}
+
+	if j.DNS64Prefix != nil {
+		err = dnsforward.CheckDNS64Prefix(*j.DNS64Prefix)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "dns64_prefix: %s", err)
+			return
+		}
+	}
+
+	if j.CacheSize != nil && *j.CacheSize < 0 {
+		httpError(w, http.StatusBadRequest, "cache_size must be a non-negative number")
+		return
+	}
+	if j.CacheMinTTL != nil {
+		minTTL = *j.CacheMinTTL
+	}
+	if j.CacheMaxTTL != nil {
+		maxTTL = *j.CacheMaxTTL
+	}
+	if minTTL != 0 && maxTTL != 0 && minTTL > maxTTL {
+		httpError(w, http.StatusBadRequest, "cache_ttl_min must be less than or equal to cache_ttl_max")
+		return
+	}
+
+	if j.EDNSCSMode != nil {
+		ecsMode = *j.EDNSCSMode
+	}
+	if j.EDNSCSPrefixV4 != nil {
+		ecsPrefixV4 = *j.EDNSCSPrefixV4
+	}
+	if j.EDNSCSPrefixV6 != nil {
+		ecsPrefixV6 = *j.EDNSCSPrefixV6
+	}
+	err = dnsforward.CheckECSMode(ecsMode, ecsPrefixV4, ecsPrefixV6)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	if j.UpstreamMode != nil {
+		switch *j.UpstreamMode {
+		case upstreamModeLoadBalance, upstreamModeParallel, upstreamModeFastestAddr:
+		default:
+			httpError(w, http.StatusBadRequest, "unknown upstream mode: %s", *j.UpstreamMode)
+			return
+		}
+	}
+
+	config.Lock()
+	if j.ProtectionEnabled != nil {
+		config.DNS.ProtectionEnabled = *j.ProtectionEnabled
+	}
+	if j.RateLimit != nil {
+		config.DNS.Ratelimit = *j.RateLimit
+	}
+	config.DNS.BlockingMode = mode
+	config.DNS.BlockingIPv4 = ipv4
+	config.DNS.BlockingIPv6 = ipv6
+	if j.UpstreamMode != nil {
+		config.DNS.AllServers = *j.UpstreamMode == upstreamModeParallel
+		config.DNS.FastestAddr = *j.UpstreamMode == upstreamModeFastestAddr
+	}
+	if j.DNSSECValidation != nil {
+		config.DNS.DNSSECValidation = *j.DNSSECValidation
+	}
+	if j.CacheSize != nil {
+		config.DNS.CacheSize = *j.CacheSize
+	}
+	if j.RatelimitWhitelist != nil {
+		config.DNS.RatelimitWhitelist = *j.RatelimitWhitelist
+	}
+	if j.RefuseAny != nil {
+		config.DNS.RefuseAny = *j.RefuseAny
+	}
+	if j.UDPMaxResponseSize != nil {
+		config.DNS.UDPMaxResponseSize = *j.UDPMaxResponseSize
+	}
+	if j.BogusNXDomain != nil {
+		config.DNS.BogusNXDomain = *j.BogusNXDomain
+	}
+	if j.AAAADisabled != nil {
+		config.DNS.AAAADisabled = *j.AAAADisabled
+	}
+	if j.HTTPSRemoveECH != nil {
+		config.DNS.HTTPSRemoveECH = *j.HTTPSRemoveECH
+	}
+	if j.DNS64Enabled != nil {
+		config.DNS.DNS64Enabled = *j.DNS64Enabled
+	}
+	if j.DNS64Prefix != nil {
+		config.DNS.DNS64Prefix = *j.DNS64Prefix
+	}
+	if j.CacheOptimistic != nil {
+		config.DNS.CacheOptimistic = *j.CacheOptimistic
+	}
+	config.DNS.CacheMinTTL = minTTL
+	config.DNS.EDNSCSMode = ecsMode
+	config.DNS.EDNSCSPrefixV4 = ecsPrefixV4
+	config.DNS.EDNSCSPrefixV6 = ecsPrefixV6
+	config.DNS.CacheMaxTTL = maxTTL
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleCacheClear removes all responses from the DNS cache
+func handleCacheClear(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	dnsServer.ClearCache()
+	_, err := fmt.Fprintf(w, "OK\n")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+	}
+}
+
+func registerDNSConfigHandlers() {
+	http.HandleFunc("/control/dns_info", postInstall(optionalAuth(ensureGET(handleGetDNSConfig))))
+	http.HandleFunc("/control/dns_config", postInstall(optionalAuth(ensurePOST(handleSetDNSConfig))))
+	http.HandleFunc("/control/cache_clear", postInstall(optionalAuth(ensurePOST(handleCacheClear))))
+}
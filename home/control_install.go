@@ -8,8 +8,6 @@ import (
 	"net/http"
 	"os/exec"
 	"strconv"
-
-	"github.com/AdguardTeam/golibs/log"
 )
 
 type firstRunData struct {
@@ -184,8 +182,7 @@ func copyInstallSettings(dst *configuration, src *configuration) {
 	dst.BindPort = src.BindPort
 	dst.DNS.BindHost = src.DNS.BindHost
 	dst.DNS.Port = src.DNS.Port
-	dst.AuthName = src.AuthName
-	dst.AuthPass = src.AuthPass
+	dst.Users = src.Users
 }
 
 // Apply new configuration, start DNS server, restart Web server
@@ -203,6 +200,11 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(newSettings.Username) != 0 && len(newSettings.Password) == 0 {
+		httpError(w, http.StatusBadRequest, "password is required")
+		return
+	}
+
 	restartHTTP := true
 	if config.BindHost == newSettings.Web.IP && config.BindPort == newSettings.Web.Port {
 		// no need to rebind
@@ -231,6 +233,16 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var users []webUser
+	if len(newSettings.Username) != 0 {
+		hash, err := hashPassword(newSettings.Password)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		users = []webUser{{Name: newSettings.Username, PasswordHash: hash}}
+	}
+
 	var curConfig configuration
 	copyInstallSettings(&curConfig, &config)
 
@@ -239,8 +251,7 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 	config.BindPort = newSettings.Web.Port
 	config.DNS.BindHost = newSettings.DNS.IP
 	config.DNS.Port = newSettings.DNS.Port
-	config.AuthName = newSettings.Username
-	config.AuthPass = newSettings.Password
+	config.Users = users
 
 	err = startDNSServer()
 	if err != nil {
@@ -258,7 +269,7 @@ func handleInstallConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go refreshFiltersIfNecessary(false)
+	go filtering.refreshFiltersIfNecessary(false)
 
 	// this needs to be done in a goroutine because Shutdown() is a blocking call, and it will block
 	// until all requests are finished, and _we_ are inside a request right now, so it will block indefinitely
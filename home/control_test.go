@@ -3,6 +3,8 @@ package home
 import (
 	"testing"
 	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 )
 
 /* Tests performed:
@@ -82,11 +84,20 @@ func TestValidateUpstream(t *testing.T) {
 		"htttps://google.com/dns-query",
 		"[/host.com]tls://dns.adguard.com",
 		"[host.ru]#",
+		"tls://",
+		"https:///dns-query",
+		"tls://dns.adguard.com:99999",
+		"https://dns..adguard.com/dns-query",
+		"quic://dns..adguard.com",
 	}
 
 	validDefaultUpstreams := []string{"1.1.1.1",
 		"tls://1.1.1.1",
 		"https://dns.adguard.com/dns-query",
+		"https://1.1.1.1:443/dns-query",
+		"tls://dns.adguard.com:853",
+		"tcp://1.1.1.1",
+		"quic://dns.adguard.com:784",
 		"sdns://AQMAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
 	}
 
@@ -151,3 +162,19 @@ func TestValidateUpstreamsSet(t *testing.T) {
 		t.Fatalf("there is an invalid upstream in set, but it pass through validation")
 	}
 }
+
+func TestValidateCommonUpstreams(t *testing.T) {
+	if err := validateCommonUpstreams([]string{"9.9.9.9", "tls://dns.quad9.net"}); err != nil {
+		t.Fatalf("validateCommonUpstreams: %s", err)
+	}
+	if validateCommonUpstreams([]string{"[/host.com/]1.1.1.1"}) == nil {
+		t.Fatalf("domain-specific upstream must not be allowed")
+	}
+	if validateCommonUpstreams([]string{"dhcp://fake.dns"}) == nil {
+		t.Fatalf("invalid upstream must not be allowed")
+	}
+
+	if upstreamTimeout(0) != dnsforward.DefaultTimeout || upstreamTimeout(3) != 3*time.Second {
+		t.Fatalf("upstreamTimeout")
+	}
+}
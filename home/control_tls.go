@@ -15,11 +15,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"reflect"
 	"strings"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/AdGuardHome/acme"
 	"github.com/joomcode/errorx"
 )
 
@@ -28,6 +27,13 @@ func RegisterTLSHandlers() {
 	http.HandleFunc("/control/tls/status", postInstall(optionalAuth(ensureGET(handleTLSStatus))))
 	http.HandleFunc("/control/tls/configure", postInstall(optionalAuth(ensurePOST(handleTLSConfigure))))
 	http.HandleFunc("/control/tls/validate", postInstall(optionalAuth(ensurePOST(handleTLSValidate))))
+	http.HandleFunc("/control/tls/local_ca/issue", postInstall(optionalAuth(ensurePOST(handleTLSLocalCAIssue))))
+	http.HandleFunc("/control/tls/local_ca/cert", postInstall(optionalAuth(ensureGET(handleTLSLocalCACert))))
+	http.HandleFunc("/control/tls/acme/status", postInstall(optionalAuth(ensureGET(handleACMEStatus))))
+	http.HandleFunc("/control/tls/acme/renew", postInstall(optionalAuth(ensurePOST(handleACMERenew))))
+
+	// the certificate authority must be able to get HTTP-01 challenge responses without authentication
+	http.Handle(acme.HTTP01Path, acmeCtx.httpSolver)
 }
 
 func handleTLSStatus(w http.ResponseWriter, r *http.Request) {
@@ -57,7 +63,11 @@ func handleTLSValidate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	fileErr := loadTLSFiles(&data.tlsConfigSettings)
 	data.tlsConfigStatus = validateCertificates(data.CertificateChain, data.PrivateKey, data.ServerName)
+	if fileErr != nil {
+		data.WarningValidation = fileErr.Error()
+	}
 	marshalTLS(w, data)
 }
 
@@ -83,14 +93,37 @@ func handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	err = loadTLSFiles(&data.tlsConfigSettings)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
 	restartHTTPS := false
 	data.tlsConfigStatus = validateCertificates(data.CertificateChain, data.PrivateKey, data.ServerName)
-	if !reflect.DeepEqual(config.TLS.tlsConfigSettings, data.tlsConfigSettings) {
+	if tlsSettingsChanged(config.TLS.tlsConfigSettings, data.tlsConfigSettings) ||
+		tlsCertificateSet(config.TLS.tlsConfigSettings) != tlsCertificateSet(data.tlsConfigSettings) {
 		log.Printf("tls config settings have changed, will restart HTTPS server")
 		restartHTTPS = true
 	}
+	if data.ValidPair {
+		// if only the certificate has changed, the running listeners use the new one right away
+		err = setTLSCertificate(data.CertificateChain, data.PrivateKey)
+		if err != nil {
+			log.Error("TLS: %s", err)
+		}
+	}
 	config.TLS = data
-	err = writeAllConfigsAndReloadDNS()
+	config.pendingTLS = nil
+	certMod, keyMod := tlsFilesModTime(data.tlsConfigSettings)
+	tlsCert.lock.Lock()
+	tlsCert.certMod, tlsCert.keyMod = certMod, keyMod
+	tlsCert.lock.Unlock()
+	if restartHTTPS {
+		err = writeAllConfigsAndReloadDNS()
+	} else {
+		err = writeAllConfigs()
+	}
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
 		return
@@ -156,6 +189,13 @@ func verifyCertChain(data *tlsConfigStatus, certChain string, serverName string)
 		DNSName: serverName,
 	}
 
+	mainCert := parsedCerts[0]
+	clockValid := clockIsValid(time.Now())
+	if !clockValid {
+		// we can't check the validity period, but we can still check the chain
+		opts.CurrentTime = mainCert.NotBefore
+	}
+
 	log.Printf("number of certs - %d", len(parsedCerts))
 	if len(parsedCerts) > 1 {
 		// set up an intermediate
@@ -168,13 +208,16 @@ func verifyCertChain(data *tlsConfigStatus, certChain string, serverName string)
 	}
 
 	// TODO: save it as a warning rather than error it out -- shouldn't be a big problem
-	mainCert := parsedCerts[0]
 	_, err := mainCert.Verify(opts)
 	if err != nil {
 		// let self-signed certs through
 		data.WarningValidation = fmt.Sprintf("Your certificate does not verify: %s", err)
 	} else {
 		data.ValidChain = true
+		if !clockValid {
+			data.WarningValidation = fmt.Sprintf("System clock is not set, the certificate validity period can't be checked: %s",
+				time.Now().Format(time.RFC3339))
+		}
 	}
 	// spew.Dump(chains)
 
@@ -296,11 +339,16 @@ func unmarshalTLS(r *http.Request) (tlsConfig, error) {
 	if err != nil {
 		return data, errorx.Decorate(err, "Failed to parse new TLS config json")
 	}
+	err = decodeTLSPEM(&data)
+	return data, err
+}
 
+// Decode the certificate chain and the private key sent as base64
+func decodeTLSPEM(data *tlsConfig) error {
 	if data.CertificateChain != "" {
 		certPEM, err := base64.StdEncoding.DecodeString(data.CertificateChain)
 		if err != nil {
-			return data, errorx.Decorate(err, "Failed to base64-decode certificate chain")
+			return errorx.Decorate(err, "Failed to base64-decode certificate chain")
 		}
 		data.CertificateChain = string(certPEM)
 	}
@@ -308,13 +356,13 @@ func unmarshalTLS(r *http.Request) (tlsConfig, error) {
 	if data.PrivateKey != "" {
 		keyPEM, err := base64.StdEncoding.DecodeString(data.PrivateKey)
 		if err != nil {
-			return data, errorx.Decorate(err, "Failed to base64-decode private key")
+			return errorx.Decorate(err, "Failed to base64-decode private key")
 		}
 
 		data.PrivateKey = string(keyPEM)
 	}
 
-	return data, nil
+	return nil
 }
 
 func marshalTLS(w http.ResponseWriter, data tlsConfig) {
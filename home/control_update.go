@@ -16,8 +16,6 @@ import (
 	"strings"
 	"syscall"
 	"time"
-
-	"github.com/AdguardTeam/golibs/log"
 )
 
 // Convert version.json data to our JSON response
@@ -42,8 +40,11 @@ func getVersionResp(data []byte) []byte {
 		return []byte{}
 	}
 
+	// the packages can't be verified without the key
 	_, ok := versionJSON[fmt.Sprintf("download_%s_%s", runtime.GOOS, runtime.GOARCH)]
-	if ok && ret["new_version"] != VersionString && VersionString >= selfUpdateMinVersion {
+	newVersion, _ := ret["new_version"].(string)
+	minVersion, err := compareVersions(VersionString, selfUpdateMinVersion)
+	if ok && checkNewerVersion(newVersion) == nil && err == nil && minVersion >= 0 && len(updatePublicKey) != 0 {
 		ret["can_autoupdate"] = true
 	}
 
@@ -60,40 +61,13 @@ func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	now := time.Now()
-	controlLock.Lock()
-	cached := now.Sub(versionCheckLastTime) <= versionCheckPeriod && len(versionCheckJSON) != 0
-	data := versionCheckJSON
-	controlLock.Unlock()
-
-	if cached {
-		// return cached copy
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(getVersionResp(data))
-		return
-	}
-
-	resp, err := client.Get(versionCheckURL)
-	if err != nil {
-		httpError(w, http.StatusBadGateway, "Couldn't get version check json from %s: %T %s\n", versionCheckURL, err, err)
-		return
-	}
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
-	}
-
-	// read the body entirely
-	body, err := ioutil.ReadAll(resp.Body)
+	// the cached copy is returned if it's recent
+	body, err := getVersionJSON(currentUpdateChannel(), false)
 	if err != nil {
-		httpError(w, http.StatusBadGateway, "Couldn't read response body from %s: %s", versionCheckURL, err)
+		httpError(w, http.StatusBadGateway, "%s", err)
 		return
 	}
 
-	controlLock.Lock()
-	versionCheckLastTime = now
-	versionCheckJSON = body
-	controlLock.Unlock()
-
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(getVersionResp(body))
 	if err != nil {
@@ -145,8 +119,9 @@ func getUpdateInfo(jsonData []byte) (*updateInfo, error) {
 		return nil, fmt.Errorf("Invalid JSON")
 	}
 
-	if u.newVer == VersionString {
-		return nil, fmt.Errorf("No need to update")
+	err = checkNewerVersion(u.newVer)
+	if err != nil {
+		return nil, fmt.Errorf("No need to update: %s", err)
 	}
 
 	u.updateDir = filepath.Join(workDir, fmt.Sprintf("agh-update-%s", u.newVer))
@@ -333,8 +308,13 @@ func copySupportingFiles(files []string, srcdir, dstdir string, useSrcNameOnly,
 	return nil
 }
 
-// Download package file and save it to disk
+// Download package file, verify its signature and save it to disk
 func getPackageFile(u *updateInfo) error {
+	sig, err := getPackageSignature(u.pkgURL)
+	if err != nil {
+		return err
+	}
+
 	resp, err := client.Get(u.pkgURL)
 	if err != nil {
 		return fmt.Errorf("HTTP request failed: %s", err)
@@ -348,6 +328,10 @@ func getPackageFile(u *updateInfo) error {
 	if err != nil {
 		return fmt.Errorf("ioutil.ReadAll() failed: %s", err)
 	}
+	err = verifyUpdateSignature(u.newVer, body, sig)
+	if err != nil {
+		return err
+	}
 
 	log.Tracef("Saving package to file")
 	err = ioutil.WriteFile(u.pkgName, body, 0644)
@@ -419,21 +403,29 @@ func doUpdate(u *updateInfo) error {
 			u.updateDir, config.ourWorkingDir, err)
 	}
 
-	log.Tracef("Renaming: %s -> %s", u.curBinName, u.bkpBinName)
-	err = os.Rename(u.curBinName, u.bkpBinName)
+	log.Tracef("Copying: %s -> %s", u.curBinName, u.bkpBinName)
+	err = replaceFile(u.curBinName, u.bkpBinName, 0755)
 	if err != nil {
 		return err
 	}
-	if runtime.GOOS == "windows" {
-		// rename fails with "File in use" error
-		err = copyFile(u.newBinName, u.curBinName)
-	} else {
-		err = os.Rename(u.newBinName, u.curBinName)
+
+	// if the new version fails to start, this one is restored
+	err = writeUpdateState(updateState{
+		Version:    u.newVer,
+		PrevBinary: u.bkpBinName,
+		PrevConfig: filepath.Join(u.backupDir, "AdGuardHome.yaml"),
+		Binary:     u.curBinName,
+	})
+	if err != nil {
+		return err
 	}
+
+	err = replaceFile(u.newBinName, u.curBinName, 0755)
 	if err != nil {
+		_ = os.Remove(updateStatePath())
 		return err
 	}
-	log.Tracef("Renamed: %s -> %s", u.newBinName, u.curBinName)
+	log.Tracef("Replaced: %s -> %s", u.newBinName, u.curBinName)
 
 	_ = os.Remove(u.pkgName)
 	_ = os.RemoveAll(u.updateDir)
@@ -446,7 +438,11 @@ func finishUpdate(u *updateInfo) {
 	cleanup()
 	stopHTTPServer()
 	cleanupAlways()
+	restartProcess(u.curBinName)
+}
 
+// Start the binary again with the same arguments
+func restartProcess(binName string) {
 	if runtime.GOOS == "windows" {
 
 		if config.runningAsService {
@@ -461,7 +457,7 @@ func finishUpdate(u *updateInfo) {
 			os.Exit(0)
 		}
 
-		cmd := exec.Command(u.curBinName, os.Args[1:]...)
+		cmd := exec.Command(binName, os.Args[1:]...)
 		log.Info("Restarting: %v", cmd.Args)
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
@@ -475,7 +471,7 @@ func finishUpdate(u *updateInfo) {
 	} else {
 
 		log.Info("Restarting: %v", os.Args)
-		err := syscall.Exec(u.curBinName, os.Args, os.Environ())
+		err := syscall.Exec(binName, os.Args, os.Environ())
 		if err != nil {
 			log.Fatalf("syscall.Exec() failed: %s", err)
 		}
@@ -483,21 +479,64 @@ func finishUpdate(u *updateInfo) {
 	}
 }
 
-// Perform an update procedure to the latest available version
+// Perform an update procedure to the latest available version in the channel
+// If the channel is specified, it's selected for the next updates as well.
 func handleUpdate(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("%s %v", r.Method, r.URL)
 
-	if len(versionCheckJSON) == 0 {
-		httpError(w, http.StatusBadRequest, "/update request isn't allowed now")
+	req := struct {
+		ConfirmBreaking bool   `json:"confirm_breaking"`
+		Channel         string `json:"channel"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = validateUpdateChannel(req.Channel)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
 		return
 	}
+	channel := req.Channel
+	if len(channel) == 0 {
+		channel = currentUpdateChannel()
+	}
 
-	u, err := getUpdateInfo(versionCheckJSON)
+	data, err := getVersionJSON(channel, false)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+
+	rep, err := getUpdateReport(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't check the update impact: %s", err)
+		return
+	}
+	if rep.Breaking && !req.ConfirmBreaking {
+		httpError(w, http.StatusPreconditionFailed, "The update has breaking changes: %s. See /control/update_report and confirm the update",
+			strings.Join(rep.Reasons, "; "))
+		return
+	}
+
+	u, err := getUpdateInfo(data)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "%s", err)
 		return
 	}
 
+	if len(req.Channel) != 0 {
+		config.Lock()
+		config.UpdateChannel = req.Channel
+		config.Unlock()
+		err = writeAllConfigs()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+			return
+		}
+	}
+
 	err = doUpdate(u)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "%s", err)
@@ -14,7 +14,6 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/dhcpd"
 	"github.com/AdguardTeam/golibs/file"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 )
 
@@ -94,7 +93,7 @@ func handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if newconfig.Enabled {
+	if newconfig.Enabled && !haStandby() {
 
 		staticIP, err := hasStaticIP(newconfig.InterfaceName)
 		if !staticIP && err == nil {
@@ -113,6 +112,7 @@ func handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	config.DHCP = newconfig.ServerConfig
+	config.pendingDHCP = nil
 	httpUpdateConfigReloadDNSReturnOK(w, r)
 }
 
@@ -439,6 +439,11 @@ func startDHCPServer() error {
 		return errorx.Decorate(err, "Couldn't init DHCP server")
 	}
 
+	if haStandby() {
+		log.Info("DHCP: standby mode, the server is paused until failover")
+		return nil
+	}
+
 	err = dhcpServer.Start()
 	if err != nil {
 		return errorx.Decorate(err, "Couldn't start DHCP server")
@@ -458,3 +463,24 @@ func stopDHCPServer() error {
 
 	return nil
 }
+
+// Get the addresses of the DHCP client with this host name
+func dhcpHostIPs(host string) []net.IP {
+	var ips []net.IP
+	for _, l := range append(dhcpServer.StaticLeases(), dhcpServer.Leases()...) {
+		if strings.EqualFold(l.Hostname, host) {
+			ips = append(ips, l.IP)
+		}
+	}
+	return ips
+}
+
+// Get the host name of the DHCP client with this address
+func dhcpHostName(ip net.IP) string {
+	for _, l := range append(dhcpServer.StaticLeases(), dhcpServer.Leases()...) {
+		if l.IP.Equal(ip) {
+			return l.Hostname
+		}
+	}
+	return ""
+}
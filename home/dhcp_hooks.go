@@ -0,0 +1,148 @@
+// DHCP lease hooks
+// When a DHCP client gets an address, renews it or its lease expires, the event is POSTed to the URL
+// and/or passed to the script, so it can trigger the automations, e.g. an alert about an unknown device.
+// The hooks are set only in the configuration file: the web interface can't make the server run a program.
+//  url: the event is POSTed in JSON: {"event":"assigned","mac":"...","ip":"...","hostname":"...","known":false,...}
+//  script: it's run with the arguments: EVENT MAC IP HOSTNAME KNOWN, e.g. "assigned 00:11:22:33:44:55 192.168.1.10 laptop false"
+// The DHCP server never waits for the hooks: if they don't keep up, the events are dropped.
+
+package home
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+)
+
+const (
+	dhcpHooksQueueSize = 256              // the new events are dropped if the queue is full
+	dhcpHooksTimeout   = 30 * time.Second // for the HTTP request and the script
+)
+
+type dhcpHooksConfig struct {
+	URL    string `yaml:"url"`    // http:// or https:// URL (empty: disabled)
+	Script string `yaml:"script"` // the path to the program (empty: disabled)
+}
+
+type leaseEventJSON struct {
+	Event    string `json:"event"` // assigned, renewed, expired
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Expires  string `json:"expires,omitempty"` // the lease expiration time (empty for the static leases)
+	Known    bool   `json:"known"`             // the device has a static lease or it's a persistent client
+	Time     string `json:"time"`
+}
+
+var dhcpHooksQueue chan leaseEventJSON
+
+// Start processing the lease events if the hooks are configured
+func initDHCPHooks() {
+	if len(config.DHCPHooks.URL) == 0 && len(config.DHCPHooks.Script) == 0 {
+		return
+	}
+	dhcpHooksQueue = make(chan leaseEventJSON, dhcpHooksQueueSize)
+	go dhcpHooksWorker(dhcpHooksQueue)
+	dhcpServer.SetOnLeaseChanged(onLeaseChanged)
+}
+
+// Called by the DHCP server: queue the event
+func onLeaseChanged(event dhcpd.LeaseEvent, l dhcpd.Lease) {
+	ev := leaseEventJSON{
+		Event:    event.String(),
+		MAC:      l.HWAddr.String(),
+		IP:       l.IP.String(),
+		Hostname: l.Hostname,
+		Time:     time.Now().Format(time.RFC3339),
+	}
+	if l.Expiry.Unix() > 1 {
+		ev.Expires = l.Expiry.Format(time.RFC3339)
+	}
+
+	select {
+	case dhcpHooksQueue <- ev:
+	default:
+		log.Debug("DHCP hooks: the queue is full, dropping the event %s for %s", ev.Event, ev.MAC)
+	}
+}
+
+// Return TRUE if the device has a static lease or it's a persistent client
+func isKnownDevice(mac string) bool {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return false
+	}
+	for _, l := range dhcpServer.StaticLeases() {
+		if bytes.Equal(l.HWAddr, hwAddr) {
+			return true
+		}
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+	for _, c := range clients.list {
+		m, err := net.ParseMAC(c.MAC)
+		if err == nil && bytes.Equal(m, hwAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+func dhcpHooksWorker(queue chan leaseEventJSON) {
+	for ev := range queue {
+		ev.Known = isKnownDevice(ev.MAC)
+		log.Debug("DHCP hooks: lease %s: %s %s %s", ev.Event, ev.MAC, ev.IP, ev.Hostname)
+
+		if len(config.DHCPHooks.URL) != 0 {
+			err := postLeaseEvent(config.DHCPHooks.URL, ev)
+			if err != nil {
+				log.Error("DHCP hooks: %s: %s", config.DHCPHooks.URL, err)
+			}
+		}
+		if len(config.DHCPHooks.Script) != 0 {
+			err := runLeaseScript(config.DHCPHooks.Script, ev)
+			if err != nil {
+				log.Error("DHCP hooks: %s: %s", config.DHCPHooks.Script, err)
+			}
+		}
+	}
+}
+
+// POST the event to the URL
+func postLeaseEvent(url string, ev leaseEventJSON) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: dhcpHooksTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run the script with the event
+func runLeaseScript(script string, ev leaseEventJSON) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dhcpHooksTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script, ev.Event, ev.MAC, ev.IP, ev.Hostname, strconv.FormatBool(ev.Known))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDHCPHooks(t *testing.T) {
+	ev := leaseEventJSON{Event: "assigned", MAC: "00:11:22:33:44:55", IP: "192.168.1.10", Hostname: "laptop"}
+
+	var got leaseEventJSON
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+	err := postLeaseEvent(srv.URL, ev)
+	if err != nil || got != ev {
+		t.Fatalf("postLeaseEvent: %s %+v", err, got)
+	}
+
+	srv404 := httptest.NewServer(http.NotFoundHandler())
+	defer srv404.Close()
+	if postLeaseEvent(srv404.URL, ev) == nil {
+		t.Fatalf("postLeaseEvent: no error for HTTP 404")
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	dir, err := ioutil.TempDir("", "dhcp_hooks")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "hook.sh")
+	out := filepath.Join(dir, "out")
+	_ = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0755)
+
+	err = runLeaseScript(script, ev)
+	data, _ := ioutil.ReadFile(out)
+	if err != nil || strings.TrimSpace(string(data)) != "assigned 00:11:22:33:44:55 192.168.1.10 laptop false" {
+		t.Fatalf("runLeaseScript: %s %s", err, data)
+	}
+	if runLeaseScript(filepath.Join(dir, "none"), ev) == nil {
+		t.Fatalf("runLeaseScript: no error for a missing script")
+	}
+}
@@ -0,0 +1,342 @@
+// Import static DHCP leases from the router configuration
+// Makes it easy to move the reservations from dnsmasq ("dhcp-host=" lines), OpenWrt (/etc/config/dhcp)
+// or a spreadsheet (CSV: MAC address, IP address, host name).
+
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+)
+
+const maxLeasesImportSize = 1024 * 1024
+
+// The formats of the imported file
+const (
+	leasesFormatDnsmasq = "dnsmasq"
+	leasesFormatOpenWrt = "openwrt"
+	leasesFormatCSV     = "csv"
+)
+
+type leasesImportJSON struct {
+	Format    string   `json:"format"` // the format of the file, it's detected if it isn't set in the request
+	Added     int      `json:"added"`
+	Duplicate int      `json:"duplicate"` // leases which already exist
+	Errors    []string `json:"errors"`    // lines which couldn't be parsed, leases which couldn't be added
+}
+
+// A lease parsed from the file
+type leaseEntry struct {
+	line  int
+	lease dhcpd.Lease
+}
+
+// Detect the format of the file
+func detectLeasesFormat(data string) string {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "dhcp-host="):
+			return leasesFormatDnsmasq
+		case strings.HasPrefix(line, "config "):
+			return leasesFormatOpenWrt
+		}
+	}
+	return leasesFormatCSV
+}
+
+// Create the lease from the text values
+func newLeaseEntry(line int, mac, ip, hostname string) (leaseEntry, error) {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil || len(hwAddr) != 6 {
+		return leaseEntry{}, fmt.Errorf("line %d: invalid MAC address: %s", line, mac)
+	}
+	ip4 := parseIPv4(ip)
+	if ip4 == nil {
+		return leaseEntry{}, fmt.Errorf("line %d: invalid IPv4 address: %s", line, ip)
+	}
+	return leaseEntry{
+		line:  line,
+		lease: dhcpd.Lease{HWAddr: hwAddr, IP: ip4, Hostname: hostname},
+	}, nil
+}
+
+// Parse dnsmasq "dhcp-host=" lines
+// The values may be in any order: "dhcp-host=00:11:22:33:44:55,set:kids,192.168.1.10,laptop,infinite"
+// The lines without MAC and IPv4 address (e.g. with client ID only) are skipped.
+func parseDnsmasqLeases(data string) ([]leaseEntry, []string) {
+	entries := []leaseEntry{}
+	errs := []string{}
+	for i, line := range strings.Split(data, "\n") {
+		pos := strings.IndexByte(line, '#')
+		if pos >= 0 {
+			line = line[:pos]
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "dhcp-host=") {
+			continue
+		}
+
+		mac, ip, hostname := "", "", ""
+		ignore := false
+		for _, val := range strings.Split(strings.TrimPrefix(line, "dhcp-host="), ",") {
+			val = strings.TrimSpace(val)
+			switch {
+			case val == "ignore":
+				ignore = true
+			case strings.Contains(val, ":") && strings.ContainsAny(val, "[]"):
+				// IPv6 address
+			case strings.HasPrefix(val, "set:") || strings.HasPrefix(val, "tag:") || strings.HasPrefix(val, "id:"):
+				// tags and client IDs
+			case isDnsmasqLeaseTime(val):
+			case len(mac) == 0 && isMAC(val):
+				mac = val
+			case isMAC(val):
+				// the other MAC addresses of the same device
+			case len(ip) == 0 && len(strings.Trim(val, "0123456789.")) == 0:
+				ip = val // it's checked later so that the invalid address is reported
+			case len(hostname) == 0:
+				hostname = val
+			}
+		}
+		if ignore || len(mac) == 0 || len(ip) == 0 {
+			continue
+		}
+
+		e, err := newLeaseEntry(i+1, mac, ip, hostname)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, errs
+}
+
+// Return TRUE if the value is a valid MAC address
+func isMAC(val string) bool {
+	_, err := net.ParseMAC(val)
+	return err == nil
+}
+
+// Return TRUE if the value is dnsmasq lease time: "infinite", "3600", "45m", "12h"
+func isDnsmasqLeaseTime(val string) bool {
+	if val == "infinite" {
+		return true
+	}
+	val = strings.TrimRight(val, "smhdw")
+	if len(val) == 0 {
+		return false
+	}
+	for _, c := range val {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse OpenWrt /etc/config/dhcp: "config host" sections with "option mac", "option ip", "option name"
+func parseOpenWrtLeases(data string) ([]leaseEntry, []string) {
+	entries := []leaseEntry{}
+	errs := []string{}
+
+	inHost := false
+	line := 0
+	mac, ip, hostname := "", "", ""
+	endSection := func() {
+		if !inHost {
+			return
+		}
+		inHost = false
+		if len(mac) == 0 && len(ip) == 0 {
+			return
+		}
+		e, err := newLeaseEntry(line, mac, ip, hostname)
+		if err != nil {
+			errs = append(errs, err.Error())
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	for i, ln := range strings.Split(data, "\n") {
+		fields := strings.Fields(ln)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "config" {
+			endSection()
+			inHost = len(fields) >= 2 && fields[1] == "host"
+			line = i + 1
+			mac, ip, hostname = "", "", ""
+			continue
+		}
+		if !inHost || len(fields) < 3 || (fields[0] != "option" && fields[0] != "list") {
+			continue
+		}
+
+		// the value is quoted, a device may have several MAC addresses
+		val := strings.Trim(strings.Join(fields[2:], " "), `'"`)
+		switch fields[1] {
+		case "mac":
+			if len(mac) == 0 {
+				mac = strings.Fields(val + " ")[0]
+			}
+		case "ip":
+			ip = val
+		case "name":
+			hostname = val
+		}
+	}
+	endSection()
+	return entries, errs
+}
+
+// Parse CSV: MAC address, IP address and the optional host name
+// The values may be quoted, the header line is skipped.
+func parseCSVLeases(data string) ([]leaseEntry, []string) {
+	entries := []leaseEntry{}
+	errs := []string{}
+	header := true
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		rec := strings.FieldsFunc(line, func(c rune) bool { return c == ',' || c == ';' })
+		for j := range rec {
+			rec[j] = strings.Trim(strings.TrimSpace(rec[j]), `"`)
+		}
+		if header {
+			header = false
+			if len(rec) >= 2 && !isMAC(rec[0]) && net.ParseIP(rec[1]) == nil {
+				continue
+			}
+		}
+		if len(rec) < 2 {
+			errs = append(errs, fmt.Sprintf("line %d: MAC and IP addresses are required", i+1))
+			continue
+		}
+
+		hostname := ""
+		if len(rec) >= 3 {
+			hostname = rec[2]
+		}
+		e, err := newLeaseEntry(i+1, rec[0], rec[1], hostname)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, errs
+}
+
+// Parse the file in the specified format
+func parseLeases(format, data string) ([]leaseEntry, []string, error) {
+	switch format {
+	case leasesFormatDnsmasq:
+		entries, errs := parseDnsmasqLeases(data)
+		return entries, errs, nil
+	case leasesFormatOpenWrt:
+		entries, errs := parseOpenWrtLeases(data)
+		return entries, errs, nil
+	case leasesFormatCSV:
+		entries, errs := parseCSVLeases(data)
+		return entries, errs, nil
+	}
+	return nil, nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// Remove the leases which already exist or appear twice in the file
+func removeDuplicateLeases(entries []leaseEntry, existing []dhcpd.Lease, res *leasesImportJSON) []leaseEntry {
+	same := func(a, b dhcpd.Lease) bool {
+		return bytes.Equal(a.HWAddr, b.HWAddr) && a.IP.Equal(b.IP)
+	}
+	arr := []leaseEntry{}
+	for _, e := range entries {
+		dup := false
+		for _, l := range existing {
+			dup = dup || same(l, e.lease)
+		}
+		for _, a := range arr {
+			dup = dup || same(a.lease, e.lease)
+		}
+		if dup {
+			res.Duplicate++
+			continue
+		}
+		arr = append(arr, e)
+	}
+	return arr
+}
+
+// Import the static leases
+// Nothing is changed if the file contains invalid lines or if it's a dry run.
+// "format=dnsmasq|openwrt|csv" sets the format of the file (it's detected by default),
+// "dry_run=true" only reports what would be changed.
+// The leases which conflict with the existing ones (the same MAC or IP address) aren't added.
+func handleDHCPImportStaticLeases(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	if !config.DHCP.Enabled {
+		httpError(w, http.StatusBadRequest, "DHCP server is disabled")
+		return
+	}
+
+	q := r.URL.Query()
+	dryRun := q.Get("dry_run") == "true"
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLeasesImportSize+1))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to read request body: %s", err)
+		return
+	}
+	if len(body) > maxLeasesImportSize {
+		httpError(w, http.StatusRequestEntityTooLarge, "The file is too large")
+		return
+	}
+
+	res := leasesImportJSON{Format: q.Get("format")}
+	if len(res.Format) == 0 {
+		res.Format = detectLeasesFormat(string(body))
+	}
+	entries, errs, err := parseLeases(res.Format, string(body))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	res.Errors = errs
+
+	entries = removeDuplicateLeases(entries, dhcpServer.StaticLeases(), &res)
+	if len(errs) == 0 && !dryRun {
+		for _, e := range entries {
+			err = dhcpServer.AddStaticLease(e.lease)
+			if err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("line %d: %s: %s", e.line, e.lease.IP, err))
+				continue
+			}
+			res.Added++
+		}
+		log.Info("DHCP: imported %d static leases from %s, %d errors", res.Added, res.Format, len(res.Errors))
+	} else if len(errs) == 0 {
+		res.Added = len(entries)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(errs) != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Error("json.Encode: %s", err)
+	}
+}
@@ -0,0 +1,88 @@
+package home
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+)
+
+func TestDHCPImportLeases(t *testing.T) {
+	dnsmasq := `# reservations
+dhcp-host=00:11:22:33:44:55,192.168.1.10,laptop,infinite
+dhcp-host=set:kids,66:77:88:99:aa:bb,tablet,192.168.1.11,12h # kids
+dhcp-host=id:client1,192.168.1.12
+dhcp-host=cc:cc:cc:cc:cc:cc,ignore
+dhcp-range=192.168.1.100,192.168.1.200,12h
+`
+	if detectLeasesFormat(dnsmasq) != leasesFormatDnsmasq {
+		t.Fatalf("detectLeasesFormat")
+	}
+	entries, errs := parseDnsmasqLeases(dnsmasq)
+	if len(errs) != 0 || len(entries) != 2 {
+		t.Fatalf("parseDnsmasqLeases: %v %v", entries, errs)
+	}
+	l := entries[1].lease
+	if entries[1].line != 3 || l.HWAddr.String() != "66:77:88:99:aa:bb" || !l.IP.Equal(net.ParseIP("192.168.1.11")) || l.Hostname != "tablet" {
+		t.Fatalf("parseDnsmasqLeases: %+v", entries[1])
+	}
+	_, errs = parseDnsmasqLeases("dhcp-host=00:11:22:33:44:55,192.168.1.300")
+	if len(errs) != 1 {
+		t.Fatalf("parseDnsmasqLeases: %v", errs)
+	}
+
+	openwrt := `config dnsmasq
+	option domain 'lan'
+
+config host
+	option name 'laptop'
+	option mac '00:11:22:33:44:55'
+	option ip '192.168.1.10'
+
+config host
+	option name "tablet"
+	list mac "66:77:88:99:aa:bb"
+	list mac "66:77:88:99:aa:bc"
+	option ip "192.168.1.11"
+`
+	if detectLeasesFormat(openwrt) != leasesFormatOpenWrt {
+		t.Fatalf("detectLeasesFormat")
+	}
+	entries, errs = parseOpenWrtLeases(openwrt)
+	if len(errs) != 0 || len(entries) != 2 {
+		t.Fatalf("parseOpenWrtLeases: %v %v", entries, errs)
+	}
+	l = entries[1].lease
+	if entries[1].line != 9 || l.HWAddr.String() != "66:77:88:99:aa:bb" || !l.IP.Equal(net.ParseIP("192.168.1.11")) || l.Hostname != "tablet" {
+		t.Fatalf("parseOpenWrtLeases: %+v", entries[1])
+	}
+	_, errs = parseOpenWrtLeases("config host\n\toption name 'x'\n\toption ip '192.168.1.10'\n")
+	if len(errs) != 1 {
+		t.Fatalf("parseOpenWrtLeases: %v", errs)
+	}
+
+	csv := `MAC,IP,Name
+00:11:22:33:44:55,192.168.1.10,laptop
+"66:77:88:99:aa:bb","192.168.1.11"
+`
+	if detectLeasesFormat(csv) != leasesFormatCSV {
+		t.Fatalf("detectLeasesFormat")
+	}
+	entries, errs = parseCSVLeases(csv)
+	if len(errs) != 0 || len(entries) != 2 || entries[0].lease.Hostname != "laptop" || entries[1].line != 3 {
+		t.Fatalf("parseCSVLeases: %v %v", entries, errs)
+	}
+	_, errs = parseCSVLeases("00:11:22:33:44:55\n00:11:22:33:44,192.168.1.10\n")
+	if len(errs) != 2 {
+		t.Fatalf("parseCSVLeases: %v", errs)
+	}
+
+	// the existing leases and the repeated lines are skipped
+	existing := []dhcpd.Lease{entries[0].lease}
+	entries = append(entries, entries[1])
+	res := leasesImportJSON{}
+	entries = removeDuplicateLeases(entries, existing, &res)
+	if len(entries) != 1 || res.Duplicate != 2 {
+		t.Fatalf("removeDuplicateLeases: %v %+v", entries, res)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -12,7 +13,6 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/dnsforward"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 	"github.com/miekg/dns"
 )
@@ -45,11 +45,7 @@ func initDNSServer(baseDir string) {
 
 	dnsServer = dnsforward.NewServer(baseDir)
 
-	bindhost := config.DNS.BindHost
-	if config.DNS.BindHost == "0.0.0.0" {
-		bindhost = "127.0.0.1"
-	}
-	resolverAddress := fmt.Sprintf("%s:%d", bindhost, config.DNS.Port)
+	resolverAddress := dnsResolverAddress()
 	opts := upstream.Options{
 		Timeout: rdnsTimeout,
 	}
@@ -90,6 +86,13 @@ func beginAsyncRDNS(ip string) {
 	}
 }
 
+// Forget the addresses which couldn't be resolved, so they're resolved again
+func resetRDNS() {
+	dnsctx.rdnsLock.Lock()
+	dnsctx.rdnsIP = make(map[string]bool)
+	dnsctx.rdnsLock.Unlock()
+}
+
 // Use rDNS to get hostname by IP address
 func resolveRDNS(ip string) string {
 	log.Tracef("Resolving host for %s", ip)
@@ -166,19 +169,27 @@ func onDNSRequest(d *proxy.DNSContext) {
 	}
 
 	beginAsyncRDNS(ip)
+	beginAsyncWhois(ip)
 }
 
 func generateServerConfig() dnsforward.ServerConfig {
 	filters := []dnsfilter.Filter{}
 	userFilter := userFilter()
+	// the temporary rules aren't saved to the user filter file
+	tempRules := activeTempRules(time.Now())
+	if len(tempRules) != 0 {
+		userFilter.Data = append(userFilter.Data, []byte("\n"+strings.Join(tempRules, "\n"))...)
+	}
 	filters = append(filters, dnsfilter.Filter{
-		ID:   userFilter.ID,
-		Data: userFilter.Data,
+		ID:      userFilter.ID,
+		Data:    userFilter.Data,
+		Trusted: true,
 	})
 	for _, filter := range config.Filters {
 		filters = append(filters, dnsfilter.Filter{
-			ID:   filter.ID,
-			Data: filter.Data,
+			ID:      filter.ID,
+			Data:    filter.Data,
+			Trusted: filter.Trusted,
 		})
 	}
 
@@ -188,43 +199,192 @@ func generateServerConfig() dnsforward.ServerConfig {
 		FilteringConfig: config.DNS.FilteringConfig,
 		Filters:         filters,
 	}
-	bindhost := config.DNS.BindHost
-	if config.DNS.BindHost == "0.0.0.0" {
-		bindhost = "127.0.0.1"
+	if len(newconfig.ParentalCategoryDB) != 0 && !filepath.IsAbs(newconfig.ParentalCategoryDB) {
+		newconfig.ParentalCategoryDB = filepath.Join(config.ourWorkingDir, newconfig.ParentalCategoryDB)
+	}
+	for _, l := range config.DNS.DisabledListeners {
+		if l != listenerHTTPS {
+			newconfig.DisabledListeners = append(newconfig.DisabledListeners, l)
+		}
 	}
-	newconfig.ResolverAddress = fmt.Sprintf("%s:%d", bindhost, config.DNS.Port)
+	newconfig.ResolverAddress = dnsResolverAddress()
+	dnsAddrs := toTCPAddrs(dnsListenAddrs())
+	if len(dnsAddrs) != 0 {
+		newconfig.UDPListenAddr = &net.UDPAddr{IP: dnsAddrs[0].IP, Port: dnsAddrs[0].Port}
+		newconfig.TCPListenAddr = dnsAddrs[0]
+		newconfig.ExtraListenAddrs = dnsAddrs[1:]
+	}
+
+	newconfig.ActivatedSockets = systemdSockets.dns
 
 	if config.TLS.Enabled {
 		newconfig.TLSConfig = config.TLS.TLSConfig
-		if config.TLS.PortDNSOverTLS != 0 {
-			newconfig.TLSListenAddr = &net.TCPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.TLS.PortDNSOverTLS}
+		newconfig.GetCertificate = getTLSCertificate
+		dotAddrs := toTCPAddrs(dotListenAddrs())
+		if len(dotAddrs) != 0 {
+			newconfig.TLSListenAddr = dotAddrs[0]
+			newconfig.ExtraTLSListenAddrs = dotAddrs[1:]
 		}
+		if config.TLS.PortDNSOverQUIC != 0 {
+			newconfig.QUICListenAddr = &net.UDPAddr{IP: net.ParseIP(config.DNS.BindHost), Port: config.TLS.PortDNSOverQUIC}
+		}
+		newconfig.TLSServerName = config.TLS.ServerName
 	}
 
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(config.DNS.UpstreamDNS, config.DNS.BootstrapDNS, dnsforward.DefaultTimeout)
+	timeout := upstreamTimeout(config.DNS.UpstreamTimeout)
+	upstreamConfig, err := dnsforward.ParseUpstreamsConfig(config.DNS.UpstreamDNS, config.DNS.BootstrapDNS, timeout, upstreamPoolConfig())
 	if err != nil {
 		log.Error("Couldn't get upstreams configuration cause: %s", err)
 	}
 	newconfig.Upstreams = upstreamConfig.Upstreams
 	newconfig.DomainsReservedUpstreams = upstreamConfig.DomainReservedUpstreams
+	newconfig.LocalPTRUpstreams = addressesToUpstreams(config.DNS.LocalPTRDNS, timeout)
+	newconfig.FallbackUpstreams = addressesToUpstreams(config.DNS.FallbackDNS, upstreamTimeout(config.DNS.FallbackTimeout))
 	newconfig.AllServers = config.DNS.AllServers
 	newconfig.FilterHandler = applyClientSettings
 	newconfig.OnDNSRequest = onDNSRequest
+	newconfig.LatencyBudgetHandler = clientLatencyBudget
+	newconfig.AAAADisabledHandler = clientAAAADisabled
+	newconfig.QueryLogIgnoredHandler = clientQueryLogIgnored
+	newconfig.ClientIDHandler = clientFindIPByID
+	newconfig.ClientUpstreamsHandler = clientUpstreams
+	if config.DHCP.Enabled {
+		newconfig.LocalDomainName = config.DHCP.LocalDomainName
+		newconfig.DHCPHostIPsHandler = dhcpHostIPs
+		newconfig.DHCPHostNameHandler = dhcpHostName
+	}
+	clientsResetUpstreams() // the upstream settings may have changed
 	return newconfig
 }
 
+// Get the upstream timeout from the setting in seconds (0: default)
+func upstreamTimeout(sec uint32) time.Duration {
+	if sec == 0 {
+		return dnsforward.DefaultTimeout
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// Get the settings of TCP and TLS connections to the upstream servers
+func upstreamPoolConfig() dnsforward.PoolConfig {
+	return dnsforward.PoolConfig{
+		Size:        config.DNS.UpstreamPoolSize,
+		Pipelining:  config.DNS.UpstreamPipelining,
+		IdleTimeout: time.Duration(config.DNS.UpstreamIdleTimeout) * time.Second,
+	}
+}
+
+// Create the upstream servers, the invalid addresses are skipped
+func addressesToUpstreams(addrs []string, timeout time.Duration) []upstream.Upstream {
+	var upstreams []upstream.Upstream
+	for _, addr := range addrs {
+		opts := upstream.Options{Bootstrap: config.DNS.BootstrapDNS, Timeout: timeout}
+		u, err := dnsforward.AddressToUpstream(addr, opts, upstreamPoolConfig())
+		if err != nil {
+			log.Error("Couldn't use %s as the upstream server: %s", addr, err)
+			continue
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
 // If a client has his own settings, apply them
+// Otherwise apply the settings of the client's group
 func applyClientSettings(clientAddr string, setts *dnsfilter.RequestFilteringSettings) {
 	c, ok := clientFind(clientAddr)
-	if !ok || !c.UseOwnSettings {
-		return
+
+	config.RLock()
+	defer config.RUnlock()
+	var group *clientGroup
+	if ok {
+		setts.ClientTags = c.Tags
+		group = findClientGroup(c.Tags)
+		if c.blockedAt(time.Now()) {
+			setts.BlockedClient = c.Name
+		}
+	}
+
+	if ok && c.UseOwnBlockedServices {
+		applyBlockedServices(setts, c.BlockedServices)
+	} else if group != nil && !group.UseGlobalBlockedServices {
+		applyBlockedServices(setts, group.BlockedServices)
+	} else {
+		applyBlockedServices(setts, config.DNS.BlockedServices)
 	}
 
-	log.Debug("Using settings for client with IP %s", clientAddr)
-	setts.FilteringEnabled = c.FilteringEnabled
-	setts.SafeSearchEnabled = c.SafeSearchEnabled
-	setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
-	setts.ParentalEnabled = c.ParentalEnabled
+	if ok {
+		setts.UnblockedDomains = portalUnblockedDomains(c.Name)
+	}
+
+	if ok && c.UseOwnSettings {
+		log.Debug("Using settings for client with IP %s", clientAddr)
+		setts.FilteringEnabled = c.FilteringEnabled
+		setts.SafeSearchEnabled = c.SafeSearchEnabled
+		setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
+		setts.ParentalEnabled = c.ParentalEnabled
+		if len(c.ParentalCategories) != 0 {
+			setts.ParentalCategories = c.ParentalCategories
+		}
+	} else if group != nil && !group.UseGlobalSettings {
+		log.Debug("Using settings of group %s for client with IP %s", group.Name, clientAddr)
+		setts.FilteringEnabled = group.FilteringEnabled
+		setts.SafeSearchEnabled = group.SafeSearchEnabled
+		setts.SafeBrowsingEnabled = group.SafeBrowsingEnabled
+		setts.ParentalEnabled = group.ParentalEnabled
+		if len(group.ParentalCategories) != 0 {
+			setts.ParentalCategories = group.ParentalCategories
+		}
+	}
+}
+
+// Get the latency budget of the client, 0 means the global setting is used
+func clientLatencyBudget(clientAddr string) uint32 {
+	c, ok := clientFind(clientAddr)
+	if !ok {
+		return 0
+	}
+	return c.LatencyBudget
+}
+
+// Return TRUE if AAAA requests are disabled for the client
+func clientAAAADisabled(clientAddr string) bool {
+	c, ok := clientFind(clientAddr)
+	return ok && c.AAAADisabled
+}
+
+// Return TRUE if the client's requests mustn't be logged
+func clientQueryLogIgnored(clientAddr string) bool {
+	c, ok := clientFind(clientAddr)
+	return ok && c.IgnoreQueryLog
+}
+
+// Get the client's own upstream servers, nil means the global setting is used
+// The upstream servers are created on the first request and reused
+func clientUpstreams(clientAddr string) *proxy.UpstreamConfig {
+	c, ok := clientFind(clientAddr)
+	if !ok || len(c.Upstreams) == 0 {
+		return nil
+	}
+
+	clients.lock.Lock()
+	conf, ok := clients.upstreams[c.Name]
+	clients.lock.Unlock()
+	if ok {
+		return conf
+	}
+
+	upstreamConf, err := dnsforward.ParseUpstreamsConfig(c.Upstreams, config.DNS.BootstrapDNS,
+		upstreamTimeout(config.DNS.UpstreamTimeout), upstreamPoolConfig())
+	if err != nil {
+		log.Error("Couldn't use the upstream servers of client %s: %s", c.Name, err)
+	} else {
+		conf = &upstreamConf
+	}
+	clients.lock.Lock()
+	clients.upstreams[c.Name] = conf
+	clients.lock.Unlock()
+	return conf
 }
 
 func startDNSServer() error {
@@ -243,6 +403,8 @@ func startDNSServer() error {
 		beginAsyncRDNS(k)
 	}
 
+	saveAppliedSettings()
+
 	return nil
 }
 
@@ -257,6 +419,7 @@ func reconfigureDNSServer() error {
 		return errorx.Decorate(err, "Couldn't start forwarding DNS server")
 	}
 
+	saveAppliedSettings()
 	return nil
 }
 
@@ -0,0 +1,166 @@
+// Enable and disable DNS listeners at runtime
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+)
+
+// DNS-over-HTTPS is served by our HTTPS server, not by the DNS server
+const listenerHTTPS = "https"
+
+// All supported listeners
+// DNSCrypt isn't supported by our DNS proxy
+var listenerNames = []string{dnsforward.ListenerUDP, dnsforward.ListenerTCP, dnsforward.ListenerTLS, dnsforward.ListenerQUIC, listenerHTTPS}
+
+type listenerStatusJSON struct {
+	Protocol string `json:"protocol"`
+	Enabled  bool   `json:"enabled"`
+	Running  bool   `json:"running"`
+	Error    string `json:"error,omitempty"` // the reason why the listener isn't running
+}
+
+// listenerDisabled returns TRUE if the listener is turned off
+// Must be called with the configuration lock held
+func listenerDisabled(name string) bool {
+	for _, l := range config.DNS.DisabledListeners {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerConfigured returns an error if the listener can't be started with the current settings
+// Must be called with the configuration lock held
+func listenerConfigured(name string) error {
+	switch name {
+	case dnsforward.ListenerTLS:
+		if !config.TLS.Enabled || config.TLS.PortDNSOverTLS == 0 {
+			return fmt.Errorf("DNS-over-TLS is not configured")
+		}
+	case dnsforward.ListenerQUIC:
+		if !config.TLS.Enabled || config.TLS.PortDNSOverQUIC == 0 {
+			return fmt.Errorf("DNS-over-QUIC is not configured")
+		}
+	case listenerHTTPS:
+		if !config.TLS.Enabled || config.TLS.PortHTTPS == 0 {
+			return fmt.Errorf("HTTPS is not configured")
+		}
+	}
+	return nil
+}
+
+// Get the status of all listeners
+func getListenersStatus() []listenerStatusJSON {
+	running := isRunning()
+	bindErrors := map[string]string{}
+	if running {
+		bindErrors = dnsServer.ListenerErrors()
+	}
+
+	list := []listenerStatusJSON{}
+	config.RLock()
+	for _, name := range listenerNames {
+		st := listenerStatusJSON{
+			Protocol: name,
+			Enabled:  !listenerDisabled(name),
+		}
+		err := listenerConfigured(name)
+		switch {
+		case !st.Enabled:
+			// not running
+		case err != nil:
+			st.Error = err.Error()
+		case !running:
+			st.Error = "DNS server is not running"
+		case len(bindErrors[name]) != 0:
+			st.Error = bindErrors[name]
+		case name == listenerHTTPS && httpsServer.server == nil:
+			st.Error = "HTTPS server is not running"
+		default:
+			st.Running = true
+		}
+		list = append(list, st)
+	}
+	config.RUnlock()
+	return list
+}
+
+func handleListenersStatus(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(getListenersStatus())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Enable or disable a listener
+// The DNS server is restarted with the new listeners set
+func handleListenersSet(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := struct {
+		Protocol string `json:"protocol"`
+		Enabled  bool   `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	known := false
+	for _, name := range listenerNames {
+		if name == req.Protocol {
+			known = true
+		}
+	}
+	if !known {
+		httpError(w, http.StatusBadRequest, "Unsupported protocol: %s", req.Protocol)
+		return
+	}
+
+	config.Lock()
+	disabled := []string{}
+	for _, l := range config.DNS.DisabledListeners {
+		if l != req.Protocol {
+			disabled = append(disabled, l)
+		}
+	}
+	if !req.Enabled {
+		disabled = append(disabled, req.Protocol)
+	}
+	prev := config.DNS.DisabledListeners
+	config.DNS.DisabledListeners = disabled
+
+	// the DNS server can't work without listeners
+	dnsListeners := 0
+	for _, name := range []string{dnsforward.ListenerUDP, dnsforward.ListenerTCP, dnsforward.ListenerTLS} {
+		if !listenerDisabled(name) && listenerConfigured(name) == nil {
+			dnsListeners++
+		}
+	}
+	if dnsListeners == 0 {
+		config.DNS.DisabledListeners = prev
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "At least one of UDP, TCP and DNS-over-TLS listeners must be enabled")
+		return
+	}
+	config.Unlock()
+
+	log.Info("DNS listener %s: enabled=%v", req.Protocol, req.Enabled)
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func registerListenersHandlers() {
+	http.HandleFunc("/control/dns_listeners", postInstall(optionalAuth(ensureGET(handleListenersStatus))))
+	http.HandleFunc("/control/dns_listeners/set", postInstall(optionalAuth(ensurePOST(handleListenersSet))))
+}
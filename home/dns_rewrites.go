@@ -0,0 +1,121 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+type rewriteEntryJSON struct {
+	Domain string `json:"domain"`
+	Answer string `json:"answer"`
+}
+
+func handleRewriteList(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	arr := []*rewriteEntryJSON{}
+
+	config.RLock()
+	for _, ent := range config.DNS.Rewrites {
+		jsent := rewriteEntryJSON{
+			Domain: ent.Domain,
+			Answer: ent.Answer,
+		}
+		arr = append(arr, &jsent)
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(arr)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Parse the request body into a rewrite entry
+func decodeRewriteEntry(r *http.Request) (dnsfilter.RewriteEntry, error) {
+	jsent := rewriteEntryJSON{}
+	err := json.NewDecoder(r.Body).Decode(&jsent)
+	if err != nil {
+		return dnsfilter.RewriteEntry{}, err
+	}
+
+	ent := dnsfilter.RewriteEntry{
+		Domain: strings.ToLower(strings.TrimSuffix(jsent.Domain, ".")),
+		Answer: strings.TrimSuffix(jsent.Answer, "."),
+	}
+	return ent, dnsfilter.CheckRewriteEntry(ent)
+}
+
+func handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	if !checkLocalRulesEditable(w) {
+		return
+	}
+
+	ent, err := decodeRewriteEntry(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.Lock()
+	for _, e := range config.DNS.Rewrites {
+		if e.Domain == ent.Domain && e.Answer == ent.Answer {
+			config.Unlock()
+			httpError(w, http.StatusBadRequest, "Rewrite already exists")
+			return
+		}
+	}
+	config.DNS.Rewrites = append(config.DNS.Rewrites, ent)
+	n := len(config.DNS.Rewrites)
+	config.Unlock()
+	log.Debug("Rewrites: added element: %s -> %s [%d]", ent.Domain, ent.Answer, n)
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleRewriteDelete(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	if !checkLocalRulesEditable(w) {
+		return
+	}
+
+	ent, err := decodeRewriteEntry(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	found := false
+	arr := []dnsfilter.RewriteEntry{}
+	config.Lock()
+	for _, e := range config.DNS.Rewrites {
+		if e.Domain == ent.Domain && e.Answer == ent.Answer {
+			log.Debug("Rewrites: removed element: %s -> %s", e.Domain, e.Answer)
+			found = true
+			continue
+		}
+		arr = append(arr, e)
+	}
+	config.DNS.Rewrites = arr
+	config.Unlock()
+
+	if !found {
+		httpError(w, http.StatusBadRequest, "Rewrite not found")
+		return
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func registerRewritesHandlers() {
+	http.HandleFunc("/control/rewrite/list", postInstall(optionalAuth(ensureGET(handleRewriteList))))
+	http.HandleFunc("/control/rewrite/add", postInstall(optionalAuth(ensurePOST(handleRewriteAdd))))
+	http.HandleFunc("/control/rewrite/delete", postInstall(optionalAuth(ensurePOST(handleRewriteDelete))))
+	http.HandleFunc("/control/rewrite/import", postInstall(optionalAuth(ensurePOST(handleRewriteImport))))
+}
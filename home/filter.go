@@ -1,9 +1,14 @@
 package home
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -13,22 +18,39 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
 	"github.com/AdguardTeam/golibs/file"
-	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	maxChecksumFileSize = 4 * 1024
+	filterRetryMinDelay = time.Minute // the delay before the first retry of a failed update
 )
 
 var (
-	nextFilterID      = time.Now().Unix() // semi-stable way to generate an unique ID
-	filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
+	nextFilterID         = time.Now().Unix() // semi-stable way to generate an unique ID
+	filterTitleRegexp    = regexp.MustCompile(`^! Title: +(.*)$`)
+	filterHomepageRegexp = regexp.MustCompile(`^! Homepage: +(.*)$`)
+	filterVersionRegexp  = regexp.MustCompile(`^! Version: +(.*)$`)
+	filterExpiresRegexp  = regexp.MustCompile(`^! Expires: +(.*)$`)
+	expiresPeriodRegexp  = regexp.MustCompile(`^(\d+) *([a-zA-Z]*)`)
 )
 
 // field ordering is important -- yaml fields will mirror ordering from here
 type filter struct {
-	Enabled     bool      `json:"enabled"`
-	URL         string    `json:"url"`
-	Name        string    `json:"name" yaml:"name"`
-	RulesCount  int       `json:"rulesCount" yaml:"-"`
-	LastUpdated time.Time `json:"lastUpdated,omitempty" yaml:"-"`
-	checksum    uint32    // checksum of the file data
+	Enabled     bool       `json:"enabled"`
+	URL         string     `json:"url"`
+	Name        string     `json:"name" yaml:"name"`
+	ChecksumURL string     `json:"checksum_url,omitempty" yaml:"checksum_url,omitempty"` // SHA-256 checksum of the list data
+	MaxSize     int64      `json:"max_size,omitempty" yaml:"max_size,omitempty"`         // overrides the global limit if non-zero
+	MaxRules    int        `json:"max_rules,omitempty" yaml:"max_rules,omitempty"`       // overrides the global limit if non-zero
+	RulesCount  int        `json:"rulesCount" yaml:"-"`
+	LastUpdated time.Time  `json:"lastUpdated,omitempty" yaml:"-"`
+	LastError   string     `json:"last_error,omitempty" yaml:"-"` // the reason why the last update or load has failed
+	Homepage    string     `json:"homepage,omitempty" yaml:"-"`
+	Version     string     `json:"version,omitempty" yaml:"-"`
+	checksum    uint32     // checksum of the file data
+	meta        filterMeta // the information from the filter data
+	failures    int        // the number of consecutive failed updates
+	nextRetry   time.Time  // don't retry a failed update before this time
 
 	dnsfilter.Filter `yaml:",inline"`
 }
@@ -71,6 +93,22 @@ func filterEnable(url string, enable bool) bool {
 	return r
 }
 
+// Change the trust level of a filter
+// Return FALSE if a filter with this URL doesn't exist
+func filterSetTrusted(url string, trusted bool) bool {
+	r := false
+	config.Lock()
+	for i := range config.Filters {
+		if config.Filters[i].URL == url {
+			config.Filters[i].Trusted = trusted
+			r = true
+			break
+		}
+	}
+	config.Unlock()
+	return r
+}
+
 // Return TRUE if a filter with this URL exists
 func filterExists(url string) bool {
 	r := false
@@ -157,10 +195,10 @@ func assignUniqueFilterID() int64 {
 	return value
 }
 
-// Sets up a timer that will be checking for filters updates periodically
-func periodicallyRefreshFilters() {
-	for range time.Tick(time.Minute) {
-		refreshFiltersIfNecessary(false)
+// Check for filters updates on every tick
+func (f *Filtering) periodicallyRefreshFilters(ticks <-chan time.Time) {
+	for range ticks {
+		f.refreshFiltersIfNecessary(false)
 	}
 }
 
@@ -174,40 +212,64 @@ func periodicallyRefreshFilters() {
 //  . If filter data has changed, parse it, save it on disk, set new update time
 //  . Apply changes to the current configuration
 // . Restart server
-func refreshFiltersIfNecessary(force bool) int {
+func (f *Filtering) refreshFiltersIfNecessary(force bool) int {
+	return f.refreshFilters(force, nil)
+}
+
+// Refresh filters and report the progress to the job (if it's not nil)
+func (f *Filtering) refreshFilters(force bool, job *refreshJob) int {
 	var updateFilters []filter
 
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+
 	if config.firstRun {
+		job.finish(0)
 		return 0
 	}
 
+	now := f.clock.Now()
 	config.RLock()
 	for i := range config.Filters {
-		f := &config.Filters[i] // otherwise we will be operating on a copy
+		cf := &config.Filters[i] // otherwise we will be operating on a copy
 
-		if !f.Enabled {
+		if !cf.Enabled {
 			continue
 		}
 
-		if !force && time.Since(f.LastUpdated) <= updatePeriod {
+		// a filter updated "in the future" means that the system clock has been set back,
+		// update it now rather than wait until the clock catches up
+		sinceUpdate := now.Sub(cf.LastUpdated)
+		if !force && sinceUpdate >= 0 && sinceUpdate <= cf.updatePeriod() {
+			continue
+		}
+		if !force && cf.failures != 0 && now.Before(cf.nextRetry) {
 			continue
 		}
 
 		var uf filter
-		uf.ID = f.ID
-		uf.URL = f.URL
-		uf.Name = f.Name
-		uf.checksum = f.checksum
+		uf.ID = cf.ID
+		uf.URL = cf.URL
+		uf.Name = cf.Name
+		uf.ChecksumURL = cf.ChecksumURL
+		uf.MaxSize = cf.MaxSize
+		uf.MaxRules = cf.MaxRules
+		uf.checksum = cf.checksum
 		updateFilters = append(updateFilters, uf)
 	}
 	config.RUnlock()
+	job.setQueue(updateFilters)
 
 	updateCount := 0
+	var parsed []int64
 	for i := range updateFilters {
 		uf := &updateFilters[i]
-		updated, err := uf.update()
+		job.setState(uf.ID, refreshDownloading, nil)
+		updated, err := f.update(uf)
 		if err != nil {
 			log.Printf("Failed to update filter %s: %s\n", uf.URL, err)
+			f.filterSetError(uf, err)
+			job.setState(uf.ID, refreshFailed, err)
 			continue
 		}
 		if updated {
@@ -215,35 +277,41 @@ func refreshFiltersIfNecessary(force bool) int {
 			err = uf.save()
 			if err != nil {
 				log.Printf("Failed to save the updated filter %d: %s", uf.ID, err)
+				f.filterSetError(uf, err)
+				job.setState(uf.ID, refreshFailed, err)
 				continue
 			}
+			// the rules are parsed when the DNS server is reconfigured
+			job.setState(uf.ID, refreshParsing, nil)
+			parsed = append(parsed, uf.ID)
 
 		} else {
-			mtime := time.Now()
-			e := os.Chtimes(uf.Path(), mtime, mtime)
-			if e != nil {
-				log.Error("os.Chtimes(): %v", e)
-			}
-			uf.LastUpdated = mtime
+			job.setState(uf.ID, refreshUnchanged, nil)
 		}
+		f.touch(uf)
 
 		config.Lock()
 		for k := range config.Filters {
-			f := &config.Filters[k]
-			if f.ID != uf.ID || f.URL != uf.URL {
+			cf := &config.Filters[k]
+			if cf.ID != uf.ID || cf.URL != uf.URL {
 				continue
 			}
-			f.LastUpdated = uf.LastUpdated
+			cf.LastUpdated = uf.LastUpdated
+			cf.LastError = ""
+			cf.failures = 0
 			if !updated {
 				continue
 			}
 
 			log.Info("Updated filter #%d.  Rules: %d -> %d",
-				f.ID, f.RulesCount, uf.RulesCount)
-			f.Name = uf.Name
-			f.Data = uf.Data
-			f.RulesCount = uf.RulesCount
-			f.checksum = uf.checksum
+				cf.ID, cf.RulesCount, uf.RulesCount)
+			cf.Name = uf.Name
+			cf.Data = uf.Data
+			cf.RulesCount = uf.RulesCount
+			cf.Homepage = uf.Homepage
+			cf.Version = uf.Version
+			cf.meta = uf.meta
+			cf.checksum = uf.checksum
 			updateCount++
 		}
 		config.Unlock()
@@ -256,15 +324,83 @@ func refreshFiltersIfNecessary(force bool) int {
 			panic(msg)
 		}
 	}
+	for _, id := range parsed {
+		job.setState(id, refreshApplied, nil)
+	}
+	job.finish(updateCount)
 	return updateCount
 }
 
+// Set the modification time of the filter file to the current time, the next update is scheduled from it
+func (f *Filtering) touch(uf *filter) {
+	mtime := f.clock.Now()
+	e := os.Chtimes(uf.Path(), mtime, mtime)
+	if e != nil {
+		log.Error("os.Chtimes(): %v", e)
+	}
+	uf.LastUpdated = mtime
+}
+
+// Save the reason why the filter couldn't be updated, so it's shown in the filter status,
+// and schedule the next attempt
+func (f *Filtering) filterSetError(uf *filter, err error) {
+	config.Lock()
+	for k := range config.Filters {
+		cf := &config.Filters[k]
+		if cf.ID == uf.ID && cf.URL == uf.URL {
+			cf.LastError = err.Error()
+			cf.failures++
+			delay := filterRetryDelay(cf.failures)
+			cf.nextRetry = f.clock.Now().Add(delay)
+			log.Debug("Filter %d: update attempt #%d has failed, retrying in %s", cf.ID, cf.failures, delay)
+		}
+	}
+	config.Unlock()
+}
+
+// Get the delay before the next update attempt after the specified number of failures
+// The delay grows exponentially up to the update period, the jitter spreads the retries of the lists on the same host
+func filterRetryDelay(failures int) time.Duration {
+	delay := filterRetryMinDelay
+	for i := 1; i < failures && delay < updatePeriod; i++ {
+		delay *= 2
+	}
+	if delay > updatePeriod {
+		delay = updatePeriod
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 5)) // up to 20%
+	return delay - delay/10 + jitter
+}
+
+// maxSize returns the maximum size of the filter data in bytes, 0 means no limit
+func (filter *filter) maxSize() int64 {
+	if filter.MaxSize != 0 {
+		return filter.MaxSize
+	}
+	return config.FilterMaxSize
+}
+
+// maxRules returns the maximum number of rules in the filter, 0 means no limit
+func (filter *filter) maxRules() int {
+	if filter.MaxRules != 0 {
+		return filter.MaxRules
+	}
+	return config.FilterMaxRules
+}
+
+// checkRulesCount returns an error if the filter has too many rules
+func (filter *filter) checkRulesCount(rulesCount int) error {
+	maxRules := filter.maxRules()
+	if maxRules > 0 && rulesCount > maxRules {
+		return fmt.Errorf("filter has %d rules which exceeds the limit of %d rules", rulesCount, maxRules)
+	}
+	return nil
+}
+
 // A helper function that parses filter contents and returns a number of rules and a filter name (if there's any)
-func parseFilterContents(contents []byte) (int, string) {
+func parseFilterContents(contents []byte) filterMeta {
 	lines := strings.Split(string(contents), "\n")
-	rulesCount := 0
-	name := ""
-	seenTitle := false
+	meta := filterMeta{}
 
 	// Count lines in the filter
 	for _, line := range lines {
@@ -275,24 +411,80 @@ func parseFilterContents(contents []byte) (int, string) {
 		}
 
 		if line[0] == '!' {
-			m := filterTitleRegexp.FindAllStringSubmatch(line, -1)
-			if len(m) > 0 && len(m[0]) >= 2 && !seenTitle {
-				name = m[0][1]
-				seenTitle = true
-			}
+			parseFilterHeader(filterTitleRegexp, line, &meta.Title)
+			parseFilterHeader(filterHomepageRegexp, line, &meta.Homepage)
+			parseFilterHeader(filterVersionRegexp, line, &meta.Version)
+			parseFilterHeader(filterExpiresRegexp, line, &meta.Expires)
 		} else {
-			rulesCount++
+			meta.RulesCount++
 		}
 	}
+	meta.ExpiresPeriod = parseExpiresPeriod(meta.Expires)
+
+	return meta
+}
+
+// Parse "! Expires:" header value, e.g. "4 days (update frequency)" or "12 hours"
+// A number without units means days
+// Returns 0 if the value can't be parsed
+func parseExpiresPeriod(s string) time.Duration {
+	m := expiresPeriodRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 {
+		return 0
+	}
+	var unit time.Duration
+	switch strings.ToLower(m[2]) {
+	case "", "d", "day", "days":
+		unit = 24 * time.Hour
+	case "h", "hour", "hours":
+		unit = time.Hour
+	case "m", "min", "minute", "minutes":
+		unit = time.Minute
+	default:
+		return 0
+	}
+	return time.Duration(n) * unit
+}
 
-	return rulesCount, name
+// Get the period of the filter updates
+// It's set by the filter itself via "! Expires:" header and bounded by the configuration limits
+// Must be called with the configuration lock held
+func (filter *filter) updatePeriod() time.Duration {
+	period := filter.meta.ExpiresPeriod
+	if period == 0 {
+		return updatePeriod
+	}
+	minPeriod := time.Duration(config.FilterMinUpdatePeriod) * time.Hour
+	maxPeriod := time.Duration(config.FilterMaxUpdatePeriod) * time.Hour
+	if period < minPeriod {
+		period = minPeriod
+	}
+	if maxPeriod != 0 && period > maxPeriod {
+		period = maxPeriod
+	}
+	return period
+}
+
+// Set the value if the line is the header matching the regexp (only the first header is used)
+func parseFilterHeader(re *regexp.Regexp, line string, value *string) {
+	if len(*value) != 0 {
+		return
+	}
+	m := re.FindAllStringSubmatch(line, -1)
+	if len(m) > 0 && len(m[0]) >= 2 {
+		*value = m[0][1]
+	}
 }
 
 // Perform upgrade on a filter
-func (filter *filter) update() (bool, error) {
+func (f *Filtering) update(filter *filter) (bool, error) {
 	log.Tracef("Downloading update for filter %d from %s", filter.ID, filter.URL)
 
-	resp, err := client.Get(filter.URL)
+	resp, err := f.client.Get(filter.URL)
 	if resp != nil && resp.Body != nil {
 		defer resp.Body.Close()
 	}
@@ -312,11 +504,23 @@ func (filter *filter) update() (bool, error) {
 		return false, fmt.Errorf("non-text response %s", contentType)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	maxSize := filter.maxSize()
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return false, fmt.Errorf("filter size %d bytes exceeds the limit of %d bytes", resp.ContentLength, maxSize)
+	}
+	var reader io.Reader = resp.Body
+	if maxSize > 0 {
+		// read one byte more than allowed to detect the overflow without reading the whole body
+		reader = io.LimitReader(resp.Body, maxSize+1)
+	}
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
 		log.Printf("Couldn't fetch filter contents from URL %s, skipping: %s", filter.URL, err)
 		return false, err
 	}
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return false, fmt.Errorf("filter size exceeds the limit of %d bytes", maxSize)
+	}
 
 	// Check if the filter has been really changed
 	checksum := crc32.ChecksumIEEE(body)
@@ -325,25 +529,80 @@ func (filter *filter) update() (bool, error) {
 		return false, nil
 	}
 
+	if len(filter.ChecksumURL) != 0 {
+		err = f.verifyChecksum(filter.ChecksumURL, body)
+		if err != nil {
+			log.Printf("Filter #%d at URL %s: checksum verification failed, skipping: %s", filter.ID, filter.URL, err)
+			return false, err
+		}
+	}
+
 	// Extract filter name and count number of rules
-	rulesCount, filterName := parseFilterContents(body)
-	log.Printf("Filter %d has been updated: %d bytes, %d rules", filter.ID, len(body), rulesCount)
-	if filterName != "" {
-		filter.Name = filterName
+	meta := parseFilterContents(body)
+	err = filter.checkRulesCount(meta.RulesCount)
+	if err != nil {
+		return false, err
 	}
-	filter.RulesCount = rulesCount
+	log.Printf("Filter %d has been updated: %d bytes, %d rules", filter.ID, len(body), meta.RulesCount)
+	if meta.Title != "" {
+		filter.Name = meta.Title
+	}
+	meta.Size = len(body)
+	meta.Checksum = checksum
+	filter.applyMeta(meta)
 	filter.Data = body
 	filter.checksum = checksum
 
 	return true, nil
 }
 
+// Download the SHA-256 checksum from checksumURL and compare it with the data
+// The checksum file contains a hex-encoded hash optionally followed by a file name, as sha256sum prints it
+func (f *Filtering) verifyChecksum(checksumURL string, data []byte) error {
+	resp, err := f.client.Get(checksumURL)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't request checksum from URL %s: %s", checksumURL, err)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got status code %d from URL %s", resp.StatusCode, checksumURL)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxChecksumFileSize))
+	if err != nil {
+		return fmt.Errorf("couldn't read checksum from URL %s: %s", checksumURL, err)
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty checksum file at URL %s", checksumURL)
+	}
+	expected, err := hex.DecodeString(fields[0])
+	if err != nil || len(expected) != sha256.Size {
+		return fmt.Errorf("invalid SHA-256 checksum at URL %s", checksumURL)
+	}
+
+	actual := sha256.Sum256(data)
+	if !bytes.Equal(expected, actual[:]) {
+		return fmt.Errorf("checksum mismatch: expected %x, got %x", expected, actual)
+	}
+	return nil
+}
+
 // saves filter contents to the file in dataDir
 func (filter *filter) save() error {
 	filterFilePath := filter.Path()
 	log.Printf("Saving filter %d contents to: %s", filter.ID, filterFilePath)
 
+	kept := filter.keepPrevious()
 	err := file.SafeWrite(filterFilePath, filter.Data)
+	if err != nil && kept {
+		filter.restorePrevious()
+	}
+	if err == nil {
+		err = filter.saveMeta(filter.meta)
+	}
 
 	// update LastUpdated field after saving the file
 	filter.LastUpdated = filter.LastTimeUpdated()
@@ -355,10 +614,16 @@ func (filter *filter) load() error {
 	filterFilePath := filter.Path()
 	log.Tracef("Loading filter %d contents to: %s", filter.ID, filterFilePath)
 
-	if _, err := os.Stat(filterFilePath); os.IsNotExist(err) {
+	st, err := os.Stat(filterFilePath)
+	if os.IsNotExist(err) {
 		// do nothing, file doesn't exist
 		return err
 	}
+	if err == nil && filter.maxSize() > 0 && st.Size() > filter.maxSize() {
+		err = fmt.Errorf("filter file size %d bytes exceeds the limit of %d bytes", st.Size(), filter.maxSize())
+		filter.LastError = err.Error()
+		return err
+	}
 
 	filterFileContents, err := ioutil.ReadFile(filterFilePath)
 	if err != nil {
@@ -366,11 +631,17 @@ func (filter *filter) load() error {
 	}
 
 	log.Tracef("File %s, id %d, length %d", filterFilePath, filter.ID, len(filterFileContents))
-	rulesCount, _ := parseFilterContents(filterFileContents)
+	checksum := crc32.ChecksumIEEE(filterFileContents)
+	meta := filter.getMeta(filterFileContents, checksum)
+	err = filter.checkRulesCount(meta.RulesCount)
+	if err != nil {
+		filter.LastError = err.Error()
+		return err
+	}
 
-	filter.RulesCount = rulesCount
+	filter.applyMeta(meta)
 	filter.Data = filterFileContents
-	filter.checksum = crc32.ChecksumIEEE(filterFileContents)
+	filter.checksum = checksum
 	filter.LastUpdated = filter.LastTimeUpdated()
 
 	return nil
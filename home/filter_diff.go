@@ -0,0 +1,142 @@
+// The previous version of each filter is kept on disk (<id>.txt.old),
+// so the user can see which rules the last update has added and removed.
+
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path to the previous version of the filter contents
+func (filter *filter) oldPath() string {
+	return filter.Path() + ".old"
+}
+
+// Move the current filter file aside before it's overwritten by the update
+func (filter *filter) keepPrevious() bool {
+	err := os.Rename(filter.Path(), filter.oldPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("Couldn't keep the previous version of filter %d: %s", filter.ID, err)
+		}
+		return false
+	}
+	return true
+}
+
+// Restore the filter file if the new version couldn't be saved
+func (filter *filter) restorePrevious() {
+	err := os.Rename(filter.oldPath(), filter.Path())
+	if err != nil {
+		log.Error("Couldn't restore the previous version of filter %d: %s", filter.ID, err)
+	}
+}
+
+type filterDiffJSON struct {
+	ID              int64     `json:"id"`
+	Updated         time.Time `json:"updated"`          // when the current version was downloaded
+	PreviousUpdated time.Time `json:"previous_updated"` // when the previous version was downloaded
+	Added           []string  `json:"added"`
+	Removed         []string  `json:"removed"`
+}
+
+// Get the unique rules of the filter data in their original order
+func filterRules(data []byte) []string {
+	rules := []string{}
+	seen := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '!' || line[0] == '#' || seen[line] {
+			continue
+		}
+		seen[line] = true
+		rules = append(rules, line)
+	}
+	return rules
+}
+
+// Get the rules which are present in "a" but not in "b"
+func rulesDifference(a, b []string) []string {
+	inB := map[string]bool{}
+	for _, r := range b {
+		inB[r] = true
+	}
+	diff := []string{}
+	for _, r := range a {
+		if !inB[r] {
+			diff = append(diff, r)
+		}
+	}
+	return diff
+}
+
+// Compare the current and the previous versions of the filter
+func filterDiff(cur, prev []byte) ([]string, []string) {
+	curRules := filterRules(cur)
+	prevRules := filterRules(prev)
+	return rulesDifference(curRules, prevRules), rulesDifference(prevRules, curRules)
+}
+
+// Get the rules added and removed by the last update of the filter
+func handleFilteringDiff(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid id parameter: %s", err)
+		return
+	}
+
+	var f *filter
+	config.RLock()
+	for i := range config.Filters {
+		if config.Filters[i].ID == id {
+			fcopy := config.Filters[i]
+			f = &fcopy
+			break
+		}
+	}
+	config.RUnlock()
+	if f == nil {
+		httpError(w, http.StatusNotFound, "Filter %d not found", id)
+		return
+	}
+
+	prev, err := ioutil.ReadFile(f.oldPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, "Filter %d has no previous version", id)
+			return
+		}
+		httpError(w, http.StatusInternalServerError, "Couldn't read the previous version: %s", err)
+		return
+	}
+	cur, err := ioutil.ReadFile(f.Path())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't read the filter: %s", err)
+		return
+	}
+	diff := filterDiffJSON{
+		ID:      id,
+		Updated: f.LastTimeUpdated(),
+	}
+	st, err := os.Stat(f.oldPath())
+	if err == nil {
+		diff.PreviousUpdated = st.ModTime()
+	}
+
+	diff.Added, diff.Removed = filterDiff(cur, prev)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(diff)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
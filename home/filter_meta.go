@@ -0,0 +1,87 @@
+// Filter metadata is stored in a small file next to the filter data,
+// so we don't need to parse every list on startup just to get the number of rules.
+
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+)
+
+// filterMeta is the information we get by parsing the filter data
+type filterMeta struct {
+	Size     int    `json:"size"`     // size of the data the metadata was obtained from
+	Checksum uint32 `json:"checksum"` // checksum of the data the metadata was obtained from
+
+	RulesCount int    `json:"rules_count"`
+	Title      string `json:"title,omitempty"`    // "! Title:" header
+	Homepage   string `json:"homepage,omitempty"` // "! Homepage:" header
+	Version    string `json:"version,omitempty"`  // "! Version:" header
+	Expires    string `json:"expires,omitempty"`  // "! Expires:" header
+
+	ExpiresPeriod time.Duration `json:"expires_period,omitempty"` // parsed "! Expires:" header value
+}
+
+// Path to the filter metadata
+func (filter *filter) metaPath() string {
+	return filepath.Join(config.ourWorkingDir, dataDir, filterDir, strconv.FormatInt(filter.ID, 10)+".meta.json")
+}
+
+// Save the filter metadata
+func (filter *filter) saveMeta(meta filterMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return file.SafeWrite(filter.metaPath(), data)
+}
+
+// Load the filter metadata
+// Returns FALSE if there's no metadata or it doesn't match the filter data
+func (filter *filter) loadMeta(size int, checksum uint32) (filterMeta, bool) {
+	meta := filterMeta{}
+	data, err := ioutil.ReadFile(filter.metaPath())
+	if err != nil {
+		return meta, false
+	}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		log.Debug("Filter %d: invalid metadata file: %s", filter.ID, err)
+		return meta, false
+	}
+	if meta.Size != size || meta.Checksum != checksum {
+		log.Debug("Filter %d: metadata is out of date", filter.ID)
+		return meta, false
+	}
+	return meta, true
+}
+
+// Get the metadata of the filter data: use the stored metadata if it's up to date, otherwise parse the data
+func (filter *filter) getMeta(data []byte, checksum uint32) filterMeta {
+	meta, ok := filter.loadMeta(len(data), checksum)
+	if ok {
+		return meta
+	}
+
+	meta = parseFilterContents(data)
+	meta.Size = len(data)
+	meta.Checksum = checksum
+	err := filter.saveMeta(meta)
+	if err != nil {
+		log.Error("Couldn't save filter %d metadata: %s", filter.ID, err)
+	}
+	return meta
+}
+
+// Set the filter fields from the metadata
+func (filter *filter) applyMeta(meta filterMeta) {
+	filter.RulesCount = meta.RulesCount
+	filter.Homepage = meta.Homepage
+	filter.Version = meta.Version
+	filter.meta = meta
+}
@@ -0,0 +1,160 @@
+// Asynchronous filters refresh with progress reporting
+
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Filter states during a refresh job
+const (
+	refreshQueued      = "queued"
+	refreshDownloading = "downloading"
+	refreshParsing     = "parsing"
+	refreshApplied     = "applied"
+	refreshUnchanged   = "unchanged"
+	refreshFailed      = "failed"
+)
+
+type refreshFilterState struct {
+	ID    int64  `json:"id"`
+	URL   string `json:"url"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// refreshJob tracks the progress of a filters refresh
+type refreshJob struct {
+	ID       uint64               `json:"id"`
+	Started  time.Time            `json:"started"`
+	Finished bool                 `json:"finished"`
+	Updated  int                  `json:"updated"` // the number of updated filters
+	Filters  []refreshFilterState `json:"filters"`
+
+	lock sync.Mutex
+}
+
+// setQueue sets the list of filters which are going to be updated
+func (j *refreshJob) setQueue(filters []filter) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	for _, f := range filters {
+		j.Filters = append(j.Filters, refreshFilterState{ID: f.ID, URL: f.URL, Name: f.Name, State: refreshQueued})
+	}
+	j.lock.Unlock()
+}
+
+// setState sets the state of the filter, err is set for the failed state
+func (j *refreshJob) setState(id int64, state string, err error) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	for i := range j.Filters {
+		if j.Filters[i].ID == id {
+			j.Filters[i].State = state
+			if err != nil {
+				j.Filters[i].Error = err.Error()
+			}
+		}
+	}
+	j.lock.Unlock()
+}
+
+// finish marks the job as finished
+func (j *refreshJob) finish(updated int) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	j.Finished = true
+	j.Updated = updated
+	j.lock.Unlock()
+}
+
+// There's only one refresh at a time: the periodic refresh and the API requests wait for each other
+var refreshLock sync.Mutex
+
+var refreshJobs struct {
+	sync.Mutex
+	last   *refreshJob // the most recent job, a new job replaces it
+	nextID uint64
+}
+
+// Start the refresh in background or return the job which is already running
+func startRefreshJob(force bool) *refreshJob {
+	refreshJobs.Lock()
+	defer refreshJobs.Unlock()
+
+	j := refreshJobs.last
+	if j != nil {
+		j.lock.Lock()
+		running := !j.Finished
+		j.lock.Unlock()
+		if running {
+			return j
+		}
+	}
+
+	refreshJobs.nextID++
+	j = &refreshJob{ID: refreshJobs.nextID, Started: time.Now(), Filters: []refreshFilterState{}}
+	refreshJobs.last = j
+	go func() {
+		updated := filtering.refreshFilters(force, j)
+		log.Debug("Filters refresh job %d is finished: %d filters updated", j.ID, updated)
+	}()
+	return j
+}
+
+// Start the refresh of all filters
+// The response contains the job ID which is used to get the progress from /control/filtering/refresh_status
+// Called from handleFilteringRefresh when "async" parameter is set
+func handleFilteringRefreshAsync(w http.ResponseWriter, r *http.Request) {
+	j := startRefreshJob(true)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]uint64{"job_id": j.ID})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+func handleFilteringRefreshStatus(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("job_id"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid job_id parameter: %s", err)
+		return
+	}
+
+	refreshJobs.Lock()
+	j := refreshJobs.last
+	refreshJobs.Unlock()
+	if j == nil || j.ID != id {
+		httpError(w, http.StatusNotFound, "No refresh job with ID %d", id)
+		return
+	}
+
+	j.lock.Lock()
+	data, err := json.Marshal(j)
+	j.lock.Unlock()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Marshal: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Unable to write response json: %s", err)
+	}
+}
@@ -0,0 +1,318 @@
+package home
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+	"github.com/AdguardTeam/AdGuardHome/testmode"
+)
+
+func TestFilterChecksum(t *testing.T) {
+	data := []byte("||example.org^\n")
+	sum := sha256.Sum256(data)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/good.sha256":
+			_, _ = fmt.Fprintf(w, "%x  filter.txt\n", sum)
+		case "/bad.sha256":
+			_, _ = fmt.Fprintf(w, "%x\n", sha256.Sum256([]byte("other")))
+		case "/invalid.sha256":
+			_, _ = fmt.Fprintf(w, "not a checksum\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	fl := newFiltering(ts.Client(), clock.Current)
+	if err := fl.verifyChecksum(ts.URL+"/good.sha256", data); err != nil {
+		t.Fatalf("verifyChecksum: %s", err)
+	}
+
+	for _, path := range []string{"/bad.sha256", "/invalid.sha256", "/missing.sha256"} {
+		if err := fl.verifyChecksum(ts.URL+path, data); err == nil {
+			t.Fatalf("verifyChecksum for %s must fail", path)
+		}
+	}
+}
+
+func TestFilterLimits(t *testing.T) {
+	data := "||example.org^\n||example.com^\n||example.net^\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(data))
+	}))
+	defer ts.Close()
+
+	fl := newFiltering(ts.Client(), clock.Current)
+	f := filter{URL: ts.URL, MaxSize: int64(len(data)) - 1}
+	if _, err := fl.update(&f); err == nil {
+		t.Fatalf("update must fail: the filter is too big")
+	}
+
+	f = filter{URL: ts.URL, MaxRules: 2}
+	if _, err := fl.update(&f); err == nil {
+		t.Fatalf("update must fail: the filter has too many rules")
+	}
+
+	f = filter{URL: ts.URL, MaxSize: int64(len(data)), MaxRules: 3}
+	updated, err := fl.update(&f)
+	if err != nil || !updated || f.RulesCount != 3 {
+		t.Fatalf("update: %v %v %d", updated, err, f.RulesCount)
+	}
+}
+
+func TestFilterRetryDelay(t *testing.T) {
+	prev := time.Duration(0)
+	for i := 1; i <= 10; i++ {
+		d := filterRetryDelay(i)
+		if d < prev*3/2 && d < updatePeriod*9/10 {
+			t.Fatalf("filterRetryDelay(%d) = %s doesn't grow", i, d)
+		}
+		if d > updatePeriod*11/10 {
+			t.Fatalf("filterRetryDelay(%d) = %s exceeds the cap", i, d)
+		}
+		prev = d
+	}
+	d := filterRetryDelay(1)
+	if d < filterRetryMinDelay*9/10 || d > filterRetryMinDelay*11/10 {
+		t.Fatalf("filterRetryDelay(1) = %s", d)
+	}
+}
+
+func TestRefreshJob(t *testing.T) {
+	var nilJob *refreshJob
+	filters := []filter{{URL: "https://example.org/1"}, {URL: "https://example.org/2"}}
+	filters[0].ID = 1
+	filters[1].ID = 2
+	nilJob.setQueue(filters)
+	nilJob.setState(1, refreshFailed, nil)
+	nilJob.finish(0)
+
+	j := &refreshJob{}
+	j.setQueue(filters)
+	if len(j.Filters) != 2 || j.Filters[0].State != refreshQueued || j.Filters[1].State != refreshQueued {
+		t.Fatalf("setQueue: %v", j.Filters)
+	}
+	j.setState(1, refreshApplied, nil)
+	j.setState(2, refreshFailed, fmt.Errorf("network error"))
+	j.finish(1)
+	if j.Filters[0].State != refreshApplied || j.Filters[1].State != refreshFailed ||
+		j.Filters[1].Error != "network error" || !j.Finished || j.Updated != 1 {
+		t.Fatalf("refreshJob: %+v", j)
+	}
+}
+
+func TestFilterMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-filters")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	_ = os.MkdirAll(filepath.Join(dir, dataDir, filterDir), 0755)
+	savedDir := config.ourWorkingDir
+	config.ourWorkingDir = dir
+	defer func() { config.ourWorkingDir = savedDir }()
+
+	data := []byte("! Title: Test\n! Homepage: https://example.org\n! Version: 42\n! Expires: 4 days\n||example.org^\n||example.com^\n")
+	meta := parseFilterContents(data)
+	if meta.RulesCount != 2 || meta.Title != "Test" || meta.Homepage != "https://example.org" ||
+		meta.Version != "42" || meta.Expires != "4 days" {
+		t.Fatalf("parseFilterContents: %+v", meta)
+	}
+
+	f := filter{}
+	f.ID = 1
+	f.Data = data
+	f.checksum = crc32.ChecksumIEEE(data)
+	meta.Size = len(data)
+	meta.Checksum = f.checksum
+	f.applyMeta(meta)
+	if err = f.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+
+	// the stored metadata is used while it matches the data
+	meta.RulesCount = 100
+	_ = f.saveMeta(meta)
+	f2 := filter{}
+	f2.ID = 1
+	if err = f2.load(); err != nil || f2.RulesCount != 100 || f2.Version != "42" {
+		t.Fatalf("load: %v %+v", err, f2)
+	}
+
+	// the data is parsed again if it has changed
+	_ = ioutil.WriteFile(f.Path(), []byte("||example.org^\n"), 0644)
+	f3 := filter{}
+	f3.ID = 1
+	if err = f3.load(); err != nil || f3.RulesCount != 1 || f3.Version != "" {
+		t.Fatalf("load - changed data: %v %+v", err, f3)
+	}
+}
+
+func TestFilterExpires(t *testing.T) {
+	tests := map[string]time.Duration{
+		"4 days (update frequency)": 4 * 24 * time.Hour,
+		"1 day":                     24 * time.Hour,
+		"12 hours":                  12 * time.Hour,
+		"2":                         2 * 24 * time.Hour,
+		"30 minutes":                30 * time.Minute,
+		"soon":                      0,
+		"0 days":                    0,
+		"5 weeks":                   0,
+	}
+	for s, d := range tests {
+		if p := parseExpiresPeriod(s); p != d {
+			t.Fatalf("parseExpiresPeriod(%s) = %s, expected %s", s, p, d)
+		}
+	}
+
+	savedMin, savedMax := config.FilterMinUpdatePeriod, config.FilterMaxUpdatePeriod
+	defer func() { config.FilterMinUpdatePeriod, config.FilterMaxUpdatePeriod = savedMin, savedMax }()
+	config.FilterMinUpdatePeriod = 1
+	config.FilterMaxUpdatePeriod = 72
+
+	f := filter{}
+	if f.updatePeriod() != updatePeriod {
+		t.Fatalf("updatePeriod without Expires: %s", f.updatePeriod())
+	}
+	f.meta = parseFilterContents([]byte("! Expires: 30 minutes\n"))
+	if f.updatePeriod() != time.Hour {
+		t.Fatalf("updatePeriod below the minimum: %s", f.updatePeriod())
+	}
+	f.meta = parseFilterContents([]byte("! Expires: 2 days\n"))
+	if f.updatePeriod() != 48*time.Hour {
+		t.Fatalf("updatePeriod: %s", f.updatePeriod())
+	}
+	f.meta = parseFilterContents([]byte("! Expires: 7 days\n"))
+	if f.updatePeriod() != 72*time.Hour {
+		t.Fatalf("updatePeriod above the maximum: %s", f.updatePeriod())
+	}
+}
+
+func TestFilterDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-filters")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	_ = os.MkdirAll(filepath.Join(dir, dataDir, filterDir), 0755)
+	savedDir := config.ourWorkingDir
+	config.ourWorkingDir = dir
+	defer func() { config.ourWorkingDir = savedDir }()
+
+	f := filter{}
+	f.ID = 1
+	f.Data = []byte("! Title: Test\n||example.org^\n||example.com^\n")
+	if err = f.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	if _, err = os.Stat(f.oldPath()); !os.IsNotExist(err) {
+		t.Fatalf("the first version must not have a previous one: %v", err)
+	}
+
+	f.Data = []byte("! Title: Test 2\n||example.org^\n||example.net^\n||example.net^\n")
+	if err = f.save(); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	prev, err := ioutil.ReadFile(f.oldPath())
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	cur, _ := ioutil.ReadFile(f.Path())
+	added, removed := filterDiff(cur, prev)
+	if len(added) != 1 || added[0] != "||example.net^" || len(removed) != 1 || removed[0] != "||example.com^" {
+		t.Fatalf("filterDiff: %v %v", added, removed)
+	}
+}
+
+func TestFilterRefreshSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-filters")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	_ = os.MkdirAll(filepath.Join(dir, dataDir, filterDir), 0755)
+	savedDir, savedFilters := config.ourWorkingDir, config.Filters
+	defer func() { config.ourWorkingDir, config.Filters = savedDir, savedFilters }()
+	config.ourWorkingDir = dir
+
+	fake := clock.NewFake(time.Unix(2000000000, 0))
+	src := testmode.NewFilterSource()
+	fl := newFiltering(&http.Client{Transport: src}, fake)
+
+	const url = "https://filters.test/list.txt"
+	src.Set(url, "||example.org^\n")
+	f := filter{Enabled: true}
+	f.ID = 1
+	f.URL = url
+	config.Filters = []filter{f}
+
+	refresh := func(expected int) {
+		t.Helper()
+		fl.refreshFiltersIfNecessary(false)
+		if src.Requests(url) != expected {
+			t.Fatalf("%s: %d requests, expected %d", fake.Now(), src.Requests(url), expected)
+		}
+	}
+
+	refresh(1)
+	if !config.Filters[0].LastUpdated.Equal(fake.Now()) || config.Filters[0].RulesCount != 1 {
+		t.Fatalf("the filter isn't updated: %+v", config.Filters[0])
+	}
+
+	// not due yet
+	fake.Advance(updatePeriod - time.Minute)
+	refresh(1)
+
+	// due: the contents haven't changed, but the next update is scheduled from now
+	fake.Advance(2 * time.Minute)
+	refresh(2)
+	if !config.Filters[0].LastUpdated.Equal(fake.Now()) {
+		t.Fatalf("LastUpdated: %s", config.Filters[0].LastUpdated)
+	}
+
+	// the failed update is retried after a delay
+	src.Remove(url)
+	fake.Advance(updatePeriod + time.Minute)
+	refresh(3)
+	if config.Filters[0].failures != 1 || len(config.Filters[0].LastError) == 0 {
+		t.Fatalf("the failure isn't recorded: %+v", config.Filters[0])
+	}
+	fake.Advance(filterRetryMinDelay / 2)
+	refresh(3)
+	src.Set(url, "||example.org^\n||example.com^\n")
+	fake.Advance(filterRetryMinDelay)
+	refresh(4)
+	if config.Filters[0].failures != 0 || config.Filters[0].RulesCount != 2 {
+		t.Fatalf("the filter isn't updated after the failure: %+v", config.Filters[0])
+	}
+
+	// the clock has been set back: update now
+	fake.Advance(-24 * time.Hour)
+	refresh(5)
+
+	// the periodic refresh is driven by the ticks
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		fl.periodicallyRefreshFilters(ticks)
+		close(done)
+	}()
+	fake.Advance(updatePeriod + time.Minute)
+	ticks <- fake.Now()
+	close(ticks)
+	<-done
+	if src.Requests(url) != 6 {
+		t.Fatalf("periodicallyRefreshFilters: %d requests", src.Requests(url))
+	}
+}
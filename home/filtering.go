@@ -0,0 +1,31 @@
+package home
+
+import (
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/clock"
+)
+
+// HTTPClient downloads the filters
+// It's implemented by *http.Client
+type HTTPClient interface {
+	Get(url string) (*http.Response, error)
+}
+
+// Filtering downloads the filter lists and keeps them up to date
+// The HTTP client and the clock are injected, so the update, retry and scheduling logic can be tested.
+type Filtering struct {
+	client HTTPClient
+	clock  clock.Clock
+}
+
+// filtering is the filtering subsystem of the application
+var filtering = newFiltering(client, clock.Current)
+
+// Create a filtering subsystem which uses the HTTP client and the clock
+func newFiltering(c HTTPClient, clk clock.Clock) *Filtering {
+	return &Filtering{
+		client: c,
+		clock:  clk,
+	}
+}
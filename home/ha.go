@@ -0,0 +1,304 @@
+// High availability pair
+// Two instances serve the same network, keepalived (VRRP) moves the virtual IP address between them.
+// Both DNS servers are running, but only one DHCP server may assign the addresses:
+//  the backup instance is in standby mode and its DHCP server is paused until keepalived reports a failover
+//  (the notify script calls /control/ha/set_state).
+// Each instance periodically pulls the DHCP leases of its peer, so the leases survive a failover in either direction.
+// The client settings are shared by the settings sync (see config_sync.go): the primary is the pair's active instance.
+// /control/ha/health doesn't require authentication: it's used by the keepalived check script.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+)
+
+const haMaxLeasesSize = 16 * 1024 * 1024
+
+type haConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Standby  bool   `yaml:"standby"`             // the DHCP server is paused until failover
+	PeerURL  string `yaml:"peer_url"`            // the address of the peer's web interface, e.g. https://192.168.1.3
+	Token    string `yaml:"token"`               // the peer's API token
+	Interval uint32 `yaml:"lease_sync_interval"` // in seconds
+}
+
+// The state of the pair
+var haState struct {
+	sync.Mutex
+	lastLeaseSync time.Time
+	lastError     string
+	dhcpError     string // the DHCP server couldn't be started after failover
+}
+
+func validateHAConfig(c haConfig) error {
+	if !c.Enabled || len(c.PeerURL) == 0 {
+		return nil
+	}
+	if !strings.HasPrefix(c.PeerURL, "http://") && !strings.HasPrefix(c.PeerURL, "https://") {
+		return fmt.Errorf("ha: invalid peer_url %q", c.PeerURL)
+	}
+	return nil
+}
+
+// Return TRUE if this instance is the backup and its DHCP server must not run
+func haStandby() bool {
+	config.RLock()
+	defer config.RUnlock()
+	return config.HA.Enabled && config.HA.Standby
+}
+
+// Download the active DHCP leases of the peer
+func downloadPeerLeases(conf haConfig) ([]dhcpd.Lease, error) {
+	url := strings.TrimRight(conf.PeerURL, "/") + "/control/dhcp/status"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+conf.Token)
+	}
+	resp, err := client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't request the leases from %s: %s", url, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got status code %d from %s", resp.StatusCode, url)
+	}
+
+	status := struct {
+		Leases []map[string]string `json:"leases"`
+	}{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, haMaxLeasesSize)).Decode(&status)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the leases from %s: %s", url, err)
+	}
+
+	leases := []dhcpd.Lease{}
+	for _, l := range status.Leases {
+		mac, err := net.ParseMAC(l["mac"])
+		if err != nil {
+			continue
+		}
+		expiry, err := time.Parse(time.RFC3339, l["expires"])
+		if err != nil {
+			continue
+		}
+		leases = append(leases, dhcpd.Lease{
+			HWAddr:   mac,
+			IP:       net.ParseIP(l["ip"]),
+			Hostname: l["hostname"],
+			Expiry:   expiry,
+		})
+	}
+	return leases, nil
+}
+
+// Merge the peer's DHCP leases into ours
+// Returns the number of the added or updated leases
+func refreshHALeases() (int, error) {
+	config.RLock()
+	conf := config.HA
+	dhcpEnabled := config.DHCP.Enabled
+	config.RUnlock()
+	if !conf.Enabled || len(conf.PeerURL) == 0 || !dhcpEnabled {
+		return 0, nil
+	}
+
+	leases, err := downloadPeerLeases(conf)
+	haState.Lock()
+	defer haState.Unlock()
+	if err != nil {
+		haState.lastError = err.Error()
+		return 0, err
+	}
+	haState.lastError = ""
+	haState.lastLeaseSync = time.Now()
+
+	n := dhcpServer.MergeLeases(leases)
+	if n != 0 {
+		log.Debug("HA: merged %d leases from %s", n, conf.PeerURL)
+	}
+	return n, nil
+}
+
+func periodicallyRefreshHALeases() {
+	for {
+		config.RLock()
+		interval := time.Duration(config.HA.Interval) * time.Second
+		config.RUnlock()
+		if interval == 0 {
+			interval = time.Minute
+		}
+		time.Sleep(interval)
+
+		_, err := refreshHALeases()
+		if err != nil {
+			log.Debug("HA: couldn't sync the leases: %s", err)
+		}
+	}
+}
+
+// Enter or leave standby mode: pause or resume the DHCP server
+func setHAStandby(standby bool) error {
+	config.Lock()
+	changed := config.HA.Standby != standby
+	config.HA.Standby = standby
+	dhcpEnabled := config.DHCP.Enabled
+	config.Unlock()
+	if !changed || !dhcpEnabled {
+		return nil
+	}
+
+	if standby {
+		log.Info("HA: standby mode, pausing the DHCP server")
+		haState.Lock()
+		haState.dhcpError = ""
+		haState.Unlock()
+		return dhcpServer.Stop()
+	}
+
+	log.Info("HA: failover, resuming the DHCP server")
+	// the leases which the peer has assigned until now (it may be unreachable already)
+	_, err := refreshHALeases()
+	if err != nil {
+		log.Debug("HA: couldn't sync the leases: %s", err)
+	}
+	err = dhcpServer.Start()
+	haState.Lock()
+	haState.dhcpError = ""
+	if err != nil {
+		haState.dhcpError = err.Error()
+	}
+	haState.Unlock()
+	return err
+}
+
+type haHealthJSON struct {
+	Status  string `json:"status"` // "ok" or "fail"
+	Standby bool   `json:"standby"`
+	DNS     bool   `json:"dns"`  // the DNS server is running
+	DHCP    bool   `json:"dhcp"` // the DHCP server is assigning the addresses
+}
+
+// The health check for keepalived
+// The status code is 503 if the DNS server isn't running or the DHCP server couldn't be resumed after failover.
+func handleHAHealth(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	standby := config.HA.Enabled && config.HA.Standby
+	dhcpEnabled := config.DHCP.Enabled
+	config.RUnlock()
+	haState.Lock()
+	dhcpFailed := len(haState.dhcpError) != 0
+	haState.Unlock()
+
+	j := haHealthJSON{
+		Status:  "ok",
+		Standby: standby,
+		DNS:     isRunning(),
+		DHCP:    dhcpEnabled && !standby && !dhcpFailed,
+	}
+	code := http.StatusOK
+	if !j.DNS || (dhcpEnabled && !standby && dhcpFailed) {
+		j.Status = "fail"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		log.Debug("json.Encode: %s", err)
+	}
+}
+
+type haStatusJSON struct {
+	Enabled       bool      `json:"enabled"`
+	Standby       bool      `json:"standby"`
+	PeerURL       string    `json:"peer_url,omitempty"`
+	Interval      uint32    `json:"lease_sync_interval"`
+	LastLeaseSync time.Time `json:"last_lease_sync,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	DHCPError     string    `json:"dhcp_error,omitempty"`
+}
+
+func handleHAStatus(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	j := haStatusJSON{
+		Enabled:  config.HA.Enabled,
+		Standby:  config.HA.Standby,
+		PeerURL:  config.HA.PeerURL,
+		Interval: config.HA.Interval,
+	}
+	config.RUnlock()
+	haState.Lock()
+	j.LastLeaseSync = haState.lastLeaseSync
+	j.LastError = haState.lastError
+	j.DHCPError = haState.dhcpError
+	haState.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+type haSetStateJSON struct {
+	Standby bool `json:"standby"`
+}
+
+// Called by the keepalived notify script: {"standby":false} on MASTER, {"standby":true} on BACKUP and FAULT
+func handleHASetState(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := haSetStateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	config.RLock()
+	enabled := config.HA.Enabled
+	config.RUnlock()
+	if !enabled {
+		httpError(w, http.StatusBadRequest, "HA mode is disabled")
+		return
+	}
+
+	err = setHAStandby(req.Standby)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't change the DHCP server state: %s", err)
+		return
+	}
+
+	// the state is kept after restart
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+func registerHAHandlers() {
+	http.HandleFunc("/control/ha/health", postInstall(ensureGET(handleHAHealth)))
+	http.HandleFunc("/control/ha/status", postInstall(optionalAuth(ensureGET(handleHAStatus))))
+	http.HandleFunc("/control/ha/set_state", postInstall(optionalAuth(ensurePOST(handleHASetState))))
+}
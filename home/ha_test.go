@@ -0,0 +1,61 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHAPeerLeases(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"leases":[
+			{"mac":"aa:aa:aa:aa:aa:aa","ip":"192.168.1.10","hostname":"host","expires":"2030-01-01T00:00:00Z"},
+			{"mac":"invalid","ip":"192.168.1.11","hostname":"","expires":"2030-01-01T00:00:00Z"}]}`))
+	}))
+	defer srv.Close()
+
+	leases, err := downloadPeerLeases(haConfig{PeerURL: srv.URL, Token: "token"})
+	if err != nil {
+		t.Fatalf("downloadPeerLeases: %s", err)
+	}
+	if len(leases) != 1 || leases[0].HWAddr.String() != "aa:aa:aa:aa:aa:aa" ||
+		leases[0].IP.String() != "192.168.1.10" || leases[0].Expiry.Year() != 2030 {
+		t.Fatalf("leases: %+v", leases)
+	}
+	_, err = downloadPeerLeases(haConfig{PeerURL: srv.URL})
+	if err == nil {
+		t.Fatalf("no token")
+	}
+
+	if validateHAConfig(haConfig{Enabled: true, PeerURL: "192.168.1.3"}) == nil {
+		t.Fatalf("invalid peer_url")
+	}
+}
+
+func TestHAHealth(t *testing.T) {
+	ha, dhcp := config.HA, config.DHCP
+	defer func() { config.HA, config.DHCP = ha, dhcp }()
+	config.HA = haConfig{Enabled: true, Standby: true}
+	config.DHCP.Enabled = true
+
+	// the DNS server isn't running
+	w := httptest.NewRecorder()
+	handleHAHealth(w, httptest.NewRequest("GET", "/control/ha/health", nil))
+	j := haHealthJSON{}
+	_ = json.Unmarshal(w.Body.Bytes(), &j)
+	if w.Code != http.StatusServiceUnavailable || j.Status != "fail" || !j.Standby || j.DHCP {
+		t.Fatalf("health: %d %+v", w.Code, j)
+	}
+	if !haStandby() {
+		t.Fatalf("standby")
+	}
+	config.HA.Enabled = false
+	if haStandby() {
+		t.Fatalf("HA mode is disabled")
+	}
+}
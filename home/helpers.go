@@ -9,7 +9,6 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -20,7 +19,6 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/joomcode/errorx"
 )
 
@@ -43,6 +41,19 @@ func ensure(method string, handler func(http.ResponseWriter, *http.Request)) fun
 	}
 }
 
+// Check the request method without taking controlLock
+// It's used by the handlers which don't change the settings and protect their data with their own locks,
+// so the slow password checks don't block the other requests.
+func ensureMethod(method string, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "This request must be "+method, http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 func ensurePOST(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return ensure("POST", handler)
 }
@@ -67,19 +78,32 @@ func ensureGETHandler(handler func(http.ResponseWriter, *http.Request)) http.Han
 }
 
 func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	handler = auditConfigChanges(handler)
 	return func(w http.ResponseWriter, r *http.Request) {
-		if config.AuthName == "" || config.AuthPass == "" {
+		if !authRequired() {
 			handler(w, r)
 			return
 		}
-		user, pass, ok := r.BasicAuth()
-		if !ok || user != config.AuthName || pass != config.AuthPass {
+		if redirectToHTTPS(w, r) {
+			// don't ask for the credentials over plain HTTP
+			return
+		}
+		a, status := authenticate(r)
+		if status == http.StatusTooManyRequests {
+			httpError(w, status, "Too many failed login attempts, try again later")
+			return
+		}
+		if status != 0 {
 			w.Header().Set("WWW-Authenticate", `Basic realm="dnsfilter"`)
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorised.\n"))
 			return
 		}
-		handler(w, r)
+		if !roleAllows(a.role, r) {
+			httpError(w, http.StatusForbidden, "%s role is required", roleAdmin)
+			return
+		}
+		handler(w, withAuthInfo(r, a))
 	}
 }
 
@@ -147,24 +171,10 @@ func postInstall(handler func(http.ResponseWriter, *http.Request)) func(http.Res
 			http.Redirect(w, r, "/install.html", http.StatusSeeOther) // should not be cacheable
 			return
 		}
-		// enforce https?
-		if config.TLS.ForceHTTPS && r.TLS == nil && config.TLS.Enabled && config.TLS.PortHTTPS != 0 && httpsServer.server != nil {
-			// yes, and we want host from host:port
-			host, _, err := net.SplitHostPort(r.Host)
-			if err != nil {
-				// no port in host
-				host = r.Host
-			}
-			// construct new URL to redirect to
-			newURL := url.URL{
-				Scheme:   "https",
-				Host:     net.JoinHostPort(host, strconv.Itoa(config.TLS.PortHTTPS)),
-				Path:     r.URL.Path,
-				RawQuery: r.URL.RawQuery,
-			}
-			http.Redirect(w, r, newURL.String(), http.StatusTemporaryRedirect)
+		if redirectToHTTPS(w, r) {
 			return
 		}
+		setHSTSHeader(w, r)
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		handler(w, r)
 	}
@@ -326,11 +336,7 @@ func customDialContext(ctx context.Context, network, addr string) (net.Conn, err
 		return con, err
 	}
 
-	bindhost := config.DNS.BindHost
-	if config.DNS.BindHost == "0.0.0.0" {
-		bindhost = "127.0.0.1"
-	}
-	resolverAddr := fmt.Sprintf("%s:%d", bindhost, config.DNS.Port)
+	resolverAddr := dnsResolverAddress()
 	r := upstream.NewResolver(resolverAddr, 30*time.Second)
 	addrs, e := r.LookupIPAddr(ctx, host)
 	log.Tracef("LookupIPAddr: %s: %v", host, addrs)
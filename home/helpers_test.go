@@ -2,8 +2,6 @@ package home
 
 import (
 	"testing"
-
-	"github.com/AdguardTeam/golibs/log"
 )
 
 func TestGetValidNetInterfacesForWeb(t *testing.T) {
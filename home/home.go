@@ -20,17 +20,22 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/AdGuardHome/logging"
 	"github.com/NYTimes/gziphandler"
 	"github.com/gobuffalo/packr"
 )
 
+var log = logging.New("home")
+
 // VersionString will be set through ldflags, contains current version
 var VersionString = "undefined"
 
 // updateChannel can be set via ldflags
 var updateChannel = "release"
-var versionCheckURL = "https://static.adguard.com/adguardhome/" + updateChannel + "/version.json"
+var versionCheckBaseURL = "https://static.adguard.com/adguardhome/"
+
+// updatePublicKey verifies the signatures of the update packages (base64 Ed25519 key), it's set via ldflags
+var updatePublicKey = ""
 
 const versionCheckPeriod = time.Hour * 8
 
@@ -50,6 +55,11 @@ const (
 
 // main is the entry point
 func Main() {
+	// administration commands manage a running instance
+	if isCLICommand(os.Args[1:]) {
+		os.Exit(runCLI(os.Args[1:], os.Stdout))
+	}
+
 	// config can be specified, which reads options from there, but other command line flags have to override config values
 	// therefore, we must do it manually instead of using a lib
 	args := loadOptions()
@@ -89,20 +99,49 @@ func run(args options) {
 	config.runningAsService = args.runningAsService
 	config.disableUpdate = args.disableUpdate
 
+	if !args.checkConfig {
+		// the previous version is restored if this one has failed to start after the update
+		checkUpdateState()
+	}
+
 	config.firstRun = detectFirstRun()
 	if config.firstRun {
 		requireAdminRights()
+
+		// the configuration may be provisioned without the wizard
+		s, err := loadSetupConfig(args.setup)
+		if err == nil && s != nil {
+			err = applySetupConfig(s)
+			config.firstRun = err != nil
+		}
+		if err != nil {
+			log.Fatalf("First run: %s", err)
+		}
 	}
 
-	signalChannel := make(chan os.Signal)
+	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 	go func() {
-		<-signalChannel
+		for sig := range signalChannel {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			if config.firstRun {
+				continue
+			}
+			sdNotify("RELOADING=1")
+			err := reloadConfig()
+			if err != nil {
+				log.Error("Couldn't reload config file: %s", err)
+			}
+			sdNotify("READY=1")
+		}
 		cleanup()
 		cleanupAlways()
 		os.Exit(0)
 	}()
 
+	initServices()
 	clientsInit()
 
 	if !config.firstRun {
@@ -144,8 +183,16 @@ func run(args options) {
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		checkFilePermissions()
 	}
 
+	initAuth()
+	initSystemdSockets()
+
+	// Load the certificate before the HTTPS and DNS-over-TLS listeners start
+	initTLS()
+
 	// Init the DNS server instance before registering HTTP handlers
 	dnsBaseDir := filepath.Join(config.ourWorkingDir, dataDir)
 	initDNSServer(dnsBaseDir)
@@ -156,6 +203,7 @@ func run(args options) {
 			log.Fatal(err)
 		}
 
+		initDHCPHooks()
 		err = startDHCPServer()
 		if err != nil {
 			log.Fatal(err)
@@ -168,10 +216,22 @@ func run(args options) {
 
 	// Update filters we've just loaded right away, don't wait for periodic update timer
 	go func() {
-		refreshFiltersIfNecessary(false)
+		filtering.refreshFiltersIfNecessary(false)
 	}()
 	// Schedule automatic filters updates
-	go periodicallyRefreshFilters()
+	go filtering.periodicallyRefreshFilters(time.Tick(time.Minute))
+	go clockMonitor()
+	go periodicallyRefreshRemoteRules()
+	go periodicallySyncConfig()
+	go periodicallyRefreshHALeases()
+	go periodicallyRemoveExpiredTempRules()
+	go periodicallyRemoveExpiredClientBlocks()
+	go periodicallyRefreshClients()
+	go periodicallyDetectPresence()
+	go periodicallyReloadTLSFiles()
+	go periodicallyRenewACMECertificate()
+	go periodicallyNotifyWatchdog()
+	initWhois()
 
 	// Initialize and run the admin Web interface
 	box := packr.NewBox("../build/static")
@@ -191,17 +251,25 @@ func run(args options) {
 
 	// for https, we have a separate goroutine loop
 	go httpServerLoop()
+	sdNotify("READY=1")
 
 	// this loop is used as an ability to change listening host and/or port
 	for !httpsServer.shutdown {
 		printHTTPAddresses("http")
 
 		// we need to have new instance, because after Shutdown() the Server is not usable
-		address := net.JoinHostPort(config.BindHost, strconv.Itoa(config.BindPort))
+		addrs := webListenAddrs()
 		httpServer = &http.Server{
-			Addr: address,
+			Addr: addrs[0],
+		}
+		httpServer.RegisterOnShutdown(stopQueryLogStreams)
+		var err error
+		if len(systemdSockets.web) != 0 {
+			err = serveSystemdWeb(httpServer)
+		} else {
+			serveAdditionalHTTP(httpServer, addrs[1:], nil, nil)
+			err = httpServer.ListenAndServe()
 		}
-		err := httpServer.ListenAndServe()
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
@@ -218,12 +286,17 @@ func httpServerLoop() {
 		httpsServer.cond.L.Lock()
 		// this mechanism doesn't let us through until all conditions are met
 		for config.TLS.Enabled == false ||
-			config.TLS.PortHTTPS == 0 ||
+			len(httpsListenAddrs())+len(config.Listen.DOH) == 0 ||
 			config.TLS.PrivateKey == "" ||
 			config.TLS.CertificateChain == "" { // sleep until necessary data is supplied
 			httpsServer.cond.Wait()
 		}
-		address := net.JoinHostPort(config.BindHost, strconv.Itoa(config.TLS.PortHTTPS))
+		addrs := httpsListenAddrs()
+		dohAddrs := config.Listen.DOH
+		var handler http.Handler // nil: the web UI and DNS-over-HTTPS
+		if len(addrs) == 0 {
+			addrs, dohAddrs, handler = dohAddrs[:1], dohAddrs[1:], dohOnlyHandler()
+		}
 		// validate current TLS config and update warnings (it could have been loaded from file)
 		data := validateCertificates(config.TLS.CertificateChain, config.TLS.PrivateKey, config.TLS.ServerName)
 		if !data.ValidPair {
@@ -234,13 +307,9 @@ func httpServerLoop() {
 		config.TLS.tlsConfigStatus = data // update warnings
 		config.Unlock()
 
-		// prepare certs for HTTPS server
-		// important -- they have to be copies, otherwise changing the contents in config.TLS will break encryption for in-flight requests
-		certchain := make([]byte, len(config.TLS.CertificateChain))
-		copy(certchain, []byte(config.TLS.CertificateChain))
-		privatekey := make([]byte, len(config.TLS.PrivateKey))
-		copy(privatekey, []byte(config.TLS.PrivateKey))
-		cert, err := tls.X509KeyPair(certchain, privatekey)
+		// prepare the certificate for HTTPS server
+		// it may be replaced later without restarting the server
+		err := setTLSCertificate(config.TLS.CertificateChain, config.TLS.PrivateKey)
 		if err != nil {
 			cleanupAlways()
 			log.Fatal(err)
@@ -248,13 +317,18 @@ func httpServerLoop() {
 		httpsServer.cond.L.Unlock()
 
 		// prepare HTTPS server
+		tlsConfig := &tls.Config{
+			GetCertificate: getTLSCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
 		httpsServer.server = &http.Server{
-			Addr: address,
-			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				MinVersion:   tls.VersionTLS12,
-			},
+			Addr:      addrs[0],
+			Handler:   handler,
+			TLSConfig: tlsConfig,
 		}
+		httpsServer.server.RegisterOnShutdown(stopQueryLogStreams)
+		serveAdditionalHTTP(httpsServer.server, addrs[1:], handler, tlsConfig)
+		serveAdditionalHTTP(httpsServer.server, dohAddrs, dohOnlyHandler(), tlsConfig)
 
 		printHTTPAddresses("https")
 		err = httpsServer.server.ListenAndServeTLS("", "")
@@ -323,54 +397,6 @@ func initWorkingDir(args options) {
 	}
 }
 
-// configureLogger configures logger level and output
-func configureLogger(args options) {
-	ls := getLogSettings()
-
-	// command-line arguments can override config settings
-	if args.verbose {
-		ls.Verbose = true
-	}
-	if args.logFile != "" {
-		ls.LogFile = args.logFile
-	}
-
-	level := log.INFO
-	if ls.Verbose {
-		level = log.DEBUG
-	}
-	log.SetLevel(level)
-
-	if args.runningAsService && ls.LogFile == "" && runtime.GOOS == "windows" {
-		// When running as a Windows service, use eventlog by default if nothing else is configured
-		// Otherwise, we'll simply loose the log output
-		ls.LogFile = configSyslog
-	}
-
-	if ls.LogFile == "" {
-		return
-	}
-
-	if ls.LogFile == configSyslog {
-		// Use syslog where it is possible and eventlog on Windows
-		err := configureSyslog()
-		if err != nil {
-			log.Fatalf("cannot initialize syslog: %s", err)
-		}
-	} else {
-		logFilePath := filepath.Join(config.ourWorkingDir, ls.LogFile)
-		if filepath.IsAbs(ls.LogFile) {
-			logFilePath = ls.LogFile
-		}
-
-		file, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-		if err != nil {
-			log.Fatalf("cannot create a log file: %s", err)
-		}
-		log.SetOutput(file)
-	}
-}
-
 // TODO after GO 1.13 release TLS 1.3 will be enabled by default. Remove this afterward
 func enableTLS13() {
 	err := os.Setenv("GODEBUG", os.Getenv("GODEBUG")+",tls13=1")
@@ -381,6 +407,8 @@ func enableTLS13() {
 
 func cleanup() {
 	log.Info("Stopping AdGuard Home")
+	sdNotify("STOPPING=1")
+	markUpdateShutdown()
 
 	err := stopDNSServer()
 	if err != nil {
@@ -421,6 +449,8 @@ type options struct {
 	checkConfig    bool   // Check configuration and exit
 	disableUpdate  bool   // If set, don't check for updates
 
+	setup setupOptions // first-run settings
+
 	// service control action (see service.ControlAction array + "status" command)
 	serviceControlAction string
 
@@ -459,6 +489,13 @@ func loadOptions() options {
 		{"pidfile", "", "Path to a file where PID is stored", func(value string) { o.pidFile = value }, nil},
 		{"check-config", "", "Check configuration and exit", nil, func() { o.checkConfig = true }},
 		{"no-check-update", "", "Don't check for updates", nil, func() { o.disableUpdate = true }},
+		{"setup-seed", "", "First run: path to the YAML file with the initial settings", func(value string) { o.setup.seedFile = value }, nil},
+		{"setup-user", "", "First run: admin user name", func(value string) { o.setup.user = value }, nil},
+		{"setup-password", "", "First run: admin password (prefer $AGH_SETUP_PASSWORD)", func(value string) { o.setup.password = value }, nil},
+		{"setup-web", "", "First run: IP:port of the web interface", func(value string) { o.setup.web = value }, nil},
+		{"setup-dns", "", "First run: IP:port of the DNS server", func(value string) { o.setup.dns = value }, nil},
+		{"setup-upstreams", "", "First run: comma-separated upstream DNS servers", func(value string) { o.setup.upstreams = value }, nil},
+		{"setup-filters", "", "First run: comma-separated filter list URLs or 'none'", func(value string) { o.setup.filters = value }, nil},
 		{"verbose", "v", "Enable verbose output", nil, func() { o.verbose = true }},
 		{"help", "", "Print this help", nil, func() {
 			printHelp()
@@ -480,6 +517,7 @@ func loadOptions() options {
 				fmt.Printf("  %-34s %s\n", "--"+opt.longName+val, opt.description)
 			}
 		}
+		fmt.Printf("\nRun \"%s status|filter|client|querylog|config\" to manage the running instance\n", os.Args[0])
 	}
 	for i := 1; i < len(os.Args); i++ {
 		v := os.Args[i]
@@ -515,6 +553,13 @@ func loadOptions() options {
 func printHTTPAddresses(proto string) {
 	var address string
 
+	if proto == "http" && len(config.Listen.Web) != 0 {
+		for _, addr := range config.Listen.Web {
+			log.Printf("Go to http://%s", addr)
+		}
+		return
+	}
+
 	if proto == "https" && config.TLS.ServerName != "" {
 		if config.TLS.PortHTTPS == 443 {
 			log.Printf("Go to https://%s", config.TLS.ServerName)
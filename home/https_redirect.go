@@ -0,0 +1,79 @@
+// Serving the web interface only over HTTPS
+// With tls.force_https the requests over plain HTTP are redirected to the HTTPS listener,
+//  the responses over HTTPS have Strict-Transport-Security header,
+//  and the credentials are never asked for over plain HTTP.
+
+package home
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const hstsDefaultMaxAge = 365 * 24 * 60 * 60 // seconds
+
+// Return TRUE if the requests over plain HTTP must be redirected to HTTPS
+func httpsRedirectEnabled() bool {
+	return config.TLS.ForceHTTPS && config.TLS.Enabled && len(httpsListenAddrs()) != 0 && httpsServer.server != nil
+}
+
+// Get the URL of the same page on the HTTPS listener
+func httpsRedirectURL(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // no port
+	}
+	port := config.TLS.PortHTTPS
+	a, err := parseListenAddr(httpsListenAddrs()[0])
+	if err == nil {
+		port = a.Port
+	}
+	if port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	return u.String()
+}
+
+// Redirect the request over plain HTTP to HTTPS
+// Return TRUE if the request has been handled.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) bool {
+	if r.TLS != nil || !httpsRedirectEnabled() {
+		return false
+	}
+	// 307: the method and the body are preserved
+	http.Redirect(w, r, httpsRedirectURL(r), http.StatusTemporaryRedirect)
+	return true
+}
+
+// Get the value of Strict-Transport-Security header
+func hstsHeaderValue(s tlsConfigSettings) string {
+	maxAge := s.HSTSMaxAge
+	if maxAge == 0 {
+		maxAge = hstsDefaultMaxAge
+	}
+	val := fmt.Sprintf("max-age=%d", maxAge)
+	if s.HSTSIncludeSubdomains {
+		val += "; includeSubDomains"
+	}
+	return val
+}
+
+// Tell the browser to use only HTTPS for this host from now on
+// The header is ignored by the browsers over plain HTTP, so it's sent over HTTPS only.
+func setHSTSHeader(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || !config.TLS.ForceHTTPS {
+		return
+	}
+	w.Header().Set("Strict-Transport-Security", hstsHeaderValue(config.TLS.tlsConfigSettings))
+}
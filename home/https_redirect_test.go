@@ -0,0 +1,56 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	tlsConf, listen, srv := config.TLS, config.Listen, httpsServer.server
+	defer func() {
+		config.TLS, config.Listen, httpsServer.server = tlsConf, listen, srv
+	}()
+	config.Listen = listenConfig{}
+	config.TLS.Enabled = true
+	config.TLS.ForceHTTPS = true
+	config.TLS.PortHTTPS = 8443
+	httpsServer.server = &http.Server{}
+
+	r := httptest.NewRequest("POST", "http://example.org:3000/control/status?a=1", nil)
+	w := httptest.NewRecorder()
+	if !redirectToHTTPS(w, r) || w.Code != http.StatusTemporaryRedirect ||
+		w.Header().Get("Location") != "https://example.org:8443/control/status?a=1" {
+		t.Fatalf("redirect: %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	config.TLS.PortHTTPS = 443
+	r = httptest.NewRequest("GET", "http://[::1]:3000/", nil)
+	if httpsRedirectURL(r) != "https://[::1]/" {
+		t.Fatalf("redirect: %s", httpsRedirectURL(r))
+	}
+
+	// over HTTPS
+	r = httptest.NewRequest("GET", "https://example.org/", nil)
+	w = httptest.NewRecorder()
+	if redirectToHTTPS(w, r) {
+		t.Fatalf("redirect over HTTPS")
+	}
+	setHSTSHeader(w, r)
+	if w.Header().Get("Strict-Transport-Security") != "max-age=31536000" {
+		t.Fatalf("HSTS: %s", w.Header().Get("Strict-Transport-Security"))
+	}
+
+	config.TLS.ForceHTTPS = false
+	r = httptest.NewRequest("GET", "http://example.org/", nil)
+	if redirectToHTTPS(httptest.NewRecorder(), r) {
+		t.Fatalf("redirect without force_https")
+	}
+}
+
+func TestHSTSHeaderValue(t *testing.T) {
+	s := tlsConfigSettings{HSTSMaxAge: 600, HSTSIncludeSubdomains: true}
+	if hstsHeaderValue(s) != "max-age=600; includeSubDomains" {
+		t.Fatalf("HSTS: %s", hstsHeaderValue(s))
+	}
+}
@@ -5,8 +5,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
-
-	"github.com/AdguardTeam/golibs/log"
 )
 
 // --------------------
@@ -0,0 +1,352 @@
+// Listen addresses of the services
+// Every service may listen on several addresses.  An empty list means the address from the older settings:
+//  web:   bind_host:bind_port
+//  https: bind_host:tls.port_https
+//  dns:   dns.bind_host:dns.port
+//  dot:   dns.bind_host:tls.port_dns_over_tls
+// The DHCP server binds to its own interface (dhcp.interface_name).
+
+package home
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+)
+
+type listenConfig struct {
+	Web   []string `yaml:"web" json:"web"`     // web UI over HTTP
+	HTTPS []string `yaml:"https" json:"https"` // web UI and DNS-over-HTTPS
+	DOH   []string `yaml:"doh" json:"doh"`     // DNS-over-HTTPS only, without web UI
+	DNS   []string `yaml:"dns" json:"dns"`     // plain DNS over UDP and TCP
+	DOT   []string `yaml:"dot" json:"dot"`     // DNS-over-TLS
+}
+
+func webListenAddrs() []string {
+	if len(config.Listen.Web) != 0 {
+		return config.Listen.Web
+	}
+	return []string{net.JoinHostPort(config.BindHost, strconv.Itoa(config.BindPort))}
+}
+
+func httpsListenAddrs() []string {
+	if len(config.Listen.HTTPS) != 0 {
+		return config.Listen.HTTPS
+	}
+	if config.TLS.PortHTTPS == 0 {
+		return nil
+	}
+	return []string{net.JoinHostPort(config.BindHost, strconv.Itoa(config.TLS.PortHTTPS))}
+}
+
+func dnsListenAddrs() []string {
+	if len(config.Listen.DNS) != 0 {
+		return config.Listen.DNS
+	}
+	return []string{net.JoinHostPort(config.DNS.BindHost, strconv.Itoa(config.DNS.Port))}
+}
+
+func dotListenAddrs() []string {
+	if len(config.Listen.DOT) != 0 {
+		return config.Listen.DOT
+	}
+	if config.TLS.PortDNSOverTLS == 0 {
+		return nil
+	}
+	return []string{net.JoinHostPort(config.DNS.BindHost, strconv.Itoa(config.TLS.PortDNSOverTLS))}
+}
+
+// Get the address of our DNS server for our own requests
+func dnsResolverAddress() string {
+	host, port, _ := net.SplitHostPort(dnsListenAddrs()[0])
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Parse "IP:port" (the IP may be empty: all interfaces)
+func parseListenAddr(addr string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	if len(host) != 0 {
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("%s: invalid IP address", addr)
+		}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 0xffff {
+		return nil, fmt.Errorf("%s: invalid port", addr)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func toTCPAddrs(addrs []string) []*net.TCPAddr {
+	list := []*net.TCPAddr{}
+	for _, addr := range addrs {
+		a, err := parseListenAddr(addr)
+		if err != nil {
+			log.Error("listen: %s", err)
+			continue
+		}
+		list = append(list, a)
+	}
+	return list
+}
+
+// Check the addresses and bring them to the canonical form
+// An address may be used by a single TCP service only
+func (c *listenConfig) validate() error {
+	used := map[string]string{}
+	lists := []struct {
+		name  string
+		addrs *[]string
+	}{
+		{"web", &c.Web}, {"https", &c.HTTPS}, {"doh", &c.DOH}, {"dns", &c.DNS}, {"dot", &c.DOT},
+	}
+	for _, l := range lists {
+		norm := []string{}
+		for _, addr := range *l.addrs {
+			a, err := parseListenAddr(addr)
+			if err != nil {
+				return fmt.Errorf("%s: %s", l.name, err)
+			}
+			s := a.String()
+			if prev, ok := used[s]; ok {
+				return fmt.Errorf("%s: %s is used by %s already", l.name, s, prev)
+			}
+			used[s] = l.name
+			norm = append(norm, s)
+		}
+		*l.addrs = norm
+	}
+	return nil
+}
+
+// Check that the new addresses can be bound
+func checkListenAddrsAvailable(addrs, current []string, udp bool) error {
+	for _, addr := range addrs {
+		inUse := false
+		for _, cur := range current {
+			inUse = inUse || addr == cur
+		}
+		if inUse {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		err := checkPortAvailable(host, p)
+		if err == nil && udp {
+			err = checkPacketPortAvailable(host, p)
+		}
+		if err != nil {
+			return fmt.Errorf("%s is not available: %s", addr, err)
+		}
+	}
+	return nil
+}
+
+// Set the older settings to the first addresses, so they still describe the primary listeners
+// The addresses must be validated.  The config lock must be held.
+func applyListenConfig(c listenConfig) {
+	config.Listen = c
+	if len(c.Web) != 0 {
+		a, _ := parseListenAddr(c.Web[0])
+		config.BindHost, config.BindPort = listenHost(a), a.Port
+	}
+	if len(c.DNS) != 0 {
+		a, _ := parseListenAddr(c.DNS[0])
+		config.DNS.BindHost, config.DNS.Port = listenHost(a), a.Port
+	}
+	if len(c.HTTPS) != 0 {
+		a, _ := parseListenAddr(c.HTTPS[0])
+		config.TLS.PortHTTPS = a.Port
+	}
+	if len(c.DOT) != 0 {
+		a, _ := parseListenAddr(c.DOT[0])
+		config.TLS.PortDNSOverTLS = a.Port
+	}
+}
+
+func listenHost(a *net.TCPAddr) string {
+	if a.IP == nil {
+		return "0.0.0.0"
+	}
+	return a.IP.String()
+}
+
+// Start HTTP servers on the additional addresses
+// They're stopped together with the primary server.
+func serveAdditionalHTTP(primary *http.Server, addrs []string, handler http.Handler, tlsConfig *tls.Config) {
+	for _, addr := range addrs {
+		srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+		srv.RegisterOnShutdown(stopQueryLogStreams)
+		primary.RegisterOnShutdown(func() { _ = srv.Shutdown(context.TODO()) })
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				log.Printf("Listening to https://%s", srv.Addr)
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				log.Printf("Listening to http://%s", srv.Addr)
+				err = srv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				log.Error("Couldn't listen on %s: %s", srv.Addr, err)
+			}
+		}()
+	}
+}
+
+// The handler of the listeners which serve only DNS-over-HTTPS
+func dohOnlyHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dnsforward.DOHPath, postInstall(handleDOH))
+	mux.HandleFunc(dnsforward.DOHPath+"/", postInstall(handleDOH))
+	return mux
+}
+
+// Get the addresses the services are listening on
+// The config lock must be held.
+func effectiveListenConfig() listenConfig {
+	c := listenConfig{
+		Web:   webListenAddrs(),
+		HTTPS: httpsListenAddrs(),
+		DOH:   config.Listen.DOH,
+		DNS:   dnsListenAddrs(),
+		DOT:   dotListenAddrs(),
+	}
+	for _, l := range []*[]string{&c.HTTPS, &c.DOH, &c.DOT} {
+		if *l == nil {
+			*l = []string{}
+		}
+	}
+	return c
+}
+
+type listenJSON struct {
+	listenConfig
+	DHCPInterface string `json:"dhcp_interface"` // changed by /control/dhcp/set_config
+}
+
+func handleListenStatus(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	resp := listenJSON{
+		listenConfig:  effectiveListenConfig(),
+		DHCPInterface: config.DHCP.InterfaceName,
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Set the listen addresses and restart the listeners which have changed
+func handleListenSet(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := listenConfig{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	err = req.validate()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	config.RLock()
+	cur := effectiveListenConfig()
+	config.RUnlock()
+	// the running listeners may be bound to any address of their service
+	curHTTPS := append(append([]string{}, cur.HTTPS...), cur.DOH...)
+	for _, c := range []struct {
+		addrs, current []string
+		udp            bool
+	}{
+		{req.Web, cur.Web, false},
+		{req.HTTPS, curHTTPS, false},
+		{req.DOH, curHTTPS, false},
+		{req.DNS, cur.DNS, true},
+		{req.DOT, cur.DOT, false},
+	} {
+		err = checkListenAddrsAvailable(c.addrs, c.current, c.udp)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+	}
+
+	config.Lock()
+	applyListenConfig(req)
+	next := effectiveListenConfig()
+	config.Unlock()
+
+	restartWeb := !stringsEqual(next.Web, cur.Web)
+	restartHTTPS := !stringsEqual(next.HTTPS, cur.HTTPS) || !stringsEqual(next.DOH, cur.DOH)
+	if !stringsEqual(next.DNS, cur.DNS) || !stringsEqual(next.DOT, cur.DOT) {
+		err = writeAllConfigsAndReloadDNS()
+	} else {
+		err = writeAllConfigs()
+	}
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't apply the settings: %s", err)
+		return
+	}
+	returnOK(w)
+
+	// Shutdown() waits for the requests to finish, and we're inside a request right now
+	go func() {
+		time.Sleep(time.Second) // let the response through
+		if restartHTTPS {
+			httpsServer.cond.L.Lock()
+			httpsServer.cond.Broadcast()
+			if httpsServer.server != nil {
+				_ = httpsServer.server.Shutdown(context.TODO())
+			}
+			httpsServer.cond.L.Unlock()
+		}
+		if restartWeb {
+			_ = httpServer.Shutdown(context.TODO())
+		}
+	}()
+}
+
+func registerListenHandlers() {
+	http.HandleFunc("/control/listen", postInstall(optionalAuth(ensureGET(handleListenStatus))))
+	http.HandleFunc("/control/listen/set", postInstall(optionalAuth(ensurePOST(handleListenSet))))
+}
@@ -0,0 +1,55 @@
+package home
+
+import (
+	"testing"
+)
+
+func TestListenConfig(t *testing.T) {
+	c := listenConfig{
+		Web:   []string{"127.0.0.1:3000", "[::1]:3000"},
+		HTTPS: []string{"192.168.1.1:8443"},
+		DNS:   []string{"0.0.0.0:53", "[::]:5353"},
+	}
+	err := c.validate()
+	if err != nil {
+		t.Fatalf("validate: %s", err)
+	}
+	if c.DOT == nil || c.Web[1] != "[::1]:3000" {
+		t.Fatalf("validate: %+v", c)
+	}
+
+	for _, bad := range []listenConfig{
+		{Web: []string{"localhost:80"}},
+		{Web: []string{"127.0.0.1"}},
+		{DNS: []string{"127.0.0.1:0"}},
+		{Web: []string{"127.0.0.1:853"}, DOT: []string{"127.0.0.1:853"}},
+	} {
+		if bad.validate() == nil {
+			t.Fatalf("validate: %+v must fail", bad)
+		}
+	}
+
+	listen, bindHost, bindPort, dnsConf, tlsConf := config.Listen, config.BindHost, config.BindPort, config.DNS, config.TLS
+	defer func() {
+		config.Listen, config.BindHost, config.BindPort, config.DNS, config.TLS = listen, bindHost, bindPort, dnsConf, tlsConf
+	}()
+	config.TLS.PortHTTPS = 443
+	config.TLS.PortDNSOverTLS = 853
+	applyListenConfig(c)
+	if config.BindHost != "127.0.0.1" || config.BindPort != 3000 || config.DNS.BindHost != "0.0.0.0" ||
+		config.DNS.Port != 53 || config.TLS.PortHTTPS != 8443 {
+		t.Fatalf("applyListenConfig: %s:%d %s:%d %d", config.BindHost, config.BindPort, config.DNS.BindHost, config.DNS.Port, config.TLS.PortHTTPS)
+	}
+	// DNS-over-TLS uses the older settings
+	addrs := dotListenAddrs()
+	if len(addrs) != 1 || addrs[0] != "0.0.0.0:853" {
+		t.Fatalf("dotListenAddrs: %v", addrs)
+	}
+	if dnsResolverAddress() != "127.0.0.1:53" {
+		t.Fatalf("dnsResolverAddress: %s", dnsResolverAddress())
+	}
+	config.Listen.DNS = []string{"[::]:5353"}
+	if dnsResolverAddress() != "[::1]:5353" {
+		t.Fatalf("dnsResolverAddress: %s", dnsResolverAddress())
+	}
+}
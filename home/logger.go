@@ -0,0 +1,533 @@
+// Structured logging
+// Our packages write the messages with their own loggers (package logging): the level of the subsystem
+//  is checked before a message is formatted, and the message is written in the selected format.
+// The subsystems are home, dnsforward, dnsfilter, dhcpd, acme, dnsproxy, or "other" for the rest.
+// Each subsystem may have its own level ("log_levels"), the others use the default one ("log_level" or "verbose").
+//  The levels are changed at runtime by /control/log_config.
+// dnsproxy and the other libraries write to the standard logger via golibs/log, its output is logWriter,
+//  which finds the subsystem by the caller and writes the message like ours.
+//  The level of golibs/log is the highest level of these subsystems only.
+// The format ("log_format") is "text": the same lines as before, or "json": an object per line.
+// The log file is rotated when it's larger than "log_max_size" MB or older than "log_max_age" days,
+//  the previous files are named "AdGuardHome-2019-10-16T20-47-26.log", "log_max_backups" of them are kept.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/logging"
+	golibslog "github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	logFormatText = logging.FormatText
+	logFormatJSON = logging.FormatJSON
+)
+
+const logSubsystemOther = "other"
+
+// The subsystems whose levels may be set
+var logSubsystems = []string{"home", "dnsforward", "dnsfilter", "dhcpd", "acme", "dnsproxy", logSubsystemOther}
+
+var logLevelNames = map[string]int{
+	"error": logging.ERROR,
+	"info":  logging.INFO,
+	"debug": logging.DEBUG,
+}
+
+// The time in the names of the rotated files
+const logBackupTimeFormat = "2006-01-02T15-04-05"
+
+// A line written by golibs/log: "PID#GOID [LEVEL] FUNCNAME(): TEXT", PID#GOID is written only in debug mode
+var logLineRegexp = regexp.MustCompile(`^(?:(\d+#\d+) )?\[(\w+)\] (?:(\S+)\(\): )?`)
+
+// The logging settings in use and the output
+// It's also the output of the standard logger.
+type logWriter struct {
+	lock   sync.Mutex
+	out    io.Writer
+	format string
+	level  int            // the default level
+	levels map[string]int // subsystem -> level
+}
+
+var logger = &logWriter{out: os.Stderr, format: logFormatText, level: logging.INFO}
+
+// Get the level by its name ("": the default one)
+func parseLogLevel(name string, def int) (int, error) {
+	if len(name) == 0 {
+		return def, nil
+	}
+	level, ok := logLevelNames[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid log level %q: must be error, info or debug", name)
+	}
+	return level, nil
+}
+
+func logLevelName(level int) string {
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return ""
+}
+
+func validLogSubsystem(name string) bool {
+	for _, s := range logSubsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validateLogSettings(ls logSettings) error {
+	if ls.LogFormat != "" && ls.LogFormat != logFormatText && ls.LogFormat != logFormatJSON {
+		return fmt.Errorf("invalid log_format %q: must be %s or %s", ls.LogFormat, logFormatText, logFormatJSON)
+	}
+	_, err := parseLogLevel(ls.LogLevel, logging.INFO)
+	if err != nil {
+		return err
+	}
+	for name, level := range ls.LogLevels {
+		if !validLogSubsystem(name) {
+			return fmt.Errorf("invalid log_levels: unknown subsystem %q", name)
+		}
+		_, err = parseLogLevel(level, logging.INFO)
+		if err != nil {
+			return fmt.Errorf("invalid log_levels: %s", err)
+		}
+	}
+	if ls.LogMaxSize < 0 || ls.LogMaxAge < 0 || ls.LogMaxBackups < 0 {
+		return fmt.Errorf("log_max_size, log_max_age and log_max_backups must not be negative")
+	}
+	return nil
+}
+
+// Apply the format and the levels
+func (l *logWriter) configure(ls logSettings) {
+	def := logging.INFO
+	if ls.Verbose {
+		def = logging.DEBUG
+	}
+	def, _ = parseLogLevel(ls.LogLevel, def)
+	levels := map[string]int{}
+	for name, s := range ls.LogLevels {
+		level, err := parseLogLevel(s, def)
+		if err != nil || !validLogSubsystem(name) {
+			continue
+		}
+		levels[name] = level
+	}
+	format := logFormatText
+	if ls.LogFormat == logFormatJSON {
+		format = logFormatJSON
+	}
+
+	l.lock.Lock()
+	l.format = format
+	l.level = def
+	l.levels = levels
+	if f, ok := l.out.(*rotatingFile); ok {
+		f.setLimits(ls)
+	}
+	l.lock.Unlock()
+	logging.Configure(format, def, levels)
+
+	// golibs/log formats only the messages which may be written by the libraries
+	max := logging.Level("dnsproxy")
+	if level := logging.Level(logSubsystemOther); level > max {
+		max = level
+	}
+	golibslog.SetLevel(max)
+}
+
+// Set the output, the previous one is closed if it's a file
+func (l *logWriter) setOutput(w io.Writer) {
+	l.lock.Lock()
+	if f, ok := l.out.(*rotatingFile); ok {
+		defer f.close()
+	}
+	l.out = w
+	l.lock.Unlock()
+	logging.SetOutput(w)
+}
+
+// Get the settings which are in use
+func (l *logWriter) settings() logSettings {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ls := logSettings{
+		LogFormat: l.format,
+		LogLevel:  logLevelName(l.level),
+		LogLevels: map[string]string{},
+	}
+	for name, level := range l.levels {
+		ls.LogLevels[name] = logLevelName(level)
+	}
+	return ls
+}
+
+// Get the subsystem by the function name, e.g. "github.com/AdguardTeam/AdGuardHome/dnsforward.(*Server).Start"
+func logSubsystem(funcName string) string {
+	const aghPackages = "github.com/AdguardTeam/AdGuardHome/"
+	pkg := funcName
+	i := strings.LastIndexByte(pkg, '/')
+	j := strings.IndexByte(pkg[i+1:], '.')
+	if j >= 0 {
+		pkg = pkg[:i+1+j]
+	}
+
+	switch {
+	case pkg == "main":
+		return "home"
+	case strings.HasPrefix(pkg, aghPackages):
+		name := strings.SplitN(pkg[len(aghPackages):], "/", 2)[0]
+		if validLogSubsystem(name) {
+			return name
+		}
+	case strings.HasPrefix(pkg, "github.com/AdguardTeam/dnsproxy/"):
+		return "dnsproxy"
+	}
+	return logSubsystemOther
+}
+
+// Get the function which has logged the message: the first caller outside of the loggers
+func logCaller() string {
+	pc := make([]uintptr, 16)
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "log.") &&
+			!strings.HasPrefix(f.Function, "github.com/AdguardTeam/golibs/log.") {
+			return f.Function
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// Parse the line written by golibs/log
+func parseLogLine(line string) logging.Entry {
+	e := logging.Entry{Level: "info", Msg: line}
+	m := logLineRegexp.FindStringSubmatch(line)
+	if m != nil {
+		e.Goroutine, e.Level, e.Func = m[1], m[2], m[3]
+		e.Msg = line[len(m[0]):]
+	}
+	return e
+}
+
+// Write a message of the standard logger
+func (l *logWriter) Write(b []byte) (int, error) {
+	e := parseLogLine(strings.TrimSuffix(string(b), "\n"))
+	e.Time = time.Now()
+	e.Subsystem = logSubsystem(logCaller())
+
+	level := logging.Level(e.Subsystem)
+	msgLevel, ok := logLevelNames[e.Level]
+	if ok && msgLevel > level {
+		return len(b), nil
+	}
+	if level < logging.DEBUG {
+		e.Goroutine = ""
+	}
+	err := logging.Write(&e)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// The log file which is rotated by size and age
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64         // 0: unlimited
+	maxAge     time.Duration // 0: unlimited
+	maxBackups int           // 0: all files are kept
+	file       *os.File
+	size       int64
+	started    time.Time // when the messages started to be written to this file
+}
+
+func openRotatingFile(path string, ls logSettings) (*rotatingFile, error) {
+	f := &rotatingFile{path: path}
+	f.setLimits(ls)
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) setLimits(ls logSettings) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.maxSize = int64(ls.LogMaxSize) * 1024 * 1024
+	f.maxAge = time.Duration(ls.LogMaxAge) * 24 * time.Hour
+	f.maxBackups = ls.LogMaxBackups
+}
+
+// Open the log file
+// The file was started when the previous one was rotated.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = st.Size()
+	f.started = time.Now()
+	backups := f.backups()
+	if f.size != 0 && len(backups) != 0 {
+		f.started = backups[len(backups)-1].t
+	}
+	return nil
+}
+
+func (f *rotatingFile) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closeFile()
+}
+
+func (f *rotatingFile) closeFile() {
+	if f.file != nil {
+		_ = f.file.Close()
+		f.file = nil
+	}
+}
+
+// A rotated log file
+type logBackup struct {
+	path string
+	t    time.Time
+}
+
+// Get the rotated files, the oldest first
+func (f *rotatingFile) backups() []logBackup {
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, ext) + "-"
+	names, _ := filepath.Glob(prefix + "*" + ext)
+	backups := []logBackup{}
+	for _, name := range names {
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		t, err := time.ParseInLocation(logBackupTimeFormat, ts, time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, logBackup{path: name, t: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].t.Before(backups[j].t) })
+	return backups
+}
+
+// Rename the log file and start a new one
+func (f *rotatingFile) rotate(now time.Time) error {
+	ext := filepath.Ext(f.path)
+	name := strings.TrimSuffix(f.path, ext) + "-" + now.Format(logBackupTimeFormat) + ext
+	f.closeFile()
+	err := os.Rename(f.path, name)
+	if err != nil {
+		return err
+	}
+
+	backups := f.backups()
+	if f.maxBackups != 0 && len(backups) > f.maxBackups {
+		for _, b := range backups[:len(backups)-f.maxBackups] {
+			_ = os.Remove(b.path)
+		}
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	if f.file != nil && f.size != 0 &&
+		((f.maxSize != 0 && f.size+int64(len(b)) > f.maxSize) ||
+			(f.maxAge != 0 && now.Sub(f.started) >= f.maxAge)) {
+		err := f.rotate(now)
+		if err != nil {
+			// keep writing to the same file
+			fmt.Fprintf(os.Stderr, "couldn't rotate the log file: %s\n", err)
+		}
+	}
+	if f.file == nil {
+		err := f.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// configureLogger configures logger level and output
+func configureLogger(args options) {
+	ls := getLogSettings()
+
+	// command-line arguments can override config settings
+	if args.verbose {
+		ls.Verbose = true
+		ls.LogLevel = "debug"
+	}
+	if args.logFile != "" {
+		ls.LogFile = args.logFile
+	}
+
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logger)
+	logger.configure(ls)
+
+	if args.runningAsService && ls.LogFile == "" && runtime.GOOS == "windows" {
+		// When running as a Windows service, use eventlog by default if nothing else is configured
+		// Otherwise, we'll simply loose the log output
+		ls.LogFile = configSyslog
+	}
+
+	if ls.LogFile == "" {
+		return
+	}
+
+	if ls.LogFile == configSyslog {
+		// Use syslog where it is possible and eventlog on Windows
+		w, err := syslogWriter()
+		if err != nil {
+			log.Fatalf("cannot initialize syslog: %s", err)
+		}
+		logger.setOutput(w)
+	} else {
+		logFilePath := filepath.Join(config.ourWorkingDir, ls.LogFile)
+		if filepath.IsAbs(ls.LogFile) {
+			logFilePath = ls.LogFile
+		}
+
+		file, err := openRotatingFile(logFilePath, ls)
+		if err != nil {
+			log.Fatalf("cannot create a log file: %s", err)
+		}
+		logger.setOutput(file)
+	}
+}
+
+type logConfigJSON struct {
+	Format     string            `json:"format"`
+	Level      string            `json:"level"`
+	Levels     map[string]string `json:"levels"`
+	MaxSize    int               `json:"max_size"`
+	MaxAge     int               `json:"max_age"`
+	MaxBackups int               `json:"max_backups"`
+	Subsystems []string          `json:"subsystems"`
+}
+
+func handleGetLogConfig(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	ls := logger.settings()
+	config.RLock()
+	j := logConfigJSON{
+		Format:     ls.LogFormat,
+		Level:      ls.LogLevel,
+		Levels:     ls.LogLevels,
+		MaxSize:    config.LogMaxSize,
+		MaxAge:     config.LogMaxAge,
+		MaxBackups: config.LogMaxBackups,
+		Subsystems: logSubsystems,
+	}
+	config.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// Change the logging settings: the fields which aren't specified are not changed
+func handleSetLogConfig(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	ls := logger.settings()
+	config.RLock()
+	ls.LogFile = config.LogFile
+	ls.LogMaxSize = config.LogMaxSize
+	ls.LogMaxAge = config.LogMaxAge
+	ls.LogMaxBackups = config.LogMaxBackups
+	config.RUnlock()
+
+	j := logConfigJSON{
+		Format:     ls.LogFormat,
+		Level:      ls.LogLevel,
+		Levels:     ls.LogLevels,
+		MaxSize:    ls.LogMaxSize,
+		MaxAge:     ls.LogMaxAge,
+		MaxBackups: ls.LogMaxBackups,
+	}
+	err := json.NewDecoder(r.Body).Decode(&j)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	ls.LogFormat = j.Format
+	ls.LogLevel = j.Level
+	ls.LogLevels = j.Levels
+	ls.LogMaxSize = j.MaxSize
+	ls.LogMaxAge = j.MaxAge
+	ls.LogMaxBackups = j.MaxBackups
+	ls.Verbose = ls.LogLevel == "debug"
+	err = validateLogSettings(ls)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	logger.configure(ls)
+	config.Lock()
+	config.logSettings = ls
+	config.Unlock()
+	err = config.write()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+// GET: the logging settings, POST: change them
+func handleLogConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		ensurePOST(handleSetLogConfig)(w, r)
+		return
+	}
+	ensureGET(handleGetLogConfig)(w, r)
+}
+
+func registerLogHandlers() {
+	http.HandleFunc("/control/log_config", postInstall(optionalAuth(handleLogConfig)))
+}
@@ -0,0 +1,135 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/logging"
+	golibslog "github.com/AdguardTeam/golibs/log"
+)
+
+func TestLogWriter(t *testing.T) {
+	if logSubsystem("github.com/AdguardTeam/AdGuardHome/dnsforward.(*Server).Start") != "dnsforward" ||
+		logSubsystem("github.com/AdguardTeam/dnsproxy/upstream.(*dnsOverTLS).Exchange") != "dnsproxy" ||
+		logSubsystem("main.main") != "home" ||
+		logSubsystem("github.com/miekg/dns.(*Server).serve") != logSubsystemOther {
+		t.Fatalf("logSubsystem")
+	}
+	e := parseLogLine("123#45 [debug] github.com/AdguardTeam/AdGuardHome/home.handleStatus(): GET /control/status")
+	if e.Goroutine != "123#45" || e.Level != "debug" || e.Func != "github.com/AdguardTeam/AdGuardHome/home.handleStatus" ||
+		e.Msg != "GET /control/status" {
+		t.Fatalf("parseLogLine: %+v", e)
+	}
+
+	if validateLogSettings(logSettings{LogLevels: map[string]string{"dnsforward": "trace"}}) == nil ||
+		validateLogSettings(logSettings{LogLevels: map[string]string{"querylog": "debug"}}) == nil ||
+		validateLogSettings(logSettings{LogFormat: "xml"}) == nil ||
+		validateLogSettings(logSettings{LogFormat: logFormatJSON, LogLevel: "error", LogMaxSize: 10}) != nil {
+		t.Fatalf("validateLogSettings")
+	}
+
+	buf := &bytes.Buffer{}
+	l := &logWriter{}
+	l.setOutput(buf)
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(l)
+	level := golibslog.GetLevel()
+	defer func() {
+		stdlog.SetFlags(stdlog.LstdFlags)
+		stdlog.SetOutput(os.Stderr)
+		golibslog.SetLevel(level)
+		logging.SetOutput(os.Stderr)
+		logging.Configure(logFormatText, logging.INFO, nil)
+	}()
+
+	// debug messages of "home" only, the level of the libraries isn't raised
+	l.configure(logSettings{LogFormat: logFormatJSON, LogLevel: "error", LogLevels: map[string]string{"home": "debug"}})
+	if golibslog.GetLevel() != logging.ERROR {
+		t.Fatalf("level: %d", golibslog.GetLevel())
+	}
+	log.With("client", "1.2.3.4").Debug("debug %d", 1)
+	j := struct {
+		Time      string            `json:"time"`
+		Level     string            `json:"level"`
+		Subsystem string            `json:"subsystem"`
+		Msg       string            `json:"msg"`
+		Fields    map[string]string `json:"fields"`
+	}{}
+	err := json.Unmarshal(buf.Bytes(), &j)
+	if err != nil || j.Level != "debug" || j.Subsystem != "home" || j.Msg != "debug 1" || len(j.Time) == 0 ||
+		j.Fields["client"] != "1.2.3.4" {
+		t.Fatalf("json: %s", buf.String())
+	}
+
+	buf.Reset()
+	l.configure(logSettings{LogLevel: "error", LogLevels: map[string]string{"dnsforward": "debug", "dnsproxy": "info"}})
+	log.Info("info")
+	if buf.Len() != 0 {
+		t.Fatalf("filtered: %s", buf.String())
+	}
+	log.Error("error")
+	if !strings.HasSuffix(buf.String(), " [error] [home] error\n") {
+		t.Fatalf("text: %s", buf.String())
+	}
+
+	// the messages of the libraries
+	if golibslog.GetLevel() != logging.INFO {
+		t.Fatalf("level: %d", golibslog.GetLevel())
+	}
+	l.configure(logSettings{LogLevel: "info"})
+	buf.Reset()
+	golibslog.Info("library")
+	if !strings.HasSuffix(buf.String(), " [info] [home] library\n") {
+		t.Fatalf("library: %s", buf.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "AdGuardHome.log")
+	old := filepath.Join(dir, "AdGuardHome-2019-10-16T20-47-26.log")
+	_ = ioutil.WriteFile(old, []byte("old\n"), 0644)
+
+	f, err := openRotatingFile(path, logSettings{LogMaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	f.maxSize = 10
+	_, _ = f.Write([]byte("12345678\n"))
+	_, _ = f.Write([]byte("next\n"))
+
+	backups := f.backups()
+	if len(backups) != 1 || backups[0].path == old {
+		t.Fatalf("backups: %+v", backups)
+	}
+	data, _ := ioutil.ReadFile(backups[0].path)
+	if string(data) != "12345678\n" {
+		t.Fatalf("backup: %q", data)
+	}
+	data, _ = ioutil.ReadFile(path)
+	if string(data) != "next\n" {
+		t.Fatalf("log file: %q", data)
+	}
+
+	// by age
+	f.maxSize = 0
+	f.maxAge = time.Hour
+	f.started = f.started.Add(-2 * time.Hour)
+	_, _ = f.Write([]byte("new\n"))
+	data, _ = ioutil.ReadFile(path)
+	if string(data) != "new\n" {
+		t.Fatalf("log file: %q", data)
+	}
+}
@@ -5,8 +5,6 @@ package home
 import (
 	"os"
 	"syscall"
-
-	"github.com/AdguardTeam/golibs/log"
 )
 
 // Set user-specified limit of how many fd's we can use
@@ -25,3 +23,12 @@ func setRlimit(val uint) {
 func haveAdminRights() (bool, error) {
 	return os.Getuid() == 0, nil
 }
+
+// Get the ID of the user who owns the file
+func getFileOwnerID(fi os.FileInfo) (int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Uid), true
+}
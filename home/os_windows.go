@@ -1,6 +1,10 @@
 package home
 
-import "golang.org/x/sys/windows"
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
 
 // Set user-specified limit of how many fd's we can use
 func setRlimit(val uint) {
@@ -26,3 +30,8 @@ func haveAdminRights() (bool, error) {
 	}
 	return true, nil
 }
+
+// File ownership isn't supported
+func getFileOwnerID(fi os.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,83 @@
+// Vendors of the LAN devices
+// The vendor is found by the first 3 bytes of the device's MAC address (OUI) in the IEEE registry file,
+// which is installed by many Linux distributions (ieee-data, hwdata packages) or set with oui_file setting.
+
+package home
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The default locations of the IEEE registry file
+var ouiFilePaths = []string{
+	"/usr/share/ieee-data/oui.txt",
+	"/usr/share/hwdata/oui.txt",
+	"/usr/share/misc/oui.txt",
+}
+
+var ouiVendors struct {
+	once    sync.Once
+	vendors map[[3]byte]string
+}
+
+// Parse the IEEE registry file: the lines "00-00-0C   (hex)		Cisco Systems, Inc"
+func parseOUI(r io.Reader) (map[[3]byte]string, error) {
+	vendors := map[[3]byte]string{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		ln := sc.Text()
+		i := strings.Index(ln, "(hex)")
+		if i <= 0 {
+			continue
+		}
+		b, err := hex.DecodeString(strings.Replace(strings.TrimSpace(ln[:i]), "-", "", -1))
+		if err != nil || len(b) != 3 {
+			continue
+		}
+		vendor := strings.TrimSpace(ln[i+len("(hex)"):])
+		if len(vendor) != 0 {
+			vendors[[3]byte{b[0], b[1], b[2]}] = vendor
+		}
+	}
+	return vendors, sc.Err()
+}
+
+// Load the registry file on the first use
+func loadOUI() {
+	paths := ouiFilePaths
+	if len(config.OUIFile) != 0 {
+		paths = []string{config.OUIFile}
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		vendors, err := parseOUI(f)
+		f.Close()
+		if err != nil {
+			log.Error("Couldn't read %s: %s", path, err)
+			continue
+		}
+		ouiVendors.vendors = vendors
+		log.Debug("Loaded %d device vendors from %s", len(vendors), path)
+		return
+	}
+	log.Debug("No OUI registry file, the device vendors are unknown")
+}
+
+// Get the vendor of the device with this MAC address, "" if it's unknown
+func macVendor(mac string) string {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil || len(hwAddr) < 3 {
+		return ""
+	}
+	ouiVendors.once.Do(loadOUI)
+	return ouiVendors.vendors[[3]byte{hwAddr[0], hwAddr[1], hwAddr[2]}]
+}
@@ -0,0 +1,179 @@
+// File permissions and ownership management
+// The configuration file contains the credentials and the TLS private key,
+// the data directory contains the query log and the filters, so they mustn't be accessible by other users.
+// The problems which can't be fixed are reported via the status API.
+
+package home
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+const (
+	privateFileMode = 0600
+	privateDirMode  = 0700
+)
+
+var filePermissions struct {
+	sync.Mutex
+	problems []string
+}
+
+// getFilePermissionProblems returns the problems found by the last check
+func getFilePermissionProblems() []string {
+	filePermissions.Lock()
+	problems := append([]string{}, filePermissions.problems...)
+	filePermissions.Unlock()
+	return problems
+}
+
+// The owner of our files
+type fileOwner struct {
+	name string
+	uid  int
+	gid  int
+}
+
+// Get the service user from the configuration
+// Returns nil if it's not set
+func getServiceUser() (*fileOwner, error) {
+	if len(config.ServiceUser) == 0 {
+		return nil, nil
+	}
+	u, err := user.Lookup(config.ServiceUser)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find service user %s: %s", config.ServiceUser, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported user ID %s: %s", u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported group ID %s: %s", u.Gid, err)
+	}
+	return &fileOwner{name: config.ServiceUser, uid: uid, gid: gid}, nil
+}
+
+// Check the permissions and the owner of the file, fix them if possible
+// Returns the description of the problem which couldn't be fixed
+func checkFile(path string, fi os.FileInfo, owner *fileOwner, admin bool) []string {
+	problems := []string{}
+
+	mode := os.FileMode(privateFileMode)
+	if fi.IsDir() {
+		mode = privateDirMode
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		// the owner can change the mode, so we don't need admin rights here
+		err := os.Chmod(path, mode)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is accessible by other users (mode %o) and it couldn't be fixed: %s",
+				path, fi.Mode().Perm(), err))
+		} else {
+			log.Info("Changed mode of %s from %o to %o", path, fi.Mode().Perm(), mode)
+		}
+	}
+
+	if owner == nil {
+		return problems
+	}
+	uid, ok := getFileOwnerID(fi)
+	if !ok || uid == owner.uid {
+		return problems
+	}
+	if !admin {
+		problems = append(problems, fmt.Sprintf("%s is owned by user ID %d, not by %s", path, uid, owner.name))
+		return problems
+	}
+	err := os.Chown(path, owner.uid, owner.gid)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("couldn't change owner of %s to %s: %s", path, owner.name, err))
+	} else {
+		log.Info("Changed owner of %s to %s", path, owner.name)
+	}
+	return problems
+}
+
+// checkFilePermissions verifies the configuration file and the data directory
+// Called on startup
+func checkFilePermissions() {
+	if runtime.GOOS == "windows" {
+		// file modes don't work there
+		return
+	}
+
+	problems := []string{}
+	admin, _ := haveAdminRights()
+	owner, err := getServiceUser()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	paths := []string{config.getConfigFilename()}
+	dataPath := filepath.Join(config.ourWorkingDir, dataDir)
+	_ = filepath.Walk(dataPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("couldn't check %s: %s", path, err))
+			return nil
+		}
+		if fi.IsDir() || owner != nil {
+			// the files in the data directory are protected by the directory mode,
+			// but they must belong to the service user
+			paths = append(paths, path)
+		}
+		return nil
+	})
+
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("couldn't check %s: %s", path, err))
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		problems = append(problems, checkFile(path, fi, owner, admin)...)
+	}
+
+	for _, p := range problems {
+		log.Error("File permissions: %s", p)
+	}
+	filePermissions.Lock()
+	filePermissions.problems = problems
+	filePermissions.Unlock()
+}
+
+// secureFile restricts access to the file we've just written
+func secureFile(path string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	err := os.Chmod(path, privateFileMode)
+	if err != nil {
+		log.Error("Couldn't change mode of %s: %s", path, err)
+	}
+
+	owner, err := getServiceUser()
+	if owner == nil || err != nil {
+		return
+	}
+	admin, _ := haveAdminRights()
+	if !admin {
+		return
+	}
+	err = os.Chown(path, owner.uid, owner.gid)
+	if err != nil {
+		log.Error("Couldn't change owner of %s: %s", path, err)
+	}
+}
@@ -0,0 +1,47 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheckFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	dir, err := ioutil.TempDir("", "agh-permissions")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedDir, savedName := config.ourWorkingDir, config.ourConfigFilename
+	defer func() { config.ourWorkingDir, config.ourConfigFilename = savedDir, savedName }()
+	config.ourWorkingDir = dir
+	config.ourConfigFilename = filepath.Join(dir, "AdGuardHome.yaml")
+
+	_ = ioutil.WriteFile(config.ourConfigFilename, []byte("bind_port: 3000\n"), 0644)
+	_ = os.Chmod(config.ourConfigFilename, 0644)
+	filtersDir := filepath.Join(dir, dataDir, filterDir)
+	_ = os.MkdirAll(filtersDir, 0755)
+	_ = os.Chmod(filepath.Join(dir, dataDir), 0755)
+	_ = os.Chmod(filtersDir, 0755)
+
+	checkFilePermissions()
+	if len(getFilePermissionProblems()) != 0 {
+		t.Fatalf("checkFilePermissions: %v", getFilePermissionProblems())
+	}
+	for path, mode := range map[string]os.FileMode{
+		config.ourConfigFilename:    privateFileMode,
+		filepath.Join(dir, dataDir): privateDirMode,
+		filtersDir:                  privateDirMode,
+	} {
+		fi, err := os.Stat(path)
+		if err != nil || fi.Mode().Perm() != mode {
+			t.Fatalf("%s: %v %o", path, err, fi.Mode().Perm())
+		}
+	}
+}
@@ -0,0 +1,368 @@
+// Client self-service portal
+// A client authenticates with its name and its own portal password (not the administrator's credentials),
+//  the password is stored as a bcrypt hash and the failed attempts are limited as the administrator's logins,
+// it can see its settings and recent queries and ask to unblock a domain for a while.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type portalConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	AutoApprove     bool   `yaml:"auto_approve"`     // unblock requests don't need the administrator's approval
+	UnblockDuration uint32 `yaml:"unblock_duration"` // for how long a domain is unblocked (in minutes)
+}
+
+const (
+	unblockPending  = "pending"
+	unblockApproved = "approved"
+	unblockRejected = "rejected"
+
+	unblockRequestsMax = 1000           // the maximum number of stored requests
+	unblockRequestTTL  = 24 * time.Hour // how long finished requests are kept
+)
+
+type unblockRequest struct {
+	ID        uint64    `json:"id"`
+	Client    string    `json:"client"`
+	Domain    string    `json:"domain"`
+	Status    string    `json:"status"`
+	Requested time.Time `json:"requested"`
+	Expires   time.Time `json:"expires,omitempty"` // set when the request is approved
+}
+
+// active returns TRUE if the domain is unblocked now
+func (u *unblockRequest) active(now time.Time) bool {
+	return u.Status == unblockApproved && now.Before(u.Expires)
+}
+
+var unblockRequests struct {
+	sync.Mutex
+	list   []*unblockRequest
+	nextID uint64
+}
+
+// Remove expired and old requests
+// Must be called with the lock held
+func purgeUnblockRequests(now time.Time) {
+	list := []*unblockRequest{}
+	for _, u := range unblockRequests.list {
+		if now.Sub(u.Requested) < unblockRequestTTL || u.active(now) {
+			list = append(list, u)
+		}
+	}
+	unblockRequests.list = list
+}
+
+// Approve the request
+// Must be called with the lock held
+func approveUnblockRequest(u *unblockRequest, now time.Time) {
+	config.RLock()
+	duration := time.Duration(config.Portal.UnblockDuration) * time.Minute
+	config.RUnlock()
+	u.Status = unblockApproved
+	u.Expires = now.Add(duration)
+	log.Info("Portal: %s is unblocked for client %s until %s", u.Domain, u.Client, u.Expires.Format(time.RFC3339))
+}
+
+// portalUnblockedDomains returns the domains that are currently unblocked for the client
+func portalUnblockedDomains(clientName string) []string {
+	var domains []string
+	now := time.Now()
+	unblockRequests.Lock()
+	for _, u := range unblockRequests.list {
+		if u.Client == clientName && u.active(now) {
+			domains = append(domains, u.Domain)
+		}
+	}
+	unblockRequests.Unlock()
+	return domains
+}
+
+// Get the client's own requests
+func clientUnblockRequests(clientName string) []unblockRequest {
+	list := []unblockRequest{}
+	unblockRequests.Lock()
+	purgeUnblockRequests(time.Now())
+	for _, u := range unblockRequests.list {
+		if u.Client == clientName {
+			list = append(list, *u)
+		}
+	}
+	unblockRequests.Unlock()
+	return list
+}
+
+// Check the client's portal password
+func checkPortalPassword(name, password string) (Client, bool) {
+	clients.lock.Lock()
+	c, found := clients.list[name]
+	hash := dummyPasswordHash
+	var cli Client
+	if found && len(c.PortalPasswordHash) != 0 {
+		hash = c.PortalPasswordHash
+		cli = *c
+	}
+	clients.lock.Unlock()
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if len(cli.PortalPasswordHash) == 0 {
+		return Client{}, false
+	}
+	return cli, err == nil
+}
+
+// Authenticate the client by its name and portal password
+func portalAuth(handler func(http.ResponseWriter, *http.Request, Client)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config.RLock()
+		enabled := config.Portal.Enabled
+		config.RUnlock()
+		if !enabled {
+			httpError(w, http.StatusForbidden, "Self-service portal is disabled")
+			return
+		}
+
+		name, pass, ok := r.BasicAuth()
+		if ok {
+			addr := remoteHost(r)
+			if authBlocked(addr) {
+				httpError(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+				return
+			}
+
+			cli, ok := checkPortalPassword(name, pass)
+			recordAuthAttempt(addr, ok)
+			if ok {
+				handler(w, r, cli)
+				return
+			}
+			log.Info("Portal: failed login of %q from %s", name, addr)
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="portal"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("Unauthorised.\n"))
+	}
+}
+
+type portalProfileJSON struct {
+	Name                string   `json:"name"`
+	UseGlobalSettings   bool     `json:"use_global_settings"`
+	FilteringEnabled    bool     `json:"filtering_enabled"`
+	ParentalEnabled     bool     `json:"parental_enabled"`
+	SafeSearchEnabled   bool     `json:"safesearch_enabled"`
+	SafeBrowsingEnabled bool     `json:"safebrowsing_enabled"`
+	BlockedServices     []string `json:"blocked_services"`
+
+	UnblockRequests []unblockRequest `json:"unblock_requests"`
+}
+
+// Show the settings which are applied to the client
+func handlePortalProfile(w http.ResponseWriter, r *http.Request, c Client) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	j := portalProfileJSON{
+		Name:                c.Name,
+		UseGlobalSettings:   !c.UseOwnSettings,
+		FilteringEnabled:    c.FilteringEnabled,
+		ParentalEnabled:     c.ParentalEnabled,
+		SafeSearchEnabled:   c.SafeSearchEnabled,
+		SafeBrowsingEnabled: c.SafeBrowsingEnabled,
+		BlockedServices:     c.BlockedServices,
+	}
+	config.RLock()
+	if !c.UseOwnSettings {
+		j.FilteringEnabled = config.DNS.FilteringEnabled
+		j.ParentalEnabled = config.DNS.ParentalEnabled
+		j.SafeSearchEnabled = config.DNS.SafeSearchEnabled
+		j.SafeBrowsingEnabled = config.DNS.SafeBrowsingEnabled
+	}
+	if !c.UseOwnBlockedServices {
+		j.BlockedServices = config.DNS.BlockedServices
+	}
+	config.RUnlock()
+	if j.BlockedServices == nil {
+		j.BlockedServices = []string{}
+	}
+	j.UnblockRequests = clientUnblockRequests(c.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Show the client's recent queries
+func handlePortalQueryLog(w http.ResponseWriter, r *http.Request, c Client) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	data := []map[string]interface{}{}
+	owners := map[string]bool{} // client IP -> whether it's this client
+	for _, entry := range dnsServer.GetQueryLog() {
+		ip, _ := entry["client"].(string)
+		own, ok := owners[ip]
+		if !ok {
+			found, foundOK := clientFind(ip)
+			own = foundOK && found.Name == c.Name
+			owners[ip] = own
+		}
+		if own {
+			data = append(data, entry)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Request a temporary unblock of a domain
+func handlePortalUnblock(w http.ResponseWriter, r *http.Request, c Client) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := struct {
+		Domain string `json:"domain"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	domain := strings.ToLower(strings.TrimSuffix(req.Domain, "."))
+	if net.ParseIP(domain) != nil || utils.IsValidHostname(domain) != nil {
+		httpError(w, http.StatusBadRequest, "Invalid domain: %s", req.Domain)
+		return
+	}
+
+	config.RLock()
+	autoApprove := config.Portal.AutoApprove
+	config.RUnlock()
+
+	now := time.Now()
+	unblockRequests.Lock()
+	purgeUnblockRequests(now)
+	for _, u := range unblockRequests.list {
+		if u.Client == c.Name && u.Domain == domain && (u.Status == unblockPending || u.active(now)) {
+			unblockRequests.Unlock()
+			httpError(w, http.StatusBadRequest, "The request for %s already exists", domain)
+			return
+		}
+	}
+	if len(unblockRequests.list) >= unblockRequestsMax {
+		unblockRequests.Unlock()
+		httpError(w, http.StatusServiceUnavailable, "Too many unblock requests")
+		return
+	}
+
+	unblockRequests.nextID++
+	u := &unblockRequest{
+		ID:        unblockRequests.nextID,
+		Client:    c.Name,
+		Domain:    domain,
+		Status:    unblockPending,
+		Requested: now,
+	}
+	if autoApprove {
+		approveUnblockRequest(u, now)
+	} else {
+		log.Info("Portal: client %s requests to unblock %s", c.Name, domain)
+	}
+	unblockRequests.list = append(unblockRequests.list, u)
+	status := u.Status
+	unblockRequests.Unlock()
+
+	_, _ = fmt.Fprintf(w, "OK %s\n", status)
+}
+
+// Administrator's handlers
+
+func handlePortalRequests(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	list := []unblockRequest{}
+	unblockRequests.Lock()
+	purgeUnblockRequests(time.Now())
+	for _, u := range unblockRequests.list {
+		list = append(list, *u)
+	}
+	unblockRequests.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(list)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Set the status of a pending request
+func setUnblockRequestStatus(w http.ResponseWriter, r *http.Request, approve bool) {
+	req := struct {
+		ID uint64 `json:"id"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	unblockRequests.Lock()
+	var u *unblockRequest
+	for _, it := range unblockRequests.list {
+		if it.ID == req.ID {
+			u = it
+			break
+		}
+	}
+	if u == nil || u.Status != unblockPending {
+		unblockRequests.Unlock()
+		httpError(w, http.StatusBadRequest, "No pending request with ID %d", req.ID)
+		return
+	}
+	if approve {
+		approveUnblockRequest(u, time.Now())
+	} else {
+		u.Status = unblockRejected
+		log.Info("Portal: request to unblock %s for client %s is rejected", u.Domain, u.Client)
+	}
+	unblockRequests.Unlock()
+
+	returnOK(w)
+}
+
+func handlePortalApprove(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	setUnblockRequestStatus(w, r, true)
+}
+
+func handlePortalReject(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	setUnblockRequestStatus(w, r, false)
+}
+
+func registerPortalHandlers() {
+	http.HandleFunc("/control/portal/profile", postInstall(ensureGET(portalAuth(handlePortalProfile))))
+	http.HandleFunc("/control/portal/querylog", postInstall(ensureGET(portalAuth(handlePortalQueryLog))))
+	http.HandleFunc("/control/portal/unblock", postInstall(ensureMethod("POST", portalAuth(handlePortalUnblock))))
+
+	http.HandleFunc("/control/portal/requests", postInstall(optionalAuth(ensureGET(handlePortalRequests))))
+	http.HandleFunc("/control/portal/requests/approve", postInstall(optionalAuth(ensurePOST(handlePortalApprove))))
+	http.HandleFunc("/control/portal/requests/reject", postInstall(optionalAuth(ensurePOST(handlePortalReject))))
+}
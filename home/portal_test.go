@@ -0,0 +1,59 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPortalAuth(t *testing.T) {
+	defer prepareTestAuth(t)()
+	enabled := config.Portal.Enabled
+	config.Portal.Enabled = true
+	defer func() { config.Portal.Enabled = enabled }()
+
+	clients.list = map[string]*Client{}
+	clients.ipIndex = map[string]*Client{}
+	clients.ipHost = map[string]ClientHost{}
+	defer func() { clients.list, clients.ipIndex, clients.ipHost = nil, nil, nil }()
+	c, err := jsonToClient(clientJSON{IP: "1.1.1.1", Name: "kid", PortalPassword: "portal"})
+	if err != nil {
+		t.Fatalf("jsonToClient: %s", err)
+	}
+	if c.PortalPasswordHash == "portal" {
+		t.Fatalf("the portal password isn't hashed")
+	}
+	b, err := clientAdd(*c)
+	if !b || err != nil {
+		t.Fatalf("clientAdd: %v %v", b, err)
+	}
+	b, err = clientAdd(Client{IP: "2.2.2.2", Name: "plain", PortalPasswordHash: "portal"})
+	if b || err == nil {
+		t.Fatalf("clientAdd with a plain text password")
+	}
+
+	var name string
+	handler := portalAuth(func(w http.ResponseWriter, r *http.Request, c Client) {
+		name = c.Name
+	})
+	login := func(pass string) int {
+		r := httptest.NewRequest("GET", "/control/portal/profile", nil)
+		r.SetBasicAuth("kid", pass)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	if code := login("portal"); code != http.StatusOK || name != "kid" {
+		t.Fatalf("valid password: %d %q", code, name)
+	}
+	for i := 0; i < 3; i++ {
+		if code := login("wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: %d", i, code)
+		}
+	}
+	// the address is blocked as for the administrator's logins
+	if code := login("portal"); code != http.StatusTooManyRequests {
+		t.Fatalf("blocked: %d", code)
+	}
+}
@@ -0,0 +1,104 @@
+// Device presence detection
+// The addresses from the DHCP leases are probed periodically: a UDP packet to the discard port makes the OS
+// resolve the address via ARP, and then the ARP table shows which devices have replied.
+// The devices which don't reply (e.g. the phones which left home) are shown offline in the clients list.
+
+package home
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+)
+
+const (
+	presencePeriod    = time.Minute
+	presenceProbeWait = 10 * time.Second // the time the OS needs to resolve the addresses via ARP
+	presenceProbePort = 9                // discard
+)
+
+type presenceContainer struct {
+	lastSeen map[string]time.Time // MAC -> the time when the device replied
+	checked  time.Time            // the time of the last check
+	lock     sync.Mutex
+}
+
+var presence = presenceContainer{lastSeen: map[string]time.Time{}}
+
+// Send a UDP packet to each address, the OS resolves them via ARP
+func probeAddresses(ips []net.IP) {
+	for _, ip := range ips {
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: presenceProbePort})
+		if err != nil {
+			log.Debug("presence: %s: %s", ip, err)
+			continue
+		}
+		_, _ = conn.Write([]byte{0})
+		conn.Close()
+	}
+}
+
+// Update the presence of the devices: a device is present if the ARP table has its address with its MAC
+// arpMACs: IP -> MAC address
+func (p *presenceContainer) update(leases []dhcpd.Lease, arpMACs map[string]string, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, l := range leases {
+		mac, err := net.ParseMAC(arpMACs[l.IP.String()])
+		if err == nil && bytes.Equal(mac, l.HWAddr) {
+			p.lastSeen[l.HWAddr.String()] = now
+		}
+	}
+	p.checked = now
+}
+
+// Get the presence of the device: whether it has replied during the last check and when it was seen
+// lastSeen is nil if the device has never replied.
+func (p *presenceContainer) get(mac string) (bool, *time.Time) {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return false, nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t, ok := p.lastSeen[hwAddr.String()]
+	if !ok {
+		return false, nil
+	}
+	return !t.Before(p.checked), &t
+}
+
+// Check the presence of the devices with DHCP leases
+func detectPresence() {
+	leases := append(dhcpServer.StaticLeases(), dhcpServer.Leases()...)
+	ips := []net.IP{}
+	for _, l := range leases {
+		if l.IP.To4() != nil {
+			ips = append(ips, l.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+
+	probeAddresses(ips)
+	time.Sleep(presenceProbeWait)
+	_, macs, ok := readARP()
+	if !ok {
+		return
+	}
+	presence.update(leases, macs, time.Now())
+	log.Tracef("presence: checked %d addresses", len(ips))
+}
+
+func periodicallyDetectPresence() {
+	for {
+		if config.PresenceDetection && config.DHCP.Enabled {
+			detectPresence()
+		}
+		time.Sleep(presencePeriod)
+	}
+}
@@ -0,0 +1,44 @@
+package home
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dhcpd"
+)
+
+func TestPresence(t *testing.T) {
+	p := presenceContainer{lastSeen: map[string]time.Time{}}
+	leases := []dhcpd.Lease{
+		{HWAddr: net.HardwareAddr{1, 1, 1, 1, 1, 1}, IP: net.IP{192, 168, 1, 10}},
+		{HWAddr: net.HardwareAddr{2, 2, 2, 2, 2, 2}, IP: net.IP{192, 168, 1, 11}},
+		{HWAddr: net.HardwareAddr{3, 3, 3, 3, 3, 3}, IP: net.IP{192, 168, 1, 12}},
+	}
+	now := time.Unix(2000000000, 0)
+	p.update(leases, map[string]string{
+		"192.168.1.10": "01:01:01:01:01:01",
+		"192.168.1.11": "02:02:02:02:02:02",
+		"192.168.1.12": "09:09:09:09:09:09", // another device has this address now
+	}, now)
+
+	online, lastSeen := p.get("01:01:01:01:01:01")
+	if !online || lastSeen == nil || !lastSeen.Equal(now) {
+		t.Fatalf("the device is online: %v %v", online, lastSeen)
+	}
+	online, lastSeen = p.get("03:03:03:03:03:03")
+	if online || lastSeen != nil {
+		t.Fatalf("the device has never replied: %v %v", online, lastSeen)
+	}
+
+	// the second device doesn't reply anymore
+	p.update(leases, map[string]string{"192.168.1.10": "01:01:01:01:01:01"}, now.Add(time.Minute))
+	online, lastSeen = p.get("02-02-02-02-02-02")
+	if online || lastSeen == nil || !lastSeen.Equal(now) {
+		t.Fatalf("the device is offline: %v %v", online, lastSeen)
+	}
+	online, _ = p.get("01:01:01:01:01:01")
+	if !online {
+		t.Fatalf("the device is still online")
+	}
+}
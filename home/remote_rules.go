@@ -0,0 +1,275 @@
+// Custom filtering rules and rewrites provisioned from a remote URL
+// A fleet of instances may share centrally managed rules without syncing the whole configuration.
+// The remote file is polled periodically, it's a YAML document:
+//   user_rules:
+//   - '||example.org^'
+//   rewrites:
+//   - domain: host.example.org
+//     answer: 192.168.1.1
+
+package home
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const remoteRulesMaxSize = 16 * 1024 * 1024
+
+type remoteRulesConfig struct {
+	URL         string `yaml:"url"`          // if empty, the rules are managed locally
+	ChecksumURL string `yaml:"checksum_url"` // SHA-256 checksum of the remote file (optional)
+	Interval    uint32 `yaml:"interval"`     // polling interval (in minutes)
+
+	// If set, the remote file isn't applied and the local rules can be modified
+	LocalOverride bool `yaml:"local_override"`
+}
+
+// The contents of the remote file
+type remoteRules struct {
+	UserRules []string                 `yaml:"user_rules"`
+	Rewrites  []dnsfilter.RewriteEntry `yaml:"rewrites"`
+}
+
+// The state of the remote rules polling
+var remoteRulesState struct {
+	sync.Mutex
+	checksum    [sha256.Size]byte // checksum of the applied data
+	lastCheck   time.Time
+	lastUpdated time.Time
+	lastError   string
+}
+
+// remoteRulesActive returns TRUE if the user rules and rewrites are managed by the remote file
+// Must be called with the configuration lock held
+func remoteRulesActive() bool {
+	return len(config.RemoteRules.URL) != 0 && !config.RemoteRules.LocalOverride
+}
+
+// Check that the user rules and rewrites can be modified via API
+func checkLocalRulesEditable(w http.ResponseWriter) bool {
+	config.RLock()
+	active := remoteRulesActive()
+	url := config.RemoteRules.URL
+	config.RUnlock()
+	if active {
+		httpError(w, http.StatusForbidden, "The rules are managed by the remote file %s, enable local override to modify them", url)
+		return false
+	}
+	return true
+}
+
+// Download and parse the remote file
+func downloadRemoteRules(conf remoteRulesConfig) ([]byte, remoteRules, error) {
+	rr := remoteRules{}
+	resp, err := filtering.client.Get(conf.URL)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, rr, fmt.Errorf("couldn't request remote rules from URL %s: %s", conf.URL, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, rr, fmt.Errorf("got status code %d from URL %s", resp.StatusCode, conf.URL)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, remoteRulesMaxSize+1))
+	if err != nil {
+		return nil, rr, fmt.Errorf("couldn't read remote rules from URL %s: %s", conf.URL, err)
+	}
+	if len(body) > remoteRulesMaxSize {
+		return nil, rr, fmt.Errorf("remote rules file exceeds the limit of %d bytes", remoteRulesMaxSize)
+	}
+
+	if len(conf.ChecksumURL) != 0 {
+		err = filtering.verifyChecksum(conf.ChecksumURL, body)
+		if err != nil {
+			return nil, rr, err
+		}
+	}
+
+	err = yaml.Unmarshal(body, &rr)
+	if err != nil {
+		return nil, rr, fmt.Errorf("couldn't parse remote rules: %s", err)
+	}
+	for _, r := range rr.Rewrites {
+		err = dnsfilter.CheckRewriteEntry(r)
+		if err != nil {
+			return nil, rr, fmt.Errorf("invalid rewrite %s -> %s: %s", r.Domain, r.Answer, err)
+		}
+	}
+	return body, rr, nil
+}
+
+// Download the remote file and apply it if it has changed
+// Returns TRUE if the rules were updated
+func refreshRemoteRules() (bool, error) {
+	config.RLock()
+	conf := config.RemoteRules
+	active := remoteRulesActive()
+	config.RUnlock()
+	if !active {
+		return false, nil
+	}
+
+	remoteRulesState.Lock()
+	remoteRulesState.lastCheck = time.Now()
+	remoteRulesState.Unlock()
+
+	body, rr, err := downloadRemoteRules(conf)
+	remoteRulesState.Lock()
+	if err != nil {
+		remoteRulesState.lastError = err.Error()
+		remoteRulesState.Unlock()
+		return false, err
+	}
+	remoteRulesState.lastError = ""
+	checksum := sha256.Sum256(body)
+	if checksum == remoteRulesState.checksum {
+		remoteRulesState.Unlock()
+		log.Tracef("Remote rules from %s haven't changed", conf.URL)
+		return false, nil
+	}
+	remoteRulesState.checksum = checksum
+	remoteRulesState.lastUpdated = time.Now()
+	remoteRulesState.Unlock()
+
+	config.Lock()
+	if !remoteRulesActive() {
+		// local override was enabled while we were downloading
+		config.Unlock()
+		return false, nil
+	}
+	config.UserRules = rr.UserRules
+	config.DNS.Rewrites = rr.Rewrites
+	config.Unlock()
+	log.Info("Applied remote rules from %s: %d rules, %d rewrites", conf.URL, len(rr.UserRules), len(rr.Rewrites))
+
+	err = writeAllConfigs()
+	if err != nil {
+		return true, err
+	}
+	if isRunning() {
+		err = reconfigureDNSServer()
+	}
+	return true, err
+}
+
+func periodicallyRefreshRemoteRules() {
+	for {
+		config.RLock()
+		interval := time.Duration(config.RemoteRules.Interval) * time.Minute
+		config.RUnlock()
+		if interval == 0 {
+			interval = time.Hour
+		}
+
+		remoteRulesState.Lock()
+		due := time.Since(remoteRulesState.lastCheck) >= interval
+		remoteRulesState.Unlock()
+		if due {
+			_, err := refreshRemoteRules()
+			if err != nil {
+				log.Error("Couldn't refresh remote rules: %s", err)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+type remoteRulesStatusJSON struct {
+	URL           string    `json:"url"`
+	ChecksumURL   string    `json:"checksum_url"`
+	Interval      uint32    `json:"interval"`
+	LocalOverride bool      `json:"local_override"`
+	LastUpdated   time.Time `json:"last_updated,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+func handleRemoteRulesStatus(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	config.RLock()
+	j := remoteRulesStatusJSON{
+		URL:           config.RemoteRules.URL,
+		ChecksumURL:   config.RemoteRules.ChecksumURL,
+		Interval:      config.RemoteRules.Interval,
+		LocalOverride: config.RemoteRules.LocalOverride,
+	}
+	config.RUnlock()
+	remoteRulesState.Lock()
+	j.LastUpdated = remoteRulesState.lastUpdated
+	j.LastError = remoteRulesState.lastError
+	remoteRulesState.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
+
+// Enable or disable the local override
+// When it's disabled, the remote file is applied right away
+func handleRemoteRulesSetOverride(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := struct {
+		Enabled bool `json:"enabled"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	config.Lock()
+	config.RemoteRules.LocalOverride = req.Enabled
+	config.Unlock()
+
+	if !req.Enabled {
+		// apply the remote file even if it hasn't changed
+		remoteRulesState.Lock()
+		remoteRulesState.checksum = [sha256.Size]byte{}
+		remoteRulesState.Unlock()
+		_, err = refreshRemoteRules()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't apply remote rules: %s", err)
+			return
+		}
+	}
+
+	err = writeAllConfigs()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+		return
+	}
+	returnOK(w)
+}
+
+func handleRemoteRulesRefresh(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	updated, err := refreshRemoteRules()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't refresh remote rules: %s", err)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "OK %v\n", updated)
+}
+
+func registerRemoteRulesHandlers() {
+	http.HandleFunc("/control/remote_rules/status", postInstall(optionalAuth(ensureGET(handleRemoteRulesStatus))))
+	http.HandleFunc("/control/remote_rules/set_override", postInstall(optionalAuth(ensurePOST(handleRemoteRulesSetOverride))))
+	http.HandleFunc("/control/remote_rules/refresh", postInstall(optionalAuth(ensurePOST(handleRemoteRulesRefresh))))
+}
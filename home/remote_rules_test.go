@@ -0,0 +1,54 @@
+package home
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteRules(t *testing.T) {
+	data := `
+user_rules:
+- '||example.org^'
+- '@@||example.com^'
+rewrites:
+- domain: host.example.org
+  answer: 192.168.1.1
+`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rules.yaml":
+			_, _ = w.Write([]byte(data))
+		case "/rules.sha256":
+			_, _ = fmt.Fprintf(w, "%x\n", sha256.Sum256([]byte(data)))
+		case "/bad.sha256":
+			_, _ = fmt.Fprintf(w, "%x\n", sha256.Sum256([]byte("other")))
+		case "/invalid.yaml":
+			_, _ = w.Write([]byte("rewrites:\n- domain: host.example.org\n  answer: ''\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	conf := remoteRulesConfig{URL: ts.URL + "/rules.yaml", ChecksumURL: ts.URL + "/rules.sha256"}
+	_, rr, err := downloadRemoteRules(conf)
+	if err != nil {
+		t.Fatalf("downloadRemoteRules: %s", err)
+	}
+	if len(rr.UserRules) != 2 || len(rr.Rewrites) != 1 || rr.Rewrites[0].Answer != "192.168.1.1" {
+		t.Fatalf("downloadRemoteRules: %v", rr)
+	}
+
+	conf.ChecksumURL = ts.URL + "/bad.sha256"
+	if _, _, err = downloadRemoteRules(conf); err == nil {
+		t.Fatalf("downloadRemoteRules must fail: checksum mismatch")
+	}
+
+	conf = remoteRulesConfig{URL: ts.URL + "/invalid.yaml"}
+	if _, _, err = downloadRemoteRules(conf); err == nil {
+		t.Fatalf("downloadRemoteRules must fail: invalid rewrite")
+	}
+}
@@ -0,0 +1,234 @@
+// Import DNS rewrites from a hosts file
+// Makes it easy to move the local host tables from routers and dnsmasq.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+const maxHostsImportSize = 16 * 1024 * 1024
+
+// Host names which are present in every hosts file and mustn't become rewrites
+var hostsSkipNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// A host from the imported file which conflicts with the existing rewrites
+type rewriteConflictJSON struct {
+	Line     int      `json:"line"`
+	Domain   string   `json:"domain"`
+	Answer   string   `json:"answer"`
+	Existing []string `json:"existing"` // the answers we already have for this domain
+}
+
+type rewriteImportJSON struct {
+	Added     int                   `json:"added"`
+	Duplicate int                   `json:"duplicate"` // entries which already exist
+	Conflicts []rewriteConflictJSON `json:"conflicts"`
+	Errors    []string              `json:"errors"` // lines which couldn't be parsed
+}
+
+// An entry parsed from the hosts file
+type hostsEntry struct {
+	line int
+	ent  dnsfilter.RewriteEntry
+}
+
+// Parse the hosts file data
+// Returns the entries and the descriptions of the lines which couldn't be parsed
+func parseHostsRewrites(data string) ([]hostsEntry, []string) {
+	entries := []hostsEntry{}
+	errs := []string{}
+	for i, line := range strings.Split(data, "\n") {
+		pos := strings.IndexByte(line, '#')
+		if pos >= 0 {
+			line = line[:pos]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			errs = append(errs, fmt.Sprintf("line %d: no host names", i+1))
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			errs = append(errs, fmt.Sprintf("line %d: invalid IP address: %s", i+1, fields[0]))
+			continue
+		}
+		for _, host := range fields[1:] {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			if hostsSkipNames[host] {
+				continue
+			}
+			ent := dnsfilter.RewriteEntry{Domain: host, Answer: ip.String()}
+			err := dnsfilter.CheckRewriteEntry(ent)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("line %d: %s", i+1, err))
+				continue
+			}
+			entries = append(entries, hostsEntry{line: i + 1, ent: ent})
+		}
+	}
+	return entries, errs
+}
+
+// The type of the answer: "A", "AAAA" or "CNAME"
+// IPv4 and IPv6 addresses of the same host don't conflict with each other
+func rewriteAnswerType(answer string) string {
+	ip := net.ParseIP(answer)
+	switch {
+	case ip == nil:
+		return "CNAME"
+	case ip.To4() != nil:
+		return "A"
+	default:
+		return "AAAA"
+	}
+}
+
+// Merge the imported entries into the list of rewrites
+// A domain which already has a different answer of the same type is a conflict.
+// The imported entry is skipped, or the existing answers which aren't in the file are removed if "replace" is set.
+// Returns the new list of rewrites
+func mergeHostsRewrites(rewrites []dnsfilter.RewriteEntry, entries []hostsEntry, replace bool,
+	res *rewriteImportJSON) []dnsfilter.RewriteEntry {
+
+	// "domain type" -> answers
+	key := func(ent dnsfilter.RewriteEntry) string {
+		return ent.Domain + " " + rewriteAnswerType(ent.Answer)
+	}
+	existing := map[string][]string{}
+	for _, r := range rewrites {
+		existing[key(r)] = append(existing[key(r)], r.Answer)
+	}
+	inFile := map[dnsfilter.RewriteEntry]bool{}
+	for _, e := range entries {
+		inFile[e.ent] = true
+	}
+	has := func(answers []string, answer string) bool {
+		for _, a := range answers {
+			if a == answer {
+				return true
+			}
+		}
+		return false
+	}
+
+	added := []dnsfilter.RewriteEntry{}
+	imported := map[string][]string{}
+	replaced := map[string]bool{}
+	for _, e := range entries {
+		k := key(e.ent)
+		answers := existing[k]
+		if has(answers, e.ent.Answer) || has(imported[k], e.ent.Answer) {
+			res.Duplicate++
+			continue
+		}
+		if len(answers) != 0 {
+			res.Conflicts = append(res.Conflicts, rewriteConflictJSON{
+				Line:     e.line,
+				Domain:   e.ent.Domain,
+				Answer:   e.ent.Answer,
+				Existing: answers,
+			})
+			if !replace {
+				continue
+			}
+			replaced[k] = true
+		}
+		imported[k] = append(imported[k], e.ent.Answer)
+		added = append(added, e.ent)
+	}
+	res.Added = len(added)
+
+	arr := []dnsfilter.RewriteEntry{}
+	for _, r := range rewrites {
+		if replaced[key(r)] && !inFile[r] {
+			continue
+		}
+		arr = append(arr, r)
+	}
+	return append(arr, added...)
+}
+
+// Import the rewrites from a hosts file
+// Nothing is changed if the file contains invalid lines or if it's a dry run.
+// "replace=true" replaces the existing answers of the conflicting domains,
+// "dry_run=true" only reports what would be changed.
+func handleRewriteImport(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	if !checkLocalRulesEditable(w) {
+		return
+	}
+
+	q := r.URL.Query()
+	replace := q.Get("replace") == "true"
+	dryRun := q.Get("dry_run") == "true"
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHostsImportSize+1))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to read request body: %s", err)
+		return
+	}
+	if len(body) > maxHostsImportSize {
+		httpError(w, http.StatusRequestEntityTooLarge, "The file is too large")
+		return
+	}
+
+	entries, errs := parseHostsRewrites(string(body))
+	res := rewriteImportJSON{
+		Conflicts: []rewriteConflictJSON{},
+		Errors:    errs,
+	}
+
+	changed := false
+	config.Lock()
+	arr := mergeHostsRewrites(config.DNS.Rewrites, entries, replace, &res)
+	if len(errs) == 0 && !dryRun && res.Added != 0 {
+		config.DNS.Rewrites = arr
+		changed = true
+	}
+	config.Unlock()
+
+	if changed {
+		log.Info("Rewrites: imported %d entries, %d conflicts", res.Added, len(res.Conflicts))
+		err = writeAllConfigsAndReloadDNS()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't write config file: %s", err)
+			return
+		}
+	} else if len(errs) != 0 {
+		res.Added = 0
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(errs) != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Error("json.Encode: %s", err)
+	}
+}
@@ -0,0 +1,58 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
+)
+
+func TestRewriteImport(t *testing.T) {
+	data := `# router hosts
+127.0.0.1 localhost
+::1 localhost ip6-localhost ip6-loopback
+192.168.1.5 nas.home nas # storage
+192.168.1.6 printer.home
+192.168.1.7 tv.home
+fe80::1 nas.home
+`
+	entries, errs := parseHostsRewrites(data)
+	if len(errs) != 0 || len(entries) != 5 {
+		t.Fatalf("parseHostsRewrites: %v %v", entries, errs)
+	}
+	if entries[0].line != 4 || entries[0].ent.Domain != "nas.home" || entries[0].ent.Answer != "192.168.1.5" {
+		t.Fatalf("parseHostsRewrites: %v", entries[0])
+	}
+
+	_, errs = parseHostsRewrites("192.168.1.300 host\nhost-only\n")
+	if len(errs) != 2 {
+		t.Fatalf("parseHostsRewrites: %v", errs)
+	}
+
+	rewrites := []dnsfilter.RewriteEntry{
+		{Domain: "nas.home", Answer: "192.168.1.5"},
+		{Domain: "tv.home", Answer: "192.168.1.100"},
+		{Domain: "tv.home", Answer: "192.168.1.101"},
+	}
+
+	// conflicts are skipped
+	res := rewriteImportJSON{}
+	arr := mergeHostsRewrites(rewrites, entries, false, &res)
+	if res.Added != 3 || res.Duplicate != 1 || len(res.Conflicts) != 1 || res.Conflicts[0].Domain != "tv.home" {
+		t.Fatalf("mergeHostsRewrites: %+v", res)
+	}
+	if len(arr) != 6 || arr[3].Domain != "nas" || arr[5].Answer != "fe80::1" {
+		t.Fatalf("mergeHostsRewrites: %v", arr)
+	}
+
+	// conflicting answers are replaced
+	res = rewriteImportJSON{}
+	arr = mergeHostsRewrites(rewrites, entries, true, &res)
+	if res.Added != 4 || len(res.Conflicts) != 1 || len(arr) != 5 {
+		t.Fatalf("mergeHostsRewrites: %+v %v", res, arr)
+	}
+	for _, r := range arr {
+		if r.Domain == "tv.home" && r.Answer != "192.168.1.7" {
+			t.Fatalf("mergeHostsRewrites: %v", arr)
+		}
+	}
+}
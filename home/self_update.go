@@ -0,0 +1,446 @@
+// Self-update: update channels, package signatures and rollback
+// The update channel is selected by "update_channel" setting: "stable" or "beta" (empty: the channel of this build).
+// The package is verified by its Ed25519 signature: the base64 signature is downloaded from the package URL + ".sig",
+//  the public key is built into the binary (updatePublicKey), the packages aren't installed without it.
+//  The signed data is "AdGuardHome VERSION\n" followed by the package, so a package can't be offered as another version,
+//  and the versions which aren't newer than the current one are refused, so an old package can't be installed again.
+// The new binary replaces the current one by rename(), so there's either the old or the new file at any moment.
+// After the restart the new version must keep running for updateConfirmDelay, otherwise the update has failed:
+//  if it has stopped without a clean shutdown (e.g. it has crashed), on the next start (e.g. by the service manager)
+//  the previous binary and configuration file are restored and started.
+//  The state of the update is kept in updateStateFile in the working directory.
+
+package home
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	updateChannelStable = "stable"
+	updateChannelBeta   = "beta"
+)
+
+const updateStateFile = "agh-update.json"
+
+// The new version must work for this time after the update
+const updateConfirmDelay = 30 * time.Second
+
+const maxSignatureSize = 1024
+
+// The update which is being started
+type updateState struct {
+	Version    string `json:"version"`     // the new version
+	PrevBinary string `json:"prev_binary"` // the previous binary in the backup directory
+	PrevConfig string `json:"prev_config"` // the previous configuration file in the backup directory
+	Binary     string `json:"binary"`      // the current binary
+	Running    bool   `json:"running"`     // the new version is started and hasn't shut down cleanly
+}
+
+// Protects the update state file
+var updateStateLock sync.Mutex
+
+func validateUpdateChannel(channel string) error {
+	switch channel {
+	case "", updateChannelStable, updateChannelBeta:
+		return nil
+	}
+	return fmt.Errorf("invalid update_channel %q: must be %s or %s", channel, updateChannelStable, updateChannelBeta)
+}
+
+// Get the selected update channel
+func currentUpdateChannel() string {
+	config.RLock()
+	channel := config.UpdateChannel
+	config.RUnlock()
+	if len(channel) != 0 {
+		return channel
+	}
+	if updateChannel == "beta" {
+		return updateChannelBeta
+	}
+	return updateChannelStable
+}
+
+// Get the URL of version.json of the channel
+// The files of the stable channel are in "release" directory
+func versionCheckURL(channel string) string {
+	dir := channel
+	if channel == updateChannelStable {
+		dir = "release"
+	}
+	return versionCheckBaseURL + dir + "/version.json"
+}
+
+// Get version.json of the channel
+// The data of the selected channel are cached, unless 'force' is set.
+func getVersionJSON(channel string, force bool) ([]byte, error) {
+	now := time.Now()
+	versionCheckLock.Lock()
+	cached := now.Sub(versionCheckLastTime) <= versionCheckPeriod && len(versionCheckJSON) != 0 &&
+		versionCheckChannel == channel
+	data := versionCheckJSON
+	versionCheckLock.Unlock()
+	if cached && !force {
+		return data, nil
+	}
+
+	url := versionCheckURL(channel)
+	resp, err := client.Get(url)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get version check json from %s: %s", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code %d from %s", resp.StatusCode, url)
+	}
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read response body from %s: %s", url, err)
+	}
+
+	versionCheckLock.Lock()
+	versionCheckLastTime = now
+	versionCheckJSON = data
+	versionCheckChannel = channel
+	versionCheckLock.Unlock()
+	return data, nil
+}
+
+// Split the version "v0.100.2-beta.1" into the numbers and the pre-release identifiers
+func parseVersion(v string) ([]int, []string, error) {
+	core := strings.TrimPrefix(v, "v")
+	pre := ""
+	if i := strings.IndexByte(core, '-'); i >= 0 {
+		core, pre = core[:i], core[i+1:]
+	}
+	nums := []int{}
+	for _, s := range strings.Split(core, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("invalid version %q", v)
+		}
+		nums = append(nums, n)
+	}
+	var ids []string
+	if len(pre) != 0 {
+		ids = strings.Split(pre, ".")
+	}
+	return nums, ids, nil
+}
+
+// Compare the versions: -1 if a is older than b, 0 if they're equal, 1 if a is newer
+// A pre-release is older than the release: v0.100-beta.1 < v0.100.
+func compareVersions(a, b string) (int, error) {
+	na, pa, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	nb, pb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(na) || i < len(nb); i++ {
+		x, y := 0, 0
+		if i < len(na) {
+			x = na[i]
+		}
+		if i < len(nb) {
+			y = nb[i]
+		}
+		if x != y {
+			return compareInts(x, y), nil
+		}
+	}
+
+	switch {
+	case len(pa) == 0 && len(pb) == 0:
+		return 0, nil
+	case len(pa) == 0:
+		return 1, nil
+	case len(pb) == 0:
+		return -1, nil
+	}
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, errx := strconv.Atoi(pa[i])
+		y, erry := strconv.Atoi(pb[i])
+		switch {
+		case errx == nil && erry == nil:
+			if x != y {
+				return compareInts(x, y), nil
+			}
+		case errx == nil:
+			return -1, nil // numeric identifiers are older
+		case erry == nil:
+			return 1, nil
+		default:
+			if c := strings.Compare(pa[i], pb[i]); c != 0 {
+				return c, nil
+			}
+		}
+	}
+	return compareInts(len(pa), len(pb)), nil
+}
+
+func compareInts(x, y int) int {
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+// Check that the version is newer than the current one
+func checkNewerVersion(version string) error {
+	c, err := compareVersions(version, VersionString)
+	if err != nil {
+		return fmt.Errorf("couldn't compare the versions: %s", err)
+	}
+	if c <= 0 {
+		return fmt.Errorf("version %s isn't newer than the current version %s", version, VersionString)
+	}
+	return nil
+}
+
+// Get the data which is signed: the version and the package
+func updateSignedData(version string, pkg []byte) []byte {
+	data := []byte("AdGuardHome " + version + "\n")
+	return append(data, pkg...)
+}
+
+// Check the signature of the update package of this version
+func verifyUpdateSignature(version string, pkg, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("this build has no valid update signing key")
+	}
+	s, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil || len(s) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid package signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), updateSignedData(version, pkg), s) {
+		return fmt.Errorf("package signature doesn't match")
+	}
+	return nil
+}
+
+// Download the signature of the update package
+func getPackageSignature(pkgURL string) ([]byte, error) {
+	url := pkgURL + ".sig"
+	resp, err := client.Get(url)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get package signature: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code %d from %s", resp.StatusCode, url)
+	}
+	sig, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read package signature: %s", err)
+	}
+	return sig, nil
+}
+
+// Replace the file by rename(), so the file is never missing or incomplete
+// The running binary can't be replaced on Windows: it's moved away first.
+func replaceFile(src, dst string, mode os.FileMode) error {
+	tmp := dst + ".new"
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil && runtime.GOOS == "windows" {
+		old := dst + ".old"
+		_ = os.Remove(old)
+		err = os.Rename(dst, old)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+func updateStatePath() string {
+	return filepath.Join(config.ourWorkingDir, updateStateFile)
+}
+
+func writeUpdateState(s updateState) error {
+	data, _ := json.Marshal(s)
+	return ioutil.WriteFile(updateStatePath(), data, 0644)
+}
+
+// Get the state of the update to this version
+// Returns FALSE if there's no update state, or it's for another version.
+// updateStateLock must be held
+func readUpdateState() (updateState, bool) {
+	s := updateState{}
+	data, err := ioutil.ReadFile(updateStatePath())
+	if err != nil {
+		return s, false
+	}
+	err = json.Unmarshal(data, &s)
+	if err != nil || s.Version != VersionString {
+		// it's not the version we've updated to
+		_ = os.Remove(updateStatePath())
+		return s, false
+	}
+	return s, true
+}
+
+// Check the update which is being started
+// Restores the previous version if the new one has stopped without a clean shutdown before.
+func checkUpdateState() {
+	updateStateLock.Lock()
+	s, ok := readUpdateState()
+	if !ok {
+		updateStateLock.Unlock()
+		return
+	}
+	if s.Running {
+		updateStateLock.Unlock()
+		rollbackUpdate(s)
+		return
+	}
+	s.Running = true
+	err := writeUpdateState(s)
+	updateStateLock.Unlock()
+	if err != nil {
+		log.Error("update: %s", err)
+		return
+	}
+	go confirmUpdate()
+}
+
+// The new version is shutting down cleanly: it's started again on the next start
+func markUpdateShutdown() {
+	updateStateLock.Lock()
+	defer updateStateLock.Unlock()
+	s, ok := readUpdateState()
+	if !ok || !s.Running {
+		return
+	}
+	s.Running = false
+	err := writeUpdateState(s)
+	if err != nil {
+		log.Error("update: %s", err)
+	}
+}
+
+// The new version is working
+func confirmUpdate() {
+	time.Sleep(updateConfirmDelay)
+	updateStateLock.Lock()
+	defer updateStateLock.Unlock()
+	_, ok := readUpdateState()
+	if !ok {
+		return
+	}
+	err := os.Remove(updateStatePath())
+	if err != nil {
+		log.Error("update: %s", err)
+		return
+	}
+	log.Info("Updated to %s successfully", VersionString)
+}
+
+// Restore the previous binary and configuration file, and start it
+func rollbackUpdate(s updateState) {
+	log.Error("Version %s has failed to start after the update, restoring the previous version", s.Version)
+	err := replaceFile(s.PrevBinary, s.Binary, 0755)
+	if err != nil {
+		log.Error("update: couldn't restore %s: %s", s.Binary, err)
+		return
+	}
+	err = replaceFile(s.PrevConfig, config.getConfigFilename(), 0644)
+	if err != nil {
+		log.Error("update: couldn't restore the configuration file: %s", err)
+	}
+	_ = os.Remove(updateStatePath())
+	restartProcess(s.Binary)
+}
+
+type updateCheckJSON struct {
+	Channel         string `json:"channel"`
+	CurrentVersion  string `json:"current_version"`
+	NewVersion      string `json:"new_version"`
+	Announcement    string `json:"announcement"`
+	AnnouncementURL string `json:"announcement_url"`
+	UpdateAvailable bool   `json:"update_available"`
+	CanAutoupdate   bool   `json:"can_autoupdate"`
+}
+
+// Check the latest version in the channel: ?channel=beta (default: the selected channel)
+func handleUpdateCheck(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	if config.disableUpdate {
+		httpError(w, http.StatusForbidden, "Update check is disabled")
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if len(channel) == 0 {
+		channel = currentUpdateChannel()
+	}
+	err := validateUpdateChannel(channel)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	data, err := getVersionJSON(channel, r.URL.Query().Get("force") == "1")
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "%s", err)
+		return
+	}
+	resp := updateCheckJSON{}
+	err = json.Unmarshal(getVersionResp(data), &resp)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "Invalid version.json data")
+		return
+	}
+	resp.Channel = channel
+	resp.CurrentVersion = VersionString
+	resp.UpdateAvailable = checkNewerVersion(resp.NewVersion) == nil
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
@@ -0,0 +1,206 @@
+package home
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestUpdateSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	key := updatePublicKey
+	defer func() { updatePublicKey = key }()
+
+	pkg := []byte("package")
+	sig := []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, updateSignedData("v9.9", pkg))) + "\n")
+	updatePublicKey = ""
+	if verifyUpdateSignature("v9.9", pkg, sig) == nil {
+		t.Fatalf("no key")
+	}
+	updatePublicKey = base64.StdEncoding.EncodeToString(pub)
+	if verifyUpdateSignature("v9.9", pkg, sig) != nil {
+		t.Fatalf("valid signature")
+	}
+	if verifyUpdateSignature("v9.9", []byte("altered"), sig) == nil || verifyUpdateSignature("v9.9", pkg, []byte("sig")) == nil {
+		t.Fatalf("invalid signature")
+	}
+	// the package of another version
+	if verifyUpdateSignature("v10.0", pkg, sig) == nil {
+		t.Fatalf("another version")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	older := [][2]string{
+		{"v0.99", "v0.100"},
+		{"v0.100", "v0.100.1"},
+		{"v0.100-beta.1", "v0.100"},
+		{"v0.100-beta.1", "v0.100-beta.2"},
+		{"v0.100-beta.2", "v0.100-beta.10"},
+		{"v0.100-b.1", "v0.100-beta"},
+		{"v0.100-beta", "v0.100-beta.1"},
+	}
+	for _, v := range older {
+		c, err := compareVersions(v[0], v[1])
+		if err != nil || c != -1 {
+			t.Fatalf("%s < %s: %d %v", v[0], v[1], c, err)
+		}
+		c, err = compareVersions(v[1], v[0])
+		if err != nil || c != 1 {
+			t.Fatalf("%s > %s: %d %v", v[1], v[0], c, err)
+		}
+	}
+	c, err := compareVersions("v0.100.0", "0.100")
+	if err != nil || c != 0 {
+		t.Fatalf("equal: %d %v", c, err)
+	}
+	_, err = compareVersions("undefined", "v0.100")
+	if err == nil {
+		t.Fatalf("invalid version")
+	}
+
+	version := VersionString
+	defer func() { VersionString = version }()
+	VersionString = "v0.100"
+	if checkNewerVersion("v0.101") != nil || checkNewerVersion("v0.100") == nil || checkNewerVersion("v0.99") == nil {
+		t.Fatalf("checkNewerVersion")
+	}
+}
+
+func TestUpdateCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-update")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := "v9.9"
+		if r.URL.Path == "/beta/version.json" {
+			version = "v9.9-b.1"
+		} else if r.URL.Path != "/release/version.json" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"version":                version,
+			"announcement":           "AdGuard Home " + version,
+			"announcement_url":       "",
+			"selfupdate_min_version": "v0.0",
+			"download_" + runtime.GOOS + "_" + runtime.GOARCH: "https://example.org/AdGuardHome.tar.gz",
+		})
+	}))
+	defer srv.Close()
+	baseURL, key, version := versionCheckBaseURL, updatePublicKey, VersionString
+	defer func() {
+		versionCheckBaseURL, updatePublicKey, VersionString = baseURL, key, version
+		versionCheckJSON, versionCheckChannel = nil, ""
+	}()
+	versionCheckBaseURL = srv.URL + "/"
+	updatePublicKey = "key"
+	VersionString = "v9.8"
+
+	check := func(query string) updateCheckJSON {
+		w := httptest.NewRecorder()
+		handleUpdateCheck(w, httptest.NewRequest("GET", "/control/update_check"+query, nil))
+		resp := updateCheckJSON{}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			t.Fatalf("update_check%s: %d %s", query, w.Code, w.Body.String())
+		}
+		return resp
+	}
+	resp := check("")
+	if resp.Channel != updateChannelStable || resp.NewVersion != "v9.9" || !resp.UpdateAvailable || !resp.CanAutoupdate {
+		t.Fatalf("stable: %+v", resp)
+	}
+	resp = check("?channel=beta")
+	if resp.Channel != updateChannelBeta || resp.NewVersion != "v9.9-b.1" {
+		t.Fatalf("beta: %+v", resp)
+	}
+	w := httptest.NewRecorder()
+	handleUpdateCheck(w, httptest.NewRequest("GET", "/control/update_check?channel=nightly", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid channel: %d", w.Code)
+	}
+
+	// the update request holds controlLock: version.json is requested without it
+	VersionString = "v9.9"
+	for i := 0; i != 2; i++ {
+		done := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			ensurePOST(handleUpdate)(w, httptest.NewRequest("POST", "/control/update", strings.NewReader("{}")))
+			done <- w.Code
+		}()
+		select {
+		case code := <-done:
+			if code == http.StatusOK {
+				t.Fatalf("update to the same version")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("/control/update is blocked")
+		}
+	}
+	VersionString = "v9.8"
+
+	// the binary is replaced
+	fn := filepath.Join(dir, "AdGuardHome")
+	_ = ioutil.WriteFile(fn, []byte("old"), 0755)
+	_ = ioutil.WriteFile(fn+"-update", []byte("new"), 0644)
+	err = replaceFile(fn+"-update", fn, 0755)
+	data, _ := ioutil.ReadFile(fn)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("replaceFile: %q %v", data, err)
+	}
+	if _, err = os.Stat(fn + ".new"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file: %v", err)
+	}
+
+	// the first start of the new version
+	workDir := config.ourWorkingDir
+	defer func() { config.ourWorkingDir = workDir }()
+	config.ourWorkingDir = dir
+	VersionString = "v9.9"
+	_ = writeUpdateState(updateState{Version: "v0.1"})
+	checkUpdateState()
+	if _, err = os.Stat(updateStatePath()); !os.IsNotExist(err) {
+		t.Fatalf("another version: %v", err)
+	}
+	_ = writeUpdateState(updateState{Version: "v9.9"})
+	checkUpdateState()
+	readState := func() updateState {
+		data, _ := ioutil.ReadFile(updateStatePath())
+		s := updateState{}
+		if json.Unmarshal(data, &s) != nil {
+			t.Fatalf("update state: %s", data)
+		}
+		return s
+	}
+	if !readState().Running {
+		t.Fatalf("the new version isn't running")
+	}
+
+	// the start after a clean shutdown isn't a failure
+	markUpdateShutdown()
+	if readState().Running {
+		t.Fatalf("the new version is still running")
+	}
+	checkUpdateState()
+	if !readState().Running {
+		t.Fatalf("the new version isn't running again")
+	}
+}
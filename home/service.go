@@ -4,7 +4,6 @@ import (
 	"os"
 	"runtime"
 
-	"github.com/AdguardTeam/golibs/log"
 	"github.com/kardianos/service"
 )
 
@@ -137,6 +136,11 @@ func configureService(c *service.Config) {
 	// POSIX
 	// Redirect StdErr & StdOut to files.
 	c.Option["LogOutput"] = true
+
+	// Linux, systemd
+	// The service notifies systemd when it's ready, and the configuration is reloaded by "systemctl reload"
+	c.Option["SystemdScript"] = systemdScript
+	c.Option["ReloadSignal"] = "HUP"
 }
 
 // cleanupService called on the service uninstall, cleans up additional files if needed
@@ -183,3 +187,31 @@ var launchdConfig = `<?xml version='1.0' encoding='UTF-8'?>
 </dict>
 </plist>
 `
+
+// Basically the same template as the one defined in github.com/kardianos/service
+// but with Type=notify: see systemd.go
+var systemdScript = `[Unit]
+Description={{.Description}}
+ConditionFileIsExecutable={{.Path|cmdEscape}}
+
+[Service]
+Type=notify
+StartLimitInterval=5
+StartLimitBurst=10
+ExecStart={{.Path|cmdEscape}}{{range .Arguments}} {{.|cmd}}{{end}}
+{{if .ChRoot}}RootDirectory={{.ChRoot|cmd}}{{end}}
+{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory|cmdEscape}}{{end}}
+{{if .UserName}}User={{.UserName}}{{end}}
+{{if .ReloadSignal}}ExecReload=/bin/kill -{{.ReloadSignal}} "$MAINPID"{{end}}
+{{if .PIDFile}}PIDFile={{.PIDFile|cmd}}{{end}}
+{{if and .LogOutput .HasOutputFileSupport -}}
+StandardOutput=file:/var/log/{{.Name}}.out
+StandardError=file:/var/log/{{.Name}}.err
+{{- end}}
+Restart=always
+RestartSec=120
+EnvironmentFile=-/etc/sysconfig/{{.Name}}
+
+[Install]
+WantedBy=multi-user.target
+`
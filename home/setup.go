@@ -0,0 +1,192 @@
+// Non-interactive first run
+// When the configuration file doesn't exist, it may be created from the command-line options,
+//  the environment variables or a seed YAML file instead of the first-run wizard (e.g. in Docker or by Ansible).
+// The command-line options override the environment variables, and they override the seed file.
+//  --setup-seed FILE       $AGH_SETUP_SEED
+//  --setup-user NAME       $AGH_SETUP_USER
+//  --setup-password PASS   $AGH_SETUP_PASSWORD
+//  --setup-web IP:PORT     $AGH_SETUP_WEB
+//  --setup-dns IP:PORT     $AGH_SETUP_DNS
+//  --setup-upstreams LIST  $AGH_SETUP_UPSTREAMS  comma-separated
+//  --setup-filters LIST    $AGH_SETUP_FILTERS    comma-separated URLs or "none" (default: the default filter lists)
+// The settings which aren't specified have the same values as in the wizard.
+
+package home
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The first-run settings, the seed file has the same format
+type setupConfig struct {
+	User      string    `yaml:"user"`
+	Password  string    `yaml:"password"`
+	Web       string    `yaml:"web"` // IP:port of the web interface
+	DNS       string    `yaml:"dns"` // IP:port of the DNS server
+	Upstreams []string  `yaml:"upstream_dns"`
+	Filters   *[]string `yaml:"filters"` // the URLs of the filter lists (nil: the default lists)
+}
+
+// The options which are passed on the command line
+type setupOptions struct {
+	seedFile  string
+	user      string
+	password  string
+	web       string
+	dns       string
+	upstreams string
+	filters   string
+}
+
+// Split the comma-separated list
+func splitSetupList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) != 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Override the setting by the command-line option or the environment variable
+// Returns TRUE if the setting is specified
+func (s *setupConfig) override(opt, env string) bool {
+	if len(opt) == 0 {
+		opt = os.Getenv(env)
+	}
+	if len(opt) == 0 {
+		return false
+	}
+	switch env {
+	case "AGH_SETUP_USER":
+		s.User = opt
+	case "AGH_SETUP_PASSWORD":
+		s.Password = opt
+	case "AGH_SETUP_WEB":
+		s.Web = opt
+	case "AGH_SETUP_DNS":
+		s.DNS = opt
+	case "AGH_SETUP_UPSTREAMS":
+		s.Upstreams = splitSetupList(opt)
+	case "AGH_SETUP_FILTERS":
+		filters := []string{}
+		if opt != "none" {
+			filters = splitSetupList(opt)
+		}
+		s.Filters = &filters
+	}
+	return true
+}
+
+// Get the first-run settings
+// Returns nil if they aren't specified: the wizard is used
+func loadSetupConfig(o setupOptions) (*setupConfig, error) {
+	s := &setupConfig{}
+	seedFile := o.seedFile
+	if len(seedFile) == 0 {
+		seedFile = os.Getenv("AGH_SETUP_SEED")
+	}
+	if len(seedFile) != 0 {
+		data, err := ioutil.ReadFile(seedFile)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read the seed file: %s", err)
+		}
+		err = yaml.UnmarshalStrict(data, s)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the seed file %s: %s", seedFile, err)
+		}
+	}
+
+	specified := len(seedFile) != 0
+	for _, v := range []struct{ opt, env string }{
+		{o.user, "AGH_SETUP_USER"},
+		{o.password, "AGH_SETUP_PASSWORD"},
+		{o.web, "AGH_SETUP_WEB"},
+		{o.dns, "AGH_SETUP_DNS"},
+		{o.upstreams, "AGH_SETUP_UPSTREAMS"},
+		{o.filters, "AGH_SETUP_FILTERS"},
+	} {
+		if s.override(v.opt, v.env) {
+			specified = true
+		}
+	}
+	if !specified {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Parse IP:port, the port must not be 0
+func parseSetupAddress(name, addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid %s address %q: %s", name, addr, err)
+	}
+	if net.ParseIP(host) == nil {
+		return "", 0, fmt.Errorf("invalid %s address %q: the host must be an IP address", name, addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 0xffff {
+		return "", 0, fmt.Errorf("invalid %s address %q: invalid port", name, addr)
+	}
+	return host, p, nil
+}
+
+// Apply the first-run settings and write the configuration file
+func applySetupConfig(s *setupConfig) error {
+	if (len(s.User) == 0) != (len(s.Password) == 0) {
+		return fmt.Errorf("both the user name and the password must be specified")
+	}
+
+	var err error
+	if len(s.Web) != 0 {
+		config.BindHost, config.BindPort, err = parseSetupAddress("web", s.Web)
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.DNS) != 0 {
+		config.DNS.BindHost, config.DNS.Port, err = parseSetupAddress("DNS", s.DNS)
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.Upstreams) != 0 {
+		err = validateUpstreams(s.Upstreams)
+		if err != nil {
+			return fmt.Errorf("invalid upstream servers: %s", err)
+		}
+		config.DNS.UpstreamDNS = s.Upstreams
+	}
+	if s.Filters != nil {
+		config.Filters = []filter{}
+		for _, u := range *s.Filters {
+			f := filter{Enabled: true, URL: u, Name: u}
+			f.ID = assignUniqueFilterID()
+			config.Filters = append(config.Filters, f)
+		}
+	}
+	if len(s.User) != 0 {
+		hash, err := hashPassword(s.Password)
+		if err != nil {
+			return err
+		}
+		config.Users = []webUser{{Name: s.User, PasswordHash: hash}}
+	}
+
+	err = config.write()
+	if err != nil {
+		return fmt.Errorf("couldn't write config: %s", err)
+	}
+	log.Info("The configuration is created from the first-run settings")
+	return nil
+}
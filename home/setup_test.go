@@ -0,0 +1,70 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-setup")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := loadSetupConfig(setupOptions{})
+	if err != nil || s != nil {
+		t.Fatalf("no settings: %v %v", s, err)
+	}
+
+	seed := filepath.Join(dir, "seed.yaml")
+	_ = ioutil.WriteFile(seed, []byte("user: admin\npassword: password\nweb: 127.0.0.1:3000\nfilters: []\n"), 0600)
+	os.Setenv("AGH_SETUP_WEB", "0.0.0.0:8080")
+	os.Setenv("AGH_SETUP_UPSTREAMS", "tls://1.1.1.1, 8.8.8.8")
+	defer os.Unsetenv("AGH_SETUP_WEB")
+	defer os.Unsetenv("AGH_SETUP_UPSTREAMS")
+
+	s, err = loadSetupConfig(setupOptions{seedFile: seed, web: "0.0.0.0:80"})
+	if err != nil || s == nil {
+		t.Fatalf("loadSetupConfig: %v", err)
+	}
+	if s.User != "admin" || s.Web != "0.0.0.0:80" || len(s.Upstreams) != 2 || s.Filters == nil || len(*s.Filters) != 0 {
+		t.Fatalf("settings: %+v", s)
+	}
+
+	_ = ioutil.WriteFile(seed, []byte("user: admin\nunknown: 1\n"), 0600)
+	_, err = loadSetupConfig(setupOptions{seedFile: seed})
+	if err == nil {
+		t.Fatalf("unknown setting")
+	}
+
+	if applySetupConfig(&setupConfig{User: "admin"}) == nil ||
+		applySetupConfig(&setupConfig{DNS: "localhost:53"}) == nil ||
+		applySetupConfig(&setupConfig{DNS: "0.0.0.0:0"}) == nil {
+		t.Fatalf("invalid settings")
+	}
+
+	workDir, configFile := config.ourWorkingDir, config.ourConfigFilename
+	users, filters, bindPort := config.Users, config.Filters, config.BindPort
+	upstreams := config.DNS.UpstreamDNS
+	defer func() {
+		config.ourWorkingDir, config.ourConfigFilename = workDir, configFile
+		config.Users, config.Filters, config.BindPort = users, filters, bindPort
+		config.DNS.UpstreamDNS = upstreams
+	}()
+	config.ourWorkingDir = dir
+	config.ourConfigFilename = "AdGuardHome.yaml"
+
+	err = applySetupConfig(s)
+	if err != nil {
+		t.Fatalf("applySetupConfig: %s", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "AdGuardHome.yaml"))
+	if config.BindPort != 80 || len(config.Filters) != 0 || len(config.Users) != 1 ||
+		config.Users[0].PasswordHash == "password" || !strings.Contains(string(data), "tls://1.1.1.1") {
+		t.Fatalf("config: %d %v %v\n%s", config.BindPort, config.Filters, config.Users, data)
+	}
+}
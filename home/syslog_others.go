@@ -3,16 +3,11 @@
 package home
 
 import (
-	"log"
+	"io"
 	"log/syslog"
 )
 
-// configureSyslog reroutes standard logger output to syslog
-func configureSyslog() error {
-	w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_USER, serviceName)
-	if err != nil {
-		return err
-	}
-	log.SetOutput(w)
-	return nil
+// syslogWriter returns the writer of the messages to syslog
+func syslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_NOTICE|syslog.LOG_USER, serviceName)
 }
@@ -1,7 +1,7 @@
 package home
 
 import (
-	"log"
+	"io"
 	"strings"
 
 	"golang.org/x/sys/windows"
@@ -17,7 +17,8 @@ func (w *eventLogWriter) Write(b []byte) (int, error) {
 	return len(b), w.el.Info(1, string(b))
 }
 
-func configureSyslog() error {
+// syslogWriter returns the writer of the messages to the Event Log
+func syslogWriter() (io.Writer, error) {
 	// Note that the eventlog src is the same as the service name
 	// Otherwise, we will get "the description for event id cannot be found" warning in every log record
 
@@ -26,14 +27,12 @@ func configureSyslog() error {
 	// for pre-existing eventlog sources.
 	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Info|eventlog.Warning|eventlog.Error); err != nil {
 		if !strings.Contains(err.Error(), "registry key already exists") && err != windows.ERROR_ACCESS_DENIED {
-			return err
+			return nil, err
 		}
 	}
 	el, err := eventlog.Open(serviceName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	log.SetOutput(&eventLogWriter{el: el})
-	return nil
+	return &eventLogWriter{el: el}, nil
 }
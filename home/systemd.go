@@ -0,0 +1,192 @@
+// systemd integration
+// Socket activation: systemd may open the listening sockets and pass them to us (LISTEN_FDS),
+//  then port 53 is held by systemd while the service restarts, and the requests wait in the socket instead of failing.
+//  The sockets are told apart by FileDescriptorName= in the .socket unit: "dns" (UDP and TCP) and "web".
+//  An unnamed socket is assigned by its port: the DNS port or the web interface port.
+//  The passed sockets of a service are used instead of its listen addresses from the configuration.
+// Notifications (Type=notify): READY=1 when the services have started, RELOADING=1 while the configuration is reloaded,
+//  STOPPING=1 on shutdown, and WATCHDOG=1 every half of WatchdogSec= while the DNS server is running.
+
+package home
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first file descriptor passed by systemd
+const systemdListenFDsStart = 3
+
+// The sockets passed by systemd
+var systemdSockets struct {
+	dns []*os.File
+	web []*os.File
+}
+
+// A socket passed by systemd
+type systemdSocket struct {
+	file *os.File
+	name string // FileDescriptorName= of the socket
+}
+
+// Get the sockets passed by systemd
+// The environment variables are removed, so the child processes don't use the sockets.
+func systemdListenFDs() []systemdSocket {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	sockets := []systemdSocket{}
+	for i := 0; i < n; i++ {
+		s := systemdSocket{}
+		if i < len(names) {
+			s.name = names[i]
+		}
+		fd := systemdListenFDsStart + i
+		s.file = os.NewFile(uintptr(fd), fmt.Sprintf("%d", fd))
+		sockets = append(sockets, s)
+	}
+	return sockets
+}
+
+// Get the port of the socket (0: unknown)
+func socketPort(f *os.File) int {
+	var addr net.Addr
+	conn, err := net.FilePacketConn(f)
+	if err == nil {
+		addr = conn.LocalAddr()
+		_ = conn.Close()
+	} else {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return 0
+		}
+		addr = ln.Addr()
+		_ = ln.Close()
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Sort the sockets passed by systemd by the services
+func initSystemdSockets() {
+	for _, s := range systemdListenFDs() {
+		name := s.name
+		if name != "dns" && name != "web" {
+			switch socketPort(s.file) {
+			case config.DNS.Port:
+				name = "dns"
+			case config.BindPort:
+				name = "web"
+			}
+		}
+		switch name {
+		case "dns":
+			systemdSockets.dns = append(systemdSockets.dns, s.file)
+		case "web":
+			systemdSockets.web = append(systemdSockets.web, s.file)
+		default:
+			log.Error("systemd: socket %s (%q) isn't used: unknown service", s.file.Name(), s.name)
+			continue
+		}
+		log.Info("systemd: using socket %s for %s", s.file.Name(), name)
+	}
+}
+
+// Serve the web interface on the sockets passed by systemd
+// The server listens on the duplicates of the sockets, so it may be started again after Shutdown().
+func serveSystemdWeb(primary *http.Server) error {
+	listeners := []net.Listener{}
+	for _, f := range systemdSockets.web {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return fmt.Errorf("systemd: socket %s: %s", f.Name(), err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	for _, ln := range listeners[1:] {
+		srv := &http.Server{}
+		srv.RegisterOnShutdown(stopQueryLogStreams)
+		primary.RegisterOnShutdown(func() { _ = srv.Shutdown(context.TODO()) })
+		go func(ln net.Listener) {
+			log.Printf("Listening to http://%s (socket activation)", ln.Addr())
+			err := srv.Serve(ln)
+			if err != http.ErrServerClosed {
+				log.Error("Couldn't serve %s: %s", ln.Addr(), err)
+			}
+		}(ln)
+	}
+	log.Printf("Listening to http://%s (socket activation)", listeners[0].Addr())
+	return primary.Serve(listeners[0])
+}
+
+// Send the notification to systemd
+// Nothing is sent if we aren't started by systemd with Type=notify.
+func sdNotify(state string) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if len(name) == 0 {
+		return
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		log.Debug("systemd: couldn't notify: %s", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		log.Debug("systemd: couldn't notify: %s", err)
+	}
+}
+
+// Get the watchdog interval (0: the watchdog is disabled)
+func systemdWatchdogInterval() time.Duration {
+	pid := os.Getenv("WATCHDOG_PID")
+	if len(pid) != 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Tell systemd we're alive until the DNS server stops working, then systemd restarts us
+func periodicallyNotifyWatchdog() {
+	interval := systemdWatchdogInterval() / 2
+	if interval == 0 {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		if config.firstRun || isRunning() {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
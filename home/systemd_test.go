@@ -0,0 +1,67 @@
+package home
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSystemd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-systemd")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram: %s", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	sdNotify("READY=1")
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("notification: %q %v", buf[:n], err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File: %s", err)
+	}
+	defer f.Close()
+	if socketPort(f) != ln.Addr().(*net.TCPAddr).Port {
+		t.Fatalf("socketPort: %d", socketPort(f))
+	}
+
+	// the sockets are passed to another process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if len(systemdListenFDs()) != 0 || len(os.Getenv("LISTEN_FDS")) != 0 {
+		t.Fatalf("LISTEN_PID")
+	}
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	if systemdWatchdogInterval() != 30*time.Second {
+		t.Fatalf("watchdog: %s", systemdWatchdogInterval())
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if systemdWatchdogInterval() != 0 {
+		t.Fatalf("watchdog of another process")
+	}
+}
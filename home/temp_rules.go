@@ -0,0 +1,166 @@
+// Temporary rules: allow or block a domain for a limited time
+// E.g. unblock a tracking domain for 15 minutes to complete a purchase.
+// The expired rules are removed by a background job.
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Temporary rule actions
+const (
+	tempRuleAllow = "allow"
+	tempRuleBlock = "block"
+)
+
+const maxTempRuleTTL = 7 * 24 * 60 * 60 // in seconds
+
+var hostnameRegexp = regexp.MustCompile(`^([a-z0-9_]([a-z0-9_-]*[a-z0-9_])?\.)*[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?$`)
+
+type tempRule struct {
+	Domain  string    `yaml:"domain"`
+	Action  string    `yaml:"action"` // "allow" or "block"
+	Expires time.Time `yaml:"expires"`
+}
+
+// Get the filtering rule text
+// The rule is important, so it takes precedence over the rules of filter lists
+func (r *tempRule) rule() string {
+	if r.Action == tempRuleAllow {
+		return "@@||" + r.Domain + "^$important"
+	}
+	return "||" + r.Domain + "^$important"
+}
+
+// Get the rules which haven't expired yet
+func activeTempRules(now time.Time) []string {
+	rules := []string{}
+	config.RLock()
+	for i := range config.TempRules {
+		if now.Before(config.TempRules[i].Expires) {
+			rules = append(rules, config.TempRules[i].rule())
+		}
+	}
+	config.RUnlock()
+	return rules
+}
+
+// Remove the expired rules
+// Returns TRUE if the list has been changed
+func removeExpiredTempRules(now time.Time) bool {
+	config.Lock()
+	defer config.Unlock()
+	rules := []tempRule{}
+	for _, r := range config.TempRules {
+		if now.Before(r.Expires) {
+			rules = append(rules, r)
+			continue
+		}
+		log.Info("Temporary rule has expired: %s %s", r.Action, r.Domain)
+	}
+	changed := len(rules) != len(config.TempRules)
+	config.TempRules = rules
+	return changed
+}
+
+// Remove the expired rules periodically
+func periodicallyRemoveExpiredTempRules() {
+	for range time.Tick(10 * time.Second) {
+		if !removeExpiredTempRules(time.Now()) {
+			continue
+		}
+		err := writeAllConfigsAndReloadDNS()
+		if err != nil {
+			log.Error("Couldn't apply the expired temporary rules: %s", err)
+		}
+	}
+}
+
+type tempRuleJSON struct {
+	Domain    string    `json:"domain"`
+	Action    string    `json:"action"`
+	Expires   time.Time `json:"expires"`
+	Remaining int       `json:"remaining"` // seconds until the rule expires
+}
+
+// Get the status of the temporary rules
+// Must be called with the configuration lock held
+func getTempRulesStatus(now time.Time) []tempRuleJSON {
+	list := []tempRuleJSON{}
+	for _, r := range config.TempRules {
+		if !now.Before(r.Expires) {
+			continue
+		}
+		list = append(list, tempRuleJSON{
+			Domain:    r.Domain,
+			Action:    r.Action,
+			Expires:   r.Expires,
+			Remaining: int((r.Expires.Sub(now) + time.Second - 1) / time.Second),
+		})
+	}
+	return list
+}
+
+// Add a temporary rule for the domain, replacing the existing one
+// TTL 0 removes the rule
+func setTempRule(domain, action string, ttl int, now time.Time) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !hostnameRegexp.MatchString(domain) {
+		return fmt.Errorf("invalid domain: %s", domain)
+	}
+	if ttl != 0 && action != tempRuleAllow && action != tempRuleBlock {
+		return fmt.Errorf("invalid action: %s", action)
+	}
+	if ttl < 0 || ttl > maxTempRuleTTL {
+		return fmt.Errorf("ttl must be within 0..%d seconds", maxTempRuleTTL)
+	}
+
+	config.Lock()
+	defer config.Unlock()
+	rules := []tempRule{}
+	for _, r := range config.TempRules {
+		if r.Domain != domain {
+			rules = append(rules, r)
+		}
+	}
+	if ttl != 0 {
+		rules = append(rules, tempRule{
+			Domain:  domain,
+			Action:  action,
+			Expires: now.Add(time.Duration(ttl) * time.Second),
+		})
+	}
+	config.TempRules = rules
+	return nil
+}
+
+// Add or remove a temporary rule
+func handleFilteringTempRule(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := struct {
+		Domain string `json:"domain"`
+		Action string `json:"action"`
+		TTL    int    `json:"ttl"` // in seconds
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	err = setTempRule(req.Domain, req.Action, req.TTL, time.Now())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	log.Info("Temporary rule: %s %s for %d seconds", req.Action, req.Domain, req.TTL)
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
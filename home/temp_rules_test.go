@@ -0,0 +1,47 @@
+package home
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTempRules(t *testing.T) {
+	saved := config.TempRules
+	defer func() { config.TempRules = saved }()
+	config.TempRules = nil
+
+	now := time.Now()
+	if setTempRule("doubleclick.net", tempRuleAllow, 900, now) != nil ||
+		setTempRule("Ads.Example.org.", tempRuleBlock, 60, now) != nil {
+		t.Fatalf("setTempRule")
+	}
+	if setTempRule("||example.org^", tempRuleBlock, 60, now) == nil ||
+		setTempRule("example.org", "deny", 60, now) == nil ||
+		setTempRule("example.org", tempRuleBlock, maxTempRuleTTL+1, now) == nil {
+		t.Fatalf("setTempRule: invalid rules must not be accepted")
+	}
+
+	rules := strings.Join(activeTempRules(now), "\n")
+	if rules != "@@||doubleclick.net^$important\n||ads.example.org^$important" {
+		t.Fatalf("activeTempRules: %s", rules)
+	}
+	st := getTempRulesStatus(now.Add(30 * time.Second))
+	if len(st) != 2 || st[0].Remaining != 870 || st[1].Domain != "ads.example.org" {
+		t.Fatalf("getTempRulesStatus: %+v", st)
+	}
+
+	// the rule for ads.example.org expires
+	later := now.Add(2 * time.Minute)
+	if len(activeTempRules(later)) != 1 || !removeExpiredTempRules(later) || len(config.TempRules) != 1 {
+		t.Fatalf("removeExpiredTempRules: %+v", config.TempRules)
+	}
+	if removeExpiredTempRules(later) {
+		t.Fatalf("removeExpiredTempRules: nothing to remove")
+	}
+
+	// TTL 0 removes the rule
+	if setTempRule("doubleclick.net", "", 0, now) != nil || len(config.TempRules) != 0 {
+		t.Fatalf("setTempRule: %+v", config.TempRules)
+	}
+}
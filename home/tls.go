@@ -0,0 +1,200 @@
+// TLS certificate
+// The certificates chain and the private key are either stored in the configuration file
+// or loaded from the files (certificate_path, private_key_path), e.g. the ones renewed by certbot.
+// The files are checked periodically, and the new certificate is used for the new connections right away:
+// HTTPS, DNS-over-HTTPS and DNS-over-TLS listeners aren't restarted.
+
+package home
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const tlsReloadPeriod = time.Minute
+
+type tlsCertContainer struct {
+	cert    *tls.Certificate // the certificate used by the listeners
+	certMod time.Time        // the modification time of the certificate file it's loaded from
+	keyMod  time.Time        // the modification time of the private key file
+	lock    sync.RWMutex
+}
+
+var tlsCert tlsCertContainer
+
+// Load the certificates chain and the private key from the files, if they are set
+func loadTLSFiles(s *tlsConfigSettings) error {
+	if len(s.CertificatePath) != 0 {
+		data, err := ioutil.ReadFile(s.CertificatePath)
+		if err != nil {
+			return fmt.Errorf("Couldn't read the certificate file: %s", err)
+		}
+		s.CertificateChain = string(data)
+	}
+	if len(s.PrivateKeyPath) != 0 {
+		data, err := ioutil.ReadFile(s.PrivateKeyPath)
+		if err != nil {
+			return fmt.Errorf("Couldn't read the private key file: %s", err)
+		}
+		s.PrivateKey = string(data)
+	}
+	return nil
+}
+
+// Get the modification times of the certificate and the private key files (zero if a file isn't set)
+func tlsFilesModTime(s tlsConfigSettings) (time.Time, time.Time) {
+	modTime := func(fn string) time.Time {
+		if len(fn) == 0 {
+			return time.Time{}
+		}
+		st, err := os.Stat(fn)
+		if err != nil {
+			return time.Time{}
+		}
+		return st.ModTime()
+	}
+	return modTime(s.CertificatePath), modTime(s.PrivateKeyPath)
+}
+
+// Use the new certificate for the new connections
+func setTLSCertificate(certChain, pkey string) error {
+	cert, err := tls.X509KeyPair([]byte(certChain), []byte(pkey))
+	if err != nil {
+		return err
+	}
+	tlsCert.lock.Lock()
+	tlsCert.cert = &cert
+	tlsCert.lock.Unlock()
+	return nil
+}
+
+// Get the certificate for the TLS handshake
+func getTLSCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	tlsCert.lock.RLock()
+	defer tlsCert.lock.RUnlock()
+	if tlsCert.cert == nil {
+		return nil, errors.New("no certificate")
+	}
+	return tlsCert.cert, nil
+}
+
+// Return TRUE if the settings other than the certificate and the private key are different
+func tlsSettingsChanged(a, b tlsConfigSettings) bool {
+	for _, s := range []*tlsConfigSettings{&a, &b} {
+		s.CertificateChain = ""
+		s.PrivateKey = ""
+		s.CertificatePath = ""
+		s.PrivateKeyPath = ""
+	}
+	return !reflect.DeepEqual(a, b)
+}
+
+// Return TRUE if the listeners are using the certificate
+func tlsCertificateSet(s tlsConfigSettings) bool {
+	return s.Enabled && len(s.CertificateChain) != 0 && len(s.PrivateKey) != 0
+}
+
+// Load the certificate before the listeners start
+func initTLS() {
+	certMod, keyMod := tlsFilesModTime(config.TLS.tlsConfigSettings)
+	err := loadTLSFiles(&config.TLS.tlsConfigSettings)
+	if err != nil {
+		log.Error("TLS: %s", err)
+	}
+	tlsCert.certMod = certMod
+	tlsCert.keyMod = keyMod
+
+	if tlsCertificateSet(config.TLS.tlsConfigSettings) {
+		err = setTLSCertificate(config.TLS.CertificateChain, config.TLS.PrivateKey)
+		if err != nil {
+			log.Error("TLS: %s", err)
+		}
+	}
+}
+
+// Don't write the certificate and the private key loaded from the files to the configuration file
+// Returns the function which restores them.  The config lock must be held.
+func excludeTLSFileContents() func() {
+	certChain := config.TLS.CertificateChain
+	pkey := config.TLS.PrivateKey
+	if len(config.TLS.CertificatePath) != 0 {
+		config.TLS.CertificateChain = ""
+	}
+	if len(config.TLS.PrivateKeyPath) != 0 {
+		config.TLS.PrivateKey = ""
+	}
+	return func() {
+		config.TLS.CertificateChain = certChain
+		config.TLS.PrivateKey = pkey
+	}
+}
+
+// Load the certificate again if its files have changed
+func reloadTLSFiles() {
+	config.RLock()
+	settings := config.TLS.tlsConfigSettings
+	config.RUnlock()
+	if len(settings.CertificatePath) == 0 && len(settings.PrivateKeyPath) == 0 {
+		return
+	}
+
+	certMod, keyMod := tlsFilesModTime(settings)
+	tlsCert.lock.Lock()
+	changed := !certMod.Equal(tlsCert.certMod) || !keyMod.Equal(tlsCert.keyMod)
+	tlsCert.certMod = certMod
+	tlsCert.keyMod = keyMod
+	tlsCert.lock.Unlock()
+	if !changed {
+		return
+	}
+
+	wasSet := tlsCertificateSet(settings)
+	err := loadTLSFiles(&settings)
+	if err != nil {
+		log.Error("TLS: %s", err)
+		return
+	}
+	status := validateCertificates(settings.CertificateChain, settings.PrivateKey, settings.ServerName)
+	if !status.ValidPair {
+		log.Error("TLS: the new certificate isn't used: %s", status.WarningValidation)
+		return
+	}
+
+	if tlsCertificateSet(settings) {
+		err = setTLSCertificate(settings.CertificateChain, settings.PrivateKey)
+		if err != nil {
+			log.Error("TLS: %s", err)
+			return
+		}
+	}
+	config.Lock()
+	config.TLS.CertificateChain = settings.CertificateChain
+	config.TLS.PrivateKey = settings.PrivateKey
+	config.TLS.tlsConfigStatus = status
+	config.Unlock()
+	log.Info("TLS: loaded the new certificate for %s, valid until %s", status.Subject, status.NotAfter.Format(time.RFC3339))
+
+	if !wasSet && tlsCertificateSet(settings) {
+		// the files have appeared: start the listeners which were waiting for them
+		httpsServer.cond.L.Lock()
+		httpsServer.cond.Broadcast()
+		httpsServer.cond.L.Unlock()
+		err = reconfigureDNSServer()
+		if err != nil {
+			log.Error("TLS: %s", err)
+		}
+	}
+}
+
+func periodicallyReloadTLSFiles() {
+	for {
+		time.Sleep(tlsReloadPeriod)
+		reloadTLSFiles()
+	}
+}
@@ -0,0 +1,376 @@
+// Local certificate authority for HTTPS access via LAN host names
+// The CA is name-constrained: it can only sign the server name it was created for, the local domain suffixes
+//  and the private IP addresses, so its leaked key can't be used to impersonate other sites.
+
+package home
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/file"
+	"github.com/AdguardTeam/golibs/utils"
+)
+
+const (
+	localCACertFile = "local_ca.crt"
+	localCAKeyFile  = "local_ca.key"
+
+	localCAValidity   = 10 * 365 * 24 * time.Hour
+	localCertValidity = 825 * 24 * time.Hour // the maximum validity accepted by Apple devices
+)
+
+// The domain suffixes which are only resolved in the local network
+var localCADomains = []string{"lan", "local", "localdomain", "home.arpa", "internal"}
+
+// The private and link-local address ranges
+var localCAIPRanges = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+	"::1/128",
+}
+
+// localCA is the certificate authority which issues certificates for the LAN host names of this instance
+type localCA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     *ecdsa.PrivateKey
+}
+
+func localCAPaths() (string, string) {
+	dir := filepath.Join(config.ourWorkingDir, dataDir)
+	return filepath.Join(dir, localCACertFile), filepath.Join(dir, localCAKeyFile)
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
+
+func marshalECKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// Return TRUE if the name is one of the domains or their subdomain
+func domainPermitted(domains []string, name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the domains the CA for this server name may sign
+func localCAPermittedDomains(serverName string) []string {
+	domains := append([]string{}, localCADomains...)
+	if len(serverName) != 0 && !domainPermitted(domains, serverName) {
+		domains = append(domains, strings.TrimPrefix(serverName, "*."))
+	}
+	return domains
+}
+
+func localCAPermittedIPs() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, s := range localCAIPRanges {
+		_, ipnet, _ := net.ParseCIDR(s)
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+// Load the local CA from disk or create a new one
+// A new CA replaces the one which can't sign this server name, including the CA created before the name constraints.
+func loadOrCreateLocalCA(serverName string) (*localCA, error) {
+	certFile, keyFile := localCAPaths()
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err == nil {
+		keyPEM, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %s", keyFile, err)
+		}
+		ca, err := parseLocalCA(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		if ca.permits(serverName) {
+			return ca, nil
+		}
+		log.Info("Local CA %s can't sign %s: replacing it, the new CA must be installed on the devices", certFile, serverName)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't read %s: %s", certFile, err)
+	}
+
+	ca, keyPEM, err := createLocalCA(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(keyFile), 0755)
+	if err != nil {
+		return nil, err
+	}
+	// write the key first: a certificate without a key would be useless
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't write %s: %s", keyFile, err)
+	}
+	err = file.SafeWrite(certFile, ca.certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("can't write %s: %s", certFile, err)
+	}
+
+	log.Info("Created local CA: %s", certFile)
+	return ca, nil
+}
+
+func parseLocalCA(certPEM, keyPEM []byte) (*localCA, error) {
+	b, _ := pem.Decode(certPEM)
+	if b == nil || b.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("local CA certificate: invalid PEM data")
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("local CA certificate: %s", err)
+	}
+
+	b, _ = pem.Decode(keyPEM)
+	if b == nil {
+		return nil, fmt.Errorf("local CA key: invalid PEM data")
+	}
+	key, err := x509.ParseECPrivateKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("local CA key: %s", err)
+	}
+
+	return &localCA{cert: cert, certPEM: certPEM, key: key}, nil
+}
+
+// Return TRUE if the CA is name-constrained and it can sign this server name
+func (ca *localCA) permits(serverName string) bool {
+	return ca.cert.PermittedDNSDomainsCritical &&
+		len(ca.cert.PermittedIPRanges) != 0 &&
+		domainPermitted(ca.cert.PermittedDNSDomains, serverName)
+}
+
+// Generate a new self-signed CA certificate which may sign the server name and the local names
+func createLocalCA(serverName string) (*localCA, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"AdGuard Home"},
+			CommonName:   fmt.Sprintf("AdGuard Home local CA (%s)", hostname),
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(localCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         localCAPermittedDomains(serverName),
+		PermittedIPRanges:           localCAPermittedIPs(),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := marshalECKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca := &localCA{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:     key,
+	}
+	return ca, keyPEM, nil
+}
+
+// Issue a certificate for the host name and IP addresses
+// The addresses which the CA isn't allowed to sign are skipped.
+// Return the PEM-encoded certificates chain and private key
+func (ca *localCA) issue(serverName string, ips []net.IP) (string, string, error) {
+	if !domainPermitted(ca.cert.PermittedDNSDomains, serverName) {
+		return "", "", fmt.Errorf("the local CA can't sign %s", serverName)
+	}
+	var permittedIPs []net.IP
+	for _, ip := range ips {
+		for _, ipnet := range ca.cert.PermittedIPRanges {
+			if ipnet.Contains(ip) {
+				permittedIPs = append(permittedIPs, ip)
+				break
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"AdGuard Home"},
+			CommonName:   serverName,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(localCertValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{serverName},
+		IPAddresses: permittedIPs,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyPEM, err := marshalECKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	chain := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) + string(ca.certPEM)
+	return chain, string(keyPEM), nil
+}
+
+// Get the IP addresses of this machine that are reachable from LAN
+func localCertIPs() []net.IP {
+	ips := []net.IP{}
+	ifaces, err := getValidNetInterfacesForWeb()
+	if err != nil {
+		log.Debug("local CA: %s", err)
+		return ips
+	}
+	for _, iface := range ifaces {
+		for _, addr := range iface.Addresses {
+			ip := net.ParseIP(addr)
+			if ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// Issue a certificate for the LAN host name signed by the local CA
+// The response is the same as for /control/tls/validate, the settings are saved by /control/tls/configure
+func handleTLSLocalCAIssue(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	req := struct {
+		ServerName string `json:"server_name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+	if len(req.ServerName) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "Couldn't get hostname: %s", err)
+			return
+		}
+		req.ServerName = strings.ToLower(hostname) + ".lan"
+	}
+	err = utils.IsValidHostname(req.ServerName)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Invalid server name: %s", err)
+		return
+	}
+
+	ca, err := loadOrCreateLocalCA(req.ServerName)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Local CA: %s", err)
+		return
+	}
+	chain, key, err := ca.issue(req.ServerName, localCertIPs())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't issue a certificate: %s", err)
+		return
+	}
+
+	config.RLock()
+	data := config.TLS
+	config.RUnlock()
+	data.ServerName = req.ServerName
+	data.CertificatePath = ""
+	data.PrivateKeyPath = ""
+	data.CertificateChain = chain
+	data.PrivateKey = key
+	data.tlsConfigStatus = validateCertificates(data.CertificateChain, data.PrivateKey, data.ServerName)
+	marshalTLS(w, data)
+}
+
+// Download the local CA certificate to install it on devices
+func handleTLSLocalCACert(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	certFile, _ := localCAPaths()
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, "Local CA hasn't been created yet")
+			return
+		}
+		httpError(w, http.StatusInternalServerError, "Couldn't read %s: %s", certFile, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"adguardhome_ca.crt\"")
+	_, err = w.Write(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
+	}
+}
@@ -0,0 +1,131 @@
+package home
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Parse the issued chain and verify the leaf against the CA
+func verifyLocalCert(t *testing.T, ca *localCA, chain, key, name string) *x509.Certificate {
+	pair, err := tls.X509KeyPair([]byte(chain), []byte(key))
+	if err != nil {
+		t.Fatalf("X509KeyPair: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+	if err != nil {
+		t.Fatalf("Verify %s: %s", name, err)
+	}
+	return leaf
+}
+
+func TestLocalCA(t *testing.T) {
+	ca, keyPEM, err := createLocalCA("router.example.org")
+	if err != nil {
+		t.Fatalf("createLocalCA: %s", err)
+	}
+	if !ca.cert.IsCA || !ca.cert.MaxPathLenZero || !ca.cert.PermittedDNSDomainsCritical {
+		t.Fatalf("CA: %+v", ca.cert)
+	}
+	if !ca.permits("router.example.org") || !ca.permits("nas.lan") || ca.permits("www.example.com") {
+		t.Fatalf("permitted domains: %v", ca.cert.PermittedDNSDomains)
+	}
+	_, err = parseLocalCA(ca.certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("parseLocalCA: %s", err)
+	}
+
+	// the public address is skipped
+	chain, key, err := ca.issue("router.example.org", []net.IP{net.ParseIP("192.168.1.1"), net.ParseIP("8.8.8.8")})
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+	leaf := verifyLocalCert(t, ca, chain, key, "router.example.org")
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("192.168.1.1")) {
+		t.Fatalf("IP addresses: %v", leaf.IPAddresses)
+	}
+	if leaf.IsCA || len(leaf.ExtKeyUsage) != 1 || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Fatalf("leaf: %+v", leaf)
+	}
+
+	chain, key, err = ca.issue("nas.home.arpa", nil)
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+	_ = verifyLocalCert(t, ca, chain, key, "nas.home.arpa")
+
+	_, _, err = ca.issue("www.example.com", nil)
+	if err == nil {
+		t.Fatalf("issue: the name outside the constraints")
+	}
+
+	// a certificate for another site signed by the leaked key isn't accepted
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: ca.cert.SerialNumber,
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"www.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &leafKey.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	forged, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, err = forged.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: roots})
+	if err == nil {
+		t.Fatalf("the forged certificate is accepted")
+	}
+}
+
+func TestLoadOrCreateLocalCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agh-localca")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	workDir := config.ourWorkingDir
+	config.ourWorkingDir = dir
+	defer func() { config.ourWorkingDir = workDir }()
+
+	ca, err := loadOrCreateLocalCA("router.lan")
+	if err != nil {
+		t.Fatalf("loadOrCreateLocalCA: %s", err)
+	}
+
+	// the same CA is loaded from disk
+	ca2, err := loadOrCreateLocalCA("nas.lan")
+	if err != nil {
+		t.Fatalf("loadOrCreateLocalCA: %s", err)
+	}
+	if !ca2.cert.Equal(ca.cert) {
+		t.Fatalf("the CA is replaced")
+	}
+
+	// the CA which can't sign the name is replaced
+	ca3, err := loadOrCreateLocalCA("router.example.org")
+	if err != nil {
+		t.Fatalf("loadOrCreateLocalCA: %s", err)
+	}
+	if ca3.cert.Equal(ca.cert) || !ca3.permits("router.example.org") {
+		t.Fatalf("the CA isn't replaced")
+	}
+}
@@ -0,0 +1,74 @@
+package home
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, _, err := createLocalCA("example.org")
+	if err != nil {
+		t.Fatalf("createLocalCA: %s", err)
+	}
+	issue := func(name string) {
+		chain, key, err := ca.issue(name, nil)
+		if err != nil {
+			t.Fatalf("issue: %s", err)
+		}
+		_ = ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte(chain), 0600)
+		_ = ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte(key), 0600)
+	}
+	issue("one.example.org")
+
+	tlsConf := config.TLS
+	defer func() {
+		config.TLS = tlsConf
+		tlsCert = tlsCertContainer{}
+	}()
+	config.TLS.Enabled = true
+	config.TLS.CertificatePath = filepath.Join(dir, "cert.pem")
+	config.TLS.PrivateKeyPath = filepath.Join(dir, "key.pem")
+	initTLS()
+	cert, err := getTLSCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("initTLS: %s", err)
+	}
+
+	// the file contents aren't written to the configuration file
+	restore := excludeTLSFileContents()
+	if len(config.TLS.CertificateChain) != 0 || len(config.TLS.PrivateKey) != 0 {
+		t.Fatalf("excludeTLSFileContents")
+	}
+	restore()
+	if len(config.TLS.CertificateChain) == 0 {
+		t.Fatalf("excludeTLSFileContents: not restored")
+	}
+
+	// the files are renewed
+	issue("two.example.org")
+	tlsCert.certMod = tlsCert.certMod.Add(-1) // the modification time may have the same value
+	reloadTLSFiles()
+	newCert, _ := getTLSCertificate(nil)
+	if newCert == cert || config.TLS.DNSNames[0] != "two.example.org" {
+		t.Fatalf("reloadTLSFiles: %v", config.TLS.DNSNames)
+	}
+
+	// the changes other than the certificate require restarting the listeners
+	s := config.TLS.tlsConfigSettings
+	s.CertificateChain = "new"
+	if tlsSettingsChanged(config.TLS.tlsConfigSettings, s) {
+		t.Fatalf("tlsSettingsChanged: only the certificate")
+	}
+	s.PortHTTPS++
+	if !tlsSettingsChanged(config.TLS.tlsConfigSettings, s) {
+		t.Fatalf("tlsSettingsChanged: the port")
+	}
+}
@@ -0,0 +1,202 @@
+// Upgrade impact report
+// Before the self-update the user can see what's changed in the new version
+// and whether the current configuration is compatible with it.
+// version.json may contain "changelog_url" pointing to a JSON document:
+//   {
+//     "version": "v0.99",
+//     "schema_version": 5,
+//     "changes": [{"type": "breaking", "description": "..."}],
+//     "deprecated_settings": ["dns.some_setting"],
+//     "removed_settings": ["dns.other_setting"]
+//   }
+
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const maxChangelogSize = 1 * 1024 * 1024
+
+// A breaking change requires the user's confirmation
+const changeBreaking = "breaking"
+
+type changelogEntry struct {
+	Type        string `json:"type"` // "feature", "fix" or "breaking"
+	Description string `json:"description"`
+}
+
+// Machine-readable changelog of the new version
+type changelog struct {
+	Version            string           `json:"version"`
+	SchemaVersion      int              `json:"schema_version"` // configuration schema version used by the new version
+	Changes            []changelogEntry `json:"changes"`
+	DeprecatedSettings []string         `json:"deprecated_settings"` // dot-separated paths of settings, e.g. "dns.port"
+	RemovedSettings    []string         `json:"removed_settings"`
+}
+
+type updateReport struct {
+	CurrentVersion string           `json:"current_version"`
+	NewVersion     string           `json:"new_version"`
+	Changes        []changelogEntry `json:"changes"`
+
+	CurrentSchemaVersion int `json:"current_schema_version"`
+	TargetSchemaVersion  int `json:"target_schema_version,omitempty"` // 0: unknown
+
+	DeprecatedSettings []string `json:"deprecated_settings"` // deprecated settings which are used in the configuration
+	RemovedSettings    []string `json:"removed_settings"`    // removed settings which are used in the configuration
+
+	// If true, the update must be confirmed
+	Breaking bool     `json:"breaking"`
+	Reasons  []string `json:"reasons"` // why the update is breaking
+}
+
+// settingInUse returns TRUE if the setting with the dot-separated path is present in the configuration
+func settingInUse(conf map[interface{}]interface{}, path string) bool {
+	var cur interface{} = conf
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[interface{}]interface{})
+		if !ok {
+			return false
+		}
+		cur, ok = m[key]
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Download the changelog of the new version
+func getChangelog(url string) (*changelog, error) {
+	resp, err := client.Get(url)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't request changelog from URL %s: %s", url, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got status code %d from URL %s", resp.StatusCode, url)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxChangelogSize))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read changelog from URL %s: %s", url, err)
+	}
+
+	cl := changelog{}
+	err = json.Unmarshal(body, &cl)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse changelog: %s", err)
+	}
+	return &cl, nil
+}
+
+// Check the changelog against the configuration file data
+func checkUpdateImpact(cl *changelog, configData []byte) (*updateReport, error) {
+	rep := updateReport{
+		CurrentVersion:       VersionString,
+		NewVersion:           cl.Version,
+		Changes:              cl.Changes,
+		CurrentSchemaVersion: currentSchemaVersion,
+		TargetSchemaVersion:  cl.SchemaVersion,
+		DeprecatedSettings:   []string{},
+		RemovedSettings:      []string{},
+		Reasons:              []string{},
+	}
+	if rep.Changes == nil {
+		rep.Changes = []changelogEntry{}
+	}
+
+	conf := map[interface{}]interface{}{}
+	err := yaml.Unmarshal(configData, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse config file: %s", err)
+	}
+
+	for _, s := range cl.DeprecatedSettings {
+		if settingInUse(conf, s) {
+			rep.DeprecatedSettings = append(rep.DeprecatedSettings, s)
+		}
+	}
+	for _, s := range cl.RemovedSettings {
+		if settingInUse(conf, s) {
+			rep.RemovedSettings = append(rep.RemovedSettings, s)
+			rep.Reasons = append(rep.Reasons, fmt.Sprintf("setting %s is no longer supported", s))
+		}
+	}
+
+	if cl.SchemaVersion != 0 && cl.SchemaVersion < currentSchemaVersion {
+		rep.Reasons = append(rep.Reasons, fmt.Sprintf("configuration schema version %d is older than the current one (%d)",
+			cl.SchemaVersion, currentSchemaVersion))
+	}
+	for _, c := range cl.Changes {
+		if c.Type == changeBreaking {
+			rep.Reasons = append(rep.Reasons, c.Description)
+		}
+	}
+	rep.Breaking = len(rep.Reasons) != 0
+	return &rep, nil
+}
+
+// Build the report for the update described by version.json data
+func getUpdateReport(versionData []byte) (*updateReport, error) {
+	versionJSON := struct {
+		Version      string `json:"version"`
+		ChangelogURL string `json:"changelog_url"`
+	}{}
+	err := json.Unmarshal(versionData, &versionJSON)
+	if err != nil {
+		return nil, fmt.Errorf("version.json: %s", err)
+	}
+
+	cl := &changelog{}
+	if len(versionJSON.ChangelogURL) != 0 {
+		cl, err = getChangelog(versionJSON.ChangelogURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cl.Version) == 0 {
+		cl.Version = versionJSON.Version
+	}
+
+	configData, err := ioutil.ReadFile(config.getConfigFilename())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %s", err)
+	}
+	return checkUpdateImpact(cl, configData)
+}
+
+// Get the impact report of the available update
+func handleUpdateReport(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+
+	versionCheckLock.Lock()
+	data := versionCheckJSON
+	versionCheckLock.Unlock()
+	if len(data) == 0 {
+		httpError(w, http.StatusBadRequest, "No update information, request /control/version.json first")
+		return
+	}
+
+	rep, err := getUpdateReport(data)
+	if err != nil {
+		httpError(w, http.StatusBadGateway, "Couldn't get update report: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(rep)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json.Encode: %s", err)
+		return
+	}
+}
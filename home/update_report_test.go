@@ -0,0 +1,42 @@
+package home
+
+import (
+	"testing"
+)
+
+func TestUpdateReport(t *testing.T) {
+	configData := []byte(`
+bind_host: 0.0.0.0
+dns:
+  port: 53
+  old_setting: true
+`)
+
+	cl := &changelog{
+		Version:       "v9.9",
+		SchemaVersion: currentSchemaVersion,
+		Changes: []changelogEntry{
+			{Type: "feature", Description: "New feature"},
+		},
+		DeprecatedSettings: []string{"dns.old_setting", "dns.unused_setting"},
+	}
+	rep, err := checkUpdateImpact(cl, configData)
+	if err != nil {
+		t.Fatalf("checkUpdateImpact: %s", err)
+	}
+	if rep.Breaking || len(rep.DeprecatedSettings) != 1 || rep.DeprecatedSettings[0] != "dns.old_setting" {
+		t.Fatalf("checkUpdateImpact: %+v", rep)
+	}
+
+	// a removed setting that is used, a breaking change and an older schema version
+	cl.RemovedSettings = []string{"dns.old_setting", "bind_host.sub"}
+	cl.Changes = append(cl.Changes, changelogEntry{Type: changeBreaking, Description: "Something is removed"})
+	cl.SchemaVersion = currentSchemaVersion - 1
+	rep, err = checkUpdateImpact(cl, configData)
+	if err != nil {
+		t.Fatalf("checkUpdateImpact: %s", err)
+	}
+	if !rep.Breaking || len(rep.RemovedSettings) != 1 || len(rep.Reasons) != 3 {
+		t.Fatalf("checkUpdateImpact - breaking: %+v", rep)
+	}
+}
@@ -6,11 +6,10 @@ import (
 	"path/filepath"
 
 	"github.com/AdguardTeam/golibs/file"
-	"github.com/AdguardTeam/golibs/log"
 	yaml "gopkg.in/yaml.v2"
 )
 
-const currentSchemaVersion = 3 // used for upgrading from old configs to new config
+const currentSchemaVersion = 8 // used for upgrading from old configs to new config
 
 // Performs necessary upgrade operations if needed
 func upgradeConfig() error {
@@ -57,16 +56,141 @@ func upgradeConfigSchema(oldVersion int, diskConfig *map[string]interface{}) err
 		if err != nil {
 			return err
 		}
+		err = upgradeSchema3to4(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema4to5(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema5to6(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema6to7(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
 	case 1:
 		err := upgradeSchema1to3(diskConfig)
 		if err != nil {
 			return err
 		}
+		err = upgradeSchema3to4(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema4to5(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema5to6(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema6to7(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
 	case 2:
 		err := upgradeSchema2to3(diskConfig)
 		if err != nil {
 			return err
 		}
+		err = upgradeSchema3to4(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema4to5(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema5to6(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema6to7(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
+	case 3:
+		err := upgradeSchema3to4(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema4to5(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema5to6(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema6to7(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
+	case 4:
+		err := upgradeSchema4to5(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema5to6(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema6to7(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
+	case 5:
+		err := upgradeSchema5to6(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema6to7(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
+	case 6:
+		err := upgradeSchema6to7(diskConfig)
+		if err != nil {
+			return err
+		}
+		err = upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
+	case 7:
+		err := upgradeSchema7to8(diskConfig)
+		if err != nil {
+			return err
+		}
 	default:
 		err := fmt.Errorf("configuration file contains unknown schema_version, abort")
 		log.Println(err)
@@ -173,6 +297,131 @@ func upgradeSchema2to3(diskConfig *map[string]interface{}) error {
 	return nil
 }
 
+// Clients which were configured before blocked services appeared should keep using the global list
+func upgradeSchema3to4(diskConfig *map[string]interface{}) error {
+	log.Printf("%s(): called", _Func())
+
+	(*diskConfig)["schema_version"] = 4
+
+	clients, ok := (*diskConfig)["clients"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, c := range clients {
+		if cm, ok := c.(map[interface{}]interface{}); ok {
+			cm["use_global_blocked_services"] = true
+		}
+	}
+
+	return nil
+}
+
+// The web interface users replace auth_name and auth_pass, the password is stored as a bcrypt hash
+func upgradeSchema4to5(diskConfig *map[string]interface{}) error {
+	log.Printf("%s(): called", _Func())
+
+	(*diskConfig)["schema_version"] = 5
+
+	name, _ := (*diskConfig)["auth_name"].(string)
+	pass, _ := (*diskConfig)["auth_pass"].(string)
+	delete(*diskConfig, "auth_name")
+	delete(*diskConfig, "auth_pass")
+	if len(name) == 0 || len(pass) == 0 {
+		return nil
+	}
+
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return fmt.Errorf("can't hash the password: %s", err)
+	}
+	(*diskConfig)["users"] = []map[string]string{
+		{"name": name, "password": hash},
+	}
+	return nil
+}
+
+// The per-client safesearch_enabled and safebrowsing_enabled settings were stored under each other's names
+func upgradeSchema5to6(diskConfig *map[string]interface{}) error {
+	log.Printf("%s(): called", _Func())
+
+	(*diskConfig)["schema_version"] = 6
+
+	clients, ok := (*diskConfig)["clients"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, c := range clients {
+		cm, ok := c.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		safeSearch, okSearch := cm["safebrowsing_enabled"]
+		safeBrowsing, okBrowsing := cm["safesearch_enabled"]
+		delete(cm, "safesearch_enabled")
+		delete(cm, "safebrowsing_enabled")
+		if okSearch {
+			cm["safesearch_enabled"] = safeSearch
+		}
+		if okBrowsing {
+			cm["safebrowsing_enabled"] = safeBrowsing
+		}
+	}
+
+	return nil
+}
+
+// The filter lists which were added before the trust level appeared keep applying their IP redirects
+func upgradeSchema6to7(diskConfig *map[string]interface{}) error {
+	log.Printf("%s(): called", _Func())
+
+	(*diskConfig)["schema_version"] = 7
+
+	filters, ok := (*diskConfig)["filters"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, f := range filters {
+		if fm, ok := f.(map[interface{}]interface{}); ok {
+			fm["trusted"] = true
+		}
+	}
+
+	return nil
+}
+
+// The clients' portal passwords are stored as bcrypt hashes
+func upgradeSchema7to8(diskConfig *map[string]interface{}) error {
+	log.Printf("%s(): called", _Func())
+
+	(*diskConfig)["schema_version"] = 8
+
+	clients, ok := (*diskConfig)["clients"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, c := range clients {
+		cm, ok := c.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		pass, _ := cm["portal_password"].(string)
+		if len(pass) == 0 {
+			continue
+		}
+		hash, err := hashPassword(pass)
+		if err != nil {
+			return fmt.Errorf("can't hash the portal password: %s", err)
+		}
+		cm["portal_password"] = hash
+	}
+
+	return nil
+}
+
 // jump three schemas at once -- this time we just do it sequentially
 func upgradeSchema0to3(diskConfig *map[string]interface{}) error {
 	err := upgradeSchema0to1(diskConfig)
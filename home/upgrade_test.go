@@ -3,6 +3,8 @@ package home
 import (
 	"fmt"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestUpgrade1to2(t *testing.T) {
@@ -90,6 +92,116 @@ func TestUpgrade2to3(t *testing.T) {
 	compareConfigsWithoutEntries(t, &oldDiskConfig, &diskConfig, excludedEntries, excludedEntries)
 }
 
+func TestUpgrade3to4(t *testing.T) {
+	diskConfig := createTestDiskConfig(3)
+	diskConfig["clients"] = []interface{}{
+		map[interface{}]interface{}{"name": "client1", "ip": "1.2.3.4"},
+	}
+
+	err := upgradeSchema3to4(&diskConfig)
+	if err != nil {
+		t.Fatalf("Can't update schema version from 3 to 4: %s", err)
+	}
+
+	compareSchemaVersion(t, diskConfig["schema_version"], 4)
+
+	c := castInterfaceToMap(t, diskConfig["clients"].([]interface{})[0])
+	if c["use_global_blocked_services"] != true {
+		t.Fatalf("use_global_blocked_services wasn't set")
+	}
+}
+
+func TestUpgrade4to5(t *testing.T) {
+	diskConfig := createTestDiskConfig(4)
+
+	err := upgradeSchema4to5(&diskConfig)
+	if err != nil {
+		t.Fatalf("Can't update schema version from 4 to 5: %s", err)
+	}
+
+	compareSchemaVersion(t, diskConfig["schema_version"], 5)
+
+	if _, ok := diskConfig["auth_name"]; ok {
+		t.Fatalf("auth_name wasn't removed")
+	}
+	users := diskConfig["users"].([]map[string]string)
+	if len(users) != 1 || users[0]["name"] != "name" {
+		t.Fatalf("users: %v", users)
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(users[0]["password"]), []byte("pass"))
+	if err != nil {
+		t.Fatalf("password hash: %s", err)
+	}
+}
+
+func TestUpgrade5to6(t *testing.T) {
+	diskConfig := createTestDiskConfig(5)
+	diskConfig["clients"] = []interface{}{
+		map[interface{}]interface{}{"name": "client1", "safesearch_enabled": true, "safebrowsing_enabled": false},
+		map[interface{}]interface{}{"name": "client2", "safebrowsing_enabled": true},
+	}
+
+	err := upgradeSchema5to6(&diskConfig)
+	if err != nil {
+		t.Fatalf("Can't update schema version from 5 to 6: %s", err)
+	}
+
+	compareSchemaVersion(t, diskConfig["schema_version"], 6)
+
+	c := castInterfaceToMap(t, diskConfig["clients"].([]interface{})[0])
+	if c["safesearch_enabled"] != false || c["safebrowsing_enabled"] != true {
+		t.Fatalf("client1: %v", c)
+	}
+	c = castInterfaceToMap(t, diskConfig["clients"].([]interface{})[1])
+	if _, ok := c["safebrowsing_enabled"]; ok || c["safesearch_enabled"] != true {
+		t.Fatalf("client2: %v", c)
+	}
+}
+
+func TestUpgrade6to7(t *testing.T) {
+	diskConfig := createTestDiskConfig(6)
+	diskConfig["filters"] = []interface{}{
+		map[interface{}]interface{}{"id": 1, "url": "https://adaway.org/hosts.txt"},
+	}
+
+	err := upgradeSchema6to7(&diskConfig)
+	if err != nil {
+		t.Fatalf("Can't update schema version from 6 to 7: %s", err)
+	}
+
+	compareSchemaVersion(t, diskConfig["schema_version"], 7)
+
+	f := castInterfaceToMap(t, diskConfig["filters"].([]interface{})[0])
+	if f["trusted"] != true {
+		t.Fatalf("trusted wasn't set")
+	}
+}
+
+func TestUpgrade7to8(t *testing.T) {
+	diskConfig := createTestDiskConfig(7)
+	diskConfig["clients"] = []interface{}{
+		map[interface{}]interface{}{"name": "client1", "portal_password": "pass"},
+		map[interface{}]interface{}{"name": "client2"},
+	}
+
+	err := upgradeSchema7to8(&diskConfig)
+	if err != nil {
+		t.Fatalf("Can't update schema version from 7 to 8: %s", err)
+	}
+
+	compareSchemaVersion(t, diskConfig["schema_version"], 8)
+
+	c := castInterfaceToMap(t, diskConfig["clients"].([]interface{})[0])
+	err = bcrypt.CompareHashAndPassword([]byte(c["portal_password"].(string)), []byte("pass"))
+	if err != nil {
+		t.Fatalf("portal password hash: %s", err)
+	}
+	c = castInterfaceToMap(t, diskConfig["clients"].([]interface{})[1])
+	if _, ok := c["portal_password"]; ok {
+		t.Fatalf("client2: %v", c)
+	}
+}
+
 func castInterfaceToMap(t *testing.T, oldConfig interface{}) (newConfig map[string]interface{}) {
 	newConfig = make(map[string]interface{})
 	switch v := oldConfig.(type) {
@@ -0,0 +1,205 @@
+// WHOIS information of the clients
+// The public addresses of the clients (they are seen when the DNS server is reachable from the Internet)
+// are looked up in WHOIS in the background, so the clients API shows their country and organization.
+
+package home
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/dnsforward"
+)
+
+const (
+	whoisDefaultServer = "whois.arin.net"
+	whoisPort          = "43"
+	whoisTimeout       = 5 * time.Second
+	whoisMaxReferrals  = 3         // the regional registries refer to each other
+	whoisMaxResponse   = 64 * 1024 // bytes
+	whoisMaxEntries    = 10000     // the addresses which are kept in memory
+	whoisQueueSize     = 256
+)
+
+// The WHOIS information shown for the client
+type whoisInfo struct {
+	Country string `json:"country,omitempty"`
+	Orgname string `json:"orgname,omitempty"`
+	City    string `json:"city,omitempty"`
+}
+
+type whoisContext struct {
+	queue chan string
+	lock  sync.Mutex
+	info  map[string]*whoisInfo // IP -> WHOIS information (empty: the lookup has failed, nil: it's in progress)
+
+	query func(server, query string) (string, error) // sends the query to WHOIS server
+}
+
+var whois = whoisContext{
+	info:  map[string]*whoisInfo{},
+	query: whoisQuery,
+}
+
+// Start the background WHOIS lookups
+func initWhois() {
+	whois.queue = make(chan string, whoisQueueSize)
+	go whoisLoop()
+}
+
+// Look up the public address of the client in WHOIS, if it hasn't been looked up yet
+func beginAsyncWhois(ip string) {
+	if !config.WhoisEnabled || whois.queue == nil || !dnsforward.IsPublicIP(net.ParseIP(ip)) {
+		return
+	}
+
+	whois.lock.Lock()
+	defer whois.lock.Unlock()
+	if _, ok := whois.info[ip]; ok || len(whois.info) >= whoisMaxEntries {
+		return
+	}
+	select {
+	case whois.queue <- ip:
+		whois.info[ip] = nil
+	default:
+		log.Tracef("WHOIS queue is full")
+	}
+}
+
+// Get the WHOIS information of the address, nil if there's none
+func clientWhois(ip string) *whoisInfo {
+	whois.lock.Lock()
+	defer whois.lock.Unlock()
+	wi := whois.info[ip]
+	if wi == nil || *wi == (whoisInfo{}) {
+		return nil
+	}
+	return wi
+}
+
+// Get the addresses with WHOIS information
+func whoisAddresses() []string {
+	whois.lock.Lock()
+	defer whois.lock.Unlock()
+	ips := []string{}
+	for ip, wi := range whois.info {
+		if wi != nil && *wi != (whoisInfo{}) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func whoisLoop() {
+	for ip := range whois.queue {
+		wi, err := whoisLookup(ip)
+		if err != nil {
+			log.Debug("WHOIS lookup of %s: %s", ip, err)
+			wi = &whoisInfo{}
+		}
+
+		whois.lock.Lock()
+		whois.info[ip] = wi
+		whois.lock.Unlock()
+	}
+}
+
+// Send the query to WHOIS server and read the response
+func whoisQuery(server, query string) (string, error) {
+	conn, err := net.DialTimeout("tcp", server, whoisTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(whoisTimeout))
+
+	_, err = conn.Write([]byte(query + "\r\n"))
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(conn, whoisMaxResponse))
+	return string(data), err
+}
+
+// Look up the address, following the referrals to the regional registries
+func whoisLookup(ip string) (*whoisInfo, error) {
+	server := whoisDefaultServer
+	for i := 0; i <= whoisMaxReferrals; i++ {
+		query := ip
+		if server == whoisDefaultServer {
+			query = "n + " + ip // the network record, not the summary
+		}
+		resp, err := whois.query(net.JoinHostPort(server, whoisPort), query)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := parseWhois(resp)
+		ref := whoisReferral(fields)
+		if len(ref) == 0 || ref == server {
+			return whoisToInfo(fields), nil
+		}
+		server = ref
+	}
+	return nil, fmt.Errorf("too many referrals")
+}
+
+// Parse WHOIS response: "key: value" lines, the keys are in lower case
+// Only the first value of a key is kept: the most specific network is the first one.
+func parseWhois(data string) map[string]string {
+	fields := map[string]string{}
+	for _, ln := range strings.Split(data, "\n") {
+		ln = strings.TrimSpace(ln)
+		if len(ln) == 0 || ln[0] == '#' || ln[0] == '%' {
+			continue
+		}
+		i := strings.IndexByte(ln, ':')
+		if i <= 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(ln[:i]))
+		val := strings.TrimSpace(ln[i+1:])
+		if _, ok := fields[key]; ok || len(val) == 0 {
+			continue
+		}
+		fields[key] = val
+	}
+	return fields
+}
+
+// Get the WHOIS server the response refers to, "" if there's none
+func whoisReferral(fields map[string]string) string {
+	ref := fields["referralserver"] // ARIN: "whois://whois.ripe.net"
+	if len(ref) == 0 {
+		ref = fields["whois"] // IANA: "whois.ripe.net"
+	}
+	if strings.Contains(ref, "://") && !strings.HasPrefix(ref, "whois://") {
+		return "" // e.g. rwhois://
+	}
+	ref = strings.TrimPrefix(ref, "whois://")
+	host, _, err := net.SplitHostPort(ref)
+	if err == nil {
+		ref = host
+	}
+	return strings.ToLower(ref)
+}
+
+// Get the information shown for the client from WHOIS response
+func whoisToInfo(fields map[string]string) *whoisInfo {
+	wi := &whoisInfo{
+		Country: fields["country"],
+		City:    fields["city"],
+	}
+	for _, key := range []string{"orgname", "org-name", "descr", "netname"} {
+		if len(fields[key]) != 0 {
+			wi.Orgname = fields[key]
+			break
+		}
+	}
+	return wi
+}
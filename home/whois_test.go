@@ -0,0 +1,98 @@
+package home
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testWhoisARIN = `
+# ARIN WHOIS data and services are subject to the Terms of Use
+
+NetRange:       2.0.0.0 - 2.255.255.255
+CIDR:           2.0.0.0/8
+NetName:        RIPE-2
+Organization:   RIPE Network Coordination Centre (RIPE)
+ReferralServer:  whois://whois.ripe.net
+`
+
+const testWhoisRIPE = `
+% This is the RIPE Database query service.
+
+inetnum:        2.2.0.0 - 2.2.255.255
+netname:        EXAMPLE-NET
+descr:          Example Broadband
+country:        FR
+org-name:       Example Telecom SA
+country:        NL
+city:           Paris
+`
+
+func TestWhois(t *testing.T) {
+	fields := parseWhois(testWhoisRIPE)
+	if fields["netname"] != "EXAMPLE-NET" || fields["country"] != "FR" || fields["org-name"] != "Example Telecom SA" {
+		t.Fatalf("parseWhois: %v", fields)
+	}
+	if whoisReferral(parseWhois(testWhoisARIN)) != "whois.ripe.net" ||
+		whoisReferral(map[string]string{"referralserver": "rwhois://rwhois.example.net:4321"}) != "" {
+		t.Fatalf("whoisReferral")
+	}
+
+	savedQuery := whois.query
+	defer func() { whois.query = savedQuery }()
+	queries := []string{}
+	whois.query = func(server, query string) (string, error) {
+		queries = append(queries, server+" "+query)
+		switch server {
+		case "whois.arin.net:43":
+			return testWhoisARIN, nil
+		case "whois.ripe.net:43":
+			return testWhoisRIPE, nil
+		}
+		return "", fmt.Errorf("unknown server")
+	}
+	wi, err := whoisLookup("2.2.2.2")
+	if err != nil || *wi != (whoisInfo{Country: "FR", Orgname: "Example Telecom SA", City: "Paris"}) {
+		t.Fatalf("whoisLookup: %v %v", wi, err)
+	}
+	if strings.Join(queries, ",") != "whois.arin.net:43 n + 2.2.2.2,whois.ripe.net:43 2.2.2.2" {
+		t.Fatalf("whoisLookup - queries: %v", queries)
+	}
+
+	// the referrals loop
+	whois.query = func(server, query string) (string, error) {
+		if server == "whois.ripe.net:43" {
+			return "whois: whois.arin.net", nil
+		}
+		return testWhoisARIN, nil
+	}
+	_, err = whoisLookup("2.2.2.2")
+	if err == nil {
+		t.Fatalf("whoisLookup - referrals loop")
+	}
+}
+
+func TestOUI(t *testing.T) {
+	vendors, err := parseOUI(strings.NewReader(`OUI/MA-L			Organization
+company_id			Organization
+				Address
+
+00-00-0C   (hex)		Cisco Systems, Inc
+00000C     (base 16)		Cisco Systems, Inc
+				170 WEST TASMAN DRIVE
+
+A4-83-E7   (hex)		Apple, Inc.
+`))
+	if err != nil || len(vendors) != 2 || vendors[[3]byte{0xa4, 0x83, 0xe7}] != "Apple, Inc." {
+		t.Fatalf("parseOUI: %v %v", vendors, err)
+	}
+
+	ouiVendors.once.Do(func() {})
+	savedVendors := ouiVendors.vendors
+	defer func() { ouiVendors.vendors = savedVendors }()
+	ouiVendors.vendors = vendors
+	if macVendor("a4:83:e7:01:02:03") != "Apple, Inc." || macVendor("00-00-0c-01-02-03") != "Cisco Systems, Inc" ||
+		macVendor("11:22:33:44:55:66") != "" || macVendor("invalid") != "" {
+		t.Fatalf("macVendor")
+	}
+}
@@ -0,0 +1,99 @@
+// Wake-on-LAN
+// The magic packet is broadcast to the LAN, it wakes up the device with the specified MAC address.
+// Only the known devices may be woken up: the ones with DHCP leases and the persistent clients.
+
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+const wolPort = 9
+
+// Create the magic packet: 6 bytes 0xff and then the MAC address 16 times
+func wolMagicPacket(mac net.HardwareAddr) []byte {
+	data := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i != 16; i++ {
+		data = append(data, mac...)
+	}
+	return data
+}
+
+// Get the broadcast addresses: the one of the DHCP server's subnet and 255.255.255.255
+func wolBroadcastAddrs() []net.IP {
+	addrs := []net.IP{}
+	gw := parseIPv4(config.DHCP.GatewayIP)
+	mask := parseIPv4(config.DHCP.SubnetMask)
+	if gw != nil && mask != nil {
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = gw[i] | ^mask[i]
+		}
+		addrs = append(addrs, bcast)
+	}
+	return append(addrs, net.IPv4bcast)
+}
+
+// Return TRUE if the device has a DHCP lease or it's a persistent client
+func isWakeableDevice(mac net.HardwareAddr) bool {
+	return isKnownDevice(mac.String()) || dhcpServer.FindIPbyMAC(mac) != nil
+}
+
+// Send the magic packet to the broadcast addresses
+func wakeDevice(mac net.HardwareAddr) error {
+	data := wolMagicPacket(mac)
+	var lastErr error
+	sent := false
+	for _, ip := range wolBroadcastAddrs() {
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: wolPort})
+		if err == nil {
+			_, err = conn.Write(data)
+			conn.Close()
+		}
+		if err != nil {
+			log.Debug("WoL: %s: %s", ip, err)
+			lastErr = err
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return lastErr
+	}
+	return nil
+}
+
+type wolJSON struct {
+	MAC string `json:"mac"`
+}
+
+func handleClientsWake(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("%s %v", r.Method, r.URL)
+	req := wolJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json.Decode: %s", err)
+		return
+	}
+
+	mac, err := net.ParseMAC(req.MAC)
+	if err != nil || len(mac) != 6 {
+		httpError(w, http.StatusBadRequest, "Invalid MAC address: %s", req.MAC)
+		return
+	}
+	if !isWakeableDevice(mac) {
+		httpError(w, http.StatusBadRequest, "Unknown device: %s", mac)
+		return
+	}
+
+	err = wakeDevice(mac)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't send the magic packet: %s", err)
+		return
+	}
+	log.Info("WoL: sent the magic packet to %s", mac)
+	returnOK(w)
+}
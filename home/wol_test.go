@@ -0,0 +1,29 @@
+package home
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWakeOnLAN(t *testing.T) {
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	data := wolMagicPacket(mac)
+	if len(data) != 102 || !bytes.Equal(data[:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) ||
+		!bytes.Equal(data[6:12], mac) || !bytes.Equal(data[96:], mac) {
+		t.Fatalf("wolMagicPacket: %v", data)
+	}
+
+	gw, mask := config.DHCP.GatewayIP, config.DHCP.SubnetMask
+	defer func() { config.DHCP.GatewayIP, config.DHCP.SubnetMask = gw, mask }()
+	config.DHCP.GatewayIP = "192.168.1.1"
+	config.DHCP.SubnetMask = "255.255.255.0"
+	addrs := wolBroadcastAddrs()
+	if len(addrs) != 2 || !addrs[0].Equal(net.IP{192, 168, 1, 255}) || !addrs[1].Equal(net.IPv4bcast) {
+		t.Fatalf("wolBroadcastAddrs: %v", addrs)
+	}
+	config.DHCP.GatewayIP = ""
+	if addrs = wolBroadcastAddrs(); len(addrs) != 1 {
+		t.Fatalf("wolBroadcastAddrs: %v", addrs)
+	}
+}
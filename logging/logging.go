@@ -0,0 +1,336 @@
+// Package logging provides the leveled loggers of the subsystems
+// Each package has its own Logger, the level of its subsystem is cached in the logger
+// and checked before the message is formatted, so a disabled message costs only an atomic load.
+// A logger may have the structured fields (With()), they're written with every message:
+//
+//	"text": "2019/10/16 20:47:26 [info] [home] message key=value", "json": an object per line with "fields".
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logging levels
+const (
+	ERROR = iota
+	INFO
+	DEBUG
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Field is a named value which is written with the messages of a logger
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Entry is a log message
+type Entry struct {
+	Time      time.Time
+	Level     string // "error", "info", "debug" or "fatal"
+	Subsystem string
+	Func      string // the function which has logged the message (may be empty)
+	Msg       string
+	Fields    []Field
+	Goroutine string // "PID#GOID" (may be empty)
+}
+
+// The output and the levels which are shared by all loggers
+var (
+	lock       sync.Mutex
+	out        io.Writer = os.Stderr
+	format               = FormatText
+	defLevel             = INFO
+	levels               = map[string]int{}    // subsystem -> level
+	registered           = map[string]*int32{} // subsystem -> the level used by its loggers
+)
+
+// Logger writes the messages of a subsystem
+type Logger struct {
+	subsystem string
+	level     *int32 // shared by the loggers of the subsystem
+	fields    []Field
+}
+
+// New returns the logger of the subsystem
+func New(name string) *Logger {
+	lock.Lock()
+	defer lock.Unlock()
+	return &Logger{subsystem: name, level: subsystemLevel(name)}
+}
+
+// Get the level of the subsystem which is updated by Configure()
+// lock must be held
+func subsystemLevel(name string) *int32 {
+	level, ok := registered[name]
+	if !ok {
+		level = new(int32)
+		*level = int32(levelOf(name))
+		registered[name] = level
+	}
+	return level
+}
+
+// lock must be held
+func levelOf(name string) int {
+	level, ok := levels[name]
+	if !ok {
+		return defLevel
+	}
+	return level
+}
+
+// Configure sets the output format, the default level and the levels of the subsystems
+func Configure(f string, def int, subsystemLevels map[string]int) {
+	lock.Lock()
+	defer lock.Unlock()
+	format = FormatText
+	if f == FormatJSON {
+		format = FormatJSON
+	}
+	defLevel = def
+	levels = map[string]int{}
+	for name, level := range subsystemLevels {
+		levels[name] = level
+	}
+	for name, level := range registered {
+		atomic.StoreInt32(level, int32(levelOf(name)))
+	}
+}
+
+// SetOutput sets the output and returns the previous one
+func SetOutput(w io.Writer) io.Writer {
+	lock.Lock()
+	defer lock.Unlock()
+	prev := out
+	out = w
+	return prev
+}
+
+// Level returns the level of the subsystem
+func Level(name string) int {
+	lock.Lock()
+	defer lock.Unlock()
+	return int(atomic.LoadInt32(subsystemLevel(name)))
+}
+
+// With returns the logger which writes the field with every message
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]Field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{
+		subsystem: l.subsystem,
+		level:     l.level,
+		fields:    append(fields, Field{Key: key, Value: value}),
+	}
+}
+
+// Enabled returns TRUE if the messages of this level are written
+func (l *Logger) Enabled(level int) bool {
+	return int32(level) <= atomic.LoadInt32(l.level)
+}
+
+// Fatal writes the message and exits the application
+func (l *Logger) Fatal(args ...interface{}) {
+	l.write("fatal", "", fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+// Fatalf writes the message and exits the application
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.write("fatal", "", fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// Error writes the message with the error level
+func (l *Logger) Error(format string, args ...interface{}) {
+	if l.Enabled(ERROR) {
+		l.write("error", "", fmt.Sprintf(format, args...))
+	}
+}
+
+// Info writes the message with the info level
+func (l *Logger) Info(format string, args ...interface{}) {
+	if l.Enabled(INFO) {
+		l.write("info", "", fmt.Sprintf(format, args...))
+	}
+}
+
+// Print writes the message with the info level
+func (l *Logger) Print(args ...interface{}) {
+	if l.Enabled(INFO) {
+		l.write("info", "", fmt.Sprint(args...))
+	}
+}
+
+// Printf writes the message with the info level
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.Info(format, args...)
+}
+
+// Println writes the message with the info level
+func (l *Logger) Println(args ...interface{}) {
+	l.Print(args...)
+}
+
+// Debug writes the message with the debug level
+func (l *Logger) Debug(format string, args ...interface{}) {
+	if l.Enabled(DEBUG) {
+		l.write("debug", "", fmt.Sprintf(format, args...))
+	}
+}
+
+// Tracef writes the message with the debug level and the name of the calling function
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	if !l.Enabled(DEBUG) {
+		return
+	}
+	funcName := ""
+	pc, _, _, ok := runtime.Caller(1)
+	if ok {
+		funcName = runtime.FuncForPC(pc).Name()
+	}
+	l.write("debug", funcName, fmt.Sprintf(format, args...))
+}
+
+// Timer measures the time of an operation
+type Timer struct {
+	l     *Logger
+	start time.Time
+}
+
+// StartTimer returns the timer which is started now
+func (l *Logger) StartTimer() Timer {
+	return Timer{l: l, start: time.Now()}
+}
+
+// LogElapsed writes the debug message with the elapsed time
+func (t Timer) LogElapsed(format string, args ...interface{}) {
+	if t.l.Enabled(DEBUG) {
+		msg := fmt.Sprintf(format, args...)
+		t.l.write("debug", "", fmt.Sprintf("%s; Elapsed time: %dms", msg, int(time.Since(t.start)/time.Millisecond)))
+	}
+}
+
+func (l *Logger) write(level string, funcName string, msg string) {
+	e := &Entry{
+		Time:      time.Now(),
+		Level:     level,
+		Subsystem: l.subsystem,
+		Func:      funcName,
+		Msg:       msg,
+		Fields:    l.fields,
+	}
+	if l.Enabled(DEBUG) {
+		e.Goroutine = fmt.Sprintf("%d#%d", os.Getpid(), goroutineID())
+	}
+	_ = Write(e)
+}
+
+// Get goroutine ID
+// (https://blog.sgmansfield.com/2015/12/goroutine-ids/)
+func goroutineID() uint64 {
+	b := make([]byte, 64)
+	b = b[:runtime.Stack(b, false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		return 0
+	}
+	n, _ := strconv.ParseUint(string(b[:i]), 10, 64)
+	return n
+}
+
+// The message in JSON format
+type jsonEntry struct {
+	Time      string                 `json:"time"`
+	Level     string                 `json:"level"`
+	Subsystem string                 `json:"subsystem"`
+	Func      string                 `json:"func,omitempty"`
+	Msg       string                 `json:"msg"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Write writes the message in the configured format
+func Write(e *Entry) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	var line []byte
+	if format == FormatJSON {
+		j := jsonEntry{
+			Time:      e.Time.Format(time.RFC3339Nano),
+			Level:     e.Level,
+			Subsystem: e.Subsystem,
+			Func:      e.Func,
+			Msg:       e.Msg,
+		}
+		if len(e.Fields) != 0 {
+			j.Fields = map[string]interface{}{}
+			for _, f := range e.Fields {
+				j.Fields[f.Key] = fieldValue(f.Value)
+			}
+		}
+		data, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	} else {
+		line = []byte(formatText(e))
+	}
+	_, err := out.Write(line)
+	return err
+}
+
+// Errors are written as their text, the other values as they are
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// TIME PID#GOID [LEVEL] [SUBSYSTEM] FUNCNAME(): TEXT KEY=VALUE...
+func formatText(e *Entry) string {
+	var sb strings.Builder
+	sb.WriteString(e.Time.Format("2006/01/02 15:04:05 "))
+	if len(e.Goroutine) != 0 {
+		sb.WriteString(e.Goroutine + " ")
+	}
+	sb.WriteString("[" + e.Level + "] ")
+	if len(e.Subsystem) != 0 {
+		sb.WriteString("[" + e.Subsystem + "] ")
+	}
+	if len(e.Func) != 0 {
+		sb.WriteString(e.Func + "(): ")
+	}
+	sb.WriteString(e.Msg)
+	for _, f := range e.Fields {
+		v := fmt.Sprint(fieldValue(f.Value))
+		if strings.ContainsAny(v, " =\"") || len(v) == 0 {
+			v = strconv.Quote(v)
+		}
+		sb.WriteString(" " + f.Key + "=" + v)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
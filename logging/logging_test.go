@@ -0,0 +1,62 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Counts how many times the value is formatted
+type countingValue struct {
+	n *int
+}
+
+func (v countingValue) String() string {
+	*v.n++
+	return "value"
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	defer func() {
+		SetOutput(os.Stderr)
+		Configure(FormatText, INFO, nil)
+	}()
+
+	// the logger which is created before the configuration uses the new levels
+	l := New("test")
+	Configure(FormatText, ERROR, map[string]int{"test": INFO})
+	if !l.Enabled(INFO) || l.Enabled(DEBUG) || Level("test") != INFO || Level("unknown") != ERROR {
+		t.Fatalf("levels")
+	}
+
+	// the disabled messages aren't formatted
+	n := 0
+	l.Debug("%s", countingValue{&n})
+	l.Tracef("%s", countingValue{&n})
+	if n != 0 || buf.Len() != 0 {
+		t.Fatalf("debug: %d %q", n, buf.String())
+	}
+	l.Info("%s", countingValue{&n})
+	if n != 1 || !strings.HasSuffix(buf.String(), " [info] [test] value\n") {
+		t.Fatalf("info: %d %q", n, buf.String())
+	}
+
+	// the fields
+	buf.Reset()
+	l.With("client", "1.2.3.4").With("err", errors.New("no route")).Error("failed")
+	if !strings.HasSuffix(buf.String(), ` [error] [test] failed client=1.2.3.4 err="no route"`+"\n") {
+		t.Fatalf("text: %q", buf.String())
+	}
+
+	buf.Reset()
+	Configure(FormatJSON, DEBUG, nil)
+	l.With("client", "1.2.3.4").Tracef("trace")
+	s := buf.String()
+	if !strings.Contains(s, `"level":"debug","subsystem":"test","func":"github.com/AdguardTeam/AdGuardHome/logging.TestLogger","msg":"trace","fields":{"client":"1.2.3.4"}}`) {
+		t.Fatalf("json: %s", s)
+	}
+}
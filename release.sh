@@ -44,6 +44,16 @@ CHANNEL=$channel GOOS=windows GOARCH=386 f
 CHANNEL=$channel GOOS=linux GOARCH=mipsle GOMIPS=softfloat f
 CHANNEL=$channel GOOS=linux GOARCH=mips GOMIPS=softfloat f
 
+# Sign the packages for the self-update (the public key is built into the binary)
+# The signed data is "AdGuardHome VERSION\n" followed by the package
+if [[ -n "$UPDATE_SIGNING_KEY" ]]; then
+	for pkg in $dst/*.zip $dst/*.tar.gz; do
+		{ printf 'AdGuardHome %s\n' "$version"; cat "$pkg"; } > "$pkg.signed"
+		openssl pkeyutl -sign -inkey "$UPDATE_SIGNING_KEY" -rawin -in "$pkg.signed" | base64 -w0 > "$pkg.sig"
+		rm "$pkg.signed"
+	done
+fi
+
 # Variables for CI
 echo "version=$version" > $dst/version.txt
 
@@ -0,0 +1,74 @@
+package testmode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// FilterSource serves the filter lists from memory
+// It's used as the Transport of an HTTP client
+type FilterSource struct {
+	lock     sync.Mutex
+	files    map[string][]byte
+	requests map[string]int
+}
+
+// NewFilterSource creates a new in-memory filter lists source
+func NewFilterSource() *FilterSource {
+	return &FilterSource{
+		files:    map[string][]byte{},
+		requests: map[string]int{},
+	}
+}
+
+// Set sets the contents of the filter list at the URL
+func (s *FilterSource) Set(url string, data string) {
+	s.lock.Lock()
+	s.files[url] = []byte(data)
+	s.lock.Unlock()
+}
+
+// Remove removes the filter list, the following requests to the URL will fail with 404
+func (s *FilterSource) Remove(url string) {
+	s.lock.Lock()
+	delete(s.files, url)
+	s.lock.Unlock()
+}
+
+// Requests returns the number of the requests to the URL
+func (s *FilterSource) Requests(url string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[url]
+}
+
+// RoundTrip serves the request
+func (s *FilterSource) RoundTrip(r *http.Request) (*http.Response, error) {
+	url := r.URL.String()
+	s.lock.Lock()
+	s.requests[url]++
+	data, ok := s.files[url]
+	s.lock.Unlock()
+
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    r,
+	}
+	if !ok {
+		resp.Status = "404 Not Found"
+		resp.StatusCode = http.StatusNotFound
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		return resp, nil
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.ContentLength = int64(len(data))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
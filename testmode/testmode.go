@@ -0,0 +1,10 @@
+// Package testmode provides the in-memory replacements of the network services for the integration tests:
+// the DNS upstream servers and the filter lists source.
+// Together with a fake clock (see package clock) they allow testing the time-dependent logic
+// deterministically and without the network access.
+//
+// The hooks:
+// . clock.Set() replaces the clock
+// . dnsforward.ServerConfig.Upstreams accepts Upstream
+// . the filtering subsystem (home.newFiltering) accepts an HTTP client with FilterSource as its Transport
+package testmode
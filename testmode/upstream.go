@@ -0,0 +1,126 @@
+package testmode
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is the in-memory DNS upstream server
+// It answers with the records set by SetAnswer or the responses set by SetResponse,
+// and with NXDOMAIN for the other requests
+// OPT record of the request is sent back in the response, as EDNS Client Subnet-aware servers do
+type Upstream struct {
+	lock        sync.Mutex
+	answers     map[string][]dns.RR
+	responses   map[string]*dns.Msg
+	err         error
+	requests    int
+	lastRequest *dns.Msg
+}
+
+// NewUpstream creates a new in-memory upstream server
+func NewUpstream() *Upstream {
+	return &Upstream{answers: map[string][]dns.RR{}, responses: map[string]*dns.Msg{}}
+}
+
+func answerKey(host string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(host)) + " " + dns.TypeToString[qtype]
+}
+
+// SetAnswer sets the records the server answers for the host and the type
+// No records remove the answer
+func (u *Upstream) SetAnswer(host string, qtype uint16, rrs ...dns.RR) {
+	u.lock.Lock()
+	if len(rrs) == 0 {
+		delete(u.answers, answerKey(host, qtype))
+	} else {
+		u.answers[answerKey(host, qtype)] = rrs
+	}
+	u.lock.Unlock()
+}
+
+// SetResponse sets the whole response for the host and the type, e.g. with the authority section
+// nil removes the response
+func (u *Upstream) SetResponse(host string, qtype uint16, resp *dns.Msg) {
+	u.lock.Lock()
+	if resp == nil {
+		delete(u.responses, answerKey(host, qtype))
+	} else {
+		u.responses[answerKey(host, qtype)] = resp.Copy()
+	}
+	u.lock.Unlock()
+}
+
+// SetError makes the server fail all requests with the error, nil restores the normal operation
+func (u *Upstream) SetError(err error) {
+	u.lock.Lock()
+	u.err = err
+	u.lock.Unlock()
+}
+
+// Requests returns the number of the requests the server has received
+func (u *Upstream) Requests() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.requests
+}
+
+// LastRequest returns the last request the server has received, or nil if there was none
+func (u *Upstream) LastRequest() *dns.Msg {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.lastRequest == nil {
+		return nil
+	}
+	return u.lastRequest.Copy()
+}
+
+// Exchange answers the request
+func (u *Upstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.requests++
+	u.lastRequest = m.Copy()
+	if u.err != nil {
+		return nil, u.err
+	}
+	resp, err := u.answer(m)
+	if err == nil {
+		if opt := m.IsEdns0(); opt != nil && resp.IsEdns0() == nil {
+			resp.Extra = append(resp.Extra, dns.Copy(opt))
+		}
+	}
+	return resp, err
+}
+
+func (u *Upstream) answer(m *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	if len(m.Question) != 1 {
+		resp.Rcode = dns.RcodeFormatError
+		return resp, nil
+	}
+	q := m.Question[0]
+	if r, ok := u.responses[answerKey(q.Name, q.Qtype)]; ok {
+		resp = r.Copy()
+		resp.Id = m.Id
+		resp.Question = m.Question
+		return resp, nil
+	}
+	rrs, ok := u.answers[answerKey(q.Name, q.Qtype)]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+		return resp, nil
+	}
+	for _, rr := range rrs {
+		resp.Answer = append(resp.Answer, dns.Copy(rr))
+	}
+	return resp, nil
+}
+
+// Address returns the address of the server
+func (u *Upstream) Address() string {
+	return "memory://upstream"
+}